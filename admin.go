@@ -0,0 +1,141 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	hnWWWAuthenticate = "WWW-Authenticate"
+
+	// pprof URL endpoints
+	debugPathPrefix = "/debug/pprof/"
+)
+
+// adminListenerEnabled returns true when the administrative endpoints are served on their own listener
+func (c *Config) adminListenerEnabled() bool {
+	return c.Admin.ListenPort > 0
+}
+
+// adminCredentialsEnabled returns true when the administrative endpoints require HTTP Basic Authentication
+func (c *Config) adminCredentialsEnabled() bool {
+	return c.Admin.Username != "" || c.Admin.Password != ""
+}
+
+// registerStatusRoutes registers the read-only routes reporting the health and version of Trickster, which are safe
+// to serve to any client
+func (t *TricksterHandler) registerStatusRoutes(router *mux.Router) {
+	router.HandleFunc(adminPathPrefix+"version", t.versionHandler).Methods("GET").Name(rnVersion)
+	router.HandleFunc("/ping", t.pingHandler).Methods("GET").Name(rnPing)
+}
+
+// registerAdminRoutes registers Trickster's administrative (non-proxy) routes on the provided router, which change
+// or expose the cache and must only be served behind the admin listener or credentials
+func (t *TricksterHandler) registerAdminRoutes(router *mux.Router) {
+	router.HandleFunc(adminPathPrefix+"explain", t.explainHandler).Methods("GET").Name(rnExplain)
+	router.HandleFunc(adminPathPrefix+"routes", t.routesHandler).Methods("GET").Name(rnRoutes)
+	router.HandleFunc(adminPathPrefix+"bypass", t.bypassHandler).Methods("GET").Name(rnBypass)
+	router.HandleFunc(adminPathPrefix+"bypass/{state}", t.bypassHandler).Methods("PUT", "POST").Name(rnBypass)
+	router.HandleFunc(adminPathPrefix+"prime", t.primeHandler).Methods("PUT", "POST").Name(rnPrime)
+	router.HandleFunc(adminPathPrefix+"purge", t.purgeHandler).Methods("PUT", "POST").Name(rnPurge)
+	router.HandleFunc(adminPathPrefix+"handoff", t.handoffHandler).Methods("PUT", "POST").Name(rnHandoff)
+	router.HandleFunc(adminPathPrefix+"clients", t.clientsHandler).Methods("GET").Name(rnClients)
+	router.HandleFunc(adminPathPrefix+"stats", t.statsHandler).Methods("GET").Name(rnStats)
+	router.HandleFunc(adminPathPrefix+"events", t.eventsHandler).Methods("GET").Name(rnEvents)
+	router.HandleFunc(adminPathPrefix+"invalidate", t.invalidateHandler).Methods("PUT", "POST").Name(rnInvalidate)
+	router.HandleFunc(adminPathPrefix+"extents", t.extentsHandler).Methods("GET").Name(rnExtents)
+	router.HandleFunc(adminPathPrefix+"snapshots", t.snapshotsHandler).Methods("PUT", "POST").Name(rnSnapshots)
+}
+
+// versionInfo describes the running Trickster build and instance
+type versionInfo struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	GoVersion  string `json:"goVersion"`
+	InstanceID int    `json:"instanceId"`
+}
+
+// versionHandler handles calls to /trickster/version, which reports the build and instance information as JSON
+func (t *TricksterHandler) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(versionInfo{
+		Name:       applicationName,
+		Version:    applicationVersion,
+		Commit:     applicationCommit,
+		GoVersion:  runtime.Version(),
+		InstanceID: t.Config.Main.InstanceID,
+	})
+}
+
+// newAdminRouter returns a router for the dedicated admin listener, with the administrative routes,
+// and the profiler when enabled, registered behind the configured authentication
+func (t *TricksterHandler) newAdminRouter() *mux.Router {
+	router := mux.NewRouter()
+	t.registerStatusRoutes(router)
+	t.registerAdminRoutes(router)
+	if t.Config.Profiler.Enabled {
+		// net/http/pprof registers its handlers on the DefaultServeMux
+		router.PathPrefix(debugPathPrefix).Handler(http.DefaultServeMux)
+	}
+	router.Use(t.withRecovery, t.withAdminAuth)
+	return router
+}
+
+// withAdminAuth wraps the handler with HTTP Basic Authentication when admin credentials are configured
+func (t *TricksterHandler) withAdminAuth(next http.Handler) http.Handler {
+	username := t.Config.Admin.Username
+	password := t.Config.Admin.Password
+	if username == "" && password == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set(hnWWWAuthenticate, `Basic realm="`+applicationName+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenAndServeAdmin starts the dedicated admin listener
+func (t *TricksterHandler) listenAndServeAdmin() {
+	c := t.Config.Admin
+	level.Info(t.Logger).Log("event", "admin http endpoint starting", "address", c.ListenAddress, "port", c.ListenPort)
+
+	router := t.newAdminRouter()
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%d", c.ListenAddress, c.ListenPort), Handler: router}
+	var err error
+	if c.TLS.Enabled {
+		if srv.TLSConfig, err = t.serverTLSConfig("admin", c.TLS); err == nil {
+			err = srv.ListenAndServeTLS("", "")
+		}
+	} else {
+		err = srv.ListenAndServe()
+	}
+	level.Error(t.Logger).Log("event", "admin http endpoint exiting", "detail", err)
+}
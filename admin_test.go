@@ -0,0 +1,141 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTricksterHandler_newAdminRouter(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.Config.Admin.ListenPort = 9091
+	tr.Config.Admin.Username = "admin"
+	tr.Config.Admin.Password = "secret"
+
+	router := tr.newAdminRouter()
+
+	// it should refuse requests without credentials
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster/ping", nil))
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("wanted %d got %d.", http.StatusUnauthorized, w.Result().StatusCode)
+	}
+	if w.Result().Header.Get(hnWWWAuthenticate) == "" {
+		t.Errorf("expected a %s header", hnWWWAuthenticate)
+	}
+
+	// it should refuse requests with the wrong credentials
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://trickster/ping", nil)
+	r.SetBasicAuth("admin", "wrong")
+	router.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("wanted %d got %d.", http.StatusUnauthorized, w.Result().StatusCode)
+	}
+
+	// it should serve requests with the right credentials
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "http://trickster/ping", nil)
+	r.SetBasicAuth("admin", "secret")
+	router.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Result().StatusCode)
+	}
+}
+
+func TestTricksterHandler_newRouter_adminListener(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// it should serve the status routes on the main listener by default
+	router := tr.newRouter()
+	var match mux.RouteMatch
+	if !router.Match(httptest.NewRequest("GET", "http://trickster/ping", nil), &match) || match.Route.GetName() != rnPing {
+		t.Errorf("expected the %s route on the main router", rnPing)
+	}
+
+	// it should not serve the other admin routes on the main listener without admin credentials
+	match = mux.RouteMatch{}
+	if router.Match(httptest.NewRequest("POST", "http://trickster/trickster/purge", nil), &match) && match.Route.GetName() == rnPurge {
+		t.Errorf("did not expect the %s route on the main router", rnPurge)
+	}
+
+	// it should serve them on the main listener behind the admin credentials
+	tr.Config.Admin.Username = "admin"
+	tr.Config.Admin.Password = "secret"
+	router = tr.newRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster/trickster/bypass", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wanted %d got %d.", http.StatusUnauthorized, w.Code)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://trickster/trickster/bypass", nil)
+	r.SetBasicAuth("admin", "secret")
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster/ping", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Code)
+	}
+
+	// it should not serve the admin routes on the main listener when the admin listener is enabled
+	tr.Config.Admin.ListenPort = 9091
+	router = tr.newRouter()
+	match = mux.RouteMatch{}
+	if router.Match(httptest.NewRequest("GET", "http://trickster/ping", nil), &match) && match.Route.GetName() == rnPing {
+		t.Errorf("did not expect the %s route on the main router", rnPing)
+	}
+}
+
+func TestConfig_validate_admin(t *testing.T) {
+	c := NewConfig()
+	c.Admin.Username = "admin"
+	if err := c.validate(); err == nil {
+		t.Errorf("expected an error for a username without a password")
+	}
+	c.Admin.Password = "secret"
+	if err := c.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTricksterHandler_versionHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.Config.Main.InstanceID = 3
+
+	w := httptest.NewRecorder()
+	tr.versionHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/version", nil))
+
+	v := versionInfo{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != applicationVersion {
+		t.Errorf("wanted %s got %s.", applicationVersion, v.Version)
+	}
+	if v.InstanceID != 3 {
+		t.Errorf("wanted %d got %d.", 3, v.InstanceID)
+	}
+}
@@ -0,0 +1,270 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// API shims, which translate the requests of an older API to the API of the origin, and its responses back
+	asPrometheusLegacy = "prometheus_legacy"
+
+	// legacyAPIPath is the path of the legacy Prometheus API, which predates /api/v1
+	legacyAPIPath = "/api/"
+
+	// Legacy Prometheus API method names
+	lmQuery      = "query"
+	lmQueryRange = "query_range"
+	lmMetrics    = "metrics"
+
+	// Legacy Prometheus API url parameters
+	lpExpr      = "expr"
+	lpTimestamp = "timestamp"
+	lpEnd       = "end"
+	lpRange     = "range"
+	lpStep      = "step"
+
+	// Legacy Prometheus API response types
+	ltError = "error"
+
+	// legacyAPIVersion is the version reported by legacy Prometheus API responses
+	legacyAPIVersion = 1
+
+	// legacyDefaultPoints is the number of points that a legacy range query without a step is resolved to
+	legacyDefaultPoints = 250
+
+	hnAcceptEncoding = "Accept-Encoding"
+)
+
+// apiShims are the known API shims
+var apiShims = map[string]bool{asPrometheusLegacy: true}
+
+// legacyResponse is a response of the legacy Prometheus API
+type legacyResponse struct {
+	Type    string      `json:"type"`
+	Value   interface{} `json:"value"`
+	Version int         `json:"version"`
+}
+
+// legacySample is a sample of an instant vector in a legacy Prometheus API response
+type legacySample struct {
+	Metric    model.Metric      `json:"metric"`
+	Value     model.SampleValue `json:"value"`
+	Timestamp model.Time        `json:"timestamp"`
+}
+
+// apiResponse is a response of the current Prometheus API, whose data is decoded by its type
+type apiResponse struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  string          `json:"error"`
+}
+
+// apiQueryData is the data of a query response of the current Prometheus API
+type apiQueryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// validateAPIShim returns an error if the origin's API shim is unknown
+func (o PrometheusOriginConfig) validateAPIShim() error {
+	if o.APIShim != "" && !apiShims[o.APIShim] {
+		return fmt.Errorf("unknown api_shim %q", o.APIShim)
+	}
+	return nil
+}
+
+// legacyAPIEnabled returns true if any origin translates the legacy Prometheus API
+func (c *Config) legacyAPIEnabled() bool {
+	for _, o := range c.Origins {
+		if o.APIShim == asPrometheusLegacy {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyAPIHandler returns the handler of the legacy Prometheus API method, which translates requests to the current
+// API, serves them as it would (from the cache, for range queries), and translates the responses back. The requests
+// of origins without the prometheus_legacy shim are proxied as they are.
+func (t *TricksterHandler) legacyAPIHandler(method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t.getOrigin(r).APIShim != asPrometheusLegacy {
+			t.promFullProxyHandler(w, r)
+			return
+		}
+
+		req, handler, err := t.translateLegacyRequest(method, r)
+		if err != nil {
+			writeLegacyResponse(w, http.StatusBadRequest, legacyResponse{Type: ltError, Value: err.Error()})
+			return
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		code, body := translateAPIResponse(method, rec.Code, rec.Body.Bytes())
+		for k, v := range rec.Header() {
+			if k != hnContentLength {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(code)
+		w.Write(body)
+	}
+}
+
+// translateLegacyRequest returns the request of the current Prometheus API that fulfills the legacy API request, and
+// the handler that serves it
+func (t *TricksterHandler) translateLegacyRequest(method string, r *http.Request) (*http.Request, http.HandlerFunc, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, err
+	}
+	params := r.Form
+	// the origin moniker, if any, is kept ahead of the translated path
+	prefix := strings.TrimSuffix(r.URL.Path, legacyAPIPath+method)
+
+	translated := url.Values{}
+	var path string
+	var handler http.HandlerFunc
+	switch method {
+	case lmMetrics:
+		path, handler = prefix+prometheusAPIv1Path+mnLabels, t.promFullProxyHandler
+	case lmQuery:
+		if params.Get(lpExpr) == "" {
+			return nil, nil, fmt.Errorf("missing expr parameter")
+		}
+		translated.Set(upQuery, params.Get(lpExpr))
+		if ts := params.Get(lpTimestamp); ts != "" {
+			translated.Set(upTime, ts)
+		}
+		path, handler = prefix+prometheusAPIv1Path+mnQuery, t.promQueryHandler
+	case lmQueryRange:
+		if params.Get(lpExpr) == "" {
+			return nil, nil, fmt.Errorf("missing expr parameter")
+		}
+		rng, err := parseDuration(params.Get(lpRange))
+		if err != nil || rng <= 0 {
+			return nil, nil, fmt.Errorf("invalid range parameter")
+		}
+		end := time.Now()
+		if e := params.Get(lpEnd); e != "" {
+			if end, err = parseTime(e); err != nil {
+				return nil, nil, fmt.Errorf("invalid end parameter")
+			}
+		}
+		step := rng / legacyDefaultPoints
+		if s := params.Get(lpStep); s != "" {
+			if step, err = parseDuration(s); err != nil || step <= 0 {
+				return nil, nil, fmt.Errorf("invalid step parameter")
+			}
+		}
+		if step < time.Second {
+			step = time.Second
+		}
+		translated.Set(upQuery, params.Get(lpExpr))
+		translated.Set(upStart, strconv.FormatInt(end.Add(-rng).Unix(), 10))
+		translated.Set(upEnd, strconv.FormatInt(end.Unix(), 10))
+		translated.Set(upStep, strconv.FormatInt(int64(step/time.Second), 10))
+		path, handler = prefix+prometheusAPIv1Path+mnQueryRange, t.promQueryRangeHandler
+	default:
+		return nil, nil, fmt.Errorf("unknown legacy api method %q", method)
+	}
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.URL.Path = path
+	req.URL.RawQuery = translated.Encode()
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = http.NoBody
+	req.Form, req.PostForm = nil, nil
+	// the response is decoded to be translated
+	req.Header.Del(hnAcceptEncoding)
+	return req, handler, nil
+}
+
+// translateAPIResponse translates the response to a request of the current Prometheus API to the response of the
+// legacy API method. Responses that are not from the Prometheus API are returned as they are.
+func translateAPIResponse(method string, code int, body []byte) (int, []byte) {
+	var ar apiResponse
+	if err := json.Unmarshal(body, &ar); err != nil || ar.Status == "" {
+		return code, body
+	}
+	if ar.Status != rvSuccess {
+		return code, legacyResponseBody(legacyResponse{Type: ltError, Value: ar.Error})
+	}
+
+	// the legacy metrics method responds with the bare list of metric names
+	if method == lmMetrics {
+		return code, ar.Data
+	}
+
+	var data apiQueryData
+	if err := json.Unmarshal(ar.Data, &data); err != nil {
+		return code, body
+	}
+	lr := legacyResponse{Type: data.ResultType}
+	var err error
+	switch data.ResultType {
+	case rvMatrix:
+		var m model.Matrix
+		err = json.Unmarshal(data.Result, &m)
+		lr.Value = m
+	case rvVector:
+		var v model.Vector
+		err = json.Unmarshal(data.Result, &v)
+		samples := make([]legacySample, 0, len(v))
+		for _, s := range v {
+			samples = append(samples, legacySample{Metric: s.Metric, Value: s.Value, Timestamp: s.Timestamp})
+		}
+		lr.Value = samples
+	case rvScalar:
+		var s model.Scalar
+		err = json.Unmarshal(data.Result, &s)
+		lr.Value = s.Value
+	case rvString:
+		var s model.String
+		err = json.Unmarshal(data.Result, &s)
+		lr.Value = s.Value
+	default:
+		return code, body
+	}
+	if err != nil {
+		return code, body
+	}
+	return code, legacyResponseBody(lr)
+}
+
+// legacyResponseBody returns the legacy Prometheus API response as JSON
+func legacyResponseBody(lr legacyResponse) []byte {
+	lr.Version = legacyAPIVersion
+	b, _ := json.Marshal(lr)
+	return b
+}
+
+// writeLegacyResponse writes the legacy Prometheus API response with the status code
+func writeLegacyResponse(w http.ResponseWriter, code int, lr legacyResponse) {
+	w.Header().Set(hnContentType, hvApplicationJSON)
+	w.WriteHeader(code)
+	w.Write(legacyResponseBody(lr))
+}
@@ -0,0 +1,140 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestPrometheusOriginConfig_validateAPIShim(t *testing.T) {
+	tests := []struct {
+		shim  string
+		valid bool
+	}{
+		{"", true},
+		{asPrometheusLegacy, true},
+		{"influxdb_1", false},
+	}
+	for i, test := range tests {
+		if err := (PrometheusOriginConfig{APIShim: test.shim}).validateAPIShim(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTranslateAPIResponse(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		want   string
+	}{
+		{lmQueryRange, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[60,"1"]]}]}}`,
+			`{"type":"matrix","value":[{"metric":{"__name__":"up"},"values":[[60,"1"]]}],"version":1}`},
+		{lmQuery, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[60.5,"1"]}]}}`,
+			`{"type":"vector","value":[{"metric":{"__name__":"up"},"value":"1","timestamp":60.5}],"version":1}`},
+		{lmQuery, `{"status":"success","data":{"resultType":"scalar","result":[60,"2"]}}`,
+			`{"type":"scalar","value":"2","version":1}`},
+		{lmQuery, `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			`{"type":"error","value":"parse error","version":1}`},
+		{lmMetrics, `{"status":"success","data":["up","node_load1"]}`, `["up","node_load1"]`},
+		// responses that are not from the Prometheus API are not translated
+		{lmQuery, `not found`, `not found`},
+	}
+	for i, test := range tests {
+		if _, body := translateAPIResponse(test.method, http.StatusOK, []byte(test.body)); string(body) != test.want {
+			t.Errorf("test %d: unexpected result %s", i, body)
+		}
+	}
+}
+
+func TestTricksterHandler_legacyAPIHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var paths []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case prometheusAPIv1Path + mnQueryRange:
+			start, _ := parseTime(r.FormValue(upStart))
+			end, _ := parseTime(r.FormValue(upEnd))
+			ss := &model.SampleStream{Metric: model.Metric{"__name__": "up"}}
+			for ts := start.Unix(); ts <= end.Unix(); ts += 60 {
+				ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: 1})
+			}
+			json.NewEncoder(w).Encode(PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{ss}}})
+		case prometheusAPIv1Path + mnQuery:
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[` +
+				r.FormValue(upTime) + `,"1"]}]}}`))
+		default:
+			w.Write([]byte(`{"type":"vector","value":[],"version":1}`))
+		}
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.APIShim = asPrometheusLegacy
+	tr.Config.Origins["default"] = o
+	tr.Config.Origins["legacy"] = PrometheusOriginConfig{OriginURL: es.URL}
+	router := tr.newRouter()
+
+	get := func(path string) (int, legacyResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster"+path, nil))
+		var lr legacyResponse
+		json.Unmarshal(w.Body.Bytes(), &lr)
+		return w.Code, lr
+	}
+
+	// it should translate a legacy range query, and serve it from the cache
+	end := time.Now().Unix() - 600
+	end -= end % 60
+	path := fmt.Sprintf("/api/query_range?expr=up&range=600&end=%d&step=60", end)
+	code, lr := get(path)
+	if code != http.StatusOK || lr.Type != rvMatrix || lr.Version != legacyAPIVersion {
+		t.Fatalf("unexpected result %d %v", code, lr)
+	}
+	if values := lr.Value.([]interface{})[0].(map[string]interface{})["values"].([]interface{}); len(values) != 11 {
+		t.Errorf("wanted %d got %d.", 11, len(values))
+	}
+	get(path)
+	if len(paths) != 1 || paths[0] != prometheusAPIv1Path+mnQueryRange {
+		t.Errorf("unexpected upstream requests %v", paths)
+	}
+
+	// it should translate a legacy instant query
+	code, lr = get("/api/query?expr=up&timestamp=60")
+	if sample := lr.Value.([]interface{})[0].(map[string]interface{}); code != http.StatusOK || lr.Type != rvVector ||
+		sample["value"] != "1" || sample["timestamp"] != float64(60) {
+		t.Errorf("unexpected result %d %v", code, lr)
+	}
+
+	// it should answer invalid legacy requests with a legacy error
+	if code, lr = get("/api/query_range?expr=up"); code != http.StatusBadRequest || lr.Type != ltError {
+		t.Errorf("unexpected result %d %v", code, lr)
+	}
+
+	// it should proxy the legacy requests of origins without the shim as they are
+	n := len(paths)
+	if code, _ = get("/legacy/api/query?expr=up"); code != http.StatusOK || len(paths) != n+1 || paths[n] != legacyAPIPath+lmQuery {
+		t.Errorf("unexpected upstream requests %v", paths[n:])
+	}
+}
@@ -0,0 +1,100 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	defaultAsyncWriteWorkers   = 4
+	defaultAsyncWriteQueueSize = 1000
+)
+
+// cacheWrite is a Store call queued by an AsyncCache
+type cacheWrite struct {
+	key  string
+	data string
+	ttl  int64
+}
+
+// AsyncCache wraps a Cache so that Store returns immediately, queuing the write for a pool of background
+// workers, and cache backend latency never delays the client response. Writes are dropped when the queue is full.
+type AsyncCache struct {
+	Cache
+	T     *TricksterHandler
+	queue chan cacheWrite
+	wg    sync.WaitGroup
+}
+
+// NewAsyncCache returns an AsyncCache writing to the provided Cache with the configured number of workers and queue size
+func NewAsyncCache(t *TricksterHandler, c Cache) *AsyncCache {
+	workers := t.Config.Caching.AsyncWriteWorkers
+	if workers <= 0 {
+		workers = defaultAsyncWriteWorkers
+	}
+	size := t.Config.Caching.AsyncWriteQueueSize
+	if size <= 0 {
+		size = defaultAsyncWriteQueueSize
+	}
+
+	a := &AsyncCache{Cache: c, T: t, queue: make(chan cacheWrite, size)}
+	a.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go a.work()
+	}
+	return a
+}
+
+// Store queues an object to be placed in the cache, returning an error if the queue is full
+func (a *AsyncCache) Store(cacheKey string, data string, ttl int64) error {
+	select {
+	case a.queue <- cacheWrite{key: cacheKey, data: data, ttl: ttl}:
+		a.updateQueueLength()
+		return nil
+	default:
+		level.Warn(a.T.Logger).Log(lfEvent, "cache write queue full, dropping write", lfCacheKey, cacheKey)
+		if a.T.Metrics != nil {
+			a.T.Metrics.CacheWritesDropped.Inc()
+		}
+		return fmt.Errorf("cache write queue full, dropped write for key [%s]", cacheKey)
+	}
+}
+
+// work writes queued objects to the cache until the queue is closed
+func (a *AsyncCache) work() {
+	defer a.wg.Done()
+	for w := range a.queue {
+		a.updateQueueLength()
+		if err := a.Cache.Store(w.key, w.data, w.ttl); err != nil {
+			level.Error(a.T.Logger).Log(lfEvent, "background cache write failed", lfCacheKey, w.key, lfDetail, err.Error())
+		}
+	}
+}
+
+func (a *AsyncCache) updateQueueLength() {
+	if a.T.Metrics != nil {
+		a.T.Metrics.CacheWriteQueueLength.Set(float64(len(a.queue)))
+	}
+}
+
+// Close waits for the queued writes to complete, then closes the underlying Cache
+func (a *AsyncCache) Close() error {
+	close(a.queue)
+	a.wg.Wait()
+	return a.Cache.Close()
+}
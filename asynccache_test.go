@@ -0,0 +1,85 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingCache is a Cache whose Store waits until it is released
+type blockingCache struct {
+	MemoryCache
+	release chan struct{}
+}
+
+func (c *blockingCache) Store(cacheKey string, data string, ttl int64) error {
+	<-c.release
+	return c.MemoryCache.Store(cacheKey, data, ttl)
+}
+
+func TestAsyncCache_Store(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.Connect()
+
+	a := NewAsyncCache(mc.T, &mc)
+
+	// it should store the object in the background
+	if err := a.Store("cacheKey", "data", 60000); err != nil {
+		t.Error(err)
+	}
+
+	// it should complete queued writes when closed
+	a.Close()
+
+	data, err := mc.Retrieve("cacheKey")
+	if err != nil {
+		t.Error(err)
+	}
+	if data != "data" {
+		t.Errorf("wanted %q got %q.", "data", data)
+	}
+}
+
+func TestAsyncCache_Overflow(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.Connect()
+	mc.T.Metrics = newApplicationMetrics(mc.T.Config, prometheus.NewRegistry())
+	mc.T.Config.Caching.AsyncWriteWorkers = 1
+	mc.T.Config.Caching.AsyncWriteQueueSize = 1
+
+	bc := &blockingCache{MemoryCache: mc, release: make(chan struct{})}
+	a := NewAsyncCache(mc.T, bc)
+
+	// the first write occupies the worker, and the second fills the queue
+	a.Store("key1", "data", 60000)
+	for len(a.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	a.Store("key2", "data", 60000)
+
+	// it should drop writes when the queue is full
+	if err := a.Store("key3", "data", 60000); err == nil {
+		t.Errorf("expected error for full queue")
+	}
+	if v := testutil.ToFloat64(mc.T.Metrics.CacheWritesDropped); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+
+	close(bc.release)
+	a.Close()
+}
@@ -0,0 +1,413 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// Bench subcommand
+	ccBench = "bench"
+
+	benchCommandUsage = `usage: trickster bench -url <trickster url> [options]
+
+Replays recorded queries, or synthesizes Prometheus range queries, against a running Trickster
+and reports the cache hit ratio, latency percentiles and upstream calls.
+
+options:`
+
+	// Trickster metrics read by the bench subcommand
+	bmRequests          = "trickster_requests_total"
+	bmOriginConnections = "trickster_origin_connections_total"
+)
+
+// benchOptions configures a run of the bench subcommand
+type benchOptions struct {
+	// URL is the base URL of the Trickster instance under test
+	URL string
+	// MetricsURL is the URL of the instance's metrics, read before and after the run for its cache results and
+	// upstream calls
+	MetricsURL string
+	// QueriesFile lists the request paths to replay, one per line, e.g. /api/v1/query_range?query=up&start=...
+	QueriesFile string
+	// Synth lists the expressions of the range queries synthesized when there is no QueriesFile
+	Synth string
+	// Range and Step shape the synthesized range queries, which end at the time of each request
+	Range time.Duration
+	Step  time.Duration
+	// Rebase moves the window of each replayed range query to end at the time of the request
+	Rebase      bool
+	Concurrency int
+	// Requests is the number of requests made, unless Duration is reached first. 0 runs for Duration
+	Requests int
+	Duration time.Duration
+	Timeout  time.Duration
+}
+
+// parseBenchOptions parses the arguments of the bench subcommand
+func parseBenchOptions(args []string, output io.Writer) (benchOptions, error) {
+	var o benchOptions
+	f := flag.NewFlagSet(ccBench, flag.ContinueOnError)
+	f.SetOutput(output)
+	f.Usage = func() {
+		fmt.Fprintln(output, benchCommandUsage)
+		f.PrintDefaults()
+	}
+	f.StringVar(&o.URL, "url", "", "Base URL of the Trickster instance, e.g. http://trickster:9090")
+	f.StringVar(&o.MetricsURL, "metrics-url", "", "URL of the instance's metrics, e.g. http://trickster:8082/metrics, to report its cache results and upstream calls")
+	f.StringVar(&o.QueriesFile, "queries", "", "File of request paths to replay, one per line")
+	f.StringVar(&o.Synth, "synth", "up", "Comma-separated expressions of the range queries synthesized when there is no -queries file")
+	f.DurationVar(&o.Range, "range", time.Hour, "Time range of the synthesized range queries")
+	f.DurationVar(&o.Step, "step", 15*time.Second, "Step of the synthesized range queries")
+	f.BoolVar(&o.Rebase, "rebase", false, "Move the window of each replayed range query to end at the time of the request")
+	f.IntVar(&o.Concurrency, "concurrency", 4, "Number of requests made at once")
+	f.IntVar(&o.Requests, "requests", 100, "Number of requests made, unless -duration is reached first. 0 runs for -duration")
+	f.DurationVar(&o.Duration, "duration", 0, "Maximum duration of the run")
+	f.DurationVar(&o.Timeout, "timeout", 30*time.Second, "Timeout of each request")
+	if err := f.Parse(args); err != nil {
+		return o, err
+	}
+
+	if o.URL == "" {
+		f.Usage()
+		return o, fmt.Errorf("-url is required")
+	}
+	if o.Concurrency < 1 {
+		return o, fmt.Errorf("-concurrency must be at least 1")
+	}
+	if o.Requests <= 0 && o.Duration <= 0 {
+		return o, fmt.Errorf("one of -requests or -duration is required")
+	}
+	if o.Step <= 0 || o.Range < o.Step {
+		return o, fmt.Errorf("-range must be at least -step, which must be positive")
+	}
+	return o, nil
+}
+
+// benchQueries returns the request paths of the run: those of the queries file, or the synthesized range queries,
+// and whether their range windows are moved to end at the time of each request
+func (o benchOptions) benchQueries() ([]string, bool, error) {
+	if o.QueriesFile == "" {
+		var queries []string
+		for _, expr := range strings.Split(o.Synth, ",") {
+			if expr = strings.TrimSpace(expr); expr == "" {
+				continue
+			}
+			params := url.Values{upQuery: {expr}, upStart: {"0"}, upEnd: {strconv.FormatFloat(o.Range.Seconds(), 'f', -1, 64)},
+				upStep: {strconv.FormatFloat(o.Step.Seconds(), 'f', -1, 64)}}
+			queries = append(queries, prometheusAPIv1Path+mnQueryRange+"?"+params.Encode())
+		}
+		if len(queries) == 0 {
+			return nil, false, fmt.Errorf("no queries to synthesize")
+		}
+		return queries, true, nil
+	}
+
+	f, err := os.Open(o.QueriesFile)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	queries, err := readBenchQueries(f)
+	if err == nil && len(queries) == 0 {
+		err = fmt.Errorf("no queries in %s", o.QueriesFile)
+	}
+	return queries, o.Rebase, err
+}
+
+// readBenchQueries reads the request paths, one per line, skipping blank lines and # comments. Full URLs are reduced
+// to their path and query.
+func readBenchQueries(r io.Reader) ([]string, error) {
+	var queries []string
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query %q: %v", line, err)
+		}
+		queries = append(queries, u.RequestURI())
+	}
+	return queries, s.Err()
+}
+
+// rebaseRange returns the request path with the start and end of a range query moved so that the window ends now
+func rebaseRange(query string, now time.Time) string {
+	u, err := url.Parse(query)
+	if err != nil || !strings.HasSuffix(u.Path, mnQueryRange) {
+		return query
+	}
+	params := u.Query()
+	start, err := parseTime(params.Get(upStart))
+	if err != nil {
+		return query
+	}
+	end, err := parseTime(params.Get(upEnd))
+	if err != nil {
+		return query
+	}
+	params.Set(upEnd, strconv.FormatInt(now.Unix(), 10))
+	params.Set(upStart, strconv.FormatInt(now.Add(-end.Sub(start)).Unix(), 10))
+	u.RawQuery = params.Encode()
+	return u.RequestURI()
+}
+
+// benchStats are the results of a run, as seen by the client
+type benchStats struct {
+	Latencies     []time.Duration
+	Statuses      map[int]int
+	CacheStatuses map[string]int
+	Errors        int
+	Elapsed       time.Duration
+}
+
+// runBench makes the requests of the run, returning the results
+func runBench(o benchOptions, queries []string, rebase bool) benchStats {
+	client := &http.Client{Timeout: o.Timeout}
+	base := strings.TrimSuffix(o.URL, "/")
+	stats := benchStats{Statuses: map[int]int{}, CacheStatuses: map[string]int{}}
+	var mu sync.Mutex
+
+	start := time.Now()
+	next := make(chan string)
+	go func() {
+		defer close(next)
+		for i := 0; o.Requests <= 0 || i < o.Requests; i++ {
+			if o.Duration > 0 && time.Since(start) >= o.Duration {
+				return
+			}
+			next <- queries[i%len(queries)]
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range next {
+				if rebase {
+					q = rebaseRange(q, time.Now())
+				}
+				requestStart := time.Now()
+				resp, err := client.Get(base + q)
+				if err == nil {
+					_, err = io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				latency := time.Since(requestStart)
+
+				mu.Lock()
+				if err != nil {
+					stats.Errors++
+				} else {
+					stats.Latencies = append(stats.Latencies, latency)
+					stats.Statuses[resp.StatusCode]++
+					if cs := resp.Header.Get(hnDiagCacheStatus); cs != "" {
+						stats.CacheStatuses[cs]++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	stats.Elapsed = time.Since(start)
+	return stats
+}
+
+// percentile returns the latency at the percentile p (0 to 100) of the sorted latencies, by the nearest rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// benchCounters are the Trickster counters that describe a run
+type benchCounters struct {
+	// Requests counts the requests by cache result
+	Requests map[string]float64
+	// UpstreamCalls counts the requests made to the origins
+	UpstreamCalls float64
+}
+
+// scrapeBenchCounters reads the counters from the Trickster metrics at the URL
+func scrapeBenchCounters(client *http.Client, metricsURL string) (benchCounters, error) {
+	c := benchCounters{Requests: map[string]float64{}}
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("metrics returned status %d", resp.StatusCode)
+	}
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return c, err
+	}
+
+	if mf, ok := families[bmRequests]; ok {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "status" {
+					c.Requests[l.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if mf, ok := families[bmOriginConnections]; ok {
+		for _, m := range mf.GetMetric() {
+			c.UpstreamCalls += m.GetCounter().GetValue()
+		}
+	}
+	return c, nil
+}
+
+// sub returns the difference of the counters to the earlier counters
+func (c benchCounters) sub(earlier benchCounters) benchCounters {
+	d := benchCounters{Requests: map[string]float64{}, UpstreamCalls: c.UpstreamCalls - earlier.UpstreamCalls}
+	for status, n := range c.Requests {
+		if n -= earlier.Requests[status]; n > 0 {
+			d.Requests[status] = n
+		}
+	}
+	return d
+}
+
+// writeBenchReport writes the report of the run, with the cache results and upstream calls of the counters if any
+func writeBenchReport(w io.Writer, stats benchStats, counters *benchCounters) {
+	n := len(stats.Latencies)
+	rate := 0.0
+	if stats.Elapsed > 0 {
+		rate = float64(n) / stats.Elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "requests:       %d in %s (%.1f/s), %d errors\n", n, stats.Elapsed.Round(time.Millisecond), rate, stats.Errors)
+
+	codes := make([]int, 0, len(stats.Statuses))
+	for code := range stats.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%d=%d", code, stats.Statuses[code]))
+	}
+	fmt.Fprintf(w, "status codes:   %s\n", strings.Join(parts, " "))
+
+	sorted := append([]time.Duration(nil), stats.Latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	parts = parts[:0]
+	for _, p := range []float64{50, 90, 99, 100} {
+		name := fmt.Sprintf("p%g", p)
+		if p == 100 {
+			name = "max"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", name, percentile(sorted, p).Round(time.Microsecond)))
+	}
+	fmt.Fprintf(w, "latency:        %s\n", strings.Join(parts, " "))
+
+	// the instance's counters include every request, while the diagnostics headers are only sent for range queries
+	results := map[string]float64{}
+	if counters != nil {
+		results = counters.Requests
+	} else {
+		for status, n := range stats.CacheStatuses {
+			results[status] = float64(n)
+		}
+	}
+	if len(results) > 0 {
+		var total float64
+		statuses := make([]string, 0, len(results))
+		for status, n := range results {
+			statuses = append(statuses, status)
+			total += n
+		}
+		sort.Strings(statuses)
+		parts = parts[:0]
+		for _, status := range statuses {
+			parts = append(parts, fmt.Sprintf("%s=%g", status, results[status]))
+		}
+		fmt.Fprintf(w, "cache results:  %s (hit ratio %.1f%%)\n", strings.Join(parts, " "), 100*results[crHit]/total)
+	}
+	if counters != nil {
+		fmt.Fprintf(w, "upstream calls: %g\n", counters.UpstreamCalls)
+	}
+}
+
+// runBenchCommand handles "trickster bench", and returns the process exit code
+func runBenchCommand(args []string) int {
+	o, err := parseBenchOptions(args, os.Stderr)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	queries, rebase, err := o.benchQueries()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	client := &http.Client{Timeout: o.Timeout}
+	var before benchCounters
+	if o.MetricsURL != "" {
+		if before, err = scrapeBenchCounters(client, o.MetricsURL); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to read the metrics:", err.Error())
+			return 1
+		}
+	}
+
+	stats := runBench(o, queries, rebase)
+
+	var counters *benchCounters
+	if o.MetricsURL != "" {
+		after, err := scrapeBenchCounters(client, o.MetricsURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to read the metrics:", err.Error())
+			return 1
+		}
+		d := after.sub(before)
+		counters = &d
+	}
+	writeBenchReport(os.Stdout, stats, counters)
+	return 0
+}
@@ -0,0 +1,163 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestReadBenchQueries(t *testing.T) {
+	in := `# recorded from grafana
+/api/v1/query_range?query=up&start=100&end=200&step=15
+
+http://trickster:9090/api/v1/query?query=up
+`
+	queries, err := readBenchQueries(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/api/v1/query_range?query=up&start=100&end=200&step=15", "/api/v1/query?query=up"}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("unexpected queries %v", queries)
+	}
+}
+
+func TestRebaseRange(t *testing.T) {
+	now := time.Unix(10000, 0)
+	tests := []struct {
+		query, rebased string
+	}{
+		{"/api/v1/query_range?end=200&query=up&start=100&step=15", "/api/v1/query_range?end=10000&query=up&start=9900&step=15"},
+		{"/api/v1/query_range?end=1970-01-01T00:03:20Z&query=up&start=100&step=15", "/api/v1/query_range?end=10000&query=up&start=9900&step=15"},
+		{"/api/v1/query?query=up&time=100", "/api/v1/query?query=up&time=100"},
+		{"/api/v1/query_range?query=up&start=100", "/api/v1/query_range?query=up&start=100"},
+	}
+
+	for i, test := range tests {
+		if rebased := rebaseRange(test.query, now); rebased != test.rebased {
+			t.Errorf("test %d: unexpected result %v", i, rebased)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{{50, 5}, {90, 9}, {99, 10}, {100, 10}, {0, 1}}
+
+	for i, test := range tests {
+		if got := percentile(sorted, test.p); got != test.want {
+			t.Errorf("test %d: unexpected result %v", i, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("unexpected result %v", got)
+	}
+}
+
+func TestParseBenchOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-url", "http://trickster:9090"}, true},
+		{[]string{}, false},
+		{[]string{"-url", "http://trickster:9090", "-concurrency", "0"}, false},
+		{[]string{"-url", "http://trickster:9090", "-requests", "0"}, false},
+		{[]string{"-url", "http://trickster:9090", "-requests", "0", "-duration", "10s"}, true},
+		{[]string{"-url", "http://trickster:9090", "-range", "1s"}, false},
+	}
+
+	for i, test := range tests {
+		if _, err := parseBenchOptions(test.args, ioutil.Discard); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, mnQueryRange) {
+			// fast forward queries
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		start, _ := parseTime(r.FormValue(upStart))
+		end, _ := parseTime(r.FormValue(upEnd))
+		step, _ := parseDuration(r.FormValue(upStep))
+		w.Write([]byte(testPrimeBody(start.Unix(), end.Unix(), int64(step.Seconds()))))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	ts := httptest.NewServer(tr.newRouter())
+	defer ts.Close()
+	ms := httptest.NewServer(promhttp.Handler())
+	defer ms.Close()
+
+	o, err := parseBenchOptions([]string{"-url", ts.URL, "-metrics-url", ms.URL, "-requests", "5", "-concurrency", "1",
+		"-range", "1h", "-step", "60s"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, rebase, err := o.benchQueries()
+	if err != nil || !rebase || len(queries) != 1 {
+		t.Fatalf("unexpected queries %v %v %v", queries, rebase, err)
+	}
+
+	client := &http.Client{}
+	before, err := scrapeBenchCounters(client, ms.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := runBench(o, queries, rebase)
+	after, err := scrapeBenchCounters(client, ms.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters := after.sub(before)
+
+	// it should make the requests, and read the cache results and upstream calls of the run from the metrics
+	if len(stats.Latencies) != 5 || stats.Statuses[http.StatusOK] != 5 || stats.Errors != 0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	// the first request misses and the rest hit, whatever the number of times each is counted
+	total := counters.Requests[crKeyMiss] + counters.Requests[crHit] + counters.Requests[crPartialHit]
+	if counters.Requests[crKeyMiss] == 0 || total != 5*counters.Requests[crKeyMiss] {
+		t.Errorf("unexpected counters %v", counters)
+	}
+	if counters.UpstreamCalls < 1 || counters.UpstreamCalls > 5 {
+		t.Errorf("unexpected upstream calls %v", counters.UpstreamCalls)
+	}
+
+	var report bytes.Buffer
+	writeBenchReport(&report, stats, &counters)
+	for _, want := range []string{"requests:       5 in", "status codes:   200=5", "latency:        p50=", "hit ratio", "upstream calls: "} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("expected %q in report:\n%s", want, report.String())
+		}
+	}
+}
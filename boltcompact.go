@@ -0,0 +1,142 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/go-kit/kit/log/level"
+)
+
+// compactionBatchSize is the number of keys copied per write transaction during compaction
+const compactionBatchSize = 1000
+
+// compactLoop periodically compacts the database file when enough of it is free pages
+func (c *BoltDBCache) compactLoop() {
+	for {
+		time.Sleep(time.Duration(c.Config.CompactionIntervalSecs) * time.Second)
+		if !c.needsCompaction() {
+			continue
+		}
+		reclaimed, err := c.compact()
+		if err != nil {
+			level.Error(c.T.Logger).Log(lfEvent, "boltdb cache compaction failed", lfDetail, err.Error())
+			continue
+		}
+		level.Info(c.T.Logger).Log(lfEvent, "boltdb cache compacted", "cacheFile", c.Config.Filename, "reclaimedBytes", reclaimed)
+		if c.T.Metrics != nil && reclaimed > 0 {
+			c.T.Metrics.CacheCompactionReclaimedBytes.WithLabelValues(ctBoltDB).Add(float64(reclaimed))
+		}
+	}
+}
+
+// needsCompaction returns true when the database file has reached the configured minimum size and
+// the configured fraction of it is free pages. bbolt reuses free pages, but never shrinks the file.
+func (c *BoltDBCache) needsCompaction() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	fi, err := os.Stat(c.Config.Filename)
+	if err != nil || fi.Size() == 0 || fi.Size() < c.Config.CompactionMinBytes {
+		return false
+	}
+
+	stats := c.dbh.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(c.dbh.Info().PageSize)
+	return float64(free)/float64(fi.Size()) >= c.Config.CompactionMinFreeRatio
+}
+
+// compact rewrites the live records into a new database file and swaps it in place of the current one,
+// returning the number of bytes reclaimed. Cache operations wait while the file is rewritten.
+func (c *BoltDBCache) compact() (int64, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	fi, err := os.Stat(c.Config.Filename)
+	if err != nil {
+		return 0, err
+	}
+	before := fi.Size()
+
+	tmpFile := c.Config.Filename + ".compact"
+	if err := c.copyTo(tmpFile); err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+
+	if err := c.dbh.Close(); err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+	renameErr := os.Rename(tmpFile, c.Config.Filename)
+	if renameErr != nil {
+		os.Remove(tmpFile)
+	}
+
+	// reopen the database whether or not the rename succeeded, so the cache remains usable
+	c.dbh, err = bolt.Open(c.Config.Filename, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, err
+	}
+	if renameErr != nil {
+		return 0, renameErr
+	}
+
+	fi, err = os.Stat(c.Config.Filename)
+	if err != nil {
+		return 0, err
+	}
+	return before - fi.Size(), nil
+}
+
+// copyTo copies every key in the cache bucket into a new database at the provided path
+func (c *BoltDBCache) copyTo(path string) error {
+	dst, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	bucket := []byte(c.Config.Bucket)
+
+	return c.dbh.View(func(src *bolt.Tx) error {
+		cursor := src.Bucket(bucket).Cursor()
+		k, v := cursor.First()
+		for k != nil {
+			err := dst.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucketIfNotExists(bucket)
+				if err != nil {
+					return err
+				}
+				for i := 0; k != nil && i < compactionBatchSize; i++ {
+					if err := b.Put(k, v); err != nil {
+						return err
+					}
+					k, v = cursor.Next()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// make sure the bucket exists even when the cache is empty
+		return dst.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			return err
+		})
+	})
+}
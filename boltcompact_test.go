@@ -0,0 +1,98 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestBoltDBCache_Compact(t *testing.T) {
+	const filename = "/tmp/test_compact.db"
+	defer os.Remove(filename)
+
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg, ResponseChannels: make(map[string]chan *ClientRequestContext)}
+	bc := BoltDBCache{T: &tr, Config: BoltDBCacheConfig{Filename: filename, Bucket: "trickster_test", CompactionMinFreeRatio: 0.5}}
+
+	if err := bc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	value := strings.Repeat("x", 4096)
+	for i := 0; i < 500; i++ {
+		bc.Store(fmt.Sprintf("key%d", i), value, 600)
+	}
+	for i := 1; i < 500; i++ {
+		bc.Delete(fmt.Sprintf("key%d", i))
+	}
+
+	// it should want compaction once most of the file is free pages
+	if !bc.needsCompaction() {
+		t.Errorf("expected compaction to be needed")
+	}
+
+	reclaimed, err := bc.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should shrink the file
+	if reclaimed <= 0 {
+		t.Errorf("expected bytes to be reclaimed, got %d", reclaimed)
+	}
+
+	// it should keep the live records
+	data, err := bc.Retrieve("key0")
+	if err != nil {
+		t.Error(err)
+	}
+	if data != value {
+		t.Errorf("wanted %d bytes got %d.", len(value), len(data))
+	}
+
+	// it should remain writable after compaction
+	if err := bc.Store("after", "data", 600); err != nil {
+		t.Error(err)
+	}
+
+	// it should not want compaction again right away
+	if bc.needsCompaction() {
+		t.Errorf("expected compaction not to be needed")
+	}
+}
+
+func TestBoltDBCache_NeedsCompactionMinBytes(t *testing.T) {
+	const filename = "/tmp/test_compact_min.db"
+	defer os.Remove(filename)
+
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
+	bc := BoltDBCache{T: &tr, Config: BoltDBCacheConfig{Filename: filename, Bucket: "trickster_test", CompactionMinBytes: 1 << 30}}
+
+	if err := bc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	// it should not compact a file smaller than the minimum size
+	if bc.needsCompaction() {
+		t.Errorf("expected compaction not to be needed")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	bolt "github.com/coreos/bbolt"
@@ -28,6 +29,8 @@ type BoltDBCache struct {
 	T      *TricksterHandler
 	Config BoltDBCacheConfig
 	dbh    *bolt.DB
+	// mtx is held exclusively while the database file is compacted and replaced
+	mtx sync.RWMutex
 }
 
 // Connect instantiates the BoltDBCache mutex map and starts the Expired Entry Reaper goroutine
@@ -52,6 +55,9 @@ func (c *BoltDBCache) Connect() error {
 	}
 
 	go c.Reap()
+	if c.Config.CompactionIntervalSecs > 0 {
+		go c.compactLoop()
+	}
 	return nil
 }
 
@@ -61,6 +67,8 @@ func (c *BoltDBCache) Store(cacheKey string, data string, ttl int64) error {
 	expKey, dataKey := c.getKeyNames(cacheKey)
 	expiration := []byte(strconv.FormatInt(time.Now().Unix()+ttl, 10))
 
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
 	err := c.dbh.Update(func(tx *bolt.Tx) error {
 
 		b := tx.Bucket([]byte(c.Config.Bucket))
@@ -98,12 +106,14 @@ func (c *BoltDBCache) retrieve(cacheKey string) (string, error) {
 
 	content := ""
 
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
 	err := c.dbh.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(c.Config.Bucket))
 		v := b.Get([]byte(cacheKey))
 		if v == nil {
 			level.Debug(c.T.Logger).Log("event", "boltdb cache miss", "key", cacheKey)
-			return fmt.Errorf("Value for key [%s] not in cache", cacheKey)
+			return &cacheMissError{key: cacheKey}
 		}
 		content = string(v)
 		return nil
@@ -115,6 +125,16 @@ func (c *BoltDBCache) retrieve(cacheKey string) (string, error) {
 	return content, nil
 }
 
+// Expiration returns the unix time at which an object in the cache expires
+func (c *BoltDBCache) Expiration(cacheKey string) (int64, error) {
+	expKey, _ := c.getKeyNames(cacheKey)
+	content, err := c.retrieve(expKey)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(content, 10, 64)
+}
+
 // checkExpiration verifies that a cacheKey is not expired
 func (c *BoltDBCache) checkExpiration(cacheKey string) {
 
@@ -137,6 +157,8 @@ func (c *BoltDBCache) Delete(cacheKey string) error {
 
 	expKey, dataKey := c.getKeyNames(cacheKey)
 
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
 	return c.dbh.Update(func(tx *bolt.Tx) error {
 
 		b := tx.Bucket([]byte(c.Config.Bucket))
@@ -151,17 +173,6 @@ func (c *BoltDBCache) Delete(cacheKey string) error {
 			level.Error(c.T.Logger).Log("event", "boltdb cache key delete failure", "key", dataKey, "reason", err2.Error())
 		}
 
-		c.T.ChannelCreateMtx.Lock()
-
-		// Close out the channel if it exists
-		if _, ok := c.T.ResponseChannels[cacheKey]; ok {
-			close(c.T.ResponseChannels[cacheKey])
-			delete(c.T.ResponseChannels, cacheKey)
-		}
-
-		// Unlock
-		c.T.ChannelCreateMtx.Unlock()
-
 		if err1 != nil {
 			return err1
 		}
@@ -192,6 +203,7 @@ func (c *BoltDBCache) ReapOnce() {
 	expiredKeys := make([]string, 0)
 
 	// Iterate through the cache to find any expiration keys and check their value
+	c.mtx.RLock()
 	c.dbh.View(func(tx *bolt.Tx) error {
 		// Assume bucket exists and has keys
 		b := tx.Bucket([]byte(c.Config.Bucket))
@@ -214,16 +226,53 @@ func (c *BoltDBCache) ReapOnce() {
 
 		return nil
 	})
+	c.mtx.RUnlock()
 
 	// Iterate through the expired keys so we can delete them
 	for _, cacheKey := range expiredKeys {
-		c.Delete(cacheKey)
+		if c.Delete(cacheKey) == nil {
+			c.T.CacheEvents.emit(cacheEvent{Type: ceExpire, Key: cacheKey})
+		}
 	}
 
 }
 
+// Walk calls fn for each unexpired record in the cache, stopping at the first error
+func (c *BoltDBCache) Walk(fn func(CacheObject) error) error {
+	now := time.Now().Unix()
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.dbh.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(c.Config.Bucket))
+		cursor := b.Cursor()
+
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			expKey := string(k)
+			if !strings.HasSuffix(expKey, ".expiration") {
+				continue
+			}
+			expiration, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil || expiration < now {
+				continue
+			}
+			cacheKey := strings.TrimSuffix(expKey, ".expiration")
+			_, dataKey := c.getKeyNames(cacheKey)
+			data := b.Get([]byte(dataKey))
+			if data == nil {
+				continue
+			}
+			if err := fn(CacheObject{Key: cacheKey, Value: string(data), Expiration: expiration}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Close closes the BoltDBCache
 func (c *BoltDBCache) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	return c.dbh.Close()
 }
 
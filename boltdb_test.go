@@ -15,6 +15,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 )
@@ -102,3 +103,35 @@ func TestBoltDBCache_Retrieve(t *testing.T) {
 		t.Errorf("wanted \"%s\". got \"%s\".", "data", data)
 	}
 }
+
+func TestBoltDBCache_Expiration(t *testing.T) {
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
+	bc := BoltDBCache{T: &tr, Config: BoltDBCacheConfig{Filename: "/tmp/test.db", Bucket: "trickster_test"}}
+
+	err := bc.Connect()
+	if err != nil {
+		t.Error(err)
+	}
+	defer bc.Close()
+
+	// it should report a miss for an absent key
+	if _, err := bc.Expiration("expirationKey"); !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+
+	err = bc.Store("expirationKey", "data", 60)
+	if err != nil {
+		t.Error(err)
+	}
+	defer bc.Delete("expirationKey")
+
+	// it should return the expiration of a stored value
+	exp, err := bc.Expiration("expirationKey")
+	if err != nil {
+		t.Error(err)
+	}
+	if now := time.Now().Unix(); exp < now+59 || exp > now+60 {
+		t.Errorf("wanted %d got %d.", now+60, exp)
+	}
+}
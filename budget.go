@@ -0,0 +1,109 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// timeoutBudgetKey is the request context key of the deadline by which the client expects a response
+type timeoutBudgetKey struct{}
+
+// errTimeoutBudgetExceeded is returned by getURL when the client's deadline passed before the upstream request was made
+var errTimeoutBudgetExceeded = errors.New("client timeout budget exceeded")
+
+// clientDeadline returns the earliest deadline implied by the client's timeout hints that the origin is configured
+// to honor, relative to the time the request was received, or the zero time if there are none
+func (o PrometheusOriginConfig) clientDeadline(r *http.Request, received time.Time) time.Time {
+	var deadline time.Time
+	earliest := func(d time.Time) {
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	if o.UseClientTimeout {
+		if v := r.FormValue(upTimeout); v != "" {
+			if d, err := parseDuration(v); err == nil && d > 0 {
+				earliest(received.Add(d))
+			}
+		}
+	}
+
+	if o.ClientTimeoutHeader != "" {
+		if v := r.Header.Get(o.ClientTimeoutHeader); v != "" {
+			// the header is either an absolute deadline or a timeout
+			if d, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				earliest(d)
+			} else if d, err := parseDuration(v); err == nil && d > 0 {
+				earliest(received.Add(d))
+			}
+		}
+	}
+
+	return deadline
+}
+
+// withTimeoutBudget wraps a handler so that the deadline implied by the client's timeout hints is available to the
+// upstream requests made on its behalf
+func (t *TricksterHandler) withTimeoutBudget(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d := t.getOrigin(r).clientDeadline(r, time.Now()); !d.IsZero() {
+			r = r.WithContext(context.WithValue(r.Context(), timeoutBudgetKey{}, d))
+		}
+		next(w, r)
+	}
+}
+
+// requestDeadline returns the deadline by which the client expects a response to the request, or the zero time
+func requestDeadline(r *http.Request) time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	d, _ := r.Context().Value(timeoutBudgetKey{}).(time.Time)
+	return d
+}
+
+// upstreamTimeout returns the timeout of an upstream request to the origin: the origin's timeout, or the time
+// remaining until the client's deadline if it is sooner
+func (o PrometheusOriginConfig) upstreamTimeout(deadline time.Time) (time.Duration, error) {
+	timeout := time.Duration(o.TimeoutSecs) * time.Second
+	if deadline.IsZero() {
+		return timeout, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, errTimeoutBudgetExceeded
+	}
+	if timeout == 0 || remaining < timeout {
+		timeout = remaining
+	}
+	return timeout, nil
+}
+
+// writeOriginError responds to a request that could not be fetched from the origin, with a 504 if the client's
+// timeout budget was exhausted, and otherwise a 502
+func writeOriginError(w http.ResponseWriter, r *http.Request) {
+	if d := requestDeadline(r); !d.IsZero() && !time.Now().Before(d) {
+		w.Header().Set(hnContentType, hvTextPlain)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		fmt.Fprintln(w, "the origin did not respond within the client's timeout")
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
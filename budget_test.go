@@ -0,0 +1,110 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusOriginConfig_clientDeadline(t *testing.T) {
+	received := time.Unix(1500000000, 0)
+	o := PrometheusOriginConfig{UseClientTimeout: true, ClientTimeoutHeader: "X-Request-Timeout"}
+
+	tests := []struct {
+		url    string
+		header string
+		want   time.Time
+	}{
+		{"http://trickster/api/v1/query?query=up", "", time.Time{}},
+		{"http://trickster/api/v1/query?query=up&timeout=30s", "", received.Add(30 * time.Second)},
+		{"http://trickster/api/v1/query?query=up&timeout=15", "", received.Add(15 * time.Second)},
+		// it should use the earliest of the parameter and header
+		{"http://trickster/api/v1/query?query=up&timeout=30s", "10", received.Add(10 * time.Second)},
+		{"http://trickster/api/v1/query?query=up&timeout=5s", "1m", received.Add(5 * time.Second)},
+		// it should accept an absolute deadline in the header
+		{"http://trickster/api/v1/query?query=up", "2017-07-14T02:40:20Z", received.Add(20 * time.Second)},
+		{"http://trickster/api/v1/query?query=up&timeout=bogus", "bogus", time.Time{}},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.header != "" {
+			r.Header.Set("X-Request-Timeout", test.header)
+		}
+		if got := o.clientDeadline(r, received); !got.Equal(test.want) {
+			t.Errorf("test %d: wanted %v got %v.", i, test.want, got)
+		}
+	}
+
+	// it should ignore the hints the origin is not configured to honor
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query?query=up&timeout=30s", nil)
+	if got := (PrometheusOriginConfig{}).clientDeadline(r, received); !got.IsZero() {
+		t.Errorf("expected no deadline, got %v", got)
+	}
+}
+
+func TestPrometheusOriginConfig_upstreamTimeout(t *testing.T) {
+	o := PrometheusOriginConfig{TimeoutSecs: 180}
+
+	// it should use the origin's timeout without a deadline
+	if d, err := o.upstreamTimeout(time.Time{}); err != nil || d != 180*time.Second {
+		t.Errorf("wanted %v got %v (%v).", 180*time.Second, d, err)
+	}
+
+	// it should use the time remaining until a sooner deadline
+	if d, err := o.upstreamTimeout(time.Now().Add(10 * time.Second)); err != nil || d > 10*time.Second || d < 9*time.Second {
+		t.Errorf("unexpected timeout %v (%v)", d, err)
+	}
+
+	// it should return an error once the deadline has passed
+	if _, err := o.upstreamTimeout(time.Now().Add(-time.Second)); err != errTimeoutBudgetExceeded {
+		t.Errorf("wanted %v got %v.", errTimeoutBudgetExceeded, err)
+	}
+}
+
+func TestTricksterHandler_withTimeoutBudget(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "{}")
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.UseClientTimeout = true
+	tr.Config.Origins["default"] = o
+	router := tr.newRouter()
+
+	// it should respond with a gateway timeout when the origin is slower than the client's timeout
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster/api/v1/labels?timeout=0.05", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("wanted %d got %d.", http.StatusGatewayTimeout, w.Code)
+	}
+	if w.Body.Len() == 0 {
+		t.Errorf("expected a body describing the timeout")
+	}
+
+	// it should proxy requests that the origin answers within the client's timeout
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster/api/v1/labels?timeout=5s", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,148 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Bypass mode states
+	bmOn  = "on"
+	bmOff = "off"
+)
+
+// bypassed returns true if the instance is in maintenance (bypass) mode, or started without a reachable cache, where
+// all requests are proxied without caching
+func (t *TricksterHandler) bypassed() bool {
+	return atomic.LoadInt32(&t.bypass) == 1 || atomic.LoadInt32(&t.cacheUnavailable) == 1
+}
+
+// setBypass enables or disables maintenance (bypass) mode
+func (t *TricksterHandler) setBypass(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	if atomic.SwapInt32(&t.bypass, v) != v {
+		level.Info(t.Logger).Log(lfEvent, "bypass mode changed", "enabled", enabled)
+	}
+	t.updateBypassMetric()
+}
+
+// updateBypassMetric sets the bypass mode metric to whether requests are currently proxied without caching
+func (t *TricksterHandler) updateBypassMetric() {
+	if t.Metrics == nil {
+		return
+	}
+	if t.bypassed() {
+		t.Metrics.BypassMode.Set(1)
+	} else {
+		t.Metrics.BypassMode.Set(0)
+	}
+}
+
+// bypassHandler handles calls to /trickster/bypass, reporting the current bypass mode,
+// and PUT or POST calls to /trickster/bypass/{state}, which switches bypass mode on or off. The state is never changed
+// by a GET, which browsers send for prefetched links and cross-site images.
+func (t *TricksterHandler) bypassHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+
+	if state, ok := mux.Vars(r)["state"]; ok {
+		if r.Method != http.MethodPut && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch strings.ToLower(state) {
+		case bmOn:
+			t.setBypass(true)
+		case bmOff:
+			t.setBypass(false)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("bypass state must be 'on' or 'off'"))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if t.bypassed() {
+		w.Write([]byte(bmOn))
+	} else {
+		w.Write([]byte(bmOff))
+	}
+}
+
+// handleBypassSignals toggles bypass mode each time the process receives a SIGUSR1
+func (t *TricksterHandler) handleBypassSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			t.setBypass(!t.bypassed())
+		}
+	}()
+}
+
+// promBypassProxyHandler proxies a query or query_range request directly to the origin, with no cache reads or writes
+func (t *TricksterHandler) promBypassProxyHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	vars := mux.Vars(r)
+
+	// clear out the origin moniker from the front of the API path
+	if originName, ok := vars["originMoniker"]; ok {
+		if strings.HasPrefix(path, "/"+originName) {
+			path = strings.Replace(path, "/"+originName, "", 1)
+		}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error parsing form", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	origin := t.getOrigin(r)
+	if origin.AllowClientRefresh {
+		r.Form.Del(origin.refreshParam())
+	}
+	var body []byte
+	var resp *http.Response
+	var err error
+	if origin.federated() {
+		body, resp, err = t.getFederatedBody(origin, path, r.Form, r)
+	} else {
+		originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
+		body, resp, _, err = t.getURL(origin, r.Method, originURL, r.Form, t.getProxyableClientHeaders(r), requestDeadline(r))
+	}
+	if err != nil {
+		t.originLog(origin, level.Error, "error fetching data from origin Prometheus").Log(lfDetail, err.Error())
+		writeOriginError(w, r)
+		return
+	}
+
+	t.MemoryLimiter.Add(mcBuffers, int64(len(body)))
+	defer t.MemoryLimiter.Release(mcBuffers, int64(len(body)))
+	t.LoadShedder.addUpstreamBytes(r, int64(len(body)))
+
+	writeResponse(w, body, resp)
+}
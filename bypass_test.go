@@ -0,0 +1,95 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTricksterHandler_bypassHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tests := []struct {
+		method string
+		state  string
+		status int
+		body   string
+	}{
+		{"GET", "", http.StatusOK, bmOff},
+		{"POST", "on", http.StatusOK, bmOn},
+		{"GET", "", http.StatusOK, bmOn},
+		{"PUT", "OFF", http.StatusOK, bmOff},
+		{"POST", "maybe", http.StatusBadRequest, "bypass state must be 'on' or 'off'"},
+		// it should not change the state on a GET
+		{"GET", "on", http.StatusMethodNotAllowed, ""},
+		{"GET", "", http.StatusOK, bmOff},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "http://trickster/trickster/bypass", nil)
+		if test.state != "" {
+			r = mux.SetURLVars(r, map[string]string{"state": test.state})
+		}
+		w := httptest.NewRecorder()
+		tr.bypassHandler(w, r)
+
+		if w.Result().StatusCode != test.status {
+			t.Errorf("wanted %d got %d.", test.status, w.Result().StatusCode)
+		}
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if string(body) != test.body {
+			t.Errorf("wanted %q got %q.", test.body, string(body))
+		}
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_bypass(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	tr.setBypass(true)
+
+	// it should proxy the request without writing anything to the cache
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil)
+	tr.promQueryRangeHandler(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Result().StatusCode)
+	}
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if string(body) != exampleRangeResponse {
+		t.Errorf("wanted %q got %q.", exampleRangeResponse, string(body))
+	}
+
+	tr.setBypass(false)
+
+	// a subsequent cacheable request should be a cache miss, since nothing was stored while bypassed
+	ctx, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.CacheLookupResult == crHit || ctx.CacheLookupResult == crPartialHit {
+		t.Errorf("expected a cache miss, got %s", ctx.CacheLookupResult)
+	}
+}
@@ -31,21 +31,37 @@ type Cache interface {
 	Connect() error
 	Store(cacheKey string, data string, ttl int64) error
 	Retrieve(cacheKey string) (string, error)
+	Delete(cacheKey string) error
 	Reap()
 	Close() error
+	// Walk calls fn for each unexpired record in the cache, stopping at the first error
+	Walk(fn func(CacheObject) error) error
+	// Expiration returns the unix time at which the object expires, or an error on cache miss
+	Expiration(cacheKey string) (int64, error)
 }
 
 func getCache(t *TricksterHandler) Cache {
-	switch t.Config.Caching.CacheType {
+	c := newCache(t, t.Config.Caching.CacheType)
+	if l1 := t.Config.Caching.Tiered.L1CacheType; l1 != "" {
+		c = &TieredCache{L1: newCache(t, l1), L2: c, T: t}
+	}
+	return &ChecksumCache{Cache: c, T: t}
+}
+
+// newCache returns a cache of the type
+func newCache(t *TricksterHandler, cacheType string) Cache {
+	var c Cache
+	switch cacheType {
 	case ctFilesystem:
-		return &FilesystemCache{Config: t.Config.Caching.Filesystem, T: t}
+		c = &FilesystemCache{Config: t.Config.Caching.Filesystem, T: t}
 	case ctBoltDB:
-		return &BoltDBCache{Config: t.Config.Caching.BoltDB, T: t}
+		c = &BoltDBCache{Config: t.Config.Caching.BoltDB, T: t}
 	case ctRedis:
-		return &RedisCache{Config: t.Config.Caching.Redis, T: t}
+		c = &RedisCache{Config: t.Config.Caching.Redis, T: t}
 	case ctMemory:
-		return &MemoryCache{T: t}
+		c = &MemoryCache{T: t}
 	default:
-		panic(fmt.Errorf("Invalid cache type: %q", t.Config.Caching.CacheType))
+		panic(fmt.Errorf("Invalid cache type: %q", cacheType))
 	}
+	return c
 }
@@ -0,0 +1,189 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// cacheArchiveFormat identifies a Trickster cache archive
+	cacheArchiveFormat = "trickster-cache-archive"
+	// cacheArchiveVersion is the archive layout version written by exportCache
+	cacheArchiveVersion = 1
+
+	// Cache subcommands
+	ccCache  = "cache"
+	ccExport = "export"
+	ccImport = "import"
+
+	cacheCommandUsage = "usage: trickster cache export|import <archive file> [-config <path>]"
+)
+
+// cacheArchiveHeader is the first line of a cache archive, describing its contents
+type cacheArchiveHeader struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CacheType string `json:"cache_type"`
+	Exported  int64  `json:"exported"`
+}
+
+// cacheArchiveRecord is a single cache record in a cache archive. Value is a []byte so that
+// compressed values are base64-encoded rather than mangled by the JSON encoder.
+type cacheArchiveRecord struct {
+	Key        string `json:"key"`
+	Value      []byte `json:"value"`
+	Expiration int64  `json:"expiration"`
+}
+
+// exportCache writes every unexpired record in the cache to w as a gzipped archive of JSON lines,
+// returning the number of records written
+func exportCache(c Cache, w io.Writer, cacheType string) (int, error) {
+	return writeCacheArchive(w, cacheType, c.Walk)
+}
+
+// writeCacheArchive writes the records that walk calls fn with to w as a gzipped archive of JSON lines, returning the
+// number of records written
+func writeCacheArchive(w io.Writer, cacheType string, walk func(fn func(CacheObject) error) error) (int, error) {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	if err := enc.Encode(cacheArchiveHeader{Format: cacheArchiveFormat, Version: cacheArchiveVersion, CacheType: cacheType, Exported: time.Now().Unix()}); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err := walk(func(o CacheObject) error {
+		if err := enc.Encode(cacheArchiveRecord{Key: o.Key, Value: []byte(o.Value), Expiration: o.Expiration}); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, gz.Close()
+}
+
+// importCache stores each unexpired record in the archive read from r into the cache, keeping
+// its remaining TTL, and returns the number of records stored
+func importCache(c Cache, r io.Reader) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(bufio.NewReader(gz))
+
+	var h cacheArchiveHeader
+	if err := dec.Decode(&h); err != nil {
+		return 0, fmt.Errorf("unable to read cache archive header: %w", err)
+	}
+	if h.Format != cacheArchiveFormat {
+		return 0, fmt.Errorf("not a trickster cache archive")
+	}
+	if h.Version != cacheArchiveVersion {
+		return 0, fmt.Errorf("unsupported cache archive version %d", h.Version)
+	}
+
+	n := 0
+	for {
+		var rec cacheArchiveRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+
+		ttl := rec.Expiration - time.Now().Unix()
+		if ttl <= 0 {
+			continue
+		}
+		if err := c.Store(rec.Key, string(rec.Value), ttl); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// runCacheCommand runs the 'trickster cache' subcommands against the configured cache and returns
+// the process exit code. The arguments following the archive path are parsed as the usual
+// command line flags, so the configured cache can be selected with -config.
+func runCacheCommand(args []string) int {
+	if len(args) < 2 || (args[0] != ccExport && args[0] != ccImport) {
+		fmt.Println(cacheCommandUsage)
+		return 1
+	}
+	command, path := args[0], args[1]
+
+	t := &TricksterHandler{}
+	t.ResponseChannels = make(map[string]chan *ClientRequestContext)
+	t.Config = NewConfig()
+	if err := loadConfiguration(t.Config, args[2:]); err != nil {
+		fmt.Println("Could not load trickster configuration: ", err.Error())
+		return 1
+	}
+	t.Logger = newLogger(t.Config.Logging, "")
+
+	// the memory cache only lives as long as a running Trickster process
+	if t.Config.Caching.CacheType == ctMemory {
+		fmt.Printf("the %s cache type cannot be exported or imported\n", ctMemory)
+		return 1
+	}
+
+	t.Cacher = getCache(t)
+	if err := t.Cacher.Connect(); err != nil {
+		level.Error(t.Logger).Log(lfEvent, "Unable to connect to Cache", lfDetail, err.Error())
+		return 1
+	}
+	defer t.Cacher.Close()
+
+	var n int
+	var err error
+	switch command {
+	case ccExport:
+		var f *os.File
+		if f, err = os.Create(path); err == nil {
+			n, err = exportCache(t.Cacher, f, t.Config.Caching.CacheType)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	case ccImport:
+		var f *os.File
+		if f, err = os.Open(path); err == nil {
+			n, err = importCache(t.Cacher, f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "cache "+command+" failed", "path", path, "records", n, lfDetail, err.Error())
+		return 1
+	}
+
+	level.Info(t.Logger).Log(lfEvent, "cache "+command+" complete", "path", path, "cacheType", t.Config.Caching.CacheType, "records", n)
+	return 0
+}
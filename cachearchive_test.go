@@ -0,0 +1,169 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExportImportCache_FilesystemToRedis(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trickster-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
+	fc := FilesystemCache{T: &tr, Config: FilesystemCacheConfig{CachePath: dir}}
+	if err := fc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	binary := string([]byte{0, 1, 2, 255, 254})
+	fc.Store("key1", "data1", 600)
+	fc.Store("key2", binary, 600)
+
+	var buf bytes.Buffer
+	n, err := exportCache(&fc, &buf, ctFilesystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should export every record
+	if n != 2 {
+		t.Errorf("wanted %d got %d.", 2, n)
+	}
+
+	rc, close := setupRedisCache()
+	defer close()
+	if err := rc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = importCache(&rc, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should import every record
+	if n != 2 {
+		t.Errorf("wanted %d got %d.", 2, n)
+	}
+
+	// it should preserve the values, including binary ones
+	for k, v := range map[string]string{"key1": "data1", "key2": binary} {
+		data, err := rc.Retrieve(k)
+		if err != nil {
+			t.Error(err)
+		}
+		if data != v {
+			t.Errorf("wanted %q got %q.", v, data)
+		}
+	}
+}
+
+func TestImportCache_SkipsExpired(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"format":"trickster-cache-archive","version":1,"cache_type":"redis","exported":0}
+{"key":"expired","value":"ZGF0YQ==","expiration":1}
+{"key":"current","value":"ZGF0YQ==","expiration":99999999999}
+`))
+	gz.Close()
+
+	mc := setupMemoryCache()
+	mc.Connect()
+
+	n, err := importCache(&mc, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should only import the unexpired record
+	if n != 1 {
+		t.Errorf("wanted %d got %d.", 1, n)
+	}
+	if _, err := mc.Retrieve("expired"); err == nil {
+		t.Errorf("expected expired record to be skipped")
+	}
+	if data, _ := mc.Retrieve("current"); data != "data" {
+		t.Errorf("wanted %q got %q.", "data", data)
+	}
+}
+
+func TestImportCache_BadArchive(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.Connect()
+
+	// it should reject input that is not gzipped
+	if _, err := importCache(&mc, bytes.NewBufferString("not an archive")); err == nil {
+		t.Errorf("expected error for non-gzipped input")
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"format":"something-else","version":1}` + "\n"))
+	gz.Close()
+
+	// it should reject an archive with an unknown format
+	if _, err := importCache(&mc, &buf); err == nil {
+		t.Errorf("expected error for unknown archive format")
+	}
+}
+
+func TestBoltDBCache_Walk(t *testing.T) {
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
+	bc := BoltDBCache{T: &tr, Config: BoltDBCacheConfig{Filename: "/tmp/test_walk.db", Bucket: "trickster_test"}}
+	defer os.Remove("/tmp/test_walk.db")
+
+	if err := bc.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	bc.Store("walk1", "data1", 600)
+	bc.Store("walk2", "data2", 600)
+
+	found := map[string]string{}
+	err := bc.Walk(func(o CacheObject) error {
+		found[o.Key] = o.Value
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should visit every record
+	if len(found) != 2 || found["walk1"] != "data1" || found["walk2"] != "data2" {
+		t.Errorf("unexpected records walked: %v", found)
+	}
+}
+
+func TestRunCacheCommand_Usage(t *testing.T) {
+	// it should fail without a subcommand and archive path
+	if code := runCacheCommand([]string{"export"}); code != 1 {
+		t.Errorf("wanted %d got %d.", 1, code)
+	}
+	if code := runCacheCommand([]string{"bogus", "file"}); code != 1 {
+		t.Errorf("wanted %d got %d.", 1, code)
+	}
+}
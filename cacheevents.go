@@ -0,0 +1,327 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// Cache event types
+	ceStore  = "store"
+	ceDelete = "delete"
+	ceExpire = "expire"
+	cePurge  = "purge"
+
+	// Cache event sinks, for the dropped events metric
+	esStream  = "stream"
+	esWebhook = "webhook"
+
+	hvTextEventStream = "text/event-stream"
+
+	defaultCacheEventsBufferSize      = 1000
+	defaultCacheEventsWebhookBatch    = 100
+	defaultCacheEventsWebhookFlushMS  = 1000
+	defaultCacheEventsWebhookTimeoutS = 10
+)
+
+// cacheEventTypes lists the cache event types
+var cacheEventTypes = []string{ceStore, ceDelete, ceExpire, cePurge}
+
+// validCacheEventType returns true if et is a cache event type
+func validCacheEventType(et string) bool {
+	for _, t := range cacheEventTypes {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheEventsConfig describes the cache events emitted to external systems, which can mirror or audit the cache
+type CacheEventsConfig struct {
+	// Enabled emits the cache events to the clients of /trickster/events and the webhook, if any
+	Enabled bool `toml:"enabled"`
+	// Types lists the event types emitted: 'store', 'delete', 'expire' and 'purge'. Default is all of them
+	Types []string `toml:"types"`
+	// BufferSize is the number of events buffered for each client and the webhook, beyond which events are dropped
+	// rather than slowing the cache down. Default is 1000
+	BufferSize int `toml:"buffer_size"`
+	// WebhookURL, when set, receives the events in batches, as POSTed JSON arrays
+	WebhookURL string `toml:"webhook_url"`
+	// WebhookBatchSize is the maximum number of events POSTed at once. Default is 100
+	WebhookBatchSize int `toml:"webhook_batch_size"`
+	// WebhookFlushMS is the longest time an event waits for its batch to fill before it is POSTed. Default is 1000
+	WebhookFlushMS int64 `toml:"webhook_flush_ms"`
+}
+
+// validate returns an error if the event types are unknown, the sizes negative or the webhook url invalid
+func (c CacheEventsConfig) validate() error {
+	for _, et := range c.Types {
+		if !validCacheEventType(et) {
+			return fmt.Errorf("cache: unknown events type %q", et)
+		}
+	}
+	if c.BufferSize < 0 || c.WebhookBatchSize < 0 || c.WebhookFlushMS < 0 {
+		return fmt.Errorf("cache: events settings must not be negative")
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("cache: events webhook_url %q is not an absolute url", c.WebhookURL)
+		}
+	}
+	return nil
+}
+
+// cacheEvent describes a change to a cache record
+type cacheEvent struct {
+	Type string    `json:"type"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+	// TTLSecs and Bytes describe stored records
+	TTLSecs int64 `json:"ttl_secs,omitempty"`
+	Bytes   int   `json:"bytes,omitempty"`
+	// Origin and Query describe purged query_range data sets
+	Origin string `json:"origin,omitempty"`
+	Query  string `json:"query,omitempty"`
+}
+
+// CacheEvents emits cache events to the subscribed clients and the webhook, without ever blocking the cache: events
+// that do not fit in a subscriber's buffer are dropped. A nil CacheEvents emits nothing.
+type CacheEvents struct {
+	config  CacheEventsConfig
+	types   map[string]bool
+	metrics *ApplicationMetrics
+
+	mu          sync.Mutex
+	subscribers map[chan cacheEvent]map[string]bool
+	webhook     chan cacheEvent
+}
+
+// NewCacheEvents returns the CacheEvents of the validated config, which reports to the metrics when they are not nil
+func NewCacheEvents(c CacheEventsConfig, m *ApplicationMetrics) *CacheEvents {
+	e := &CacheEvents{config: c, types: map[string]bool{}, metrics: m, subscribers: map[chan cacheEvent]map[string]bool{}}
+	types := c.Types
+	if len(types) == 0 {
+		types = cacheEventTypes
+	}
+	for _, et := range types {
+		e.types[et] = true
+	}
+	if c.WebhookURL != "" {
+		e.webhook = make(chan cacheEvent, e.bufferSize())
+	}
+	return e
+}
+
+func (e *CacheEvents) bufferSize() int {
+	if e.config.BufferSize > 0 {
+		return e.config.BufferSize
+	}
+	return defaultCacheEventsBufferSize
+}
+
+// emit sends the event, timestamped now, to the subscribers and the webhook
+func (e *CacheEvents) emit(ev cacheEvent) {
+	if e == nil || !e.types[ev.Type] {
+		return
+	}
+	ev.Time = time.Now()
+	if e.metrics != nil {
+		e.metrics.CacheEvents.WithLabelValues(ev.Type).Inc()
+	}
+
+	e.mu.Lock()
+	for ch, types := range e.subscribers {
+		if len(types) > 0 && !types[ev.Type] {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			e.dropped(esStream, 1)
+		}
+	}
+	e.mu.Unlock()
+
+	if e.webhook != nil {
+		select {
+		case e.webhook <- ev:
+		default:
+			e.dropped(esWebhook, 1)
+		}
+	}
+}
+
+func (e *CacheEvents) dropped(sink string, n int) {
+	if e.metrics != nil {
+		e.metrics.CacheEventsDropped.WithLabelValues(sink).Add(float64(n))
+	}
+}
+
+// subscribe returns a channel receiving the events of the types (all types when empty), and the function that
+// ends the subscription
+func (e *CacheEvents) subscribe(types []string) (<-chan cacheEvent, func()) {
+	ch := make(chan cacheEvent, e.bufferSize())
+	filter := map[string]bool{}
+	for _, et := range types {
+		filter[et] = true
+	}
+	e.mu.Lock()
+	e.subscribers[ch] = filter
+	e.mu.Unlock()
+	return ch, func() {
+		e.mu.Lock()
+		delete(e.subscribers, ch)
+		e.mu.Unlock()
+	}
+}
+
+// runWebhook POSTs the events to the webhook in batches, until the process exits
+func (e *CacheEvents) runWebhook(logger log.Logger) {
+	size := e.config.WebhookBatchSize
+	if size <= 0 {
+		size = defaultCacheEventsWebhookBatch
+	}
+	interval := time.Duration(e.config.WebhookFlushMS) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultCacheEventsWebhookFlushMS * time.Millisecond
+	}
+	client := &http.Client{Timeout: defaultCacheEventsWebhookTimeoutS * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]cacheEvent, 0, size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := postCacheEvents(client, e.config.WebhookURL, batch); err != nil {
+			level.Warn(logger).Log(lfEvent, "error posting cache events", "events", len(batch), lfDetail, err.Error())
+			e.dropped(esWebhook, len(batch))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case ev := <-e.webhook:
+			batch = append(batch, ev)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// postCacheEvents POSTs the events to the url as a JSON array
+func postCacheEvents(client *http.Client, u string, events []cacheEvent) error {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(u, hvApplicationJSON, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EventCache wraps a Cache to emit an event for each record stored or deleted
+type EventCache struct {
+	Cache
+	events *CacheEvents
+}
+
+// NewEventCache returns an EventCache emitting the events of c
+func NewEventCache(c Cache, events *CacheEvents) *EventCache {
+	return &EventCache{Cache: c, events: events}
+}
+
+// Store places an object in the cache, emitting a store event
+func (c *EventCache) Store(cacheKey string, data string, ttl int64) error {
+	err := c.Cache.Store(cacheKey, data, ttl)
+	if err == nil {
+		c.events.emit(cacheEvent{Type: ceStore, Key: cacheKey, TTLSecs: ttl, Bytes: len(data)})
+	}
+	return err
+}
+
+// Delete removes an object from the cache, emitting a delete event
+func (c *EventCache) Delete(cacheKey string) error {
+	err := c.Cache.Delete(cacheKey)
+	if err == nil {
+		c.events.emit(cacheEvent{Type: ceDelete, Key: cacheKey})
+	}
+	return err
+}
+
+// eventsHandler handles calls to /trickster/events?types=..., which streams the cache events of the types (a
+// comma-separated list, all types when unset) as Server-Sent Events until the client disconnects
+func (t *TricksterHandler) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	flusher, ok := w.(http.Flusher)
+	if t.CacheEvents == nil || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "cache events are not enabled")
+		return
+	}
+
+	var types []string
+	if v := r.URL.Query().Get("types"); v != "" {
+		types = strings.Split(v, ",")
+		for _, et := range types {
+			if !validCacheEventType(et) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "unknown event type %q\n", et)
+				return
+			}
+		}
+	}
+
+	events, unsubscribe := t.CacheEvents.subscribe(types)
+	defer unsubscribe()
+
+	w.Header().Set(hnContentType, hvTextEventStream)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheEventsConfig_validate(t *testing.T) {
+	tests := []struct {
+		config CacheEventsConfig
+		valid  bool
+	}{
+		{CacheEventsConfig{}, true},
+		{CacheEventsConfig{Enabled: true, Types: []string{ceStore, cePurge}}, true},
+		{CacheEventsConfig{Enabled: true, Types: []string{"evict"}}, false},
+		{CacheEventsConfig{Enabled: true, BufferSize: -1}, false},
+		{CacheEventsConfig{Enabled: true, WebhookURL: "http://auditor:8080/events"}, true},
+		{CacheEventsConfig{Enabled: true, WebhookURL: "auditor/events"}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestCacheEvents_emit(t *testing.T) {
+	e := NewCacheEvents(CacheEventsConfig{Types: []string{ceStore, ceDelete}, BufferSize: 1}, nil)
+	all, cancelAll := e.subscribe(nil)
+	deletes, cancelDeletes := e.subscribe([]string{ceDelete})
+	defer cancelDeletes()
+
+	// it should send the emitted types to the subscribers of the type
+	e.emit(cacheEvent{Type: ceDelete, Key: "a"})
+	if ev := <-all; ev.Type != ceDelete || ev.Key != "a" || ev.Time.IsZero() {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if ev := <-deletes; ev.Key != "a" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	// it should filter the events by the subscribed and emitted types
+	e.emit(cacheEvent{Type: ceStore, Key: "b"})
+	e.emit(cacheEvent{Type: ceExpire, Key: "c"})
+	if len(deletes) != 0 || len(all) != 1 {
+		t.Errorf("unexpected events %d, %d", len(deletes), len(all))
+	}
+
+	// it should drop the events that do not fit in the buffer
+	e.emit(cacheEvent{Type: ceStore, Key: "d"})
+	if ev := <-all; ev.Key != "b" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	// it should stop sending to canceled subscriptions
+	cancelAll()
+	e.emit(cacheEvent{Type: ceStore, Key: "e"})
+	if len(all) != 0 {
+		t.Errorf("wanted %d got %d.", 0, len(all))
+	}
+
+	// it should emit nothing when disabled
+	var nilEvents *CacheEvents
+	nilEvents.emit(cacheEvent{Type: ceStore, Key: "f"})
+}
+
+func TestEventCache(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	e := NewCacheEvents(CacheEventsConfig{}, tr.Metrics)
+	events, cancel := e.subscribe(nil)
+	defer cancel()
+	c := NewEventCache(tr.Cacher, e)
+
+	// it should emit an event for each stored and deleted record
+	if err := c.Store("k", "data", 60); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev.Type != ceStore || ev.Key != "k" || ev.TTLSecs != 60 || ev.Bytes != 4 {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if d, err := c.Retrieve("k"); err != nil || d != "data" {
+		t.Errorf("unexpected result %s %v", d, err)
+	}
+	c.Delete("k")
+	if ev := <-events; ev.Type != ceDelete || ev.Key != "k" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if len(events) != 0 {
+		t.Errorf("wanted %d got %d.", 0, len(events))
+	}
+}
+
+func TestCacheEvents_runWebhook(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	batches := make(chan []cacheEvent, 10)
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []cacheEvent
+		json.NewDecoder(r.Body).Decode(&batch)
+		batches <- batch
+	}))
+	defer ws.Close()
+
+	e := NewCacheEvents(CacheEventsConfig{WebhookURL: ws.URL, WebhookBatchSize: 2, WebhookFlushMS: 10}, nil)
+	go e.runWebhook(tr.Logger)
+
+	// it should POST full batches, then the remaining events once they have waited long enough
+	for _, key := range []string{"a", "b", "c"} {
+		e.emit(cacheEvent{Type: ceStore, Key: key})
+	}
+	var keys []string
+	for len(keys) < 3 {
+		select {
+		case batch := <-batches:
+			if len(batch) > 2 {
+				t.Errorf("unexpected batch %+v", batch)
+			}
+			for _, ev := range batch {
+				keys = append(keys, ev.Key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out with events %v", keys)
+		}
+	}
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Errorf("unexpected events %v", keys)
+	}
+}
+
+func TestTricksterHandler_eventsHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// it should not be found when cache events are disabled
+	w := httptest.NewRecorder()
+	tr.newAdminRouter().ServeHTTP(w, httptest.NewRequest("GET", "/trickster/events", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("wanted %d got %d.", http.StatusNotFound, w.Code)
+	}
+
+	tr.CacheEvents = NewCacheEvents(CacheEventsConfig{}, tr.Metrics)
+	ts := httptest.NewServer(tr.newAdminRouter())
+	defer ts.Close()
+
+	// it should refuse unknown event types
+	resp, err := http.Get(ts.URL + "/trickster/events?types=store,evict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wanted %d got %d.", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// it should stream the events of the requested types
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", ts.URL+"/trickster/events?types=purge", nil)
+	resp, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get(hnContentType); ct != hvTextEventStream {
+		t.Errorf("wanted %s got %s.", hvTextEventStream, ct)
+	}
+
+	tr.CacheEvents.emit(cacheEvent{Type: ceStore, Key: "a"})
+	tr.CacheEvents.emit(cacheEvent{Type: cePurge, Key: "b", Origin: "default", Query: "up"})
+
+	lines := bufio.NewReader(resp.Body)
+	line, _ := lines.ReadString('\n')
+	if line != "event: purge\n" {
+		t.Errorf("unexpected line %q", line)
+	}
+	line, _ = lines.ReadString('\n')
+	var ev cacheEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Key != "b" || ev.Origin != "default" || ev.Query != "up" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
@@ -0,0 +1,86 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	hnCookie = "Cookie"
+
+	// Policies for caching requests that carry credentials
+	acShared        = "shared"
+	acPerCredential = "per_credential"
+	acNoCache       = "no_cache"
+)
+
+// hasCredentials returns true if the request carries an Authorization or Cookie header
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get(hnAuthorization) != "" || r.Header.Get(hnCookie) != ""
+}
+
+// cachesCredentialedRequest returns false if the request carries credentials and the origin does not cache such requests
+func (o PrometheusOriginConfig) cachesCredentialedRequest(r *http.Request) bool {
+	return o.AuthCachePolicy != acNoCache || !hasCredentials(r)
+}
+
+// credentialScope returns the part of the cache key scope that separates the cached objects of requests with
+// different credentials, according to the origin's policy. By default, only the Authorization header does.
+func (o PrometheusOriginConfig) credentialScope(r *http.Request) string {
+	switch o.AuthCachePolicy {
+	case acShared, acNoCache:
+		// credentials are ignored, or requests carrying them are not cached
+		return ""
+	case acPerCredential:
+		if !hasCredentials(r) {
+			return ""
+		}
+		return md5sum(strings.Join(r.Header[hnAuthorization], " ") + "\n" + strings.Join(r.Header[hnCookie], "; "))
+	}
+	// if we have an authorization header, that should be part of the cache key to ensure only authorized users can access cached datasets
+	return strings.Join(r.Header[hnAuthorization], " ")
+}
+
+// validateAuthCachePolicy returns an error if the origin's policy for requests carrying credentials is unknown
+func (o PrometheusOriginConfig) validateAuthCachePolicy() error {
+	switch o.AuthCachePolicy {
+	case "", acShared, acPerCredential, acNoCache:
+		return nil
+	}
+	return fmt.Errorf("unknown auth_cache_policy %q", o.AuthCachePolicy)
+}
+
+// cacheKeyScope returns the part of the cache key base that separates the request's cached objects from those of
+// requests with other credentials, Grafana users or cache key header values
+func (o PrometheusOriginConfig) cacheKeyScope(r *http.Request) string {
+	scope := o.credentialScope(r)
+	// and when the origin scopes cached data to Grafana users, teams or orgs, so should theirs
+	scope += o.Grafana.cacheKeyScope(r)
+	for _, name := range o.CacheKeyHeaders {
+		scope += "\n" + strings.ToLower(name) + ": " + strings.Join(r.Header[http.CanonicalHeaderKey(name)], ", ")
+	}
+	return scope
+}
+
+// cacheKeyPartition returns the prefix of the request's cache keys, which is the hash of its value of the origin's
+// partition header, or empty if the origin is not partitioned
+func (o PrometheusOriginConfig) cacheKeyPartition(r *http.Request) string {
+	if o.CacheKeyPartitionHeader == "" {
+		return ""
+	}
+	return md5sum(r.Header.Get(o.CacheKeyPartitionHeader)) + "."
+}
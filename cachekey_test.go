@@ -0,0 +1,204 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusOriginConfig_cacheKeyScope(t *testing.T) {
+	o := PrometheusOriginConfig{}
+	r := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+	r.Header.Set("X-Scope-OrgID", "tenant-a")
+
+	// it should not scope by headers that are not configured
+	if scope := o.cacheKeyScope(r); scope != "" {
+		t.Errorf("unexpected scope %q", scope)
+	}
+
+	// it should scope by the authorization header
+	r.Header.Set(hnAuthorization, "Bearer abc")
+	if scope := o.cacheKeyScope(r); scope != "Bearer abc" {
+		t.Errorf("wanted %q got %q.", "Bearer abc", scope)
+	}
+
+	// it should scope by the configured headers
+	o.CacheKeyHeaders = []string{"x-scope-orgid"}
+	scope := o.cacheKeyScope(r)
+	r.Header.Set("X-Scope-OrgID", "tenant-b")
+	if o.cacheKeyScope(r) == scope {
+		t.Errorf("expected tenants to have separate scopes")
+	}
+}
+
+func TestTricksterHandler_buildRequestContext_cacheKeyPartition(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	o := tr.Config.Origins["default"]
+	o.CacheKeyPartitionHeader = "X-Scope-OrgID"
+	tr.Config.Origins["default"] = o
+
+	cacheKey := func(tenant string) string {
+		r := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+		r.Header.Set("X-Scope-OrgID", tenant)
+		ctx, err := tr.buildRequestContext(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx.CacheKey
+	}
+
+	// it should prefix the cache keys with the hashed partition header
+	key := cacheKey("tenant-a")
+	if !strings.HasPrefix(key, md5sum("tenant-a")+".") {
+		t.Errorf("unexpected cache key %q", key)
+	}
+	if other := cacheKey("tenant-b"); strings.TrimPrefix(other, md5sum("tenant-b")) != strings.TrimPrefix(key, md5sum("tenant-a")) {
+		t.Errorf("expected only the partition to differ: %q %q", key, other)
+	}
+}
+
+func TestTricksterHandler_fetchPromQuery_cacheKeyHeaders(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	requests := 0
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("{}"))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.CacheKeyHeaders = []string{"X-Scope-OrgID"}
+	tr.Config.Origins["default"] = o
+
+	query := func(tenant string) {
+		r := httptest.NewRequest("GET", "http://trickster/api/v1/query?query=up&time=0", nil)
+		r.Header.Set("X-Scope-OrgID", tenant)
+		if _, _, err := tr.fetchPromQuery(es.URL+prometheusAPIv1Path+"query", r.URL.Query(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// it should serve a tenant's cached result to that tenant only
+	query("tenant-a")
+	query("tenant-a")
+	query("tenant-b")
+	if requests != 2 {
+		t.Errorf("wanted %d got %d.", 2, requests)
+	}
+}
+
+func TestPrometheusOriginConfig_credentialScope(t *testing.T) {
+	anonymous := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+	bearer := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+	bearer.Header.Set(hnAuthorization, "Bearer abc")
+	cookie := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+	cookie.Header.Set(hnCookie, "session=abc")
+	otherCookie := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+	otherCookie.Header.Set(hnCookie, "session=def")
+
+	tests := []struct {
+		policy   string
+		r1, r2   *http.Request
+		separate bool
+	}{
+		// by default, only the Authorization header separates cached objects
+		{"", anonymous, bearer, true},
+		{"", cookie, otherCookie, false},
+		{acShared, anonymous, bearer, false},
+		{acShared, cookie, otherCookie, false},
+		{acPerCredential, anonymous, bearer, true},
+		{acPerCredential, cookie, otherCookie, true},
+		{acPerCredential, bearer, cookie, true},
+	}
+
+	for i, test := range tests {
+		o := PrometheusOriginConfig{AuthCachePolicy: test.policy}
+		if separate := o.cacheKeyScope(test.r1) != o.cacheKeyScope(test.r2); separate != test.separate {
+			t.Errorf("test %d: unexpected result %v", i, separate)
+		}
+	}
+
+	// it should not put credentials in the cache key in the clear
+	if scope := (PrometheusOriginConfig{AuthCachePolicy: acPerCredential}).cacheKeyScope(bearer); strings.Contains(scope, "abc") {
+		t.Errorf("unexpected scope %q", scope)
+	}
+}
+
+func TestPrometheusOriginConfig_validateAuthCachePolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		ok     bool
+	}{
+		{"", true},
+		{acShared, true},
+		{acPerCredential, true},
+		{acNoCache, true},
+		{"private", false},
+	}
+
+	for i, test := range tests {
+		if err := (PrometheusOriginConfig{AuthCachePolicy: test.policy}).validateAuthCachePolicy(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTricksterHandler_promQueryHandler_authCachePolicy(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	requests := 0
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(exampleResponse))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.AuthCachePolicy = acNoCache
+	tr.Config.Origins["default"] = o
+
+	query := func(cookie string) {
+		r := httptest.NewRequest("GET", "http://trickster/api/v1/query?query=up&time=1", nil)
+		if cookie != "" {
+			r.Header.Set(hnCookie, cookie)
+		}
+		w := httptest.NewRecorder()
+		tr.promQueryHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("wanted %d got %d.", http.StatusOK, w.Code)
+		}
+	}
+
+	// it should never cache requests carrying credentials
+	query("session=abc")
+	query("session=abc")
+	if requests != 2 {
+		t.Errorf("wanted %d got %d.", 2, requests)
+	}
+
+	// and cache the others as usual
+	query("")
+	query("")
+	if requests != 3 {
+		t.Errorf("wanted %d got %d.", 3, requests)
+	}
+}
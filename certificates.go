@@ -0,0 +1,273 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	hvOCSPRequest = "application/ocsp-request"
+
+	// defaultOCSPRefreshSecs is the interval between OCSP staple refreshes when ocsp_refresh_secs is not set
+	defaultOCSPRefreshSecs = 3600
+	// ocspRetryInterval is the wait before retrying a failed OCSP staple refresh
+	ocspRetryInterval = time.Minute
+	// ocspTimeout limits the time an OCSP responder has to respond
+	ocspTimeout = 10 * time.Second
+)
+
+// oidSHA1 identifies the hash algorithm of the certificate IDs of OCSP requests
+var oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+
+// ocspCertID identifies a certificate to an OCSP responder (RFC 6960 4.1.1)
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			ReqCert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Raw         asn1.RawContent
+		Version     int `asn1:"optional,explicit,default:0,tag:0"`
+		ResponderID asn1.RawValue
+		ProducedAt  time.Time `asn1:"generalized"`
+		Responses   []ocspSingleResponse
+		Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	CertStatus asn1.RawValue
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// servedCertificate is the certificate of a TLS listener, along with its current OCSP staple
+type servedCertificate struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// issuer is the certificate that issued the leaf, as required for OCSP requests
+	issuer *x509.Certificate
+	// stapleExpiry is when the current staple stops being valid
+	stapleExpiry time.Time
+}
+
+// getCertificate returns the certificate and its current staple, as tls.Config.GetCertificate does
+func (s *servedCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// setStaple replaces the certificate's OCSP staple. A nil staple removes it.
+func (s *servedCertificate) setStaple(staple []byte, expiry time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cert := *s.cert
+	cert.OCSPStaple = staple
+	s.cert, s.stapleExpiry = &cert, expiry
+}
+
+// serverTLSConfig returns the tls.Config of the named listener with the TLS settings, serving the certificate it loads.
+// It exports the certificate's expiry and, when stapling is enabled, starts keeping its OCSP staple fresh.
+func (t *TricksterHandler) serverTLSConfig(listener string, c TLSConfig) (*tls.Config, error) {
+	// the tls settings were already validated with the rest of the configuration
+	cfg, _ := c.serverConfig()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.FullChainCertPath, c.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	t.Metrics.TLSCertificateExpiry.WithLabelValues(listener, c.FullChainCertPath).Set(float64(cert.Leaf.NotAfter.Unix()))
+
+	s := &servedCertificate{cert: &cert}
+	if c.OCSPStapling {
+		if len(cert.Certificate) < 2 || len(cert.Leaf.OCSPServer) == 0 {
+			level.Warn(t.Logger).Log(lfEvent, "ocsp stapling requires the issuer certificate in the chain and an ocsp server in the certificate", "listener", listener)
+		} else if s.issuer, err = x509.ParseCertificate(cert.Certificate[1]); err != nil {
+			return nil, err
+		} else {
+			go t.keepOCSPStapleFresh(listener, s, c.ocspRefreshInterval())
+		}
+	}
+
+	cfg.GetCertificate = s.getCertificate
+	return cfg, nil
+}
+
+// ocspRefreshInterval returns the interval between OCSP staple refreshes
+func (c TLSConfig) ocspRefreshInterval() time.Duration {
+	if c.OCSPRefreshSecs > 0 {
+		return time.Duration(c.OCSPRefreshSecs) * time.Second
+	}
+	return defaultOCSPRefreshSecs * time.Second
+}
+
+// keepOCSPStapleFresh refreshes the certificate's OCSP staple at the interval, for as long as the process runs
+func (t *TricksterHandler) keepOCSPStapleFresh(listener string, s *servedCertificate, interval time.Duration) {
+	for {
+		time.Sleep(t.refreshOCSPStaple(listener, s, interval))
+	}
+}
+
+// refreshOCSPStaple fetches a new OCSP staple for the certificate, and returns the wait before the next refresh. When
+// the responder fails, the current staple is kept until it expires.
+func (t *TricksterHandler) refreshOCSPStaple(listener string, s *servedCertificate, interval time.Duration) time.Duration {
+	s.mu.RLock()
+	leaf, expiry := s.cert.Leaf, s.stapleExpiry
+	s.mu.RUnlock()
+
+	staple, nextUpdate, err := fetchOCSPStaple(leaf, s.issuer)
+	if err != nil {
+		level.Warn(t.Logger).Log(lfEvent, "unable to refresh ocsp staple", "listener", listener, lfDetail, err.Error())
+		if !expiry.IsZero() && time.Now().After(expiry) {
+			s.setStaple(nil, time.Time{})
+		}
+		return ocspRetryInterval
+	}
+	s.setStaple(staple, nextUpdate)
+
+	// refresh before the staple expires, even when the interval is longer than its validity
+	if !nextUpdate.IsZero() {
+		if untilHalfway := time.Until(nextUpdate) / 2; untilHalfway < interval && untilHalfway > ocspRetryInterval {
+			return untilHalfway
+		}
+	}
+	return interval
+}
+
+// fetchOCSPStaple requests the status of the certificate from its OCSP responder, returning the raw response, to be
+// stapled, and when it stops being valid (zero when the responder does not say). Only responses that the certificate
+// is good are returned. Their signatures are verified by the clients the staple is sent to.
+func fetchOCSPStaple(leaf, issuer *x509.Certificate) ([]byte, time.Time, error) {
+	certID, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var req ocspRequest
+	req.TBSRequest.RequestList = []struct{ ReqCert ocspCertID }{{certID}}
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	client := &http.Client{Timeout: ocspTimeout}
+	resp, err := client.Post(leaf.OCSPServer[0], hvOCSPRequest, bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("ocsp responder returned status %d", resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	nextUpdate, err := parseOCSPResponse(raw, leaf.SerialNumber)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return raw, nextUpdate, nil
+}
+
+// newOCSPCertID returns the OCSP certificate ID of the leaf certificate
+func newOCSPCertID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash[:],
+		IssuerKeyHash:  keyHash[:],
+		SerialNumber:   leaf.SerialNumber,
+	}, nil
+}
+
+// parseOCSPResponse returns the next update time of an OCSP response that the certificate with the serial number is
+// good, or an error if the response is unsuccessful, is for another certificate, or does not say it is good
+func parseOCSPResponse(raw []byte, serial *big.Int) (time.Time, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(raw, &resp); err != nil {
+		return time.Time{}, fmt.Errorf("malformed ocsp response: %v", err)
+	}
+	if resp.Status != 0 {
+		return time.Time{}, fmt.Errorf("ocsp responder returned response status %d", resp.Status)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.ResponseBytes.Response, &basic); err != nil {
+		return time.Time{}, fmt.Errorf("malformed ocsp response: %v", err)
+	}
+	for _, r := range basic.TBSResponseData.Responses {
+		if r.CertID.SerialNumber == nil || r.CertID.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		// the status is good ([0] IMPLICIT NULL), revoked ([1]) or unknown ([2])
+		if r.CertStatus.Class != asn1.ClassContextSpecific || r.CertStatus.Tag != 0 {
+			return time.Time{}, fmt.Errorf("ocsp responder did not report the certificate as good (status %d)", r.CertStatus.Tag)
+		}
+		return r.NextUpdate, nil
+	}
+	return time.Time{}, fmt.Errorf("ocsp response does not include the certificate")
+}
@@ -0,0 +1,241 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestOCSPResponse returns a minimal, unsigned OCSP response for the certificate with the serial number, with the
+// status ([0] good, [1] revoked) and next update
+func newTestOCSPResponse(t *testing.T, serial *big.Int, status int, nextUpdate time.Time) []byte {
+	var basic ocspBasicResponse
+	basic.TBSResponseData.ResponderID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: []byte{4, 0}}
+	basic.TBSResponseData.ProducedAt = time.Now().UTC().Truncate(time.Second)
+	basic.TBSResponseData.Responses = []ocspSingleResponse{{
+		CertID:     ocspCertID{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}, SerialNumber: serial},
+		CertStatus: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: status},
+		ThisUpdate: basic.TBSResponseData.ProducedAt,
+		NextUpdate: nextUpdate.UTC().Truncate(time.Second),
+	}}
+	basic.SignatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}}
+	basic.Signature = asn1.BitString{Bytes: []byte{0}, BitLength: 8}
+	basicBytes, err := asn1.Marshal(basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp ocspResponse
+	resp.ResponseBytes.ResponseType = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	resp.ResponseBytes.Response = basicBytes
+	b, err := asn1.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newTestCertificates returns a certificate issued by a new CA for example.com with the OCSP server, along with the
+// paths of its chain and key files and the CA
+func newTestCertificates(t *testing.T, ocspServer string) (chainPath, keyPath string, ca *x509.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Trickster Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Unix(2000000000, 0),
+		OCSPServer:   []string{ocspServer},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &bytes.Buffer{}
+	pem.Encode(chain, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	pem.Encode(chain, &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	writeTemp := func(b []byte) string {
+		f, err := ioutil.TempFile("", "trickster-cert")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(b)
+		f.Close()
+		return f.Name()
+	}
+	return writeTemp(chain.Bytes()), writeTemp(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), ca
+}
+
+func TestTricksterHandler_serverTLSConfig(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	chainPath, keyPath, ca := newTestCertificates(t, "http://127.0.0.1:1/")
+	defer os.Remove(chainPath)
+	defer os.Remove(keyPath)
+
+	cfg, err := tr.serverTLSConfig("main", TLSConfig{Enabled: true, FullChainCertPath: chainPath, PrivateKeyPath: keyPath, MinVersion: "1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should export the certificate's expiry
+	if v := testutil.ToFloat64(tr.Metrics.TLSCertificateExpiry.WithLabelValues("main", chainPath)); v != 2000000000 {
+		t.Errorf("wanted %d got %v.", 2000000000, v)
+	}
+
+	// it should serve the certificate with the TLS settings
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wanted %d got %d.", tls.VersionTLS12, cfg.MinVersion)
+	}
+	es := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	es.TLS = cfg
+	es.StartTLS()
+	defer es.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "example.com"}}}
+	resp, err := client.Get(es.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// it should fail for missing files
+	if _, err := tr.serverTLSConfig("main", TLSConfig{Enabled: true, FullChainCertPath: "/nonexistent", PrivateKeyPath: keyPath}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestTricksterHandler_refreshOCSPStaple(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	status := 0
+	nextUpdate := time.Now().Add(time.Hour)
+	var ca *x509.Certificate
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req ocspRequest
+		if _, err := asn1.Unmarshal(body, &req); err != nil || r.Header.Get(hnContentType) != hvOCSPRequest || len(req.TBSRequest.RequestList) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := req.TBSRequest.RequestList[0].ReqCert
+		if nameHash := sha1.Sum(ca.RawSubject); !bytes.Equal(id.IssuerNameHash, nameHash[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(newTestOCSPResponse(t, id.SerialNumber, status, nextUpdate))
+	}))
+	defer responder.Close()
+
+	chainPath, keyPath, ca := newTestCertificates(t, responder.URL)
+	defer os.Remove(chainPath)
+	defer os.Remove(keyPath)
+
+	cert, err := tls.LoadX509KeyPair(chainPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	s := &servedCertificate{cert: &cert, issuer: ca}
+
+	// it should staple a good response, and refresh it halfway to its next update when that is sooner than the interval
+	wait := tr.refreshOCSPStaple("main", s, 2*time.Hour)
+	if wait < 29*time.Minute || wait > 30*time.Minute {
+		t.Errorf("unexpected wait %v", wait)
+	}
+	served, _ := s.getCertificate(nil)
+	if _, err := parseOCSPResponse(served.OCSPStaple, cert.Leaf.SerialNumber); err != nil {
+		t.Error(err)
+	}
+
+	// it should keep the current staple, and retry sooner, when the certificate is not reported good
+	status = 1
+	if wait := tr.refreshOCSPStaple("main", s, 2*time.Hour); wait != ocspRetryInterval {
+		t.Errorf("wanted %v got %v.", ocspRetryInterval, wait)
+	}
+	if served, _ := s.getCertificate(nil); len(served.OCSPStaple) == 0 {
+		t.Errorf("expected a staple")
+	}
+
+	// it should remove the staple once it has expired
+	s.stapleExpiry = time.Now().Add(-time.Second)
+	tr.refreshOCSPStaple("main", s, 2*time.Hour)
+	if served, _ := s.getCertificate(nil); served.OCSPStaple != nil {
+		t.Errorf("unexpected staple")
+	}
+}
+
+func TestParseOCSPResponse(t *testing.T) {
+	nextUpdate := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	// it should return the next update of a good response
+	if v, err := parseOCSPResponse(newTestOCSPResponse(t, big.NewInt(42), 0, nextUpdate), big.NewInt(42)); err != nil || !v.Equal(nextUpdate) {
+		t.Errorf("unexpected result %v %v", v, err)
+	}
+
+	// it should reject revoked certificates, other certificates, unsuccessful and malformed responses
+	if _, err := parseOCSPResponse(newTestOCSPResponse(t, big.NewInt(42), 1, nextUpdate), big.NewInt(42)); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := parseOCSPResponse(newTestOCSPResponse(t, big.NewInt(42), 0, nextUpdate), big.NewInt(43)); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := parseOCSPResponse([]byte{0x30, 0x03, 0x0a, 0x01, 0x06}, big.NewInt(42)); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := parseOCSPResponse([]byte("not ocsp"), big.NewInt(42)); err == nil {
+		t.Errorf("expected an error")
+	}
+}
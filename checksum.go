@@ -0,0 +1,113 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// checksumMagic marks a cache value that is prefixed with its checksum. Neither JSON nor
+	// snappy-encoded values begin with a NUL byte, so values written before checksums were
+	// introduced are distinguishable and are returned unverified.
+	checksumMagic = "\x00tc1"
+	// checksumHeaderLen is the length of the magic plus the big-endian CRC-32C of the value
+	checksumHeaderLen = len(checksumMagic) + 4
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumCache wraps a Cache, storing a checksum with each value and verifying it on retrieval,
+// so that records damaged by partial or corrupted writes are treated as misses rather than served
+type ChecksumCache struct {
+	Cache
+	T *TricksterHandler
+}
+
+// Store places an object in the cache, prefixed with its checksum
+func (c *ChecksumCache) Store(cacheKey string, data string, ttl int64) error {
+	return c.Cache.Store(cacheKey, addChecksum(data), ttl)
+}
+
+// Retrieve looks for an object in cache and verifies its checksum. A record that fails verification is
+// deleted and reported as a miss.
+func (c *ChecksumCache) Retrieve(cacheKey string) (string, error) {
+	raw, err := c.Cache.Retrieve(cacheKey)
+	if err != nil {
+		return "", err
+	}
+	data, ok := verifyChecksum(raw)
+	if !ok {
+		c.corrupt(cacheKey)
+		return "", classify(ecDecode, fmt.Errorf("Value for key [%s] failed checksum verification", cacheKey))
+	}
+	return data, nil
+}
+
+// Walk calls fn for each unexpired record with a valid checksum, stopping at the first error
+func (c *ChecksumCache) Walk(fn func(CacheObject) error) error {
+	return c.Cache.Walk(func(o CacheObject) error {
+		data, ok := verifyChecksum(o.Value)
+		if !ok {
+			level.Warn(c.T.Logger).Log(lfEvent, "skipping cache record that failed checksum verification", lfCacheKey, o.Key)
+			return nil
+		}
+		o.Value = data
+		return fn(o)
+	})
+}
+
+// corrupt deletes a record that failed checksum verification and counts it
+func (c *ChecksumCache) corrupt(cacheKey string) {
+	level.Warn(c.T.Logger).Log(lfEvent, "cache record failed checksum verification", lfCacheKey, cacheKey)
+	if err := c.Cache.Delete(cacheKey); err != nil {
+		level.Error(c.T.Logger).Log(lfEvent, "unable to delete corrupt cache record", lfCacheKey, cacheKey, lfDetail, err.Error())
+	}
+	if c.T.Metrics != nil {
+		c.T.Metrics.CacheCorruptRecords.WithLabelValues(c.T.Config.Caching.CacheType).Inc()
+	}
+}
+
+// addChecksum returns the value prefixed with the checksum header
+func addChecksum(data string) string {
+	h := make([]byte, checksumHeaderLen)
+	copy(h, checksumMagic)
+	binary.BigEndian.PutUint32(h[len(checksumMagic):], crc32.Checksum([]byte(data), checksumTable))
+	return string(h) + data
+}
+
+// verifyChecksum strips the checksum header from a stored value, returning false if the checksum does not
+// match. Values without a checksum header are returned as-is.
+func verifyChecksum(raw string) (string, bool) {
+	if !strings.HasPrefix(raw, checksumMagic) {
+		// a value truncated partway through its header is corrupt, anything else predates checksums
+		if raw != "" && strings.HasPrefix(checksumMagic, raw) {
+			return "", false
+		}
+		return raw, true
+	}
+	if len(raw) < checksumHeaderLen {
+		return "", false
+	}
+	data := raw[checksumHeaderLen:]
+	if binary.BigEndian.Uint32([]byte(raw[len(checksumMagic):checksumHeaderLen])) != crc32.Checksum([]byte(data), checksumTable) {
+		return "", false
+	}
+	return data, true
+}
@@ -0,0 +1,87 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	stored := addChecksum("data")
+
+	tests := []struct {
+		raw  string
+		data string
+		ok   bool
+	}{
+		{stored, "data", true},
+		// a value without a checksum header predates checksums
+		{`{"status":"success"}`, `{"status":"success"}`, true},
+		{"", "", true},
+		// a flipped byte in the value
+		{stored[:len(stored)-1] + "b", "", false},
+		// a value truncated after its header
+		{stored[:len(stored)-2], "", false},
+		// a value truncated within its header
+		{stored[:3], "", false},
+	}
+
+	for i, test := range tests {
+		data, ok := verifyChecksum(test.raw)
+		if ok != test.ok || data != test.data {
+			t.Errorf("test %d: wanted (%q, %t) got (%q, %t).", i, test.data, test.ok, data, ok)
+		}
+	}
+}
+
+func TestChecksumCache_Retrieve(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.Connect()
+	mc.T.Metrics = newApplicationMetrics(mc.T.Config, prometheus.NewRegistry())
+	mc.T.Config.Caching.CacheType = ctMemory
+	cc := &ChecksumCache{Cache: &mc, T: mc.T}
+
+	cc.Store("good", "data", 600)
+
+	// it should return the stored value without its checksum
+	data, err := cc.Retrieve("good")
+	if err != nil {
+		t.Error(err)
+	}
+	if data != "data" {
+		t.Errorf("wanted %q got %q.", "data", data)
+	}
+
+	// corrupt the stored record underneath the checksum cache
+	raw, _ := mc.Retrieve("good")
+	mc.Store("good", raw[:len(raw)-1]+"X", 600)
+
+	// it should treat a corrupt record as a miss
+	if _, err := cc.Retrieve("good"); err == nil {
+		t.Errorf("expected error for corrupt record")
+	}
+
+	// it should delete the corrupt record
+	if _, err := mc.Retrieve("good"); err == nil {
+		t.Errorf("expected corrupt record to be deleted")
+	}
+
+	// it should count the corrupt record
+	if v := testutil.ToFloat64(mc.T.Metrics.CacheCorruptRecords.WithLabelValues(ctMemory)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+}
@@ -0,0 +1,160 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// lsClientConcurrency is the reason of requests shed because their client reached its concurrency limit
+	lsClientConcurrency = "client_concurrency"
+
+	// maxTrackedClients bounds the number of clients accounted at once. Idle clients are forgotten beyond it
+	maxTrackedClients = 10000
+
+	defaultClientsLimit = 100
+)
+
+// clientIdentityKey is the request context key of the identity of the client that made the request
+type clientIdentityKey struct{}
+
+// clientAccount accounts the proxied requests of a client
+type clientAccount struct {
+	inFlight      int
+	requests      int64
+	shed          int64
+	upstreamBytes int64
+	lastSeen      time.Time
+}
+
+// clientIdentity returns the identity of the client of the request: the value of the configured identity header,
+// when set, and otherwise its client IP
+func (t *TricksterHandler) clientIdentity(r *http.Request) string {
+	if h := t.Config.LoadShedding.ClientIdentityHeader; h != "" {
+		if v := r.Header.Get(h); v != "" {
+			return v
+		}
+	}
+	return t.TrustedProxies.clientIP(r)
+}
+
+// account returns the account of the client, opening one if needed. s.mu must be held.
+func (s *LoadShedder) account(client string) *clientAccount {
+	a, ok := s.clients[client]
+	if !ok {
+		if len(s.clients) >= maxTrackedClients {
+			s.forgetIdleClients()
+		}
+		a = &clientAccount{}
+		s.clients[client] = a
+	}
+	a.lastSeen = time.Now()
+	return a
+}
+
+// forgetIdleClients forgets the clients without requests in flight that were seen least recently, until a tenth of
+// the tracked clients are forgotten. s.mu must be held.
+func (s *LoadShedder) forgetIdleClients() {
+	idle := make([]string, 0, len(s.clients))
+	for client, a := range s.clients {
+		if a.inFlight == 0 {
+			idle = append(idle, client)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return s.clients[idle[i]].lastSeen.Before(s.clients[idle[j]].lastSeen) })
+	n := len(s.clients) / 10
+	if n > len(idle) {
+		n = len(idle)
+	}
+	for _, client := range idle[:n] {
+		delete(s.clients, client)
+	}
+}
+
+// shed accounts a shed request of the client
+func (s *LoadShedder) shed(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.account(client).shed++
+}
+
+// addUpstreamBytes accounts n bytes read from the origins on behalf of the client of the request
+func (s *LoadShedder) addUpstreamBytes(r *http.Request, n int64) {
+	if s == nil || r == nil {
+		return
+	}
+	client, ok := r.Context().Value(clientIdentityKey{}).(string)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.account(client).upstreamBytes += n
+}
+
+// clientStatus describes the accounted requests of a client
+type clientStatus struct {
+	Client        string `json:"client"`
+	InFlight      int    `json:"inFlight"`
+	Requests      int64  `json:"requests"`
+	Shed          int64  `json:"shed"`
+	UpstreamBytes int64  `json:"upstreamBytes"`
+	LastSeen      int64  `json:"lastSeen"`
+}
+
+// clientStatuses returns the status of up to limit clients, those that read the most bytes from the origins first
+func (s *LoadShedder) clientStatuses(limit int) []clientStatus {
+	s.mu.Lock()
+	statuses := make([]clientStatus, 0, len(s.clients))
+	for client, a := range s.clients {
+		statuses = append(statuses, clientStatus{Client: client, InFlight: a.inFlight, Requests: a.requests,
+			Shed: a.shed, UpstreamBytes: a.upstreamBytes, LastSeen: a.lastSeen.Unix()})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].UpstreamBytes != statuses[j].UpstreamBytes {
+			return statuses[i].UpstreamBytes > statuses[j].UpstreamBytes
+		}
+		return statuses[i].Client < statuses[j].Client
+	})
+	if len(statuses) > limit {
+		statuses = statuses[:limit]
+	}
+	return statuses
+}
+
+// clientsHandler handles calls to /trickster/clients?limit=..., which reports the accounted requests of the clients
+// that read the most bytes from the origins as JSON
+func (t *TricksterHandler) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	limit := defaultClientsLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	statuses := []clientStatus{}
+	if t.LoadShedder != nil {
+		statuses = t.LoadShedder.clientStatuses(limit)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statuses)
+}
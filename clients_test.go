@@ -0,0 +1,147 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadShedder_admit_clientConcurrency(t *testing.T) {
+	s := NewLoadShedder(LoadSheddingConfig{MaxClientConcurrentRequests: 1}, nil)
+
+	release, reason := s.admit(context.Background(), s.defaultClass, "script")
+	if reason != "" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+
+	// it should limit the concurrency of each client, leaving the others unaffected
+	if _, reason := s.admit(context.Background(), s.defaultClass, "script"); reason != lsClientConcurrency {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if r, reason := s.admit(context.Background(), s.defaultClass, "user"); reason != "" {
+		t.Errorf("unexpected reason %q", reason)
+	} else {
+		r()
+	}
+	release()
+	if r, reason := s.admit(context.Background(), s.defaultClass, "script"); reason != "" {
+		t.Errorf("unexpected reason %q", reason)
+	} else {
+		r()
+	}
+
+	statuses := s.clientStatuses(10)
+	if len(statuses) != 2 || statuses[0].Client != "script" || statuses[0].Requests != 2 || statuses[0].Shed != 1 ||
+		statuses[0].InFlight != 0 {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+}
+
+func TestLoadShedder_forgetIdleClients(t *testing.T) {
+	s := NewLoadShedder(LoadSheddingConfig{}, nil)
+	base := time.Now()
+	for i := 0; i < 20; i++ {
+		s.clients[fmt.Sprintf("client%d", i)] = &clientAccount{lastSeen: base.Add(time.Duration(i) * time.Second)}
+	}
+	s.clients["client0"].inFlight = 1
+
+	// it should forget the idle clients seen least recently
+	s.forgetIdleClients()
+	if len(s.clients) != 18 {
+		t.Errorf("wanted %d got %d.", 18, len(s.clients))
+	}
+	for _, client := range []string{"client0", "client3"} {
+		if _, ok := s.clients[client]; !ok {
+			t.Errorf("expected %s to be tracked", client)
+		}
+	}
+	for _, client := range []string{"client1", "client2"} {
+		if _, ok := s.clients[client]; ok {
+			t.Errorf("expected %s to be forgotten", client)
+		}
+	}
+}
+
+func TestTricksterHandler_clientsHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	body := `{"status":"success","data":["up"]}`
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	tr.Config.LoadShedding = LoadSheddingConfig{ClientIdentityHeader: "X-User", MaxClientConcurrentRequests: 1}
+	tr.LoadShedder = NewLoadShedder(tr.Config.LoadShedding, tr.Metrics)
+	router := tr.newRouter()
+	admin := tr.newAdminRouter()
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://trickster"+path, nil)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		if strings.HasPrefix(path, adminPathPrefix) {
+			admin.ServeHTTP(w, r)
+		} else {
+			router.ServeHTTP(w, r)
+		}
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get("/api/v1/label/__name__/values", "alice"); w.Code != http.StatusOK {
+			t.Errorf("wanted %d got %d.", http.StatusOK, w.Code)
+		}
+	}
+	get("/api/v1/label/__name__/values", "")
+
+	// it should shed the requests of a client at its concurrency limit
+	release, _ := tr.LoadShedder.admit(context.Background(), tr.LoadShedder.defaultClass, "bob")
+	if w := get("/api/v1/label/__name__/values", "bob"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, w.Code)
+	}
+	release()
+	if v := testutil.ToFloat64(tr.Metrics.RequestsShed.WithLabelValues(lsDefaultClass, lsClientConcurrency)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+
+	// it should report the clients that read the most from the origins first
+	w := get("/trickster/clients?limit=2", "")
+	var statuses []clientStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("unexpected statuses %v", statuses)
+	}
+	if s := statuses[0]; s.Client != "alice" || s.Requests != 2 || s.UpstreamBytes != int64(2*len(body)) {
+		t.Errorf("unexpected status %v", s)
+	}
+	if s := statuses[1]; s.Client != "192.0.2.1" || s.UpstreamBytes != int64(len(body)) {
+		t.Errorf("unexpected status %v", s)
+	}
+}
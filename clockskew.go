@@ -0,0 +1,123 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	hnDate = "Date"
+
+	// clockOffsetAlpha is the weight given to each new sample in the clock offset EWMA
+	clockOffsetAlpha = 0.2
+	// clockOffsetWarnMS is the absolute offset beyond which a clock skew warning is logged
+	clockOffsetWarnMS = 1000
+)
+
+// ClockOffsets tracks an exponentially-weighted moving average of the offset between each origin's clock
+// (as reported in its Date response header) and the local clock
+type ClockOffsets struct {
+	mtx     sync.Mutex
+	offsets map[string]float64
+	warned  map[string]bool
+}
+
+// NewClockOffsets returns an empty ClockOffsets
+func NewClockOffsets() *ClockOffsets {
+	return &ClockOffsets{offsets: make(map[string]float64), warned: make(map[string]bool)}
+}
+
+// Offset returns the measured clock offset of the origin in milliseconds. Positive values mean the origin is ahead.
+func (c *ClockOffsets) Offset(originURL string) int64 {
+	if c == nil {
+		return 0
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return int64(c.offsets[originURL])
+}
+
+// observe folds a new offset sample (in milliseconds) for the origin into the moving average and returns the
+// new average, and whether the average has just crossed the warning threshold
+func (c *ClockOffsets) observe(originURL string, sampleMS float64) (float64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	avg, ok := c.offsets[originURL]
+	if !ok {
+		avg = sampleMS
+	} else {
+		avg = clockOffsetAlpha*sampleMS + (1-clockOffsetAlpha)*avg
+	}
+	c.offsets[originURL] = avg
+
+	skewed := math.Abs(avg) > clockOffsetWarnMS
+	crossed := skewed != c.warned[originURL]
+	c.warned[originURL] = skewed
+
+	return avg, crossed && skewed
+}
+
+// recordClockOffset measures the origin's clock offset from the Date header of the response, relative to the midpoint
+// of the request, and updates the moving average for the origin
+func (t *TricksterHandler) recordClockOffset(o PrometheusOriginConfig, resp *http.Response, sent time.Time, received time.Time) {
+	if t.ClockOffsets == nil || resp == nil {
+		return
+	}
+
+	d := resp.Header.Get(hnDate)
+	if d == "" {
+		return
+	}
+	originTime, err := http.ParseTime(d)
+	if err != nil {
+		return
+	}
+
+	// The Date header has a resolution of one second, so compare it to the midpoint of the request
+	// truncated the same way. The moving average smooths out the remaining jitter.
+	local := sent.Add(received.Sub(sent) / 2).Truncate(time.Second)
+	avg, crossed := t.ClockOffsets.observe(o.baseURL(), float64(originTime.Sub(local)/time.Millisecond))
+
+	if t.Metrics != nil {
+		t.Metrics.OriginClockOffset.WithLabelValues(o.baseURL()).Set(avg / 1000)
+	}
+
+	if crossed {
+		t.originLog(o, level.Warn, "origin clock offset detected").Log("offsetMS", int64(avg), "compensating", o.ClockSkewCompensation)
+	}
+}
+
+// baseURL returns the URL of the origin, without the API path that the range query handlers append to it, so that
+// the clock of an origin is tracked once whichever requests measure it
+func (o PrometheusOriginConfig) baseURL() string {
+	return strings.TrimSuffix(o.OriginURL, strings.Replace(o.APIPath+"/", "//", "/", 1))
+}
+
+// originNow returns the current time in epoch seconds as measured by the origin's clock when clock skew compensation
+// is enabled for the origin, and by the local clock otherwise
+func (t *TricksterHandler) originNow(o PrometheusOriginConfig) int64 {
+	now := time.Now()
+	if o.ClockSkewCompensation {
+		now = now.Add(time.Duration(t.ClockOffsets.Offset(o.baseURL())) * time.Millisecond)
+	}
+	return now.Unix()
+}
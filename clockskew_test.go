@@ -0,0 +1,85 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClockOffsets_observe(t *testing.T) {
+	c := NewClockOffsets()
+
+	// the first sample should seed the average and report crossing the warning threshold
+	avg, crossed := c.observe("origin", 5000)
+	if avg != 5000 || !crossed {
+		t.Errorf("wanted 5000/true got %v/%v", avg, crossed)
+	}
+
+	// subsequent samples should be smoothed, and not re-warn
+	avg, crossed = c.observe("origin", 0)
+	if avg != 4000 || crossed {
+		t.Errorf("wanted 4000/false got %v/%v", avg, crossed)
+	}
+
+	if c.Offset("origin") != 4000 {
+		t.Errorf("wanted 4000 got %d", c.Offset("origin"))
+	}
+	if c.Offset("other") != 0 {
+		t.Errorf("wanted 0 got %d", c.Offset("other"))
+	}
+}
+
+func TestTricksterHandler_recordClockOffset(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.ClockOffsets = NewClockOffsets()
+
+	o := tr.Config.Origins["default"]
+	now := time.Now()
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(hnDate, now.Add(time.Minute).UTC().Format(http.TimeFormat))
+
+	// it should measure the origin as being a minute ahead
+	tr.recordClockOffset(o, resp, now, now)
+	if offset := tr.ClockOffsets.Offset(o.OriginURL); offset < 59000 || offset > 61000 {
+		t.Errorf("wanted ~60000 got %d", offset)
+	}
+
+	// it should only apply the offset when compensation is enabled
+	if n := tr.originNow(o); n > time.Now().Unix()+1 {
+		t.Errorf("expected local time without compensation, got %d", n)
+	}
+	o.ClockSkewCompensation = true
+	if n := tr.originNow(o); n < time.Now().Unix()+58 {
+		t.Errorf("expected origin time with compensation, got %d", n)
+	}
+
+	// it should track the offset of an origin once, whether measured by range queries or others
+	ro := o
+	ro.OriginURL = ro.apiURL()
+	if n := tr.originNow(ro); n < time.Now().Unix()+58 {
+		t.Errorf("expected origin time with compensation, got %d", n)
+	}
+	tr.recordClockOffset(ro, resp, now, now)
+	if v := testutil.ToFloat64(tr.Metrics.OriginClockOffset.WithLabelValues(o.OriginURL)); v < 59 || v > 61 {
+		t.Errorf("wanted ~60 got %v", v)
+	}
+	if tr.Metrics.OriginClockOffset.DeleteLabelValues(ro.OriginURL) {
+		t.Errorf("unexpected offset labeled with the origin's API URL")
+	}
+}
@@ -0,0 +1,142 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// Compression codec names
+	czSnappy = "snappy"
+	czGzip   = "gzip"
+	// czNone disables compression for an origin
+	czNone = "none"
+)
+
+// compressionCodec compresses and decompresses cached data sets
+type compressionCodec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+	// Detect returns true if data appears to have been encoded by the codec
+	Detect(data []byte) bool
+}
+
+// compressionCodecs are the available compression codecs by name
+var compressionCodecs = map[string]compressionCodec{
+	czSnappy: snappyCodec{},
+	czGzip:   gzipCodec{},
+	czLZ4:    lz4Codec{},
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Decode(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// Detect always returns true, since snappy blocks have no header to check. The snappy codec is
+// therefore the fallback when no other codec recognizes the data.
+func (snappyCodec) Detect(data []byte) bool {
+	return true
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (gzipCodec) Detect(data []byte) bool {
+	return len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// compressCacheBody compresses a data set of the provided object type (query or query_range) for the cache with the
+// codec configured for the origin. Data sets smaller than the compression threshold, and object types that are not
+// configured for compression, are returned unchanged, since compressing them costs more CPU than it saves space.
+func (t *TricksterHandler) compressCacheBody(o PrometheusOriginConfig, objectType string, data []byte) ([]byte, error) {
+	c := t.Config.Caching
+	if !c.Compression || int64(len(data)) < c.CompressionMinBytes || !c.compresses(objectType) {
+		return data, nil
+	}
+
+	name := c.CompressionCodec
+	if o.CompressionCodec != "" {
+		name = o.CompressionCodec
+	}
+	if name == czNone {
+		return data, nil
+	}
+
+	codec, ok := compressionCodecs[name]
+	if !ok {
+		codec = compressionCodecs[czSnappy]
+	}
+	return codec.Encode(data)
+}
+
+// compresses returns true if cached data sets of the object type should be compressed. Only query_range
+// data sets are compressed when no types are configured.
+func (c CachingConfig) compresses(objectType string) bool {
+	if len(c.CompressionTypes) == 0 {
+		return objectType == mnQueryRange
+	}
+	for _, t := range c.CompressionTypes {
+		if t == objectType {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressCacheBody returns a cached data set in its uncompressed form. The codec is detected from the
+// data itself rather than the configuration, since the cache may hold data compressed with a previously
+// configured codec, or not compressed at all.
+func decompressCacheBody(data []byte) ([]byte, error) {
+	// uncompressed JSON starts with "{"
+	if len(data) == 0 || data[0] == '{' {
+		return data, nil
+	}
+	for _, name := range []string{czGzip, czLZ4} {
+		if codec := compressionCodecs[name]; codec.Detect(data) {
+			return codec.Decode(data)
+		}
+	}
+	return compressionCodecs[czSnappy].Decode(data)
+}
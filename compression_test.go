@@ -0,0 +1,132 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecompressCacheBody(t *testing.T) {
+	body := []byte(exampleRangeResponse)
+
+	// it should pass uncompressed data through
+	data, err := decompressCacheBody(body)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != exampleRangeResponse {
+		t.Errorf("wanted %q got %q.", exampleRangeResponse, string(data))
+	}
+
+	// it should detect and decode each codec
+	for name, codec := range compressionCodecs {
+		encoded, err := codec.Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := decompressCacheBody(encoded)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if string(data) != exampleRangeResponse {
+			t.Errorf("%s: wanted %q got %q.", name, exampleRangeResponse, string(data))
+		}
+	}
+}
+
+func TestTricksterHandler_compressCacheBody(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	large := []byte(strings.Repeat(exampleRangeResponse, 10))
+	o := PrometheusOriginConfig{}
+
+	// it should use the configured codec
+	tr.Config.Caching.CompressionCodec = czGzip
+	data, err := tr.compressCacheBody(o, mnQueryRange, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compressionCodecs[czGzip].Detect(data) {
+		t.Errorf("expected gzip encoded data")
+	}
+
+	// it should not compress data sets below the threshold
+	data, _ = tr.compressCacheBody(o, mnQueryRange, []byte(exampleRangeResponse))
+	if string(data) != exampleRangeResponse {
+		t.Errorf("expected small data set to be uncompressed")
+	}
+
+	// it should not compress object types that are not configured for compression
+	data, _ = tr.compressCacheBody(o, mnQuery, large)
+	if string(data) != string(large) {
+		t.Errorf("expected query data set to be uncompressed")
+	}
+	tr.Config.Caching.CompressionTypes = []string{mnQuery, mnQueryRange}
+	data, _ = tr.compressCacheBody(o, mnQuery, large)
+	if string(data) == string(large) {
+		t.Errorf("expected query data set to be compressed")
+	}
+
+	// it should use the origin's codec override
+	o.CompressionCodec = czSnappy
+	data, _ = tr.compressCacheBody(o, mnQueryRange, large)
+	if compressionCodecs[czGzip].Detect(data) || string(data) == string(large) {
+		t.Errorf("expected snappy encoded data")
+	}
+	o.CompressionCodec = czNone
+	data, _ = tr.compressCacheBody(o, mnQueryRange, large)
+	if string(data) != string(large) {
+		t.Errorf("expected origin with compression_codec none to be uncompressed")
+	}
+}
+
+func TestConfig_validate_compressionCodec(t *testing.T) {
+	c := NewConfig()
+	c.Caching.CompressionCodec = "lzma"
+
+	// it should reject unknown codecs
+	if err := c.validate(); err == nil {
+		t.Errorf("expected error for unknown compression_codec")
+	}
+
+	c = NewConfig()
+	c.Origins["default"] = PrometheusOriginConfig{CompressionCodec: "lzma"}
+	if err := c.validate(); err == nil {
+		t.Errorf("expected error for unknown origin compression_codec")
+	}
+
+	c = NewConfig()
+	c.Caching.CompressionTypes = []string{"labels"}
+	if err := c.validate(); err == nil {
+		t.Errorf("expected error for unknown compression_types entry")
+	}
+}
+
+func benchmarkCodec(b *testing.B, name string) {
+	codec := compressionCodecs[name]
+	body := []byte(strings.Repeat(exampleRangeResponse, 100))
+	var encoded []byte
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		encoded, _ = codec.Encode(body)
+		codec.Decode(encoded)
+	}
+	b.ReportMetric(float64(len(encoded))/float64(len(body)), "ratio")
+}
+
+func BenchmarkCodec_snappy(b *testing.B) { benchmarkCodec(b, czSnappy) }
+func BenchmarkCodec_gzip(b *testing.B)   { benchmarkCodec(b, czGzip) }
+func BenchmarkCodec_lz4(b *testing.B)    { benchmarkCodec(b, czLZ4) }
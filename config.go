@@ -13,18 +13,27 @@
 
 package main
 
-import "github.com/BurntSushi/toml"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
 
 // Config is the main configuration object
 type Config struct {
+	Admin            AdminConfig                       `toml:"admin"`
 	Caching          CachingConfig                     `toml:"cache"`
+	Control          ControlConfig                     `toml:"control"`
 	DefaultOriginURL string                            // to capture a CLI origin url
 	Logging          LoggingConfig                     `toml:"logging"`
+	LoadShedding     LoadSheddingConfig                `toml:"load_shedding"`
 	Main             GeneralConfig                     `toml:"main"`
 	Metrics          MetricsConfig                     `toml:"metrics"`
 	Profiler         ProfilerConfig                    `toml:"profiler"`
 	Origins          map[string]PrometheusOriginConfig `toml:"origins"`
 	ProxyServer      ProxyServerConfig                 `toml:"proxy_server"`
+	Stats            StatsConfig                       `toml:"stats"`
 	TLS              TLSConfig                         `toml:"tls"`
 }
 
@@ -38,6 +47,20 @@ type GeneralConfig struct {
 	ConfigFile string
 	// Hostname is populated with the self-resolved Hostname where the instance is running
 	Hostname string
+	// MaxResidentBytes is the global memory budget shared by the memory cache, upstream response buffers
+	// and in-flight merges. When the budget is exhausted, new requests are refused with a 503. 0 is unlimited
+	MaxResidentBytes int64 `toml:"max_resident_bytes"`
+	// MemoryRetryAfterSecs is the Retry-After value sent to clients that are refused due to the memory budget
+	MemoryRetryAfterSecs int `toml:"memory_retry_after_secs"`
+	// StartupWaitSecs retries connecting to the cache at startup, and waits for the origins when StartupCheckOrigins is
+	// set, for up to this long before the listeners are started. 0 makes a single attempt
+	StartupWaitSecs int64 `toml:"startup_wait_secs"`
+	// StartupCheckOrigins waits at startup for every origin to pass its health check. Origins still failing after
+	// StartupWaitSecs are logged, and the instance starts anyway
+	StartupCheckOrigins bool `toml:"startup_check_origins"`
+	// StartupDegraded starts the instance when the cache is still unreachable after StartupWaitSecs, proxying all
+	// requests without caching until it can be connected, instead of exiting
+	StartupDegraded bool `toml:"startup_degraded"`
 }
 
 // ProxyServerConfig is a collection of configurations for the main http listener for the application
@@ -46,6 +69,52 @@ type ProxyServerConfig struct {
 	ListenAddress string `toml:"listen_address"`
 	// ListenPort is TCP Port for the main http listener for the application
 	ListenPort int `toml:"listen_port"`
+	// TrustedProxies is a list of IP addresses and CIDR blocks of proxies in front of Trickster whose
+	// X-Forwarded-For and Forwarded headers are trusted when determining the real client IP
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// UnmatchedOriginPolicy controls requests that name no configured origin: "default" (proxy to the default origin),
+	// "not_found" (404), "misdirected" (421) or "redirect"
+	UnmatchedOriginPolicy string `toml:"unmatched_origin_policy"`
+	// UnmatchedOriginBody is the template of the body of not_found and misdirected responses
+	UnmatchedOriginBody string `toml:"unmatched_origin_body"`
+	// UnmatchedOriginRedirectURL is the template of the url that the redirect policy redirects to
+	UnmatchedOriginRedirectURL string `toml:"unmatched_origin_redirect_url"`
+
+	// KeepAlivePeriodSecs is the TCP keepalive period of client connections to the main listener. Default is Go's
+	// (15s), and a negative value disables keepalives
+	KeepAlivePeriodSecs int64 `toml:"keepalive_period_secs"`
+	// ReadBufferBytes and WriteBufferBytes set the socket buffer sizes of client connections to the main listener.
+	// Default is the operating system's
+	ReadBufferBytes  int `toml:"read_buffer_bytes"`
+	WriteBufferBytes int `toml:"write_buffer_bytes"`
+	// ProxyProtocol requires connections to the main listener from the ProxyProtocolSources to begin with an HAProxy
+	// PROXY protocol header, whose source address is used as the client's
+	ProxyProtocol bool `toml:"proxy_protocol"`
+	// ProxyProtocolSources lists the IP addresses and CIDR blocks of the load balancers that send PROXY protocol
+	// headers. When empty, every connection must send one
+	ProxyProtocolSources []string `toml:"proxy_protocol_sources"`
+
+	// Listeners are additional listeners of the Proxy server, each with its own address, TLS settings and origins
+	Listeners []ListenerConfig `toml:"listeners"`
+
+	// Middlewares is the ordered middleware chain of proxied routes, outermost first. Middlewares left out are
+	// disabled. Default is every middleware, in the order of defaultMiddlewares
+	Middlewares []string `toml:"middlewares"`
+}
+
+// AdminConfig is a collection of configurations for the optional dedicated admin listener, which serves /ping,
+// the /trickster/ administrative endpoints and the profiler apart from the port that dashboards talk to
+type AdminConfig struct {
+	// ListenAddress is IP address for the admin http listener
+	ListenAddress string `toml:"listen_address"`
+	// ListenPort is TCP Port for the admin http listener. 0 serves the admin endpoints on the main listener
+	ListenPort int `toml:"listen_port"`
+	// TLS configures TLS for the admin http listener
+	TLS TLSConfig `toml:"tls"`
+	// Username and Password, when set, require HTTP Basic Authentication for the admin http listener
+	Username string `toml:"username"`
+	Password string `toml:"password"`
 }
 
 // CachingConfig is a collection of defining the Trickster Caching Behavior
@@ -58,6 +127,39 @@ type CachingConfig struct {
 	ReapSleepMS   int64                 `toml:"reap_sleep_ms"`
 	Compression   bool                  `toml:"compression"`
 	BoltDB        BoltDBCacheConfig     `toml:"boltdb"`
+
+	// CompressionCodec is the codec used to compress cached data sets when Compression is enabled: "snappy", "gzip" or "lz4"
+	CompressionCodec string `toml:"compression_codec"`
+	// CompressionMinBytes is the size below which cached data sets are stored uncompressed
+	CompressionMinBytes int64 `toml:"compression_min_bytes"`
+	// CompressionTypes lists the object types whose cached data sets are compressed: "query_range" and "query"
+	CompressionTypes []string `toml:"compression_types"`
+	// Memory configures the In-Memory Cache
+	Memory MemoryCacheConfig `toml:"memory"`
+	// AsyncWrites queues cache writes to background workers so that responses are not delayed by the cache backend
+	AsyncWrites bool `toml:"async_writes"`
+	// AsyncWriteWorkers is the number of background workers writing to the cache when AsyncWrites is enabled
+	AsyncWriteWorkers int `toml:"async_write_workers"`
+	// AsyncWriteQueueSize is the number of cache writes that can be queued before new writes are dropped
+	AsyncWriteQueueSize int `toml:"async_write_queue_size"`
+	// Handoff configures the handoff of the most recently used records when the process is asked to terminate
+	Handoff HandoffConfig `toml:"handoff"`
+	// Events emits an event for each change to the cache, for external systems to mirror or audit
+	Events CacheEventsConfig `toml:"events"`
+	// Invalidation subscribes to the invalidation messages of a central controller
+	Invalidation InvalidationConfig `toml:"invalidation"`
+	// Snapshots configures the immutable snapshots of query responses taken at /trickster/snapshots
+	Snapshots SnapshotsConfig `toml:"snapshots"`
+	// Tiered places a cache of another type in front of the configured cache
+	Tiered TieredCacheConfig `toml:"tiered"`
+	// Stampede protects the origins from concurrent requests for popular records that are missing or expired
+	Stampede StampedeConfig `toml:"stampede"`
+}
+
+// MemoryCacheConfig is a collection of Configurations for the In-Memory Cache
+type MemoryCacheConfig struct {
+	// Shards is the number of independently locked partitions of the In-Memory Cache. Default is 64
+	Shards int `toml:"shards"`
 }
 
 // RedisCacheConfig is a collection of Configurations for Connecting to Redis
@@ -76,6 +178,12 @@ type BoltDBCacheConfig struct {
 	Filename string `toml:"filename"`
 	// Bucket represents the name of the bucket within BoltDB under which Trickster's keys will be stored.
 	Bucket string `toml:"bucket"`
+	// CompactionIntervalSecs is how often the database file is checked for compaction. 0 disables compaction
+	CompactionIntervalSecs int64 `toml:"compaction_interval_secs"`
+	// CompactionMinFreeRatio is the fraction of the database file that must be free pages before it is compacted
+	CompactionMinFreeRatio float64 `toml:"compaction_min_free_ratio"`
+	// CompactionMinBytes is the size the database file must reach before it is compacted
+	CompactionMinBytes int64 `toml:"compaction_min_bytes"`
 }
 
 // FilesystemCacheConfig is a collection of Configurations for storing cached data on the Filesystem
@@ -94,6 +202,162 @@ type PrometheusOriginConfig struct {
 	FastForwardDisable  bool   `toml:"fast_forward_disable"`
 	NoCacheLastDataSecs int64  `toml:"no_cache_last_data_secs"`
 	TimeoutSecs         int64  `toml:"timeout_secs"`
+	// OriginType is "prometheus" (default), "federated" for a virtual origin that fans queries out to its Members, or
+	// "sql_gateway" for a PostgREST-style HTTP gateway in front of a SQL database such as TimescaleDB
+	OriginType string `toml:"origin_type"`
+	// Members lists the names of the origins that a federated origin fans queries out to
+	Members []string `toml:"members"`
+	// FederationLabel is the label injected into each series of a federated origin to identify its member origin. Default is "origin"
+	FederationLabel string `toml:"federation_label"`
+	// AllowClientRefresh lets clients send a cache directive ("refresh" or "bypass") for a single request
+	// via the RefreshParam url parameter or the RefreshHeader request header
+	AllowClientRefresh bool `toml:"allow_client_refresh"`
+	// RefreshParam is the name of the cache directive url parameter. Default is "trickster"
+	RefreshParam string `toml:"refresh_param"`
+	// RefreshHeader is the name of the cache directive request header. Default is "X-Trickster-Cache"
+	RefreshHeader string `toml:"refresh_header"`
+	// AllowTimePinning lets clients pin the time that a request is resolved at, with the X-Trickster-Now request header
+	// or trickster_now url parameter, so that a dashboard can be replayed as it was at that time
+	AllowTimePinning bool `toml:"allow_time_pinning"`
+	// ShardDurationSecs splits range queries spanning more than this many seconds into parallel sub-range
+	// queries that are merged before caching. 0 disables sharding
+	ShardDurationSecs int64 `toml:"shard_duration_secs"`
+	// ShardMaxParallelism limits the number of shards of a single range query that are fetched concurrently
+	ShardMaxParallelism int `toml:"shard_max_parallelism"`
+	// RawStepSecs, when set, caches range queries whose step is a multiple of it at this raw resolution, sharing
+	// one cache entry across steps and re-bucketing to the requested step when responding. 0 disables sharing
+	RawStepSecs int64 `toml:"raw_step_secs"`
+	// TTLBuckets scales the cache record TTL of range queries with the requested range. When empty, cache.record_ttl_secs is used
+	TTLBuckets []TTLBucket `toml:"ttl_buckets"`
+	// ResolutionTiers describe the coarser resolutions the origin serves older data at, so that cached points are
+	// fetched again once they age into a tier, rather than merged with the points at its resolution
+	ResolutionTiers []ResolutionTier `toml:"resolution_tiers"`
+	// APIShim translates the requests of an older API version to the origin's API, and its responses back, so that
+	// clients of the older API keep working after the origin is upgraded: "prometheus_legacy". Default is none
+	APIShim string `toml:"api_shim"`
+	// Relabel is an ordered list of Prometheus-style relabeling rules applied to series before they are returned to the client
+	Relabel []RelabelConfig `toml:"relabel"`
+	// Transform describes value post-processing (unit scaling, clamping, gap filling) applied to series before they are returned to the client
+	Transform TransformConfig `toml:"transform"`
+	// Diagnostics returns per-request cache and upstream diagnostics for range queries to the client, as "headers" or as a "trailer"
+	Diagnostics string `toml:"diagnostics"`
+	// RequestHeaders controls which client request headers are forwarded to the origin
+	RequestHeaders HeaderScrubConfig `toml:"request_headers"`
+	// ResponseHeaders modifies the headers of responses returned to clients
+	ResponseHeaders ResponseHeaderPolicy `toml:"response_headers"`
+	// XForwardedHeaders controls the X-Forwarded-For/Proto/Host headers sent to the origin: "omit" (default), "append" or "replace"
+	XForwardedHeaders string `toml:"x_forwarded_headers"`
+	// ForwardedHeader controls the RFC 7239 Forwarded header sent to the origin: "omit" (default), "append" or "replace"
+	ForwardedHeader string `toml:"forwarded_header"`
+	// ClockSkewCompensation adjusts extent boundaries and fast forward windows by the measured offset of the origin's clock
+	ClockSkewCompensation bool `toml:"clock_skew_compensation"`
+	// CompressionCodec overrides cache.compression_codec for this origin's data sets, or disables compression with "none"
+	CompressionCodec string `toml:"compression_codec"`
+	// FidelityCheckSampleRate is the fraction (0 to 1) of range queries served from the cache that are also fetched from
+	// the origin in the background and compared point-by-point with the cached data. 0 disables fidelity checks
+	FidelityCheckSampleRate float64 `toml:"fidelity_check_sample_rate"`
+	// FidelityCheckTolerance is the relative difference (e.g., 0.001 for 0.1%) within which a cached value matches the
+	// origin's in fidelity checks. 0 requires values to be identical
+	FidelityCheckTolerance float64 `toml:"fidelity_check_tolerance"`
+	// FidelityCheckCounts also compares the number of points of each series in fidelity checks, and the series present
+	FidelityCheckCounts bool `toml:"fidelity_check_counts"`
+	// UseClientTimeout limits upstream requests to the time remaining of the client's Prometheus timeout parameter
+	UseClientTimeout bool `toml:"use_client_timeout"`
+	// ClientTimeoutHeader is the name of a request header carrying the client's timeout or deadline, which limits
+	// upstream requests to the time remaining
+	ClientTimeoutHeader string `toml:"client_timeout_header"`
+	// MaxConnsPerHost limits the connections to the origin, including those in use. 0 is unlimited
+	MaxConnsPerHost int `toml:"max_conns_per_host"`
+	// MaxIdleConnsPerHost is the number of idle connections to the origin kept for reuse. 0 uses Go's default of 2
+	MaxIdleConnsPerHost int `toml:"max_idle_conns_per_host"`
+	// TLSSessionCacheSize is the number of TLS sessions to the origin cached for resumption. 0 disables resumption
+	TLSSessionCacheSize int `toml:"tls_session_cache_size"`
+	// DialKeepAliveSecs is the TCP keep-alive period of connections to the origin. Default is 30
+	DialKeepAliveSecs int64 `toml:"dial_keep_alive_secs"`
+	// DNSResolvers lists the name servers (host:port) used to resolve the origin's host, instead of the system's
+	DNSResolvers []string `toml:"dns_resolvers"`
+	// DNSRefreshSecs closes idle connections to the origin at this interval, so that new connections re-resolve its
+	// host and follow DNS changes. 0 keeps idle connections until they time out
+	DNSRefreshSecs int64 `toml:"dns_refresh_secs"`
+	// DNSPins maps hostnames to the IP addresses that connections to them are made to, without resolving them
+	DNSPins map[string]string `toml:"dns_pins"`
+	// ProxyURL is the outbound proxy (http, https, socks5 or socks5h URL, with optional user:password) that connections
+	// to the origin are made through, instead of the proxy configured by the HTTP_PROXY environment variables
+	ProxyURL string `toml:"proxy_url"`
+	// HedgeDelayMS sends an identical request to a replica of the origin when it has not responded within this delay,
+	// and uses whichever response arrives first. Only GET and HEAD requests are hedged. 0 disables hedging
+	HedgeDelayMS int64 `toml:"hedge_delay_ms"`
+	// HedgeOriginURLs are the replicas (scheme://host:port) that hedged requests are sent to. Default is the origin
+	HedgeOriginURLs []string `toml:"hedge_origin_urls"`
+	// Discovery discovers the replicas that hedged requests are sent to from DNS SRV records or the Consul catalog,
+	// in place of HedgeOriginURLs
+	Discovery DiscoveryConfig `toml:"discovery"`
+	// Grafana attributes requests relayed by Grafana's datasource proxy to Grafana users, for forwarding and cache keying
+	Grafana GrafanaProxyConfig `toml:"grafana"`
+	// CacheKeyHeaders lists request headers whose values are part of the cache keys of the origin's cached objects
+	CacheKeyHeaders []string `toml:"cache_key_headers"`
+	// CacheKeyPartitionHeader is a request header whose hashed value prefixes the cache keys of the origin's cached
+	// objects, so that those of each tenant share a partition that can be listed or purged by prefix
+	CacheKeyPartitionHeader string `toml:"cache_key_partition_header"`
+	// HealthCheck describes the upstream request made for the origin's /health endpoint, and the response that makes it healthy
+	HealthCheck HealthCheckConfig `toml:"health_check"`
+	// LogLevel overrides logging.log_level for messages about the origin, e.g., to debug a single origin
+	LogLevel string `toml:"log_level"`
+	// LogSampleRate logs only 1 of every LogSampleRate occurrences of each repetitive warning or error about the
+	// origin, such as failed upstream requests. 0 or 1 logs every occurrence
+	LogSampleRate int `toml:"log_sample_rate"`
+	// MaxResponseBytes fails upstream requests whose response body is larger, with a 502. 0 is unlimited
+	MaxResponseBytes int64 `toml:"max_response_bytes"`
+	// MaxResponseSeries fails query and query_range requests whose response has more series, with a 502. 0 is unlimited
+	MaxResponseSeries int `toml:"max_response_series"`
+	// MaxResponsePoints fails query_range requests whose response has more points, with a 502. 0 is unlimited
+	MaxResponsePoints int64 `toml:"max_response_points"`
+	// CacheRedirects caches the origin's 301, 302 and 308 responses to proxied GET requests, and replays them with
+	// their Location until they expire
+	CacheRedirects bool `toml:"cache_redirects"`
+	// RedirectTTLSecs is the TTL of cached redirects whose Cache-Control and Expires headers give no freshness lifetime.
+	// Default is 300
+	RedirectTTLSecs int64 `toml:"redirect_ttl_secs"`
+	// ObjectCache caches the whole responses of proxied paths that are polled continuously, such as the Alertmanager
+	// discovery and alerts endpoints, for a short time
+	ObjectCache ObjectCacheConfig `toml:"object_cache"`
+	// TLSServerName is the name sent in the TLS handshake with the origin (SNI) and verified against its certificate,
+	// when it differs from the host of the origin url
+	TLSServerName string `toml:"tls_server_name"`
+	// TLSCAFiles lists PEM files of certificate authorities trusted for the origin, in addition to the system's
+	TLSCAFiles []string `toml:"tls_ca_files"`
+	// TLSPinnedFingerprints lists the SHA-256 fingerprints (hex, optionally colon-separated) of certificates, one of
+	// which the origin must present
+	TLSPinnedFingerprints []string `toml:"tls_pinned_fingerprints"`
+	// FastForwardLookbackSecs is the lookback delta the origin evaluates queries with. Fast forward points are only
+	// added when the next step boundary is within it. Default is 300, Prometheus' default
+	FastForwardLookbackSecs int64 `toml:"fast_forward_lookback_secs"`
+	// WriteInvalidatesCache removes cached query_range data sets overlapping the samples of remote writes proxied to
+	// the origin, so that backfilled or late data is not hidden by the cache
+	WriteInvalidatesCache bool `toml:"write_invalidates_cache"`
+	// AuthCachePolicy is how requests carrying an Authorization or Cookie header are cached: "shared" like any other,
+	// "per_credential" separately for each credential, or "no_cache" not at all. By default, they are cached
+	// separately for each Authorization header
+	AuthCachePolicy string `toml:"auth_cache_policy"`
+	// SQLGateway describes the time column of a "sql_gateway" origin, so that time-filtered rows can be delta cached
+	SQLGateway SQLGatewayConfig `toml:"sql_gateway"`
+	// FaultInjection injects artificial latency, errors and truncated bodies into the origin's upstream requests, for
+	// resilience testing. It must not be enabled in production
+	FaultInjection FaultInjectionConfig `toml:"fault_injection"`
+	// Recording records the origin's upstream responses to disk, or replays them without contacting the origin
+	Recording RecordingConfig `toml:"recording"`
+	// Signing signs the origin's upstream requests, for origins that authenticate the requests they receive
+	Signing SigningConfig `toml:"signing"`
+	// Script is a Lua script called as the origin's requests are received, sent upstream and responded to, to
+	// manipulate their headers, URL and status
+	Script ScriptConfig `toml:"script"`
+	// GRPC passes the gRPC requests for the origin through to it, over HTTP/2, without caching them
+	GRPC bool `toml:"grpc"`
+	// GRPCPaths lists the path prefixes, such as '/tempopb.Querier/', of the gRPC requests passed to the origin
+	// whatever their authority
+	GRPCPaths []string `toml:"grpc_paths"`
+	// DisabledMiddlewares lists the middlewares of the proxy server's chain that the origin's requests skip
+	DisabledMiddlewares []string `toml:"disabled_middlewares"`
 }
 
 // MetricsConfig is a collection of Metrics Collection configurations
@@ -102,6 +366,8 @@ type MetricsConfig struct {
 	ListenAddress string `toml:"listen_address"`
 	// ListenPort is TCP Port from which the Application Metrics are available for pulling at /metrics
 	ListenPort int `toml:"listen_port"`
+	// InstanceIDLabel adds the main instance_id as an instance_id label to all Trickster metrics
+	InstanceIDLabel bool `toml:"instance_id_label"`
 }
 
 // ProfilerConfig is a collection of pprof profiling configurations
@@ -118,6 +384,11 @@ type LoggingConfig struct {
 	LogFile string `toml:"log_file"`
 	// LogLevel provides the most granular level (e.g., DEBUG, INFO, ERROR) to log
 	LogLevel string `toml:"log_level"`
+
+	// SlowQueryThresholdMS logs range queries taking at least this many milliseconds to the slow query log. 0 disables it
+	SlowQueryThresholdMS int64 `toml:"slow_query_threshold_ms"`
+	// SlowQueryLogFile provides the filepath of the slow query log. Set as empty string to log slow queries to the LogFile
+	SlowQueryLogFile string `toml:"slow_query_log_file"`
 }
 
 // TLSConfig is a collection of TLS configurations for the main http listenr for the application
@@ -128,6 +399,17 @@ type TLSConfig struct {
 	FullChainCertPath string `toml:"full_chain_cert_path"`
 	// PrivateKeyPath specifies the path of the private key file for the tls endpoint
 	PrivateKeyPath string `toml:"private_key_path"`
+	// MinVersion is the minimum TLS version accepted: "1.0", "1.1", "1.2" or "1.3". Default is Go's
+	MinVersion string `toml:"min_version"`
+	// CipherSuites lists the cipher suites accepted for TLS 1.2 and earlier, by their Go names. Default is Go's
+	CipherSuites []string `toml:"cipher_suites"`
+	// SessionTicketsDisabled disables TLS session resumption with session tickets
+	SessionTicketsDisabled bool `toml:"session_tickets_disabled"`
+	// OCSPStapling staples the certificate's OCSP response, fetched from the responder named in the certificate, to
+	// handshakes. It requires the issuer certificate to follow the server certificate in the chain file
+	OCSPStapling bool `toml:"ocsp_stapling"`
+	// OCSPRefreshSecs is the interval between refreshes of the OCSP staple. Default is 3600
+	OCSPRefreshSecs int64 `toml:"ocsp_refresh_secs"`
 }
 
 // NewConfig returns a Config initialized with default values.
@@ -144,18 +426,28 @@ func NewConfig() *Config {
 
 			Redis:      RedisCacheConfig{Protocol: "tcp", Endpoint: "redis:6379"},
 			Filesystem: FilesystemCacheConfig{CachePath: defaultCachePath},
-			BoltDB:     BoltDBCacheConfig{Filename: defaultBoltDBFile, Bucket: "trickster"},
+			BoltDB:     BoltDBCacheConfig{Filename: defaultBoltDBFile, Bucket: "trickster", CompactionMinFreeRatio: 0.5, CompactionMinBytes: 67108864},
 
-			ReapSleepMS: 1000,
-			Compression: true,
+			ReapSleepMS:      1000,
+			Compression:      true,
+			CompressionCodec: czSnappy,
+
+			CompressionMinBytes: 1024,
+			CompressionTypes:    []string{mnQueryRange},
+
+			AsyncWriteWorkers:   defaultAsyncWriteWorkers,
+			AsyncWriteQueueSize: defaultAsyncWriteQueueSize,
+
+			Snapshots: SnapshotsConfig{TTLSecs: defaultSnapshotTTLSecs},
 		},
 		Logging: LoggingConfig{
 			LogFile:  "",
 			LogLevel: "INFO",
 		},
 		Main: GeneralConfig{
-			ConfigFile: "/etc/trickster/trickster.conf",
-			Hostname:   "localhost.unknown",
+			ConfigFile:           "/etc/trickster/trickster.conf",
+			Hostname:             "localhost.unknown",
+			MemoryRetryAfterSecs: 5,
 		},
 		Metrics: MetricsConfig{
 			ListenPort: 8082,
@@ -185,6 +477,7 @@ func defaultOriginConfig() PrometheusOriginConfig {
 		IgnoreNoCacheHeader: true,
 		MaxValueAgeSecs:     86400, // Keep datapoints up to 24 hours old
 		TimeoutSecs:         180,
+		ShardMaxParallelism: defaultShardMaxParallelism,
 	}
 }
 
@@ -193,3 +486,174 @@ func (c *Config) LoadFile(path string) error {
 	_, err := toml.DecodeFile(path, &c)
 	return err
 }
+
+// validate checks the loaded configuration for values that can't be used
+func (c *Config) validate() error {
+	if c.Main.StartupWaitSecs < 0 {
+		return fmt.Errorf("main: startup_wait_secs must not be negative")
+	}
+	if _, err := parseTrustedProxies(c.ProxyServer.TrustedProxies); err != nil {
+		return fmt.Errorf("proxy_server: %v", err)
+	}
+	if err := c.validateListeners(); err != nil {
+		return fmt.Errorf("proxy_server: %v", err)
+	}
+	if err := c.ProxyServer.validateUnmatchedOriginPolicy(); err != nil {
+		return fmt.Errorf("proxy_server: %v", err)
+	}
+	if err := c.validateMiddlewares(); err != nil {
+		return err
+	}
+	if (c.Admin.Username == "") != (c.Admin.Password == "") {
+		return fmt.Errorf("admin: username and password must be set together")
+	}
+	if err := c.Admin.TLS.validate(); err != nil {
+		return fmt.Errorf("admin: %v", err)
+	}
+	if _, ok := compressionCodecs[c.Caching.CompressionCodec]; !ok && c.Caching.CompressionCodec != "" {
+		return fmt.Errorf("cache: unknown compression_codec %q", c.Caching.CompressionCodec)
+	}
+	if err := c.Caching.validateHandoff(); err != nil {
+		return err
+	}
+	if err := c.Caching.Events.validate(); err != nil {
+		return err
+	}
+	if err := c.Caching.Snapshots.validate(); err != nil {
+		return err
+	}
+	if err := c.Caching.validateTiered(); err != nil {
+		return err
+	}
+	if err := c.Caching.Stampede.validate(); err != nil {
+		return err
+	}
+	if err := c.Stats.validate(); err != nil {
+		return err
+	}
+	if err := c.Control.validate(); err != nil {
+		return err
+	}
+	if err := c.Caching.Invalidation.validate(); err != nil {
+		return err
+	}
+	if err := c.LoadShedding.validate(); err != nil {
+		return err
+	}
+	for _, ot := range c.Caching.CompressionTypes {
+		if ot != mnQuery && ot != mnQueryRange {
+			return fmt.Errorf("cache: unknown compression_types entry %q", ot)
+		}
+	}
+	for name, o := range c.Origins {
+		if err := c.validateFederation(name, o); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if _, ok := compressionCodecs[o.CompressionCodec]; !ok && o.CompressionCodec != "" && o.CompressionCodec != czNone {
+			return fmt.Errorf("origin %q: unknown compression_codec %q", name, o.CompressionCodec)
+		}
+		if o.MaxConnsPerHost < 0 || o.MaxIdleConnsPerHost < 0 || o.TLSSessionCacheSize < 0 || o.DialKeepAliveSecs < 0 {
+			return fmt.Errorf("origin %q: connection settings must not be negative", name)
+		}
+		if err := o.validateDNS(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if _, err := o.proxyURL(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateTLS(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateHedging(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.Discovery.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.Grafana.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.HealthCheck.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateLogging(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateResponseLimits(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.ResponseHeaders.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateRedirectCaching(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.ObjectCache.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateFastForward(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateAuthCachePolicy(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.SQLGateway.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.FaultInjection.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.Recording.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.Signing.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.Script.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateGRPC(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if o.FidelityCheckSampleRate < 0 || o.FidelityCheckSampleRate > 1 {
+			return fmt.Errorf("origin %q: fidelity_check_sample_rate must be between 0 and 1", name)
+		}
+		if o.FidelityCheckTolerance < 0 {
+			return fmt.Errorf("origin %q: fidelity_check_tolerance must not be negative", name)
+		}
+		if o.federated() && o.OriginURL == "" {
+			// federated origins have no URL of their own, but need a unique one to distinguish their cache keys
+			o.OriginURL = otFederated + "://" + name + "/"
+			c.Origins[name] = o
+		}
+		for _, rc := range o.Relabel {
+			if err := rc.validate(); err != nil {
+				return fmt.Errorf("origin %q: %v", name, err)
+			}
+		}
+		if err := validateTTLBuckets(o.TTLBuckets); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := validateResolutionTiers(o.ResolutionTiers); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.validateAPIShim(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if err := o.Transform.validate(); err != nil {
+			return fmt.Errorf("origin %q: %v", name, err)
+		}
+		if !validForwardedMode(o.XForwardedHeaders) {
+			return fmt.Errorf("origin %q: unknown x_forwarded_headers mode %q", name, o.XForwardedHeaders)
+		}
+		if !validForwardedMode(o.ForwardedHeader) {
+			return fmt.Errorf("origin %q: unknown forwarded_header mode %q", name, o.ForwardedHeader)
+		}
+		switch strings.ToLower(o.Diagnostics) {
+		case "", dmHeaders, dmTrailer:
+		default:
+			return fmt.Errorf("origin %q: unknown diagnostics mode %q", name, o.Diagnostics)
+		}
+	}
+	return nil
+}
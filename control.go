@@ -0,0 +1,221 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// Control plane commands. ctUnknown labels the metric of unsupported or untrusted commands
+	ctBypass  = "bypass"
+	ctPurge   = "purge"
+	ctUnknown = "unknown"
+
+	// Control plane command statuses, for the control commands metric
+	csApplied  = "applied"
+	csRejected = "rejected"
+	csFailed   = "failed"
+
+	defaultControlMaxAgeSecs = 60
+)
+
+// ControlConfig describes the control plane channel on which an operator publishes signed runtime commands to a
+// fleet of Tricksters, whose admin endpoints cannot be reached directly
+type ControlConfig struct {
+	// RedisChannel, when set, subscribes to the commands published on the channel
+	RedisChannel string `toml:"redis_channel"`
+	// RedisEndpoint is the FQDN:port or IPAddress:Port of the Redis server the channel is subscribed on. Default is
+	// the [cache.redis] endpoint
+	RedisEndpoint string `toml:"redis_endpoint"`
+	// RedisPassword is the password of the Redis server, when RedisEndpoint is set
+	RedisPassword string `toml:"redis_password"`
+	// Secret is the key that commands are signed with, shared with the operator. Required with a RedisChannel
+	Secret string `toml:"secret"`
+	// MaxAgeSecs is how long after they were issued commands are accepted. Default is 60
+	MaxAgeSecs int64 `toml:"max_age_secs"`
+}
+
+// validate returns an error if the channel is set without a secret, or the max age is negative
+func (c ControlConfig) validate() error {
+	if c.RedisChannel != "" && c.Secret == "" {
+		return fmt.Errorf("control: a secret is required to subscribe to commands")
+	}
+	if c.MaxAgeSecs < 0 {
+		return fmt.Errorf("control: max_age_secs must not be negative")
+	}
+	return nil
+}
+
+// maxAge returns how long after they were issued commands are accepted
+func (c ControlConfig) maxAge() time.Duration {
+	if c.MaxAgeSecs > 0 {
+		return time.Duration(c.MaxAgeSecs) * time.Second
+	}
+	return defaultControlMaxAgeSecs * time.Second
+}
+
+// controlMessage is a message published on the control plane channel: a JSON controlCommand and its signature, the
+// hex encoded HMAC-SHA256 of the payload with the shared secret
+type controlMessage struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// controlCommand is a runtime command issued to the fleet
+type controlCommand struct {
+	// Command is 'bypass' or 'purge'
+	Command string `json:"command"`
+	// State is the bypass mode set by a bypass command: 'on' or 'off'
+	State string `json:"state,omitempty"`
+	// Invalidation selects the cache records removed by a purge command
+	Invalidation *invalidationMessage `json:"invalidation,omitempty"`
+	// Issuer identifies who issued the command, for the audit log
+	Issuer string `json:"issuer"`
+	// IssuedAt is the time the command was issued, in seconds since the epoch
+	IssuedAt int64 `json:"issued_at"`
+}
+
+// signControlPayload returns the signature of the payload with the secret
+func signControlPayload(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ControlPlane authenticates the commands received on the control plane channel, refusing commands that are
+// unsigned, too old, or replayed
+type ControlPlane struct {
+	config ControlConfig
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewControlPlane returns the ControlPlane of the validated config
+func NewControlPlane(c ControlConfig) *ControlPlane {
+	return &ControlPlane{config: c, seen: map[string]time.Time{}}
+}
+
+// verify returns the command of the message received at the time, or an error if it cannot be trusted
+func (p *ControlPlane) verify(data []byte, now time.Time) (controlCommand, error) {
+	var cmd controlCommand
+	var m controlMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return cmd, fmt.Errorf("invalid control message: %v", err)
+	}
+	if !hmac.Equal([]byte(m.Signature), []byte(signControlPayload(p.config.Secret, m.Payload))) {
+		return cmd, fmt.Errorf("invalid signature")
+	}
+	if err := json.Unmarshal([]byte(m.Payload), &cmd); err != nil {
+		return cmd, fmt.Errorf("invalid control command: %v", err)
+	}
+
+	issued := time.Unix(cmd.IssuedAt, 0)
+	if d := now.Sub(issued); d > p.config.maxAge() || d < -p.config.maxAge() {
+		return cmd, fmt.Errorf("command issued at %d is outside the accepted age", cmd.IssuedAt)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for sig, t := range p.seen {
+		if now.Sub(t) > p.config.maxAge() {
+			delete(p.seen, sig)
+		}
+	}
+	if _, ok := p.seen[m.Signature]; ok {
+		return cmd, fmt.Errorf("command was already applied")
+	}
+	p.seen[m.Signature] = issued
+	return cmd, nil
+}
+
+// runControlCommand applies the command, returning a description of its result
+func (t *TricksterHandler) runControlCommand(cmd controlCommand) (string, error) {
+	switch cmd.Command {
+	case ctBypass:
+		switch strings.ToLower(cmd.State) {
+		case bmOn:
+			t.setBypass(true)
+		case bmOff:
+			t.setBypass(false)
+		default:
+			return "", fmt.Errorf("bypass state must be 'on' or 'off'")
+		}
+		return "bypass " + strings.ToLower(cmd.State), nil
+	case ctPurge:
+		if cmd.Invalidation == nil {
+			return "", fmt.Errorf("a purge command requires an invalidation")
+		}
+		data, err := json.Marshal(cmd.Invalidation)
+		if err != nil {
+			return "", err
+		}
+		inv, err := t.parseInvalidation(data)
+		if err != nil {
+			return "", err
+		}
+		result, err := t.invalidate(inv)
+		return fmt.Sprintf("trimmed %d, deleted %d", result.Trimmed, result.Deleted), err
+	}
+	return "", fmt.Errorf("unsupported command %q", cmd.Command)
+}
+
+// subscribeControl applies the commands published on the configured control plane channel, until the process exits.
+// The client reconnects and subscribes again whenever the connection is lost.
+func (t *TricksterHandler) subscribeControl(c ControlConfig) {
+	client := redis.NewClient(subscriberRedisOptions(c.RedisEndpoint, c.RedisPassword, t.Config.Caching.Redis))
+	pubsub := client.Subscribe(c.RedisChannel)
+	defer pubsub.Close()
+	level.Info(t.Logger).Log(lfEvent, "subscribed to control commands", "channel", c.RedisChannel, "endpoint", client.Options().Addr)
+	t.applyControlMessages(NewControlPlane(c), pubsub.Channel())
+}
+
+// applyControlMessages verifies and applies the control messages, until the channel is closed. Each command is
+// audited in the log, whether it was applied or not.
+func (t *TricksterHandler) applyControlMessages(p *ControlPlane, messages <-chan *redis.Message) {
+	for m := range messages {
+		cmd, err := p.verify([]byte(m.Payload), time.Now())
+		if err != nil {
+			// the command of a message that cannot be trusted is not logged, so that it cannot be spoofed
+			t.Metrics.ControlCommands.WithLabelValues(ctUnknown, csRejected).Inc()
+			level.Warn(t.Logger).Log(lfEvent, "control command rejected", "channel", m.Channel, lfDetail, err.Error())
+			continue
+		}
+		command := cmd.Command
+		if command != ctBypass && command != ctPurge {
+			command = ctUnknown
+		}
+		result, err := t.runControlCommand(cmd)
+		if err != nil {
+			t.Metrics.ControlCommands.WithLabelValues(command, csFailed).Inc()
+			level.Warn(t.Logger).Log(lfEvent, "control command failed", "command", cmd.Command, "issuer", cmd.Issuer,
+				"issuedAt", cmd.IssuedAt, lfDetail, err.Error())
+			continue
+		}
+		t.Metrics.ControlCommands.WithLabelValues(command, csApplied).Inc()
+		level.Info(t.Logger).Log(lfEvent, "control command applied", "command", cmd.Command, "issuer", cmd.Issuer,
+			"issuedAt", cmd.IssuedAt, lfDetail, result)
+	}
+}
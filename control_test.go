@@ -0,0 +1,125 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// testControlMessage returns the control message of the command, signed with the secret
+func testControlMessage(secret, command string) string {
+	data, _ := json.Marshal(controlMessage{Payload: command, Signature: signControlPayload(secret, command)})
+	return string(data)
+}
+
+func TestControlConfig_validate(t *testing.T) {
+	tests := []struct {
+		config ControlConfig
+		valid  bool
+	}{
+		{ControlConfig{}, true},
+		{ControlConfig{RedisChannel: "control", Secret: "s"}, true},
+		{ControlConfig{RedisChannel: "control"}, false},
+		{ControlConfig{MaxAgeSecs: -1}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestControlPlane_verify(t *testing.T) {
+	p := NewControlPlane(ControlConfig{Secret: "secret"})
+	now := time.Unix(1546300800, 0)
+	command := func(issuedAt int64) string {
+		return fmt.Sprintf(`{"command":"bypass","state":"on","issuer":"ops","issued_at":%d}`, issuedAt)
+	}
+
+	// it should accept a signed recent command once
+	message := testControlMessage("secret", command(now.Unix()-5))
+	cmd, err := p.verify([]byte(message), now)
+	if err != nil || cmd.Command != ctBypass || cmd.State != bmOn || cmd.Issuer != "ops" {
+		t.Errorf("unexpected result %+v %v", cmd, err)
+	}
+	if _, err := p.verify([]byte(message), now); err == nil {
+		t.Errorf("expected a replayed command to be rejected")
+	}
+
+	// it should reject commands that are badly signed, malformed or too old
+	for i, message := range []string{
+		testControlMessage("other", command(now.Unix())),
+		`{"payload":"`,
+		testControlMessage("secret", `{"command":`),
+		testControlMessage("secret", command(now.Unix()-120)),
+		testControlMessage("secret", command(now.Unix()+120)),
+	} {
+		if _, err := p.verify([]byte(message), now); err == nil {
+			t.Errorf("test %d: expected an error", i)
+		}
+	}
+}
+
+func TestTricksterHandler_applyControlMessages(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.Cacher.Store("tenant-a.1", "data", 60)
+
+	now := time.Now().Unix()
+	messages := make(chan *redis.Message, 5)
+	send := func(message string) {
+		messages <- &redis.Message{Channel: "control", Payload: message}
+	}
+	send(testControlMessage("secret", fmt.Sprintf(`{"command":"bypass","state":"on","issuer":"ops","issued_at":%d}`, now)))
+	send(testControlMessage("secret", fmt.Sprintf(`{"command":"purge","invalidation":{"prefix":"tenant-a."},"issuer":"ops","issued_at":%d}`, now)))
+	send(testControlMessage("secret", fmt.Sprintf(`{"command":"reload","issuer":"ops","issued_at":%d}`, now)))
+	send(testControlMessage("forged", fmt.Sprintf(`{"command":"bypass","state":"off","issuer":"ops","issued_at":%d}`, now)))
+	close(messages)
+	tr.applyControlMessages(NewControlPlane(ControlConfig{Secret: "secret"}), messages)
+
+	// it should apply the trusted commands only
+	if !tr.bypassed() {
+		t.Errorf("expected bypass mode to be on")
+	}
+	if _, err := tr.Cacher.Retrieve("tenant-a.1"); !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+}
+
+func TestTricksterHandler_runControlCommand(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tests := []struct {
+		cmd   controlCommand
+		valid bool
+	}{
+		{controlCommand{Command: ctBypass, State: "OFF"}, true},
+		{controlCommand{Command: ctBypass, State: "maybe"}, false},
+		{controlCommand{Command: ctPurge, Invalidation: &invalidationMessage{Keys: []string{"a"}}}, true},
+		{controlCommand{Command: ctPurge}, false},
+		{controlCommand{Command: ctPurge, Invalidation: &invalidationMessage{}}, false},
+		{controlCommand{Command: "drain"}, false},
+	}
+	for i, test := range tests {
+		if _, err := tr.runControlCommand(test.cmd); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
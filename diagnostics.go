@@ -0,0 +1,221 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Diagnostics delivery modes
+	dmHeaders = "headers"
+	dmTrailer = "trailer"
+
+	// Diagnostic header names
+	hnDiagCacheStatus      = "X-Trickster-Cache-Status"
+	hnDiagCacheExtents     = "X-Trickster-Cache-Extents"
+	hnDiagFetchedExtents   = "X-Trickster-Fetched-Extents"
+	hnDiagUpstreamDuration = "X-Trickster-Upstream-Durations"
+
+	// Fetch names used in diagnostics
+	fnLower       = "lower"
+	fnUpper       = "upper"
+	fnFastForward = "fastforward"
+)
+
+// String returns the extents in "start-end" (epoch milliseconds) notation, or "none" if empty
+func (e MatrixExtents) String() string {
+	if e.Start == 0 && e.End == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d-%d", e.Start, e.End)
+}
+
+// diagnostics returns the per-request diagnostic values describing how the request was fulfilled
+func (ctx *ClientRequestContext) diagnostics(durations map[string]time.Duration) http.Header {
+	h := http.Header{}
+	h.Set(hnDiagCacheStatus, ctx.CacheLookupResult)
+	h.Set(hnDiagCacheExtents, ctx.CacheExtents.String())
+
+	fetched := make([]string, 0, 2)
+	if ctx.OriginLowerExtents.Start > 0 && ctx.OriginLowerExtents.End > 0 {
+		fetched = append(fetched, fnLower+"="+ctx.OriginLowerExtents.String())
+	}
+	if ctx.OriginUpperExtents.Start > 0 && ctx.OriginUpperExtents.End > 0 {
+		fetched = append(fetched, fnUpper+"="+ctx.OriginUpperExtents.String())
+	}
+	if len(fetched) == 0 {
+		fetched = append(fetched, "none")
+	}
+	h.Set(hnDiagFetchedExtents, strings.Join(fetched, ";"))
+
+	if len(durations) > 0 {
+		names := make([]string, 0, len(durations))
+		for name := range durations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, fmt.Sprintf("%s=%.3fs", name, durations[name].Seconds()))
+		}
+		h.Set(hnDiagUpstreamDuration, strings.Join(values, ";"))
+	}
+
+	return h
+}
+
+// writeDiagnostics sets the diagnostic values on the response. It must be called both before the body is written
+// (for the headers mode) and after the body is written (for the trailer mode); it is a no-op for the other phase.
+func writeDiagnostics(w http.ResponseWriter, mode string, diag http.Header, bodyWritten bool) {
+	prefix := ""
+	switch strings.ToLower(mode) {
+	case dmHeaders:
+		if bodyWritten {
+			return
+		}
+	case dmTrailer:
+		if !bodyWritten {
+			return
+		}
+		prefix = http.TrailerPrefix
+	default:
+		return
+	}
+	for k, v := range diag {
+		w.Header()[prefix+k] = v
+	}
+}
+
+// explainResult describes how Trickster would fulfill a request, without performing any upstream fetch
+type explainResult struct {
+	URL                string          `json:"url"`
+	Method             string          `json:"method"`
+	Route              string          `json:"route"`
+	Path               string          `json:"path,omitempty"`
+	Match              string          `json:"match,omitempty"`
+	OriginName         string          `json:"originName,omitempty"`
+	Origin             string          `json:"origin,omitempty"`
+	UnmatchedOrigin    string          `json:"unmatchedOriginPolicy,omitempty"`
+	CacheKey           string          `json:"cacheKey,omitempty"`
+	CacheLookupResult  string          `json:"cacheLookupResult,omitempty"`
+	StepMS             int64           `json:"stepMS,omitempty"`
+	RequestExtents     *MatrixExtents  `json:"requestExtents,omitempty"`
+	CacheExtents       *MatrixExtents  `json:"cacheExtents,omitempty"`
+	OriginLowerExtents *MatrixExtents  `json:"originLowerExtents,omitempty"`
+	OriginUpperExtents *MatrixExtents  `json:"originUpperExtents,omitempty"`
+	Shards             []MatrixExtents `json:"shards,omitempty"`
+	FastForward        bool            `json:"fastForward"`
+	Error              string          `json:"error,omitempty"`
+}
+
+// explainHandler handles calls to /trickster/explain?url=..., which reports the route, cache key and delta extents that
+// Trickster would use to fulfill the provided url, without fetching anything from the origin
+func (t *TricksterHandler) explainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	u := r.URL.Query().Get("url")
+	if u == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(explainResult{Error: "missing url parameter"})
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	result := t.explain(strings.ToUpper(method), u, r.Header)
+	if result.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// explain simulates route matching, cache key derivation and extent math for the provided method and url, as
+// requested with the provided headers, which may select the origin's cache key partition and scope
+func (t *TricksterHandler) explain(method, u string, header http.Header) explainResult {
+	result := explainResult{URL: u, Method: method}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+
+	var match mux.RouteMatch
+	if t.Router == nil || !t.Router.Match(req, &match) {
+		result.Error = "no matching route"
+		if match.MatchErr == mux.ErrMethodMismatch {
+			result.Error = "method not allowed"
+		}
+		return result
+	}
+	result.Route = match.Route.GetName()
+	result.Path, _ = match.Route.GetPathTemplate()
+	result.Match = routeMatchType(match.Route)
+	req = mux.SetURLVars(req, match.Vars)
+
+	if !proxyRoutes[result.Route] {
+		return result
+	}
+
+	result.OriginName = getOriginName(req)
+	if _, ok := t.Config.Origins[result.OriginName]; !ok {
+		if p := t.Config.ProxyServer.UnmatchedOriginPolicy; p != "" && p != uoDefault {
+			result.UnmatchedOrigin = p
+			return result
+		}
+	}
+
+	origin := t.getOrigin(req)
+	result.Origin = origin.OriginURL
+
+	if result.Route != rnQueryRange {
+		return result
+	}
+
+	ctx, err := t.buildRequestContext(httptest.NewRecorder(), req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.CacheKey = ctx.CacheKey
+	result.CacheLookupResult = ctx.CacheLookupResult
+	result.StepMS = ctx.StepMS
+	result.RequestExtents = &ctx.RequestExtents
+	result.CacheExtents = &ctx.CacheExtents
+	result.OriginLowerExtents = &ctx.OriginLowerExtents
+	result.OriginUpperExtents = &ctx.OriginUpperExtents
+	if ctx.OriginUpperExtents.Start > 0 && ctx.OriginUpperExtents.End > 0 {
+		result.Shards = shardExtents(ctx.OriginUpperExtents, ctx.StepMS, ctx.Origin.ShardDurationSecs*1000)
+	}
+	_, result.FastForward = ctx.fastForwardTime()
+
+	return result
+}
@@ -0,0 +1,139 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTricksterHandler_diagnosticsHeaders(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.Diagnostics = dmHeaders
+	tr.Config.Origins["default"] = o
+
+	// it should report the cache status and fetched extents in the response headers
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil)
+	tr.promQueryRangeHandler(w, r)
+
+	h := w.Result().Header
+	// the example data is older than max_value_age_secs, so it is a range miss
+	if h.Get(hnDiagCacheStatus) != crRangeMiss {
+		t.Errorf("wanted %q got %q.", crRangeMiss, h.Get(hnDiagCacheStatus))
+	}
+	if h.Get(hnDiagFetchedExtents) != "upper=1435781430000-1435781460000" {
+		t.Errorf("unexpected fetched extents %q.", h.Get(hnDiagFetchedExtents))
+	}
+	if h.Get(hnDiagCacheExtents) != "none" {
+		t.Errorf("unexpected cache extents %q.", h.Get(hnDiagCacheExtents))
+	}
+}
+
+func TestWriteDiagnostics(t *testing.T) {
+	diag := http.Header{}
+	diag.Set(hnDiagCacheStatus, crHit)
+
+	// it should not set headers in the trailer mode before the body is written
+	w := httptest.NewRecorder()
+	writeDiagnostics(w, dmTrailer, diag, false)
+	if len(w.Header()) != 0 {
+		t.Errorf("expected no headers, got %v", w.Header())
+	}
+
+	// it should set trailers after the body is written
+	writeDiagnostics(w, dmTrailer, diag, true)
+	if w.Header().Get(http.TrailerPrefix+hnDiagCacheStatus) != crHit {
+		t.Errorf("expected trailer to be set, got %v", w.Header())
+	}
+
+	// it should do nothing when diagnostics are disabled
+	w = httptest.NewRecorder()
+	writeDiagnostics(w, "", diag, false)
+	writeDiagnostics(w, "", diag, true)
+	if len(w.Header()) != 0 {
+		t.Errorf("expected no headers, got %v", w.Header())
+	}
+}
+
+func TestTricksterHandler_explainHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+
+	// it should explain a range query without fetching from the (nonexistent) origin
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://trickster/trickster/explain?url="+url.QueryEscape("http://trickster"+exampleRangeQuery), nil)
+	tr.explainHandler(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Result().StatusCode)
+	}
+
+	result := explainResult{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Route != rnQueryRange {
+		t.Errorf("wanted %q got %q.", rnQueryRange, result.Route)
+	}
+	if result.CacheKey == "" {
+		t.Errorf("expected a cache key")
+	}
+	if result.RequestExtents == nil || result.RequestExtents.Start != 1435781430000 {
+		t.Errorf("unexpected request extents %v", result.RequestExtents)
+	}
+
+	if result.Method != http.MethodGet || result.Path != "/api/v1/query_range" || result.Match != rmExact || result.OriginName != "trickster" {
+		t.Errorf("unexpected route match %v", result)
+	}
+
+	// it should derive the cache key with the headers of the explain request
+	o := tr.Config.Origins["default"]
+	o.CacheKeyPartitionHeader = "X-Tenant"
+	tr.Config.Origins["default"] = o
+	w = httptest.NewRecorder()
+	r.Header.Set("X-Tenant", "tenant1")
+	tr.explainHandler(w, r)
+	partitioned := explainResult{}
+	json.NewDecoder(w.Result().Body).Decode(&partitioned)
+	if want := md5sum("tenant1") + "." + result.CacheKey; partitioned.CacheKey != want {
+		t.Errorf("wanted %q got %q.", want, partitioned.CacheKey)
+	}
+
+	// it should report a method that the matching route does not allow
+	w = httptest.NewRecorder()
+	tr.explainHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/explain?method=delete&url="+url.QueryEscape("http://trickster/api/v1/labels"), nil))
+	result = explainResult{}
+	json.NewDecoder(w.Result().Body).Decode(&result)
+	if w.Result().StatusCode != http.StatusBadRequest || result.Error != "method not allowed" {
+		t.Errorf("wanted %q got %q.", "method not allowed", result.Error)
+	}
+
+	// it should report a bad request for a missing url
+	w = httptest.NewRecorder()
+	tr.explainHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/explain", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("wanted %d got %d.", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
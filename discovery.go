@@ -0,0 +1,230 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	defaultDiscoveryRefreshSecs = 30
+	discoveryTimeout            = 10 * time.Second
+)
+
+// DiscoveryConfig describes how the replicas of an origin are discovered, from DNS SRV records or the Consul
+// catalog, for environments where they are not listed in hedge_origin_urls
+type DiscoveryConfig struct {
+	// SRV is the DNS name whose SRV records list the replicas, such as '_prometheus._tcp.example.com'
+	SRV string `toml:"srv"`
+	// ConsulURL is the base URL of the Consul HTTP API, such as 'http://consul:8500'
+	ConsulURL string `toml:"consul_url"`
+	// ConsulService is the name of the Consul service whose healthy instances are the replicas
+	ConsulService string `toml:"consul_service"`
+	// ConsulTag, when set, restricts the replicas to the instances of the service with the tag
+	ConsulTag string `toml:"consul_tag"`
+	// Scheme is the scheme of the replica URLs. Default is the scheme of the origin_url
+	Scheme string `toml:"scheme"`
+	// RefreshSecs is how often the replicas are discovered again. Default is 30
+	RefreshSecs int64 `toml:"refresh_secs"`
+}
+
+// enabled returns true if the origin's replicas are discovered
+func (c DiscoveryConfig) enabled() bool {
+	return c.SRV != "" || c.ConsulService != ""
+}
+
+// refreshInterval returns how often the replicas are discovered again
+func (c DiscoveryConfig) refreshInterval() time.Duration {
+	if c.RefreshSecs > 0 {
+		return time.Duration(c.RefreshSecs) * time.Second
+	}
+	return defaultDiscoveryRefreshSecs * time.Second
+}
+
+// validate returns an error if both sources are set, or a setting is invalid
+func (c DiscoveryConfig) validate() error {
+	if c.SRV != "" && c.ConsulService != "" {
+		return fmt.Errorf("discovery: srv and consul_service are mutually exclusive")
+	}
+	if c.ConsulService != "" {
+		if u, err := url.Parse(c.ConsulURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("discovery: consul_url %q is not an absolute url", c.ConsulURL)
+		}
+	}
+	if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("discovery: scheme must be 'http' or 'https'")
+	}
+	if c.RefreshSecs < 0 {
+		return fmt.Errorf("discovery: refresh_secs must not be negative")
+	}
+	return nil
+}
+
+// consulServiceEntry is an instance of a service, as listed by the Consul health API
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// Discovery holds the replicas discovered for each origin, by origin URL
+type Discovery struct {
+	mtx      sync.RWMutex
+	replicas map[string][]string
+
+	// lookupSRV resolves SRV records, and is replaced in tests
+	lookupSRV func(name string) ([]*net.SRV, error)
+	client    *http.Client
+}
+
+// NewDiscovery returns a Discovery with no replicas
+func NewDiscovery() *Discovery {
+	return &Discovery{
+		replicas: make(map[string][]string),
+		lookupSRV: func(name string) ([]*net.SRV, error) {
+			_, addrs, err := net.LookupSRV("", "", name)
+			return addrs, err
+		},
+		client: &http.Client{Timeout: discoveryTimeout},
+	}
+}
+
+// Replicas returns the URLs (scheme://host:port) of the replicas last discovered for the origin, if any
+func (d *Discovery) Replicas(originURL string) []string {
+	if d == nil {
+		return nil
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.replicas[originURL]
+}
+
+// discover returns the sorted URLs of the origin's replicas, per its discovery config
+func (d *Discovery) discover(o PrometheusOriginConfig) ([]string, error) {
+	scheme := o.Discovery.Scheme
+	if scheme == "" {
+		if u, err := url.Parse(o.OriginURL); err == nil && u.Scheme != "" {
+			scheme = u.Scheme
+		} else {
+			scheme = "http"
+		}
+	}
+
+	var hosts []string
+	if o.Discovery.SRV != "" {
+		addrs, err := d.lookupSRV(o.Discovery.SRV)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port))))
+		}
+	} else {
+		entries, err := d.consulServiceEntries(o.Discovery)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			addr := e.Service.Address
+			if addr == "" {
+				addr = e.Node.Address
+			}
+			hosts = append(hosts, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+		}
+	}
+
+	replicas := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		replicas = append(replicas, scheme+"://"+h)
+	}
+	sort.Strings(replicas)
+	return replicas, nil
+}
+
+// consulServiceEntries returns the instances of the configured service that pass their health checks
+func (d *Discovery) consulServiceEntries(c DiscoveryConfig) ([]consulServiceEntry, error) {
+	params := url.Values{"passing": []string{"true"}}
+	if c.ConsulTag != "" {
+		params.Set("tag", c.ConsulTag)
+	}
+	u := strings.TrimSuffix(c.ConsulURL, "/") + "/v1/health/service/" + url.PathEscape(c.ConsulService) + "?" + params.Encode()
+	resp, err := d.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned status %d", resp.StatusCode)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// refreshReplicas discovers the origin's replicas. The previously discovered replicas are kept when discovery fails or finds
+// none, so that a flapping DNS server or Consul agent does not take them all away.
+func (t *TricksterHandler) refreshReplicas(name string, o PrometheusOriginConfig) {
+	replicas, err := t.Discovery.discover(o)
+	if err == nil && len(replicas) == 0 {
+		err = fmt.Errorf("no replicas were found")
+	}
+	if err != nil {
+		level.Warn(t.Logger).Log(lfEvent, "error discovering origin replicas", "origin", name, lfDetail, err.Error())
+		return
+	}
+
+	t.Discovery.mtx.Lock()
+	changed := strings.Join(t.Discovery.replicas[o.OriginURL], ",") != strings.Join(replicas, ",")
+	t.Discovery.replicas[o.OriginURL] = replicas
+	t.Discovery.mtx.Unlock()
+
+	if changed {
+		level.Info(t.Logger).Log(lfEvent, "discovered origin replicas", "origin", name, "replicas", strings.Join(replicas, ","))
+	}
+	if t.Metrics != nil {
+		t.Metrics.OriginReplicas.WithLabelValues(o.OriginURL).Set(float64(len(replicas)))
+	}
+}
+
+// discoverReplicas discovers the replicas of each origin with a discovery config, then refreshes them periodically
+func (t *TricksterHandler) discoverReplicas() {
+	for name, o := range t.Config.Origins {
+		if !o.Discovery.enabled() {
+			continue
+		}
+		t.refreshReplicas(name, o)
+		go func(name string, o PrometheusOriginConfig) {
+			for range time.Tick(o.Discovery.refreshInterval()) {
+				t.refreshReplicas(name, o)
+			}
+		}(name, o)
+	}
+}
@@ -0,0 +1,161 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDiscoveryConfig_validate(t *testing.T) {
+	tests := []struct {
+		config DiscoveryConfig
+		valid  bool
+	}{
+		{DiscoveryConfig{}, true},
+		{DiscoveryConfig{SRV: "_prometheus._tcp.example.com"}, true},
+		{DiscoveryConfig{ConsulURL: "http://consul:8500", ConsulService: "prometheus"}, true},
+		{DiscoveryConfig{ConsulService: "prometheus"}, false},
+		{DiscoveryConfig{SRV: "_prometheus._tcp.example.com", ConsulURL: "http://consul:8500", ConsulService: "prometheus"}, false},
+		{DiscoveryConfig{SRV: "_prometheus._tcp.example.com", Scheme: "ftp"}, false},
+		{DiscoveryConfig{SRV: "_prometheus._tcp.example.com", RefreshSecs: -1}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestDiscovery_discover_srv(t *testing.T) {
+	d := NewDiscovery()
+	d.lookupSRV = func(name string) ([]*net.SRV, error) {
+		if name != "_prometheus._tcp.example.com" {
+			return nil, fmt.Errorf("no such host")
+		}
+		return []*net.SRV{{Target: "prometheus-b.example.com.", Port: 9090}, {Target: "prometheus-a.example.com.", Port: 9091}}, nil
+	}
+
+	// it should list the targets of the records, with the scheme of the origin
+	o := PrometheusOriginConfig{OriginURL: "https://prometheus:9090", Discovery: DiscoveryConfig{SRV: "_prometheus._tcp.example.com"}}
+	replicas, err := d.discover(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(replicas, ","); got != "https://prometheus-a.example.com:9091,https://prometheus-b.example.com:9090" {
+		t.Errorf("unexpected replicas %s", got)
+	}
+
+	o.Discovery.SRV = "_missing._tcp.example.com"
+	if _, err := d.discover(o); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestDiscovery_discover_consul(t *testing.T) {
+	var query url.Values
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/prometheus" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte(`[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":9090}},
+			{"Node":{"Address":"10.0.0.2"},"Service":{"Address":"10.0.1.2","Port":9091}}]`))
+	}))
+	defer consul.Close()
+
+	// it should list the passing instances of the service, at their service or node address
+	o := PrometheusOriginConfig{OriginURL: "http://prometheus:9090",
+		Discovery: DiscoveryConfig{ConsulURL: consul.URL + "/", ConsulService: "prometheus", ConsulTag: "primary"}}
+	replicas, err := NewDiscovery().discover(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(replicas, ","); got != "http://10.0.0.1:9090,http://10.0.1.2:9091" {
+		t.Errorf("unexpected replicas %s", got)
+	}
+	if query.Get("passing") != "true" || query.Get("tag") != "primary" {
+		t.Errorf("unexpected query %v", query)
+	}
+
+	o.Discovery.ConsulService = "alertmanager"
+	if _, err := NewDiscovery().discover(o); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestTricksterHandler_refreshReplicas(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the slow origin responds only when its request is canceled
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	replica := newTestServer(`{"replica":true}`)
+	defer replica.Close()
+	replicaURL, _ := url.Parse(replica.URL)
+	host, port, _ := net.SplitHostPort(replicaURL.Host)
+
+	records := []*net.SRV{}
+	tr.Discovery = NewDiscovery()
+	tr.Discovery.lookupSRV = func(name string) ([]*net.SRV, error) {
+		return records, nil
+	}
+
+	o := tr.Config.Origins["default"]
+	o.OriginURL = slow.URL
+	o.HedgeDelayMS = 10
+	o.Discovery.SRV = "_prometheus._tcp.example.com"
+
+	// it should discover nothing without records
+	tr.refreshReplicas("default", o)
+	if replicas := tr.Discovery.Replicas(o.OriginURL); len(replicas) != 0 {
+		t.Errorf("unexpected replicas %v", replicas)
+	}
+
+	var p uint16
+	fmt.Sscan(port, &p)
+	records = []*net.SRV{{Target: host, Port: p}}
+	tr.refreshReplicas("default", o)
+	if v := testutil.ToFloat64(tr.Metrics.OriginReplicas.WithLabelValues(o.OriginURL)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+
+	// it should keep the discovered replicas when no records are found
+	records = []*net.SRV{}
+	tr.refreshReplicas("default", o)
+	if replicas := tr.Discovery.Replicas(o.OriginURL); len(replicas) != 1 || replicas[0] != replica.URL {
+		t.Errorf("unexpected replicas %v", replicas)
+	}
+
+	// it should hedge requests to the discovered replicas
+	body, _, _, err := tr.getURL(o, "GET", slow.URL+"/api/v1/query", url.Values{}, nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"replica":true}` {
+		t.Errorf("wanted %q got %q.", `{"replica":true}`, body)
+	}
+}
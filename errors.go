@@ -0,0 +1,120 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	// Error classes, for the errors metric
+	ecTimeout           = "timeout"
+	ecConnectionRefused = "connection_refused"
+	ecTLS               = "tls"
+	ecDecode            = "decode"
+	ecCacheBackend      = "cache_backend"
+	ecTooLarge          = "too_large"
+	ecOther             = "other"
+)
+
+// classifiedError is an error whose class is known where it occurs, rather than inferred from its cause
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classify returns the error with the provided class
+func classify(class string, err error) error {
+	return &classifiedError{class: class, err: err}
+}
+
+// cacheMissError is returned by a cache's Retrieve when the key is not in the cache, as opposed to the cache
+// failing to retrieve it
+type cacheMissError struct {
+	key string
+}
+
+func (e *cacheMissError) Error() string {
+	return fmt.Sprintf("Value for key [%s] not in cache", e.key)
+}
+
+// isCacheMiss returns true if the error is a cache miss
+func isCacheMiss(err error) bool {
+	var m *cacheMissError
+	return errors.As(err, &m)
+}
+
+// errorClass returns the class of the error: its class when it was classified, or that of its cause otherwise
+func errorClass(err error) string {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return ecTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ecConnectionRefused
+	}
+
+	var (
+		uae x509.UnknownAuthorityError
+		he  x509.HostnameError
+		cie x509.CertificateInvalidError
+		rhe tls.RecordHeaderError
+	)
+	if errors.As(err, &uae) || errors.As(err, &he) || errors.As(err, &cie) || errors.As(err, &rhe) {
+		return ecTLS
+	}
+
+	var (
+		se  *json.SyntaxError
+		ute *json.UnmarshalTypeError
+	)
+	if errors.As(err, &se) || errors.As(err, &ute) {
+		return ecDecode
+	}
+	return ecOther
+}
+
+// countError counts the error in the errors metric, by the origin it occurred for, its source ("origin" or "cache")
+// and its class. Cache misses are not errors, and are not counted.
+func (t *TricksterHandler) countError(o PrometheusOriginConfig, source string, err error) {
+	// canceled requests, like hedged requests that lost the race, did not fail
+	if t.Metrics == nil || err == nil || isCacheMiss(err) || errors.Is(err, context.Canceled) {
+		return
+	}
+	class := errorClass(err)
+	if class == ecOther && source == psCache {
+		class = ecCacheBackend
+	}
+	t.Metrics.Errors.WithLabelValues(o.OriginURL, source, class).Inc()
+}
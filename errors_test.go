@@ -0,0 +1,98 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorClass(t *testing.T) {
+	var v interface{}
+	decodeErr := json.Unmarshal([]byte("{"), &v)
+
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{fmt.Errorf("error downloading URL: %w", context.DeadlineExceeded), ecTimeout},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ecConnectionRefused},
+		{fmt.Errorf("x509: %w", x509.UnknownAuthorityError{}), ecTLS},
+		{decodeErr, ecDecode},
+		{classify(ecDecode, fmt.Errorf("failed checksum verification")), ecDecode},
+		{fmt.Errorf("something else"), ecOther},
+	}
+
+	for i, test := range tests {
+		if class := errorClass(test.err); class != test.class {
+			t.Errorf("test %d: wanted %q got %q.", i, test.class, class)
+		}
+	}
+}
+
+func TestTricksterHandler_countError(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	o := tr.Config.Origins["default"]
+
+	// it should count errors by source and class
+	tr.countError(o, psOrigin, context.DeadlineExceeded)
+	if v := testutil.ToFloat64(tr.Metrics.Errors.WithLabelValues(o.OriginURL, psOrigin, ecTimeout)); v != 1 {
+		t.Errorf("wanted %d got %f.", 1, v)
+	}
+
+	// it should count unclassified cache errors as cache backend errors, and ignore cache misses
+	tr.countError(o, psCache, fmt.Errorf("connection reset"))
+	_, err := tr.Cacher.Retrieve("missing")
+	if !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+	tr.countError(o, psCache, err)
+	if v := testutil.ToFloat64(tr.Metrics.Errors.WithLabelValues(o.OriginURL, psCache, ecCacheBackend)); v != 1 {
+		t.Errorf("wanted %d got %f.", 1, v)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.Errors.WithLabelValues(o.OriginURL, psCache, ecOther)); v != 0 {
+		t.Errorf("wanted %d got %f.", 0, v)
+	}
+}
+
+func TestTricksterHandler_doRequest_connectionRefused(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// a server that is closed refuses connections on its address
+	es := httptest.NewServer(nil)
+	es.Close()
+	tr.setTestOrigin(es.URL)
+	tr.Transports = NewTransports()
+	o := tr.Config.Origins["default"]
+
+	u, _ := url.Parse(es.URL + "/api/v1/query")
+	if _, _, err := tr.doRequest(context.Background(), o, "GET", u, nil, nil, 0); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if v := testutil.ToFloat64(tr.Metrics.Errors.WithLabelValues(o.OriginURL, psOrigin, ecConnectionRefused)); v != 1 {
+		t.Errorf("wanted %d got %f.", 1, v)
+	}
+}
@@ -0,0 +1,235 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Extent report formats
+	efJSON = "json"
+	efText = "text"
+
+	// timelineWidth is the number of columns of the text timeline
+	timelineWidth = 72
+)
+
+// extentReport describes the extents of the data cached under a key, and the gaps between them
+type extentReport struct {
+	CacheKey string          `json:"cacheKey"`
+	StepMS   int64           `json:"stepMS,omitempty"`
+	Extents  MatrixExtents   `json:"extents"`
+	Covered  []MatrixExtents `json:"covered"`
+	Gaps     []MatrixExtents `json:"gaps"`
+	Series   []seriesExtents `json:"series"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// seriesExtents describes the extents of a single cached series, and the gaps between them
+type seriesExtents struct {
+	Metric  string          `json:"metric"`
+	Points  int             `json:"points"`
+	Covered []MatrixExtents `json:"covered"`
+	Gaps    []MatrixExtents `json:"gaps"`
+}
+
+// extentsHandler handles calls to /trickster/extents?key=..., which reports the extents of the query_range data set
+// cached under the key, and the gaps within it, as JSON, or as a text timeline with &format=text. The key of a
+// request's data set is found with &url= in place of &key=, as with /trickster/explain.
+func (t *TricksterHandler) extentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	params := r.URL.Query()
+
+	key := params.Get("key")
+	if key == "" && params.Get("url") != "" {
+		key = t.explain(http.MethodGet, params.Get("url"), r.Header).CacheKey
+	}
+	var stepMS int64
+	if s := params.Get("step"); s != "" {
+		secs, err := strconv.ParseFloat(s, 64)
+		if err != nil || secs <= 0 {
+			writeExtentReport(w, http.StatusBadRequest, efJSON, extentReport{CacheKey: key, Error: "invalid step"})
+			return
+		}
+		stepMS = int64(secs * 1000)
+	}
+	if key == "" {
+		writeExtentReport(w, http.StatusBadRequest, efJSON, extentReport{Error: "missing key or url parameter"})
+		return
+	}
+
+	format := params.Get("format")
+	if format != efText {
+		format = efJSON
+	}
+
+	report, err := t.cachedExtents(key, stepMS)
+	if err != nil {
+		report.Error = err.Error()
+		writeExtentReport(w, http.StatusNotFound, format, report)
+		return
+	}
+	writeExtentReport(w, http.StatusOK, format, report)
+}
+
+// writeExtentReport writes the report in the format
+func writeExtentReport(w http.ResponseWriter, code int, format string, report extentReport) {
+	if format == efText {
+		w.Header().Set(hnContentType, hvTextPlain)
+		w.WriteHeader(code)
+		report.writeTimeline(w)
+		return
+	}
+	w.Header().Set(hnContentType, hvApplicationJSON)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// cachedExtents returns the extents of the query_range data set cached under the key. Points are expected every
+// stepMS, or, when it is 0, every smallest interval found between the points of a series.
+func (t *TricksterHandler) cachedExtents(key string, stepMS int64) (extentReport, error) {
+	report := extentReport{CacheKey: key, Covered: []MatrixExtents{}, Gaps: []MatrixExtents{},
+		Series: []seriesExtents{}}
+
+	body, err := t.Cacher.Retrieve(key)
+	if err != nil {
+		return report, fmt.Errorf("no data set is cached under the key")
+	}
+	if body != "" && body[0] != '{' {
+		if b, err := decompressCacheBody([]byte(body)); err == nil {
+			body = string(b)
+		}
+	}
+	var pe PrometheusMatrixEnvelope
+	if err := t.unmarshalMatrix([]byte(body), psCache, &pe); err != nil {
+		return report, fmt.Errorf("the cached data set is not a query_range result: %v", err)
+	}
+
+	if stepMS == 0 {
+		stepMS = inferStepMS(pe.Data.Result)
+	}
+	report.StepMS = stepMS
+	report.Extents = pe.getExtents()
+
+	all := map[int64]bool{}
+	for _, s := range pe.Data.Result {
+		times := make([]int64, 0, len(s.Values))
+		for _, v := range s.Values {
+			times = append(times, int64(v.Timestamp))
+			all[int64(v.Timestamp)] = true
+		}
+		covered, gaps := coveredExtents(times, stepMS)
+		report.Series = append(report.Series, seriesExtents{Metric: s.Metric.String(), Points: len(s.Values),
+			Covered: covered, Gaps: gaps})
+	}
+	sort.Slice(report.Series, func(i, j int) bool { return report.Series[i].Metric < report.Series[j].Metric })
+
+	times := make([]int64, 0, len(all))
+	for ts := range all {
+		times = append(times, ts)
+	}
+	report.Covered, report.Gaps = coveredExtents(times, stepMS)
+	return report, nil
+}
+
+// inferStepMS returns the smallest interval between the consecutive points of any series, or 0 if no series has two
+// points
+func inferStepMS(m model.Matrix) int64 {
+	var step int64
+	for _, s := range m {
+		for i := 1; i < len(s.Values); i++ {
+			if d := int64(s.Values[i].Timestamp - s.Values[i-1].Timestamp); d > 0 && (step == 0 || d < step) {
+				step = d
+			}
+		}
+	}
+	return step
+}
+
+// coveredExtents returns the runs of the timestamps that are a step apart, and the gaps between them, each gap
+// spanning the steps that have no point
+func coveredExtents(times []int64, stepMS int64) (covered, gaps []MatrixExtents) {
+	covered, gaps = []MatrixExtents{}, []MatrixExtents{}
+	if len(times) == 0 {
+		return
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	run := MatrixExtents{Start: times[0], End: times[0]}
+	for _, ts := range times[1:] {
+		if stepMS > 0 && ts-run.End > stepMS {
+			covered = append(covered, run)
+			gaps = append(gaps, MatrixExtents{Start: run.End + stepMS, End: ts - stepMS})
+			run = MatrixExtents{Start: ts}
+		}
+		run.End = ts
+	}
+	covered = append(covered, run)
+	return
+}
+
+// writeTimeline writes the report as a text timeline of the data set's extents, one line for the whole data set and
+// one for each series, where '#' marks a column with cached points and '.' one with a gap
+func (report extentReport) writeTimeline(w io.Writer) {
+	fmt.Fprintf(w, "cache key: %s\n", report.CacheKey)
+	if report.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", report.Error)
+		return
+	}
+	fmt.Fprintf(w, "extents: %s, step: %dms, gaps: %d\n", report.Extents, report.StepMS, len(report.Gaps))
+	for _, g := range report.Gaps {
+		fmt.Fprintf(w, "  gap: %s\n", g)
+	}
+	fmt.Fprintf(w, "%s  all\n", timeline(report.Extents, report.StepMS, report.Covered, report.Gaps))
+	for _, s := range report.Series {
+		fmt.Fprintf(w, "%s  %s\n", timeline(report.Extents, report.StepMS, s.Covered, s.Gaps), s.Metric)
+	}
+}
+
+// timeline returns a row of timelineWidth columns spanning the extents, where each point spans a step, marking the
+// columns that overlap the covered extents and then those that overlap the gaps, so that a gap narrower than a column
+// is still shown
+func timeline(extents MatrixExtents, stepMS int64, covered, gaps []MatrixExtents) string {
+	row := []byte(strings.Repeat(".", timelineWidth))
+	if stepMS <= 0 {
+		stepMS = 1
+	}
+	span := extents.End + stepMS - extents.Start
+	// mark marks the columns overlapping the extents, at least one
+	mark := func(e MatrixExtents, b byte) {
+		first := int((e.Start - extents.Start) * timelineWidth / span)
+		last := int((e.End+stepMS-extents.Start)*timelineWidth/span) - 1
+		if last < first {
+			last = first
+		}
+		for c := first; c <= last && c < timelineWidth; c++ {
+			row[c] = b
+		}
+	}
+	for _, e := range covered {
+		mark(e, '#')
+	}
+	for _, e := range gaps {
+		mark(e, '.')
+	}
+	return "|" + string(row) + "|"
+}
@@ -0,0 +1,113 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testExtentsBody = `{"status":"success","data":{"resultType":"matrix","result":[
+{"metric":{"__name__":"up","job":"prometheus"},"values":[[60,"1"],[120,"1"],[180,"1"],[360,"1"],[420,"1"]]},
+{"metric":{"__name__":"up","job":"node"},"values":[[60,"1"],[120,"1"],[180,"1"],[240,"1"],[420,"1"]]}]}}`
+
+func TestCoveredExtents(t *testing.T) {
+	tests := []struct {
+		times   []int64
+		step    int64
+		covered []MatrixExtents
+		gaps    []MatrixExtents
+	}{
+		{nil, 10, []MatrixExtents{}, []MatrixExtents{}},
+		{[]int64{10, 20, 30}, 10, []MatrixExtents{{10, 30}}, []MatrixExtents{}},
+		{[]int64{50, 10, 20}, 10, []MatrixExtents{{10, 20}, {50, 50}}, []MatrixExtents{{30, 40}}},
+		{[]int64{10, 50}, 0, []MatrixExtents{{10, 50}}, []MatrixExtents{}},
+	}
+	for i, test := range tests {
+		covered, gaps := coveredExtents(test.times, test.step)
+		if !reflect.DeepEqual(covered, test.covered) || !reflect.DeepEqual(gaps, test.gaps) {
+			t.Errorf("test %d: unexpected result %v %v", i, covered, gaps)
+		}
+	}
+}
+
+func TestTricksterHandler_extentsHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+
+	tr.Cacher.Store("extents-key", testExtentsBody, 60)
+
+	// it should report the extents and gaps of the data set and of each series, inferring the step
+	w := httptest.NewRecorder()
+	tr.extentsHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/extents?key=extents-key", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wanted %d got %d.", http.StatusOK, w.Code)
+	}
+	var report extentReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.StepMS != 60000 || report.Extents != (MatrixExtents{60000, 420000}) {
+		t.Errorf("unexpected step %d extents %v", report.StepMS, report.Extents)
+	}
+	if !reflect.DeepEqual(report.Gaps, []MatrixExtents{{300000, 300000}}) {
+		t.Errorf("unexpected gaps %v", report.Gaps)
+	}
+	if len(report.Series) != 2 || report.Series[0].Points != 5 ||
+		!reflect.DeepEqual(report.Series[1].Gaps, []MatrixExtents{{240000, 300000}}) {
+		t.Errorf("unexpected series %v", report.Series)
+	}
+
+	// it should expect points at the provided step
+	w = httptest.NewRecorder()
+	tr.extentsHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/extents?key=extents-key&step=30", nil))
+	report = extentReport{}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.StepMS != 30000 || len(report.Gaps) != 5 {
+		t.Errorf("unexpected step %d gaps %v", report.StepMS, report.Gaps)
+	}
+
+	// it should render a text timeline
+	w = httptest.NewRecorder()
+	tr.extentsHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/extents?key=extents-key&format=text", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 6 || !strings.HasPrefix(lines[3], "|") || !strings.HasSuffix(lines[3], "|  all") ||
+		!strings.Contains(lines[3], "#.") {
+		t.Errorf("unexpected timeline\n%s", w.Body.String())
+	}
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusBadRequest},
+		{"key=extents-key&step=-1", http.StatusBadRequest},
+		{"key=missing", http.StatusNotFound},
+		// the data set of a request that is not cached
+		{"url=" + "http%3A%2F%2Ftrickster%2Fapi%2Fv1%2Fquery_range%3Fquery%3Dup%26start%3D0%26end%3D600%26step%3D60",
+			http.StatusNotFound},
+	}
+	for i, test := range tests {
+		w = httptest.NewRecorder()
+		tr.extentsHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/extents?"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("test %d: unexpected result %d", i, w.Code)
+		}
+	}
+}
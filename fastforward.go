@@ -0,0 +1,65 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// defaultFastForwardLookbackSecs is Prometheus' default lookback delta, used when fast_forward_lookback_secs is not set
+const defaultFastForwardLookbackSecs = 300
+
+// fastForwardLookbackMS returns the lookback delta of the origin, in milliseconds
+func (o PrometheusOriginConfig) fastForwardLookbackMS() int64 {
+	if o.FastForwardLookbackSecs > 0 {
+		return o.FastForwardLookbackSecs * 1000
+	}
+	return defaultFastForwardLookbackSecs * 1000
+}
+
+// validateFastForward returns an error if the origin's fast forward lookback is negative
+func (o PrometheusOriginConfig) validateFastForward() error {
+	if o.FastForwardLookbackSecs < 0 {
+		return fmt.Errorf("fast_forward_lookback_secs must not be negative")
+	}
+	return nil
+}
+
+// fastForwardTime returns the timestamp, in milliseconds, of the fast forward point of the request: the step boundary
+// following the end of the requested range, so that the point lines up with those the next request will get from the
+// origin. It returns false when the request is not for real-time data, when fast forward is disabled, when the request
+// is pinned to a time, so that it is served from the cache alone when possible, or when the boundary is further ahead
+// than the origin's lookback delta, since the origin would find no samples to evaluate it.
+func (ctx *ClientRequestContext) fastForwardTime() (int64, bool) {
+	if ctx.Origin.FastForwardDisable || ctx.Pinned || ctx.RequestExtents.End < ctx.Time*1000-ctx.ResponseStepMS {
+		return 0, false
+	}
+	ts := ctx.RequestExtents.End + ctx.ResponseStepMS
+	if ts-ctx.Time*1000 >= ctx.Origin.fastForwardLookbackMS() {
+		return 0, false
+	}
+	return ts, true
+}
+
+// fastForwardParams returns the parameters of the instant query for the fast forward point at the timestamp
+func (ctx *ClientRequestContext) fastForwardParams(ts int64) url.Values {
+	originParams := url.Values{}
+	// Add the prometheus query params from the user urlparams to the origin request
+	passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
+	passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
+	originParams.Set(upTime, strconv.FormatFloat(float64(ts)/1000, 'f', -1, 64))
+	return originParams
+}
@@ -0,0 +1,70 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestClientRequestContext_fastForwardTime(t *testing.T) {
+	tests := []struct {
+		origin  PrometheusOriginConfig
+		end     int64
+		stepMS  int64
+		ts      int64
+		enabled bool
+	}{
+		// the boundary following the end of a real-time range
+		{PrometheusOriginConfig{}, 1260000, 300000, 1560000, true},
+		{PrometheusOriginConfig{}, 1500000, 60000, 1560000, true},
+		// ranges ending before the latest step are not real-time
+		{PrometheusOriginConfig{}, 1200000, 60000, 0, false},
+		{PrometheusOriginConfig{FastForwardDisable: true}, 1260000, 300000, 0, false},
+		// boundaries further ahead than the lookback delta cannot be evaluated
+		{PrometheusOriginConfig{FastForwardLookbackSecs: 120}, 1260000, 300000, 0, false},
+		{PrometheusOriginConfig{}, 1200000, 600000, 0, false},
+		{PrometheusOriginConfig{FastForwardLookbackSecs: 600}, 1200000, 600000, 1800000, true},
+	}
+
+	for i, test := range tests {
+		ctx := &ClientRequestContext{Origin: test.origin, Time: 1290, ResponseStepMS: test.stepMS}
+		ctx.RequestExtents.End = test.end
+		if ts, ok := ctx.fastForwardTime(); ts != test.ts || ok != test.enabled {
+			t.Errorf("test %d: unexpected result %d %v", i, ts, ok)
+		}
+	}
+}
+
+func TestClientRequestContext_fastForwardParams(t *testing.T) {
+	ctx := &ClientRequestContext{RequestParams: url.Values{upQuery: {"up"}, upStep: {"60"}, upTime: {"1"}}}
+
+	// it should evaluate the query at the fast forward point
+	params := ctx.fastForwardParams(1560000)
+	if params.Get(upQuery) != "up" || params.Get(upTime) != "1560" || params.Get(upStep) != "" {
+		t.Errorf("unexpected params %v", params)
+	}
+	if params := ctx.fastForwardParams(1560500); params.Get(upTime) != "1560.5" {
+		t.Errorf("wanted %s got %s.", "1560.5", params.Get(upTime))
+	}
+}
+
+func TestPrometheusOriginConfig_validateFastForward(t *testing.T) {
+	if err := (PrometheusOriginConfig{FastForwardLookbackSecs: 600}).validateFastForward(); err != nil {
+		t.Error(err)
+	}
+	if err := (PrometheusOriginConfig{FastForwardLookbackSecs: -1}).validateFastForward(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
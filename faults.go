@@ -0,0 +1,130 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const defaultFaultErrorStatus = http.StatusServiceUnavailable
+
+// FaultInjectionConfig describes artificial faults injected into the origin's upstream requests, for testing how
+// Trickster and its clients behave when the origin is slow or failing. It is meant for test environments only
+type FaultInjectionConfig struct {
+	// LatencyMS is the delay added before the upstream requests selected by LatencyRate are sent
+	LatencyMS int64 `toml:"latency_ms"`
+	// LatencyRate is the fraction (0 to 1) of upstream requests that are delayed
+	LatencyRate float64 `toml:"latency_rate"`
+	// ErrorRate is the fraction (0 to 1) of upstream requests that are not sent, and answered with ErrorStatus instead
+	ErrorRate float64 `toml:"error_rate"`
+	// ErrorStatus is the status of the injected error responses. Default is 503
+	ErrorStatus int `toml:"error_status"`
+	// TruncateRate is the fraction (0 to 1) of upstream responses whose body is cut off halfway, as if the connection
+	// to the origin was lost
+	TruncateRate float64 `toml:"truncate_rate"`
+}
+
+// enabled returns true if any faults are injected
+func (c FaultInjectionConfig) enabled() bool {
+	return (c.LatencyMS > 0 && c.LatencyRate > 0) || c.ErrorRate > 0 || c.TruncateRate > 0
+}
+
+// validate returns an error if a rate is not between 0 and 1, the latency is negative or the error status is invalid
+func (c FaultInjectionConfig) validate() error {
+	for _, rate := range []float64{c.LatencyRate, c.ErrorRate, c.TruncateRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault_injection: rates must be between 0 and 1")
+		}
+	}
+	if c.LatencyMS < 0 {
+		return fmt.Errorf("fault_injection: latency_ms must not be negative")
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 100 || c.ErrorStatus > 599) {
+		return fmt.Errorf("fault_injection: invalid error_status %d", c.ErrorStatus)
+	}
+	return nil
+}
+
+// faultTransport injects the configured faults into the requests made through the next transport
+type faultTransport struct {
+	next   http.RoundTripper
+	config FaultInjectionConfig
+	// random returns a number in [0, 1) that a rate is compared with
+	random func() float64
+}
+
+// newFaultTransport returns a transport injecting the configured faults into the requests made through next
+func newFaultTransport(next http.RoundTripper, c FaultInjectionConfig) *faultTransport {
+	return &faultTransport{next: next, config: c, random: rand.Float64}
+}
+
+// RoundTrip delays, fails or truncates the request at the configured rates, and otherwise sends it as is
+func (f *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := f.config
+	if c.LatencyMS > 0 && f.random() < c.LatencyRate {
+		timer := time.NewTimer(time.Duration(c.LatencyMS) * time.Millisecond)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	if f.random() < c.ErrorRate {
+		status := c.ErrorStatus
+		if status == 0 {
+			status = defaultFaultErrorStatus
+		}
+		body := fmt.Sprintf("injected fault: %s\n", http.StatusText(status))
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{hnContentType: []string{"text/plain"}},
+			Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := f.next.RoundTrip(req)
+	if err != nil || f.random() >= c.TruncateRate {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), errReader{io.ErrUnexpectedEOF}))
+	return resp, nil
+}
+
+// errReader is a reader that always fails with its error
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,124 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectionConfig_validate(t *testing.T) {
+	tests := []struct {
+		config FaultInjectionConfig
+		valid  bool
+	}{
+		{FaultInjectionConfig{}, true},
+		{FaultInjectionConfig{LatencyMS: 100, LatencyRate: 0.5, ErrorRate: 1, ErrorStatus: 502, TruncateRate: 0.1}, true},
+		{FaultInjectionConfig{ErrorRate: 1.5}, false},
+		{FaultInjectionConfig{TruncateRate: -0.1}, false},
+		{FaultInjectionConfig{LatencyMS: -1}, false},
+		{FaultInjectionConfig{ErrorStatus: 42}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestFaultTransport_RoundTrip(t *testing.T) {
+	es := newTestServer("0123456789")
+	defer es.Close()
+	newRequest := func(ctx context.Context) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, es.URL, nil)
+		return req.WithContext(ctx)
+	}
+	always := func() float64 { return 0 }
+
+	// it should send the request as is without faults
+	f := newFaultTransport(http.DefaultTransport, FaultInjectionConfig{})
+	resp, err := f.RoundTrip(newRequest(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "0123456789" {
+		t.Errorf("wanted %s got %s.", "0123456789", body)
+	}
+
+	// it should answer injected errors without sending the request
+	f = newFaultTransport(http.DefaultTransport, FaultInjectionConfig{ErrorRate: 1})
+	f.random = always
+	resp, err = f.RoundTrip(newRequest(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	f.config.ErrorStatus = http.StatusBadGateway
+	if resp, _ = f.RoundTrip(newRequest(context.Background())); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("wanted %d got %d.", http.StatusBadGateway, resp.StatusCode)
+	}
+
+	// it should cut truncated bodies off halfway with an error
+	f = newFaultTransport(http.DefaultTransport, FaultInjectionConfig{TruncateRate: 1})
+	f.random = always
+	if resp, err = f.RoundTrip(newRequest(context.Background())); err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if string(body) != "01234" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected truncated body %q, %v", body, err)
+	}
+
+	// it should delay requests, unless their context ends first
+	f = newFaultTransport(http.DefaultTransport, FaultInjectionConfig{LatencyMS: 50, LatencyRate: 1})
+	f.random = always
+	start := time.Now()
+	if _, err = f.RoundTrip(newRequest(context.Background())); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected a delay of at least 50ms, got %s", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	f.config.LatencyMS = 10000
+	if _, err = f.RoundTrip(newRequest(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestTricksterHandler_getURL_faults(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer("{}")
+	defer es.Close()
+
+	// it should inject the origin's faults into its upstream requests
+	o := PrometheusOriginConfig{FaultInjection: FaultInjectionConfig{ErrorRate: 1, ErrorStatus: http.StatusGatewayTimeout}}
+	_, resp, _, err := tr.getURL(o, http.MethodGet, es.URL, nil, http.Header{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("wanted %d got %d.", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
@@ -0,0 +1,247 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Origin types
+	otFederated = "federated"
+
+	// defaultFederationLabel is the label injected into each series to identify the member origin it came from
+	defaultFederationLabel = "origin"
+)
+
+// federated returns true if the origin is a virtual origin that fans queries out to its member origins
+func (o PrometheusOriginConfig) federated() bool {
+	return strings.ToLower(o.OriginType) == otFederated
+}
+
+// federationLabel returns the name of the label that identifies the member origin of each series
+func (o PrometheusOriginConfig) federationLabel() model.LabelName {
+	if o.FederationLabel == "" {
+		return defaultFederationLabel
+	}
+	return model.LabelName(o.FederationLabel)
+}
+
+// validateFederation checks that a federated origin's members exist and are not federated themselves
+func (c *Config) validateFederation(name string, o PrometheusOriginConfig) error {
+	if !o.federated() {
+		if len(o.Members) > 0 {
+			return fmt.Errorf("members requires origin_type %q", otFederated)
+		}
+		return nil
+	}
+	if len(o.Members) == 0 {
+		return fmt.Errorf("federated origins require at least one member")
+	}
+	for _, m := range o.Members {
+		mo, ok := c.Origins[m]
+		if !ok {
+			return fmt.Errorf("unknown member origin %q", m)
+		}
+		if mo.federated() || mo.sqlGateway() {
+			return fmt.Errorf("member origin %q must be a prometheus origin", m)
+		}
+	}
+	return nil
+}
+
+// memberResult is the response of a single member origin to a federated query
+type memberResult struct {
+	name     string
+	body     []byte
+	resp     *http.Response
+	duration time.Duration
+	err      error
+}
+
+// fanOut sends the request for the provided API method to each of the federated origin's members in parallel
+func (t *TricksterHandler) fanOut(o PrometheusOriginConfig, method string, params url.Values, r *http.Request) []memberResult {
+	results := make([]memberResult, len(o.Members))
+	headers := t.getProxyableClientHeaders(r)
+
+	var wg sync.WaitGroup
+	for i, name := range o.Members {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			member := t.Config.Origins[name]
+			u := member.OriginURL + strings.Replace(member.APIPath+"/", "//", "/", 1) + method
+			mr := &results[i]
+			mr.name = name
+			mr.body, mr.resp, mr.duration, mr.err = t.getURL(member, r.Method, u, params, headers, requestDeadline(r))
+		}(i, name)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// getFederatedMatrix fans a query_range out to the federated origin's members, and merges the resulting series,
+// labeling each with the member origin it came from. If any member fails, its response is returned as-is,
+// so that partial results are never cached.
+func (t *TricksterHandler) getFederatedMatrix(o PrometheusOriginConfig, params url.Values, r *http.Request) (PrometheusMatrixEnvelope, []byte, *http.Response, time.Duration, error) {
+	merged := defaultPrometheusMatrixEnvelope()
+	merged.Status = rvSuccess
+
+	var resp *http.Response
+	var duration time.Duration
+
+	for _, mr := range t.fanOut(o, mnQueryRange, params, r) {
+		if mr.err != nil {
+			return PrometheusMatrixEnvelope{}, nil, nil, 0, fmt.Errorf("member origin %q: %v", mr.name, mr.err)
+		}
+		if mr.resp.StatusCode != http.StatusOK {
+			return PrometheusMatrixEnvelope{}, mr.body, mr.resp, 0, nil
+		}
+		pe := PrometheusMatrixEnvelope{}
+		if err := t.unmarshalMatrix(mr.body, psOrigin, &pe); err != nil {
+			return PrometheusMatrixEnvelope{}, nil, nil, 0, fmt.Errorf("member origin %q: Prometheus matrix unmarshaling error: %v", mr.name, err)
+		}
+		if err := t.Config.Origins[mr.name].checkMatrixLimits(pe); err != nil {
+			t.countError(t.Config.Origins[mr.name], psOrigin, err)
+			return PrometheusMatrixEnvelope{}, nil, nil, 0, fmt.Errorf("member origin %q: %w", mr.name, err)
+		}
+		if pe.Status != rvSuccess {
+			return pe, mr.body, mr.resp, 0, nil
+		}
+		if resp == nil {
+			resp = mr.resp
+		}
+		if mr.duration > duration {
+			duration = mr.duration
+		}
+		for _, stream := range pe.Data.Result {
+			merged.Data.Result = append(merged.Data.Result, &model.SampleStream{
+				Metric: withLabel(stream.Metric, o.federationLabel(), mr.name),
+				Values: stream.Values,
+			})
+		}
+	}
+
+	return merged, nil, resp, duration, nil
+}
+
+// getFederatedVector fans an instantaneous query out to the federated origin's members, and merges the resulting
+// samples, labeling each with the member origin it came from
+func (t *TricksterHandler) getFederatedVector(o PrometheusOriginConfig, params url.Values, r *http.Request) (PrometheusVectorEnvelope, []byte, *http.Response, error) {
+	merged := PrometheusVectorEnvelope{Status: rvSuccess, Data: PrometheusVectorData{ResultType: rvVector, Result: model.Vector{}}}
+
+	var resp *http.Response
+
+	for _, mr := range t.fanOut(o, mnQuery, params, r) {
+		if mr.err != nil {
+			return PrometheusVectorEnvelope{}, nil, nil, fmt.Errorf("member origin %q: %v", mr.name, mr.err)
+		}
+		if mr.resp.StatusCode != http.StatusOK {
+			return PrometheusVectorEnvelope{}, mr.body, mr.resp, nil
+		}
+		// scalar and string results have no series to label, and every member evaluates them the same way
+		if rt := resultType(mr.body); rt == rvScalar || rt == rvString {
+			return PrometheusVectorEnvelope{}, mr.body, mr.resp, nil
+		}
+		pe := PrometheusVectorEnvelope{}
+		if err := json.Unmarshal(mr.body, &pe); err != nil {
+			return PrometheusVectorEnvelope{}, nil, nil, fmt.Errorf("member origin %q: Prometheus vector unmarshaling error: %v", mr.name, err)
+		}
+		if err := t.Config.Origins[mr.name].checkVectorLimits(pe); err != nil {
+			t.countError(t.Config.Origins[mr.name], psOrigin, err)
+			return PrometheusVectorEnvelope{}, nil, nil, fmt.Errorf("member origin %q: %w", mr.name, err)
+		}
+		if pe.Status != rvSuccess {
+			return pe, mr.body, mr.resp, nil
+		}
+		if resp == nil {
+			resp = mr.resp
+		}
+		for _, s := range pe.Data.Result {
+			merged.Data.Result = append(merged.Data.Result, &model.Sample{
+				Metric:    withLabel(s.Metric, o.federationLabel(), mr.name),
+				Value:     s.Value,
+				Timestamp: s.Timestamp,
+			})
+		}
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return PrometheusVectorEnvelope{}, nil, nil, err
+	}
+
+	return merged, body, resp, nil
+}
+
+// withLabel returns a copy of the metric with the provided label set
+func withLabel(m model.Metric, name model.LabelName, value string) model.Metric {
+	out := make(model.Metric, len(m)+1)
+	for k, v := range m {
+		out[k] = v
+	}
+	out[name] = model.LabelValue(value)
+	return out
+}
+
+// getMatrix fetches a query_range from the origin, fanning it out to the members of federated origins
+func (t *TricksterHandler) getMatrix(o PrometheusOriginConfig, url string, params url.Values, r *http.Request) (PrometheusMatrixEnvelope, []byte, *http.Response, time.Duration, error) {
+	if o.federated() {
+		return t.getFederatedMatrix(o, params, r)
+	}
+	return t.getMatrixFromPrometheus(url, params, r)
+}
+
+// getVector fetches an instantaneous query from the origin, fanning it out to the members of federated origins
+func (t *TricksterHandler) getVector(o PrometheusOriginConfig, url string, params url.Values, r *http.Request) (PrometheusVectorEnvelope, []byte, *http.Response, error) {
+	if o.federated() {
+		return t.getFederatedVector(o, params, r)
+	}
+	return t.getVectorFromPrometheus(url, params, r)
+}
+
+// proxyOrigin returns the origin that non-query requests (e.g., health checks, label lookups and the Prometheus UI)
+// are proxied to. Federated origins proxy these requests to their first member.
+func (t *TricksterHandler) proxyOrigin(o PrometheusOriginConfig) PrometheusOriginConfig {
+	if o.federated() && len(o.Members) > 0 {
+		if m, ok := t.Config.Origins[o.Members[0]]; ok {
+			return m
+		}
+	}
+	return o
+}
+
+// getFederatedBody fans the query or query_range request for the provided API path out to the federated origin's
+// members, and returns the merged response body
+func (t *TricksterHandler) getFederatedBody(o PrometheusOriginConfig, path string, params url.Values, r *http.Request) ([]byte, *http.Response, error) {
+	if !strings.HasSuffix(path, mnQueryRange) {
+		_, body, resp, err := t.getFederatedVector(o, params, r)
+		return body, resp, err
+	}
+	pe, body, resp, _, err := t.getFederatedMatrix(o, params, r)
+	if err != nil || body != nil {
+		return body, resp, err
+	}
+	body, err = json.Marshal(pe)
+	return body, resp, err
+}
@@ -0,0 +1,82 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTricksterHandler_promQueryRangeHandler_federated(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	east := newTestServer(exampleRangeResponse)
+	defer east.Close()
+	west := newTestServer(exampleRangeResponse)
+	defer west.Close()
+
+	tr.setTestOrigin(east.URL)
+	tr.Config.Origins["east"] = PrometheusOriginConfig{OriginURL: east.URL, APIPath: prometheusAPIv1Path, MaxValueAgeSecs: 86400}
+	tr.Config.Origins["west"] = PrometheusOriginConfig{OriginURL: west.URL, APIPath: prometheusAPIv1Path, MaxValueAgeSecs: 86400}
+	tr.Config.Origins["default"] = PrometheusOriginConfig{OriginType: otFederated, Members: []string{"east", "west"},
+		APIPath: prometheusAPIv1Path, MaxValueAgeSecs: 86400, FastForwardDisable: true}
+	if err := tr.Config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should merge the series of both members, labeled with the member origin
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted %d got %d.", http.StatusOK, w.Result().StatusCode)
+	}
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&pe); err != nil {
+		t.Fatal(err)
+	}
+	if len(pe.Data.Result) != 4 {
+		t.Fatalf("wanted %d got %d.", 4, len(pe.Data.Result))
+	}
+	members := map[string]int{}
+	for _, s := range pe.Data.Result {
+		members[string(s.Metric[defaultFederationLabel])]++
+	}
+	if members["east"] != 2 || members["west"] != 2 {
+		t.Errorf("unexpected member labels %v", members)
+	}
+}
+
+func TestConfig_validateFederation(t *testing.T) {
+	c := NewConfig()
+	c.Origins["fed"] = PrometheusOriginConfig{OriginType: otFederated}
+	if err := c.validate(); err == nil {
+		t.Errorf("expected an error for a federated origin without members")
+	}
+
+	c.Origins["fed"] = PrometheusOriginConfig{OriginType: otFederated, Members: []string{"missing"}}
+	if err := c.validate(); err == nil {
+		t.Errorf("expected an error for an unknown member")
+	}
+
+	c.Origins["fed"] = PrometheusOriginConfig{OriginType: otFederated, Members: []string{"default"}}
+	if err := c.validate(); err != nil {
+		t.Error(err)
+	}
+	if c.Origins["fed"].OriginURL != "federated://fed/" {
+		t.Errorf("wanted %s got %s.", "federated://fed/", c.Origins["fed"].OriginURL)
+	}
+}
@@ -0,0 +1,216 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Fidelity check results
+	fcMatch         = "match"
+	fcMismatch      = "mismatch"
+	fcCountMismatch = "count_mismatch"
+	fcError         = "error"
+
+	// fidelitySettleSecs excludes the most recent points from fidelity checks, since the origin may still be
+	// receiving samples for them
+	fidelitySettleSecs = 60
+)
+
+// sampleFidelityCheck returns true if a response from this origin's cache should be checked against the origin
+func (o PrometheusOriginConfig) sampleFidelityCheck() bool {
+	return o.FidelityCheckSampleRate > 0 && rand.Float64() < o.FidelityCheckSampleRate
+}
+
+// startFidelityCheck compares the matrix of a request served from the cache against the same range fetched from
+// the origin, in the background, counting and logging any point whose value differs beyond the origin's tolerance and,
+// when the origin compares them, any series whose number of points differs
+func (t *TricksterHandler) startFidelityCheck(ctx *ClientRequestContext) {
+	// the matrix continues to be modified for the response, so the check needs its own copy
+	served := ctx.Matrix.deepCopy()
+	// the check runs after the response is written, so it is not bound by the client's timeout budget
+	r := ctx.Request.WithContext(context.Background())
+	origin := ctx.Origin
+	e := ctx.RequestExtents
+	settled := (ctx.Time - max64(origin.NoCacheLastDataSecs, fidelitySettleSecs)) * 1000
+
+	originParams := url.Values{}
+	passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
+	passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
+	originParams.Add(upStep, ctx.StepParam)
+	queryURL := origin.OriginURL + mnQueryRange
+
+	go func() {
+		pe, _, resp, _, err := t.getShardedMatrixFromPrometheus(ctx, queryURL, originParams, e, r)
+		if err != nil || resp.StatusCode != http.StatusOK || pe.Status != rvSuccess {
+			t.Metrics.FidelityChecks.WithLabelValues(origin.OriginURL, fcError).Inc()
+			return
+		}
+
+		mismatches, first := compareMatrices(served, pe, settled, origin.FidelityCheckTolerance)
+		if mismatches > 0 {
+			t.Metrics.FidelityChecks.WithLabelValues(origin.OriginURL, fcMismatch).Inc()
+			t.originLog(origin, level.Warn, "cached data differs from origin").Log(lfCacheKey, ctx.CacheKey, "mismatchedPoints", mismatches, lfDetail, first)
+			return
+		}
+		if origin.FidelityCheckCounts {
+			if mismatches, first := comparePointCounts(served, pe, settled); mismatches > 0 {
+				t.Metrics.FidelityChecks.WithLabelValues(origin.OriginURL, fcCountMismatch).Inc()
+				t.originLog(origin, level.Warn, "cached point counts differ from origin").Log(lfCacheKey, ctx.CacheKey, "mismatchedSeries", mismatches, lfDetail, first)
+				return
+			}
+		}
+		t.Metrics.FidelityChecks.WithLabelValues(origin.OriginURL, fcMatch).Inc()
+	}()
+}
+
+// compareMatrices returns the number of points in served whose value differs beyond the relative tolerance from the
+// point with the same series and timestamp in origin, and a description of the first, considering only points with
+// timestamps before the provided time. Points present in only one of the matrices are not compared.
+func compareMatrices(served, origin PrometheusMatrixEnvelope, before int64, tolerance float64) (int, string) {
+	byFingerprint := make(map[model.Fingerprint]*model.SampleStream, len(origin.Data.Result))
+	for _, ss := range origin.Data.Result {
+		byFingerprint[ss.Metric.Fingerprint()] = ss
+	}
+
+	mismatches := 0
+	first := ""
+	for _, ss := range served.Data.Result {
+		os, ok := byFingerprint[ss.Metric.Fingerprint()]
+		if !ok {
+			continue
+		}
+		j := 0
+		for _, v := range ss.Values {
+			if int64(v.Timestamp) >= before {
+				break
+			}
+			for j < len(os.Values) && os.Values[j].Timestamp < v.Timestamp {
+				j++
+			}
+			if j == len(os.Values) {
+				break
+			}
+			if os.Values[j].Timestamp == v.Timestamp && !matchingValues(v.Value, os.Values[j].Value, tolerance) {
+				if mismatches == 0 {
+					first = ss.Metric.String() + " " + v.String() + " != " + os.Values[j].String()
+				}
+				mismatches++
+			}
+		}
+	}
+	return mismatches, first
+}
+
+// comparePointCounts returns the number of series whose number of points with timestamps before the provided time
+// differs between served and origin, including series present in only one of them, and a description of the first
+func comparePointCounts(served, origin PrometheusMatrixEnvelope, before int64) (int, string) {
+	counts := make(map[model.Fingerprint]int, len(origin.Data.Result))
+	for _, ss := range origin.Data.Result {
+		counts[ss.Metric.Fingerprint()] = settledPoints(ss, before)
+	}
+
+	mismatches := 0
+	first := ""
+	mismatch := func(description string) {
+		if mismatches == 0 {
+			first = description
+		}
+		mismatches++
+	}
+	for _, ss := range served.Data.Result {
+		fp := ss.Metric.Fingerprint()
+		originCount, ok := counts[fp]
+		delete(counts, fp)
+		if n := settledPoints(ss, before); !ok && n > 0 {
+			mismatch(fmt.Sprintf("%s has %d points, and is missing from the origin", ss.Metric, n))
+		} else if n != originCount {
+			mismatch(fmt.Sprintf("%s has %d points != %d", ss.Metric, n, originCount))
+		}
+	}
+	for _, ss := range origin.Data.Result {
+		if _, ok := counts[ss.Metric.Fingerprint()]; ok && settledPoints(ss, before) > 0 {
+			mismatch(fmt.Sprintf("%s is missing from the cache", ss.Metric))
+		}
+	}
+	return mismatches, first
+}
+
+// settledPoints returns the number of points of the series with timestamps before the provided time
+func settledPoints(ss *model.SampleStream, before int64) int {
+	n := 0
+	for _, v := range ss.Values {
+		if int64(v.Timestamp) < before {
+			n++
+		}
+	}
+	return n
+}
+
+// matchingValues returns true if the values differ by no more than the relative tolerance. NaN and infinite values
+// match only if they are identical.
+func matchingValues(a, b model.SampleValue, tolerance float64) bool {
+	fa, fb := float64(a), float64(b)
+	if tolerance == 0 || math.IsNaN(fa) || math.IsNaN(fb) || math.IsInf(fa, 0) || math.IsInf(fb, 0) {
+		return identicalValues(a, b)
+	}
+	return math.Abs(fa-fb) <= tolerance*math.Max(math.Abs(fa), math.Abs(fb))
+}
+
+// identicalValues returns true if the values are exactly the same, treating all NaNs (including staleness markers,
+// which the Prometheus API renders as "NaN") as identical
+func identicalValues(a, b model.SampleValue) bool {
+	if math.IsNaN(float64(a)) || math.IsNaN(float64(b)) {
+		return math.IsNaN(float64(a)) && math.IsNaN(float64(b))
+	}
+	return math.Float64bits(float64(a)) == math.Float64bits(float64(b))
+}
+
+// deepCopy returns a copy of the matrix sharing no series, labels or values with the original
+func (pe PrometheusMatrixEnvelope) deepCopy() PrometheusMatrixEnvelope {
+	out := PrometheusMatrixEnvelope{Status: pe.Status, Data: PrometheusMatrixData{ResultType: pe.Data.ResultType, Result: make(model.Matrix, len(pe.Data.Result))}}
+	for i, ss := range pe.Data.Result {
+		m := make(model.Metric, len(ss.Metric))
+		for k, v := range ss.Metric {
+			m[k] = v
+		}
+		values := make([]model.SamplePair, len(ss.Values))
+		copy(values, ss.Values)
+		out.Data.Result[i] = &model.SampleStream{Metric: m, Values: values}
+	}
+	return out
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
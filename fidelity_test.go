@@ -0,0 +1,214 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	exampleSpecialValuesEarly = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1435781430,"NaN"],[1435781445,"+Inf"]]}]}}`
+	exampleSpecialValuesLate  = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1435781460,"-Inf"],[1435781475,"1"]]}]}}`
+	exampleSpecialValuesMerge = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1435781430,"NaN"],[1435781445,"+Inf"],[1435781460,"-Inf"],[1435781475,"1"]]}]}}`
+)
+
+func TestSpecialValues_roundTrip(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.Connect()
+	tr := mc.T
+	tr.Metrics = newApplicationMetrics(tr.Config, prometheus.NewRegistry())
+	tr.Config.Caching.Compression = true
+	tr.Config.Caching.CompressionCodec = czGzip
+	cc := &ChecksumCache{Cache: &mc, T: tr}
+
+	roundTrip := func(body string) PrometheusMatrixEnvelope {
+		pe := PrometheusMatrixEnvelope{}
+		if err := tr.unmarshalMatrix([]byte(body), psOrigin, &pe); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(pe)
+		cb, err := tr.compressCacheBody(PrometheusOriginConfig{}, mnQueryRange, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc.Store("special", string(cb), 600)
+		stored, err := cc.Retrieve("special")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := decompressCacheBody([]byte(stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached := PrometheusMatrixEnvelope{}
+		if err := tr.unmarshalMatrix(db, psCache, &cached); err != nil {
+			t.Fatal(err)
+		}
+		return cached
+	}
+
+	// it should return NaN, +Inf and -Inf byte-for-byte after caching
+	early := roundTrip(exampleSpecialValuesEarly)
+	if b, _ := json.Marshal(early); string(b) != exampleSpecialValuesEarly {
+		t.Errorf("wanted %s got %s.", exampleSpecialValuesEarly, b)
+	}
+
+	// it should preserve them when merging cached and new data
+	late := roundTrip(exampleSpecialValuesLate)
+	merged := tr.mergeMatrix(late, early)
+	if b, _ := json.Marshal(merged); string(b) != exampleSpecialValuesMerge {
+		t.Errorf("wanted %s got %s.", exampleSpecialValuesMerge, b)
+	}
+
+	// it should preserve them when cropping
+	merged.cropToRange(1435781430000, 1435781460000)
+	if b, _ := json.Marshal(merged); string(b) != `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1435781430,"NaN"],[1435781445,"+Inf"],[1435781460,"-Inf"]]}]}}` {
+		t.Errorf("unexpected cropped matrix %s", b)
+	}
+}
+
+func TestCompareMatrices(t *testing.T) {
+	matrix := func(values ...float64) PrometheusMatrixEnvelope {
+		ss := &model.SampleStream{Metric: model.Metric{"__name__": "up"}}
+		for i, v := range values {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: model.SampleValue(v)})
+		}
+		return PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{ss}}}
+	}
+
+	tests := []struct {
+		served, origin PrometheusMatrixEnvelope
+		before         int64
+		tolerance      float64
+		mismatches     int
+	}{
+		// identical special values should match
+		{matrix(math.NaN(), math.Inf(1), math.Inf(-1), 1), matrix(math.NaN(), math.Inf(1), math.Inf(-1), 1), 10000, 0, 0},
+		// any difference, including between NaN and a number or between infinities, should not
+		{matrix(math.NaN(), math.Inf(1), math.Inf(-1), 1), matrix(0, math.Inf(-1), math.Inf(-1), 2), 10000, 0, 3},
+		// points after the settle time should not be compared
+		{matrix(1, 2, 3), matrix(1, 2, 4), 2000, 0, 0},
+		// points missing from the origin should not be compared
+		{matrix(1, 2, 3), matrix(1), 10000, 0, 0},
+		// values within the tolerance should match, unlike special values
+		{matrix(100, 200, 0, math.NaN()), matrix(100.05, 201, 0, 1), 10000, 0.001, 2},
+	}
+
+	for i, test := range tests {
+		if n, _ := compareMatrices(test.served, test.origin, test.before, test.tolerance); n != test.mismatches {
+			t.Errorf("test %d: wanted %d got %d.", i, test.mismatches, n)
+		}
+	}
+
+	// series with different labels should not be compared
+	other := matrix(5)
+	other.Data.Result[0].Metric = model.Metric{"__name__": "down"}
+	if n, _ := compareMatrices(matrix(1), other, 10000, 0); n != 0 {
+		t.Errorf("wanted %d got %d.", 0, n)
+	}
+}
+
+func TestComparePointCounts(t *testing.T) {
+	series := func(name string, points int) *model.SampleStream {
+		ss := &model.SampleStream{Metric: model.Metric{"__name__": model.LabelValue(name)}}
+		for i := 0; i < points; i++ {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: 1})
+		}
+		return ss
+	}
+	matrix := func(ss ...*model.SampleStream) PrometheusMatrixEnvelope {
+		return PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: ss}}
+	}
+
+	tests := []struct {
+		served, origin PrometheusMatrixEnvelope
+		before         int64
+		mismatches     int
+	}{
+		{matrix(series("up", 3)), matrix(series("up", 3)), 10000, 0},
+		// series with fewer points than the origin's should not match
+		{matrix(series("up", 2), series("down", 3)), matrix(series("up", 3), series("down", 3)), 10000, 1},
+		// points after the settle time should not be counted
+		{matrix(series("up", 2)), matrix(series("up", 3)), 2000, 0},
+		// series present in only one of the matrices should not match
+		{matrix(series("up", 3)), matrix(series("down", 3)), 10000, 2},
+		{matrix(series("up", 3), series("down", 0)), matrix(series("up", 3)), 10000, 0},
+	}
+	for i, test := range tests {
+		if n, _ := comparePointCounts(test.served, test.origin, test.before); n != test.mismatches {
+			t.Errorf("test %d: wanted %d got %d.", i, test.mismatches, n)
+		}
+	}
+}
+
+func TestPrometheusMatrixEnvelope_deepCopy(t *testing.T) {
+	pe := PrometheusMatrixEnvelope{}
+	json.Unmarshal([]byte(exampleRangeResponse), &pe)
+	c := pe.deepCopy()
+
+	// it should share no values or labels with the original
+	c.Data.Result[0].Values[0].Value = 99
+	c.Data.Result[0].Metric["job"] = "changed"
+	if pe.Data.Result[0].Values[0].Value == 99 || pe.Data.Result[0].Metric["job"] == "changed" {
+		t.Errorf("copy modified the original matrix")
+	}
+}
+
+func TestTricksterHandler_fidelityCheck(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the origin returns a special value at every step of the requested range
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := parseTime(r.FormValue(upStart))
+		end, _ := parseTime(r.FormValue(upEnd))
+		ss := &model.SampleStream{Metric: model.Metric{"__name__": "up"}}
+		for ts := start.Unix() - start.Unix()%15; ts <= end.Unix(); ts += 15 {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: model.SampleValue(math.Inf(1))})
+		}
+		json.NewEncoder(w).Encode(PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{ss}}})
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.FidelityCheckSampleRate = 1
+	tr.Config.Origins["default"] = o
+
+	// the first request populates the cache, and the second is served from it and checked
+	now := time.Now().Unix()
+	query := fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=15", now-600, now-300)
+	r := httptest.NewRequest("GET", es.URL+query, nil)
+	for i := 0; i < 2; i++ {
+		tr.promQueryRangeHandler(httptest.NewRecorder(), r)
+	}
+
+	// it should count the check as a match, since the origin data is unchanged
+	c := tr.Metrics.FidelityChecks.WithLabelValues(es.URL+prometheusAPIv1Path, fcMatch)
+	for i := 0; i < 100 && testutil.ToFloat64(c) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := testutil.ToFloat64(c); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+}
@@ -77,13 +77,50 @@ func (c *FilesystemCache) Retrieve(cacheKey string) (string, error) {
 	mtx.Lock()
 	content, err := ioutil.ReadFile(dataFile)
 	mtx.Unlock()
+	if os.IsNotExist(err) {
+		return "", &cacheMissError{key: cacheKey}
+	}
 	if err != nil {
-		return "", fmt.Errorf("Value for key [%s] not in cache", cacheKey)
+		return "", err
 	}
 
 	return string(content), nil
 }
 
+// Expiration returns the unix time at which an object in the cache expires
+func (c *FilesystemCache) Expiration(cacheKey string) (int64, error) {
+	expFile, _ := c.getFileNames(cacheKey)
+
+	mtx := c.getMutex(cacheKey)
+	mtx.Lock()
+	content, err := ioutil.ReadFile(expFile)
+	mtx.Unlock()
+	if os.IsNotExist(err) {
+		return 0, &cacheMissError{key: cacheKey}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(content), 10, 64)
+}
+
+// Delete removes an object from the cache, if present
+func (c *FilesystemCache) Delete(cacheKey string) error {
+	expFile, dataFile := c.getFileNames(cacheKey)
+	level.Debug(c.T.Logger).Log("event", "filesystem cache delete", "key", cacheKey, "dataFile", dataFile)
+
+	mtx := c.getMutex(cacheKey)
+	mtx.Lock()
+	err := os.Remove(dataFile)
+	os.Remove(expFile)
+	mtx.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // Reap continually iterates through the cache to find expired elements and removes them
 func (c *FilesystemCache) Reap() {
 	for {
@@ -109,6 +146,7 @@ func (c *FilesystemCache) Reap() {
 							// Delete the key
 							os.Remove(expFile)
 							os.Remove(dataFile)
+							c.T.CacheEvents.emit(cacheEvent{Type: ceExpire, Key: cacheKey})
 
 							// Close out the channel if it exists
 							if _, ok := c.T.ResponseChannels[cacheKey]; ok {
@@ -129,6 +167,42 @@ func (c *FilesystemCache) Reap() {
 	}
 }
 
+// Walk calls fn for each unexpired record in the cache, stopping at the first error
+func (c *FilesystemCache) Walk(fn func(CacheObject) error) error {
+	now := time.Now().Unix()
+
+	files, err := ioutil.ReadDir(c.Config.CachePath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".expiration") {
+			continue
+		}
+		cacheKey := strings.TrimSuffix(file.Name(), ".expiration")
+		expFile, dataFile := c.getFileNames(cacheKey)
+
+		mtx := c.getMutex(cacheKey)
+		mtx.Lock()
+		content, err1 := ioutil.ReadFile(expFile)
+		data, err2 := ioutil.ReadFile(dataFile)
+		mtx.Unlock()
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		expiration, err := strconv.ParseInt(string(content), 10, 64)
+		if err != nil || expiration < now {
+			continue
+		}
+		if err := fn(CacheObject{Key: cacheKey, Value: string(data), Expiration: expiration}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Close is not used for FilesystemCache
 func (c *FilesystemCache) Close() error {
 	return nil
@@ -14,15 +14,29 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 )
 
-func TestFilesystemCache_Connect(t *testing.T) {
-	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1}}
+// newTestFilesystemCache returns a filesystem cache in its own directory, so that the reapers of other tests do not
+// remove its records, and a function that removes the directory
+func newTestFilesystemCache(t *testing.T, reapSleepMS int64) (FilesystemCache, func()) {
+	dir, err := ioutil.TempDir("", "trickster-filesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: reapSleepMS}}
 	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
-	fc := FilesystemCache{T: &tr, Config: FilesystemCacheConfig{CachePath: "."}}
+	return FilesystemCache{T: &tr, Config: FilesystemCacheConfig{CachePath: dir}}, func() { os.RemoveAll(dir) }
+}
+
+func TestFilesystemCache_Connect(t *testing.T) {
+	fc, closeFn := newTestFilesystemCache(t, 1)
+	defer closeFn()
 
 	// it should connect
 	err := fc.Connect()
@@ -32,9 +46,8 @@ func TestFilesystemCache_Connect(t *testing.T) {
 }
 
 func TestFilesystemCache_Store(t *testing.T) {
-	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1}}
-	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
-	fc := FilesystemCache{T: &tr, Config: FilesystemCacheConfig{CachePath: "."}}
+	fc, closeFn := newTestFilesystemCache(t, 1)
+	defer closeFn()
 
 	err := fc.Connect()
 	if err != nil {
@@ -49,9 +62,8 @@ func TestFilesystemCache_Store(t *testing.T) {
 }
 
 func TestFilesystemCache_Retrieve(t *testing.T) {
-	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1}}
-	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
-	fc := FilesystemCache{T: &tr, Config: FilesystemCacheConfig{CachePath: "."}}
+	fc, closeFn := newTestFilesystemCache(t, 1)
+	defer closeFn()
 
 	err := fc.Connect()
 	if err != nil {
@@ -71,3 +83,33 @@ func TestFilesystemCache_Retrieve(t *testing.T) {
 		t.Errorf("wanted \"%s\". got \"%s\".", "data", data)
 	}
 }
+
+func TestFilesystemCache_Expiration(t *testing.T) {
+	fc, closeFn := newTestFilesystemCache(t, 1000)
+	defer closeFn()
+
+	err := fc.Connect()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should report a miss for an absent key
+	if _, err := fc.Expiration("expirationKey"); !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+
+	err = fc.Store("expirationKey", "data", 60)
+	if err != nil {
+		t.Error(err)
+	}
+	defer fc.Delete("expirationKey")
+
+	// it should return the expiration of a stored value
+	exp, err := fc.Expiration("expirationKey")
+	if err != nil {
+		t.Error(err)
+	}
+	if now := time.Now().Unix(); exp < now+59 || exp > now+60 {
+		t.Errorf("wanted %d got %d.", now+60, exp)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -31,6 +32,7 @@ const (
 	cfProxyPort    = "proxy-port"
 	cfMetricsPort  = "metrics-port"
 	cfProfilerPort = "profiler-port"
+	cfSet          = "set"
 
 	// Environment variables
 	evOrigin       = "TRK_ORIGIN"
@@ -46,11 +48,13 @@ const (
 func loadConfiguration(c *Config, arguments []string) error {
 	var path string
 	var version bool
+	var overrides overrideFlags
 
 	f := flag.NewFlagSet(applicationName, -1)
 	f.SetOutput(ioutil.Discard)
 	f.StringVar(&path, cfConfig, "", "Supplies Path to Config File")
 	f.BoolVar(&version, cfVersion, false, "Prints trickster version")
+	f.Var(&overrides, cfSet, "Overrides a config option")
 	f.Parse(arguments)
 
 	// If the config file is not specified on the cmdline then try the default
@@ -77,11 +81,16 @@ func loadConfiguration(c *Config, arguments []string) error {
 
 	// Load from Environment Variables
 	loadEnvVars(c)
+	if err := loadEnvOverrides(c, os.Environ()); err != nil {
+		return err
+	}
 
 	//Load from command line flags.
-	loadFlags(c, arguments)
+	if err := loadFlags(c, arguments); err != nil {
+		return err
+	}
 
-	return nil
+	return c.validate()
 }
 
 func loadEnvVars(c *Config) {
@@ -119,14 +128,15 @@ func loadEnvVars(c *Config) {
 
 }
 
-// loadFlags loads configuration from command line flags.
-func loadFlags(c *Config, arguments []string) {
+// loadFlags loads configuration from command line flags, followed by the options overridden with -set flags.
+func loadFlags(c *Config, arguments []string) error {
 	var path string
 	var version bool
 	var origin string
 	var proxyListenPort int
 	var metricsListenPort int
 	var profilerListenPort int
+	var overrides overrideFlags
 
 	f := flag.NewFlagSet(applicationName, flag.ExitOnError)
 	f.BoolVar(&version, cfVersion, true, "Prints Trickster version")
@@ -136,6 +146,7 @@ func loadFlags(c *Config, arguments []string) {
 	f.IntVar(&proxyListenPort, cfProxyPort, 0, "Port that the Proxy server will listen on.")
 	f.IntVar(&metricsListenPort, cfMetricsPort, 0, "Port that the /metrics endpoint will listen on.")
 	f.IntVar(&profilerListenPort, cfProfilerPort, 0, "Port that the /debug/pprof endpoint will listen on.")
+	f.Var(&overrides, cfSet, "Overrides a config option, e.g., -set origins.default.timeout_secs=30. May be repeated.")
 
 	// BEGIN IGNORED FLAGS
 	f.StringVar(&path, cfConfig, "", "Path to Trickster Config File")
@@ -156,4 +167,15 @@ func loadFlags(c *Config, arguments []string) {
 		c.Profiler.ListenPort = profilerListenPort
 		c.Profiler.Enabled = true
 	}
+
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("-%s %q: expected path=value", cfSet, o)
+		}
+		if err := setConfigOption(c, parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
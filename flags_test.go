@@ -53,3 +53,29 @@ func TestLoadConfiguration(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLoadFlags_set(t *testing.T) {
+	c := NewConfig()
+	a := []string{
+		"-set",
+		"origins.default.timeout_secs=30",
+		"-set",
+		"cache.cache_type=redis",
+	}
+
+	// it should override config options
+	if err := loadFlags(c, a); err != nil {
+		t.Error(err)
+	}
+	if c.Origins["default"].TimeoutSecs != 30 {
+		t.Errorf("wanted \"%d\". got \"%d\".", 30, c.Origins["default"].TimeoutSecs)
+	}
+	if c.Caching.CacheType != ctRedis {
+		t.Errorf("wanted \"%s\". got \"%s\".", ctRedis, c.Caching.CacheType)
+	}
+
+	// it should fail on malformed overrides
+	if err := loadFlags(c, []string{"-set", "origins.default.timeout_secs"}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
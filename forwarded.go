@@ -0,0 +1,189 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Forwarded header names
+	hnForwarded       = "Forwarded"
+	hnXForwardedFor   = "X-Forwarded-For"
+	hnXForwardedProto = "X-Forwarded-Proto"
+	hnXForwardedHost  = "X-Forwarded-Host"
+
+	// Forwarded header modes
+	fwOmit    = "omit"
+	fwAppend  = "append"
+	fwReplace = "replace"
+)
+
+// validForwardedMode returns true if the provided forwarded header mode is supported
+func validForwardedMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", fwOmit, fwAppend, fwReplace:
+		return true
+	}
+	return false
+}
+
+// TrustedProxies is a list of networks whose forwarded headers are trusted when determining the real client IP
+type TrustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of IP addresses and CIDR blocks into TrustedProxies
+func parseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	tp := make(TrustedProxies, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		tp = append(tp, n)
+	}
+	return tp, nil
+}
+
+// contains returns true if the IP is within one of the trusted networks
+func (tp TrustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the immediate peer of the request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedFor returns the addresses listed in the request's X-Forwarded-For header or, when absent,
+// in the for= parameters of its Forwarded header, in the order they were added
+func forwardedFor(r *http.Request) []string {
+	addrs := make([]string, 0)
+	if xff := r.Header.Get(hnXForwardedFor); xff != "" {
+		for _, a := range strings.Split(strings.Join(r.Header[hnXForwardedFor], ","), ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				addrs = append(addrs, a)
+			}
+		}
+		return addrs
+	}
+	for _, element := range strings.Split(strings.Join(r.Header[hnForwarded], ","), ",") {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "for" {
+				a := strings.Trim(kv[1], `"`)
+				if h, _, err := net.SplitHostPort(a); err == nil {
+					a = h
+				}
+				addrs = append(addrs, strings.Trim(a, "[]"))
+			}
+		}
+	}
+	return addrs
+}
+
+// clientIP returns the real client IP of the request. Forwarded addresses are only honored when the request
+// arrived via a trusted proxy, in which case the nearest untrusted forwarded address is the client.
+func (tp TrustedProxies) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !tp.contains(net.ParseIP(ip)) {
+		return ip
+	}
+	addrs := forwardedFor(r)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip = addrs[i]
+		if !tp.contains(net.ParseIP(ip)) {
+			break
+		}
+	}
+	return ip
+}
+
+// requestScheme returns the scheme the client used to connect to Trickster
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedNode formats an address as a node for the RFC 7239 Forwarded header
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// setForwardedHeaders adds the X-Forwarded-* and RFC 7239 Forwarded headers to the upstream request headers
+// per the origin's configuration. The scheme and host forwarded by the client are only honored from trusted proxies.
+func setForwardedHeaders(o PrometheusOriginConfig, tp TrustedProxies, r *http.Request, headers http.Header) {
+	ip := remoteIP(r)
+	proto := requestScheme(r)
+	trusted := tp.contains(net.ParseIP(ip))
+
+	switch strings.ToLower(o.XForwardedHeaders) {
+	case fwAppend:
+		xff := ip
+		if prior := strings.Join(r.Header[hnXForwardedFor], ", "); prior != "" {
+			xff = prior + ", " + ip
+		}
+		headers.Set(hnXForwardedFor, xff)
+		if p := r.Header.Get(hnXForwardedProto); p != "" && trusted {
+			proto = p
+		}
+		headers.Set(hnXForwardedProto, proto)
+		host := r.Host
+		if h := r.Header.Get(hnXForwardedHost); h != "" && trusted {
+			host = h
+		}
+		headers.Set(hnXForwardedHost, host)
+	case fwReplace:
+		headers.Set(hnXForwardedFor, ip)
+		headers.Set(hnXForwardedProto, proto)
+		headers.Set(hnXForwardedHost, r.Host)
+	}
+
+	element := fmt.Sprintf("for=%s;host=%q;proto=%s", forwardedNode(ip), r.Host, proto)
+	switch strings.ToLower(o.ForwardedHeader) {
+	case fwAppend:
+		if prior := strings.Join(r.Header[hnForwarded], ", "); prior != "" {
+			element = prior + ", " + element
+		}
+		headers.Set(hnForwarded, element)
+	case fwReplace:
+		headers.Set(hnForwarded, element)
+	}
+}
@@ -0,0 +1,107 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+	r.RemoteAddr = "10.0.0.2:5555"
+	r.Header.Set(hnXForwardedFor, "192.168.1.1")
+	r.Header.Set(hnForwarded, "for=192.168.1.1")
+
+	tests := []struct {
+		xForwarded string
+		forwarded  string
+		wantXFF    string
+		wantFwd    string
+	}{
+		{"", "", "", ""},
+		{fwOmit, fwOmit, "", ""},
+		{fwAppend, fwAppend, "192.168.1.1, 10.0.0.2", `for=192.168.1.1, for=10.0.0.2;host="trickster";proto=http`},
+		{fwReplace, fwReplace, "10.0.0.2", `for=10.0.0.2;host="trickster";proto=http`},
+	}
+
+	for _, test := range tests {
+		headers := http.Header{}
+		setForwardedHeaders(PrometheusOriginConfig{XForwardedHeaders: test.xForwarded, ForwardedHeader: test.forwarded}, nil, r, headers)
+		if headers.Get(hnXForwardedFor) != test.wantXFF {
+			t.Errorf("wanted %q got %q.", test.wantXFF, headers.Get(hnXForwardedFor))
+		}
+		if headers.Get(hnForwarded) != test.wantFwd {
+			t.Errorf("wanted %q got %q.", test.wantFwd, headers.Get(hnForwarded))
+		}
+	}
+
+	// it should only honor the scheme and host forwarded by trusted proxies
+	r.Header.Set(hnXForwardedProto, "https")
+	r.Header.Set(hnXForwardedHost, "grafana.example.com")
+	o := PrometheusOriginConfig{XForwardedHeaders: fwAppend}
+	headers := http.Header{}
+	setForwardedHeaders(o, nil, r, headers)
+	if headers.Get(hnXForwardedProto) != "http" || headers.Get(hnXForwardedHost) != "trickster" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	tp, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	headers = http.Header{}
+	setForwardedHeaders(o, tp, r, headers)
+	if headers.Get(hnXForwardedProto) != "https" || headers.Get(hnXForwardedHost) != "grafana.example.com" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestTrustedProxies_clientIP(t *testing.T) {
+	tp, err := parseTrustedProxies([]string{"10.0.0.0/8", "172.16.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		forwarded  string
+		want       string
+	}{
+		// it should ignore forwarded headers from untrusted peers
+		{"192.168.1.1:80", "1.2.3.4", "", "192.168.1.1"},
+		// it should use the nearest untrusted forwarded address from trusted peers
+		{"10.0.0.2:80", "1.2.3.4, 5.6.7.8, 172.16.0.1", "", "5.6.7.8"},
+		// it should fall back to the Forwarded header
+		{"172.16.0.1:80", "", `for=1.2.3.4, for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		// it should use the peer when there are no forwarded headers
+		{"10.0.0.2:80", "", "", "10.0.0.2"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://trickster/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xff != "" {
+			r.Header.Set(hnXForwardedFor, test.xff)
+		}
+		if test.forwarded != "" {
+			r.Header.Set(hnForwarded, test.forwarded)
+		}
+		if ip := tp.clientIP(r); ip != test.want {
+			t.Errorf("wanted %s got %s.", test.want, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Errorf("expected an error for an invalid trusted proxy")
+	}
+}
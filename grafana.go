@@ -0,0 +1,138 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// Headers and cookies set by Grafana's datasource proxy
+	hnGrafanaUser        = "X-Grafana-User"
+	hnGrafanaOrgID       = "X-Grafana-Org-Id"
+	hnGrafanaTeam        = "X-Grafana-Team"
+	grafanaSessionCookie = "grafana_session"
+
+	// Grafana cache key scopes
+	gsUser = "user"
+	gsTeam = "team"
+	gsOrg  = "org"
+)
+
+// GrafanaProxyConfig describes how requests relayed by Grafana's datasource proxy are attributed to Grafana users
+type GrafanaProxyConfig struct {
+	// Enabled recognizes the Grafana user, team and org of requests relayed by Grafana's datasource proxy
+	Enabled bool `toml:"enabled"`
+	// UserHeader is the request header with the Grafana login, sent when Grafana's send_user_header is enabled
+	UserHeader string `toml:"user_header"`
+	// TeamHeader is the request header with the Grafana team, configured as a custom header of the datasource
+	TeamHeader string `toml:"team_header"`
+	// ForwardUserHeader is the header that the Grafana user is forwarded to the origin as. Default is not to forward it
+	ForwardUserHeader string `toml:"forward_user_header"`
+	// ForwardTeamHeader is the header that the Grafana team is forwarded to the origin as. Default is not to forward it
+	ForwardTeamHeader string `toml:"forward_team_header"`
+	// CacheKeyScope caches data separately per Grafana "user", "team" or "org". Default is to share cached data
+	CacheKeyScope string `toml:"cache_key_scope"`
+}
+
+// grafanaIdentity is the Grafana user, team and org on whose behalf a request was made
+type grafanaIdentity struct {
+	User string
+	Team string
+	Org  string
+}
+
+// identity returns the Grafana user, team and org of the request. Without a user header, the user is identified by
+// the Grafana session cookie, when the datasource forwards it.
+func (gc GrafanaProxyConfig) identity(r *http.Request) grafanaIdentity {
+	if !gc.Enabled {
+		return grafanaIdentity{}
+	}
+
+	id := grafanaIdentity{
+		User: r.Header.Get(gc.userHeader()),
+		Team: r.Header.Get(gc.teamHeader()),
+		Org:  r.Header.Get(hnGrafanaOrgID),
+	}
+	if id.User == "" {
+		if c, err := r.Cookie(grafanaSessionCookie); err == nil && c.Value != "" {
+			id.User = grafanaSessionCookie + ":" + c.Value
+		}
+	}
+	return id
+}
+
+// setForwardedHeaders sets the Grafana user and team headers of the request on the upstream request headers, when
+// configured, replacing any that the client sent itself. A user identified only by its session cookie is not forwarded.
+func (gc GrafanaProxyConfig) setForwardedHeaders(r *http.Request, headers http.Header) {
+	if !gc.Enabled {
+		return
+	}
+	forward := func(name, value string) {
+		if name == "" {
+			return
+		}
+		headers.Del(name)
+		if value != "" {
+			headers.Set(name, value)
+		}
+	}
+	forward(gc.ForwardUserHeader, r.Header.Get(gc.userHeader()))
+	forward(gc.ForwardTeamHeader, r.Header.Get(gc.teamHeader()))
+}
+
+// userHeader returns the name of the request header with the Grafana login
+func (gc GrafanaProxyConfig) userHeader() string {
+	if gc.UserHeader == "" {
+		return hnGrafanaUser
+	}
+	return gc.UserHeader
+}
+
+// teamHeader returns the name of the request header with the Grafana team
+func (gc GrafanaProxyConfig) teamHeader() string {
+	if gc.TeamHeader == "" {
+		return hnGrafanaTeam
+	}
+	return gc.TeamHeader
+}
+
+// cacheKeyScope returns the part of the cache key base that separates the cached data of the request's Grafana user,
+// team or org from that of others, so that per-user filtering by the origin is not defeated by a shared cache
+func (gc GrafanaProxyConfig) cacheKeyScope(r *http.Request) string {
+	id := gc.identity(r)
+	switch gc.CacheKeyScope {
+	case gsUser:
+		return "grafana-user:" + id.Org + "/" + id.User
+	case gsTeam:
+		return "grafana-team:" + id.Org + "/" + id.Team
+	case gsOrg:
+		return "grafana-org:" + id.Org
+	}
+	return ""
+}
+
+// validate returns an error if the cache key scope is unknown, or set without enabling Grafana support
+func (gc GrafanaProxyConfig) validate() error {
+	switch gc.CacheKeyScope {
+	case "", gsUser, gsTeam, gsOrg:
+	default:
+		return fmt.Errorf("unknown grafana cache_key_scope %q", gc.CacheKeyScope)
+	}
+	if gc.CacheKeyScope != "" && !gc.Enabled {
+		return fmt.Errorf("grafana cache_key_scope requires grafana to be enabled")
+	}
+	return nil
+}
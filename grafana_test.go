@@ -0,0 +1,137 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newGrafanaRequest(user, team, org string) *http.Request {
+	r := httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil)
+	if user != "" {
+		r.Header.Set(hnGrafanaUser, user)
+	}
+	if team != "" {
+		r.Header.Set(hnGrafanaTeam, team)
+	}
+	if org != "" {
+		r.Header.Set(hnGrafanaOrgID, org)
+	}
+	return r
+}
+
+func TestGrafanaProxyConfig_identity(t *testing.T) {
+	gc := GrafanaProxyConfig{Enabled: true}
+
+	// it should read the user, team and org headers
+	id := gc.identity(newGrafanaRequest("alice", "sre", "1"))
+	if id != (grafanaIdentity{User: "alice", Team: "sre", Org: "1"}) {
+		t.Errorf("unexpected identity %v", id)
+	}
+
+	// it should identify the user by the session cookie without a user header
+	r := newGrafanaRequest("", "", "1")
+	r.AddCookie(&http.Cookie{Name: grafanaSessionCookie, Value: "abc"})
+	if id := gc.identity(r); id.User != grafanaSessionCookie+":abc" {
+		t.Errorf("wanted %q got %q.", grafanaSessionCookie+":abc", id.User)
+	}
+
+	// it should read custom headers
+	gc.UserHeader = "X-WEBAUTH-USER"
+	r = newGrafanaRequest("", "", "1")
+	r.Header.Set("X-WEBAUTH-USER", "bob")
+	if id := gc.identity(r); id.User != "bob" {
+		t.Errorf("wanted %q got %q.", "bob", id.User)
+	}
+
+	// it should identify no one when disabled
+	if id := (GrafanaProxyConfig{}).identity(newGrafanaRequest("alice", "sre", "1")); id != (grafanaIdentity{}) {
+		t.Errorf("unexpected identity %v", id)
+	}
+}
+
+func TestGrafanaProxyConfig_setForwardedHeaders(t *testing.T) {
+	gc := GrafanaProxyConfig{Enabled: true, ForwardUserHeader: "X-Scope-User", ForwardTeamHeader: "X-Scope-Team"}
+
+	// it should forward the user and team, replacing any the client sent
+	headers := http.Header{"X-Scope-User": {"mallory"}}
+	gc.setForwardedHeaders(newGrafanaRequest("alice", "sre", "1"), headers)
+	if v := headers.Get("X-Scope-User"); v != "alice" {
+		t.Errorf("wanted %q got %q.", "alice", v)
+	}
+	if v := headers.Get("X-Scope-Team"); v != "sre" {
+		t.Errorf("wanted %q got %q.", "sre", v)
+	}
+
+	// it should remove a client's header when there is no Grafana user to forward
+	headers = http.Header{"X-Scope-User": {"mallory"}}
+	gc.setForwardedHeaders(newGrafanaRequest("", "", "1"), headers)
+	if v, ok := headers["X-Scope-User"]; ok {
+		t.Errorf("unexpected forwarded user %q", v)
+	}
+}
+
+func TestTricksterHandler_buildRequestContext_grafanaCacheKeyScope(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+
+	cacheKey := func(r *http.Request) string {
+		ctx, err := tr.buildRequestContext(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx.CacheKey
+	}
+
+	// it should share cached data by default
+	if cacheKey(newGrafanaRequest("alice", "sre", "1")) != cacheKey(newGrafanaRequest("bob", "dev", "1")) {
+		t.Errorf("expected users to share a cache key")
+	}
+
+	o := tr.Config.Origins["default"]
+	o.Grafana = GrafanaProxyConfig{Enabled: true, CacheKeyScope: gsTeam}
+	tr.Config.Origins["default"] = o
+
+	// it should key cached data per team
+	if cacheKey(newGrafanaRequest("alice", "sre", "1")) != cacheKey(newGrafanaRequest("bob", "sre", "1")) {
+		t.Errorf("expected members of a team to share a cache key")
+	}
+	if cacheKey(newGrafanaRequest("alice", "sre", "1")) == cacheKey(newGrafanaRequest("bob", "dev", "1")) {
+		t.Errorf("expected teams to have separate cache keys")
+	}
+	if cacheKey(newGrafanaRequest("alice", "sre", "1")) == cacheKey(newGrafanaRequest("alice", "sre", "2")) {
+		t.Errorf("expected teams of different orgs to have separate cache keys")
+	}
+}
+
+func TestGrafanaProxyConfig_validate(t *testing.T) {
+	tests := []struct {
+		gc GrafanaProxyConfig
+		ok bool
+	}{
+		{GrafanaProxyConfig{}, true},
+		{GrafanaProxyConfig{Enabled: true, CacheKeyScope: gsUser}, true},
+		{GrafanaProxyConfig{Enabled: true, CacheKeyScope: "dashboard"}, false},
+		{GrafanaProxyConfig{CacheKeyScope: gsOrg}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.gc.validate(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
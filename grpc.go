@@ -0,0 +1,172 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	hnGRPCStatus      = "Grpc-Status"
+	hnGRPCMessage     = "Grpc-Message"
+	hvApplicationGRPC = "application/grpc"
+
+	// gRPC status codes
+	gsUnimplemented = "12"
+	gsUnavailable   = "14"
+
+	rnGRPC = "grpc"
+)
+
+// grpcEnabled returns true if any origin is passed gRPC requests
+func (c *Config) grpcEnabled() bool {
+	for _, o := range c.Origins {
+		if o.GRPC {
+			return true
+		}
+	}
+	return false
+}
+
+// validateGRPC returns an error if the origin lists gRPC paths without being passed gRPC requests, or a path is not
+// absolute
+func (o PrometheusOriginConfig) validateGRPC() error {
+	if len(o.GRPCPaths) > 0 && !o.GRPC {
+		return fmt.Errorf("grpc_paths requires grpc = true")
+	}
+	for _, p := range o.GRPCPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("grpc path %q must start with /", p)
+		}
+	}
+	return nil
+}
+
+// isGRPCRequest matches the requests of gRPC clients, which are HTTP/2 POSTs of gRPC content
+func isGRPCRequest(r *http.Request, rm *mux.RouteMatch) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodPost &&
+		strings.HasPrefix(r.Header.Get(hnContentType), hvApplicationGRPC)
+}
+
+// grpcOriginName returns the name of the gRPC origin that the request is passed to: the origin with the longest of
+// the grpc_paths prefixing the request's path or, failing that, the origin named by the host of the request's
+// authority, or the default origin. ok is false if that origin is not passed gRPC requests.
+func (t *TricksterHandler) grpcOriginName(r *http.Request) (name string, ok bool) {
+	longest := -1
+	for n, o := range t.Config.Origins {
+		if !o.GRPC {
+			continue
+		}
+		for _, p := range o.GRPCPaths {
+			if strings.HasPrefix(r.URL.Path, p) && (len(p) > longest || (len(p) == longest && n < name)) {
+				name, longest = n, len(p)
+			}
+		}
+	}
+	if longest >= 0 {
+		return name, true
+	}
+
+	// clients include the port in the authority of gRPC requests
+	name = r.Host
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	if _, ok := t.Config.Origins[name]; !ok {
+		name = "default"
+	}
+	return name, t.Config.Origins[name].GRPC
+}
+
+// withGRPCOrigin wraps a gRPC handler so that the request names the gRPC origin it is passed to, and answers the
+// requests that no origin is passed with the Unimplemented status
+func (t *TricksterHandler) withGRPCOrigin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := t.grpcOriginName(r)
+		if !ok {
+			t.Metrics.GRPCRequests.WithLabelValues(name, gsUnimplemented).Inc()
+			writeGRPCStatus(w, gsUnimplemented, "no origin serves "+r.URL.Path)
+			return
+		}
+		next(w, mux.SetURLVars(r, map[string]string{"originMoniker": name}))
+	}
+}
+
+// grpcProxyHandler passes a gRPC request through to its origin over HTTP/2, streaming the messages of both directions
+// and passing the response's trailers back to the client
+func (t *TricksterHandler) grpcProxyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["originMoniker"]
+	o := t.Config.Origins[name]
+	// config validation ensures the origin url parses
+	u, _ := url.Parse(o.OriginURL)
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = u.Scheme
+			req.URL.Host = u.Host
+			req.URL.Path = strings.TrimSuffix(u.Path, "/") + req.URL.Path
+			req.URL.RawPath = ""
+			req.Host = u.Host
+		},
+		Transport: t.Transports.get(o, u.Host),
+		// messages are passed on as soon as they are read, in both directions
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			level.Error(t.Logger).Log(lfEvent, "error proxying grpc request", "origin", name, "path", r.URL.Path,
+				lfDetail, err.Error())
+			writeGRPCStatus(w, gsUnavailable, err.Error())
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	t.Metrics.GRPCRequests.WithLabelValues(name, grpcStatus(w.Header())).Inc()
+}
+
+// writeGRPCStatus answers a gRPC request with the status and message, and no messages
+func writeGRPCStatus(w http.ResponseWriter, status, message string) {
+	w.Header().Set(hnContentType, hvApplicationGRPC)
+	w.Header().Set(hnGRPCStatus, status)
+	w.Header().Set(hnGRPCMessage, message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatus returns the gRPC status of a response from its headers, where the trailers are also found once the
+// response is written
+func grpcStatus(h http.Header) string {
+	if s := h.Get(hnGRPCStatus); s != "" {
+		return s
+	}
+	if s := h.Get(http.TrailerPrefix + hnGRPCStatus); s != "" {
+		return s
+	}
+	// a response with no status is treated as unavailable by gRPC clients
+	return gsUnavailable
+}
+
+// grpcProtocols returns the protocols of a proxy server or upstream transport passing gRPC requests, which cleartext
+// connections carry over HTTP/2 without an upgrade
+func grpcProtocols(http1 bool) *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(http1)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
@@ -0,0 +1,144 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusOriginConfig_validateGRPC(t *testing.T) {
+	tests := []struct {
+		config PrometheusOriginConfig
+		valid  bool
+	}{
+		{PrometheusOriginConfig{}, true},
+		{PrometheusOriginConfig{GRPC: true}, true},
+		{PrometheusOriginConfig{GRPC: true, GRPCPaths: []string{"/tempopb.Querier/"}}, true},
+		{PrometheusOriginConfig{GRPCPaths: []string{"/tempopb.Querier/"}}, false},
+		{PrometheusOriginConfig{GRPC: true, GRPCPaths: []string{"tempopb.Querier/"}}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validateGRPC(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTricksterHandler_grpcOriginName(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tr.Config.Origins["tempo"] = PrometheusOriginConfig{GRPC: true, GRPCPaths: []string{"/tempopb."}}
+	tr.Config.Origins["querier"] = PrometheusOriginConfig{GRPC: true, GRPCPaths: []string{"/tempopb.Querier/"}}
+	tr.Config.Origins["jaeger"] = PrometheusOriginConfig{GRPC: true}
+
+	tests := []struct {
+		host, path string
+		name       string
+		ok         bool
+	}{
+		{"trickster", "/tempopb.Querier/FindTraceByID", "querier", true},
+		{"trickster", "/tempopb.Pusher/PushBytes", "tempo", true},
+		{"jaeger", "/jaeger.api_v2.QueryService/GetTrace", "jaeger", true},
+		{"jaeger:16685", "/jaeger.api_v2.QueryService/GetTrace", "jaeger", true},
+		{"trickster", "/jaeger.api_v2.QueryService/GetTrace", "default", false},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", "http://"+test.host+test.path, nil)
+		if name, ok := tr.grpcOriginName(r); name != test.name || ok != test.ok {
+			t.Errorf("test %d: unexpected result %s %t", i, name, ok)
+		}
+	}
+}
+
+func TestTricksterHandler_grpcProxyHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the origin streams a message, and only ends the response once the client has read it
+	read := make(chan struct{})
+	es := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/tempopb.Querier/Search" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set(hnContentType, hvApplicationGRPC)
+		w.Header().Set("Trailer", hnGRPCStatus)
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(body, '\n'))
+		w.(http.Flusher).Flush()
+		<-read
+		w.Write([]byte("done\n"))
+		w.Header().Set(hnGRPCStatus, "0")
+	}))
+	es.Config.Protocols = grpcProtocols(false)
+	es.Start()
+	defer es.Close()
+
+	tr.Transports = NewTransports()
+	tr.Config.Origins["tempo"] = PrometheusOriginConfig{OriginURL: es.URL, GRPC: true,
+		GRPCPaths: []string{"/tempopb.Querier/"}, ResponseHeaders: ResponseHeaderPolicy{HSTS: "max-age=60"}}
+	ts := httptest.NewUnstartedServer(tr.newRouter())
+	ts.Config.Protocols = grpcProtocols(true)
+	ts.Start()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{Protocols: grpcProtocols(false)}}
+
+	// it should pass the request through over HTTP/2, streaming the response and passing its trailers back
+	req, _ := http.NewRequest("POST", ts.URL+"/tempopb.Querier/Search", strings.NewReader("search"))
+	req.Header.Set(hnContentType, hvApplicationGRPC+"+proto")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	if line, _ := br.ReadString('\n'); line != "search\n" {
+		t.Errorf("wanted %q got %q.", "search\n", line)
+	}
+	close(read)
+	io.Copy(ioutil.Discard, br)
+	if s := resp.Trailer.Get(hnGRPCStatus); s != "0" {
+		t.Errorf("wanted %q got %q.", "0", s)
+	}
+	// it should apply the middleware of proxied routes
+	if v := resp.Header.Get(hnStrictTransportSecurity); v != "max-age=60" {
+		t.Errorf("wanted %q got %q.", "max-age=60", v)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.GRPCRequests.WithLabelValues("tempo", "0")); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+
+	// it should answer requests that no origin is passed with the Unimplemented status
+	req, _ = http.NewRequest("POST", ts.URL+"/jaeger.api_v2.QueryService/GetTrace", strings.NewReader(""))
+	req.Header.Set(hnContentType, hvApplicationGRPC)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := resp.Header.Get(hnGRPCStatus); s != gsUnimplemented {
+		t.Errorf("wanted %q got %q.", gsUnimplemented, s)
+	}
+}
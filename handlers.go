@@ -14,6 +14,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
@@ -29,7 +31,6 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/golang/snappy"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
@@ -42,12 +43,14 @@ const (
 	// Common HTTP Header Values
 	hvNoCache         = "no-cache"
 	hvApplicationJSON = "application/json"
+	hvTextPlain       = "text/plain; charset=utf-8"
 
 	// Common HTTP Header Names
 	hnCacheControl  = "Cache-Control"
 	hnAllowOrigin   = "Access-Control-Allow-Origin"
 	hnContentType   = "Content-Type"
 	hnAuthorization = "Authorization"
+	hnRetryAfter    = "Retry-After"
 
 	// HTTP methods
 	hmGet = "GET"
@@ -56,6 +59,8 @@ const (
 	rvSuccess = "success"
 	rvMatrix  = "matrix"
 	rvVector  = "vector"
+	rvScalar  = "scalar"
+	rvString  = "string"
 
 	// Common URL parameter names
 	upQuery      = "query"
@@ -79,11 +84,32 @@ const (
 // TricksterHandler contains the services the Handlers need to operate
 type TricksterHandler struct {
 	Logger           log.Logger
+	SlowQueryLogger  log.Logger
+	OriginLoggers    map[string]log.Logger
+	LogSampler       *LogSampler
 	Config           *Config
 	Metrics          *ApplicationMetrics
 	Cacher           Cache
+	MemoryLimiter    *MemoryLimiter
+	LoadShedder      *LoadShedder
+	Stats            *HitStats
+	CacheEvents      *CacheEvents
+	Router           *mux.Router
+	ClockOffsets     *ClockOffsets
+	Discovery        *Discovery
+	Transports       *Transports
+	TrustedProxies   TrustedProxies
 	ResponseChannels map[string]chan *ClientRequestContext
 	ChannelCreateMtx sync.Mutex
+	// KeyLocks holds the cache keys of the records being fetched by a single request on behalf of concurrent ones
+	KeyLocks keyLocks
+
+	// bypass is 1 when all requests are proxied without caching; accessed atomically
+	bypass int32
+	// cacheUnavailable is 1 when the instance started without a reachable cache; accessed atomically
+	cacheUnavailable int32
+	// writeInvalidations holds the written series awaiting cache invalidation
+	writeInvalidations writeInvalidationQueue
 }
 
 // HTTP Handlers
@@ -101,30 +127,77 @@ func (t *TricksterHandler) pingHandler(w http.ResponseWriter, r *http.Request) {
 func (t *TricksterHandler) promHealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	level.Debug(t.Logger).Log(lfEvent, "promHealthCheckHandler", "path", r.URL.Path, "method", r.Method)
 
-	// Check the labels path for Prometheus Origin Handler to satisfy health check
+	origin := t.proxyOrigin(t.getOrigin(r))
+	hc := origin.HealthCheck
+
+	// Check the labels path for Prometheus Origin Handler to satisfy health check, unless the origin has its own
 	path := prometheusAPIv1Path + mnLabels
+	if hc.Path != "" {
+		path = hc.Path
+	}
+	method := r.Method
+	if hc.Method != "" {
+		method = hc.Method
+	}
+	if hc.TimeoutSecs > 0 {
+		origin.TimeoutSecs = hc.TimeoutSecs
+	}
 
-	origin := t.getOrigin(r)
 	originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
-	body, resp, _, err := t.getURL(origin, r.Method, originURL, r.URL.Query(), getProxyableClientHeaders(r))
+	if q := r.URL.Query(); len(q) > 0 {
+		originURL += "?" + q.Encode()
+	}
+	u, err := url.Parse(originURL)
 	if err != nil {
-		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
+		level.Error(t.Logger).Log(lfEvent, "error parsing health check url", lfDetail, err.Error())
 		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 
-	for k, v := range resp.Header {
-		w.Header().Set(k, strings.Join(v, ","))
+	headers := t.getProxyableClientHeaders(r)
+	for k, v := range hc.Headers {
+		headers.Set(k, v)
+	}
+	var reqBody []byte
+	if hc.Body != "" {
+		reqBody = []byte(hc.Body)
+	}
+
+	var body []byte
+	var resp *http.Response
+	timeout, err := origin.upstreamTimeout(requestDeadline(r))
+	if err == nil {
+		body, resp, err = t.doRequest(context.Background(), origin, method, u, headers, reqBody, timeout)
+	}
+	if err != nil {
+		t.originLog(origin, level.Error, "error fetching data from origin Prometheus").Log(lfDetail, err.Error())
+		writeOriginError(w, r)
+		return
 	}
 
+	if hc.judged() {
+		// the origin's response is only relayed when it is healthy
+		if reason := hc.check(resp.StatusCode, body); reason != "" {
+			t.originLog(origin, level.Warn, "origin health check failed").Log(lfDetail, reason)
+			w.Header().Set(hnContentType, hvTextPlain)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, reason)
+			return
+		}
+		resp.StatusCode = http.StatusOK
+	}
+
+	copyResponseHeaders(w.Header(), resp.Header)
+
 	w.WriteHeader(resp.StatusCode)
 	w.Write(body)
+	copyResponseTrailers(w, resp.Trailer)
 }
 
 // promFullProxyHandler handles calls to non-api paths for single-origin configurations and multi-origin via param or hostname
 // can't support multi-origin full proxy for path-based proxying
 func (t *TricksterHandler) promFullProxyHandler(w http.ResponseWriter, r *http.Request) {
-	level.Debug(t.Logger).Log(lfEvent, "promFullProxyHandler", "path", r.URL.Path, "method", r.Method)
+	level.Debug(t.Logger).Log(lfEvent, "promFullProxyHandler", "path", r.URL.Path, "method", r.Method, lfClientIP, t.TrustedProxies.clientIP(r))
 
 	path := r.URL.Path
 	vars := mux.Vars(r)
@@ -136,24 +209,75 @@ func (t *TricksterHandler) promFullProxyHandler(w http.ResponseWriter, r *http.R
 		}
 	}
 
-	origin := t.getOrigin(r)
+	origin := t.proxyOrigin(t.getOrigin(r))
 	originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
-	body, resp, _, err := t.getURL(origin, r.Method, originURL, r.URL.Query(), getProxyableClientHeaders(r))
-	if err != nil {
-		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
-		w.WriteHeader(http.StatusBadGateway)
+
+	// time range requests to sql gateways are delta cached, like query_range requests are
+	if origin.sqlGateway() && t.serveSQLRange(w, r, origin, originURL) {
 		return
 	}
 
-	for k, v := range resp.Header {
-		w.Header().Set(k, strings.Join(v, ","))
+	// the cached paths of the origin, and redirects of origins that cache them, are served from the cache, unless the
+	// client asked for fresh data
+	var objectKey string
+	// the lock of a missing object is released once it is cached, or the request fails
+	unlockObject := func() {}
+	defer func() { unlockObject() }()
+	if origin.ObjectCache.caches(r.Method, path) && !t.bypassed() {
+		switch cacheDirective(origin, r) {
+		case "":
+			objectKey = origin.objectCacheKey(r, originURL)
+			var served bool
+			if served, unlockObject = t.serveCachedObject(w, origin, objectKey); served {
+				return
+			}
+		case cdRefresh:
+			objectKey = origin.objectCacheKey(r, originURL)
+		}
+	}
+	var redirectKey string
+	if origin.CacheRedirects && r.Method == http.MethodGet && !t.bypassed() {
+		switch cacheDirective(origin, r) {
+		case "":
+			redirectKey = origin.redirectCacheKey(r, originURL)
+			if t.serveCachedRedirect(w, origin, redirectKey) {
+				return
+			}
+		case cdRefresh:
+			redirectKey = origin.redirectCacheKey(r, originURL)
+		}
+	}
+
+	body, resp, _, err := t.getURL(origin, r.Method, originURL, r.URL.Query(), t.getProxyableClientHeaders(r), requestDeadline(r))
+	if err != nil {
+		t.originLog(origin, level.Error, "error fetching data from origin Prometheus").Log(lfDetail, err.Error())
+		writeOriginError(w, r)
+		return
+	}
+	if objectKey != "" {
+		t.cacheObject(origin, objectKey, body, resp)
 	}
+	unlockObject()
+	if redirectKey != "" && origin.cachesRedirect(r.Method, resp.StatusCode) {
+		t.cacheRedirect(origin, redirectKey, body, resp)
+	}
+
+	t.MemoryLimiter.Add(mcBuffers, int64(len(body)))
+	defer t.MemoryLimiter.Release(mcBuffers, int64(len(body)))
+	t.LoadShedder.addUpstreamBytes(r, int64(len(body)))
+
+	copyResponseHeaders(w.Header(), resp.Header)
 
 	writeResponse(w, body, resp)
 }
 
 // promQueryHandler handles calls to /query (for instantaneous values)
 func (t *TricksterHandler) promQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if t.bypassed() || cacheDirective(t.getOrigin(r), r) == cdBypass {
+		t.promBypassProxyHandler(w, r)
+		return
+	}
+
 	path := r.URL.Path
 	vars := mux.Vars(r)
 
@@ -164,7 +288,8 @@ func (t *TricksterHandler) promQueryHandler(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	originURL := t.getOrigin(r).OriginURL + strings.Replace(path, "//", "/", 1)
+	origin := t.getOrigin(r)
+	originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
 
 	// Get the params from the User request so we can inspect them and pass on to prometheus
 	if err := r.ParseForm(); err != nil {
@@ -174,18 +299,41 @@ func (t *TricksterHandler) promQueryHandler(w http.ResponseWriter, r *http.Reque
 	}
 	params := r.Form
 
-	body, resp, err := t.fetchPromQuery(originURL, params, r)
+	var body []byte
+	var resp *http.Response
+	var err error
+	if origin.federated() {
+		_, body, resp, err = t.getFederatedVector(origin, params, r)
+	} else {
+		body, resp, err = t.fetchPromQuery(originURL, params, r)
+	}
 	if err != nil {
-		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
-		w.WriteHeader(http.StatusBadGateway)
+		t.originLog(origin, level.Error, "error fetching data from origin Prometheus").Log(lfDetail, err.Error())
+		writeOriginError(w, r)
 		return
 	}
+	t.MemoryLimiter.Add(mcBuffers, int64(len(body)))
+	defer t.MemoryLimiter.Release(mcBuffers, int64(len(body)))
+	t.LoadShedder.addUpstreamBytes(r, int64(len(body)))
+
+	if len(origin.Relabel) > 0 && resp.StatusCode == http.StatusOK {
+		body = relabelVectorBody(body, origin.Relabel)
+	}
+	if origin.Transform.enabled() && resp.StatusCode == http.StatusOK {
+		body = transformVectorBody(body, origin.Transform)
+	}
 
 	writeResponse(w, body, resp)
 }
 
 // promQueryRangeHandler handles calls to /query_range (requests for timeseries values)
 func (t *TricksterHandler) promQueryRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if t.bypassed() || cacheDirective(t.getOrigin(r), r) == cdBypass {
+		t.promBypassProxyHandler(w, r)
+		return
+	}
+
+	start := time.Now()
 	ctx, err := t.buildRequestContext(w, r)
 	if err != nil {
 		level.Error(t.Logger).Log(lfEvent, "error building request context", lfDetail, err.Error())
@@ -193,10 +341,20 @@ func (t *TricksterHandler) promQueryRangeHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// An expired data set kept for the stale window is refreshed by a single request, and served to the others until
+	// it is
+	if t.expired(ctx.CacheKey) {
+		if unlock, ok := t.KeyLocks.tryLock(ctx.CacheKey); ok {
+			ctx.RefreshLock = unlock
+		} else if ctx.CacheLookupResult == crHit {
+			t.Metrics.CacheStaleServes.WithLabelValues(ctx.Origin.OriginURL).Inc()
+		}
+	}
+
 	// This WaitGroup ensures that the server does not write the response until we are 100% done Trickstering the range request.
 	// The responsders that fulfill client requests will mark the waitgroup done when the response is ready for delivery.
 	ctx.WaitGroup.Add(1)
-	if ctx.CacheLookupResult == crHit {
+	if ctx.CacheLookupResult == crHit && ctx.RefreshLock == nil {
 		t.respondToCacheHit(ctx)
 	} else {
 		t.queueRangeProxyRequest(ctx)
@@ -204,6 +362,8 @@ func (t *TricksterHandler) promQueryRangeHandler(w http.ResponseWriter, r *http.
 
 	// Wait until the response is fulfilled before delivering.
 	ctx.WaitGroup.Wait()
+
+	t.logSlowQuery(ctx, time.Since(start))
 }
 
 // End HTTP Handlers
@@ -221,37 +381,40 @@ func defaultPrometheusMatrixEnvelope() PrometheusMatrixEnvelope {
 }
 
 // getProxyableClientHeaders returns any pertinent http headers from the client that we should pass through to the Origin when proxying
-func getProxyableClientHeaders(r *http.Request) http.Header {
-	headers := http.Header{}
+func (t *TricksterHandler) getProxyableClientHeaders(r *http.Request) http.Header {
+	origin := t.getOrigin(r)
 
-	// pass through Authorization Header
-	if authorization, ok := r.Header[hnAuthorization]; ok {
-		headers.Add(hnAuthorization, strings.Join(authorization, " "))
-	}
+	// pass through the Authorization Header, or the origin's allowed headers, less any denied headers
+	headers := origin.RequestHeaders.scrub(r.Header)
+
+	setForwardedHeaders(origin, t.TrustedProxies, r, headers)
+	origin.Grafana.setForwardedHeaders(r, headers)
 
 	return headers
 }
 
-// getOrigin determines the origin server to service the request based on the Host header and url params
-func (t *TricksterHandler) getOrigin(r *http.Request) PrometheusOriginConfig {
-	var originName string
-	var ok bool
-
+// getOriginName returns the name of the origin requested by the client, from the path, url params or Host header
+func getOriginName(r *http.Request) string {
 	vars := mux.Vars(r)
 
 	// Check for the Origin Name URL Path
-	if originName, ok = vars["originMoniker"]; !ok {
-		// Check for the Origin Name URL Parmameter (origin=)
-		if on, ok := r.URL.Query()[upOrigin]; ok {
-			originName = on[1]
-		} else {
-			// Otherwise use the Host Header
-			originName = r.Host
-		}
+	if originName, ok := vars["originMoniker"]; ok {
+		return originName
 	}
 
+	// Check for the Origin Name URL Parmameter (origin=)
+	if on, ok := r.URL.Query()[upOrigin]; ok {
+		return on[0]
+	}
+
+	// Otherwise use the Host Header
+	return r.Host
+}
+
+// getOrigin determines the origin server to service the request based on the Host header and url params
+func (t *TricksterHandler) getOrigin(r *http.Request) PrometheusOriginConfig {
 	// If we have matching origin in our Origins Map, return it.
-	if p, ok := t.Config.Origins[originName]; ok {
+	if p, ok := t.Config.Origins[getOriginName(r)]; ok {
 		return p
 	}
 
@@ -280,7 +443,12 @@ func setResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 }
 
 // getURL makes an HTTP request to the provided URL with the provided parameters and returns the response body
-func (t *TricksterHandler) getURL(o PrometheusOriginConfig, method string, uri string, params url.Values, headers http.Header) ([]byte, *http.Response, time.Duration, error) {
+func (t *TricksterHandler) getURL(o PrometheusOriginConfig, method string, uri string, params url.Values, headers http.Header, deadline time.Time) ([]byte, *http.Response, time.Duration, error) {
+	timeout, err := o.upstreamTimeout(deadline)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
 	if len(params) > 0 {
 		uri += "?" + params.Encode()
 	}
@@ -291,38 +459,64 @@ func (t *TricksterHandler) getURL(o PrometheusOriginConfig, method string, uri s
 	}
 
 	startTime := time.Now()
-	client := &http.Client{
-		Timeout: time.Duration(o.TimeoutSecs * time.Second.Nanoseconds()),
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	resp, err := client.Do(&http.Request{Method: method, URL: parsedURL})
-	if err != nil {
-		return nil, nil, 0, fmt.Errorf("error downloading URL %q: %v", uri, err)
+	var body []byte
+	var resp *http.Response
+	if o.hedgeable(method) {
+		body, resp, err = t.doHedgedRequest(o, method, parsedURL, headers, timeout)
+	} else {
+		body, resp, err = t.doRequest(context.Background(), o, method, parsedURL, headers, nil, timeout)
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, 0, fmt.Errorf("error reading body from HTTP response for URL %q: %v", uri, err)
+		return nil, nil, 0, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		// We don't want to return non-200 status codes as internal Go errors,
 		// as we want to proxy those status codes all the way back to the user.
-		level.Warn(t.Logger).Log(lfEvent, "error downloading URL", "url", uri, "status", resp.Status)
+		t.originLog(o, level.Warn, "error downloading URL").Log("url", uri, "status", resp.Status)
 		return body, resp, 0, nil
 	}
 
 	duration := time.Since(startTime)
 
-	level.Debug(t.Logger).Log(lfEvent, "prometheusOriginHttpRequest", "url", uri, "duration", duration)
+	level.Debug(t.originLogger(o)).Log(lfEvent, "prometheusOriginHttpRequest", "url", uri, "duration", duration)
 
 	return body, resp, duration, nil
 }
 
+// doRequest makes the request, with the provided body if any, to the origin and reads the response body
+func (t *TricksterHandler) doRequest(ctx context.Context, o PrometheusOriginConfig, method string, u *url.URL, headers http.Header, reqBody []byte, timeout time.Duration) ([]byte, *http.Response, error) {
+	startTime := time.Now()
+	client := &http.Client{
+		Transport: t.Transports.Get(o, u.Host),
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req := &http.Request{Method: method, URL: u, Header: headers}
+	if reqBody != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		req.ContentLength = int64(len(reqBody))
+	}
+	resp, err := client.Do(req.WithContext(t.withConnectionTrace(ctx, u.Host)))
+	if err != nil {
+		t.countError(o, psOrigin, err)
+		return nil, nil, fmt.Errorf("error downloading URL %q: %w", u.String(), err)
+	}
+	defer resp.Body.Close()
+
+	t.recordClockOffset(o, resp, startTime, time.Now())
+
+	body, err := readResponseBody(resp.Body, o.MaxResponseBytes)
+	if err != nil {
+		t.countError(o, psOrigin, err)
+		return nil, nil, fmt.Errorf("error reading body from HTTP response for URL %q: %w", u.String(), err)
+	}
+	return body, resp, nil
+}
+
 func (t *TricksterHandler) getVectorFromPrometheus(url string, params url.Values, r *http.Request) (PrometheusVectorEnvelope, []byte, *http.Response, error) {
 	pe := PrometheusVectorEnvelope{}
 
@@ -334,12 +528,18 @@ func (t *TricksterHandler) getVectorFromPrometheus(url string, params url.Values
 	// Unmarshal the prometheus data into another PrometheusMatrixEnvelope
 	err = json.Unmarshal(body, &pe)
 	if err != nil {
-		// If we get a scalar response, we just want to return the resp without an error
+		// If we get a scalar or string response, we just want to return the resp without an error
 		// this will allow the upper layers to just use the raw response
-		if pe.Data.ResultType != "scalar" {
-			return pe, nil, nil, fmt.Errorf("Prometheus vector unmarshaling error for URL %q: %v", url, err)
+		if pe.Data.ResultType != rvScalar && pe.Data.ResultType != rvString {
+			err = classify(ecDecode, fmt.Errorf("Prometheus vector unmarshaling error for URL %q: %w", url, err))
+			t.countError(t.getOrigin(r), psOrigin, err)
+			return pe, nil, nil, err
 		}
 	}
+	if err := t.getOrigin(r).checkVectorLimits(pe); err != nil {
+		t.countError(t.getOrigin(r), psOrigin, err)
+		return pe, nil, nil, fmt.Errorf("Prometheus vector for URL %q: %w", url, err)
+	}
 
 	return pe, body, resp, nil
 }
@@ -348,16 +548,22 @@ func (t *TricksterHandler) getMatrixFromPrometheus(url string, params url.Values
 	pe := PrometheusMatrixEnvelope{}
 
 	// Make the HTTP Request - don't use fetchPromQuery here, that is for instantaneous only.
-	body, resp, duration, err := t.getURL(t.getOrigin(r), r.Method, url, params, getProxyableClientHeaders(r))
+	body, resp, duration, err := t.getURL(t.getOrigin(r), r.Method, url, params, t.getProxyableClientHeaders(r), requestDeadline(r))
 	if err != nil {
 		return pe, nil, nil, 0, err
 	}
 
 	if resp.StatusCode == http.StatusOK {
 		// Unmarshal the prometheus data into another PrometheusMatrixEnvelope
-		err := json.Unmarshal(body, &pe)
+		err := t.unmarshalMatrix(body, psOrigin, &pe)
 		if err != nil {
-			return pe, nil, nil, 0, fmt.Errorf("Prometheus matrix unmarshaling error for URL %q: %v", url, err)
+			err = classify(ecDecode, fmt.Errorf("Prometheus matrix unmarshaling error for URL %q: %w", url, err))
+			t.countError(t.getOrigin(r), psOrigin, err)
+			return pe, nil, nil, 0, err
+		}
+		if err := t.getOrigin(r).checkMatrixLimits(pe); err != nil {
+			t.countError(t.getOrigin(r), psOrigin, err)
+			return pe, nil, nil, 0, fmt.Errorf("Prometheus matrix for URL %q: %w", url, err)
 		}
 	}
 
@@ -372,10 +578,14 @@ func (t *TricksterHandler) fetchPromQuery(originURL string, params url.Values, r
 	var end int64
 	var err error
 
-	cacheKeyBase := originURL
-	// if we have an authorization header, that should be part of the cache key to ensure only authorized users can access cached datasets
-	if authorization, ok := r.Header[hnAuthorization]; ok {
-		cacheKeyBase += strings.Join(authorization, " ")
+	cacheKeyBase := originURL + t.getOrigin(r).cacheKeyScope(r)
+
+	// a query pinned to a time is evaluated at that time, unless it has its own
+	if pinned, ok := t.getOrigin(r).pinnedTime(r, time.Now().Unix()); ok {
+		params.Del(upPinnedNow)
+		if _, ok := params[upTime]; !ok {
+			params.Set(upTime, strconv.FormatInt(pinned, 10))
+		}
 	}
 
 	if ts, ok := params[upTime]; ok {
@@ -394,7 +604,13 @@ func (t *TricksterHandler) fetchPromQuery(originURL string, params url.Values, r
 		params.Set(upTime, strconv.Itoa(int(end)))
 	}
 
-	cacheKey := deriveCacheKey(cacheKeyBase, params)
+	origin := t.getOrigin(r)
+	refresh := cacheDirective(origin, r) == cdRefresh
+	if origin.AllowClientRefresh {
+		params.Del(origin.refreshParam())
+	}
+
+	cacheKey := origin.cacheKeyPartition(r) + deriveCacheKey(cacheKeyBase, params)
 
 	var body []byte
 	resp := &http.Response{}
@@ -402,25 +618,50 @@ func (t *TricksterHandler) fetchPromQuery(originURL string, params url.Values, r
 
 	cacheResult := crKeyMiss
 
-	// check for it in the cache
-	cachedBody, err := t.Cacher.Retrieve(cacheKey)
-	if err != nil {
+	// check for it in the cache, unless the client asked for fresh data. Concurrent requests for a missing or expired
+	// record wait for, or are served the expired record while, a single request fetches it.
+	var cachedBody string
+	if refresh {
+		cacheResult = crPurge
+	} else {
+		var unlock func()
+		cachedBody, unlock, err = t.retrieveProtected(origin, cacheKey)
+		defer unlock()
+		t.countError(origin, psCache, err)
+	}
+	if err != nil || refresh {
 		// Cache Miss, we need to get it from prometheus
-		body, resp, duration, err = t.getURL(t.getOrigin(r), r.Method, originURL, params, getProxyableClientHeaders(r))
+		body, resp, duration, err = t.getURL(origin, r.Method, originURL, params, t.getProxyableClientHeaders(r), requestDeadline(r))
 		if err != nil {
 			return nil, nil, err
 		}
 
 		t.Metrics.ProxyRequestDuration.WithLabelValues(originURL, otPrometheus, mnQuery, crKeyMiss, strconv.Itoa(resp.StatusCode)).Observe(duration.Seconds())
-		t.Cacher.Store(cacheKey, string(body), ttl)
+		cacheBody, err := t.compressCacheBody(origin, mnQuery, body)
+		if err != nil {
+			level.Error(t.Logger).Log(lfEvent, "error compressing cached data", lfDetail, err.Error())
+			cacheBody = body
+		}
+		ttl = t.Config.Caching.Stampede.jitterTTL(ttl)
+		if err := t.Cacher.Store(cacheKey, string(cacheBody), ttl+t.Config.Caching.Stampede.StaleSecs); err != nil {
+			t.countError(origin, psCache, err)
+		} else {
+			setClientExpiration(r, time.Now().Unix()+ttl)
+		}
 	} else {
 		// Cache hit, return the data set
-		body = []byte(cachedBody)
+		body, err = decompressCacheBody([]byte(cachedBody))
+		if err != nil {
+			return nil, nil, err
+		}
 		cacheResult = crHit
 		resp.StatusCode = http.StatusOK
+		t.lookupClientExpiration(r, cacheKey, t.Config.Caching.Stampede.StaleSecs)
 	}
 
+	// the requests metric of instant queries is labeled with their full url, while the stats group them by origin
 	t.Metrics.CacheRequestStatus.WithLabelValues(originURL, otPrometheus, mnQuery, cacheResult, strconv.Itoa(resp.StatusCode)).Inc()
+	t.Stats.record(origin.OriginURL, mnQuery, cacheResult, time.Now())
 
 	return body, resp, nil
 }
@@ -429,20 +670,31 @@ func (t *TricksterHandler) fetchPromQuery(originURL string, params url.Values, r
 func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Request) (*ClientRequestContext, error) {
 	var err error
 
+	origin := t.getOrigin(r)
 	ctx := &ClientRequestContext{
 		Request: r,
 		Writer:  w,
-		Origin:  t.getOrigin(r),
-		Time:    time.Now().Unix(),
+		Origin:  origin,
+		// when clock skew compensation is enabled, extents and fast forward windows are computed using the origin's clock
+		Time: t.originNow(origin),
 	}
 
-	ctx.Origin.OriginURL += strings.Replace(ctx.Origin.APIPath+"/", "//", "/", 1)
+	ctx.Origin.OriginURL = ctx.Origin.apiURL()
 
 	// Get the params from the User request so we can inspect them and pass on to prometheus
 	if err := r.ParseForm(); err != nil {
 		return nil, errors.Wrap(err, "unable to parse form")
 	}
 	ctx.RequestParams = r.Form
+	if ctx.Origin.AllowClientRefresh {
+		// the cache directive is for Trickster, and must not affect the cache key or be sent to the origin
+		ctx.RequestParams.Del(ctx.Origin.refreshParam())
+	}
+	// the pin is not removed from the params, since only the query, timeout and step are sent to the origin, and the
+	// context may be built again from the same request
+	if pinned, ok := ctx.Origin.pinnedTime(r, ctx.Time); ok {
+		ctx.Time, ctx.Pinned = pinned, true
+	}
 
 	// Validate and parse the step value from the user request URL params.
 	if len(ctx.RequestParams[upStep]) == 0 {
@@ -458,30 +710,18 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 	}
 	ctx.StepMS = int64(step.Seconds() * 1000)
 
-	cacheKeyBase := ctx.Origin.OriginURL + ctx.StepParam
-	// if we have an authorization header, that should be part of the cache key to ensure only authorized users can access cached datasets
-	if authorization, ok := r.Header[hnAuthorization]; ok {
-		cacheKeyBase += strings.Join(authorization, " ")
-	}
-
-	// Derive a hashed cacheKey for the query where we will get and set the result set
-	// inclusion of the step ensures that datasets with different resolutions are not written to the same key.
-	ctx.CacheKey = deriveCacheKey(cacheKeyBase, ctx.RequestParams)
-
 	// We will look for a Cache-Control: No-Cache request header and,
 	// if present, bypass the cache for a fresh full query from prometheus.
 	// Any user can trigger w/ hard reload (ctrl/cmd+shift+r) to clear out cache-related anomalies
-	noCache := false
-	if ctx.Origin.IgnoreNoCacheHeader == false && (strings.ToLower(r.Header.Get(hnCacheControl)) == hvNoCache) {
-		noCache = true
-	}
+	// When allowed, clients can also request the same with a refresh cache directive
+	noCache := noCacheRequested(ctx.Origin, r) || cacheDirective(ctx.Origin, r) == cdRefresh
 
 	// get the browser-requested start/end times, so we can determine what part of the range is not in the cache
 	if len(ctx.RequestParams[upStart]) == 0 {
 		return nil, fmt.Errorf("missing start time parameter")
 	}
 
-	reqStart, err := parseTime(ctx.RequestParams[upStart][0])
+	reqStart, err := parseRequestTime(ctx.RequestParams[upStart][0], ctx.Time)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("failed to parse parameter %q with value %q", upStart, ctx.RequestParams[upStart][0]))
 	}
@@ -490,7 +730,7 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 		return nil, fmt.Errorf("missing end time parameter")
 	}
 
-	reqEnd, err := parseTime(ctx.RequestParams[upEnd][0])
+	reqEnd, err := parseRequestTime(ctx.RequestParams[upEnd][0], ctx.Time)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("failed to parse parameter %q with value %q", upEnd, ctx.RequestParams[upEnd][0]))
 	}
@@ -499,6 +739,21 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 	if err != nil {
 		return nil, errors.Wrap(err, "error aligning step boundary")
 	}
+
+	// When the origin shares a raw resolution across steps, query and cache at the raw step,
+	// and re-bucket to the requested step when responding
+	ctx.ResponseStepMS = ctx.StepMS
+	if rawStepMS := sharedStepMS(ctx.Origin.RawStepSecs, ctx.StepMS, ctx.RequestExtents); rawStepMS > 0 {
+		ctx.StepMS = rawStepMS
+		ctx.StepParam = strconv.FormatInt(rawStepMS/1000, 10)
+	}
+
+	cacheKeyBase := ctx.Origin.OriginURL + ctx.StepParam + ctx.Origin.cacheKeyScope(r)
+
+	// Derive a hashed cacheKey for the query where we will get and set the result set
+	// inclusion of the step ensures that datasets with different resolutions are not written to the same key.
+	ctx.CacheKey = ctx.Origin.cacheKeyPartition(r) + deriveCacheKey(cacheKeyBase, ctx.RequestParams)
+
 	// setup some variables to determine and track the status of the query vs what's in the cache
 	ctx.Matrix = defaultPrometheusMatrixEnvelope()
 	ctx.CacheLookupResult = crKeyMiss
@@ -516,6 +771,7 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 
 	// Get the cached result set if present
 	cachedBody, err := t.Cacher.Retrieve(ctx.CacheKey)
+	t.countError(ctx.Origin, psCache, err)
 
 	if err != nil || noCache {
 		// Cache Miss, Get the whole blob from Prometheus.
@@ -531,27 +787,31 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 		// See if cache data is compressed by looking for the first character to be "{":, with which the uncompressed JSON would start
 		// We do this instead of checking the Compression config bit because if someone turns compression on or off when using filesystem or redis cache,
 		// we will have no idea if what is already in the cache was compressed or not based on previous settings
-		cb := []byte(cachedBody)
-		if cb[0] != 123 {
+		if cachedBody != "" && cachedBody[0] != '{' {
 			// Not a JSON object, try decompressing
 			level.Debug(t.Logger).Log("event", "Decompressing Cached Data", "cacheKey", ctx.CacheKey)
-			cb, err = snappy.Decode(nil, cb)
-			if err == nil {
+			if cb, err := decompressCacheBody([]byte(cachedBody)); err == nil {
 				cachedBody = string(cb)
 			}
 		}
 
 		// Marshall the cache payload into a PrometheusMatrixEnvelope struct
-		err = json.Unmarshal([]byte(cachedBody), &ctx.Matrix)
+		err = t.unmarshalMatrix([]byte(cachedBody), psCache, &ctx.Matrix)
 		// If there is an error unmarshaling the cache we should treat it as a cache miss
 		// and re-fetch from origin
 		if err != nil {
+			t.countError(ctx.Origin, psCache, classify(ecDecode, err))
 			ctx.CacheLookupResult = crRangeMiss
 			return ctx, nil
 		}
 
+		if len(ctx.Origin.ResolutionTiers) > 0 {
+			t.cropStaleResolutions(ctx)
+		}
+
 		// Get the Extents of the data in the cache
 		ce := ctx.Matrix.getExtents()
+		ctx.CacheExtents = ce
 
 		extent := "none"
 
@@ -614,34 +874,43 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 
 func (t *TricksterHandler) respondToCacheHit(ctx *ClientRequestContext) {
 	defer ctx.WaitGroup.Done()
-	t.Metrics.CacheRequestStatus.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, "200").Inc()
+	t.countCacheResult(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, http.StatusOK)
 
 	// Do the extraction of the range the user requested from the fully cached dataset, if needed.
 	ctx.Matrix.cropToRange(ctx.RequestExtents.Start, ctx.RequestExtents.End+ctx.StepMS)
 
+	// Check a sample of responses served from the cache against the origin
+	if ctx.Origin.sampleFidelityCheck() {
+		t.startFidelityCheck(ctx)
+	}
+
+	ctx.Matrix.rebucket(ctx.StepMS, ctx.ResponseStepMS)
+
 	r := &http.Response{}
+	durations := make(map[string]time.Duration)
+	t.lookupClientExpiration(ctx.Request, ctx.CacheKey, t.Config.Caching.Stampede.StaleSecs)
 
 	// If Fast Forward is enabled and the request is a real-time request, go get that data
-	if !ctx.Origin.FastForwardDisable && !(ctx.RequestExtents.End < (ctx.Time*1000)-ctx.StepMS) {
+	if ffTime, ok := ctx.fastForwardTime(); ok {
 		// Query the latest points if Fast Forward is enabled
 		queryURL := ctx.Origin.OriginURL + mnQuery
-		originParams := url.Values{}
-		// Add the prometheus query params from the user urlparams to the origin request
-		passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
-		passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
-		passthroughParam(upTime, ctx.RequestParams, originParams, nil)
-		ffd, _, resp, err := t.getVectorFromPrometheus(queryURL, originParams, ctx.Request)
+		ffStart := time.Now()
+		ffd, _, resp, err := t.getVector(ctx.Origin, queryURL, ctx.fastForwardParams(ffTime), ctx.Request)
 		if err != nil {
-			level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
-			ctx.Writer.WriteHeader(http.StatusBadGateway)
+			t.originLog(ctx.Origin, level.Error, "error fetching data from origin Prometheus").Log(lfDetail, err.Error())
+			writeOriginError(ctx.Writer, ctx.Request)
 			return
 		}
 		r = resp
 		if resp.StatusCode == http.StatusOK && ffd.Status == rvSuccess {
 			ctx.Matrix = t.mergeVector(ctx.Matrix, ffd)
+			durations[fnFastForward] = time.Since(ffStart)
 		}
 	}
 
+	ctx.Matrix.relabel(ctx.Origin.Relabel)
+	ctx.Matrix.transform(ctx.Origin.Transform, ctx.RequestExtents, ctx.ResponseStepMS)
+
 	// Marshal the Envelope back to a json object for User Response)
 	body, err := json.Marshal(ctx.Matrix)
 	if err != nil {
@@ -650,7 +919,11 @@ func (t *TricksterHandler) respondToCacheHit(ctx *ClientRequestContext) {
 		return
 	}
 
+	diag := ctx.diagnostics(durations)
+	ctx.Diagnostics = diag
+	writeDiagnostics(ctx.Writer, ctx.Origin.Diagnostics, diag, false)
 	writeResponse(ctx.Writer, body, r)
+	writeDiagnostics(ctx.Writer, ctx.Origin.Diagnostics, diag, true)
 }
 
 func writeResponse(w http.ResponseWriter, body []byte, resp *http.Response) {
@@ -663,6 +936,7 @@ func writeResponse(w http.ResponseWriter, body []byte, resp *http.Response) {
 
 	w.WriteHeader(resp.StatusCode)
 	w.Write(body)
+	copyResponseTrailers(w, resp.Trailer)
 }
 
 func (t *TricksterHandler) queueRangeProxyRequest(ctx *ClientRequestContext) {
@@ -676,6 +950,7 @@ func (t *TricksterHandler) queueRangeProxyRequest(ctx *ClientRequestContext) {
 	}
 	t.ChannelCreateMtx.Unlock()
 
+	t.LoadShedder.queue(1)
 	ch <- ctx
 }
 
@@ -687,13 +962,17 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 
 			t.ChannelCreateMtx.Lock()
 
+			// the channel of the key may have been closed and replaced by a newer one, served by its own handler
+			ch, ok := t.ResponseChannels[cacheKey]
+			if !ok || ch != originRangeRequests {
+				t.ChannelCreateMtx.Unlock()
+				return
+			}
 			if len(originRangeRequests) == 0 {
-				if _, ok := t.ResponseChannels[cacheKey]; ok {
-					close(t.ResponseChannels[cacheKey])
-					delete(t.ResponseChannels, cacheKey)
-					t.ChannelCreateMtx.Unlock()
-					return
-				}
+				close(ch)
+				delete(t.ResponseChannels, cacheKey)
+				t.ChannelCreateMtx.Unlock()
+				return
 			}
 
 			t.ChannelCreateMtx.Unlock()
@@ -701,252 +980,320 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 	}()
 
 	for r := range originRangeRequests {
-		// get the cache data for this request again, in case anything about the record has changed
-		// between the time we queued the request and the time it was consumed from the channel
-		ctx, err := t.buildRequestContext(r.Writer, r.Request)
-		if err != nil {
-			level.Error(t.Logger).Log(lfEvent, "error building request context", lfDetail, err.Error())
-			r.Writer.WriteHeader(http.StatusBadRequest)
-			r.WaitGroup.Done()
-			continue
-		}
+		t.serveRangeProxyRequest(cacheKey, r)
+		t.LoadShedder.queue(-1)
+		// Explicitly release the request context so that the underlying memory can be
+		// freed before the next request is received via the channel, which overwrites "r".
+		r = nil
+	}
+}
 
-		// The cache miss became a cache hit between the time it was queued and processed.
-		if ctx.CacheLookupResult == crHit {
-			level.Debug(t.Logger).Log(lfEvent, "delayedCacheHit", lfDetail, "cache was populated with needed data by another proxy request while this one was queued.")
-			// Lay the newly-retreived data into the original origin range request so it can fully service the client
-			r.Matrix = ctx.Matrix
-			// And change the lookup result to a hit.
-			r.CacheLookupResult = crHit
-			// Respond with the modified original request object so the right WaitGroup is marked as Done()
-			t.respondToCacheHit(r)
-		} else {
+// serveRangeProxyRequest fulfills a queued range request, fetching the data missing from the cache from the origin,
+// merging and caching it, and responding to the client
+func (t *TricksterHandler) serveRangeProxyRequest(cacheKey string, r *ClientRequestContext) {
+	defer t.recoverRangeProxyRequest(r)
+	if r.RefreshLock != nil {
+		defer r.RefreshLock()
+	}
 
-			// Now we know if we need to make any calls to the Origin, lets set those up
-			upperDeltaData := PrometheusMatrixEnvelope{}
-			lowerDeltaData := PrometheusMatrixEnvelope{}
-			fastForwardData := PrometheusVectorEnvelope{}
-
-			var wg sync.WaitGroup
-
-			var m sync.Mutex // Protects originErr and resp below.
-			var originErr error
-			var errorBody []byte
-			resp := &http.Response{}
-
-			if ctx.OriginLowerExtents.Start > 0 && ctx.OriginLowerExtents.End > 0 {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-
-					queryURL := ctx.Origin.OriginURL + mnQueryRange
-					originParams := url.Values{}
-					// Add the prometheus query params from the user urlparams to the origin request
-					passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
-					passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
-					originParams.Add(upStep, ctx.StepParam)
-					originParams.Add(upStart, strconv.FormatInt(ctx.OriginLowerExtents.Start/1000, 10))
-					originParams.Add(upEnd, strconv.FormatInt(ctx.OriginLowerExtents.End/1000, 10))
-					ldd, b, r, duration, err := t.getMatrixFromPrometheus(queryURL, originParams, r.Request)
-
-					if err != nil {
-						m.Lock()
-						originErr = err
-						m.Unlock()
-						return
-					}
+	// get the cache data for this request again, in case anything about the record has changed
+	// between the time we queued the request and the time it was consumed from the channel
+	ctx, err := t.buildRequestContext(r.Writer, r.Request)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error building request context", lfDetail, err.Error())
+		r.Writer.WriteHeader(http.StatusBadRequest)
+		r.WaitGroup.Done()
+		return
+	}
+	// the requested range of an expired data set is fetched again, and merged into the cached data set
+	if r.RefreshLock != nil {
+		ctx.refreshRequestedRange()
+	}
+
+	// The cache miss became a cache hit between the time it was queued and processed.
+	if ctx.CacheLookupResult == crHit {
+		level.Debug(t.Logger).Log(lfEvent, "delayedCacheHit", lfDetail, "cache was populated with needed data by another proxy request while this one was queued.")
+		// Lay the newly-retreived data into the original origin range request so it can fully service the client
+		r.Matrix = ctx.Matrix
+		// And change the lookup result to a hit.
+		r.CacheLookupResult = crHit
+		// Respond with the modified original request object so the right WaitGroup is marked as Done()
+		t.respondToCacheHit(r)
+	} else {
 
+		// Now we know if we need to make any calls to the Origin, lets set those up
+		upperDeltaData := PrometheusMatrixEnvelope{}
+		lowerDeltaData := PrometheusMatrixEnvelope{}
+		fastForwardData := PrometheusVectorEnvelope{}
+
+		var wg sync.WaitGroup
+
+		var m sync.Mutex // Protects originErr, resp, bufferedBytes and durations below.
+		var originErr error
+		var errorBody []byte
+		var bufferedBytes int64
+		durations := make(map[string]time.Duration)
+		resp := &http.Response{}
+
+		if ctx.OriginLowerExtents.Start > 0 && ctx.OriginLowerExtents.End > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				queryURL := ctx.Origin.OriginURL + mnQueryRange
+				originParams := url.Values{}
+				// Add the prometheus query params from the user urlparams to the origin request
+				passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
+				passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
+				originParams.Add(upStep, ctx.StepParam)
+				ldd, b, r, duration, err := t.getShardedMatrixFromPrometheus(ctx, queryURL, originParams, ctx.OriginLowerExtents, r.Request)
+
+				if err != nil {
 					m.Lock()
-					if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
-						if r.StatusCode != http.StatusOK {
-							errorBody = b
-						}
-						resp = r
-					}
+					originErr = err
 					m.Unlock()
+					return
+				}
 
-					if r.StatusCode == http.StatusOK && ldd.Status == rvSuccess {
-						lowerDeltaData = ldd
-						t.Metrics.ProxyRequestDuration.WithLabelValues(ctx.Origin.OriginURL, otPrometheus,
-							mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(r.StatusCode)).Observe(duration.Seconds())
-					}
-				}()
-			}
-
-			if ctx.OriginUpperExtents.Start > 0 && ctx.OriginUpperExtents.End > 0 {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-
-					queryURL := ctx.Origin.OriginURL + mnQueryRange
-					originParams := url.Values{}
-					// Add the prometheus query params from the user urlparams to the origin request
-					passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
-					passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
-					originParams.Add(upStep, ctx.StepParam)
-					originParams.Add(upStart, strconv.FormatInt(ctx.OriginUpperExtents.Start/1000, 10))
-					originParams.Add(upEnd, strconv.FormatInt(ctx.OriginUpperExtents.End/1000, 10))
-					udd, b, r, duration, err := t.getMatrixFromPrometheus(queryURL, originParams, r.Request)
-
-					if err != nil {
-						m.Lock()
-						originErr = err
-						m.Unlock()
-						return
+				t.MemoryLimiter.Add(mcBuffers, int64(len(b)))
+				t.LoadShedder.addUpstreamBytes(ctx.Request, int64(len(b)))
+				m.Lock()
+				bufferedBytes += int64(len(b))
+				if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
+					if r.StatusCode != http.StatusOK {
+						errorBody = b
 					}
+					resp = r
+				}
+				m.Unlock()
 
+				if r.StatusCode == http.StatusOK && ldd.Status == rvSuccess {
+					lowerDeltaData = ldd
 					m.Lock()
-					if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
-						if r.StatusCode != http.StatusOK {
-							errorBody = b
-						}
-						resp = r
-					}
+					durations[fnLower] = duration
 					m.Unlock()
+					t.Metrics.ProxyRequestDuration.WithLabelValues(ctx.Origin.OriginURL, otPrometheus,
+						mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(r.StatusCode)).Observe(duration.Seconds())
+				}
+			}()
+		}
 
-					if r != nil && r.StatusCode == http.StatusOK && udd.Status == rvSuccess {
-						upperDeltaData = udd
-						t.Metrics.ProxyRequestDuration.WithLabelValues(ctx.Origin.OriginURL, otPrometheus,
-							mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(r.StatusCode)).Observe(duration.Seconds())
-					}
-				}()
-			}
+		if ctx.OriginUpperExtents.Start > 0 && ctx.OriginUpperExtents.End > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-			if !ctx.Origin.FastForwardDisable && !(ctx.RequestExtents.End < ctx.Time*1000-ctx.StepMS) {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-
-					// Query the latest points if Fast Forward is enabled
-					queryURL := ctx.Origin.OriginURL + mnQuery
-					originParams := url.Values{}
-					// Add the prometheus query params from the user urlparams to the origin request
-					passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
-					passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
-					passthroughParam(upTime, ctx.RequestParams, originParams, nil)
-					ffd, b, r, err := t.getVectorFromPrometheus(queryURL, originParams, r.Request)
-
-					if err != nil {
-						m.Lock()
-						originErr = err
-						m.Unlock()
-						return
-					}
+				queryURL := ctx.Origin.OriginURL + mnQueryRange
+				originParams := url.Values{}
+				// Add the prometheus query params from the user urlparams to the origin request
+				passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
+				passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
+				originParams.Add(upStep, ctx.StepParam)
+				udd, b, r, duration, err := t.getShardedMatrixFromPrometheus(ctx, queryURL, originParams, ctx.OriginUpperExtents, r.Request)
 
+				if err != nil {
 					m.Lock()
-					if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
-						if r.StatusCode != http.StatusOK {
-							errorBody = b
-						}
-						resp = r
-					}
+					originErr = err
 					m.Unlock()
+					return
+				}
 
-					if r != nil && r.StatusCode == http.StatusOK && ffd.Status == rvSuccess {
-						fastForwardData = ffd
+				t.MemoryLimiter.Add(mcBuffers, int64(len(b)))
+				t.LoadShedder.addUpstreamBytes(ctx.Request, int64(len(b)))
+				m.Lock()
+				bufferedBytes += int64(len(b))
+				if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
+					if r.StatusCode != http.StatusOK {
+						errorBody = b
 					}
-				}()
-			}
-
-			wg.Wait()
+					resp = r
+				}
+				m.Unlock()
 
-			if originErr != nil {
-				level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, originErr.Error())
-				r.Writer.WriteHeader(http.StatusBadGateway)
-				r.WaitGroup.Done()
-				continue
-			}
+				if r != nil && r.StatusCode == http.StatusOK && udd.Status == rvSuccess {
+					upperDeltaData = udd
+					m.Lock()
+					durations[fnUpper] = duration
+					m.Unlock()
+					t.Metrics.ProxyRequestDuration.WithLabelValues(ctx.Origin.OriginURL, otPrometheus,
+						mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(r.StatusCode)).Observe(duration.Seconds())
+				}
+			}()
+		}
 
-			t.Metrics.CacheRequestStatus.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(resp.StatusCode)).Inc()
+		if ffTime, ok := ctx.fastForwardTime(); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-			uncachedElementCnt := int64(0)
+				// Query the latest points if Fast Forward is enabled
+				queryURL := ctx.Origin.OriginURL + mnQuery
+				ffStart := time.Now()
+				ffd, b, r, err := t.getVector(ctx.Origin, queryURL, ctx.fastForwardParams(ffTime), r.Request)
 
-			if lowerDeltaData.Status == rvSuccess {
-				uncachedElementCnt += lowerDeltaData.getValueCount()
-				ctx.Matrix = t.mergeMatrix(ctx.Matrix, lowerDeltaData)
-			}
+				if err != nil {
+					m.Lock()
+					originErr = err
+					m.Unlock()
+					return
+				}
 
-			if upperDeltaData.Status == rvSuccess {
-				uncachedElementCnt += upperDeltaData.getValueCount()
-				ctx.Matrix = t.mergeMatrix(upperDeltaData, ctx.Matrix)
-			}
+				t.MemoryLimiter.Add(mcBuffers, int64(len(b)))
+				t.LoadShedder.addUpstreamBytes(ctx.Request, int64(len(b)))
+				m.Lock()
+				bufferedBytes += int64(len(b))
+				if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
+					if r.StatusCode != http.StatusOK {
+						errorBody = b
+					}
+					resp = r
+				}
+				m.Unlock()
 
-			// If the request is entirely outside of the cache window, we don't want to cache it
-			// otherwise we actually *clear* the cache of any data it has in it!
-			skipCache := (ctx.Time*1000 - ctx.RequestExtents.End) > ctx.Origin.MaxValueAgeSecs*1000
+				if r != nil && r.StatusCode == http.StatusOK && ffd.Status == rvSuccess {
+					fastForwardData = ffd
+					m.Lock()
+					durations[fnFastForward] = time.Since(ffStart)
+					m.Unlock()
+				}
+			}()
+		}
 
-			// If it's not a full cache hit, we want to write this back to the cache
-			if ctx.CacheLookupResult != crHit && !skipCache {
-				cacheMatrix := ctx.Matrix.copy()
+		wg.Wait()
 
-				// Prune any old points based on retention policy
-				cacheMatrix.cropToRange(int64(ctx.Time-ctx.Origin.MaxValueAgeSecs)*1000, 0)
+		// The upstream response buffers are held until the client response is written
+		releaseBuffers := func() { t.MemoryLimiter.Release(mcBuffers, bufferedBytes) }
 
-				if ctx.Origin.NoCacheLastDataSecs != 0 {
-					cacheMatrix.cropToRange(0, int64(ctx.Time-ctx.Origin.NoCacheLastDataSecs)*1000)
-				}
+		if originErr != nil {
+			t.originLog(ctx.Origin, level.Error, "error fetching data from origin Prometheus").Log(lfDetail, originErr.Error())
+			writeOriginError(r.Writer, r.Request)
+			r.WaitGroup.Done()
+			releaseBuffers()
+			return
+		}
 
-				// Marshal the Envelope back to a json object for Cache Storage
-				cacheBody, err := json.Marshal(cacheMatrix)
-				if err != nil {
-					level.Error(t.Logger).Log(lfEvent, "prometheus matrix marshaling error", lfDetail, err.Error())
-					r.Writer.WriteHeader(http.StatusInternalServerError)
-					r.WaitGroup.Done()
-					continue
-				}
+		t.countCacheResult(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, resp.StatusCode)
 
-				if t.Config.Caching.Compression {
-					level.Debug(t.Logger).Log("event", "Compressing Cached Data", "cacheKey", ctx.CacheKey)
-					cacheBody = snappy.Encode(nil, cacheBody)
-				}
+		uncachedElementCnt := int64(0)
 
-				// Set the Cache Key with the merged dataset
-				t.Cacher.Store(cacheKey, string(cacheBody), t.Config.Caching.RecordTTLSecs)
-				level.Debug(t.Logger).Log(lfEvent, "setCacheRecord", lfCacheKey, cacheKey, "ttl", t.Config.Caching.RecordTTLSecs)
-			}
+		if lowerDeltaData.Status == rvSuccess {
+			uncachedElementCnt += lowerDeltaData.getValueCount()
+			ctx.Matrix = t.mergeMatrix(ctx.Matrix, lowerDeltaData)
+		}
 
-			//Do the extraction of the range the user requested, if needed.
-			// The only time it may not be needed is if the result was a Key Miss (so the dataset we have is exactly what the user asked for)
-			// I add one more step on the end of the request to ensure we catch the fast forward data
-			if ctx.CacheLookupResult != crKeyMiss {
-				ctx.Matrix.cropToRange(ctx.RequestExtents.Start, ctx.RequestExtents.End+ctx.StepMS)
+		if upperDeltaData.Status == rvSuccess {
+			uncachedElementCnt += upperDeltaData.getValueCount()
+			if r.RefreshLock != nil {
+				ctx.Matrix = t.mergeRefreshedRange(ctx.Matrix, upperDeltaData, ctx.OriginUpperExtents)
+			} else {
+				ctx.Matrix = t.mergeMatrix(upperDeltaData, ctx.Matrix)
 			}
+		}
 
-			allElementCnt := ctx.Matrix.getValueCount()
-			cachedElementCnt := allElementCnt - uncachedElementCnt
+		// If the request is entirely outside of the cache window, we don't want to cache it
+		// otherwise we actually *clear* the cache of any data it has in it!
+		skipCache := (ctx.Time*1000 - ctx.RequestExtents.End) > ctx.Origin.MaxValueAgeSecs*1000
 
-			if uncachedElementCnt > 0 {
-				t.Metrics.CacheRequestElements.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, "uncached").Add(float64(uncachedElementCnt))
-			}
+		// If it's not a full cache hit, we want to write this back to the cache
+		if ctx.CacheLookupResult != crHit && !skipCache {
+			cacheMatrix := ctx.Matrix.copy()
 
-			if cachedElementCnt > 0 {
-				t.Metrics.CacheRequestElements.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, "cached").Add(float64(cachedElementCnt))
-			}
+			// Prune any old points based on retention policy
+			cacheMatrix.cropToRange(int64(ctx.Time-ctx.Origin.MaxValueAgeSecs)*1000, 0)
 
-			// Stictch in Fast Forward Data
-			if fastForwardData.Status == rvSuccess {
-				ctx.Matrix = t.mergeVector(ctx.Matrix, fastForwardData)
+			if ctx.Origin.NoCacheLastDataSecs != 0 {
+				cacheMatrix.cropToRange(0, int64(ctx.Time-ctx.Origin.NoCacheLastDataSecs)*1000)
 			}
 
-			// Marshal the Envelope back to a json object for User Response)
-			body, err := json.Marshal(ctx.Matrix)
+			// Marshal the Envelope back to a json object for Cache Storage
+			cacheBody, err := json.Marshal(cacheMatrix)
 			if err != nil {
 				level.Error(t.Logger).Log(lfEvent, "prometheus matrix marshaling error", lfDetail, err.Error())
 				r.Writer.WriteHeader(http.StatusInternalServerError)
 				r.WaitGroup.Done()
-				continue
+				releaseBuffers()
+				return
 			}
+			t.MemoryLimiter.Add(mcMerges, int64(len(cacheBody)))
+			mergedBytes := int64(len(cacheBody))
 
-			if resp.StatusCode != http.StatusOK {
-				writeResponse(r.Writer, errorBody, resp)
+			if cb, err := t.compressCacheBody(ctx.Origin, mnQueryRange, cacheBody); err == nil {
+				cacheBody = cb
 			} else {
-				writeResponse(r.Writer, body, resp)
+				level.Error(t.Logger).Log(lfEvent, "error compressing cached data", lfDetail, err.Error())
 			}
+
+			// Set the Cache Key with the merged dataset, with a TTL scaled to the requested range
+			ttl := rangeTTL(ctx.Origin.TTLBuckets, (ctx.RequestExtents.End-ctx.RequestExtents.Start)/1000, t.Config.Caching.RecordTTLSecs)
+			// the data set is kept for the stale window, along with its info
+			ttl = t.Config.Caching.Stampede.jitterTTL(ttl)
+			storeTTL := ttl + t.Config.Caching.Stampede.StaleSecs
+			if err := t.Cacher.Store(cacheKey, string(cacheBody), storeTTL); err != nil {
+				t.countError(ctx.Origin, psCache, err)
+			} else {
+				setClientExpiration(r.Request, time.Now().Unix()+ttl)
+				t.storeRecordInfo(cacheKey, t.recordInfo(ctx, cacheMatrix), storeTTL)
+			}
+			level.Debug(t.Logger).Log(lfEvent, "setCacheRecord", lfCacheKey, cacheKey, "ttl", ttl)
+			t.MemoryLimiter.Release(mcMerges, mergedBytes)
+		}
+
+		//Do the extraction of the range the user requested, if needed.
+		// The only time it may not be needed is if the result was a Key Miss (so the dataset we have is exactly what the user asked for)
+		// I add one more step on the end of the request to ensure we catch the fast forward data
+		if ctx.CacheLookupResult != crKeyMiss {
+			ctx.Matrix.cropToRange(ctx.RequestExtents.Start, ctx.RequestExtents.End+ctx.StepMS)
+		}
+
+		allElementCnt := ctx.Matrix.getValueCount()
+		cachedElementCnt := allElementCnt - uncachedElementCnt
+
+		if uncachedElementCnt > 0 {
+			t.Metrics.CacheRequestElements.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, "uncached").Add(float64(uncachedElementCnt))
+		}
+
+		if cachedElementCnt > 0 {
+			t.Metrics.CacheRequestElements.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, "cached").Add(float64(cachedElementCnt))
+		}
+
+		// Check a sample of responses served from the cache against the origin
+		if ctx.CacheLookupResult == crPartialHit && ctx.Origin.sampleFidelityCheck() {
+			t.startFidelityCheck(ctx)
+		}
+
+		ctx.Matrix.rebucket(ctx.StepMS, ctx.ResponseStepMS)
+
+		// Stictch in Fast Forward Data
+		if fastForwardData.Status == rvSuccess {
+			ctx.Matrix = t.mergeVector(ctx.Matrix, fastForwardData)
+		}
+
+		ctx.Matrix.relabel(ctx.Origin.Relabel)
+		ctx.Matrix.transform(ctx.Origin.Transform, ctx.RequestExtents, ctx.ResponseStepMS)
+
+		// Marshal the Envelope back to a json object for User Response)
+		body, err := json.Marshal(ctx.Matrix)
+		if err != nil {
+			level.Error(t.Logger).Log(lfEvent, "prometheus matrix marshaling error", lfDetail, err.Error())
+			r.Writer.WriteHeader(http.StatusInternalServerError)
 			r.WaitGroup.Done()
+			releaseBuffers()
+			return
 		}
-		// Explicitly release the request context so that the underlying memory can be
-		// freed before the next request is received via the channel, which overwrites "r".
-		r = nil
+		t.MemoryLimiter.Add(mcMerges, int64(len(body)))
+
+		diag := ctx.diagnostics(durations)
+		r.Diagnostics = diag
+		writeDiagnostics(r.Writer, ctx.Origin.Diagnostics, diag, false)
+		if resp.StatusCode != http.StatusOK {
+			writeResponse(r.Writer, errorBody, resp)
+		} else {
+			writeResponse(r.Writer, body, resp)
+		}
+		writeDiagnostics(r.Writer, ctx.Origin.Diagnostics, diag, true)
+		r.WaitGroup.Done()
+		t.MemoryLimiter.Release(mcMerges, int64(len(body)))
+		releaseBuffers()
 	}
 }
 
@@ -24,6 +24,7 @@ import (
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/common/model"
@@ -137,7 +138,7 @@ func newTestTricksterHandler(t *testing.T) (tr *TricksterHandler, close func(t *
 		ResponseChannels: make(map[string]chan *ClientRequestContext),
 		Config:           conf,
 		Logger:           log.NewNopLogger(),
-		Metrics:          NewApplicationMetrics(),
+		Metrics:          NewApplicationMetrics(conf),
 	}
 
 	tr.Cacher = getCache(tr)
@@ -382,7 +383,7 @@ func TestTricksterHandler_getURL(t *testing.T) {
 	tr.setTestOrigin(es.URL)
 
 	// it should get from the echo server
-	b, _, _, err := tr.getURL(tr.Config.Origins["default"], "GET", es.URL, url.Values{}, nil)
+	b, _, _, err := tr.getURL(tr.Config.Origins["default"], "GET", es.URL, url.Values{}, nil, time.Time{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,320 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	hvApplicationGzip = "application/gzip"
+
+	// Handoff metric directions
+	hdSent     = "sent"
+	hdReceived = "received"
+	hdRefresh  = "refreshed"
+
+	defaultHandoffMaxRecords      = 10000
+	defaultHandoffTimeoutSecs     = 30
+	defaultHandoffMaxReceiveBytes = 256 << 20
+)
+
+// HandoffConfig describes the cache handoff performed when the process is asked to terminate, so that a deploy does not
+// cause a storm of cache misses against the origins
+type HandoffConfig struct {
+	// PeerURL is the base URL of the instance that receives the most recently used records, e.g. 'http://trickster-b:9090'
+	PeerURL string `toml:"peer_url"`
+	// MaxRecords is the number of most recently used records handed off. Default is 10000
+	MaxRecords int `toml:"max_records"`
+	// MinTTLSecs is the time to live the handed off records are refreshed to, when they have less left. Without a
+	// PeerURL, the records are refreshed in place in the shared cache
+	MinTTLSecs int64 `toml:"min_ttl_secs"`
+	// TimeoutSecs limits the time the handoff may take. Default is 30
+	TimeoutSecs int64 `toml:"timeout_secs"`
+	// MaxReceiveBytes limits the size of the compressed cache archive received from a peer. Default is 256MB
+	MaxReceiveBytes int64 `toml:"max_receive_bytes"`
+}
+
+// enabled returns true if records are handed off on termination
+func (c HandoffConfig) enabled() bool {
+	return c.PeerURL != "" || c.MinTTLSecs > 0
+}
+
+// maxRecords returns the number of records handed off
+func (c HandoffConfig) maxRecords() int {
+	if c.MaxRecords > 0 {
+		return c.MaxRecords
+	}
+	return defaultHandoffMaxRecords
+}
+
+// maxReceiveBytes returns the size limit of a received cache archive
+func (c HandoffConfig) maxReceiveBytes() int64 {
+	if c.MaxReceiveBytes > 0 {
+		return c.MaxReceiveBytes
+	}
+	return defaultHandoffMaxReceiveBytes
+}
+
+// timeout returns the time the handoff may take
+func (c HandoffConfig) timeout() time.Duration {
+	if c.TimeoutSecs > 0 {
+		return time.Duration(c.TimeoutSecs) * time.Second
+	}
+	return defaultHandoffTimeoutSecs * time.Second
+}
+
+// validateHandoff returns an error if the handoff settings are negative, or would refresh records in a private cache
+func (c CachingConfig) validateHandoff() error {
+	h := c.Handoff
+	if h.MaxRecords < 0 || h.MinTTLSecs < 0 || h.TimeoutSecs < 0 || h.MaxReceiveBytes < 0 {
+		return fmt.Errorf("cache: handoff settings must not be negative")
+	}
+	if h.PeerURL == "" && h.MinTTLSecs > 0 && c.CacheType == ctMemory {
+		return fmt.Errorf("cache: handoff without a peer_url requires a shared cache_type")
+	}
+	return nil
+}
+
+// RecencyCache wraps a Cache to track when each record was last stored or retrieved, so that the most recently used
+// records can be handed off on termination
+type RecencyCache struct {
+	Cache
+	max int
+
+	mu       sync.Mutex
+	accessed map[string]int64
+}
+
+// NewRecencyCache returns a RecencyCache tracking the use of at least the max most recently used records
+func NewRecencyCache(c Cache, max int) *RecencyCache {
+	return &RecencyCache{Cache: c, max: max, accessed: make(map[string]int64)}
+}
+
+// touch records the use of the key, forgetting the least recently used keys once twice as many as needed are tracked
+func (c *RecencyCache) touch(cacheKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessed[cacheKey] = time.Now().UnixNano()
+	if len(c.accessed) > 4*c.max {
+		for _, key := range c.lru(len(c.accessed) - 2*c.max) {
+			delete(c.accessed, key)
+		}
+	}
+}
+
+// lru returns the n least recently used keys. c.mu must be held.
+func (c *RecencyCache) lru(n int) []string {
+	keys := make([]string, 0, len(c.accessed))
+	for key := range c.accessed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.accessed[keys[i]] < c.accessed[keys[j]] })
+	return keys[:n]
+}
+
+// Store places an object in the cache, recording its use
+func (c *RecencyCache) Store(cacheKey string, data string, ttl int64) error {
+	err := c.Cache.Store(cacheKey, data, ttl)
+	if err == nil {
+		c.touch(cacheKey)
+	}
+	return err
+}
+
+// Retrieve looks for an object in the cache, recording its use when found
+func (c *RecencyCache) Retrieve(cacheKey string) (string, error) {
+	data, err := c.Cache.Retrieve(cacheKey)
+	if err == nil {
+		c.touch(cacheKey)
+	}
+	return data, err
+}
+
+// Delete removes an object from the cache, and forgets its use
+func (c *RecencyCache) Delete(cacheKey string) error {
+	c.mu.Lock()
+	delete(c.accessed, cacheKey)
+	c.mu.Unlock()
+	return c.Cache.Delete(cacheKey)
+}
+
+// mostRecent returns up to n keys, the most recently used first
+func (c *RecencyCache) mostRecent(n int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := c.lru(len(c.accessed))
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// handleHandoffSignals hands the cache off when the process receives a SIGTERM or SIGINT, then exits
+func (t *TricksterHandler) handleHandoffSignals(rc *RecencyCache) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		level.Info(t.Logger).Log(lfEvent, "handing off cache before exiting", "signal", sig.String())
+		if n, err := t.handoff(rc); err != nil {
+			level.Error(t.Logger).Log(lfEvent, "cache handoff failed", "records", n, lfDetail, err.Error())
+		} else {
+			level.Info(t.Logger).Log(lfEvent, "cache handoff complete", "records", n)
+		}
+		t.Cacher.Close()
+		os.Exit(0)
+	}()
+}
+
+// handoff sends the most recently used records to the peer or, without one, refreshes their time to live in the shared
+// cache, returning the number of records handed off
+func (t *TricksterHandler) handoff(rc *RecencyCache) (int, error) {
+	c := t.Config.Caching.Handoff
+	keys := rc.mostRecent(c.maxRecords())
+	deadline := time.Now().Add(c.timeout())
+
+	if c.PeerURL == "" {
+		n := 0
+		for _, key := range keys {
+			if time.Now().After(deadline) {
+				return n, fmt.Errorf("handoff timed out")
+			}
+			o, ok := handoffRecord(rc, key, c.MinTTLSecs)
+			if !ok {
+				continue
+			}
+			if err := rc.Cache.Store(o.Key, o.Value, o.Expiration-time.Now().Unix()); err != nil {
+				return n, err
+			}
+			n++
+			t.Metrics.CacheHandoffRecords.WithLabelValues(hdRefresh).Inc()
+		}
+		return n, nil
+	}
+
+	// the archive is streamed to the peer as it is written
+	pr, pw := io.Pipe()
+	written := make(chan int, 1)
+	go func() {
+		n, err := writeCacheArchive(pw, t.Config.Caching.CacheType, func(fn func(CacheObject) error) error {
+			for _, key := range keys {
+				if o, ok := handoffRecord(rc, key, c.MinTTLSecs); ok {
+					if err := fn(o); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		pw.CloseWithError(err)
+		written <- n
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.PeerURL, "/")+adminPathPrefix+rnHandoff, pr)
+	if err != nil {
+		pr.Close()
+		return 0, err
+	}
+	req.Header.Set(hnContentType, hvApplicationGzip)
+	if a := t.Config.Admin; a.Username != "" || a.Password != "" {
+		// the instances of a fleet are expected to share their admin credentials
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+	resp, err := (&http.Client{Timeout: time.Until(deadline)}).Do(req)
+	if err != nil {
+		pr.Close()
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	pr.Close()
+	n := <-written
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	t.Metrics.CacheHandoffRecords.WithLabelValues(hdSent).Add(float64(n))
+	return n, nil
+}
+
+// handoffRecord returns the record with the key, with its expiration extended to at least minTTL from now, or false
+// if it is no longer cached
+func handoffRecord(rc *RecencyCache, key string, minTTL int64) (CacheObject, bool) {
+	data, err := rc.Cache.Retrieve(key)
+	if err != nil {
+		return CacheObject{}, false
+	}
+	expiration, err := rc.Cache.Expiration(key)
+	if err != nil {
+		return CacheObject{}, false
+	}
+	if now := time.Now().Unix(); expiration < now+minTTL {
+		expiration = now + minTTL
+	}
+	return CacheObject{Key: key, Value: data, Expiration: expiration}, true
+}
+
+// handoffResult describes the records received from a terminating peer
+type handoffResult struct {
+	Records int    `json:"records"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handoffHandler handles calls to /trickster/handoff, which stores the records of the cache archive in the request body,
+// as sent by a terminating peer, keeping their remaining time to live
+func (t *TricksterHandler) handoffHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	// records are written synchronously, since a handoff would overflow the asynchronous write queue
+	c := t.Cacher
+	if ac, ok := c.(*AsyncCache); ok {
+		c = ac.Cache
+	}
+
+	var result handoffResult
+	status := http.StatusOK
+	n, err := importCache(c, http.MaxBytesReader(w, r.Body, t.Config.Caching.Handoff.maxReceiveBytes()))
+	result.Records = n
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		status = http.StatusRequestEntityTooLarge
+		result.Error = err.Error()
+	} else if err != nil {
+		status = http.StatusBadRequest
+		result.Error = err.Error()
+	}
+	t.Metrics.CacheHandoffRecords.WithLabelValues(hdReceived).Add(float64(n))
+	level.Info(t.Logger).Log(lfEvent, "received cache handoff", "records", n)
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,156 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecencyCache_mostRecent(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	rc := NewRecencyCache(tr.Cacher, 2)
+
+	for i := 0; i < 3; i++ {
+		rc.Store(fmt.Sprintf("key%d", i), "data", 60)
+		time.Sleep(time.Millisecond)
+	}
+	rc.Retrieve("key0")
+	rc.Retrieve("missing")
+
+	// it should return the most recently used keys first
+	if keys := rc.mostRecent(2); !reflect.DeepEqual(keys, []string{"key0", "key2"}) {
+		t.Errorf("unexpected result %v", keys)
+	}
+
+	// it should forget deleted keys
+	rc.Delete("key0")
+	if keys := rc.mostRecent(5); !reflect.DeepEqual(keys, []string{"key2", "key1"}) {
+		t.Errorf("unexpected result %v", keys)
+	}
+
+	// it should bound the number of tracked keys
+	for i := 0; i < 20; i++ {
+		rc.Store(fmt.Sprintf("more%d", i), "data", 60)
+	}
+	if n := len(rc.accessed); n > 4*rc.max {
+		t.Errorf("wanted at most %d got %d.", 4*rc.max, n)
+	}
+}
+
+func TestTricksterHandler_handoff(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	// the metrics of both handlers are registered with the default registry, so the peer shares them
+	peer := &TricksterHandler{Config: NewConfig(), Logger: tr.Logger, Metrics: tr.Metrics}
+	peer.Cacher = getCache(peer)
+	if err := peer.Cacher.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Cacher.Close()
+
+	peer.Config.Admin.Username = "admin"
+	peer.Config.Admin.Password = "secret"
+	tr.Config.Admin = peer.Config.Admin
+	ps := httptest.NewServer(peer.newAdminRouter())
+	defer ps.Close()
+
+	rc := NewRecencyCache(tr.Cacher, 2)
+	tr.Cacher = rc
+	rc.Store("old", "data", 60)
+	rc.Store("recent", "data", 60)
+	rc.Store("expiring", "data", 5)
+
+	tr.Config.Caching.Handoff = HandoffConfig{PeerURL: ps.URL, MaxRecords: 2, MinTTLSecs: 600}
+	n, err := tr.handoff(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should send the most recently used records, with at least the minimum ttl
+	if n != 2 {
+		t.Errorf("wanted %d got %d.", 2, n)
+	}
+	if _, err := peer.Cacher.Retrieve("old"); err == nil {
+		t.Errorf("expected old to be left behind")
+	}
+	for _, key := range []string{"recent", "expiring"} {
+		if data, err := peer.Cacher.Retrieve(key); err != nil || data != "data" {
+			t.Errorf("%s: unexpected result %q %v", key, data, err)
+		}
+	}
+	if exp, _ := peer.Cacher.Expiration("expiring"); exp < time.Now().Unix()+590 {
+		t.Errorf("unexpected expiration %d", exp)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheHandoffRecords.WithLabelValues(hdSent)); v != 2 {
+		t.Errorf("wanted %d got %v.", 2, v)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheHandoffRecords.WithLabelValues(hdReceived)); v != 2 {
+		t.Errorf("wanted %d got %v.", 2, v)
+	}
+
+	// it should report a peer that refuses the handoff
+	tr.Config.Admin.Password = "wrong"
+	if _, err := tr.handoff(rc); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// it should refuse an archive larger than the peer accepts
+	tr.Config.Admin.Password = "secret"
+	peer.Config.Caching.Handoff.MaxReceiveBytes = 16
+	if _, err := tr.handoff(rc); err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// it should refresh the records in place without a peer
+	tr.Config.Caching.Handoff = HandoffConfig{MaxRecords: 1, MinTTLSecs: 600}
+	if n, err := tr.handoff(rc); err != nil || n != 1 {
+		t.Errorf("unexpected result %d %v", n, err)
+	}
+	if exp, _ := tr.Cacher.Expiration("expiring"); exp < time.Now().Unix()+590 {
+		t.Errorf("unexpected expiration %d", exp)
+	}
+	if exp, _ := tr.Cacher.Expiration("recent"); exp > time.Now().Unix()+60 {
+		t.Errorf("unexpected expiration %d", exp)
+	}
+}
+
+func TestCachingConfig_validateHandoff(t *testing.T) {
+	tests := []struct {
+		cacheType string
+		h         HandoffConfig
+		ok        bool
+	}{
+		{ctMemory, HandoffConfig{}, true},
+		{ctMemory, HandoffConfig{PeerURL: "http://peer:9090", MinTTLSecs: 600}, true},
+		{ctMemory, HandoffConfig{MinTTLSecs: 600}, false},
+		{ctRedis, HandoffConfig{MinTTLSecs: 600}, true},
+		{ctRedis, HandoffConfig{MaxRecords: -1}, false},
+		{ctRedis, HandoffConfig{MaxReceiveBytes: -1}, false},
+	}
+
+	for i, test := range tests {
+		err := CachingConfig{CacheType: test.cacheType, Handoff: test.h}.validateHandoff()
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// hopByHopHeaders are never forwarded from the client to the origin
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te",
+	"Trailer", "Transfer-Encoding", "Upgrade", "Host", "Content-Length"}
+
+// HeaderScrubConfig describes which client request headers are forwarded to the origin
+type HeaderScrubConfig struct {
+	// Allow lists the client headers forwarded to the origin. When empty, only the Authorization header is forwarded
+	Allow []string `toml:"allow"`
+	// Deny lists client headers that are never forwarded to the origin, even when allowed
+	Deny []string `toml:"deny"`
+}
+
+// headerNameMatches returns true if the header name matches one of the patterns. Matching is case-insensitive,
+// and a pattern ending in '*' matches any header name with that prefix
+func headerNameMatches(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == "*" || p == name || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub returns the client request headers that may be forwarded to the origin
+func (hc HeaderScrubConfig) scrub(in http.Header) http.Header {
+	allow := hc.Allow
+	if len(allow) == 0 {
+		allow = []string{hnAuthorization}
+	}
+
+	headers := http.Header{}
+	for name, values := range in {
+		if !headerNameMatches(name, allow) || headerNameMatches(name, hc.Deny) || headerNameMatches(name, hopByHopHeaders) {
+			continue
+		}
+		headers[name] = values
+	}
+	return headers
+}
+
+const (
+	hnSetCookie               = "Set-Cookie"
+	hnServer                  = "Server"
+	hnXPoweredBy              = "X-Powered-By"
+	hnStrictTransportSecurity = "Strict-Transport-Security"
+	hnExpires                 = "Expires"
+	hnContentLength           = "Content-Length"
+
+	hvNoStore = "no-store"
+)
+
+const (
+	// Client Cache-Control policies
+	dcTTL     = "ttl"
+	dcNoStore = hvNoStore
+)
+
+// ResponseHeaderPolicy describes modifications made to the headers of every response returned to clients for an origin
+type ResponseHeaderPolicy struct {
+	// Remove lists response headers that are removed before the response is returned to the client
+	Remove []string `toml:"remove"`
+	// StripSetCookie removes any Set-Cookie headers from the response
+	StripSetCookie bool `toml:"strip_set_cookie"`
+	// HSTS, when set, is returned as the Strict-Transport-Security header value
+	HSTS string `toml:"hsts"`
+	// MaskServer removes headers that identify the origin server software
+	MaskServer bool `toml:"mask_server"`
+	// CacheControl replaces the caching headers relayed from the origin: "ttl" sends a max-age and Expires computed
+	// from the remaining TTL of the cached object a response is served from, and "no-store" forbids clients from
+	// caching any response. When empty, the origin's caching headers are relayed
+	CacheControl string `toml:"cache_control"`
+	// MaxAgeSecs caps the max-age sent to clients by the "ttl" cache_control policy. 0 means no cap
+	MaxAgeSecs int64 `toml:"max_age_secs"`
+	// NoStorePaths lists request paths, following the origin moniker, whose responses are always sent with no-store.
+	// A trailing '*' matches any path with that prefix
+	NoStorePaths []string `toml:"no_store_paths"`
+}
+
+// enabled returns true if the policy modifies any response headers
+func (p ResponseHeaderPolicy) enabled() bool {
+	return len(p.Remove) > 0 || p.StripSetCookie || p.HSTS != "" || p.MaskServer || p.CacheControl != "" ||
+		len(p.NoStorePaths) > 0
+}
+
+// noStore returns true if clients are forbidden from caching the response to the request at the path
+func (p ResponseHeaderPolicy) noStore(path string) bool {
+	if p.CacheControl == dcNoStore {
+		return true
+	}
+	for _, np := range p.NoStorePaths {
+		if np == path || (strings.HasSuffix(np, "*") && strings.HasPrefix(path, strings.TrimSuffix(np, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns an error if the policy has an unknown cache_control policy or a negative max_age_secs
+func (p ResponseHeaderPolicy) validate() error {
+	switch p.CacheControl {
+	case "", dcTTL, dcNoStore:
+	default:
+		return fmt.Errorf("response_headers: unknown cache_control policy %q", p.CacheControl)
+	}
+	if p.MaxAgeSecs < 0 {
+		return fmt.Errorf("response_headers: max_age_secs must not be negative")
+	}
+	return nil
+}
+
+// apply modifies the response headers per the policy
+func (p ResponseHeaderPolicy) apply(h http.Header) {
+	for name := range h {
+		if headerNameMatches(name, p.Remove) {
+			h.Del(name)
+		}
+	}
+	if p.StripSetCookie {
+		h.Del(hnSetCookie)
+	}
+	if p.MaskServer {
+		h.Del(hnServer)
+		h.Del(hnXPoweredBy)
+	}
+	if p.HSTS != "" {
+		h.Set(hnStrictTransportSecurity, p.HSTS)
+	}
+}
+
+// applyCacheControl sets the caching headers of a response with the status code, per the policy. expiration is the
+// unix time at which the cached object the response is served from expires, or 0 if it was not served from the cache
+func (p ResponseHeaderPolicy) applyCacheControl(h http.Header, code int, noStore bool, expiration int64, now time.Time) {
+	if noStore {
+		h.Set(hnCacheControl, hvNoStore)
+		h.Del(hnExpires)
+		return
+	}
+	if p.CacheControl != dcTTL || expiration == 0 || code != http.StatusOK {
+		return
+	}
+	maxAge := expiration - now.Unix()
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	if p.MaxAgeSecs > 0 && maxAge > p.MaxAgeSecs {
+		maxAge = p.MaxAgeSecs
+	}
+	h.Set(hnCacheControl, "max-age="+strconv.FormatInt(maxAge, 10))
+	h.Set(hnExpires, now.Add(time.Duration(maxAge)*time.Second).UTC().Format(http.TimeFormat))
+}
+
+// clientExpirationKey is the request context key of the clientExpiration of a response
+type clientExpirationKey struct{}
+
+// clientExpiration holds the expiration of the cached object a response is served from, recorded by the handler for
+// the policyResponseWriter
+type clientExpiration struct {
+	at int64
+}
+
+// setClientExpiration records the unix time at which the cached object the response to r is served from expires,
+// when the origin computes its clients' caching headers from it
+func setClientExpiration(r *http.Request, expiration int64) {
+	if r == nil {
+		return
+	}
+	if ce, ok := r.Context().Value(clientExpirationKey{}).(*clientExpiration); ok {
+		ce.at = expiration
+	}
+}
+
+// lookupClientExpiration records the expiration of the cached object with the key as that of the response to r,
+// when the origin computes its clients' caching headers from it. Objects kept for a stale window expire that many
+// seconds before they are removed from the cache.
+func (t *TricksterHandler) lookupClientExpiration(r *http.Request, cacheKey string, staleSecs int64) {
+	if r == nil || r.Context().Value(clientExpirationKey{}) == nil {
+		return
+	}
+	// asynchronously written objects may not be stored yet, and get no caching headers
+	if expiration, err := t.Cacher.Expiration(cacheKey); err == nil {
+		setClientExpiration(r, expiration-staleSecs)
+	}
+}
+
+// copyResponseHeaders copies the headers of an origin response to the client response. Each value of multi-value
+// headers is kept separate, since headers such as Set-Cookie and Warning are corrupted when joined with commas.
+func copyResponseHeaders(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = append([]string(nil), values...)
+	}
+}
+
+// copyResponseTrailers sends the trailers of an origin response, which are only known once its body has been read,
+// as trailers of the client response. It must be called after the body is written.
+func copyResponseTrailers(w http.ResponseWriter, trailer http.Header) {
+	for name, values := range trailer {
+		if len(values) > 0 {
+			w.Header()[http.TrailerPrefix+name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// policyResponseWriter applies a ResponseHeaderPolicy to the headers just before they are written
+type policyResponseWriter struct {
+	http.ResponseWriter
+	policy      ResponseHeaderPolicy
+	noStore     bool
+	expiration  *clientExpiration
+	wroteHeader bool
+}
+
+func (pw *policyResponseWriter) WriteHeader(code int) {
+	if !pw.wroteHeader {
+		pw.wroteHeader = true
+		pw.policy.apply(pw.Header())
+		pw.policy.applyCacheControl(pw.Header(), code, pw.noStore, pw.expiration.at, time.Now())
+	}
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *policyResponseWriter) Write(b []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+// Flush writes the headers, if they have not been, and flushes the wrapped writer if it supports flushing, so that
+// streamed responses reach the client as they are written
+func (pw *policyResponseWriter) Flush() {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withResponseHeaderPolicy wraps a handler so that the origin's response header policy is applied to every
+// response, whether it was served from the cache or proxied from the origin
+func (t *TricksterHandler) withResponseHeaderPolicy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := t.getOrigin(r).ResponseHeaders; p.enabled() {
+			pw := &policyResponseWriter{ResponseWriter: w, policy: p, noStore: p.noStore(originPath(r)),
+				expiration: &clientExpiration{}}
+			if p.CacheControl == dcTTL {
+				r = r.WithContext(context.WithValue(r.Context(), clientExpirationKey{}, pw.expiration))
+			}
+			w = pw
+		}
+		next(w, r)
+	}
+}
+
+// originPath returns the path of the request following the origin moniker, if any
+func originPath(r *http.Request) string {
+	if name, ok := mux.Vars(r)["originMoniker"]; ok {
+		return strings.TrimPrefix(r.URL.Path, "/"+name)
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,300 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderScrubConfig_scrub(t *testing.T) {
+	in := http.Header{}
+	in.Set(hnAuthorization, "Basic dGVzdDp0ZXN0")
+	in.Set("Cookie", "session=abc")
+	in.Set("X-Grafana-Org-Id", "1")
+	in.Set("X-Scope-OrgID", "tenant")
+	in.Set("Connection", "keep-alive")
+
+	tests := []struct {
+		hc   HeaderScrubConfig
+		want []string
+	}{
+		// it should only pass the Authorization header by default
+		{HeaderScrubConfig{}, []string{hnAuthorization}},
+		// it should drop denied headers
+		{HeaderScrubConfig{Deny: []string{"authorization"}}, []string{}},
+		// it should pass allowed headers, supporting prefix wildcards
+		{HeaderScrubConfig{Allow: []string{"X-*"}}, []string{"X-Grafana-Org-Id", "X-Scope-Orgid"}},
+		// it should never pass hop-by-hop headers
+		{HeaderScrubConfig{Allow: []string{"*"}, Deny: []string{"Cookie"}}, []string{hnAuthorization, "X-Grafana-Org-Id", "X-Scope-Orgid"}},
+	}
+
+	for i, test := range tests {
+		out := test.hc.scrub(in)
+		if len(out) != len(test.want) {
+			t.Errorf("test %d: wanted %v got %v.", i, test.want, out)
+			continue
+		}
+		for _, name := range test.want {
+			if out.Get(name) != in.Get(name) {
+				t.Errorf("test %d: wanted %s to be passed, got %v.", i, name, out)
+			}
+		}
+	}
+}
+
+func TestTricksterHandler_withResponseHeaderPolicy(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hnSetCookie, "session=abc")
+		w.Header().Set(hnXPoweredBy, "origin")
+		w.Header().Set("X-Internal-Id", "42")
+		fmt.Fprint(w, "{}")
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.ResponseHeaders = ResponseHeaderPolicy{
+		Remove:         []string{"x-internal-*"},
+		StripSetCookie: true,
+		HSTS:           "max-age=31536000",
+		MaskServer:     true,
+	}
+	tr.Config.Origins["default"] = o
+
+	// it should apply the policy to proxied responses
+	w := httptest.NewRecorder()
+	tr.proxyHandler(tr.promFullProxyHandler)(w, httptest.NewRequest("GET", es.URL+"/api/v1/labels", nil))
+
+	h := w.Result().Header
+	for _, name := range []string{hnSetCookie, hnXPoweredBy, "X-Internal-Id"} {
+		if h.Get(name) != "" {
+			t.Errorf("expected %s to be removed, got %q", name, h.Get(name))
+		}
+	}
+	if h.Get(hnStrictTransportSecurity) != "max-age=31536000" {
+		t.Errorf("wanted %q got %q.", "max-age=31536000", h.Get(hnStrictTransportSecurity))
+	}
+}
+
+func TestPolicyResponseWriter_Flush(t *testing.T) {
+	w := httptest.NewRecorder()
+	pw := &policyResponseWriter{ResponseWriter: w, policy: ResponseHeaderPolicy{HSTS: "max-age=60"},
+		expiration: &clientExpiration{}}
+	var _ http.Flusher = pw
+
+	// it should apply the policy and flush the wrapped writer
+	pw.Flush()
+	if !w.Flushed {
+		t.Errorf("expected the response to be flushed")
+	}
+	if v := w.Result().Header.Get(hnStrictTransportSecurity); v != "max-age=60" {
+		t.Errorf("wanted %q got %q.", "max-age=60", v)
+	}
+}
+
+func TestResponseHeaderPolicy_applyCacheControl(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		p            ResponseHeaderPolicy
+		code         int
+		noStore      bool
+		expiration   int64
+		cacheControl string
+	}{
+		{ResponseHeaderPolicy{}, http.StatusOK, false, 1060, "public"},
+		{ResponseHeaderPolicy{CacheControl: dcTTL}, http.StatusOK, false, 1060, "max-age=60"},
+		{ResponseHeaderPolicy{CacheControl: dcTTL, MaxAgeSecs: 30}, http.StatusOK, false, 1060, "max-age=30"},
+		{ResponseHeaderPolicy{CacheControl: dcTTL}, http.StatusOK, false, 990, "max-age=0"},
+		{ResponseHeaderPolicy{CacheControl: dcTTL}, http.StatusOK, false, 0, "public"},
+		{ResponseHeaderPolicy{CacheControl: dcTTL}, http.StatusBadGateway, false, 1060, "public"},
+		{ResponseHeaderPolicy{CacheControl: dcTTL}, http.StatusOK, true, 1060, hvNoStore},
+	}
+
+	for i, test := range tests {
+		h := http.Header{hnCacheControl: {"public"}}
+		test.p.applyCacheControl(h, test.code, test.noStore, test.expiration, now)
+		if v := h.Get(hnCacheControl); v != test.cacheControl {
+			t.Errorf("test %d: wanted %q got %q.", i, test.cacheControl, v)
+		}
+	}
+
+	// it should set Expires to the end of the max-age
+	h := http.Header{}
+	ResponseHeaderPolicy{CacheControl: dcTTL}.applyCacheControl(h, http.StatusOK, false, 1060, now)
+	if v, want := h.Get(hnExpires), now.Add(time.Minute).UTC().Format(http.TimeFormat); v != want {
+		t.Errorf("wanted %q got %q.", want, v)
+	}
+}
+
+func TestResponseHeaderPolicy_noStore(t *testing.T) {
+	p := ResponseHeaderPolicy{NoStorePaths: []string{"/api/v1/series", "/api/v1/label/*"}}
+
+	tests := []struct {
+		path    string
+		noStore bool
+	}{
+		{"/api/v1/series", true},
+		{"/api/v1/label/job/values", true},
+		{"/api/v1/labels", false},
+		{"/api/v1/query", false},
+	}
+
+	for i, test := range tests {
+		if p.noStore(test.path) != test.noStore {
+			t.Errorf("test %d: unexpected result for %s", i, test.path)
+		}
+	}
+
+	// it should forbid caching of every path with the no-store policy
+	if !(ResponseHeaderPolicy{CacheControl: dcNoStore}).noStore("/api/v1/query") {
+		t.Errorf("expected no-store")
+	}
+}
+
+func TestResponseHeaderPolicy_validate(t *testing.T) {
+	tests := []struct {
+		p  ResponseHeaderPolicy
+		ok bool
+	}{
+		{ResponseHeaderPolicy{}, true},
+		{ResponseHeaderPolicy{CacheControl: dcTTL, MaxAgeSecs: 60}, true},
+		{ResponseHeaderPolicy{CacheControl: dcNoStore}, true},
+		{ResponseHeaderPolicy{CacheControl: "private"}, false},
+		{ResponseHeaderPolicy{MaxAgeSecs: -1}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.p.validate(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTricksterHandler_withResponseHeaderPolicy_cacheControl(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.ResponseHeaders = ResponseHeaderPolicy{CacheControl: dcTTL, NoStorePaths: []string{"/api/v1/labels"}}
+	tr.Config.Origins["default"] = o
+
+	query := func() http.Header {
+		w := httptest.NewRecorder()
+		tr.proxyHandler(tr.promQueryHandler)(w, httptest.NewRequest("GET", es.URL+exampleQuery, nil))
+		return w.Result().Header
+	}
+
+	// it should send the TTL of the object cached from the origin's response
+	if v := query().Get(hnCacheControl); v != "max-age=15" {
+		t.Errorf("wanted %q got %q.", "max-age=15", v)
+	}
+
+	// it should send the remaining TTL of the object the response is served from
+	h := query()
+	if v := h.Get(hnCacheControl); v != "max-age=15" && v != "max-age=14" {
+		t.Errorf("wanted %q got %q.", "max-age=15", v)
+	}
+	if h.Get(hnExpires) == "" {
+		t.Errorf("expected an Expires header")
+	}
+
+	// it should forbid caching of the responses of no-store paths
+	w := httptest.NewRecorder()
+	tr.proxyHandler(tr.promFullProxyHandler)(w, httptest.NewRequest("GET", es.URL+"/api/v1/labels", nil))
+	if v := w.Result().Header.Get(hnCacheControl); v != hvNoStore {
+		t.Errorf("wanted %q got %q.", hvNoStore, v)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_multiValueHeaders(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add(hnSetCookie, "session=abc; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+		w.Header().Add(hnSetCookie, "theme=dark")
+		w.Header().Add("Warning", `299 - "deprecated, use v2"`)
+		w.Header().Add("Warning", `199 - "stale"`)
+		fmt.Fprint(w, "{}")
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	w := httptest.NewRecorder()
+	tr.proxyHandler(tr.promFullProxyHandler)(w, httptest.NewRequest("GET", es.URL+"/api/v1/labels", nil))
+
+	// it should relay each value of multi-value headers separately
+	h := w.Result().Header
+	if v := h[hnSetCookie]; len(v) != 2 || v[0] != "session=abc; Expires=Wed, 21 Oct 2015 07:28:00 GMT" || v[1] != "theme=dark" {
+		t.Errorf("unexpected %s %q", hnSetCookie, v)
+	}
+	if v := h["Warning"]; len(v) != 2 || v[1] != `199 - "stale"` {
+		t.Errorf("unexpected Warning %q", v)
+	}
+	if len(w.Result().Cookies()) != 2 {
+		t.Errorf("wanted %d got %d.", 2, len(w.Result().Cookies()))
+	}
+}
+
+func TestCopyResponseHeaders(t *testing.T) {
+	src := http.Header{hnSetCookie: {"a=1", "b=2"}, hnContentType: {"application/json"}}
+	dst := http.Header{hnContentType: {"text/plain"}, hnCacheControl: {hvNoCache}}
+	copyResponseHeaders(dst, src)
+
+	// it should replace the copied headers, keeping their values apart, and leave the others alone
+	if len(dst[hnSetCookie]) != 2 || dst.Get(hnContentType) != "application/json" || dst.Get(hnCacheControl) != hvNoCache {
+		t.Errorf("unexpected headers %v", dst)
+	}
+
+	// it should not share the values with the source
+	dst[hnSetCookie][0] = "c=3"
+	if src[hnSetCookie][0] != "a=1" {
+		t.Errorf("unexpected source headers %v", src)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_trailers(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set(hnContentType, "application/grpc-web+proto")
+		w.Write([]byte{0, 0, 0, 0, 1, 8})
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	w := httptest.NewRecorder()
+	tr.proxyHandler(tr.promFullProxyHandler)(w, httptest.NewRequest("GET", es.URL+"/api/v1/stream", nil))
+
+	// it should relay the body as is, followed by the origin's trailers
+	res := w.Result()
+	if body := w.Body.Bytes(); len(body) != 6 || body[5] != 8 {
+		t.Errorf("unexpected body %v", body)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" || res.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("unexpected trailers %v", res.Trailer)
+	}
+}
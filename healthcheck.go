@@ -0,0 +1,107 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// HealthCheckConfig describes the upstream request made for an origin's /health endpoint, and the response that makes
+// the origin healthy
+type HealthCheckConfig struct {
+	// Path is the origin path that is requested. Default is the labels endpoint of the Prometheus API
+	Path string `toml:"path"`
+	// Method is the method of the request. Default is the client's method
+	Method string `toml:"method"`
+	// Body is the body of the request, for health endpoints that are POSTed to
+	Body string `toml:"body"`
+	// Headers are set on the request, in addition to the client headers forwarded to the origin
+	Headers map[string]string `toml:"headers"`
+	// TimeoutSecs limits the request. Default is the origin's timeout_secs
+	TimeoutSecs int64 `toml:"timeout_secs"`
+	// ExpectedCodes lists the response status codes of a healthy origin. Default is 200 when a body is expected
+	ExpectedCodes []int `toml:"expected_codes"`
+	// ExpectedBody is a substring of the response body of a healthy origin
+	ExpectedBody string `toml:"expected_body"`
+	// ExpectedBodyRegex is a regular expression matching the response body of a healthy origin
+	ExpectedBodyRegex string `toml:"expected_body_regex"`
+}
+
+// healthCheckRegexps caches compiled expected body expressions by their source
+var healthCheckRegexps sync.Map
+
+func (hc HealthCheckConfig) regexp() (*regexp.Regexp, error) {
+	if re, ok := healthCheckRegexps.Load(hc.ExpectedBodyRegex); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(hc.ExpectedBodyRegex)
+	if err != nil {
+		return nil, err
+	}
+	healthCheckRegexps.Store(hc.ExpectedBodyRegex, re)
+	return re, nil
+}
+
+// judged returns true if Trickster judges the origin's health from its response, rather than relaying the response
+func (hc HealthCheckConfig) judged() bool {
+	return len(hc.ExpectedCodes) > 0 || hc.ExpectedBody != "" || hc.ExpectedBodyRegex != ""
+}
+
+// check returns a description of why the origin's response does not meet the expectations, or empty if it does
+func (hc HealthCheckConfig) check(code int, body []byte) string {
+	codes := hc.ExpectedCodes
+	if len(codes) == 0 {
+		codes = []int{http.StatusOK}
+	}
+	expected := false
+	for _, c := range codes {
+		expected = expected || c == code
+	}
+	if !expected {
+		return fmt.Sprintf("unexpected status %d", code)
+	}
+
+	if hc.ExpectedBody != "" && !bytes.Contains(body, []byte(hc.ExpectedBody)) {
+		return fmt.Sprintf("response body does not contain %q", hc.ExpectedBody)
+	}
+	if hc.ExpectedBodyRegex != "" {
+		// config validation ensures the expression compiles
+		if re, err := hc.regexp(); err == nil && !re.Match(body) {
+			return fmt.Sprintf("response body does not match %q", hc.ExpectedBodyRegex)
+		}
+	}
+	return ""
+}
+
+// validate returns an error if the health check has an invalid expected status code, expression or timeout
+func (hc HealthCheckConfig) validate() error {
+	for _, c := range hc.ExpectedCodes {
+		if c < 100 || c > 599 {
+			return fmt.Errorf("health_check expected_codes: %d is not an HTTP status code", c)
+		}
+	}
+	if hc.ExpectedBodyRegex != "" {
+		if _, err := hc.regexp(); err != nil {
+			return fmt.Errorf("health_check expected_body_regex: %v", err)
+		}
+	}
+	if hc.TimeoutSecs < 0 {
+		return fmt.Errorf("health_check timeout_secs must not be negative")
+	}
+	return nil
+}
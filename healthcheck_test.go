@@ -0,0 +1,110 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthCheckConfig_check(t *testing.T) {
+	tests := []struct {
+		hc      HealthCheckConfig
+		code    int
+		body    string
+		healthy bool
+	}{
+		{HealthCheckConfig{ExpectedBody: "ok"}, http.StatusOK, "all ok", true},
+		{HealthCheckConfig{ExpectedBody: "ok"}, http.StatusInternalServerError, "all ok", false},
+		{HealthCheckConfig{ExpectedBody: "ok"}, http.StatusOK, "degraded", false},
+		{HealthCheckConfig{ExpectedCodes: []int{200, 204}}, http.StatusNoContent, "", true},
+		{HealthCheckConfig{ExpectedBodyRegex: `"status":\s*"success"`}, http.StatusOK, `{"status": "success"}`, true},
+		{HealthCheckConfig{ExpectedBodyRegex: `"status":\s*"success"`}, http.StatusOK, `{"status": "error"}`, false},
+	}
+
+	for i, test := range tests {
+		if reason := test.hc.check(test.code, []byte(test.body)); (reason == "") != test.healthy {
+			t.Errorf("test %d: unexpected result %q", i, reason)
+		}
+	}
+}
+
+func TestHealthCheckConfig_validate(t *testing.T) {
+	tests := []struct {
+		hc HealthCheckConfig
+		ok bool
+	}{
+		{HealthCheckConfig{}, true},
+		{HealthCheckConfig{ExpectedCodes: []int{200}, ExpectedBodyRegex: "ok|healthy", TimeoutSecs: 5}, true},
+		{HealthCheckConfig{ExpectedCodes: []int{42}}, false},
+		{HealthCheckConfig{ExpectedBodyRegex: "(ok"}, false},
+		{HealthCheckConfig{TimeoutSecs: -1}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.hc.validate(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTricksterHandler_promHealthCheckHandler_healthCheck(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	status := http.StatusOK
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.URL.Path != "/status" || string(body) != "query=up" || r.Header.Get("X-Check") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("ok"))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.HealthCheck = HealthCheckConfig{Path: "/status", Method: "POST", Body: "query=up", Headers: map[string]string{"X-Check": "1"}}
+	tr.Config.Origins["default"] = o
+
+	check := func() int {
+		w := httptest.NewRecorder()
+		tr.promHealthCheckHandler(w, httptest.NewRequest("GET", "http://trickster/health", nil))
+		return w.Result().StatusCode
+	}
+
+	// it should make the configured request, and relay the response without expectations
+	status = http.StatusAccepted
+	if code := check(); code != http.StatusAccepted {
+		t.Errorf("wanted %d got %d.", http.StatusAccepted, code)
+	}
+
+	// it should respond 200 when the response meets the expectations
+	o.HealthCheck.ExpectedCodes = []int{http.StatusAccepted}
+	o.HealthCheck.ExpectedBody = "ok"
+	tr.Config.Origins["default"] = o
+	if code := check(); code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, code)
+	}
+
+	// it should respond 503 when it does not
+	status = http.StatusOK
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, code)
+	}
+}
@@ -0,0 +1,123 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Hedged request results, for the hedged requests metric
+	hrWon  = "won"
+	hrLost = "lost"
+)
+
+// hedgeable returns true if requests to the origin with the method are hedged. Only idempotent requests are hedged.
+func (o PrometheusOriginConfig) hedgeable(method string) bool {
+	return o.HedgeDelayMS > 0 && (method == http.MethodGet || method == http.MethodHead)
+}
+
+// hedgeURL returns the url of a hedged request for u: u on a randomly chosen hedge replica of the origin, or u itself
+// when the origin has none. Discovered replicas must already be in HedgeOriginURLs.
+func (o PrometheusOriginConfig) hedgeURL(u *url.URL) *url.URL {
+	if len(o.HedgeOriginURLs) == 0 {
+		return u
+	}
+	replica, err := url.Parse(o.HedgeOriginURLs[rand.Intn(len(o.HedgeOriginURLs))])
+	if err != nil {
+		return u
+	}
+	hu := *u
+	hu.Scheme, hu.Host = replica.Scheme, replica.Host
+	return &hu
+}
+
+// doHedgedRequest makes the request to the origin and, if it has not responded within the origin's hedge delay, an
+// identical request to one of its replicas, returning whichever successful response arrives first
+func (t *TricksterHandler) doHedgedRequest(o PrometheusOriginConfig, method string, u *url.URL, headers http.Header, timeout time.Duration) ([]byte, *http.Response, error) {
+	// the request that loses the race is canceled when the winner is returned
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type hedgeResult struct {
+		body   []byte
+		resp   *http.Response
+		err    error
+		hedged bool
+	}
+	results := make(chan hedgeResult, 2)
+	fetch := func(u *url.URL, timeout time.Duration, hedged bool) {
+		body, resp, err := t.doRequest(ctx, o, method, u, headers, nil, timeout)
+		results <- hedgeResult{body, resp, err, hedged}
+	}
+
+	go fetch(u, timeout, false)
+
+	delay := time.Duration(o.HedgeDelayMS) * time.Millisecond
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.body, r.resp, r.err
+	case <-timer.C:
+	}
+
+	// the hedged request shares the original's deadline
+	if timeout > 0 {
+		if timeout <= delay {
+			r := <-results
+			return r.body, r.resp, r.err
+		}
+		timeout -= delay
+	}
+	if replicas := t.Discovery.Replicas(o.OriginURL); len(replicas) > 0 {
+		o.HedgeOriginURLs = replicas
+	}
+	go fetch(o.hedgeURL(u), timeout, true)
+
+	r := <-results
+	if r.err != nil {
+		// the other request may yet succeed
+		if r2 := <-results; r2.err == nil {
+			r = r2
+		}
+	}
+
+	result := hrLost
+	if r.hedged && r.err == nil {
+		result = hrWon
+	}
+	if t.Metrics != nil {
+		t.Metrics.HedgedRequests.WithLabelValues(u.Host, result).Inc()
+	}
+	return r.body, r.resp, r.err
+}
+
+// validateHedging returns an error if the origin's hedge delay is negative, or its replicas are not absolute urls
+func (o PrometheusOriginConfig) validateHedging() error {
+	if o.HedgeDelayMS < 0 {
+		return fmt.Errorf("hedge_delay_ms must not be negative")
+	}
+	for _, u := range o.HedgeOriginURLs {
+		if replica, err := url.Parse(u); err != nil || replica.Scheme == "" || replica.Host == "" {
+			return fmt.Errorf("hedge_origin_urls: %q is not an absolute url", u)
+		}
+	}
+	return nil
+}
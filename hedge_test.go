@@ -0,0 +1,112 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTricksterHandler_getURL_hedged(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the slow origin responds only when its request is canceled
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	replica := newTestServer(`{"replica":true}`)
+	defer replica.Close()
+
+	o := tr.Config.Origins["default"]
+	o.HedgeDelayMS = 10
+	o.HedgeOriginURLs = []string{replica.URL}
+	host := strings.TrimPrefix(slow.URL, "http://")
+
+	// it should use the replica's response when the origin is slower than the hedge delay
+	body, _, _, err := tr.getURL(o, "GET", slow.URL+"/api/v1/query", url.Values{}, nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"replica":true}` {
+		t.Errorf("wanted %q got %q.", `{"replica":true}`, body)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.HedgedRequests.WithLabelValues(host, hrWon)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+
+	// it should not hedge requests that respond within the delay
+	o.HedgeDelayMS = 1000
+	if _, _, _, err := tr.getURL(o, "GET", replica.URL+"/api/v1/query", url.Values{}, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.HedgedRequests.WithLabelValues(strings.TrimPrefix(replica.URL, "http://"), hrLost)); v != 0 {
+		t.Errorf("wanted %d got %v.", 0, v)
+	}
+}
+
+func TestPrometheusOriginConfig_hedgeable(t *testing.T) {
+	o := PrometheusOriginConfig{}
+	if o.hedgeable(http.MethodGet) {
+		t.Errorf("expected no hedging without a delay")
+	}
+	o.HedgeDelayMS = 100
+	if !o.hedgeable(http.MethodGet) {
+		t.Errorf("expected GET requests to be hedged")
+	}
+	if o.hedgeable(http.MethodPost) {
+		t.Errorf("expected POST requests not to be hedged")
+	}
+}
+
+func TestPrometheusOriginConfig_hedgeURL(t *testing.T) {
+	u, _ := url.Parse("http://prometheus-a:9090/api/v1/query?query=up")
+
+	// it should hedge to the origin itself without replicas
+	o := PrometheusOriginConfig{}
+	if got := o.hedgeURL(u).String(); got != u.String() {
+		t.Errorf("wanted %q got %q.", u.String(), got)
+	}
+
+	// it should keep the path and query on the replica
+	o.HedgeOriginURLs = []string{"https://prometheus-b:9091"}
+	if got := o.hedgeURL(u).String(); got != "https://prometheus-b:9091/api/v1/query?query=up" {
+		t.Errorf("unexpected hedge url %q", got)
+	}
+}
+
+func TestPrometheusOriginConfig_validateHedging(t *testing.T) {
+	tests := []struct {
+		o  PrometheusOriginConfig
+		ok bool
+	}{
+		{PrometheusOriginConfig{}, true},
+		{PrometheusOriginConfig{HedgeDelayMS: 500, HedgeOriginURLs: []string{"http://prometheus-b:9090"}}, true},
+		{PrometheusOriginConfig{HedgeDelayMS: -1}, false},
+		{PrometheusOriginConfig{HedgeOriginURLs: []string{"prometheus-b"}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.o.validateHedging(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// Invalidation sources, for the invalidations metric
+	isHTTP  = "http"
+	isRedis = "redis"
+
+	// Invalidation statuses, for the invalidations metric
+	isOK    = "ok"
+	isError = "error"
+
+	// maxInvalidationBytes limits the size of an invalidation message
+	maxInvalidationBytes = 1 << 20
+)
+
+// InvalidationConfig describes the Redis channel on which a central controller publishes invalidation messages, so
+// that a fleet of Tricksters is purged consistently
+type InvalidationConfig struct {
+	// RedisChannel, when set, subscribes to the invalidation messages published on the channel
+	RedisChannel string `toml:"redis_channel"`
+	// RedisEndpoint is the FQDN:port or IPAddress:Port of the Redis server the channel is subscribed on. Default is
+	// the [cache.redis] endpoint
+	RedisEndpoint string `toml:"redis_endpoint"`
+	// RedisPassword is the password of the Redis server, when RedisEndpoint is set
+	RedisPassword string `toml:"redis_password"`
+	// Secret is the key that the messages are signed with, shared with the controller. Required with a RedisChannel
+	Secret string `toml:"secret"`
+	// MaxAgeSecs is how long after they were issued messages are accepted. Default is 60
+	MaxAgeSecs int64 `toml:"max_age_secs"`
+}
+
+// validate returns an error if the channel is set without a secret, or the max age is negative
+func (c InvalidationConfig) validate() error {
+	if c.RedisChannel != "" && c.Secret == "" {
+		return fmt.Errorf("cache: a secret is required to subscribe to invalidations")
+	}
+	if c.MaxAgeSecs < 0 {
+		return fmt.Errorf("cache: invalidation max_age_secs must not be negative")
+	}
+	return nil
+}
+
+// controlConfig returns the configuration that the messages published on the channel are authenticated with, which
+// are signed like control plane commands
+func (c InvalidationConfig) controlConfig() ControlConfig {
+	return ControlConfig{Secret: c.Secret, MaxAgeSecs: c.MaxAgeSecs}
+}
+
+// redisOptions returns the options of the client subscribing to the channel, which defaults to the cache's Redis
+func (c InvalidationConfig) redisOptions(cache RedisCacheConfig) *redis.Options {
+	return subscriberRedisOptions(c.RedisEndpoint, c.RedisPassword, cache)
+}
+
+// subscriberRedisOptions returns the options of a client subscribing to a channel on the Redis server at the endpoint,
+// or on the cache's Redis when the endpoint is empty
+func subscriberRedisOptions(endpoint, password string, cache RedisCacheConfig) *redis.Options {
+	if endpoint == "" {
+		return &redis.Options{Network: cache.Protocol, Addr: cache.Endpoint, Password: cache.Password}
+	}
+	return &redis.Options{Network: "tcp", Addr: endpoint, Password: password}
+}
+
+// invalidationMessage selects the cache records to invalidate, by key, by key prefix or by the origin, query and time
+// range of query_range data sets. At least one scope is required, and all the scopes set are invalidated.
+type invalidationMessage struct {
+	// Keys are deleted from the cache, along with their query_range data set info, if any
+	Keys []string `json:"keys,omitempty"`
+	// Prefix deletes every record whose key starts with it, such as a cache key partition
+	Prefix string `json:"prefix,omitempty"`
+	// Origin (by name) and Query (a regular expression) select the query_range data sets purged of the points at or
+	// after Start (every point when unset), unless they start after End. Start and End are unix or RFC 3339 times.
+	Origin string `json:"origin,omitempty"`
+	Query  string `json:"query,omitempty"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+}
+
+// invalidation is a parsed invalidationMessage
+type invalidation struct {
+	keys   []string
+	prefix string
+	purge  *purgeRequest
+}
+
+// parseInvalidation returns the invalidation of the JSON message
+func (t *TricksterHandler) parseInvalidation(data []byte) (invalidation, error) {
+	var inv invalidation
+	var m invalidationMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return inv, fmt.Errorf("invalid invalidation message: %v", err)
+	}
+	inv.keys = m.Keys
+	inv.prefix = m.Prefix
+	if m.Origin != "" || m.Query != "" || m.Start != "" || m.End != "" {
+		p, err := t.newPurgeRequest(m.Origin, m.Query, m.Start, m.End)
+		if err != nil {
+			return inv, err
+		}
+		inv.purge = &p
+	}
+	if len(inv.keys) == 0 && inv.prefix == "" && inv.purge == nil {
+		return inv, fmt.Errorf("keys, a prefix, an origin or a query is required")
+	}
+	return inv, nil
+}
+
+// invalidate removes the records selected by the invalidation from the cache. The records deleted by key or prefix
+// are reported as deleted data sets.
+func (t *TricksterHandler) invalidate(inv invalidation) (purgeResult, error) {
+	var result purgeResult
+	keys := inv.keys
+	if inv.prefix != "" {
+		// the records are deleted after the walk, since some caches hold a lock while walking
+		err := t.Cacher.Walk(func(o CacheObject) error {
+			if strings.HasPrefix(o.Key, inv.prefix) && !strings.HasSuffix(o.Key, recordInfoSuffix) {
+				keys = append(keys, o.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	for _, key := range keys {
+		if err := t.Cacher.Delete(key); err != nil {
+			return result, err
+		}
+		t.Cacher.Delete(key + recordInfoSuffix)
+		result.Deleted++
+	}
+	if len(keys) > 0 {
+		level.Info(t.Logger).Log(lfEvent, "invalidated cache records", "prefix", inv.prefix, "deleted", len(keys))
+	}
+
+	if inv.purge != nil {
+		pr, err := t.purge(*inv.purge)
+		result.Trimmed += pr.Trimmed
+		result.Deleted += pr.Deleted
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// countInvalidation counts an invalidation message from the source, which failed when err is not nil
+func (t *TricksterHandler) countInvalidation(source string, err error) {
+	status := isOK
+	if err != nil {
+		status = isError
+	}
+	t.Metrics.CacheInvalidations.WithLabelValues(source, status).Inc()
+}
+
+// invalidateHandler handles calls to /trickster/invalidate, whose body is a JSON invalidation message. The response
+// reports the number of records or data sets deleted and trimmed as JSON.
+func (t *TricksterHandler) invalidateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	var result purgeResult
+	status := http.StatusOK
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInvalidationBytes))
+	if err == nil {
+		var inv invalidation
+		if inv, err = t.parseInvalidation(data); err != nil {
+			status = http.StatusBadRequest
+		} else if result, err = t.invalidate(inv); err != nil {
+			status = http.StatusInternalServerError
+		}
+	} else {
+		status = http.StatusBadRequest
+	}
+	t.countInvalidation(isHTTP, err)
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// subscribeInvalidations applies the invalidation messages published on the configured Redis channel, until the
+// process exits. The client reconnects and subscribes again whenever the connection is lost.
+func (t *TricksterHandler) subscribeInvalidations(c InvalidationConfig) {
+	client := redis.NewClient(c.redisOptions(t.Config.Caching.Redis))
+	pubsub := client.Subscribe(c.RedisChannel)
+	defer pubsub.Close()
+	level.Info(t.Logger).Log(lfEvent, "subscribed to cache invalidations", "channel", c.RedisChannel, "endpoint", client.Options().Addr)
+	t.applyInvalidations(NewControlPlane(c.controlConfig()), pubsub.Channel())
+}
+
+// applyInvalidations applies the invalidation messages received on the Redis channel, until the channel is closed.
+// Each message is a signed control plane purge command, and messages that are unsigned, too old or replayed are
+// refused.
+func (t *TricksterHandler) applyInvalidations(p *ControlPlane, messages <-chan *redis.Message) {
+	for m := range messages {
+		cmd, err := p.verify([]byte(m.Payload), time.Now())
+		if err == nil && (cmd.Command != ctPurge || cmd.Invalidation == nil) {
+			err = fmt.Errorf("not a purge command")
+		}
+		if err == nil {
+			var data []byte
+			if data, err = json.Marshal(cmd.Invalidation); err == nil {
+				var inv invalidation
+				if inv, err = t.parseInvalidation(data); err == nil {
+					_, err = t.invalidate(inv)
+				}
+			}
+		}
+		t.countInvalidation(isRedis, err)
+		if err != nil {
+			level.Warn(t.Logger).Log(lfEvent, "error applying cache invalidation", "source", isRedis, "channel", m.Channel, lfDetail, err.Error())
+			continue
+		}
+		level.Info(t.Logger).Log(lfEvent, "cache invalidation applied", "issuer", cmd.Issuer, "issuedAt", cmd.IssuedAt)
+	}
+}
@@ -0,0 +1,183 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInvalidationConfig_redisOptions(t *testing.T) {
+	cache := RedisCacheConfig{Protocol: "unix", Endpoint: "/tmp/redis.sock", Password: "cache"}
+
+	// it should default to the cache's redis
+	if o := (InvalidationConfig{RedisChannel: "c"}).redisOptions(cache); o.Network != "unix" || o.Addr != cache.Endpoint || o.Password != "cache" {
+		t.Errorf("unexpected options %+v", o)
+	}
+	o := (InvalidationConfig{RedisChannel: "c", RedisEndpoint: "controller:6379", RedisPassword: "pw"}).redisOptions(cache)
+	if o.Network != "tcp" || o.Addr != "controller:6379" || o.Password != "pw" {
+		t.Errorf("unexpected options %+v", o)
+	}
+}
+
+func TestTricksterHandler_parseInvalidation(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tests := []struct {
+		message string
+		valid   bool
+		purge   bool
+	}{
+		{`{"keys":["a","b"]}`, true, false},
+		{`{"prefix":"tenant-a."}`, true, false},
+		{`{"origin":"default","start":"2019-01-01T00:00:00Z","end":"1546347600"}`, true, true},
+		{`{"query":"^job:","start":"1546300800"}`, true, true},
+		{`{}`, false, false},
+		{`{"keys":`, false, false},
+		{`{"start":"1546300800"}`, false, false},
+		{`{"origin":"nonexistent"}`, false, false},
+		{`{"origin":"default","start":"2","end":"1"}`, false, false},
+	}
+	for i, test := range tests {
+		inv, err := tr.parseInvalidation([]byte(test.message))
+		if (err == nil) != test.valid || (inv.purge != nil) != test.purge {
+			t.Errorf("test %d: unexpected result %+v %v", i, inv, err)
+		}
+	}
+}
+
+func TestTricksterHandler_invalidateHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+	router := tr.newAdminRouter()
+
+	start := (time.Now().Unix()/60 - 60) * 60
+	w := httptest.NewRecorder()
+	u := "http://trickster/api/v1/query_range?step=60&query=" + url.QueryEscape("job:up:sum")
+	router.ServeHTTP(w, httptest.NewRequest("POST", "http://trickster/trickster/prime?url="+url.QueryEscape(u), strings.NewReader(testPrimeBody(start, start+1200, 60))))
+	var primed primeResult
+	json.NewDecoder(w.Result().Body).Decode(&primed)
+	if primed.Error != "" {
+		t.Fatal(primed.Error)
+	}
+	for _, key := range []string{"tenant-a.1", "tenant-a.2", "tenant-b.1"} {
+		tr.Cacher.Store(key, "data", 60)
+	}
+
+	invalidate := func(message string) (int, purgeResult) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "http://trickster/trickster/invalidate", strings.NewReader(message)))
+		var result purgeResult
+		json.NewDecoder(w.Result().Body).Decode(&result)
+		return w.Result().StatusCode, result
+	}
+
+	// it should delete the records by key and by prefix
+	code, result := invalidate(`{"keys":["tenant-b.1"],"prefix":"tenant-a."}`)
+	if code != http.StatusOK || result.Deleted != 3 {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+	for _, key := range []string{"tenant-a.1", "tenant-a.2", "tenant-b.1"} {
+		if _, err := tr.Cacher.Retrieve(key); !isCacheMiss(err) {
+			t.Errorf("%s: expected a cache miss, got %v", key, err)
+		}
+	}
+
+	// it should purge the data sets overlapping the time range
+	code, result = invalidate(fmt.Sprintf(`{"origin":"default","start":"%d","end":"%d"}`, start+600, start+660))
+	if code != http.StatusOK || result.Trimmed != 1 || result.Deleted != 0 {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+
+	// it should refuse invalid messages
+	if code, result := invalidate(`{}`); code != http.StatusBadRequest || result.Error == "" {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+}
+
+func TestTricksterHandler_applyInvalidations(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.Cacher.Store("a", "data", 60)
+	tr.Cacher.Store("b", "data", 60)
+
+	tr.Cacher.Store("c", "data", 60)
+	tr.Cacher.Store("d", "data", 60)
+
+	purge := func(invalidation string, issuedAt int64) string {
+		return fmt.Sprintf(`{"command":"purge","invalidation":%s,"issuer":"controller","issued_at":%d}`, invalidation, issuedAt)
+	}
+	now := time.Now().Unix()
+	replayed := testControlMessage("secret", purge(`{"keys":["a"]}`, now))
+
+	// it should apply each signed message, until the channel is closed
+	messages := make(chan *redis.Message, 8)
+	messages <- &redis.Message{Channel: "invalidations", Payload: replayed}
+	messages <- &redis.Message{Channel: "invalidations", Payload: `not json`}
+	messages <- &redis.Message{Channel: "invalidations", Payload: testControlMessage("secret", purge(`{"prefix":"b"}`, now))}
+	// it should refuse unsigned, old, replayed and other messages
+	messages <- &redis.Message{Channel: "invalidations", Payload: `{"keys":["c"]}`}
+	messages <- &redis.Message{Channel: "invalidations", Payload: testControlMessage("wrong", purge(`{"keys":["c"]}`, now))}
+	messages <- &redis.Message{Channel: "invalidations", Payload: testControlMessage("secret", purge(`{"keys":["c"]}`, now-3600))}
+	messages <- &redis.Message{Channel: "invalidations", Payload: testControlMessage("secret",
+		fmt.Sprintf(`{"command":"bypass","state":"on","issuer":"controller","issued_at":%d}`, now))}
+	messages <- &redis.Message{Channel: "invalidations", Payload: replayed}
+	close(messages)
+	tr.applyInvalidations(NewControlPlane(InvalidationConfig{Secret: "secret"}.controlConfig()), messages)
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := tr.Cacher.Retrieve(key); !isCacheMiss(err) {
+			t.Errorf("%s: expected a cache miss, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"c", "d"} {
+		if _, err := tr.Cacher.Retrieve(key); err != nil {
+			t.Errorf("%s: unexpected error %v", key, err)
+		}
+	}
+	if tr.bypassed() {
+		t.Errorf("did not expect bypass mode")
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheInvalidations.WithLabelValues(isRedis, isError)); v != 6 {
+		t.Errorf("wanted %d got %v.", 6, v)
+	}
+}
+
+func TestInvalidationConfig_validate(t *testing.T) {
+	tests := []struct {
+		config InvalidationConfig
+		valid  bool
+	}{
+		{InvalidationConfig{}, true},
+		{InvalidationConfig{RedisChannel: "invalidations", Secret: "secret"}, true},
+		{InvalidationConfig{RedisChannel: "invalidations"}, false},
+		{InvalidationConfig{MaxAgeSecs: -1}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// ListenerConfig describes an additional listener of the Proxy server, for serving some or all origins on another
+// address or port with its own TLS settings
+type ListenerConfig struct {
+	// Name identifies the listener in logs
+	Name string `toml:"name"`
+	// ListenAddress is the IP address of the listener. Empty listens on all interfaces
+	ListenAddress string `toml:"listen_address"`
+	// ListenPort is the TCP port of the listener
+	ListenPort int `toml:"listen_port"`
+	// TLS configures the listener to serve https
+	TLS TLSConfig `toml:"tls"`
+	// Origins restricts the listener to the named origins, responding 404 to requests for any other. When empty, all
+	// origins are served
+	Origins []string `toml:"origins"`
+	// KeepAlivePeriodSecs is the TCP keepalive period of client connections. Default is Go's (15s), and a negative
+	// value disables keepalives
+	KeepAlivePeriodSecs int64 `toml:"keepalive_period_secs"`
+	// ReadBufferBytes and WriteBufferBytes set the socket buffer sizes of client connections. Default is the
+	// operating system's
+	ReadBufferBytes  int `toml:"read_buffer_bytes"`
+	WriteBufferBytes int `toml:"write_buffer_bytes"`
+	// ProxyProtocol requires connections from the ProxyProtocolSources to begin with a PROXY protocol header
+	ProxyProtocol bool `toml:"proxy_protocol"`
+	// ProxyProtocolSources lists the IP addresses and CIDR blocks of the load balancers that send PROXY protocol
+	// headers. When empty, every connection must send one
+	ProxyProtocolSources []string `toml:"proxy_protocol_sources"`
+}
+
+// address returns the host:port the listener listens on
+func (l ListenerConfig) address() string {
+	return fmt.Sprintf("%s:%d", l.ListenAddress, l.ListenPort)
+}
+
+// proxyListeners returns the listeners of the Proxy server: the main listener, followed by any additional listeners.
+// Unnamed listeners are named by their address.
+func (c *Config) proxyListeners() []ListenerConfig {
+	listeners := []ListenerConfig{{
+		Name:                 "main",
+		ListenAddress:        c.ProxyServer.ListenAddress,
+		ListenPort:           c.ProxyServer.ListenPort,
+		TLS:                  c.TLS,
+		KeepAlivePeriodSecs:  c.ProxyServer.KeepAlivePeriodSecs,
+		ReadBufferBytes:      c.ProxyServer.ReadBufferBytes,
+		WriteBufferBytes:     c.ProxyServer.WriteBufferBytes,
+		ProxyProtocol:        c.ProxyServer.ProxyProtocol,
+		ProxyProtocolSources: c.ProxyServer.ProxyProtocolSources,
+	}}
+	for _, l := range c.ProxyServer.Listeners {
+		if l.Name == "" {
+			l.Name = l.address()
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// validateListeners returns an error if an additional listener has no port or an unknown origin, if two listeners
+// share an address, or if a listener has invalid TLS settings, socket buffer sizes or PROXY protocol sources
+func (c *Config) validateListeners() error {
+	addresses := map[string]bool{}
+	for i, l := range c.proxyListeners() {
+		if err := l.TLS.validate(); err != nil {
+			return fmt.Errorf("listener %q: %v", l.Name, err)
+		}
+		if l.ReadBufferBytes < 0 || l.WriteBufferBytes < 0 {
+			return fmt.Errorf("listener %q: socket buffer sizes must not be negative", l.Name)
+		}
+		if _, err := parseTrustedProxies(l.ProxyProtocolSources); err != nil {
+			return fmt.Errorf("listener %q: proxy_protocol_sources: %v", l.Name, err)
+		}
+		if i > 0 {
+			if l.ListenPort <= 0 || l.ListenPort > 65535 {
+				return fmt.Errorf("listener %q: listen_port must be between 1 and 65535", l.Name)
+			}
+			for _, name := range l.Origins {
+				if _, ok := c.Origins[name]; !ok {
+					return fmt.Errorf("listener %q: unknown origin %q", l.Name, name)
+				}
+			}
+		}
+		if addresses[l.address()] {
+			return fmt.Errorf("listener %q: address %s is already in use by another listener", l.Name, l.address())
+		}
+		addresses[l.address()] = true
+	}
+	return nil
+}
+
+// keepAlive returns the TCP keepalive period of the listener's connections, as net.ListenConfig takes it
+func (l ListenerConfig) keepAlive() time.Duration {
+	if l.KeepAlivePeriodSecs < 0 {
+		return -1
+	}
+	return time.Duration(l.KeepAlivePeriodSecs) * time.Second
+}
+
+// bufferSizeListener sets the socket buffer sizes of the connections it accepts
+type bufferSizeListener struct {
+	net.Listener
+	readBytes, writeBytes int
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *bufferSizeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.readBytes > 0 {
+			tc.SetReadBuffer(l.readBytes)
+		}
+		if l.writeBytes > 0 {
+			tc.SetWriteBuffer(l.writeBytes)
+		}
+	}
+	return c, nil
+}
+
+// listenerOriginsKey is the request context key of the origins that the listener a request was received on serves
+type listenerOriginsKey struct{}
+
+// listenerHandler wraps the handler of a listener so that requests received on it carry the listener's origin
+// restriction
+func listenerHandler(l ListenerConfig, next http.Handler) http.Handler {
+	if len(l.Origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerOriginsKey{}, l.Origins)))
+	})
+}
+
+// withListenerOrigins wraps a handler so that requests for origins not served by the listener they were received on
+// are answered with a 404
+func (t *TricksterHandler) withListenerOrigins(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origins, ok := r.Context().Value(listenerOriginsKey{}).([]string)
+		if !ok {
+			next(w, r)
+			return
+		}
+		name := getOriginName(r)
+		if _, ok := t.Config.Origins[name]; !ok {
+			name = "default"
+		}
+		for _, o := range origins {
+			if o == name {
+				next(w, r)
+				return
+			}
+		}
+		level.Debug(t.Logger).Log(lfEvent, "request for origin not served by listener", "origin", name, "path", r.URL.Path)
+		w.Header().Set(hnCacheControl, hvNoCache)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// listenAndServeProxy serves the handler on the listener until it fails
+func (t *TricksterHandler) listenAndServeProxy(l ListenerConfig, handler http.Handler) error {
+	level.Info(t.Logger).Log("event", "proxy http endpoint starting", "listener", l.Name, "address", l.ListenAddress, "port", l.ListenPort, "tls", l.TLS.Enabled)
+
+	lc := net.ListenConfig{KeepAlive: l.keepAlive()}
+	ln, err := lc.Listen(context.Background(), "tcp", l.address())
+	if err != nil {
+		return err
+	}
+	if l.ReadBufferBytes > 0 || l.WriteBufferBytes > 0 {
+		ln = &bufferSizeListener{Listener: ln, readBytes: l.ReadBufferBytes, writeBytes: l.WriteBufferBytes}
+	}
+	if l.ProxyProtocol {
+		// the sources were already validated with the rest of the configuration
+		sources, _ := parseTrustedProxies(l.ProxyProtocolSources)
+		ln = &proxyProtocolListener{Listener: ln, sources: sources}
+	}
+	srv := &http.Server{Handler: listenerHandler(l, handler)}
+	if t.Config.grpcEnabled() {
+		srv.Protocols = grpcProtocols(true)
+	}
+	if l.TLS.Enabled {
+		if srv.TLSConfig, err = t.serverTLSConfig(l.Name, l.TLS); err != nil {
+			ln.Close()
+			return err
+		}
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
@@ -0,0 +1,127 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfig_proxyListeners(t *testing.T) {
+	c := NewConfig()
+	c.ProxyServer.ListenPort = 9090
+	c.TLS = TLSConfig{Enabled: true, FullChainCertPath: "a.crt", PrivateKeyPath: "a.key"}
+	c.ProxyServer.Listeners = []ListenerConfig{{Name: "internal", ListenPort: 9092}, {ListenAddress: "10.0.0.1", ListenPort: 9093}}
+
+	listeners := c.proxyListeners()
+	if len(listeners) != 3 {
+		t.Fatalf("wanted %d got %d.", 3, len(listeners))
+	}
+
+	// it should list the main listener first, with the main tls settings
+	if listeners[0].ListenPort != 9090 || !listeners[0].TLS.Enabled {
+		t.Errorf("unexpected main listener %v", listeners[0])
+	}
+
+	// it should name unnamed listeners by their address
+	if listeners[1].Name != "internal" {
+		t.Errorf("wanted %q got %q.", "internal", listeners[1].Name)
+	}
+	if listeners[2].Name != "10.0.0.1:9093" {
+		t.Errorf("wanted %q got %q.", "10.0.0.1:9093", listeners[2].Name)
+	}
+}
+
+func TestConfig_validateListeners(t *testing.T) {
+	tests := []struct {
+		l  ListenerConfig
+		ok bool
+	}{
+		{ListenerConfig{ListenPort: 9443, Origins: []string{"default"}}, true},
+		{ListenerConfig{ListenPort: 9443, TLS: TLSConfig{Enabled: true, FullChainCertPath: "a.crt", PrivateKeyPath: "a.key"}}, true},
+		{ListenerConfig{}, false},
+		{ListenerConfig{ListenPort: 9443, TLS: TLSConfig{Enabled: true}}, false},
+		{ListenerConfig{ListenPort: 9443, Origins: []string{"unknown"}}, false},
+		{ListenerConfig{ListenPort: 9090}, false},
+		{ListenerConfig{ListenPort: 9443, ReadBufferBytes: -1}, false},
+		{ListenerConfig{ListenPort: 9443, TLS: TLSConfig{MinVersion: "1.4"}}, false},
+	}
+
+	for i, test := range tests {
+		c := NewConfig()
+		c.ProxyServer.ListenPort = 9090
+		c.Origins["default"] = defaultOriginConfig()
+		c.ProxyServer.Listeners = []ListenerConfig{test.l}
+		if err := c.validateListeners(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTricksterHandler_withListenerOrigins(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer("{}")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	tr.Config.Origins["other"] = tr.Config.Origins["default"]
+	router := tr.newRouter()
+
+	get := func(l ListenerConfig, path string) int {
+		w := httptest.NewRecorder()
+		listenerHandler(l, router).ServeHTTP(w, httptest.NewRequest("GET", "http://trickster"+path, nil))
+		return w.Code
+	}
+
+	// it should serve every origin on an unrestricted listener
+	if code := get(ListenerConfig{}, "/other/api/v1/labels"); code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, code)
+	}
+
+	// it should serve the listener's origins
+	l := ListenerConfig{Origins: []string{"default"}}
+	if code := get(l, "/default/api/v1/labels"); code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, code)
+	}
+	if code := get(l, "/api/v1/labels"); code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, code)
+	}
+
+	// it should not serve any other origin
+	if code := get(l, "/other/api/v1/labels"); code != http.StatusNotFound {
+		t.Errorf("wanted %d got %d.", http.StatusNotFound, code)
+	}
+	if code := get(l, "/other/health"); code != http.StatusNotFound {
+		t.Errorf("wanted %d got %d.", http.StatusNotFound, code)
+	}
+}
+
+func TestListenerConfig_keepAlive(t *testing.T) {
+	tests := []struct {
+		secs int64
+		d    time.Duration
+	}{
+		{0, 0},
+		{30, 30 * time.Second},
+		{-1, -1},
+	}
+
+	for i, test := range tests {
+		if d := (ListenerConfig{KeepAlivePeriodSecs: test.secs}).keepAlive(); d != test.d {
+			t.Errorf("test %d: wanted %v got %v.", i, test.d, d)
+		}
+	}
+}
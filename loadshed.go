@@ -0,0 +1,277 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Load shedding reasons
+	lsConcurrency      = "concurrency"
+	lsClassConcurrency = "class_concurrency"
+	lsUpstreamQueue    = "upstream_queue"
+	lsQueueTimeout     = "queue_timeout"
+
+	// lsDefaultClass is the class of requests that match no configured class
+	lsDefaultClass = "default"
+
+	defaultShedRetryAfterSecs = 5
+)
+
+// LoadSheddingConfig describes when proxied requests are refused with a 503 to protect Trickster and the origins from
+// a storm of requests, such as dashboards being reloaded during an incident
+type LoadSheddingConfig struct {
+	// MaxConcurrentRequests is the number of proxied requests being served at once that is considered full load.
+	// 0 does not shed on concurrency
+	MaxConcurrentRequests int `toml:"max_concurrent_requests"`
+	// MaxUpstreamQueueDepth is the number of range requests waiting for data from the origins that is considered full
+	// load. 0 does not shed on the queue depth
+	MaxUpstreamQueueDepth int `toml:"max_upstream_queue_depth"`
+	// QueueTimeoutMS, when set, queues the requests over a concurrency limit for up to this long, starting them in
+	// priority order as other requests finish, instead of shedding them right away
+	QueueTimeoutMS int64 `toml:"queue_timeout_ms"`
+	// MaxClientConcurrentRequests limits the number of requests of each client being served at once. 0 is unlimited
+	MaxClientConcurrentRequests int `toml:"max_client_concurrent_requests"`
+	// ClientIdentityHeader is the request header that identifies clients, e.g. 'X-Grafana-User'. Requests without
+	// it are identified by their client IP
+	ClientIdentityHeader string `toml:"client_identity_header"`
+	// RetryAfterSecs is the Retry-After value sent with shed requests. Default is 5
+	RetryAfterSecs int `toml:"retry_after_secs"`
+	// Classes group requests by route, path and headers, each with its own priority and share of full load
+	Classes map[string]LoadSheddingClassConfig `toml:"classes"`
+}
+
+// LoadSheddingClassConfig describes a class of requests, its priority and the load at which they are shed
+type LoadSheddingClassConfig struct {
+	// Routes lists the route names of the requests in the class, e.g. 'query_range', 'query' or 'proxy'.
+	// Empty matches every route
+	Routes []string `toml:"routes"`
+	// Paths lists regular expressions matched against the request path. Empty matches every path
+	Paths []string `toml:"paths"`
+	// Headers maps request header names to regular expressions that their values must all match
+	Headers map[string]string `toml:"headers"`
+	// Priority is 'alerting', 'interactive' (the default) or 'batch'. Queued requests are started in priority order
+	Priority string `toml:"priority"`
+	// ShedAtPercent is the percentage of full load at which the class is shed. Lower priority classes should be shed
+	// first, at a lower percentage, and a percentage over 100 lets critical requests through beyond full load.
+	// Default is 150 for alerting, 100 for interactive and 50 for batch requests
+	ShedAtPercent int `toml:"shed_at_percent"`
+	// MaxConcurrentRequests limits the number of requests of the class being served at once. 0 is unlimited
+	MaxConcurrentRequests int `toml:"max_concurrent_requests"`
+}
+
+// validate returns an error if the thresholds are negative or a class is invalid
+func (c LoadSheddingConfig) validate() error {
+	if c.MaxConcurrentRequests < 0 || c.MaxUpstreamQueueDepth < 0 || c.RetryAfterSecs < 0 || c.QueueTimeoutMS < 0 ||
+		c.MaxClientConcurrentRequests < 0 {
+		return fmt.Errorf("load_shedding: thresholds must not be negative")
+	}
+	for name, lc := range c.Classes {
+		if name == lsDefaultClass {
+			return fmt.Errorf("load_shedding: class name %q is reserved", lsDefaultClass)
+		}
+		if lc.ShedAtPercent < 0 || lc.MaxConcurrentRequests < 0 {
+			return fmt.Errorf("load_shedding: class %q thresholds must not be negative", name)
+		}
+		if _, ok := priorities[lc.priority()]; !ok {
+			return fmt.Errorf("load_shedding: class %q has an unknown priority %q", name, lc.Priority)
+		}
+		for _, p := range lc.Paths {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("load_shedding: class %q has an invalid path expression %q: %v", name, p, err)
+			}
+		}
+		for h, p := range lc.Headers {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("load_shedding: class %q has an invalid %s header expression %q: %v", name, h, p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadClass is a configured class of requests, with its expressions compiled
+type loadClass struct {
+	name          string
+	routes        map[string]bool
+	paths         []*regexp.Regexp
+	headers       map[string]*regexp.Regexp
+	priority      int
+	shedAtPercent int
+	maxConcurrent int
+}
+
+// matches returns true if the request on the named route is in the class
+func (lc *loadClass) matches(route string, r *http.Request) bool {
+	if len(lc.routes) > 0 && !lc.routes[route] {
+		return false
+	}
+	for h, re := range lc.headers {
+		if !re.MatchString(r.Header.Get(h)) {
+			return false
+		}
+	}
+	if len(lc.paths) == 0 {
+		return true
+	}
+	for _, re := range lc.paths {
+		if re.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadShedder tracks the proxied requests in flight, overall and by client, and the range requests waiting for the
+// origins, and schedules the proxied requests by class: starting them while their class and client are within their
+// share of the configured load, queueing them by priority when they are not, and otherwise shedding them.
+// A nil LoadShedder tracks nothing and never sheds.
+type LoadShedder struct {
+	config       LoadSheddingConfig
+	classes      []*loadClass
+	defaultClass *loadClass
+	metrics      *ApplicationMetrics
+
+	mu            sync.Mutex
+	inFlight      int
+	classInFlight map[string]int
+	clients       map[string]*clientAccount
+	waiting       []*waiter
+	seq           uint64
+
+	// queued is accessed atomically
+	queued int64
+}
+
+// NewLoadShedder returns a LoadShedder for the validated config, which reports to the metrics when they are not nil
+func NewLoadShedder(c LoadSheddingConfig, m *ApplicationMetrics) *LoadShedder {
+	s := &LoadShedder{
+		config:        c,
+		metrics:       m,
+		classInFlight: make(map[string]int),
+		clients:       make(map[string]*clientAccount),
+		defaultClass:  newLoadClass(lsDefaultClass, LoadSheddingClassConfig{}),
+	}
+	for name, cc := range c.Classes {
+		s.classes = append(s.classes, newLoadClass(name, cc))
+	}
+	// a request in several classes belongs to the one shed first
+	sort.Slice(s.classes, func(i, j int) bool {
+		if s.classes[i].shedAtPercent != s.classes[j].shedAtPercent {
+			return s.classes[i].shedAtPercent < s.classes[j].shedAtPercent
+		}
+		return s.classes[i].name < s.classes[j].name
+	})
+	return s
+}
+
+func newLoadClass(name string, cc LoadSheddingClassConfig) *loadClass {
+	lc := &loadClass{
+		name:          name,
+		routes:        map[string]bool{},
+		headers:       map[string]*regexp.Regexp{},
+		priority:      priorities[cc.priority()],
+		shedAtPercent: cc.ShedAtPercent,
+		maxConcurrent: cc.MaxConcurrentRequests,
+	}
+	if lc.shedAtPercent == 0 {
+		lc.shedAtPercent = defaultShedAtPercents[cc.priority()]
+	}
+	for _, r := range cc.Routes {
+		lc.routes[r] = true
+	}
+	for _, p := range cc.Paths {
+		lc.paths = append(lc.paths, regexp.MustCompile(p))
+	}
+	for h, p := range cc.Headers {
+		lc.headers[h] = regexp.MustCompile(p)
+	}
+	return lc
+}
+
+// class returns the class of the request on the named route
+func (s *LoadShedder) class(route string, r *http.Request) *loadClass {
+	for _, lc := range s.classes {
+		if lc.matches(route, r) {
+			return lc
+		}
+	}
+	return s.defaultClass
+}
+
+// over returns true if n is at or over the class's share of max, when max is set
+func (lc *loadClass) over(n int64, max int) bool {
+	return max > 0 && n*100 >= int64(max)*int64(lc.shedAtPercent)
+}
+
+// queue accounts n range requests starting (n > 0) or ending (n < 0) a wait for data from the origins
+func (s *LoadShedder) queue(n int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.queued, n)
+	if s.metrics != nil {
+		s.metrics.UpstreamQueueDepth.Add(float64(n))
+	}
+}
+
+// withLoadShedding wraps a handler so that requests are scheduled by their class, and refused with a 503 and a
+// Retry-After header when their class is over its share of the configured load
+func (t *TricksterHandler) withLoadShedding(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := t.LoadShedder
+		if s == nil {
+			next(w, r)
+			return
+		}
+
+		route := ""
+		if cr := mux.CurrentRoute(r); cr != nil {
+			route = cr.GetName()
+		}
+		lc := s.class(route, r)
+		client := t.clientIdentity(r)
+		r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, client))
+		release, reason := s.admit(r.Context(), lc, client)
+		if reason != "" {
+			level.Debug(t.Logger).Log(lfEvent, "shedding request", "class", lc.name, "reason", reason, "path", r.URL.Path,
+				"client", client)
+			if s.metrics != nil {
+				s.metrics.RequestsShed.WithLabelValues(lc.name, reason).Inc()
+			}
+			retryAfter := s.config.RetryAfterSecs
+			if retryAfter == 0 {
+				retryAfter = defaultShedRetryAfterSecs
+			}
+			w.Header().Set(hnCacheControl, hvNoCache)
+			w.Header().Set(hnRetryAfter, strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		defer release()
+		next(w, r)
+	}
+}
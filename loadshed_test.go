@@ -0,0 +1,196 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadSheddingConfig_validate(t *testing.T) {
+	tests := []struct {
+		c  LoadSheddingConfig
+		ok bool
+	}{
+		{LoadSheddingConfig{}, true},
+		{LoadSheddingConfig{MaxConcurrentRequests: 100, Classes: map[string]LoadSheddingClassConfig{"low": {Paths: []string{"^/api/v1/series"}, ShedAtPercent: 50}}}, true},
+		{LoadSheddingConfig{MaxUpstreamQueueDepth: -1}, false},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{"low": {}}}, true},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{"low": {ShedAtPercent: -1}}}, false},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{"low": {Paths: []string{"("}, ShedAtPercent: 50}}}, false},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{lsDefaultClass: {ShedAtPercent: 50}}}, false},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{"rules": {Priority: "Alerting"}}}, true},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{"rules": {Priority: "urgent"}}}, false},
+		{LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{"rules": {Headers: map[string]string{"User-Agent": "("}}}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.c.validate(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestLoadShedder_class(t *testing.T) {
+	s := NewLoadShedder(LoadSheddingConfig{Classes: map[string]LoadSheddingClassConfig{
+		"metadata": {Routes: []string{rnProxy}, Paths: []string{"/api/v1/(series|labels?)"}, ShedAtPercent: 50},
+		"ranges":   {Routes: []string{rnQueryRange}, ShedAtPercent: 80},
+		"critical": {Paths: []string{"^/critical/"}, ShedAtPercent: 150},
+		"rules":    {Headers: map[string]string{"User-Agent": "^Grafana"}, Priority: prAlerting},
+	}}, nil)
+
+	tests := []struct {
+		route, path, userAgent string
+		class                  string
+		percent                int
+	}{
+		{rnProxy, "/api/v1/series", "", "metadata", 50},
+		{rnQuery, "/api/v1/series", "", lsDefaultClass, 100},
+		{rnQueryRange, "/api/v1/query_range", "", "ranges", 80},
+		{rnQueryRange, "/critical/api/v1/query_range", "", "ranges", 80},
+		{rnQuery, "/critical/api/v1/query", "", "critical", 150},
+		{rnQuery, "/api/v1/query", "Grafana/6.0", "rules", 150},
+		{rnQuery, "/api/v1/query", "curl/7.0", lsDefaultClass, 100},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "http://trickster"+test.path, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		if lc := s.class(test.route, r); lc.name != test.class || lc.shedAtPercent != test.percent {
+			t.Errorf("test %d: unexpected result %s %d", i, lc.name, lc.shedAtPercent)
+		}
+	}
+}
+
+func TestLoadShedder_admit(t *testing.T) {
+	s := NewLoadShedder(LoadSheddingConfig{MaxConcurrentRequests: 10, MaxUpstreamQueueDepth: 4}, nil)
+	half := newLoadClass("half", LoadSheddingClassConfig{ShedAtPercent: 50})
+	full := s.defaultClass
+	extra := newLoadClass("extra", LoadSheddingClassConfig{ShedAtPercent: 150})
+
+	// it should start everything under the thresholds
+	var releases []func()
+	for i := 0; i < 5; i++ {
+		release, reason := s.admit(context.Background(), full, "")
+		if reason != "" {
+			t.Fatalf("unexpected reason %q", reason)
+		}
+		releases = append(releases, release)
+	}
+
+	// it should shed each class at its share of the thresholds
+	if _, reason := s.admit(context.Background(), half, ""); reason != lsConcurrency {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	release, reason := s.admit(context.Background(), full, "")
+	if reason != "" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	release()
+	s.queue(4)
+	if _, reason := s.admit(context.Background(), full, ""); reason != lsUpstreamQueue {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if release, reason := s.admit(context.Background(), extra, ""); reason != "" {
+		t.Errorf("unexpected reason %q", reason)
+	} else {
+		release()
+	}
+
+	// it should account the end of each request
+	for _, release := range releases {
+		release()
+	}
+	if s.inFlight != 0 || s.classInFlight[lsDefaultClass] != 0 {
+		t.Errorf("unexpected in flight %d %v", s.inFlight, s.classInFlight)
+	}
+
+	// a nil LoadShedder should track nothing
+	var ns *LoadShedder
+	ns.queue(1)
+}
+
+func TestTricksterHandler_withLoadShedding(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	tr.Config.LoadShedding = LoadSheddingConfig{
+		MaxConcurrentRequests: 4,
+		RetryAfterSecs:        10,
+		Classes: map[string]LoadSheddingClassConfig{
+			"metadata": {Routes: []string{rnProxy}, Paths: []string{"/api/v1/series"}, ShedAtPercent: 50},
+		},
+	}
+	tr.LoadShedder = NewLoadShedder(tr.Config.LoadShedding, tr.Metrics)
+	router := tr.newRouter()
+
+	get := func(path string) *http.Response {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster"+path, nil))
+		return w.Result()
+	}
+	occupy := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, reason := tr.LoadShedder.admit(context.Background(), tr.LoadShedder.defaultClass, ""); reason != "" {
+				t.Fatalf("unexpected reason %q", reason)
+			}
+		}
+	}
+
+	// it should serve requests, and account them only while they are in flight
+	if resp := get("/api/v1/series?match[]=up"); resp.StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.InFlightRequests); v != 0 {
+		t.Errorf("wanted %d got %v.", 0, v)
+	}
+
+	// it should shed the lower priority class first
+	occupy(2)
+	resp := get("/api/v1/series?match[]=up")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if v := resp.Header.Get(hnRetryAfter); v != "10" {
+		t.Errorf("wanted %s got %s.", "10", v)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.RequestsShed.WithLabelValues("metadata", lsConcurrency)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+	if resp := get("/api/v1/labels"); resp.StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// it should shed every class at full load, except the health checks
+	occupy(2)
+	if resp := get("/api/v1/labels"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.RequestsShed.WithLabelValues(lsDefaultClass, lsConcurrency)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+	if resp := get("/health"); resp.StatusCode == http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
@@ -29,49 +29,58 @@ import (
 // returned Logger will write to files distinguished from other Loggers by the
 // instance string.
 func newLogger(cfg LoggingConfig, instance string) log.Logger {
-	var wr io.Writer
-
-	if cfg.LogFile == "" {
-		wr = os.Stdout
-	} else {
-		logFile := cfg.LogFile
-		if instance != "" {
-			logFile = strings.Replace(logFile, ".log", "."+instance+".log", 1)
-		}
+	return newLevelFilter(newBaseLogger(cfg, instance), cfg.LogLevel)
+}
 
-		wr = &lumberjack.Logger{
-			Filename:   logFile,
-			MaxSize:    256,  // megabytes
-			MaxBackups: 80,   // 256 megs @ 80 backups is 20GB of Logs
-			MaxAge:     7,    // days
-			Compress:   true, // Compress Rolled Backups
-		}
-	}
+// newBaseLogger returns a Logger for the provided logging configuration that logs every level, for wrapping with
+// level filters
+func newBaseLogger(cfg LoggingConfig, instance string) log.Logger {
+	wr := newLogWriter(cfg.LogFile, instance)
 
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(wr))
-	logger = log.With(logger,
+	return log.With(logger,
 		"time", log.DefaultTimestampUTC,
 		"app", "trickster",
 		"caller", log.Valuer(func() interface{} {
 			return pkgCaller{stack.Caller(5)}
 		}),
 	)
+}
 
-	// wrap logger depending on log level
-	switch strings.ToLower(cfg.LogLevel) {
+// newLevelFilter wraps the logger to log only at the provided level or above. Unknown levels log at info.
+func newLevelFilter(logger log.Logger, logLevel string) log.Logger {
+	switch strings.ToLower(logLevel) {
 	case "debug":
-		logger = level.NewFilter(logger, level.AllowDebug())
+		return level.NewFilter(logger, level.AllowDebug())
 	case "info":
-		logger = level.NewFilter(logger, level.AllowInfo())
+		return level.NewFilter(logger, level.AllowInfo())
 	case "warn":
-		logger = level.NewFilter(logger, level.AllowWarn())
+		return level.NewFilter(logger, level.AllowWarn())
 	case "error":
-		logger = level.NewFilter(logger, level.AllowError())
+		return level.NewFilter(logger, level.AllowError())
 	default:
-		logger = level.NewFilter(logger, level.AllowInfo())
+		return level.NewFilter(logger, level.AllowInfo())
+	}
+}
+
+// newLogWriter returns a writer for the provided log file, distinguished from the files of other instances by the
+// instance string, which is auto-rolled and maintained. An empty log file writes to STDOUT.
+func newLogWriter(logFile string, instance string) io.Writer {
+	if logFile == "" {
+		return os.Stdout
 	}
 
-	return logger
+	if instance != "" {
+		logFile = strings.Replace(logFile, ".log", "."+instance+".log", 1)
+	}
+
+	return &lumberjack.Logger{
+		Filename:   logFile,
+		MaxSize:    256,  // megabytes
+		MaxBackups: 80,   // 256 megs @ 80 backups is 20GB of Logs
+		MaxAge:     7,    // days
+		Compress:   true, // Compress Rolled Backups
+	}
 }
 
 // pkgCaller wraps a stack.Call to make the default string output include the
@@ -0,0 +1,91 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// The LZ4 codec writes the LZ4 frame format (https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md), so that
+// cached records can be read with the lz4 tool.
+
+const (
+	czLZ4 = "lz4"
+
+	lz4Magic = 0x184D2204
+	// lz4ReadSize is the size of the reads from the frame reader, which decodes a block of up to 4MB at a time
+	lz4ReadSize = 64 << 10
+)
+
+var (
+	errLZ4Corrupt     = errors.New("lz4: corrupt input")
+	errLZ4ContentSize = errors.New("lz4: decoded data does not match the frame content size")
+)
+
+type lz4Codec struct{}
+
+func (lz4Codec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	// the content size lets the decoder reject frames that decode to more data than was written
+	if err := w.Apply(lz4.BlockSizeOption(lz4.Block4Mb), lz4.SizeOption(uint64(len(data)))); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes an LZ4 frame. Each block is decoded into a buffer of the frame's maximum block size, and blocks
+// that decode to more than it are rejected by the reader. Frames that declare their content size are rejected as
+// soon as they decode to more than it.
+func (lz4Codec) Decode(data []byte) ([]byte, error) {
+	// the reader takes data that ends before the frame descriptor for an empty stream
+	if len(data) < 7 || binary.LittleEndian.Uint32(data) != lz4Magic {
+		return nil, errLZ4Corrupt
+	}
+	r := lz4.NewReader(bytes.NewReader(data))
+	out := []byte{}
+	buf := make([]byte, lz4ReadSize)
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if size := r.Size(); size > 0 && len(out) > size {
+			return nil, errLZ4ContentSize
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size := r.Size(); size > 0 && len(out) != size {
+		return nil, errLZ4ContentSize
+	}
+	return out, nil
+}
+
+func (lz4Codec) Detect(data []byte) bool {
+	return len(data) > 3 && binary.LittleEndian.Uint32(data) == lz4Magic
+}
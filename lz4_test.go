@@ -0,0 +1,129 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+func TestLZ4Codec(t *testing.T) {
+	c := lz4Codec{}
+
+	// it should decode frames written by the lz4 tool, with and without a content checksum
+	want := "hello hello hello hello hello trickster trickster trickster"
+	for _, frame := range []string{
+		"04224d186040821c0000006f68656c6c6f200600059b747269636b737465720a00506b7374657200000000",
+		"04224d186440a71c0000006f68656c6c6f200600059b747269636b737465720a00506b7374657200000000acff5f21",
+	} {
+		b, _ := hex.DecodeString(frame)
+		if !c.Detect(b) {
+			t.Errorf("expected lz4 frame to be detected")
+		}
+		data, err := c.Decode(b)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(data) != want {
+			t.Errorf("wanted %q got %q.", want, string(data))
+		}
+	}
+
+	// it should round trip compressible, incompressible and multi-block data
+	random := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte(exampleRangeResponse),
+		[]byte(strings.Repeat(exampleRangeResponse, 1000)),
+		random,
+		bytes.Repeat([]byte{0}, int(lz4.Block4Mb)+100),
+	}
+	for i, test := range tests {
+		encoded, err := c.Encode(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := c.Decode(encoded)
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+		}
+		if !bytes.Equal(data, test) {
+			t.Errorf("test %d: unexpected result of %d bytes", i, len(data))
+		}
+	}
+	if encoded, _ := c.Encode(tests[3]); len(encoded) > len(tests[3])/10 {
+		t.Errorf("unexpected compressed size %d", len(encoded))
+	}
+
+	// it should reject corrupt frames
+	encoded, _ := c.Encode(tests[3])
+	for _, b := range [][]byte{encoded[:len(encoded)/2], append([]byte{}, encoded[:4]...), []byte("not lz4")} {
+		if _, err := c.Decode(b); err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+
+	// it should reject frames with random corruption, or decode them to the data that was encoded
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := append([]byte{}, encoded...)
+		for j := r.Intn(4); j >= 0; j-- {
+			b[r.Intn(len(b))] ^= byte(r.Intn(255) + 1)
+		}
+		if data, err := c.Decode(b); err == nil && len(data) != len(tests[3]) {
+			t.Errorf("test %d: unexpected result of %d bytes", i, len(data))
+		}
+	}
+}
+
+func TestLZ4Codec_bounds(t *testing.T) {
+	c := lz4Codec{}
+	frame := func(size uint64, data []byte) []byte {
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		w.Apply(lz4.BlockSizeOption(lz4.Block64Kb), lz4.SizeOption(size), lz4.ChecksumOption(false))
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	// it should reject frames that decode to more or less than their content size
+	for _, size := range []uint64{10, 1000} {
+		if _, err := c.Decode(frame(size, bytes.Repeat([]byte("a"), 100))); err != errLZ4ContentSize {
+			t.Errorf("wanted %v got %v.", errLZ4ContentSize, err)
+		}
+	}
+
+	// it should reject blocks that decode to more than the maximum block size, here one literal and a match of
+	// 15+4+255*300 bytes
+	block := []byte{0x1f, 'a', 1, 0}
+	block = append(block, bytes.Repeat([]byte{255}, 300)...)
+	block = append(block, 0)
+	b := frame(0, nil)
+	b = b[:len(b)-4]
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(block)))
+	b = append(append(b, block...), 0, 0, 0, 0)
+	if data, err := c.Decode(b); err == nil {
+		t.Errorf("expected an error, got %d bytes", len(data))
+	}
+}
@@ -25,6 +25,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// applicationCommit is the source control revision Trickster was built from, set at build time with
+// -ldflags "-X main.applicationCommit=..."
+var applicationCommit = "unknown"
+
 const (
 	applicationName    = "trickster"
 	applicationVersion = "0.1.10"
@@ -33,6 +37,7 @@ const (
 	lfEvent    = "event"
 	lfDetail   = "detail"
 	lfCacheKey = "cacheKey"
+	lfClientIP = "clientIP"
 
 	// Prometheus API method names
 	mnQueryRange = "query_range"
@@ -42,11 +47,49 @@ const (
 
 	// Prometheus URL endpoints
 	prometheusAPIv1Path = "/api/v1/"
+
+	// Trickster administrative URL endpoints
+	adminPathPrefix = "/trickster/"
+
+	// Route names
+	rnPing       = "ping"
+	rnHealth     = "health"
+	rnQueryRange = "query_range"
+	rnQuery      = "query"
+	rnProxy      = "proxy"
+	rnExplain    = "explain"
+	rnRoutes     = "routes"
+	rnBypass     = "bypass"
+	rnVersion    = "version"
+	rnPrime      = "prime"
+	rnPurge      = "purge"
+	rnHandoff    = "handoff"
+	rnClients    = "clients"
+	rnStats      = "stats"
+	rnEvents     = "events"
+	rnInvalidate = "invalidate"
+	rnExtents    = "extents"
+	rnSnapshots  = "snapshots"
+	rnSnapshot   = "snapshot"
+	rnLegacyAPI  = "legacy_api"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == ccCache {
+		os.Exit(runCacheCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == ccSchema {
+		os.Exit(runSchemaCommand())
+	}
+	if len(os.Args) > 1 && os.Args[1] == ccBench {
+		os.Exit(runBenchCommand(os.Args[2:]))
+	}
+
 	t := &TricksterHandler{}
 	t.ResponseChannels = make(map[string]chan *ClientRequestContext)
+	t.ClockOffsets = NewClockOffsets()
+	t.Transports = NewTransports()
+	t.Discovery = NewDiscovery()
 
 	t.Config = NewConfig()
 	if err := loadConfiguration(t.Config, os.Args[1:]); err != nil {
@@ -56,57 +99,162 @@ func main() {
 		os.Exit(1)
 	}
 
+	instance := ""
 	if t.Config.Main.InstanceID > 0 {
-		t.Logger = newLogger(t.Config.Logging, fmt.Sprint(t.Config.Main.InstanceID))
-	} else {
-		t.Logger = newLogger(t.Config.Logging, "")
+		instance = fmt.Sprint(t.Config.Main.InstanceID)
 	}
+	baseLogger := newBaseLogger(t.Config.Logging, instance)
+	t.Logger = newLevelFilter(baseLogger, t.Config.Logging.LogLevel)
+	t.OriginLoggers = newOriginLoggers(baseLogger, t.Config.Origins)
+	t.LogSampler = NewLogSampler()
+	t.SlowQueryLogger = newSlowQueryLogger(t.Config.Logging, instance, t.Logger)
 
 	level.Info(t.Logger).Log("event", "application startup", "version", applicationVersion)
+	for name, o := range t.Config.Origins {
+		if o.FaultInjection.enabled() {
+			level.Warn(t.Logger).Log("event", "fault injection is enabled, upstream requests will be delayed or fail", "origin", name)
+		}
+		if o.Recording.enabled() {
+			level.Info(t.Logger).Log("event", "recording upstream responses", "origin", name, "mode", o.Recording.Mode, "path", o.Recording.Path)
+		}
+	}
+
+	if !t.Config.adminListenerEnabled() && !t.Config.adminCredentialsEnabled() {
+		level.Warn(t.Logger).Log("event", "admin endpoints are disabled, configure the [admin] listen_port or credentials to enable them")
+	}
 
-	if t.Config.Profiler.Enabled {
+	if t.Config.Profiler.Enabled && !t.Config.adminListenerEnabled() {
 		go exposeProfilerEndpoint(t.Config, t.Logger)
 	}
 
-	t.Metrics = NewApplicationMetrics()
+	// the trusted proxies were already validated with the rest of the configuration
+	t.TrustedProxies, _ = parseTrustedProxies(t.Config.ProxyServer.TrustedProxies)
+
+	t.Metrics = NewApplicationMetrics(t.Config)
 	t.Metrics.ListenAndServe(t.Config, t.Logger)
 
+	t.MemoryLimiter = NewMemoryLimiter(t.Config.Main.MaxResidentBytes, t.Metrics.MemoryResidentBytes)
+	t.Metrics.MemoryLimitBytes.Set(float64(t.Config.Main.MaxResidentBytes))
+	t.LoadShedder = NewLoadShedder(t.Config.LoadShedding, t.Metrics)
+	t.discoverReplicas()
+
 	t.Cacher = getCache(t)
-	if err := t.Cacher.Connect(); err != nil {
+	if err := t.connectCache(); err != nil {
 		level.Error(t.Logger).Log("event", "Unable to connect to Cache", "detail", err.Error())
 		os.Exit(1)
 	}
+	if c := t.Config.Caching.Events; c.Enabled {
+		t.CacheEvents = NewCacheEvents(c, t.Metrics)
+		t.Cacher = NewEventCache(t.Cacher, t.CacheEvents)
+		if c.WebhookURL != "" {
+			go t.CacheEvents.runWebhook(t.Logger)
+		}
+	}
+	if h := t.Config.Caching.Handoff; h.enabled() {
+		rc := NewRecencyCache(t.Cacher, h.maxRecords())
+		t.Cacher = rc
+		t.handleHandoffSignals(rc)
+	}
+	if t.Config.Caching.AsyncWrites {
+		t.Cacher = NewAsyncCache(t, t.Cacher)
+	}
+
+	t.Stats = NewHitStats(t.Config.Stats)
+	if t.Config.Stats.Persist {
+		if err := t.Stats.restore(t.Cacher); err != nil && !isCacheMiss(err) {
+			level.Warn(t.Logger).Log("event", "error restoring stats", "detail", err.Error())
+		}
+		go t.Stats.persistPeriodically(t.Cacher, t.Logger)
+	}
+	if c := t.Config.Caching.Invalidation; c.RedisChannel != "" {
+		go t.subscribeInvalidations(c)
+	}
+	if c := t.Config.Control; c.RedisChannel != "" {
+		go t.subscribeControl(c)
+	}
 	defer t.Cacher.Close()
 
+	t.handleBypassSignals()
+
+	router := t.newRouter()
+
+	if t.Config.Main.StartupCheckOrigins {
+		if err := t.waitForOrigins(); err != nil {
+			level.Error(t.Logger).Log("event", "starting with unhealthy origins", "detail", err.Error())
+		}
+	}
+
+	if t.Config.adminListenerEnabled() {
+		go t.listenAndServeAdmin()
+	}
+
+	// Start the Servers, with the main listener in the foreground
+	handler := handlers.CompressHandler(router)
+	listeners := t.Config.proxyListeners()
+	for _, l := range listeners[1:] {
+		go func(l ListenerConfig) {
+			err := t.listenAndServeProxy(l, handler)
+			level.Error(t.Logger).Log("event", "proxy http endpoint exiting", "listener", l.Name, "detail", err)
+		}(l)
+	}
+	err := t.listenAndServeProxy(listeners[0], handler)
+	level.Error(t.Logger).Log("event", "exiting", "err", err)
+}
+
+// newRouter returns a router with all of Trickster's HTTP routes registered
+func (t *TricksterHandler) newRouter() *mux.Router {
 	router := mux.NewRouter()
+	t.Router = router
+
+	// Admin Paths, unless they are served by the dedicated admin listener. The proxy listener is reachable by every
+	// dashboard user, so the routes that change or expose the cache are only served there behind the admin credentials
+	if !t.Config.adminListenerEnabled() {
+		t.registerStatusRoutes(router)
+		if t.Config.adminCredentialsEnabled() {
+			admin := router.NewRoute().Subrouter()
+			t.registerAdminRoutes(admin)
+			admin.Use(t.withAdminAuth)
+		}
+	}
+
+	// Snapshots are served on the proxy listener, so that they can be embedded wherever its queries are
+	router.HandleFunc(snapshotPath("{name}"), t.snapshotHandler).Methods("GET").Name(rnSnapshot)
+
+	// gRPC passthrough, ahead of any route that could match the path of a gRPC method
+	if t.Config.grpcEnabled() {
+		router.MatcherFunc(isGRPCRequest).HandlerFunc(t.withGRPCOrigin(t.proxyHandler(t.grpcProxyHandler))).Name(rnGRPC)
+	}
 
 	// Health Check Paths
-	router.HandleFunc("/ping", t.pingHandler).Methods("GET")
-	router.HandleFunc("/{originMoniker}/"+mnHealth, t.promHealthCheckHandler).Methods("GET")
-	router.HandleFunc("/"+mnHealth, t.promHealthCheckHandler).Methods("GET")
+	router.HandleFunc("/{originMoniker}/"+mnHealth, t.withListenerOrigins(t.promHealthCheckHandler)).Methods("GET").Name(rnHealth)
+	router.HandleFunc("/"+mnHealth, t.withListenerOrigins(t.promHealthCheckHandler)).Methods("GET").Name(rnHealth)
+
+	// Writes, which are never cached
+	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnWrite, t.proxyHandler(t.promWriteHandler)).Methods("POST").Name(rnWrite)
+	router.HandleFunc(prometheusAPIv1Path+mnWrite, t.proxyHandler(t.promWriteHandler)).Methods("POST").Name(rnWrite)
+
+	// The legacy Prometheus API, translated to the current API for the origins with the prometheus_legacy shim
+	if t.Config.legacyAPIEnabled() {
+		for _, m := range []string{lmQuery, lmQueryRange, lmMetrics} {
+			router.HandleFunc("/{originMoniker}"+legacyAPIPath+m, t.proxyHandler(t.legacyAPIHandler(m))).Methods("GET").Name(rnLegacyAPI)
+			router.HandleFunc(legacyAPIPath+m, t.proxyHandler(t.legacyAPIHandler(m))).Methods("GET").Name(rnLegacyAPI)
+		}
+	}
 
 	// Path-based  multi-origin support - no support for full proxy of the prometheus UI, only querying
-	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnQueryRange, t.promQueryRangeHandler).Methods("GET", "POST")
-	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnQuery, t.promQueryHandler).Methods("GET", "POST")
-	router.PathPrefix("/{originMoniker}" + prometheusAPIv1Path).HandlerFunc(t.promFullProxyHandler).Methods("GET")
+	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnQueryRange, t.proxyHandler(t.promQueryRangeHandler)).Methods("GET", "POST").Name(rnQueryRange)
+	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnQuery, t.proxyHandler(t.promQueryHandler)).Methods("GET", "POST").Name(rnQuery)
+	router.PathPrefix("/{originMoniker}" + prometheusAPIv1Path).HandlerFunc(t.proxyHandler(t.promFullProxyHandler)).Methods("GET").Name(rnProxy)
 
-	router.HandleFunc(prometheusAPIv1Path+mnQueryRange, t.promQueryRangeHandler).Methods("GET", "POST")
-	router.HandleFunc(prometheusAPIv1Path+mnQuery, t.promQueryHandler).Methods("GET", "POST")
-	router.PathPrefix(prometheusAPIv1Path).HandlerFunc(t.promFullProxyHandler).Methods("GET")
+	router.HandleFunc(prometheusAPIv1Path+mnQueryRange, t.proxyHandler(t.promQueryRangeHandler)).Methods("GET", "POST").Name(rnQueryRange)
+	router.HandleFunc(prometheusAPIv1Path+mnQuery, t.proxyHandler(t.promQueryHandler)).Methods("GET", "POST").Name(rnQuery)
+	router.PathPrefix(prometheusAPIv1Path).HandlerFunc(t.proxyHandler(t.promFullProxyHandler)).Methods("GET").Name(rnProxy)
 
 	// Catch All for Single-Origin proxy
-	router.PathPrefix("/").HandlerFunc(t.promFullProxyHandler).Methods("GET")
+	router.PathPrefix("/").HandlerFunc(t.proxyHandler(t.promFullProxyHandler)).Methods("GET").Name(rnProxy)
 
-	level.Info(t.Logger).Log("event", "proxy http endpoint starting", "address", t.Config.ProxyServer.ListenAddress, "port", t.Config.ProxyServer.ListenPort)
-
-	// Start the Server
-	if t.Config.TLS.Enabled {
-		err := http.ListenAndServeTLS(fmt.Sprintf("%s:%d", t.Config.ProxyServer.ListenAddress, t.Config.ProxyServer.ListenPort), t.Config.TLS.FullChainCertPath, t.Config.TLS.PrivateKeyPath, handlers.CompressHandler(router))
-		level.Error(t.Logger).Log("event", "exiting", "err", err)
-	} else {
-		err := http.ListenAndServe(fmt.Sprintf("%s:%d", t.Config.ProxyServer.ListenAddress, t.Config.ProxyServer.ListenPort), handlers.CompressHandler(router))
-		level.Error(t.Logger).Log("event", "exiting", "err", err)
-	}
+	router.Use(t.withRecovery)
+	return router
 }
 
 func exposeProfilerEndpoint(c *Config, l log.Logger) {
@@ -0,0 +1,370 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Sources of parsed matrices, for the parse duration metric
+	psOrigin = "origin"
+	psCache  = "cache"
+)
+
+// errNotMatrix is returned by parseMatrix when the result is not a matrix
+var errNotMatrix = errors.New("result is not a matrix")
+
+// maxParseDepth limits the nesting of objects and arrays that parseMatrix descends into, so that a malformed body
+// cannot exhaust the stack. Prometheus responses nest 6 levels deep.
+const maxParseDepth = 32
+
+// unmarshalMatrix parses a Prometheus matrix response from the provided source (origin or cache) into pe,
+// using parseMatrix and falling back to encoding/json for anything parseMatrix does not handle, including
+// vector and scalar results, which are decoded as a matrix
+func (t *TricksterHandler) unmarshalMatrix(body []byte, source string, pe *PrometheusMatrixEnvelope) error {
+	start := time.Now()
+	err := func() (err error) {
+		// a body that trips up the parser falls back to encoding/json, rather than crashing the process
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("matrix parser panicked: %v", p)
+			}
+		}()
+		return parseMatrix(body, pe)
+	}()
+	if err != nil {
+		*pe = PrometheusMatrixEnvelope{}
+		err = decodeAsMatrix(body, pe)
+	}
+	if t.Metrics != nil {
+		t.Metrics.ParseDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+	}
+	return err
+}
+
+// parseMatrix parses a Prometheus matrix response in a single pass over the body. encoding/json decodes each
+// sample pair with a nested json.Unmarshal call, which dominates the CPU and allocations of large matrices.
+func parseMatrix(body []byte, pe *PrometheusMatrixEnvelope) error {
+	p := &matrixParser{b: body}
+	err := p.object(func(key string) error {
+		switch key {
+		case "status":
+			s, err := p.str()
+			pe.Status = s
+			return err
+		case "data":
+			return p.object(func(key string) error {
+				switch key {
+				case "resultType":
+					s, err := p.str()
+					pe.Data.ResultType = s
+					if err == nil && s != rvMatrix {
+						return errNotMatrix
+					}
+					return err
+				case "result":
+					// the result can only be parsed once its type is known
+					if pe.Data.ResultType != rvMatrix {
+						return errNotMatrix
+					}
+					pe.Data.Result = model.Matrix{}
+					return p.array(func() error {
+						ss, err := p.sampleStream()
+						pe.Data.Result = append(pe.Data.Result, ss)
+						return err
+					})
+				default:
+					return p.skip()
+				}
+			})
+		default:
+			return p.skip()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	p.ws()
+	if p.i != len(p.b) {
+		return p.errorf("unexpected data after response")
+	}
+	return nil
+}
+
+// matrixParser is a minimal JSON parser for the layout of Prometheus matrix responses
+type matrixParser struct {
+	b     []byte
+	i     int
+	depth int
+}
+
+func (p *matrixParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", p.i, fmt.Sprintf(format, args...))
+}
+
+// ws skips whitespace
+func (p *matrixParser) ws() {
+	for p.i < len(p.b) {
+		switch p.b[p.i] {
+		case ' ', '\t', '\n', '\r':
+			p.i++
+		default:
+			return
+		}
+	}
+}
+
+// peek skips whitespace and returns the next byte, or 0 at the end of the body
+func (p *matrixParser) peek() byte {
+	p.ws()
+	if p.i >= len(p.b) {
+		return 0
+	}
+	return p.b[p.i]
+}
+
+func (p *matrixParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.i++
+	return nil
+}
+
+// null consumes a null literal if it is next, returning true if it was
+func (p *matrixParser) null() bool {
+	if p.peek() == 'n' && bytes.HasPrefix(p.b[p.i:], []byte("null")) {
+		p.i += 4
+		return true
+	}
+	return false
+}
+
+// descend enters a nested object or array, returning an error if it is nested too deeply. The returned function
+// leaves it.
+func (p *matrixParser) descend() (func(), error) {
+	if p.depth >= maxParseDepth {
+		return nil, p.errorf("nesting exceeds %d levels", maxParseDepth)
+	}
+	p.depth++
+	return func() { p.depth-- }, nil
+}
+
+// object parses an object, calling fn with each key once the parser is positioned at its value
+func (p *matrixParser) object(fn func(key string) error) error {
+	if p.null() {
+		return nil
+	}
+	if err := p.expect('{'); err != nil {
+		return err
+	}
+	leave, err := p.descend()
+	if err != nil {
+		return err
+	}
+	defer leave()
+	if p.peek() == '}' {
+		p.i++
+		return nil
+	}
+	for {
+		key, err := p.str()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+		switch p.peek() {
+		case ',':
+			p.i++
+		case '}':
+			p.i++
+			return nil
+		default:
+			return p.errorf("expected ',' or '}'")
+		}
+	}
+}
+
+// array parses an array, calling fn once the parser is positioned at each element
+func (p *matrixParser) array(fn func() error) error {
+	if p.null() {
+		return nil
+	}
+	if err := p.expect('['); err != nil {
+		return err
+	}
+	leave, err := p.descend()
+	if err != nil {
+		return err
+	}
+	defer leave()
+	if p.peek() == ']' {
+		p.i++
+		return nil
+	}
+	for {
+		if err := fn(); err != nil {
+			return err
+		}
+		switch p.peek() {
+		case ',':
+			p.i++
+		case ']':
+			p.i++
+			return nil
+		default:
+			return p.errorf("expected ',' or ']'")
+		}
+	}
+}
+
+// rawStr returns the next string, including its quotes, and whether it contains escapes
+func (p *matrixParser) rawStr() ([]byte, bool, error) {
+	if p.peek() != '"' {
+		return nil, false, p.errorf("expected string")
+	}
+	start := p.i
+	escaped := false
+	for p.i++; p.i < len(p.b); p.i++ {
+		switch p.b[p.i] {
+		case '\\':
+			escaped = true
+			p.i++
+		case '"':
+			p.i++
+			return p.b[start:p.i], escaped, nil
+		}
+	}
+	return nil, false, p.errorf("unterminated string")
+}
+
+// str returns the next string, unescaped
+func (p *matrixParser) str() (string, error) {
+	raw, escaped, err := p.rawStr()
+	if err != nil {
+		return "", err
+	}
+	if !escaped {
+		return string(raw[1 : len(raw)-1]), nil
+	}
+	var s string
+	err = json.Unmarshal(raw, &s)
+	return s, err
+}
+
+// number returns the next number
+func (p *matrixParser) number() ([]byte, error) {
+	p.ws()
+	start := p.i
+	for p.i < len(p.b) {
+		c := p.b[p.i]
+		if (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E' {
+			p.i++
+			continue
+		}
+		break
+	}
+	if p.i == start {
+		return nil, p.errorf("expected number")
+	}
+	return p.b[start:p.i], nil
+}
+
+// skip skips the next value of any type
+func (p *matrixParser) skip() error {
+	switch c := p.peek(); {
+	case c == '{':
+		return p.object(func(string) error { return p.skip() })
+	case c == '[':
+		return p.array(p.skip)
+	case c == '"':
+		_, _, err := p.rawStr()
+		return err
+	case c == 't' && bytes.HasPrefix(p.b[p.i:], []byte("true")):
+		p.i += 4
+	case c == 'f' && bytes.HasPrefix(p.b[p.i:], []byte("false")):
+		p.i += 5
+	case p.null():
+	default:
+		_, err := p.number()
+		return err
+	}
+	return nil
+}
+
+// sampleStream parses a series of a matrix result
+func (p *matrixParser) sampleStream() (*model.SampleStream, error) {
+	ss := &model.SampleStream{}
+	err := p.object(func(key string) error {
+		switch key {
+		case "metric":
+			if p.null() {
+				return nil
+			}
+			ss.Metric = model.Metric{}
+			return p.object(func(name string) error {
+				value, err := p.str()
+				ss.Metric[model.LabelName(name)] = model.LabelValue(value)
+				return err
+			})
+		case "values":
+			return p.array(func() error {
+				sp, err := p.samplePair()
+				ss.Values = append(ss.Values, sp)
+				return err
+			})
+		default:
+			return p.skip()
+		}
+	})
+	return ss, err
+}
+
+// samplePair parses a [timestamp, "value"] pair, using the same conversions as model.SamplePair
+func (p *matrixParser) samplePair() (model.SamplePair, error) {
+	sp := model.SamplePair{}
+	if err := p.expect('['); err != nil {
+		return sp, err
+	}
+	ts, err := p.number()
+	if err != nil {
+		return sp, err
+	}
+	if err := sp.Timestamp.UnmarshalJSON(ts); err != nil {
+		return sp, err
+	}
+	if err := p.expect(','); err != nil {
+		return sp, err
+	}
+	v, _, err := p.rawStr()
+	if err != nil {
+		return sp, err
+	}
+	if err := sp.Value.UnmarshalJSON(v); err != nil {
+		return sp, err
+	}
+	return sp, p.expect(']')
+}
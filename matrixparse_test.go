@@ -0,0 +1,132 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseMatrix(t *testing.T) {
+	bodies := []string{
+		exampleRangeResponse,
+		`{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+		` { "status" : "success" , "data" : { "resultType" : "matrix" , "result" : [ { "metric" : { } , "values" : [ [ 1435781430.781 , "1.5e3" ] ] } ] } } `,
+		`{"status":"success","warnings":["a \"quoted\" warning"],"data":{"resultType":"matrix","result":[{"metric":{"path":"C:\\temp","unicode":"\u00e9"},"values":[[1435781430,"NaN"],[1435781445,"+Inf"],[1435781460,"-Inf"]]}]}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":null,"values":null}],"stats":{"timings":{"evalTotalTime":0.1}}}}`,
+	}
+
+	for i, body := range bodies {
+		want := PrometheusMatrixEnvelope{}
+		if err := json.Unmarshal([]byte(body), &want); err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+
+		got := PrometheusMatrixEnvelope{}
+		if err := parseMatrix([]byte(body), &got); err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+
+		// it should parse the same matrix as encoding/json (compared marshaled, since NaN != NaN)
+		wb, _ := json.Marshal(want)
+		gb, _ := json.Marshal(got)
+		if !bytes.Equal(wb, gb) {
+			t.Errorf("test %d: wanted %s got %s.", i, wb, gb)
+		}
+	}
+}
+
+func TestParseMatrix_errors(t *testing.T) {
+	bodies := []string{
+		`{"status":"success","data":{"resultType":"vector","result":[]}}`,
+		`{"status":"success","data":{"result":[],"resultType":"matrix"}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"values":[[1,"1"]}]}}`,
+		`{"status":"success"} trailing`,
+		`{"status":"success`,
+	}
+
+	// it should return an error for input it does not handle, so the caller can fall back to encoding/json
+	for i, body := range bodies {
+		pe := PrometheusMatrixEnvelope{}
+		if err := parseMatrix([]byte(body), &pe); err == nil {
+			t.Errorf("test %d: expected error", i)
+		}
+	}
+}
+
+func TestTricksterHandler_unmarshalMatrix(t *testing.T) {
+	tr := &TricksterHandler{Config: NewConfig()}
+	tr.Metrics = newApplicationMetrics(tr.Config, prometheus.NewRegistry())
+
+	// it should fall back to encoding/json for layouts the parser does not handle
+	pe := PrometheusMatrixEnvelope{}
+	err := tr.unmarshalMatrix([]byte(`{"data":{"result":[{"metric":{"a":"b"},"values":[[1,"1"]]}],"resultType":"matrix"},"status":"success"}`), psOrigin, &pe)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(pe.Data.Result) != 1 || pe.Data.ResultType != rvMatrix {
+		t.Errorf("unexpected matrix %v", pe)
+	}
+
+	// it should return an error for invalid input
+	if err := tr.unmarshalMatrix([]byte(`not json`), psOrigin, &pe); err == nil {
+		t.Errorf("expected error for invalid input")
+	}
+}
+
+// largeMatrixBody returns a matrix response with the provided number of series and points per series
+func largeMatrixBody(series, points int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+	for s := 0; s < series; s++ {
+		if s > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"metric":{"__name__":"up","instance":"host-%d:9100","job":"node"},"values":[`, s)
+		for i := 0; i < points; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(&buf, `[%d.781,"%d.25"]`, 1435781430+i*15, i)
+		}
+		buf.WriteString(`]}`)
+	}
+	buf.WriteString(`]}}`)
+	return buf.Bytes()
+}
+
+func BenchmarkParseMatrix(b *testing.B) {
+	body := largeMatrixBody(100, 1000)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pe := PrometheusMatrixEnvelope{}
+		parseMatrix(body, &pe)
+	}
+}
+
+func BenchmarkParseMatrix_encodingJSON(b *testing.B) {
+	body := largeMatrixBody(100, 1000)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pe := PrometheusMatrixEnvelope{}
+		json.Unmarshal(body, &pe)
+	}
+}
@@ -0,0 +1,131 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Memory accounting components
+	mcCache   = "cache"
+	mcBuffers = "buffers"
+	mcMerges  = "merges"
+)
+
+var memoryComponents = []string{mcCache, mcBuffers, mcMerges}
+
+// MemoryLimiter tracks the bytes held by Trickster across the memory cache, upstream response
+// buffers and in-flight merges, and enforces the configured global memory budget.
+// A nil MemoryLimiter, or one with a Limit of 0, tracks usage but never refuses a reservation.
+type MemoryLimiter struct {
+	// Limit is the maximum number of resident bytes allowed across all components
+	Limit int64
+	used  map[string]*int64
+	total int64
+	gauge *prometheus.GaugeVec
+}
+
+// NewMemoryLimiter returns a MemoryLimiter for the provided budget, which reports usage to the
+// provided gauge when it is not nil.
+func NewMemoryLimiter(limit int64, gauge *prometheus.GaugeVec) *MemoryLimiter {
+	m := &MemoryLimiter{Limit: limit, used: make(map[string]*int64), gauge: gauge}
+	for _, c := range memoryComponents {
+		m.used[c] = new(int64)
+	}
+	return m
+}
+
+// Reserve accounts n bytes against the component if doing so does not exceed the budget.
+// It returns false, without accounting anything, when the budget would be exceeded.
+func (m *MemoryLimiter) Reserve(component string, n int64) bool {
+	if m == nil {
+		return true
+	}
+	for {
+		total := atomic.LoadInt64(&m.total)
+		if m.Limit > 0 && n > 0 && total+n > m.Limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.total, total, total+n) {
+			break
+		}
+	}
+	m.update(component, n)
+	return true
+}
+
+// Add unconditionally accounts n bytes against the component. It is used for memory that has
+// already been allocated (e.g., an upstream response body) and so can't be refused.
+func (m *MemoryLimiter) Add(component string, n int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.total, n)
+	m.update(component, n)
+}
+
+// Release returns n bytes previously accounted against the component to the budget.
+func (m *MemoryLimiter) Release(component string, n int64) {
+	m.Add(component, -n)
+}
+
+// Used returns the number of bytes currently accounted against the component,
+// or against all components when component is empty.
+func (m *MemoryLimiter) Used(component string) int64 {
+	if m == nil {
+		return 0
+	}
+	if component == "" {
+		return atomic.LoadInt64(&m.total)
+	}
+	if u, ok := m.used[component]; ok {
+		return atomic.LoadInt64(u)
+	}
+	return 0
+}
+
+// Exceeded returns true if a budget is configured and current usage has reached it.
+func (m *MemoryLimiter) Exceeded() bool {
+	return m != nil && m.Limit > 0 && atomic.LoadInt64(&m.total) >= m.Limit
+}
+
+func (m *MemoryLimiter) update(component string, n int64) {
+	u, ok := m.used[component]
+	if !ok {
+		return
+	}
+	v := atomic.AddInt64(u, n)
+	if m.gauge != nil {
+		m.gauge.WithLabelValues(component).Set(float64(v))
+	}
+}
+
+// withMemoryLimit wraps a handler so that requests are refused with a 503 and a Retry-After header
+// while the global memory budget is exhausted, rather than allowing the process to grow until it is OOMKilled.
+func (t *TricksterHandler) withMemoryLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t.MemoryLimiter.Exceeded() {
+			w.Header().Set(hnCacheControl, hvNoCache)
+			w.Header().Set(hnRetryAfter, strconv.Itoa(t.Config.Main.MemoryRetryAfterSecs))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
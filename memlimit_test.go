@@ -0,0 +1,125 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemoryLimiter_Reserve(t *testing.T) {
+	m := NewMemoryLimiter(100, nil)
+
+	// it should accept reservations within the budget
+	if !m.Reserve(mcCache, 60) {
+		t.Errorf("expected reservation of 60 bytes to succeed")
+	}
+
+	// it should refuse reservations beyond the budget
+	if m.Reserve(mcCache, 50) {
+		t.Errorf("expected reservation of 50 bytes to fail")
+	}
+	if m.Used("") != 60 {
+		t.Errorf("wanted %d got %d", 60, m.Used(""))
+	}
+
+	// it should account unconditional additions per component
+	m.Add(mcBuffers, 40)
+	if !m.Exceeded() {
+		t.Errorf("expected budget to be exceeded")
+	}
+	if m.Used(mcBuffers) != 40 {
+		t.Errorf("wanted %d got %d", 40, m.Used(mcBuffers))
+	}
+
+	m.Release(mcBuffers, 40)
+	if m.Exceeded() {
+		t.Errorf("expected budget not to be exceeded")
+	}
+}
+
+func TestMemoryLimiter_Unlimited(t *testing.T) {
+	var m *MemoryLimiter
+
+	// a nil limiter should never refuse
+	if !m.Reserve(mcCache, 1<<40) || m.Exceeded() {
+		t.Errorf("expected nil limiter to be unlimited")
+	}
+
+	m = NewMemoryLimiter(0, nil)
+	if !m.Reserve(mcCache, 1<<40) || m.Exceeded() {
+		t.Errorf("expected zero limit to be unlimited")
+	}
+}
+
+func TestMemoryCache_StoreOverBudget(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.T.MemoryLimiter = NewMemoryLimiter(20, nil)
+	mc.Connect()
+
+	// it should account the key and value bytes
+	if err := mc.Store("cacheKey", "data", 60000); err != nil {
+		t.Error(err)
+	}
+	if mc.T.MemoryLimiter.Used(mcCache) != 12 {
+		t.Errorf("wanted %d got %d", 12, mc.T.MemoryLimiter.Used(mcCache))
+	}
+
+	// it should refuse a store that would exceed the budget
+	if err := mc.Store("cacheKey2", "more data", 60000); err == nil {
+		t.Errorf("expected error storing beyond memory budget")
+	}
+
+	// it should release the bytes of replaced records
+	if err := mc.Store("cacheKey", "dat", 60000); err != nil {
+		t.Error(err)
+	}
+	if mc.T.MemoryLimiter.Used(mcCache) != 11 {
+		t.Errorf("wanted %d got %d", 11, mc.T.MemoryLimiter.Used(mcCache))
+	}
+
+	// it should release the bytes of reaped records
+	mc.Store("cacheKey", "dat", -1000)
+	mc.ReapOnce()
+	if mc.T.MemoryLimiter.Used(mcCache) != 0 {
+		t.Errorf("wanted %d got %d", 0, mc.T.MemoryLimiter.Used(mcCache))
+	}
+}
+
+func TestTricksterHandler_withMemoryLimit(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tr.MemoryLimiter = NewMemoryLimiter(10, nil)
+	h := tr.withMemoryLimit(tr.pingHandler)
+
+	// it should pass requests through while under budget
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "http://trickster/ping", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Result().StatusCode)
+	}
+
+	// it should refuse requests with a Retry-After once the budget is exhausted
+	tr.MemoryLimiter.Add(mcBuffers, 10)
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "http://trickster/ping", nil))
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, w.Result().StatusCode)
+	}
+	if w.Result().Header.Get(hnRetryAfter) != "5" {
+		t.Errorf("wanted Retry-After %q got %q.", "5", w.Result().Header.Get(hnRetryAfter))
+	}
+}
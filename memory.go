@@ -15,16 +15,29 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log/level"
 )
 
+// defaultMemoryCacheShards is the number of shards used when cache.memory.shards is not set
+const defaultMemoryCacheShards = 64
+
 // MemoryCache defines a a Memory Cache client that conforms to the Cache interface
 type MemoryCache struct {
-	T      *TricksterHandler
-	client sync.Map
+	T *TricksterHandler
+	// shards partition the records by key hash, each with its own lock, so that concurrent requests for
+	// different keys rarely contend
+	shards []*memoryCacheShard
+}
+
+// memoryCacheShard holds the records for one partition of the Memory Cache keyspace
+type memoryCacheShard struct {
+	// mtx guards records, and serializes replacement and removal of records so that memory accounting stays byte-precise
+	mtx     sync.RWMutex
+	records map[string]CacheObject
 }
 
 // CacheObject represents a Cached object as stored in the Memory Cache
@@ -36,27 +49,82 @@ type CacheObject struct {
 
 // Connect initializes the MemoryCache
 func (c *MemoryCache) Connect() error {
-	level.Info(c.T.Logger).Log("event", "memorycache setup")
-	c.client = sync.Map{}
+	n := c.T.Config.Caching.Memory.Shards
+	if n <= 0 {
+		n = defaultMemoryCacheShards
+	}
+	level.Info(c.T.Logger).Log("event", "memorycache setup", "shards", n)
+	c.shards = make([]*memoryCacheShard, n)
+	for i := range c.shards {
+		c.shards[i] = &memoryCacheShard{records: make(map[string]CacheObject)}
+	}
 	go c.Reap()
 	return nil
 }
 
+// shard returns the shard holding the provided key
+func (c *MemoryCache) shard(cacheKey string) *memoryCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(cacheKey))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
 // Store places an object in the cache using the specified key and ttl
 func (c *MemoryCache) Store(cacheKey string, data string, ttl int64) error {
 	level.Debug(c.T.Logger).Log("event", "memorycache cache store", "key", cacheKey)
-	c.client.Store(cacheKey, CacheObject{Key: cacheKey, Value: data, Expiration: time.Now().Unix() + ttl})
+	o := CacheObject{Key: cacheKey, Value: data, Expiration: time.Now().Unix() + ttl}
+	s := c.shard(cacheKey)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// only the difference in size is reserved when replacing an existing record
+	delta := o.size()
+	if prev, loaded := s.records[cacheKey]; loaded {
+		delta -= prev.size()
+	}
+	if !c.T.MemoryLimiter.Reserve(mcCache, delta) {
+		return fmt.Errorf("memory budget exceeded storing key [%s]", cacheKey)
+	}
+	s.records[cacheKey] = o
 	return nil
 }
 
 // Retrieve looks for an object in cache and returns it (or an error if not found)
 func (c *MemoryCache) Retrieve(cacheKey string) (string, error) {
-	record, ok := c.client.Load(cacheKey)
+	s := c.shard(cacheKey)
+	s.mtx.RLock()
+	record, ok := s.records[cacheKey]
+	s.mtx.RUnlock()
 	if ok {
 		level.Debug(c.T.Logger).Log("event", "memorycache cache retrieve", "key", cacheKey)
-		return record.(CacheObject).Value, nil
+		return record.Value, nil
 	}
-	return "", fmt.Errorf("Value  for key [%s] not in cache", cacheKey)
+	return "", &cacheMissError{key: cacheKey}
+}
+
+// Expiration returns the unix time at which an object in the cache expires
+func (c *MemoryCache) Expiration(cacheKey string) (int64, error) {
+	s := c.shard(cacheKey)
+	s.mtx.RLock()
+	record, ok := s.records[cacheKey]
+	s.mtx.RUnlock()
+	if !ok {
+		return 0, &cacheMissError{key: cacheKey}
+	}
+	return record.Expiration, nil
+}
+
+// Delete removes an object from the cache, if present
+func (c *MemoryCache) Delete(cacheKey string) error {
+	level.Debug(c.T.Logger).Log("event", "memorycache cache delete", "key", cacheKey)
+
+	s := c.shard(cacheKey)
+	s.mtx.Lock()
+	if current, ok := s.records[cacheKey]; ok {
+		delete(s.records, cacheKey)
+		c.T.MemoryLimiter.Release(mcCache, current.size())
+	}
+	s.mtx.Unlock()
+	return nil
 }
 
 // Reap continually iterates through the cache to find expired elements and removes them
@@ -71,13 +139,29 @@ func (c *MemoryCache) Reap() {
 func (c *MemoryCache) ReapOnce() {
 	now := time.Now().Unix()
 
-	c.client.Range(func(k, value interface{}) bool {
-		if value.(CacheObject).Expiration < now {
-			key := k.(string)
+	for _, s := range c.shards {
+		// find the expired keys under the read lock, so the shard is only locked exclusively for removals
+		var expired []string
+		s.mtx.RLock()
+		for key, o := range s.records {
+			if o.Expiration < now {
+				expired = append(expired, key)
+			}
+		}
+		s.mtx.RUnlock()
+
+		for _, key := range expired {
 			level.Debug(c.T.Logger).Log("event", "memorycache cache reap", "key", key)
 
 			c.T.ChannelCreateMtx.Lock()
-			c.client.Delete(k)
+			s.mtx.Lock()
+			// the record may have been replaced since it was found, so account for what is actually removed
+			if current, ok := s.records[key]; ok && current.Expiration < now {
+				delete(s.records, key)
+				c.T.MemoryLimiter.Release(mcCache, current.size())
+				c.T.CacheEvents.emit(cacheEvent{Type: ceExpire, Key: key})
+			}
+			s.mtx.Unlock()
 
 			// Close out the channel if it exists
 			if _, ok := c.T.ResponseChannels[key]; ok {
@@ -87,8 +171,35 @@ func (c *MemoryCache) ReapOnce() {
 
 			c.T.ChannelCreateMtx.Unlock()
 		}
-		return true
-	})
+	}
+}
+
+// Walk calls fn for each unexpired record in the cache, stopping at the first error
+func (c *MemoryCache) Walk(fn func(CacheObject) error) error {
+	now := time.Now().Unix()
+	for _, s := range c.shards {
+		// copy the shard's records so that fn is not called with the shard locked
+		s.mtx.RLock()
+		records := make([]CacheObject, 0, len(s.records))
+		for _, o := range s.records {
+			if o.Expiration >= now {
+				records = append(records, o)
+			}
+		}
+		s.mtx.RUnlock()
+
+		for _, o := range records {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// size returns the number of bytes the CacheObject accounts against the memory budget
+func (o CacheObject) size() int64 {
+	return int64(len(o.Key) + len(o.Value))
 }
 
 // Close is not used for MemoryCache, and is here to fully prototype the Cache Interface
@@ -14,7 +14,9 @@
 package main
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 )
@@ -78,6 +80,34 @@ func TestMemoryCache_Retrieve(t *testing.T) {
 	}
 }
 
+func TestMemoryCache_Expiration(t *testing.T) {
+	mc := setupMemoryCache()
+
+	err := mc.Connect()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should report a miss for an absent key
+	if _, err := mc.Expiration("cacheKey"); !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+
+	err = mc.Store("cacheKey", "data", 60)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should return the expiration of a stored value
+	exp, err := mc.Expiration("cacheKey")
+	if err != nil {
+		t.Error(err)
+	}
+	if now := time.Now().Unix(); exp < now+59 || exp > now+60 {
+		t.Errorf("wanted %d got %d.", now+60, exp)
+	}
+}
+
 func TestMemoryCache_ReapOnce(t *testing.T) {
 	mc := setupMemoryCache()
 
@@ -101,7 +131,96 @@ func TestMemoryCache_ReapOnce(t *testing.T) {
 	}
 }
 
+func TestMemoryCache_Delete(t *testing.T) {
+	mc := setupMemoryCache()
+
+	err := mc.Connect()
+	if err != nil {
+		t.Error(err)
+	}
+	mc.Store("cacheKey", "data", 60)
+
+	// a range request may be queued for the key
+	ch := make(chan *ClientRequestContext, 100)
+	mc.T.ResponseChannels["cacheKey"] = ch
+
+	// it should remove the record, leaving the response channel to its handler
+	if err := mc.Delete("cacheKey"); err != nil {
+		t.Error(err)
+	}
+	if _, err := mc.Retrieve("cacheKey"); err == nil {
+		t.Errorf("expected a cache miss")
+	}
+	if mc.T.ResponseChannels["cacheKey"] != ch {
+		t.Errorf("expected response channel to be kept")
+	}
+	ch <- nil
+}
+
 func TestMemoryCache_Close(t *testing.T) {
 	mc := setupMemoryCache()
 	mc.Close()
 }
+
+func TestMemoryCache_Shards(t *testing.T) {
+	mc := setupMemoryCache()
+	mc.T.Config.Caching.Memory.Shards = 8
+
+	err := mc.Connect()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should create the configured number of shards
+	if len(mc.shards) != 8 {
+		t.Errorf("wanted %d got %d.", 8, len(mc.shards))
+	}
+
+	for i := 0; i < 100; i++ {
+		mc.Store(fmt.Sprintf("key%d", i), "data", 60000)
+	}
+
+	// it should spread keys across the shards
+	total := 0
+	for i, s := range mc.shards {
+		if len(s.records) == 0 {
+			t.Errorf("expected shard %d to hold records", i)
+		}
+		total += len(s.records)
+	}
+	if total != 100 {
+		t.Errorf("wanted %d got %d.", 100, total)
+	}
+
+	// it should always find a key in the same shard
+	for i := 0; i < 100; i++ {
+		if _, err := mc.Retrieve(fmt.Sprintf("key%d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func BenchmarkMemoryCache_Parallel(b *testing.B) {
+	mc := setupMemoryCache()
+	mc.Connect()
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		mc.Store(keys[i], "data", 60000)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%4 == 0 {
+				mc.Store(key, "data", 60000)
+			} else {
+				mc.Retrieve(key)
+			}
+			i++
+		}
+	})
+}
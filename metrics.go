@@ -18,6 +18,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"runtime"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -31,13 +32,83 @@ type ApplicationMetrics struct {
 	CacheRequestStatus   *prometheus.CounterVec
 	CacheRequestElements *prometheus.CounterVec
 	ProxyRequestDuration *prometheus.HistogramVec
+	MemoryResidentBytes  *prometheus.GaugeVec
+	MemoryLimitBytes     prometheus.Gauge
+	OriginClockOffset    *prometheus.GaugeVec
+	BypassMode           prometheus.Gauge
+	BuildInfo            prometheus.Gauge
+
+	CacheCompactionReclaimedBytes *prometheus.CounterVec
+	CacheCorruptRecords           *prometheus.CounterVec
+	CacheWriteQueueLength         prometheus.Gauge
+	CacheWritesDropped            prometheus.Counter
+	ParseDuration                 *prometheus.HistogramVec
+	FidelityChecks                *prometheus.CounterVec
+	OriginConnections             *prometheus.CounterVec
+	HedgedRequests                *prometheus.CounterVec
+	Errors                        *prometheus.CounterVec
+	Panics                        *prometheus.CounterVec
+	TLSCertificateExpiry          *prometheus.GaugeVec
+	WriteInvalidatedRecords       prometheus.Counter
+	CacheHandoffRecords           *prometheus.CounterVec
+	RequestsShed                  *prometheus.CounterVec
+	InFlightRequests              prometheus.Gauge
+	UpstreamQueueDepth            prometheus.Gauge
+	RequestsWaiting               *prometheus.GaugeVec
+	CacheEvents                   *prometheus.CounterVec
+	CacheEventsDropped            *prometheus.CounterVec
+	CacheInvalidations            *prometheus.CounterVec
+	ControlCommands               *prometheus.CounterVec
+	OriginReplicas                *prometheus.GaugeVec
+	GRPCRequests                  *prometheus.CounterVec
+	CacheTierReads                *prometheus.CounterVec
+	CacheTierReadDuration         *prometheus.HistogramVec
+	CacheHedgedReads              prometheus.Counter
+	CacheLockWaits                *prometheus.CounterVec
+	CacheStaleServes              *prometheus.CounterVec
+
+	// registerer is the registerer the metrics were registered with, which applies any configured constant labels
+	registerer prometheus.Registerer
 }
 
 // Unregister removes registered metrics from the Prometheus metrics instrumentation.
 func (metrics ApplicationMetrics) Unregister() {
-	prometheus.Unregister(metrics.CacheRequestStatus)
-	prometheus.Unregister(metrics.CacheRequestElements)
-	prometheus.Unregister(metrics.ProxyRequestDuration)
+	metrics.registerer.Unregister(metrics.CacheRequestStatus)
+	metrics.registerer.Unregister(metrics.CacheRequestElements)
+	metrics.registerer.Unregister(metrics.ProxyRequestDuration)
+	metrics.registerer.Unregister(metrics.MemoryResidentBytes)
+	metrics.registerer.Unregister(metrics.MemoryLimitBytes)
+	metrics.registerer.Unregister(metrics.OriginClockOffset)
+	metrics.registerer.Unregister(metrics.BypassMode)
+	metrics.registerer.Unregister(metrics.BuildInfo)
+	metrics.registerer.Unregister(metrics.CacheCompactionReclaimedBytes)
+	metrics.registerer.Unregister(metrics.CacheCorruptRecords)
+	metrics.registerer.Unregister(metrics.CacheWriteQueueLength)
+	metrics.registerer.Unregister(metrics.CacheWritesDropped)
+	metrics.registerer.Unregister(metrics.ParseDuration)
+	metrics.registerer.Unregister(metrics.FidelityChecks)
+	metrics.registerer.Unregister(metrics.OriginConnections)
+	metrics.registerer.Unregister(metrics.HedgedRequests)
+	metrics.registerer.Unregister(metrics.Errors)
+	metrics.registerer.Unregister(metrics.Panics)
+	metrics.registerer.Unregister(metrics.TLSCertificateExpiry)
+	metrics.registerer.Unregister(metrics.WriteInvalidatedRecords)
+	metrics.registerer.Unregister(metrics.CacheHandoffRecords)
+	metrics.registerer.Unregister(metrics.RequestsShed)
+	metrics.registerer.Unregister(metrics.InFlightRequests)
+	metrics.registerer.Unregister(metrics.UpstreamQueueDepth)
+	metrics.registerer.Unregister(metrics.RequestsWaiting)
+	metrics.registerer.Unregister(metrics.CacheEvents)
+	metrics.registerer.Unregister(metrics.CacheEventsDropped)
+	metrics.registerer.Unregister(metrics.CacheInvalidations)
+	metrics.registerer.Unregister(metrics.ControlCommands)
+	metrics.registerer.Unregister(metrics.OriginReplicas)
+	metrics.registerer.Unregister(metrics.GRPCRequests)
+	metrics.registerer.Unregister(metrics.CacheTierReads)
+	metrics.registerer.Unregister(metrics.CacheTierReadDuration)
+	metrics.registerer.Unregister(metrics.CacheHedgedReads)
+	metrics.registerer.Unregister(metrics.CacheLockWaits)
+	metrics.registerer.Unregister(metrics.CacheStaleServes)
 }
 
 // ListenAndServe Starts the HTTP Server for Prometheus Scraping
@@ -58,8 +129,23 @@ func (metrics ApplicationMetrics) ListenAndServe(config *Config, logger log.Logg
 }
 
 // NewApplicationMetrics returns a ApplicationMetrics object and instantiates an HTTP server for polling them.
-func NewApplicationMetrics() *ApplicationMetrics {
+func NewApplicationMetrics(c *Config) *ApplicationMetrics {
+	return newApplicationMetrics(c, prometheus.DefaultRegisterer)
+}
+
+// newApplicationMetrics returns a ApplicationMetrics object registered with the provided registerer
+func newApplicationMetrics(c *Config, registerer prometheus.Registerer) *ApplicationMetrics {
+	instanceID := fmt.Sprint(c.Main.InstanceID)
+
+	buildLabels := prometheus.Labels{"version": applicationVersion, "commit": applicationCommit, "goversion": runtime.Version()}
+	if c.Metrics.InstanceIDLabel {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"instance_id": instanceID}, registerer)
+	} else {
+		buildLabels["instance_id"] = instanceID
+	}
+
 	metrics := ApplicationMetrics{
+		registerer: registerer,
 		CacheRequestStatus: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "trickster_requests_total",
@@ -82,11 +168,286 @@ func NewApplicationMetrics() *ApplicationMetrics {
 			},
 			[]string{"origin", "origin_type", "method", "status", "http_status"},
 		),
+		MemoryResidentBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_memory_resident_bytes",
+				Help: "Number of bytes currently accounted against the global memory budget.",
+			},
+			[]string{"component"},
+		),
+		MemoryLimitBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "trickster_memory_limit_bytes",
+				Help: "The configured global memory budget in bytes. 0 is unlimited.",
+			},
+		),
+		OriginClockOffset: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_origin_clock_offset_seconds",
+				Help: "Moving average of the offset between the origin's clock (per its Date header) and Trickster's clock.",
+			},
+			[]string{"origin"},
+		),
+		BypassMode: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "trickster_bypass_mode",
+				Help: "1 when Trickster is in bypass mode, proxying all requests without caching, and 0 otherwise.",
+			},
+		),
+		BuildInfo: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "trickster_build_info",
+				Help:        "Always 1, labeled with the version, commit and Go version Trickster was built with, and its instance ID.",
+				ConstLabels: buildLabels,
+			},
+		),
+		CacheCompactionReclaimedBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_compaction_reclaimed_bytes_total",
+				Help: "Count of bytes returned to the filesystem by compacting the cache.",
+			},
+			[]string{"cache_type"},
+		),
+		CacheCorruptRecords: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_corrupt_records_total",
+				Help: "Count of cache records that failed checksum verification and were discarded.",
+			},
+			[]string{"cache_type"},
+		),
+		CacheWriteQueueLength: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "trickster_cache_write_queue_length",
+				Help: "Number of cache writes waiting in the background write queue.",
+			},
+		),
+		CacheWritesDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_writes_dropped_total",
+				Help: "Count of cache writes dropped because the background write queue was full.",
+			},
+		),
+		ParseDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "trickster_parse_duration_seconds",
+				Help:    "Time required in seconds to parse a Prometheus matrix from the origin or the cache.",
+				Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5},
+			},
+			[]string{"source"},
+		),
+		FidelityChecks: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_fidelity_checks_total",
+				Help: "Count of sampled comparisons of cached range query data with the origin, by result.",
+			},
+			[]string{"origin", "result"},
+		),
+		OriginConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_origin_connections_total",
+				Help: "Count of upstream requests by whether they reused a pooled connection or dialed a new one.",
+			},
+			[]string{"host", "state"},
+		),
+
+		HedgedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_origin_hedged_requests_total",
+				Help: "Count of hedged upstream requests, by whether the hedged response won the race.",
+			},
+			[]string{"host", "result"},
+		),
+
+		Errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_errors_total",
+				Help: "Count of errors fetching from origins and caches, by origin, source and class.",
+			},
+			[]string{"origin", "source", "class"},
+		),
+
+		Panics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_panics_total",
+				Help: "Count of requests whose handler panicked and was recovered, by route.",
+			},
+			[]string{"route"},
+		),
+
+		TLSCertificateExpiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_tls_certificate_expiry_timestamp_seconds",
+				Help: "Unix time at which the certificate served by a TLS listener expires, by listener and certificate path.",
+			},
+			[]string{"listener", "cert_path"},
+		),
+
+		WriteInvalidatedRecords: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "trickster_write_invalidated_records_total",
+				Help: "Count of cached query_range data sets removed because they overlapped the samples of a remote write.",
+			},
+		),
+
+		CacheHandoffRecords: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_handoff_records_total",
+				Help: "Count of cache records handed off on termination, by direction.",
+			},
+			[]string{"direction"},
+		),
+
+		RequestsShed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_requests_shed_total",
+				Help: "Count of proxied requests refused with a 503 because their class was over its share of the configured load.",
+			},
+			[]string{"class", "reason"},
+		),
+
+		InFlightRequests: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "trickster_inflight_requests",
+				Help: "Number of proxied requests currently being served.",
+			},
+		),
+
+		UpstreamQueueDepth: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "trickster_upstream_queue_depth",
+				Help: "Number of range requests currently waiting for data from the origins.",
+			},
+		),
+
+		RequestsWaiting: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_requests_waiting",
+				Help: "Number of proxied requests currently queued until their class is within its concurrency limits.",
+			},
+			[]string{"class"},
+		),
+
+		CacheEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_events_total",
+				Help: "Count of cache events emitted, by type.",
+			},
+			[]string{"type"},
+		),
+
+		CacheEventsDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_events_dropped_total",
+				Help: "Count of cache events dropped because a sink could not keep up or failed, by sink.",
+			},
+			[]string{"sink"},
+		),
+
+		CacheInvalidations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_invalidations_total",
+				Help: "Count of cache invalidation messages received, by source and status.",
+			},
+			[]string{"source", "status"},
+		),
+
+		ControlCommands: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_control_commands_total",
+				Help: "Count of commands received on the control plane channel, by command and status.",
+			},
+			[]string{"command", "status"},
+		),
+
+		OriginReplicas: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_origin_discovered_replicas",
+				Help: "Number of replicas last discovered for the origin from DNS SRV records or the Consul catalog.",
+			},
+			[]string{"origin"},
+		),
+		GRPCRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_grpc_requests_total",
+				Help: "Count of gRPC requests passed through to origins, by gRPC status.",
+			},
+			[]string{"origin", "status"},
+		),
+		CacheTierReads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_tier_reads_total",
+				Help: "Count of reads of the tiers of a tiered cache, by result.",
+			},
+			[]string{"tier", "result"},
+		),
+		CacheTierReadDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "trickster_cache_tier_read_duration_seconds",
+				Help:    "Time required in seconds to read a record from a tier of a tiered cache.",
+				Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5},
+			},
+			[]string{"tier"},
+		),
+		CacheHedgedReads: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_hedged_reads_total",
+				Help: "Count of L2 cache reads raced with an L1 cache read that had not hit within the hedge delay.",
+			},
+		),
+		CacheLockWaits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_lock_waits_total",
+				Help: "Count of requests for a missing record that waited for another request fetching it.",
+			},
+			[]string{"origin", "result"},
+		),
+		CacheStaleServes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_stale_serves_total",
+				Help: "Count of expired records served while another request refreshed them.",
+			},
+			[]string{"origin"},
+		),
 	}
 
-	prometheus.MustRegister(metrics.CacheRequestStatus)
-	prometheus.MustRegister(metrics.CacheRequestElements)
-	prometheus.MustRegister(metrics.ProxyRequestDuration)
+	metrics.registerer.MustRegister(metrics.CacheRequestStatus)
+	metrics.registerer.MustRegister(metrics.CacheRequestElements)
+	metrics.registerer.MustRegister(metrics.ProxyRequestDuration)
+	metrics.registerer.MustRegister(metrics.MemoryResidentBytes)
+	metrics.registerer.MustRegister(metrics.MemoryLimitBytes)
+	metrics.registerer.MustRegister(metrics.OriginClockOffset)
+	metrics.registerer.MustRegister(metrics.BypassMode)
+	metrics.registerer.MustRegister(metrics.BuildInfo)
+	metrics.registerer.MustRegister(metrics.CacheCompactionReclaimedBytes)
+	metrics.registerer.MustRegister(metrics.CacheCorruptRecords)
+	metrics.registerer.MustRegister(metrics.CacheWriteQueueLength)
+	metrics.registerer.MustRegister(metrics.CacheWritesDropped)
+	metrics.registerer.MustRegister(metrics.ParseDuration)
+	metrics.registerer.MustRegister(metrics.FidelityChecks)
+	metrics.registerer.MustRegister(metrics.OriginConnections)
+	metrics.registerer.MustRegister(metrics.HedgedRequests)
+	metrics.registerer.MustRegister(metrics.Errors)
+	metrics.registerer.MustRegister(metrics.Panics)
+	metrics.registerer.MustRegister(metrics.TLSCertificateExpiry)
+	metrics.registerer.MustRegister(metrics.WriteInvalidatedRecords)
+	metrics.registerer.MustRegister(metrics.CacheHandoffRecords)
+	metrics.registerer.MustRegister(metrics.RequestsShed)
+	metrics.registerer.MustRegister(metrics.InFlightRequests)
+	metrics.registerer.MustRegister(metrics.UpstreamQueueDepth)
+	metrics.registerer.MustRegister(metrics.RequestsWaiting)
+	metrics.registerer.MustRegister(metrics.CacheEvents)
+	metrics.registerer.MustRegister(metrics.CacheEventsDropped)
+	metrics.registerer.MustRegister(metrics.CacheInvalidations)
+	metrics.registerer.MustRegister(metrics.ControlCommands)
+	metrics.registerer.MustRegister(metrics.OriginReplicas)
+	metrics.registerer.MustRegister(metrics.GRPCRequests)
+	metrics.registerer.MustRegister(metrics.CacheTierReads)
+	metrics.registerer.MustRegister(metrics.CacheTierReadDuration)
+	metrics.registerer.MustRegister(metrics.CacheHedgedReads)
+	metrics.registerer.MustRegister(metrics.CacheLockWaits)
+	metrics.registerer.MustRegister(metrics.CacheStaleServes)
+
+	metrics.BuildInfo.Set(1)
 
 	return &metrics
 }
@@ -0,0 +1,66 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricLabels returns the labels of the first sample of the named metric in the registry
+func metricLabels(t *testing.T, g prometheus.Gatherer, name string) map[string]string {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name && len(mf.Metric) > 0 {
+			labels := make(map[string]string)
+			for _, lp := range mf.Metric[0].Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			return labels
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return nil
+}
+
+func TestNewApplicationMetrics_instanceIDLabel(t *testing.T) {
+	c := NewConfig()
+	c.Main.InstanceID = 2
+
+	// it should label the build info with the instance id
+	reg := prometheus.NewRegistry()
+	newApplicationMetrics(c, reg)
+	labels := metricLabels(t, reg, "trickster_build_info")
+	if labels["instance_id"] != "2" || labels["version"] != applicationVersion {
+		t.Errorf("unexpected build info labels %v", labels)
+	}
+	if _, ok := metricLabels(t, reg, "trickster_memory_limit_bytes")["instance_id"]; ok {
+		t.Errorf("did not expect an instance_id label")
+	}
+
+	// it should label all metrics with the instance id when configured to
+	c.Metrics.InstanceIDLabel = true
+	reg = prometheus.NewRegistry()
+	newApplicationMetrics(c, reg)
+	if metricLabels(t, reg, "trickster_memory_limit_bytes")["instance_id"] != "2" {
+		t.Errorf("expected an instance_id label")
+	}
+	if metricLabels(t, reg, "trickster_build_info")["instance_id"] != "2" {
+		t.Errorf("expected an instance_id label")
+	}
+}
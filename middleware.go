@@ -0,0 +1,131 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// Middleware names
+	mwListenerOrigins = "listener_origins"
+	mwUnmatchedOrigin = "unmatched_origin"
+	mwScripts         = "scripts"
+	mwResponseHeaders = "response_headers"
+	mwMemoryLimit     = "memory_limit"
+	mwLoadShedding    = "load_shedding"
+	mwTimeoutBudget   = "timeout_budget"
+)
+
+// defaultMiddlewares is the middleware chain of proxied routes, outermost first, when none is configured
+var defaultMiddlewares = []string{mwListenerOrigins, mwUnmatchedOrigin, mwScripts, mwResponseHeaders, mwMemoryLimit,
+	mwLoadShedding, mwTimeoutBudget}
+
+// middleware wraps a handler with some behavior common to proxied routes
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// middlewares returns the middleware of each name
+func (t *TricksterHandler) middlewares() map[string]middleware {
+	return map[string]middleware{
+		mwListenerOrigins: t.withListenerOrigins,
+		mwUnmatchedOrigin: t.withUnmatchedOriginPolicy,
+		mwScripts:         t.withScripts,
+		mwResponseHeaders: t.withResponseHeaderPolicy,
+		mwMemoryLimit:     t.withMemoryLimit,
+		mwLoadShedding:    t.withLoadShedding,
+		mwTimeoutBudget:   t.withTimeoutBudget,
+	}
+}
+
+// validateMiddlewares returns an error if the proxy server's middleware chain or an origin's disabled middlewares
+// name an unknown middleware, or the chain names one twice
+func (c *Config) validateMiddlewares() error {
+	seen := map[string]bool{}
+	for _, name := range c.ProxyServer.Middlewares {
+		if !validMiddleware(name) {
+			return fmt.Errorf("proxy_server: unknown middleware %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("proxy_server: middleware %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	for name, o := range c.Origins {
+		for _, mw := range o.DisabledMiddlewares {
+			if !validMiddleware(mw) {
+				return fmt.Errorf("origin %q: unknown middleware %q", name, mw)
+			}
+		}
+	}
+	return nil
+}
+
+// validMiddleware returns true if name is the name of a middleware
+func validMiddleware(name string) bool {
+	for _, mw := range defaultMiddlewares {
+		if name == mw {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareChain returns the configured middleware chain of proxied routes, outermost first
+func (c ProxyServerConfig) middlewareChain() []string {
+	if c.Middlewares == nil {
+		return defaultMiddlewares
+	}
+	return c.Middlewares
+}
+
+// disablesMiddleware returns true if the origin's requests skip the middleware
+func (o PrometheusOriginConfig) disablesMiddleware(name string) bool {
+	for _, mw := range o.DisabledMiddlewares {
+		if mw == name {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyHandler wraps a handler that serves origin data with the configured middleware chain common to all proxied
+// routes
+func (t *TricksterHandler) proxyHandler(next http.HandlerFunc) http.HandlerFunc {
+	middlewares := t.middlewares()
+	chain := t.Config.ProxyServer.middlewareChain()
+	for i := len(chain) - 1; i >= 0; i-- {
+		next = t.withOriginMiddleware(chain[i], middlewares[chain[i]], next)
+	}
+	return next
+}
+
+// withOriginMiddleware wraps a handler with the middleware, except for the requests of origins that disable it
+func (t *TricksterHandler) withOriginMiddleware(name string, m middleware, next http.HandlerFunc) http.HandlerFunc {
+	wrapped := m(next)
+	disabled := false
+	for _, o := range t.Config.Origins {
+		disabled = disabled || o.disablesMiddleware(name)
+	}
+	if !disabled {
+		return wrapped
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t.getOrigin(r).disablesMiddleware(name) {
+			next(w, r)
+			return
+		}
+		wrapped(w, r)
+	}
+}
@@ -0,0 +1,84 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfig_validateMiddlewares(t *testing.T) {
+	tests := []struct {
+		middlewares []string
+		disabled    []string
+		valid       bool
+	}{
+		{nil, nil, true},
+		{[]string{}, nil, true},
+		{[]string{mwLoadShedding, mwListenerOrigins}, []string{mwLoadShedding}, true},
+		{[]string{"auth"}, nil, false},
+		{[]string{mwMemoryLimit, mwMemoryLimit}, nil, false},
+		{nil, []string{"trace"}, false},
+	}
+	for i, test := range tests {
+		c := NewConfig()
+		c.ProxyServer.Middlewares = test.middlewares
+		c.Origins["default"] = PrometheusOriginConfig{DisabledMiddlewares: test.disabled}
+		if err := c.validateMiddlewares(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTricksterHandler_proxyHandler_middlewares(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	handled := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		w.WriteHeader(http.StatusOK)
+	}
+	serve := func() int {
+		handled = false
+		w := httptest.NewRecorder()
+		tr.proxyHandler(next)(w, httptest.NewRequest("GET", "http://trickster/api/v1/labels", nil))
+		return w.Code
+	}
+
+	// the memory budget is exhausted, so that the memory limit middleware refuses requests
+	tr.MemoryLimiter = NewMemoryLimiter(1, nil)
+	tr.MemoryLimiter.Add(mcCache, 2)
+
+	// it should apply the default chain
+	if code := serve(); code != http.StatusServiceUnavailable || handled {
+		t.Errorf("unexpected result %d %t", code, handled)
+	}
+
+	// it should skip the middlewares left out of the configured chain
+	tr.Config.ProxyServer.Middlewares = []string{mwListenerOrigins, mwTimeoutBudget}
+	if code := serve(); code != http.StatusOK || !handled {
+		t.Errorf("unexpected result %d %t", code, handled)
+	}
+
+	// it should skip the middlewares disabled by the origin
+	tr.Config.ProxyServer.Middlewares = nil
+	o := tr.Config.Origins["default"]
+	o.DisabledMiddlewares = []string{mwMemoryLimit}
+	tr.Config.Origins["default"] = o
+	if code := serve(); code != http.StatusOK || !handled {
+		t.Errorf("unexpected result %d %t", code, handled)
+	}
+}
@@ -55,12 +55,21 @@ type ClientRequestContext struct {
 	Origin             PrometheusOriginConfig
 	RequestParams      url.Values
 	RequestExtents     MatrixExtents
+	CacheExtents       MatrixExtents
 	OriginUpperExtents MatrixExtents
 	OriginLowerExtents MatrixExtents
 	StepParam          string
 	StepMS             int64
+	ResponseStepMS     int64
 	Time               int64
+	Pinned             bool
 	WaitGroup          sync.WaitGroup
+
+	// RefreshLock, when set, unlocks the expired cache record that the request refreshes, once it is stored
+	RefreshLock func()
+
+	// Diagnostics describes how the request was fulfilled, once it has been
+	Diagnostics http.Header
 }
 
 // MatrixExtents describes the start and end epoch times (in ms) for a given range of data
@@ -0,0 +1,149 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	defaultObjectTTLSecs         = 5
+	defaultObjectNegativeTTLSecs = 2
+)
+
+// defaultObjectCachePaths are the status endpoints that dashboards and status pages poll continuously
+var defaultObjectCachePaths = []string{"/api/v1/alertmanagers", "/api/v2/alerts"}
+
+// ObjectCacheConfig describes the proxied paths of an origin whose responses are cached whole, for a short time, such
+// as the Alertmanager discovery and alerts endpoints
+type ObjectCacheConfig struct {
+	// Enabled caches the GET responses of the Paths
+	Enabled bool `toml:"enabled"`
+	// Paths lists request paths, following the origin moniker, whose responses are cached. A trailing '*' matches any
+	// path with that prefix. Default is ['/api/v1/alertmanagers', '/api/v2/alerts']
+	Paths []string `toml:"paths"`
+	// TTLSecs is the time to live of cached 200 responses. Default is 5
+	TTLSecs int64 `toml:"ttl_secs"`
+	// NegativeTTLSecs is the time to live of cached 4xx and 5xx responses, so that a failing origin is not polled
+	// more often. Default is 2
+	NegativeTTLSecs int64 `toml:"negative_ttl_secs"`
+}
+
+// cachedObject is a proxied response, as stored in the cache
+type cachedObject struct {
+	StatusCode  int    `json:"code"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// caches returns true if the responses to GET requests for the path are cached
+func (c ObjectCacheConfig) caches(method, path string) bool {
+	if !c.Enabled || method != http.MethodGet {
+		return false
+	}
+	paths := c.Paths
+	if len(paths) == 0 {
+		paths = defaultObjectCachePaths
+	}
+	for _, p := range paths {
+		if p == path || (strings.HasSuffix(p, "*") && strings.HasPrefix(path, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// ttl returns the number of seconds a response with the status code is cached. 0 means it is not cached.
+func (c ObjectCacheConfig) ttl(code int) int64 {
+	switch {
+	case code == http.StatusOK:
+		if c.TTLSecs > 0 {
+			return c.TTLSecs
+		}
+		return defaultObjectTTLSecs
+	case code >= http.StatusBadRequest:
+		if c.NegativeTTLSecs > 0 {
+			return c.NegativeTTLSecs
+		}
+		return defaultObjectNegativeTTLSecs
+	}
+	return 0
+}
+
+// validate returns an error if a time to live is negative
+func (c ObjectCacheConfig) validate() error {
+	if c.TTLSecs < 0 || c.NegativeTTLSecs < 0 {
+		return fmt.Errorf("object_cache: ttls must not be negative")
+	}
+	return nil
+}
+
+// objectCacheKey returns the cache key of the origin's response to the request for the origin url
+func (o PrometheusOriginConfig) objectCacheKey(r *http.Request, originURL string) string {
+	params := r.URL.Query()
+	if o.AllowClientRefresh {
+		params.Del(o.refreshParam())
+	}
+	return o.cacheKeyPartition(r) + deriveCacheKey(originURL+"?"+params.Encode()+o.cacheKeyScope(r), nil) + ".object"
+}
+
+// serveCachedObject responds with the cached response, returning false if there is none, or it expired, along with
+// the function to call once the response is fetched and cached
+func (t *TricksterHandler) serveCachedObject(w http.ResponseWriter, o PrometheusOriginConfig, cacheKey string) (bool, func()) {
+	data, unlock, err := t.retrieveProtected(o, cacheKey)
+	if err != nil {
+		t.countError(o, psCache, err)
+		return false, unlock
+	}
+	var co cachedObject
+	if err := json.Unmarshal([]byte(data), &co); err != nil {
+		t.countError(o, psCache, classify(ecDecode, err))
+		return false, unlock
+	}
+
+	t.countCacheResult(o.OriginURL, otPrometheus, rnProxy, crHit, co.StatusCode)
+	if co.ContentType != "" {
+		w.Header().Set(hnContentType, co.ContentType)
+	}
+	w.WriteHeader(co.StatusCode)
+	w.Write(co.Body)
+	return true, unlock
+}
+
+// cacheObject stores the origin's response, when its status code is cached
+func (t *TricksterHandler) cacheObject(o PrometheusOriginConfig, cacheKey string, body []byte, resp *http.Response) {
+	t.countCacheResult(o.OriginURL, otPrometheus, rnProxy, crKeyMiss, resp.StatusCode)
+
+	ttl := o.ObjectCache.ttl(resp.StatusCode)
+	if ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(cachedObject{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get(hnContentType),
+		Body:        body,
+	})
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error marshaling cached object", lfDetail, err.Error())
+		return
+	}
+	if err := t.Cacher.Store(cacheKey, string(data), t.Config.Caching.Stampede.storeTTL(ttl)); err != nil {
+		t.countError(o, psCache, err)
+	}
+}
@@ -0,0 +1,132 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestObjectCacheConfig_caches(t *testing.T) {
+	tests := []struct {
+		config ObjectCacheConfig
+		method string
+		path   string
+		caches bool
+	}{
+		{ObjectCacheConfig{}, http.MethodGet, "/api/v1/alertmanagers", false},
+		{ObjectCacheConfig{Enabled: true}, http.MethodGet, "/api/v1/alertmanagers", true},
+		{ObjectCacheConfig{Enabled: true}, http.MethodGet, "/api/v2/alerts", true},
+		{ObjectCacheConfig{Enabled: true}, http.MethodPost, "/api/v2/alerts", false},
+		{ObjectCacheConfig{Enabled: true}, http.MethodGet, "/api/v1/rules", false},
+		{ObjectCacheConfig{Enabled: true, Paths: []string{"/api/v1/rules"}}, http.MethodGet, "/api/v1/rules", true},
+		{ObjectCacheConfig{Enabled: true, Paths: []string{"/api/v1/rules"}}, http.MethodGet, "/api/v2/alerts", false},
+		{ObjectCacheConfig{Enabled: true, Paths: []string{"/api/v2/*"}}, http.MethodGet, "/api/v2/silences", true},
+	}
+	for i, test := range tests {
+		if caches := test.config.caches(test.method, test.path); caches != test.caches {
+			t.Errorf("test %d: unexpected result %t", i, caches)
+		}
+	}
+}
+
+func TestObjectCacheConfig_ttl(t *testing.T) {
+	tests := []struct {
+		config ObjectCacheConfig
+		code   int
+		ttl    int64
+	}{
+		{ObjectCacheConfig{}, http.StatusOK, defaultObjectTTLSecs},
+		{ObjectCacheConfig{}, http.StatusServiceUnavailable, defaultObjectNegativeTTLSecs},
+		{ObjectCacheConfig{}, http.StatusNotFound, defaultObjectNegativeTTLSecs},
+		{ObjectCacheConfig{}, http.StatusFound, 0},
+		{ObjectCacheConfig{TTLSecs: 10, NegativeTTLSecs: 1}, http.StatusOK, 10},
+		{ObjectCacheConfig{TTLSecs: 10, NegativeTTLSecs: 1}, http.StatusBadGateway, 1},
+	}
+	for i, test := range tests {
+		if ttl := test.config.ttl(test.code); ttl != test.ttl {
+			t.Errorf("test %d: unexpected result %d", i, ttl)
+		}
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_objectCache(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	requests := 0
+	status := http.StatusOK
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set(hnContentType, hvApplicationJSON)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"status":"success","path":"` + r.URL.Path + `"}`))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	get := func(path string) *http.Response {
+		w := httptest.NewRecorder()
+		tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+path, nil))
+		return w.Result()
+	}
+
+	// it should proxy every request by default
+	get("/api/v1/alertmanagers")
+	get("/api/v1/alertmanagers")
+	if requests != 2 {
+		t.Errorf("wanted %d got %d.", 2, requests)
+	}
+
+	o := tr.Config.Origins["default"]
+	o.ObjectCache.Enabled = true
+	o.AllowClientRefresh = true
+	tr.Config.Origins["default"] = o
+
+	// it should serve the cached response of a cached path
+	requests = 0
+	get("/api/v2/alerts")
+	resp := get("/api/v2/alerts")
+	if requests != 1 {
+		t.Errorf("wanted %d got %d.", 1, requests)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"status":"success","path":"/api/v2/alerts"}` {
+		t.Errorf("unexpected response %d %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get(hnContentType); ct != hvApplicationJSON {
+		t.Errorf("wanted %s got %s.", hvApplicationJSON, ct)
+	}
+
+	// it should not cache other paths
+	requests = 0
+	get("/api/v1/status/config")
+	get("/api/v1/status/config")
+	if requests != 2 {
+		t.Errorf("wanted %d got %d.", 2, requests)
+	}
+
+	// it should cache error responses
+	requests = 0
+	status = http.StatusServiceUnavailable
+	get("/api/v1/alertmanagers?trickster=refresh")
+	if resp := get("/api/v1/alertmanagers"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if requests != 1 {
+		t.Errorf("wanted %d got %d.", 1, requests)
+	}
+}
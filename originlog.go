@@ -0,0 +1,94 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+// LogSampler counts the occurrences of repetitive log events, so that only 1 of every N is logged
+type LogSampler struct {
+	mtx    sync.Mutex
+	counts map[string]int64
+}
+
+// NewLogSampler returns a new LogSampler
+func NewLogSampler() *LogSampler {
+	return &LogSampler{counts: make(map[string]int64)}
+}
+
+// sample counts an occurrence of the event and returns the number of occurrences so far, and true if this one is
+// logged: the first and then every nth. A nil LogSampler logs every occurrence.
+func (s *LogSampler) sample(event string, n int) (int64, bool) {
+	if s == nil || n <= 1 {
+		return 0, true
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.counts[event]++
+	count := s.counts[event]
+	return count, (count-1)%int64(n) == 0
+}
+
+// newOriginLoggers returns loggers that log at the levels of the origins that override the global log level, by
+// origin url, wrapping the unfiltered base logger
+func newOriginLoggers(base log.Logger, origins map[string]PrometheusOriginConfig) map[string]log.Logger {
+	loggers := make(map[string]log.Logger)
+	for _, o := range origins {
+		if o.LogLevel != "" {
+			loggers[o.OriginURL] = newLevelFilter(base, o.LogLevel)
+		}
+	}
+	return loggers
+}
+
+// originLogger returns the logger for messages about the origin, which logs at the origin's level when it overrides
+// the global log level
+func (t *TricksterHandler) originLogger(o PrometheusOriginConfig) log.Logger {
+	if l, ok := t.OriginLoggers[o.OriginURL]; ok {
+		return l
+	}
+	return t.Logger
+}
+
+// originLog returns the logger for a warning or error event about the origin, at the provided level, with the event and
+// origin fields set. Only 1 of every log_sample_rate occurrences of the event is logged, and the rest are discarded.
+func (t *TricksterHandler) originLog(o PrometheusOriginConfig, lvl func(log.Logger) log.Logger, event string) log.Logger {
+	n, ok := t.LogSampler.sample(o.OriginURL+" "+event, o.LogSampleRate)
+	if !ok {
+		return log.NewNopLogger()
+	}
+	l := log.With(lvl(t.originLogger(o)), lfEvent, event, "origin", o.OriginURL)
+	if o.LogSampleRate > 1 {
+		l = log.With(l, "occurrences", n)
+	}
+	return l
+}
+
+// validateLogging returns an error if the origin's log level is unknown, or its log sample rate is negative
+func (o PrometheusOriginConfig) validateLogging() error {
+	switch strings.ToLower(o.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unknown log_level %q", o.LogLevel)
+	}
+	if o.LogSampleRate < 0 {
+		return fmt.Errorf("log_sample_rate must not be negative")
+	}
+	return nil
+}
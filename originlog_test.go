@@ -0,0 +1,102 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestLogSampler_sample(t *testing.T) {
+	s := NewLogSampler()
+
+	// it should log the first and then every nth occurrence
+	logged := []int64{}
+	for i := 0; i < 7; i++ {
+		if n, ok := s.sample("event", 3); ok {
+			logged = append(logged, n)
+		}
+	}
+	if len(logged) != 3 || logged[0] != 1 || logged[1] != 4 || logged[2] != 7 {
+		t.Errorf("unexpected logged occurrences %v", logged)
+	}
+
+	// it should log every occurrence without sampling
+	var nilSampler *LogSampler
+	if _, ok := nilSampler.sample("event", 3); !ok {
+		t.Errorf("expected the occurrence to be logged")
+	}
+	if _, ok := s.sample("event", 0); !ok {
+		t.Errorf("expected the occurrence to be logged")
+	}
+}
+
+func TestTricksterHandler_originLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := log.NewLogfmtLogger(buf)
+
+	debugOrigin := PrometheusOriginConfig{OriginURL: "http://debug:9090", LogLevel: "debug"}
+	sampledOrigin := PrometheusOriginConfig{OriginURL: "http://sampled:9090", LogSampleRate: 2}
+	tr := &TricksterHandler{
+		Logger:        newLevelFilter(base, "error"),
+		OriginLoggers: newOriginLoggers(base, map[string]PrometheusOriginConfig{"debug": debugOrigin, "sampled": sampledOrigin}),
+		LogSampler:    NewLogSampler(),
+	}
+
+	// it should log at the origin's level
+	level.Debug(tr.originLogger(debugOrigin)).Log(lfEvent, "debugging")
+	if !strings.Contains(buf.String(), "debugging") {
+		t.Errorf("expected the debug message to be logged")
+	}
+	buf.Reset()
+	level.Warn(tr.originLogger(sampledOrigin)).Log(lfEvent, "warning")
+	if buf.Len() > 0 {
+		t.Errorf("unexpected log %q", buf.String())
+	}
+
+	// it should log 1 of every log_sample_rate occurrences, with their count
+	sampledOrigin.LogLevel = "warn"
+	tr.OriginLoggers = newOriginLoggers(base, map[string]PrometheusOriginConfig{"sampled": sampledOrigin})
+	for i := 0; i < 3; i++ {
+		tr.originLog(sampledOrigin, level.Warn, "origin health check failed").Log(lfDetail, "down")
+	}
+	if n := strings.Count(buf.String(), "origin health check failed"); n != 2 {
+		t.Errorf("wanted %d got %d.", 2, n)
+	}
+	if !strings.Contains(buf.String(), "occurrences=3") || !strings.Contains(buf.String(), "origin=http://sampled:9090") {
+		t.Errorf("unexpected log %q", buf.String())
+	}
+}
+
+func TestPrometheusOriginConfig_validateLogging(t *testing.T) {
+	tests := []struct {
+		o  PrometheusOriginConfig
+		ok bool
+	}{
+		{PrometheusOriginConfig{}, true},
+		{PrometheusOriginConfig{LogLevel: "DEBUG", LogSampleRate: 10}, true},
+		{PrometheusOriginConfig{LogLevel: "trace"}, false},
+		{PrometheusOriginConfig{LogSampleRate: -1}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.o.validateLogging(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
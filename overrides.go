@@ -0,0 +1,199 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// evOverridePrefix prefixes environment variables that override configuration options, named by the option's path
+// in upper case with underscores, e.g., TRK_ORIGINS_FOO_TIMEOUT_SECS for origins.foo.timeout_secs
+const evOverridePrefix = "TRK_"
+
+// overrideFlags collects repeated -set path=value command line flags
+type overrideFlags []string
+
+func (o *overrideFlags) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrideFlags) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+// setConfigOption sets the option at the dotted path, as named in the configuration file (e.g.,
+// origins.foo.timeout_secs), to the value. Lists are set from comma-separated values, and origins that are not yet
+// configured are added.
+func setConfigOption(c *Config, path, value string) error {
+	if err := setOption(reflect.ValueOf(c).Elem(), strings.Split(path, "."), value); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func setOption(v reflect.Value, keys []string, value string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		if len(keys) == 0 {
+			return fmt.Errorf("is a table, not an option")
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if key := v.Type().Field(i).Tag.Get("toml"); key != "" && key == keys[0] {
+				return setOption(v.Field(i), keys[1:], value)
+			}
+		}
+		return fmt.Errorf("unknown option %q", keys[0])
+	case reflect.Map:
+		if len(keys) == 0 {
+			return fmt.Errorf("is a table, not an option")
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		// map entries are not addressable, so the entry is copied, set and stored back
+		k := reflect.ValueOf(keys[0])
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if current := v.MapIndex(k); current.IsValid() {
+			elem.Set(current)
+		}
+		if err := setOption(elem, keys[1:], value); err != nil {
+			return err
+		}
+		v.SetMapIndex(k, elem)
+		return nil
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("unknown option %q", keys[0])
+	}
+	return setValue(v, value)
+}
+
+// setValue parses the value into v according to its type
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetFloat(f)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setValue(p.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Slice:
+		var items []string
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(s.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	default:
+		return fmt.Errorf("cannot be set from the command line or environment")
+	}
+	return nil
+}
+
+// envOptionPath returns the dotted path of the option that the upper case, underscore-separated tokens of an
+// environment variable name refer to in v, or false if they refer to none. Origin names are matched to the configured
+// origins regardless of case, or are taken in lower case otherwise.
+func envOptionPath(v reflect.Value, tokens []string) (string, bool) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			key := v.Type().Field(i).Tag.Get("toml")
+			n := strings.Count(key, "_") + 1
+			if key == "" || n > len(tokens) || strings.Join(tokens[:n], "_") != strings.ToUpper(key) {
+				continue
+			}
+			if rest, ok := envOptionPath(v.Field(i), tokens[n:]); ok {
+				return joinOptionPath(key, rest), true
+			}
+		}
+		return "", false
+	case reflect.Map:
+		for n := 1; n <= len(tokens); n++ {
+			name := strings.ToLower(strings.Join(tokens[:n], "_"))
+			for _, k := range v.MapKeys() {
+				if strings.EqualFold(strings.Replace(k.String(), "-", "_", -1), name) {
+					name = k.String()
+					break
+				}
+			}
+			elem := v.MapIndex(reflect.ValueOf(name))
+			if !elem.IsValid() {
+				elem = reflect.Zero(v.Type().Elem())
+			}
+			if rest, ok := envOptionPath(elem, tokens[n:]); ok {
+				return joinOptionPath(name, rest), true
+			}
+		}
+		return "", false
+	}
+	return "", len(tokens) == 0
+}
+
+func joinOptionPath(key, rest string) string {
+	if rest == "" {
+		return key
+	}
+	return key + "." + rest
+}
+
+// loadEnvOverrides sets the options named by TRK_ environment variables in environ, a list of key=value pairs as
+// returned by os.Environ. Variables that name no option are ignored.
+func loadEnvOverrides(c *Config, environ []string) error {
+	sort.Strings(environ)
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], evOverridePrefix) {
+			continue
+		}
+		tokens := strings.Split(strings.TrimPrefix(parts[0], evOverridePrefix), "_")
+		path, ok := envOptionPath(reflect.ValueOf(c).Elem(), tokens)
+		if !ok {
+			continue
+		}
+		if err := setConfigOption(c, path, parts[1]); err != nil {
+			return fmt.Errorf("%s: %v", parts[0], err)
+		}
+	}
+	return nil
+}
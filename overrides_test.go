@@ -0,0 +1,103 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetConfigOption(t *testing.T) {
+	tests := []struct {
+		path  string
+		value string
+		ok    bool
+	}{
+		{"origins.default.timeout_secs", "30", true},
+		{"origins.default.ignore_no_cache_header", "false", true},
+		{"origins.default.fidelity_check_sample_rate", "0.25", true},
+		{"origins.default.transform.clamp_min", "0", true},
+		{"origins.default.dns_pins.prometheus", "10.0.0.1", true},
+		{"origins.foo.origin_url", "http://foo:9090", true},
+		{"cache.compression_types", "query_range, query", true},
+		{"origins.default.timeout_secs", "thirty", false},
+		{"origins.default.relabel", "drop", false},
+		{"origins.default.nope", "1", false},
+		{"cache", "memory", false},
+		{"main.hostname", "localhost", false},
+	}
+
+	for i, test := range tests {
+		if err := setConfigOption(NewConfig(), test.path, test.value); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+
+	// it should set the options, adding origins that are not configured
+	c := NewConfig()
+	setConfigOption(c, "origins.default.timeout_secs", "30")
+	setConfigOption(c, "origins.default.transform.clamp_min", "0")
+	setConfigOption(c, "origins.foo.members", "a,b")
+	setConfigOption(c, "cache.compression_types", "query_range, query")
+	if v := c.Origins["default"].TimeoutSecs; v != 30 {
+		t.Errorf("wanted %d got %d.", 30, v)
+	}
+	if v := c.Origins["default"].Transform.ClampMin; v == nil || *v != 0 {
+		t.Errorf("unexpected clamp_min %v", v)
+	}
+	if v := c.Origins["default"].OriginURL; v != defaultOriginConfig().OriginURL {
+		t.Errorf("wanted %q got %q.", defaultOriginConfig().OriginURL, v)
+	}
+	if v := c.Origins["foo"].Members; !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Errorf("unexpected members %v", v)
+	}
+	if v := c.Caching.CompressionTypes; !reflect.DeepEqual(v, []string{mnQueryRange, mnQuery}) {
+		t.Errorf("unexpected compression types %v", v)
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	c := NewConfig()
+	c.Origins["my_prom"] = PrometheusOriginConfig{}
+
+	err := loadEnvOverrides(c, []string{
+		"TRK_ORIGINS_FOO_TIMEOUT_SECS=30",
+		"TRK_ORIGINS_MY_PROM_MAX_IDLE_CONNS_PER_HOST=8",
+		"TRK_CACHE_BOLTDB_COMPACTION_MIN_FREE_RATIO=0.25",
+		"TRK_PROXY_PORT=8000",
+		"HOME=/root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should set the options named by the variables
+	if v := c.Origins["foo"].TimeoutSecs; v != 30 {
+		t.Errorf("wanted %d got %d.", 30, v)
+	}
+	if v := c.Origins["my_prom"].MaxIdleConnsPerHost; v != 8 {
+		t.Errorf("wanted %d got %d.", 8, v)
+	}
+	if v := c.Caching.BoltDB.CompactionMinFreeRatio; v != 0.25 {
+		t.Errorf("wanted %f got %f.", 0.25, v)
+	}
+	if len(c.Origins) != 3 {
+		t.Errorf("unexpected origins %v", c.Origins)
+	}
+
+	// it should fail on values that are not valid for the option
+	if err := loadEnvOverrides(c, []string{"TRK_MAIN_STARTUP_DEGRADED=maybe"}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
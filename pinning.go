@@ -0,0 +1,64 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// hnPinnedNow and upPinnedNow are the request header and url parameter pinning the time a request is resolved at
+	hnPinnedNow = "X-Trickster-Now"
+	upPinnedNow = "trickster_now"
+
+	// relativeNow is the time a request is resolved at, in start and end parameters relative to it (e.g., now-6h)
+	relativeNow = "now"
+)
+
+// pinnedTime returns the time, in epoch seconds, that the client pinned the request to with the X-Trickster-Now header
+// or trickster_now url parameter, if the origin allows it. Times after now are pinned to now.
+func (o PrometheusOriginConfig) pinnedTime(r *http.Request, now int64) (int64, bool) {
+	if !o.AllowTimePinning {
+		return 0, false
+	}
+	v := r.Header.Get(hnPinnedNow)
+	if v == "" {
+		v = r.FormValue(upPinnedNow)
+	}
+	if v == "" {
+		return 0, false
+	}
+	t, err := parseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return min64(t.Unix(), now), true
+}
+
+// parseRequestTime converts a start or end url parameter to time.Time, like parseTime, also accepting times relative
+// to now, the epoch seconds that the request is resolved at, such as 'now' or 'now-6h'
+func parseRequestTime(s string, now int64) (time.Time, error) {
+	if s == relativeNow {
+		return time.Unix(now, 0), nil
+	}
+	if strings.HasPrefix(s, relativeNow+"-") {
+		d, err := parseDuration(strings.TrimPrefix(s, relativeNow+"-"))
+		if err == nil {
+			return time.Unix(now, 0).Add(-d), nil
+		}
+	}
+	return parseTime(s)
+}
@@ -0,0 +1,147 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestPrometheusOriginConfig_pinnedTime(t *testing.T) {
+	now := int64(1546300800)
+	tests := []struct {
+		allow  bool
+		header string
+		param  string
+		pinned int64
+		ok     bool
+	}{
+		{false, "1546297200", "", 0, false},
+		{true, "", "", 0, false},
+		{true, "1546297200", "", 1546297200, true},
+		{true, "", "2019-01-01T00:00:00Z", 1546300800, true},
+		// times after now should be pinned to now
+		{true, "1546304400", "", now, true},
+		{true, "yesterday", "", 0, false},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "http://trickster/api/v1/query?"+url.Values{upPinnedNow: {test.param}}.Encode(), nil)
+		if test.header != "" {
+			r.Header.Set(hnPinnedNow, test.header)
+		}
+		o := PrometheusOriginConfig{AllowTimePinning: test.allow}
+		if pinned, ok := o.pinnedTime(r, now); pinned != test.pinned || ok != test.ok {
+			t.Errorf("test %d: unexpected result %d %t", i, pinned, ok)
+		}
+	}
+}
+
+func TestParseRequestTime(t *testing.T) {
+	now := int64(1546300800)
+	tests := []struct {
+		s     string
+		want  int64
+		valid bool
+	}{
+		{"now", now, true},
+		{"now-6h", now - 6*3600, true},
+		{"now-90", now - 90, true},
+		{"1546297200", 1546297200, true},
+		{"now-yesterday", 0, false},
+		{"now+1h", 0, false},
+	}
+	for i, test := range tests {
+		ts, err := parseRequestTime(test.s, now)
+		if (err == nil) != test.valid || (test.valid && ts.Unix() != test.want) {
+			t.Errorf("test %d: unexpected result %v %v", i, ts, err)
+		}
+	}
+}
+
+func TestTricksterHandler_pinnedRequests(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the origin returns a point at every step of the requested range, or a vector at the requested time
+	var upstream []url.Values
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		upstream = append(upstream, r.Form)
+		if r.Form.Get(upStart) == "" {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		start, _ := parseTime(r.FormValue(upStart))
+		end, _ := parseTime(r.FormValue(upEnd))
+		ss := &model.SampleStream{Metric: model.Metric{"__name__": "up"}}
+		for ts := start.Unix(); ts <= end.Unix(); ts += 15 {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: 1})
+		}
+		json.NewEncoder(w).Encode(PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{ss}}})
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.AllowTimePinning = true
+	tr.Config.Origins["default"] = o
+
+	pinned := time.Now().Add(-time.Hour).Unix()
+	pinned -= pinned % 15
+	query := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", es.URL+path, nil)
+		if path[len(prometheusAPIv1Path):][:len(mnQueryRange)] == mnQueryRange {
+			tr.promQueryRangeHandler(w, r)
+		} else {
+			tr.promQueryHandler(w, r)
+		}
+		return w
+	}
+
+	// it should resolve the relative range at the pinned time, without a fast forward point
+	path := fmt.Sprintf("/api/v1/query_range?query=up&start=now-10m&end=now&step=15&%s=%d", upPinnedNow, pinned)
+	var pe PrometheusMatrixEnvelope
+	json.Unmarshal(query(path).Body.Bytes(), &pe)
+	if len(pe.Data.Result) != 1 || len(pe.Data.Result[0].Values) == 0 {
+		t.Fatalf("unexpected result %v", pe)
+	}
+	values := pe.Data.Result[0].Values
+	if first, last := int64(values[0].Timestamp)/1000, int64(values[len(values)-1].Timestamp)/1000; first != pinned-600 ||
+		last != pinned {
+		t.Errorf("unexpected range %d-%d, wanted %d-%d", first, last, pinned-600, pinned)
+	}
+	if upstream[0].Get(upPinnedNow) != "" {
+		t.Errorf("unexpected upstream params %v", upstream[0])
+	}
+
+	// it should serve the same request from the cache
+	n := len(upstream)
+	query(path)
+	if len(upstream) != n {
+		t.Errorf("wanted %d got %d.", n, len(upstream))
+	}
+
+	// it should evaluate an instant query at the pinned time
+	query(fmt.Sprintf("/api/v1/query?query=up&%s=%d", upPinnedNow, pinned))
+	if p := upstream[len(upstream)-1]; p.Get(upTime) != fmt.Sprint(pinned) || p.Get(upPinnedNow) != "" {
+		t.Errorf("unexpected upstream params %v", p)
+	}
+}
@@ -0,0 +1,160 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+// maxPrimeBytes limits the size of the query_range response a cache priming request writes to the cache
+const maxPrimeBytes = 64 << 20
+
+// primeResult describes the cache record written by a cache priming request
+type primeResult struct {
+	URL          string         `json:"url"`
+	CacheKey     string         `json:"cacheKey,omitempty"`
+	Series       int            `json:"series"`
+	CacheExtents *MatrixExtents `json:"cacheExtents,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// primeHandler handles calls to /trickster/prime?url=..., which writes the Prometheus query_range response in the
+// request body to the cache under the key that Trickster would use to fulfill the provided url, so that a new
+// instance can be primed from a batch job (e.g., an export of recording rule results) before it takes traffic
+func (t *TricksterHandler) primeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	result := primeResult{URL: r.URL.Query().Get("url")}
+	status := http.StatusOK
+	if t.bypassed() {
+		status = http.StatusServiceUnavailable
+		result.Error = "the cache is bypassed"
+	} else if result.URL == "" {
+		status = http.StatusBadRequest
+		result.Error = "missing url parameter"
+	} else {
+		var pe PrometheusMatrixEnvelope
+		var tooLarge *http.MaxBytesError
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrimeBytes)).Decode(&pe); errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+			result.Error = err.Error()
+		} else if err != nil {
+			status = http.StatusBadRequest
+			result.Error = fmt.Sprintf("unable to parse request body: %s", err.Error())
+		} else if result = t.prime(result.URL, pe); result.Error != "" {
+			status = http.StatusBadRequest
+		}
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// prime merges the matrix into the cache record for the provided query_range url. When the matrix overlaps or adjoins
+// the cached extents, the cached points outside of its range are kept; otherwise it replaces the record, so that the
+// cached extents never have a gap.
+func (t *TricksterHandler) prime(u string, pe PrometheusMatrixEnvelope) primeResult {
+	result := primeResult{URL: u}
+
+	if pe.Status != rvSuccess || pe.Data.ResultType != rvMatrix {
+		result.Error = "request body is not a successful matrix response"
+		return result
+	}
+	extents := pe.getExtents()
+	if extents.End == 0 {
+		result.Error = "request body has no data points"
+		return result
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// the time range of the query is that of the data
+	params := req.URL.Query()
+	params.Set(upStart, strconv.FormatInt(extents.Start/1000, 10))
+	params.Set(upEnd, strconv.FormatInt(extents.End/1000, 10))
+	req.URL.RawQuery = params.Encode()
+
+	var match mux.RouteMatch
+	if t.Router == nil || !t.Router.Match(req, &match) || match.Route.GetName() != rnQueryRange {
+		result.Error = "url is not a range query"
+		return result
+	}
+	req = mux.SetURLVars(req, match.Vars)
+
+	ctx, err := t.buildRequestContext(httptest.NewRecorder(), req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.CacheKey = ctx.CacheKey
+
+	if (ctx.Time*1000 - extents.End) > ctx.Origin.MaxValueAgeSecs*1000 {
+		result.Error = "data is older than the origin's max_value_age_secs"
+		return result
+	}
+	if extents.Start%ctx.StepMS != 0 {
+		result.Error = fmt.Sprintf("data points are not aligned to the %dms step", ctx.StepMS)
+		return result
+	}
+
+	if ce := ctx.CacheExtents; ce.End > 0 && extents.Start <= ce.End+ctx.StepMS && extents.End >= ce.Start-ctx.StepMS {
+		tail := ctx.Matrix.copy()
+		tail.cropToRange(extents.End+1, 0)
+		pe = t.mergeMatrix(t.mergeMatrix(pe, ctx.Matrix), tail)
+	}
+
+	// Prune any old points based on retention policy
+	pe.cropToRange(int64(ctx.Time-ctx.Origin.MaxValueAgeSecs)*1000, 0)
+	if ctx.Origin.NoCacheLastDataSecs != 0 {
+		pe.cropToRange(0, int64(ctx.Time-ctx.Origin.NoCacheLastDataSecs)*1000)
+	}
+
+	cacheBody, err := json.Marshal(pe)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if cb, err := t.compressCacheBody(ctx.Origin, mnQueryRange, cacheBody); err == nil {
+		cacheBody = cb
+	} else {
+		level.Error(t.Logger).Log(lfEvent, "error compressing cached data", lfDetail, err.Error())
+	}
+
+	ce := pe.getExtents()
+	ttl := t.Config.Caching.Stampede.storeTTL(rangeTTL(ctx.Origin.TTLBuckets, (ce.End-ce.Start)/1000, t.Config.Caching.RecordTTLSecs))
+	if err := t.Cacher.Store(ctx.CacheKey, string(cacheBody), ttl); err != nil {
+		t.countError(ctx.Origin, psCache, err)
+		result.Error = err.Error()
+		return result
+	}
+	t.storeRecordInfo(ctx.CacheKey, t.recordInfo(ctx, pe), ttl)
+	level.Info(t.Logger).Log(lfEvent, "primed cache record", lfCacheKey, ctx.CacheKey, "start", ce.Start, "end", ce.End, "ttl", ttl)
+
+	result.Series = len(pe.Data.Result)
+	result.CacheExtents = &ce
+	return result
+}
@@ -0,0 +1,115 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPrimeBody returns a matrix response with a point every step from start to end, in epoch seconds
+func testPrimeBody(start, end, step int64) string {
+	values := []string{}
+	for ts := start; ts <= end; ts += step {
+		values = append(values, fmt.Sprintf(`[%d,"1"]`, ts))
+	}
+	return `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"job:up:sum"},"values":[` + strings.Join(values, ",") + `]}]}}`
+}
+
+func TestTricksterHandler_primeHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+	router := tr.newAdminRouter()
+
+	query := "http://trickster/api/v1/query_range?query=job:up:sum&step=60"
+	start := (time.Now().Unix()/60 - 60) * 60
+
+	prime := func(u, body string) (int, primeResult) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "http://trickster/trickster/prime?url="+url.QueryEscape(u), strings.NewReader(body)))
+		result := primeResult{}
+		json.NewDecoder(w.Result().Body).Decode(&result)
+		return w.Result().StatusCode, result
+	}
+
+	// it should write the data to the cache key of the range query
+	code, result := prime(query, testPrimeBody(start, start+1200, 60))
+	if code != http.StatusOK {
+		t.Fatalf("wanted %d got %d: %s", http.StatusOK, code, result.Error)
+	}
+	if result.Series != 1 {
+		t.Errorf("wanted %d got %d.", 1, result.Series)
+	}
+	explained := tr.explain(http.MethodGet, fmt.Sprintf("%s&start=%d&end=%d", query, start+600, start+1200), nil)
+	if explained.CacheKey != result.CacheKey {
+		t.Errorf("wanted %q got %q.", explained.CacheKey, result.CacheKey)
+	}
+	if explained.CacheLookupResult != crHit {
+		t.Errorf("wanted %q got %q.", crHit, explained.CacheLookupResult)
+	}
+
+	// it should keep the cached points when the data adjoins them
+	code, result = prime(query, testPrimeBody(start+1260, start+1800, 60))
+	if code != http.StatusOK {
+		t.Fatalf("wanted %d got %d: %s", http.StatusOK, code, result.Error)
+	}
+	if result.CacheExtents.Start != start*1000 || result.CacheExtents.End != (start+1800)*1000 {
+		t.Errorf("unexpected cache extents %v", result.CacheExtents)
+	}
+
+	// it should replace the cached points when there would be a gap between them and the data
+	code, result = prime(query, testPrimeBody(start+2400, start+3000, 60))
+	if code != http.StatusOK {
+		t.Fatalf("wanted %d got %d: %s", http.StatusOK, code, result.Error)
+	}
+	if result.CacheExtents.Start != (start+2400)*1000 {
+		t.Errorf("unexpected cache extents %v", result.CacheExtents)
+	}
+
+	// it should reject data that is not aligned to the step, is not a matrix, or is not for a range query
+	tests := []struct {
+		url  string
+		body string
+	}{
+		{query, testPrimeBody(start+30, start+600, 60)},
+		{query, `{"status":"success","data":{"resultType":"vector","result":[]}}`},
+		{query, `not json`},
+		{"http://trickster/api/v1/query?query=job:up:sum", testPrimeBody(start, start+600, 60)},
+		{"", testPrimeBody(start, start+600, 60)},
+	}
+	for i, test := range tests {
+		if code, _ := prime(test.url, test.body); code != http.StatusBadRequest {
+			t.Errorf("test %d: wanted %d got %d.", i, http.StatusBadRequest, code)
+		}
+	}
+
+	// it should refuse data larger than a priming request may write
+	if code, _ := prime(query, strings.Repeat(" ", maxPrimeBytes+1)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("wanted %d got %d.", http.StatusRequestEntityTooLarge, code)
+	}
+
+	// it should not write to the cache in bypass mode
+	tr.setBypass(true)
+	defer tr.setBypass(false)
+	if code, _ := prime(query, testPrimeBody(start, start+600, 60)); code != http.StatusServiceUnavailable {
+		t.Errorf("wanted %d got %d.", http.StatusServiceUnavailable, code)
+	}
+}
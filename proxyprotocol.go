@@ -0,0 +1,193 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout limits the time a connection has to send its PROXY protocol header
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header, including the CRLF
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Signature begins every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errProxyHeader is returned by connections from trusted sources that do not begin with a valid PROXY protocol header
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyProtocolListener wraps a listener so that connections from trusted sources, such as a TCP load balancer, are
+// required to begin with an HAProxy PROXY protocol (v1 or v2) header, whose source address becomes the connection's
+// remote address. Connections from other sources are served as they are.
+type proxyProtocolListener struct {
+	net.Listener
+	// sources are the trusted sources. When empty, every connection must send a header
+	sources TrustedProxies
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.sources) > 0 {
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !l.sources.contains(addr.IP) {
+			return c, nil
+		}
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header of a connection before any of its data is read or its remote
+// address is used. The header is read in the connection's own goroutine, so a slow client does not delay Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			// the connection is dropped without a response, as the protocol requires
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address from the PROXY protocol header, or the address of the connection's peer
+// when the header carries none
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, returning its source address, or nil if the header carries
+// none (the v1 UNKNOWN and v2 LOCAL commands, and non-TCP/UDP address families)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if b, err := r.Peek(6); err == nil && string(b) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyHeaderV1 reads a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	verCmd, family := h[12], h[13]
+	payload := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%v: unsupported version %d", errProxyHeader, verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: the connection was made by the proxy itself, such as a health check
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("%v: unsupported command %d", errProxyHeader, verCmd&0xf)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errProxyHeader
+	}
+	ip := net.IP(payload[:ipLen])
+	port := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	if family&0xf == 2 {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
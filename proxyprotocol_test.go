@@ -0,0 +1,117 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a PROXY protocol v2 header with the command, address family and payload
+func proxyV2Header(cmd, family byte, payload []byte) string {
+	return string(proxyV2Signature) + string([]byte{0x20 | cmd, family, byte(len(payload) >> 8), byte(len(payload))}) + string(payload)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...), 0xdc, 0x04, 0x01, 0xbb)
+
+	tests := []struct {
+		header string
+		remote string
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", false},
+		{"PROXY " + strings.Repeat("x", proxyV1MaxLen), "", false},
+		{proxyV2Header(1, 0x11, tcp4), "192.0.2.1:56324", true},
+		{proxyV2Header(1, 0x11, tcp4[:8]), "", false},
+		{proxyV2Header(0, 0x00, nil), "", true},
+		{proxyV2Header(2, 0x11, tcp4), "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+	}
+
+	for i, test := range tests {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n")))
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+			continue
+		}
+		if remote := fmt.Sprint(addr); test.ok && test.remote != "" && remote != test.remote {
+			t.Errorf("test %d: wanted %q got %q.", i, test.remote, remote)
+		}
+		if test.ok && test.remote == "" && addr != nil {
+			t.Errorf("test %d: unexpected address %v", i, addr)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	serve := func(sources TrustedProxies) (string, func()) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.RemoteAddr)
+		})}
+		go srv.Serve(&proxyProtocolListener{Listener: ln, sources: sources})
+		return ln.Addr().String(), func() { srv.Close() }
+	}
+
+	request := func(addr, header string) string {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprint(c, header+"GET / HTTP/1.0\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	addr, closeFn := serve(nil)
+	defer closeFn()
+
+	// it should use the source address of the PROXY header as the remote address
+	if remote := request(addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"); remote != "192.0.2.1:56324" {
+		t.Errorf("wanted %q got %q.", "192.0.2.1:56324", remote)
+	}
+
+	// it should refuse connections without a PROXY header
+	if remote := request(addr, ""); remote != "" {
+		t.Errorf("unexpected response %q", remote)
+	}
+
+	// it should serve connections from untrusted sources as they are
+	sources, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	addr, closeFn2 := serve(sources)
+	defer closeFn2()
+	if remote := request(addr, ""); !strings.HasPrefix(remote, "127.0.0.1:") {
+		t.Errorf("unexpected remote address %q", remote)
+	}
+}
@@ -0,0 +1,242 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// recordInfoSuffix is appended to the cache key of a query_range data set to form the key of its cacheRecordInfo
+const recordInfoSuffix = ".info"
+
+// cacheRecordInfo describes the origin and query of a cached query_range data set, whose key is a hash of them, so
+// that the data sets of an origin or query can be found for purging
+type cacheRecordInfo struct {
+	// Origin is the API URL of the origin
+	Origin string `json:"origin"`
+	Query  string `json:"query"`
+	// Resolutions are the resolutions of the cached points, when the origin has resolution tiers
+	Resolutions []resolutionExtent `json:"resolutions,omitempty"`
+}
+
+// storeRecordInfo stores the info of the query_range data set with the cache key, expiring along with it
+func (t *TricksterHandler) storeRecordInfo(cacheKey string, info cacheRecordInfo, ttl int64) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	if err := t.Cacher.Store(cacheKey+recordInfoSuffix, string(data), ttl); err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error storing cache record info", lfCacheKey, cacheKey, lfDetail, err.Error())
+	}
+}
+
+// apiURL returns the URL of the origin's API, which the query_range data sets of the origin are recorded with
+func (o PrometheusOriginConfig) apiURL() string {
+	return o.OriginURL + strings.Replace(o.APIPath+"/", "//", "/", 1)
+}
+
+// originByAPIURL returns the configured origin with the API URL, or an empty origin config if there is none
+func (t *TricksterHandler) originByAPIURL(u string) PrometheusOriginConfig {
+	for _, o := range t.Config.Origins {
+		if o.apiURL() == u {
+			return o
+		}
+	}
+	return PrometheusOriginConfig{}
+}
+
+// purgeRequest selects the cached query_range data to purge: the points at or after Since of the data sets of the
+// origin (by API URL) and with a query matching the expression, when set. When Until is set, data sets starting after
+// it are left alone.
+type purgeRequest struct {
+	Origin string
+	Query  *regexp.Regexp
+	Since  time.Time
+	Until  time.Time
+}
+
+// matches returns true if the data set with the info is selected by the request
+func (p purgeRequest) matches(info cacheRecordInfo) bool {
+	return (p.Origin == "" || info.Origin == p.Origin) && (p.Query == nil || p.Query.MatchString(info.Query))
+}
+
+// purgeResult describes the cached data sets affected by a purge
+type purgeResult struct {
+	// Trimmed is the number of data sets whose points at or after the purge time were removed
+	Trimmed int `json:"trimmed"`
+	// Deleted is the number of data sets removed entirely, having no points before the purge time
+	Deleted int    `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// purgeHandler handles calls to /trickster/purge?origin=...&query=...&since=...&until=..., which removes the cached
+// query_range points at or after since (every point when unset) from the data sets of the named origin and with a
+// query matching the query regular expression, for use after the origin's data was corrected. Data sets starting after
+// until, when set, are left alone. At least one of origin and query is required. Data sets cached before their origin
+// and query were recorded are not matched.
+func (t *TricksterHandler) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	var result purgeResult
+	status := http.StatusOK
+	if p, err := t.parsePurgeRequest(r); err != nil {
+		status = http.StatusBadRequest
+		result.Error = err.Error()
+	} else if result, err = t.purge(p); err != nil {
+		status = http.StatusInternalServerError
+		result.Error = err.Error()
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// parsePurgeRequest returns the purge request of the origin, query, since and until parameters
+func (t *TricksterHandler) parsePurgeRequest(r *http.Request) (purgeRequest, error) {
+	params := r.URL.Query()
+	return t.newPurgeRequest(params.Get(upOrigin), params.Get(upQuery), params.Get("since"), params.Get("until"))
+}
+
+// newPurgeRequest returns the purge request of the origin name, query expression and since and until times, which
+// are optional
+func (t *TricksterHandler) newPurgeRequest(name, q, since, until string) (purgeRequest, error) {
+	var p purgeRequest
+	if name != "" {
+		o, ok := t.Config.Origins[name]
+		if !ok {
+			return p, fmt.Errorf("unknown origin %q", name)
+		}
+		p.Origin = o.apiURL()
+	}
+	if q != "" {
+		re, err := regexp.Compile(q)
+		if err != nil {
+			return p, fmt.Errorf("invalid query expression: %v", err)
+		}
+		p.Query = re
+	}
+	if p.Origin == "" && p.Query == nil {
+		return p, fmt.Errorf("an origin or query is required")
+	}
+	if since != "" {
+		s, err := parseTime(since)
+		if err != nil {
+			return p, err
+		}
+		p.Since = s
+	}
+	if until != "" {
+		u, err := parseTime(until)
+		if err != nil {
+			return p, err
+		}
+		p.Until = u
+	}
+	if !p.Since.IsZero() && !p.Until.IsZero() && p.Until.Before(p.Since) {
+		return p, fmt.Errorf("until must not be before since")
+	}
+	return p, nil
+}
+
+// purge removes the selected points from the cached query_range data sets. Data sets left without points are deleted,
+// and the others are stored again with their remaining time to live.
+func (t *TricksterHandler) purge(p purgeRequest) (purgeResult, error) {
+	var result purgeResult
+
+	// the records are modified after the walk, since some caches hold a lock while walking
+	selected := map[string]cacheRecordInfo{}
+	err := t.Cacher.Walk(func(o CacheObject) error {
+		if !strings.HasSuffix(o.Key, recordInfoSuffix) {
+			return nil
+		}
+		var info cacheRecordInfo
+		if json.Unmarshal([]byte(o.Value), &info) == nil && p.matches(info) {
+			selected[strings.TrimSuffix(o.Key, recordInfoSuffix)] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	var since, until int64
+	if !p.Since.IsZero() {
+		since = p.Since.UnixNano() / int64(time.Millisecond)
+	}
+	if !p.Until.IsZero() {
+		until = p.Until.UnixNano() / int64(time.Millisecond)
+	}
+	for key, info := range selected {
+		data, err := t.Cacher.Retrieve(key)
+		if err != nil {
+			// the data set expired or was removed since its info was written
+			t.Cacher.Delete(key + recordInfoSuffix)
+			continue
+		}
+		body, err := decompressCacheBody([]byte(data))
+		if err != nil {
+			continue
+		}
+		var pe PrometheusMatrixEnvelope
+		if err := parseMatrix(body, &pe); err != nil {
+			continue
+		}
+
+		if until > 0 && pe.getExtents().Start > until {
+			continue
+		}
+		if since > 0 {
+			if pe.getExtents().End < since {
+				continue
+			}
+			pe.cropToRange(0, since-1)
+		}
+		if since <= 0 || pe.getExtents().End == 0 {
+			t.Cacher.Delete(key)
+			t.Cacher.Delete(key + recordInfoSuffix)
+			result.Deleted++
+			t.CacheEvents.emit(cacheEvent{Type: cePurge, Key: key, Origin: info.Origin, Query: info.Query})
+			continue
+		}
+
+		expiration, err := t.Cacher.Expiration(key)
+		ttl := expiration - time.Now().Unix()
+		if err != nil || ttl <= 0 {
+			continue
+		}
+		cacheBody, err := json.Marshal(pe)
+		if err != nil {
+			continue
+		}
+		if cb, err := t.compressCacheBody(t.originByAPIURL(info.Origin), mnQueryRange, cacheBody); err == nil {
+			cacheBody = cb
+		}
+		if err := t.Cacher.Store(key, string(cacheBody), ttl); err != nil {
+			return result, err
+		}
+		result.Trimmed++
+		t.CacheEvents.emit(cacheEvent{Type: cePurge, Key: key, Origin: info.Origin, Query: info.Query})
+	}
+
+	level.Info(t.Logger).Log(lfEvent, "purged cache records", "origin", p.Origin, "since", p.Since.Unix(), "trimmed", result.Trimmed, "deleted", result.Deleted)
+	return result, nil
+}
@@ -0,0 +1,106 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTricksterHandler_purgeHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+	router := tr.newAdminRouter()
+
+	start := (time.Now().Unix()/60 - 60) * 60
+	prime := func(query string) string {
+		u := "http://trickster/api/v1/query_range?step=60&query=" + url.QueryEscape(query)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "http://trickster/trickster/prime?url="+url.QueryEscape(u), strings.NewReader(testPrimeBody(start, start+1200, 60))))
+		result := primeResult{}
+		json.NewDecoder(w.Result().Body).Decode(&result)
+		if result.Error != "" {
+			t.Fatal(result.Error)
+		}
+		return result.CacheKey
+	}
+	purge := func(params string) (int, purgeResult) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "http://trickster/trickster/purge?"+params, nil))
+		result := purgeResult{}
+		json.NewDecoder(w.Result().Body).Decode(&result)
+		return w.Result().StatusCode, result
+	}
+	cachedExtents := func(key string) MatrixExtents {
+		data, err := tr.Cacher.Retrieve(key)
+		if err != nil {
+			return MatrixExtents{}
+		}
+		body, _ := decompressCacheBody([]byte(data))
+		var pe PrometheusMatrixEnvelope
+		parseMatrix(body, &pe)
+		return pe.getExtents()
+	}
+
+	sumKey := prime("job:up:sum")
+	rateKey := prime("rate(http_requests_total[5m])")
+
+	// it should remove the points at or after the purge time of the matching data sets only
+	code, result := purge(fmt.Sprintf("origin=default&query=%s&since=%d", url.QueryEscape("^job:"), start+600))
+	if code != http.StatusOK || result.Trimmed != 1 || result.Deleted != 0 {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+	if e := cachedExtents(sumKey); e.Start != start*1000 || e.End != (start+540)*1000 {
+		t.Errorf("unexpected cache extents %v", e)
+	}
+	if e := cachedExtents(rateKey); e.End != (start+1200)*1000 {
+		t.Errorf("unexpected cache extents %v", e)
+	}
+
+	// it should delete the data sets left without points, along with their info
+	code, result = purge(fmt.Sprintf("query=rate&since=%d", start-60))
+	if code != http.StatusOK || result.Trimmed != 0 || result.Deleted != 1 {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+	if _, err := tr.Cacher.Retrieve(rateKey); err == nil {
+		t.Errorf("expected a cache miss")
+	}
+	if _, err := tr.Cacher.Retrieve(rateKey + recordInfoSuffix); err == nil {
+		t.Errorf("expected a cache miss")
+	}
+
+	// it should leave data sets that end before the purge time alone
+	if code, result = purge(fmt.Sprintf("origin=default&since=%d", start+900)); code != http.StatusOK || result.Trimmed != 0 {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+
+	// it should leave data sets that start after the purge range alone
+	if code, result = purge(fmt.Sprintf("origin=default&since=%d&until=%d", start-600, start-60)); code != http.StatusOK || result.Deleted != 0 {
+		t.Errorf("unexpected result %d %v", code, result)
+	}
+
+	// it should reject requests without a known origin or valid query or range
+	for _, params := range []string{"", "since=1", "origin=nonexistent", "query=(", "origin=default&since=2&until=1"} {
+		if code, result := purge(params); code != http.StatusBadRequest || result.Error == "" {
+			t.Errorf("%q: unexpected result %d %v", params, code, result)
+		}
+	}
+}
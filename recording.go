@@ -0,0 +1,188 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+const (
+	// Recording modes
+	rmRecord = "record"
+	rmReplay = "replay"
+
+	recordingFileSuffix = ".json"
+)
+
+// RecordingConfig describes the recording of the origin's upstream requests and responses to disk, or their replay
+// from disk without contacting the origin, so that tests and dashboard development can run against captured responses
+type RecordingConfig struct {
+	// Mode is "record", which sends upstream requests to the origin and writes each response to Path, or "replay",
+	// which answers upstream requests with the responses in Path, and fails those that were not recorded.
+	// Default is to do neither
+	Mode string `toml:"mode"`
+	// Path is the directory that the responses are recorded to and replayed from
+	Path string `toml:"path"`
+}
+
+// enabled returns true if the origin's upstream requests are recorded or replayed
+func (c RecordingConfig) enabled() bool {
+	return c.Mode != ""
+}
+
+// validate returns an error if the mode is unknown, or set without a path
+func (c RecordingConfig) validate() error {
+	switch c.Mode {
+	case "":
+		return nil
+	case rmRecord, rmReplay:
+	default:
+		return fmt.Errorf("recording: unknown mode %q", c.Mode)
+	}
+	if c.Path == "" {
+		return fmt.Errorf("recording: a path is required")
+	}
+	return nil
+}
+
+// recordedResponse is an upstream response recorded to disk, along with the request it answered
+type recordedResponse struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is the response body when it is valid UTF-8, and BodyBase64 when it is not
+	Body       string `json:"body,omitempty"`
+	BodyBase64 string `json:"body_base64,omitempty"`
+}
+
+// recordingTransport records the responses to the requests made through the next transport, or replays them
+type recordingTransport struct {
+	next   http.RoundTripper
+	config RecordingConfig
+}
+
+// newRecordingTransport returns a transport recording or replaying the requests made through next
+func newRecordingTransport(next http.RoundTripper, c RecordingConfig) *recordingTransport {
+	return &recordingTransport{next: next, config: c}
+}
+
+// recordingKey returns the name of the file that the response to the request is recorded to. It identifies the
+// request by its method, path, query and body, but not its host, so that the responses recorded from one origin can
+// be replayed in place of another.
+func recordingKey(method, requestURI string, body []byte) string {
+	return md5sum(method + " " + requestURI + "\n" + string(body))
+}
+
+// RoundTrip replays the recorded response to the request, or sends it and records its response
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	filename := filepath.Join(rt.config.Path, recordingKey(req.Method, req.URL.RequestURI(), reqBody)+recordingFileSuffix)
+
+	if rt.config.Mode == rmReplay {
+		return replayResponse(filename, req)
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	rec := recordedResponse{Method: req.Method, URL: req.URL.RequestURI(), Status: resp.StatusCode, Header: resp.Header}
+	if utf8.Valid(body) {
+		rec.Body = string(body)
+	} else {
+		rec.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	if err := writeRecording(filename, rec); err != nil {
+		return nil, fmt.Errorf("error recording response: %w", err)
+	}
+	return resp, nil
+}
+
+// writeRecording writes the recorded response to the file, replacing any previous recording at once
+func writeRecording(filename string, rec recordedResponse) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// replayResponse returns the response recorded to the file, as the answer to the request
+func replayResponse(filename string, req *http.Request) (*http.Response, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recorded response to %s %s", req.Method, req.URL.RequestURI())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec recordedResponse
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %w", filename, err)
+	}
+	body := []byte(rec.Body)
+	if rec.BodyBase64 != "" {
+		if body, err = base64.StdEncoding.DecodeString(rec.BodyBase64); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", filename, err)
+		}
+	}
+	if rec.Header == nil {
+		rec.Header = http.Header{}
+	}
+	// the body is replayed as read, whatever length it was sent with
+	rec.Header.Del(hnContentLength)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
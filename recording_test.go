@@ -0,0 +1,156 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordingConfig_validate(t *testing.T) {
+	tests := []struct {
+		config RecordingConfig
+		valid  bool
+	}{
+		{RecordingConfig{}, true},
+		{RecordingConfig{Mode: rmRecord, Path: "/tmp/recordings"}, true},
+		{RecordingConfig{Mode: rmReplay, Path: "/tmp/recordings"}, true},
+		{RecordingConfig{Mode: rmReplay}, false},
+		{RecordingConfig{Mode: "rewind", Path: "/tmp/recordings"}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestRecordingTransport_RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trickster-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	requests := 0
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set(hnContentType, hvApplicationJSON)
+		w.Write([]byte(`{"query":"` + r.URL.Query().Get(upQuery) + `","body":"` + string(body) + `"}`))
+	}))
+	defer es.Close()
+
+	newRequest := func(host, query, body string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, host+"/api/v1/query?query="+query, bytes.NewBufferString(body))
+		return req
+	}
+	read := func(resp *http.Response) string {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	// it should send the request to the origin and record its response
+	rt := newRecordingTransport(http.DefaultTransport, RecordingConfig{Mode: rmRecord, Path: dir})
+	resp, err := rt.RoundTrip(newRequest(es.URL, "up", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := read(resp); body != `{"query":"up","body":"a"}` {
+		t.Errorf("unexpected body %s", body)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+recordingFileSuffix)); len(files) != 1 {
+		t.Errorf("wanted %d got %d.", 1, len(files))
+	}
+
+	// it should replay the recorded response without contacting the origin, whatever its host
+	rt = newRecordingTransport(nil, RecordingConfig{Mode: rmReplay, Path: dir})
+	resp, err = rt.RoundTrip(newRequest("http://replayed:9090", "up", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := read(resp); body != `{"query":"up","body":"a"}` || resp.StatusCode != http.StatusOK || requests != 1 {
+		t.Errorf("unexpected replay %d %s after %d requests", resp.StatusCode, body, requests)
+	}
+	if ct := resp.Header.Get(hnContentType); ct != hvApplicationJSON {
+		t.Errorf("wanted %s got %s.", hvApplicationJSON, ct)
+	}
+
+	// it should fail requests that were not recorded, including those with another body
+	for _, req := range []*http.Request{newRequest(es.URL, "down", "a"), newRequest(es.URL, "up", "b")} {
+		if _, err := rt.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "no recorded response") {
+			t.Errorf("expected a missing recording error, got %v", err)
+		}
+	}
+}
+
+func TestRecordingTransport_binaryBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trickster-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// it should replay bodies that are not valid UTF-8 as they were recorded
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	}))
+	defer es.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, es.URL+"/api/v1/read", nil)
+	if _, err := newRecordingTransport(http.DefaultTransport, RecordingConfig{Mode: rmRecord, Path: dir}).RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newRecordingTransport(nil, RecordingConfig{Mode: rmReplay, Path: dir}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); !bytes.Equal(body, binary) {
+		t.Errorf("wanted %v got %v.", binary, body)
+	}
+}
+
+func TestTricksterHandler_getURL_replay(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	dir, err := ioutil.TempDir("", "trickster-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es := newTestServer(`{"status":"success"}`)
+
+	// it should record the origin's upstream responses and replay them once the origin is gone
+	o := PrometheusOriginConfig{Recording: RecordingConfig{Mode: rmRecord, Path: dir}}
+	if _, _, _, err := tr.getURL(o, http.MethodGet, es.URL+"/api/v1/labels", nil, http.Header{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	es.Close()
+	o.Recording.Mode = rmReplay
+	body, resp, _, err := tr.getURL(o, http.MethodGet, es.URL+"/api/v1/labels", nil, http.Header{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != `{"status":"success"}` {
+		t.Errorf("unexpected replay %d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,66 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+// withRecovery wraps the handler to respond 500 to requests whose handler panics, logging the panic, rather than
+// letting one request crash the process
+func (t *TricksterHandler) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// net/http aborts the response without logging on this panic
+				panic(p)
+			}
+			route := ""
+			if cr := mux.CurrentRoute(r); cr != nil {
+				route = cr.GetName()
+			}
+			t.handlePanic(p, route, w, r)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverRangeProxyRequest responds 500 to a queued range request whose processing panicked, so that the queue
+// keeps serving the requests behind it. It must be deferred.
+func (t *TricksterHandler) recoverRangeProxyRequest(r *ClientRequestContext) {
+	if p := recover(); p != nil {
+		t.handlePanic(p, rnQueryRange, r.Writer, r.Request)
+		r.WaitGroup.Done()
+	}
+}
+
+// handlePanic logs a recovered panic with its stack and the request, counts it, and responds 500
+func (t *TricksterHandler) handlePanic(p interface{}, route string, w http.ResponseWriter, r *http.Request) {
+	level.Error(t.Logger).Log(lfEvent, "recovered from panic", lfDetail, fmt.Sprint(p), "route", route, "method", r.Method,
+		"path", r.URL.Path, lfClientIP, t.TrustedProxies.clientIP(r), "stack", string(debug.Stack()))
+	if t.Metrics != nil {
+		t.Metrics.Panics.WithLabelValues(route).Inc()
+	}
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.WriteHeader(http.StatusInternalServerError)
+}
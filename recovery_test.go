@@ -0,0 +1,78 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTricksterHandler_withRecovery(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("malformed response")
+	}).Name("panic")
+	router.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}).Name("abort")
+	router.Use(tr.withRecovery)
+
+	// it should respond 500 and count the panic
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wanted %d got %d.", http.StatusInternalServerError, w.Code)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.Panics.WithLabelValues("panic")); v != 1 {
+		t.Errorf("wanted %d got %f.", 1, v)
+	}
+
+	// it should leave aborted responses to net/http
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected the abort to be re-panicked, got %v", p)
+		}
+	}()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://trickster/abort", nil))
+}
+
+func TestTricksterHandler_recoverRangeProxyRequest(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	w := httptest.NewRecorder()
+	r := &ClientRequestContext{Request: httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil), Writer: w}
+	r.WaitGroup.Add(1)
+
+	func() {
+		defer tr.recoverRangeProxyRequest(r)
+		panic("malformed response")
+	}()
+
+	// it should respond 500 to the queued request and release it
+	r.WaitGroup.Wait()
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wanted %d got %d.", http.StatusInternalServerError, w.Code)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.Panics.WithLabelValues(rnQueryRange)); v != 1 {
+		t.Errorf("wanted %d got %f.", 1, v)
+	}
+}
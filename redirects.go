@@ -0,0 +1,162 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	hnLocation = "Location"
+
+	// defaultRedirectTTLSecs is the TTL of cached redirects without freshness headers when redirect_ttl_secs is not set
+	defaultRedirectTTLSecs = 300
+)
+
+// cachedRedirect is a redirect response of the origin, as stored in the cache
+type cachedRedirect struct {
+	StatusCode  int    `json:"code"`
+	Location    string `json:"location"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// cachesRedirect returns true if the origin's responses with the status code to requests with the method are cached
+func (o PrometheusOriginConfig) cachesRedirect(method string, code int) bool {
+	if !o.CacheRedirects || method != http.MethodGet {
+		return false
+	}
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectTTL returns the number of seconds a redirect response with the headers may be cached: the freshness
+// lifetime given by its Cache-Control or Expires header, or else the origin's redirect TTL. 0 means it is not cached.
+func (o PrometheusOriginConfig) redirectTTL(h http.Header, now time.Time) int64 {
+	if h.Get(hnLocation) == "" {
+		return 0
+	}
+
+	var maxAge, sMaxAge int64 = -1, -1
+	for _, directive := range strings.Split(h.Get(hnCacheControl), ",") {
+		name, value := strings.TrimSpace(strings.ToLower(directive)), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age":
+			if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+				maxAge = v
+			}
+		case "s-maxage":
+			if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+				sMaxAge = v
+			}
+		}
+	}
+	if sMaxAge >= 0 {
+		return sMaxAge
+	}
+	if maxAge >= 0 {
+		return maxAge
+	}
+
+	if v := h.Get(hnExpires); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil || !expires.After(now) {
+			return 0
+		}
+		return int64(expires.Sub(now) / time.Second)
+	}
+
+	if o.RedirectTTLSecs > 0 {
+		return o.RedirectTTLSecs
+	}
+	return defaultRedirectTTLSecs
+}
+
+// redirectCacheKey returns the cache key of the origin's redirect response to the request for the origin url
+func (o PrometheusOriginConfig) redirectCacheKey(r *http.Request, originURL string) string {
+	params := r.URL.Query()
+	if o.AllowClientRefresh {
+		params.Del(o.refreshParam())
+	}
+	return o.cacheKeyPartition(r) + deriveCacheKey(originURL+"?"+params.Encode()+o.cacheKeyScope(r), nil) + ".redirect"
+}
+
+// serveCachedRedirect responds with the cached redirect, returning false if there is none
+func (t *TricksterHandler) serveCachedRedirect(w http.ResponseWriter, o PrometheusOriginConfig, cacheKey string) bool {
+	data, err := t.Cacher.Retrieve(cacheKey)
+	if err != nil {
+		t.countError(o, psCache, err)
+		return false
+	}
+	var cr cachedRedirect
+	if err := json.Unmarshal([]byte(data), &cr); err != nil {
+		t.countError(o, psCache, classify(ecDecode, err))
+		return false
+	}
+
+	t.countCacheResult(o.OriginURL, otPrometheus, rnProxy, crHit, cr.StatusCode)
+	w.Header().Set(hnLocation, cr.Location)
+	if cr.ContentType != "" {
+		w.Header().Set(hnContentType, cr.ContentType)
+	}
+	w.WriteHeader(cr.StatusCode)
+	w.Write(cr.Body)
+	return true
+}
+
+// cacheRedirect stores the origin's redirect response, unless its headers forbid it
+func (t *TricksterHandler) cacheRedirect(o PrometheusOriginConfig, cacheKey string, body []byte, resp *http.Response) {
+	t.countCacheResult(o.OriginURL, otPrometheus, rnProxy, crKeyMiss, resp.StatusCode)
+
+	ttl := o.redirectTTL(resp.Header, time.Now())
+	if ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(cachedRedirect{
+		StatusCode:  resp.StatusCode,
+		Location:    resp.Header.Get(hnLocation),
+		ContentType: resp.Header.Get(hnContentType),
+		Body:        body,
+	})
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error marshaling redirect", lfDetail, err.Error())
+		return
+	}
+	if err := t.Cacher.Store(cacheKey, string(data), ttl); err != nil {
+		t.countError(o, psCache, err)
+	}
+}
+
+// validateRedirectCaching returns an error if the origin's redirect TTL is negative
+func (o PrometheusOriginConfig) validateRedirectCaching() error {
+	if o.RedirectTTLSecs < 0 {
+		return fmt.Errorf("redirect_ttl_secs must not be negative")
+	}
+	return nil
+}
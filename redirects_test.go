@@ -0,0 +1,149 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusOriginConfig_cachesRedirect(t *testing.T) {
+	o := PrometheusOriginConfig{CacheRedirects: true}
+
+	tests := []struct {
+		method string
+		code   int
+		cached bool
+	}{
+		{http.MethodGet, http.StatusMovedPermanently, true},
+		{http.MethodGet, http.StatusFound, true},
+		{http.MethodGet, http.StatusPermanentRedirect, true},
+		{http.MethodGet, http.StatusTemporaryRedirect, false},
+		{http.MethodGet, http.StatusOK, false},
+		{http.MethodPost, http.StatusFound, false},
+	}
+
+	for i, test := range tests {
+		if o.cachesRedirect(test.method, test.code) != test.cached {
+			t.Errorf("test %d: unexpected result for %s %d", i, test.method, test.code)
+		}
+	}
+
+	// it should cache nothing when disabled
+	if (PrometheusOriginConfig{}).cachesRedirect(http.MethodGet, http.StatusFound) {
+		t.Errorf("expected redirects not to be cached")
+	}
+}
+
+func TestPrometheusOriginConfig_redirectTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		o   PrometheusOriginConfig
+		h   http.Header
+		ttl int64
+	}{
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}}, defaultRedirectTTLSecs},
+		{PrometheusOriginConfig{RedirectTTLSecs: 60}, http.Header{hnLocation: {"/login"}}, 60},
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}, hnCacheControl: {"public, max-age=120"}}, 120},
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}, hnCacheControl: {"max-age=120, s-maxage=30"}}, 30},
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}, hnCacheControl: {"no-store"}}, 0},
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}, hnCacheControl: {"Private"}}, 0},
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}, hnExpires: {now.Add(90 * time.Second).UTC().Format(http.TimeFormat)}}, 90},
+		{PrometheusOriginConfig{}, http.Header{hnLocation: {"/login"}, hnExpires: {"0"}}, 0},
+		{PrometheusOriginConfig{}, http.Header{}, 0},
+	}
+
+	for i, test := range tests {
+		if ttl := test.o.redirectTTL(test.h, now); ttl != test.ttl {
+			t.Errorf("test %d: wanted %d got %d.", i, test.ttl, ttl)
+		}
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_cacheRedirects(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	requests := 0
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "/login?next="+r.URL.Path, http.StatusFound)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	get := func(path string) *http.Response {
+		w := httptest.NewRecorder()
+		tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+path, nil))
+		return w.Result()
+	}
+
+	// it should proxy every redirect by default
+	get("/graph")
+	get("/graph")
+	if requests != 2 {
+		t.Errorf("wanted %d got %d.", 2, requests)
+	}
+
+	o := tr.Config.Origins["default"]
+	o.CacheRedirects = true
+	o.AllowClientRefresh = true
+	tr.Config.Origins["default"] = o
+
+	// it should replay a cached redirect with its Location
+	requests = 0
+	get("/graph")
+	resp := get("/graph")
+	if requests != 1 {
+		t.Errorf("wanted %d got %d.", 1, requests)
+	}
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("wanted %d got %d.", http.StatusFound, resp.StatusCode)
+	}
+	if l := resp.Header.Get(hnLocation); l != "/login?next=/graph" {
+		t.Errorf("wanted %q got %q.", "/login?next=/graph", l)
+	}
+
+	// it should cache redirects of different paths separately
+	if l := get("/alerts").Header.Get(hnLocation); l != "/login?next=/alerts" {
+		t.Errorf("wanted %q got %q.", "/login?next=/alerts", l)
+	}
+
+	// it should revalidate the cached redirect when the client asks for fresh data
+	requests = 0
+	get("/graph?trickster=refresh")
+	get("/graph")
+	if requests != 1 {
+		t.Errorf("wanted %d got %d.", 1, requests)
+	}
+}
+
+func TestPrometheusOriginConfig_validateRedirectCaching(t *testing.T) {
+	tests := []struct {
+		o  PrometheusOriginConfig
+		ok bool
+	}{
+		{PrometheusOriginConfig{}, true},
+		{PrometheusOriginConfig{CacheRedirects: true, RedirectTTLSecs: 60}, true},
+		{PrometheusOriginConfig{RedirectTTLSecs: -1}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.o.validateRedirectCaching(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
@@ -52,7 +52,30 @@ func (r *RedisCache) Store(cacheKey string, data string, ttl int64) error {
 // Retrieve gets data from the Redis Cache using the provided Key
 func (r *RedisCache) Retrieve(cacheKey string) (string, error) {
 	level.Debug(r.T.Logger).Log("event", "redis cache retrieve", "key", cacheKey)
-	return r.client.Get(cacheKey).Result()
+	data, err := r.client.Get(cacheKey).Result()
+	if err == redis.Nil {
+		return "", &cacheMissError{key: cacheKey}
+	}
+	return data, err
+}
+
+// Expiration returns the unix time at which the data in the Redis Cache using the provided Key expires
+func (r *RedisCache) Expiration(cacheKey string) (int64, error) {
+	ttl, err := r.client.TTL(cacheKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	// Redis reports a negative TTL for a key that does not exist, or that never expires
+	if ttl < 0 {
+		return 0, &cacheMissError{key: cacheKey}
+	}
+	return time.Now().Add(ttl).Unix(), nil
+}
+
+// Delete removes the data from the Redis Cache using the provided Key
+func (r *RedisCache) Delete(cacheKey string) error {
+	level.Debug(r.T.Logger).Log("event", "redis cache delete", "key", cacheKey)
+	return r.client.Del(cacheKey).Err()
 }
 
 // Reap continually iterates through the cache to find expired elements and removes them
@@ -98,6 +121,28 @@ func (r *RedisCache) ReapOnce() {
 	}
 }
 
+// Walk calls fn for each record in the Redis Cache, stopping at the first error.
+// Redis expires records itself, so every key found is unexpired.
+func (r *RedisCache) Walk(fn func(CacheObject) error) error {
+	iter := r.client.Scan(0, "", 0).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		data, err := r.client.Get(key).Result()
+		if err != nil {
+			// the key expired or was removed since it was scanned
+			continue
+		}
+		ttl, err := r.client.TTL(key).Result()
+		if err != nil {
+			return err
+		}
+		if err := fn(CacheObject{Key: key, Value: data, Expiration: time.Now().Add(ttl).Unix()}); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
 // Close disconnects from the Redis Cache
 func (r *RedisCache) Close() error {
 	level.Info(r.T.Logger).Log("event", "closing redis connection")
@@ -15,6 +15,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/go-kit/kit/log"
@@ -88,6 +89,35 @@ func TestRedisCache_Retrieve(t *testing.T) {
 	}
 }
 
+func TestRedisCache_Expiration(t *testing.T) {
+	rc, close := setupRedisCache()
+	defer close()
+
+	err := rc.Connect()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should report a miss for an absent key
+	if _, err := rc.Expiration("cacheKey"); !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+
+	err = rc.Store("cacheKey", "data", 60)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should return the expiration of a stored value
+	exp, err := rc.Expiration("cacheKey")
+	if err != nil {
+		t.Error(err)
+	}
+	if now := time.Now().Unix(); exp < now+59 || exp > now+60 {
+		t.Errorf("wanted %d got %d.", now+60, exp)
+	}
+}
+
 func TestRedisCache_ReapOnce(t *testing.T) {
 	rc, close := setupRedisCache()
 	defer close()
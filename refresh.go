@@ -0,0 +1,77 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	hnPragma = "Pragma"
+
+	// Default names of the client cache directive url parameter and header
+	defaultRefreshParam  = "trickster"
+	defaultRefreshHeader = "X-Trickster-Cache"
+
+	// Client cache directives
+	cdRefresh = "refresh"
+	cdBypass  = "bypass"
+)
+
+// refreshParam returns the name of the url parameter clients may use to send a cache directive
+func (o PrometheusOriginConfig) refreshParam() string {
+	if o.RefreshParam == "" {
+		return defaultRefreshParam
+	}
+	return o.RefreshParam
+}
+
+// refreshHeader returns the name of the request header clients may use to send a cache directive
+func (o PrometheusOriginConfig) refreshHeader() string {
+	if o.RefreshHeader == "" {
+		return defaultRefreshHeader
+	}
+	return o.RefreshHeader
+}
+
+// cacheDirective returns the cache directive the client sent for this request, if the origin allows it:
+// "refresh" forces the cache to be revalidated from the origin, and "bypass" proxies the request without caching.
+// Requests carrying credentials to origins that do not cache them are always bypassed.
+func cacheDirective(o PrometheusOriginConfig, r *http.Request) string {
+	if !o.cachesCredentialedRequest(r) {
+		return cdBypass
+	}
+	if !o.AllowClientRefresh {
+		return ""
+	}
+	d := r.URL.Query().Get(o.refreshParam())
+	if d == "" {
+		d = r.Header.Get(o.refreshHeader())
+	}
+	switch d = strings.ToLower(d); d {
+	case cdRefresh, cdBypass:
+		return d
+	}
+	return ""
+}
+
+// noCacheRequested returns true if the client sent a Cache-Control or Pragma no-cache request header,
+// and the origin does not ignore it
+func noCacheRequested(o PrometheusOriginConfig, r *http.Request) bool {
+	if o.IgnoreNoCacheHeader {
+		return false
+	}
+	return strings.ToLower(r.Header.Get(hnCacheControl)) == hvNoCache || strings.ToLower(r.Header.Get(hnPragma)) == hvNoCache
+}
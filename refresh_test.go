@@ -0,0 +1,97 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheDirective(t *testing.T) {
+	o := PrometheusOriginConfig{AllowClientRefresh: true}
+
+	tests := []struct {
+		url    string
+		header string
+		want   string
+	}{
+		{"http://trickster/api/v1/query?query=up", "", ""},
+		{"http://trickster/api/v1/query?query=up&trickster=refresh", "", cdRefresh},
+		{"http://trickster/api/v1/query?query=up&trickster=BYPASS", "", cdBypass},
+		{"http://trickster/api/v1/query?query=up&trickster=other", "", ""},
+		{"http://trickster/api/v1/query?query=up", cdRefresh, cdRefresh},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.header != "" {
+			r.Header.Set(defaultRefreshHeader, test.header)
+		}
+		if d := cacheDirective(o, r); d != test.want {
+			t.Errorf("wanted %q got %q.", test.want, d)
+		}
+	}
+
+	// it should ignore directives unless the origin allows them
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query?query=up&trickster=refresh", nil)
+	if d := cacheDirective(PrometheusOriginConfig{}, r); d != "" {
+		t.Errorf("wanted %q got %q.", "", d)
+	}
+}
+
+func TestNoCacheRequested(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query?query=up", nil)
+	r.Header.Set(hnPragma, "no-cache")
+
+	if !noCacheRequested(PrometheusOriginConfig{}, r) {
+		t.Errorf("expected Pragma: no-cache to be honored")
+	}
+	if noCacheRequested(PrometheusOriginConfig{IgnoreNoCacheHeader: true}, r) {
+		t.Errorf("expected Pragma: no-cache to be ignored")
+	}
+}
+
+func TestTricksterHandler_buildRequestContext_refresh(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.AllowClientRefresh = true
+	o.MaxValueAgeSecs = 0x7fffffff
+	tr.Config.Origins["default"] = o
+
+	ctx, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Cacher.Store(ctx.CacheKey, exampleRangeResponse, 60)
+
+	// it should force revalidation, without the directive affecting the cache key or the origin params
+	ctx2, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery+"&trickster=refresh", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx2.CacheKey != ctx.CacheKey {
+		t.Errorf("wanted %s got %s.", ctx.CacheKey, ctx2.CacheKey)
+	}
+	if ctx2.CacheLookupResult != crPurge {
+		t.Errorf("wanted %s got %s.", crPurge, ctx2.CacheLookupResult)
+	}
+	if _, ok := ctx2.RequestParams[defaultRefreshParam]; ok {
+		t.Errorf("expected the %s param to be removed", defaultRefreshParam)
+	}
+}
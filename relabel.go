@@ -0,0 +1,250 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Relabel actions
+	raReplace   = "replace"
+	raKeep      = "keep"
+	raDrop      = "drop"
+	raLabelMap  = "labelmap"
+	raLabelDrop = "labeldrop"
+	raLabelKeep = "labelkeep"
+
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelSeparator   = ";"
+	defaultRelabelReplacement = "$1"
+)
+
+// RelabelConfig is a Prometheus-style relabeling rule applied to the series returned to the client
+type RelabelConfig struct {
+	// SourceLabels lists the labels whose values are concatenated (using Separator) and matched against Regex
+	SourceLabels []string `toml:"source_labels"`
+	// Separator is placed between concatenated source label values. Default is ";"
+	Separator string `toml:"separator"`
+	// Regex is matched against the concatenated source label values (or label names for labelmap/labeldrop/labelkeep). Default is "(.*)"
+	Regex string `toml:"regex"`
+	// TargetLabel is the label written by the replace action
+	TargetLabel string `toml:"target_label"`
+	// Replacement is the value written by the replace and labelmap actions, with regex group references expanded. Default is "$1"
+	Replacement string `toml:"replacement"`
+	// Action is one of "replace" (default), "keep", "drop", "labelmap", "labeldrop" or "labelkeep"
+	Action string `toml:"action"`
+}
+
+// relabelRegexps caches compiled relabel expressions by their source
+var relabelRegexps sync.Map
+
+func (rc RelabelConfig) regexp() (*regexp.Regexp, error) {
+	expr := rc.Regex
+	if expr == "" {
+		expr = defaultRelabelRegex
+	}
+	if re, ok := relabelRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	// Prometheus relabel expressions are fully anchored
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	relabelRegexps.Store(expr, re)
+	return re, nil
+}
+
+// validate returns an error if the rule has an unknown action or an invalid expression
+func (rc RelabelConfig) validate() error {
+	switch rc.action() {
+	case raReplace:
+		if rc.TargetLabel == "" {
+			return fmt.Errorf("relabel action %q requires a target_label", raReplace)
+		}
+	case raKeep, raDrop, raLabelMap, raLabelDrop, raLabelKeep:
+	default:
+		return fmt.Errorf("unknown relabel action %q", rc.Action)
+	}
+	if _, err := rc.regexp(); err != nil {
+		return fmt.Errorf("invalid relabel regex %q: %v", rc.Regex, err)
+	}
+	return nil
+}
+
+func (rc RelabelConfig) action() string {
+	if rc.Action == "" {
+		return raReplace
+	}
+	return strings.ToLower(rc.Action)
+}
+
+// relabel applies the rules to a copy of the provided metric, returning nil if the series should be dropped
+func relabel(m model.Metric, rules []RelabelConfig) model.Metric {
+	m = m.Clone()
+
+	for _, rc := range rules {
+		re, err := rc.regexp()
+		if err != nil {
+			// invalid rules are rejected at config load, so this is unreachable for loaded configs
+			continue
+		}
+
+		separator := rc.Separator
+		if separator == "" {
+			separator = defaultRelabelSeparator
+		}
+		replacement := rc.Replacement
+		if replacement == "" {
+			replacement = defaultRelabelReplacement
+		}
+
+		values := make([]string, 0, len(rc.SourceLabels))
+		for _, l := range rc.SourceLabels {
+			values = append(values, string(m[model.LabelName(l)]))
+		}
+		source := strings.Join(values, separator)
+
+		switch rc.action() {
+		case raReplace:
+			indexes := re.FindStringSubmatchIndex(source)
+			if indexes == nil {
+				continue
+			}
+			target := model.LabelName(re.ExpandString([]byte{}, rc.TargetLabel, source, indexes))
+			value := re.ExpandString([]byte{}, replacement, source, indexes)
+			if len(value) == 0 {
+				delete(m, target)
+				continue
+			}
+			m[target] = model.LabelValue(value)
+		case raKeep:
+			if !re.MatchString(source) {
+				return nil
+			}
+		case raDrop:
+			if re.MatchString(source) {
+				return nil
+			}
+		case raLabelMap:
+			mapped := model.Metric{}
+			for name, value := range m {
+				if re.MatchString(string(name)) {
+					mapped[model.LabelName(re.ReplaceAllString(string(name), replacement))] = value
+				}
+			}
+			for name, value := range mapped {
+				m[name] = value
+			}
+		case raLabelDrop:
+			for name := range m {
+				if re.MatchString(string(name)) {
+					delete(m, name)
+				}
+			}
+		case raLabelKeep:
+			for name := range m {
+				if !re.MatchString(string(name)) {
+					delete(m, name)
+				}
+			}
+		}
+	}
+
+	return m
+}
+
+// relabel applies the rules to each series in the matrix, removing any series that are dropped. Series that end up
+// with the same labels, e.g. once labeldrop removes the only label telling them apart, are merged into one, whose
+// value at a timestamp is that of the first series with a point at it.
+func (pe *PrometheusMatrixEnvelope) relabel(rules []RelabelConfig) {
+	if len(rules) == 0 {
+		return
+	}
+	result := make(model.Matrix, 0, len(pe.Data.Result))
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for _, ss := range pe.Data.Result {
+		m := relabel(ss.Metric, rules)
+		if m == nil {
+			continue
+		}
+		if merged, ok := series[m.Fingerprint()]; ok {
+			merged.Values = mergeSamplePairs(merged.Values, ss.Values)
+			continue
+		}
+		s := &model.SampleStream{Metric: m, Values: ss.Values}
+		series[m.Fingerprint()] = s
+		result = append(result, s)
+	}
+	pe.Data.Result = result
+}
+
+// mergeSamplePairs returns the points of a and b in timestamp order, keeping those of a where both have a point at
+// the same timestamp
+func mergeSamplePairs(a, b []model.SamplePair) []model.SamplePair {
+	merged := make([]model.SamplePair, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].Timestamp < b[0].Timestamp:
+			merged, a = append(merged, a[0]), a[1:]
+		case b[0].Timestamp < a[0].Timestamp:
+			merged, b = append(merged, b[0]), b[1:]
+		default:
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// relabel applies the rules to each sample in the vector, removing any samples that are dropped. Of the samples that
+// end up with the same labels, only the first is kept.
+func (pv *PrometheusVectorEnvelope) relabel(rules []RelabelConfig) {
+	if len(rules) == 0 {
+		return
+	}
+	result := make(model.Vector, 0, len(pv.Data.Result))
+	seen := map[model.Fingerprint]bool{}
+	for _, s := range pv.Data.Result {
+		m := relabel(s.Metric, rules)
+		if m == nil || seen[m.Fingerprint()] {
+			continue
+		}
+		seen[m.Fingerprint()] = true
+		result = append(result, &model.Sample{Metric: m, Value: s.Value, Timestamp: s.Timestamp})
+	}
+	pv.Data.Result = result
+}
+
+// relabelVectorBody applies the rules to an instantaneous query response body. Bodies that are not
+// successful vector results (e.g., scalars or errors) are returned unmodified.
+func relabelVectorBody(body []byte, rules []RelabelConfig) []byte {
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal(body, &pv); err != nil || pv.Status != rvSuccess || pv.Data.ResultType != rvVector {
+		return body
+	}
+	pv.relabel(rules)
+	b, err := json.Marshal(pv)
+	if err != nil {
+		return body
+	}
+	return b
+}
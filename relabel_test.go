@@ -0,0 +1,185 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestRelabel(t *testing.T) {
+	in := model.Metric{"__name__": "up", "job": "node", "instance": "localhost:9091", "dc": "us-east-1a"}
+
+	tests := []struct {
+		rules []RelabelConfig
+		out   model.Metric
+	}{
+		// no rules
+		{
+			nil,
+			in,
+		},
+		// drop a high-cardinality label
+		{
+			[]RelabelConfig{{Action: raLabelDrop, Regex: "instance"}},
+			model.Metric{"__name__": "up", "job": "node", "dc": "us-east-1a"},
+		},
+		// rename a datacenter label value
+		{
+			[]RelabelConfig{{SourceLabels: []string{"dc"}, Regex: "(us-east-1).*", TargetLabel: "region"}},
+			model.Metric{"__name__": "up", "job": "node", "instance": "localhost:9091", "dc": "us-east-1a", "region": "us-east-1"},
+		},
+		// keep only the listed labels
+		{
+			[]RelabelConfig{{Action: raLabelKeep, Regex: "__name__|job"}},
+			model.Metric{"__name__": "up", "job": "node"},
+		},
+		// map labels to new names
+		{
+			[]RelabelConfig{{Action: raLabelMap, Regex: "d(c)", Replacement: "${1}_zone"}, {Action: raLabelDrop, Regex: "dc"}},
+			model.Metric{"__name__": "up", "job": "node", "instance": "localhost:9091", "c_zone": "us-east-1a"},
+		},
+		// keep series that match
+		{
+			[]RelabelConfig{{Action: raKeep, SourceLabels: []string{"job"}, Regex: "node"}},
+			in,
+		},
+		// drop series that match
+		{
+			[]RelabelConfig{{Action: raDrop, SourceLabels: []string{"job", "dc"}, Regex: "node;us-.*"}},
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out := relabel(in, test.rules)
+			if !reflect.DeepEqual(out, test.out) {
+				t.Fatalf("Mismatch\nactual=%v\nexpected=%v", out, test.out)
+			}
+		})
+	}
+
+	// it should not modify the input metric
+	if len(in) != 4 {
+		t.Errorf("input metric was modified: %v", in)
+	}
+}
+
+func TestRelabelConfig_validate(t *testing.T) {
+	if err := (RelabelConfig{Action: "bogus"}).validate(); err == nil {
+		t.Errorf("expected error for unknown action")
+	}
+	if err := (RelabelConfig{Action: raLabelDrop, Regex: "("}).validate(); err == nil {
+		t.Errorf("expected error for invalid regex")
+	}
+	if err := (RelabelConfig{SourceLabels: []string{"job"}}).validate(); err == nil {
+		t.Errorf("expected error for replace without target_label")
+	}
+	if err := (RelabelConfig{Action: raDrop, SourceLabels: []string{"job"}, Regex: "node"}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrometheusMatrixEnvelope_relabel(t *testing.T) {
+	pm := PrometheusMatrixEnvelope{}
+	err := json.Unmarshal([]byte(exampleRangeResponse), &pm)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// it should remove dropped series and keep the values of the others
+	pm.relabel([]RelabelConfig{{Action: raDrop, SourceLabels: []string{"job"}, Regex: "node"}})
+	if len(pm.Data.Result) != 1 {
+		t.Errorf("wanted 1 series got %d.", len(pm.Data.Result))
+	}
+	if pm.getValueCount() != 3 {
+		t.Errorf("wanted 3 got %d.", pm.getValueCount())
+	}
+
+	// it should merge the series left with the same labels, keeping the values of the first one
+	pm = PrometheusMatrixEnvelope{}
+	json.Unmarshal([]byte(exampleRangeResponse), &pm)
+	pm.relabel([]RelabelConfig{{Action: raLabelKeep, Regex: "__name__"}})
+	if len(pm.Data.Result) != 1 {
+		t.Fatalf("wanted 1 series got %d.", len(pm.Data.Result))
+	}
+	for i, v := range pm.Data.Result[0].Values {
+		if v.Value != 1 {
+			t.Errorf("test %d: unexpected result %v", i, v)
+		}
+	}
+	if pm.getValueCount() != 3 {
+		t.Errorf("wanted 3 got %d.", pm.getValueCount())
+	}
+}
+
+func TestMergeSamplePairs(t *testing.T) {
+	points := func(values ...int64) []model.SamplePair {
+		p := make([]model.SamplePair, 0, len(values))
+		for _, v := range values {
+			p = append(p, model.SamplePair{Timestamp: model.TimeFromUnix(v), Value: model.SampleValue(v)})
+		}
+		return p
+	}
+
+	tests := []struct {
+		a, b, want []model.SamplePair
+	}{
+		{points(1, 3, 5), points(2, 4, 6), points(1, 2, 3, 4, 5, 6)},
+		{points(4, 5), points(1, 2), points(1, 2, 4, 5)},
+		{points(1, 2), nil, points(1, 2)},
+		{nil, points(1, 2), points(1, 2)},
+		{points(1, 2, 3), []model.SamplePair{{Timestamp: model.TimeFromUnix(2), Value: -1}}, points(1, 2, 3)},
+	}
+	for i, test := range tests {
+		if got := mergeSamplePairs(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("test %d: unexpected result %v", i, got)
+		}
+	}
+}
+
+func TestRelabelVectorBody(t *testing.T) {
+	body := relabelVectorBody([]byte(exampleResponse), []RelabelConfig{{Action: raLabelDrop, Regex: "instance"}})
+
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal(body, &pv); err != nil {
+		t.Error(err)
+	}
+	for _, s := range pv.Data.Result {
+		if _, ok := s.Metric["instance"]; ok {
+			t.Errorf("expected instance label to be dropped")
+		}
+	}
+
+	// it should keep only the first of the samples left with the same labels
+	body = relabelVectorBody([]byte(exampleResponse), []RelabelConfig{{Action: raLabelDrop, Regex: "instance|job"}})
+	pv = PrometheusVectorEnvelope{}
+	if err := json.Unmarshal(body, &pv); err != nil {
+		t.Error(err)
+	}
+	if len(pv.Data.Result) != 1 || pv.Data.Result[0].Value != 1 {
+		t.Errorf("unexpected result %v", pv.Data.Result)
+	}
+
+	// it should pass through non-vector bodies
+	scalar := `{"status":"success","data":{"resultType":"scalar","result":[1435781451.781,"1"]}}`
+	if string(relabelVectorBody([]byte(scalar), []RelabelConfig{{Action: raLabelDrop, Regex: "instance"}})) != scalar {
+		t.Errorf("expected scalar body to be unmodified")
+	}
+}
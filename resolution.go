@@ -0,0 +1,118 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// ResolutionTier describes the resolution an origin serves data at once it is older than MinAgeSecs, such as the
+// downsampled blocks of Thanos or IRONdb
+type ResolutionTier struct {
+	// MinAgeSecs is the age, in seconds, beyond which the origin serves data at this tier's resolution
+	MinAgeSecs int64 `toml:"min_age_secs"`
+	// ResolutionSecs is the interval, in seconds, of the samples the origin serves in this tier (e.g., 300 for 5m)
+	ResolutionSecs int64 `toml:"resolution_secs"`
+}
+
+// resolutionExtent describes the resolution of the cached points within the extent
+type resolutionExtent struct {
+	Start          int64 `json:"start"`
+	End            int64 `json:"end"`
+	ResolutionSecs int64 `json:"resolutionSecs"`
+}
+
+// validateResolutionTiers checks that the tiers are in ascending order of age and resolution
+func validateResolutionTiers(tiers []ResolutionTier) error {
+	for i, rt := range tiers {
+		if rt.MinAgeSecs <= 0 || rt.ResolutionSecs <= 0 {
+			return fmt.Errorf("resolution tier %d: min_age_secs and resolution_secs must be greater than 0", i)
+		}
+		if i > 0 && (rt.MinAgeSecs <= tiers[i-1].MinAgeSecs || rt.ResolutionSecs <= tiers[i-1].ResolutionSecs) {
+			return fmt.Errorf("resolution tier %d: tiers must be in ascending order of min_age_secs and resolution_secs", i)
+		}
+	}
+	return nil
+}
+
+// resolutionExtents splits the extents (in ms) at the boundaries of the origin's resolution tiers, as of now (in
+// epoch seconds), returning the newest first. Data in no tier is at the origin's raw resolution, 0.
+func (o PrometheusOriginConfig) resolutionExtents(e MatrixExtents, now int64) []resolutionExtent {
+	extents := []resolutionExtent{}
+	end := e.End
+	for i := -1; i < len(o.ResolutionTiers) && end >= e.Start; i++ {
+		var res int64
+		if i >= 0 {
+			res = o.ResolutionTiers[i].ResolutionSecs
+		}
+		// the points of this tier are those no older than the next tier's min age
+		start := e.Start
+		if i+1 < len(o.ResolutionTiers) {
+			start = max64(start, (now-o.ResolutionTiers[i+1].MinAgeSecs)*1000)
+		}
+		if start <= end {
+			extents = append(extents, resolutionExtent{Start: start, End: end, ResolutionSecs: res})
+			end = start - 1
+		}
+	}
+	return extents
+}
+
+// staleResolutionEnd returns the time (in ms) of the newest point in the recorded extents that the origin would now
+// serve at a different resolution than the one it was cached at, or 0 if there is none
+func (o PrometheusOriginConfig) staleResolutionEnd(recorded []resolutionExtent, now int64) int64 {
+	var stale int64
+	for _, r := range recorded {
+		for _, c := range o.resolutionExtents(MatrixExtents{Start: r.Start, End: r.End}, now) {
+			if c.ResolutionSecs != r.ResolutionSecs && c.End > stale {
+				stale = c.End
+			}
+		}
+	}
+	return stale
+}
+
+// cropStaleResolutions removes the points of the context's cached data set that the origin now serves at a coarser
+// resolution than the one they were cached at, so that they are fetched again rather than merged with the points at
+// the new resolution. Since the cached data set must not have gaps, every older point is removed along with them.
+// Data sets whose resolutions were not recorded are discarded.
+func (t *TricksterHandler) cropStaleResolutions(ctx *ClientRequestContext) {
+	var info cacheRecordInfo
+	data, err := t.Cacher.Retrieve(ctx.CacheKey + recordInfoSuffix)
+	if err == nil {
+		err = json.Unmarshal([]byte(data), &info)
+	}
+	if err != nil || len(info.Resolutions) == 0 {
+		level.Debug(t.Logger).Log(lfEvent, "discarding cached data set without recorded resolutions", lfCacheKey, ctx.CacheKey)
+		ctx.Matrix = defaultPrometheusMatrixEnvelope()
+		return
+	}
+	if end := ctx.Origin.staleResolutionEnd(info.Resolutions, t.originNow(ctx.Origin)); end > 0 {
+		level.Debug(t.Logger).Log(lfEvent, "cropping cached points at a stale resolution", lfCacheKey, ctx.CacheKey, "end", end)
+		ctx.Matrix.cropToRange(end+1, 0)
+	}
+}
+
+// recordInfo returns the info of the query_range data set cached for the context, with the resolutions of its points
+// when the origin has resolution tiers
+func (t *TricksterHandler) recordInfo(ctx *ClientRequestContext, cached PrometheusMatrixEnvelope) cacheRecordInfo {
+	info := cacheRecordInfo{Origin: ctx.Origin.OriginURL, Query: ctx.RequestParams.Get(upQuery)}
+	if len(ctx.Origin.ResolutionTiers) > 0 {
+		info.Resolutions = ctx.Origin.resolutionExtents(cached.getExtents(), t.originNow(ctx.Origin))
+	}
+	return info
+}
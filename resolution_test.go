@@ -0,0 +1,143 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestValidateResolutionTiers(t *testing.T) {
+	tests := []struct {
+		tiers []ResolutionTier
+		valid bool
+	}{
+		{nil, true},
+		{[]ResolutionTier{{MinAgeSecs: 86400, ResolutionSecs: 300}, {MinAgeSecs: 864000, ResolutionSecs: 3600}}, true},
+		{[]ResolutionTier{{MinAgeSecs: 86400}}, false},
+		{[]ResolutionTier{{MinAgeSecs: 864000, ResolutionSecs: 300}, {MinAgeSecs: 86400, ResolutionSecs: 3600}}, false},
+		{[]ResolutionTier{{MinAgeSecs: 86400, ResolutionSecs: 3600}, {MinAgeSecs: 864000, ResolutionSecs: 300}}, false},
+	}
+	for i, test := range tests {
+		if err := validateResolutionTiers(test.tiers); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestPrometheusOriginConfig_resolutionExtents(t *testing.T) {
+	now := int64(10000)
+	o := PrometheusOriginConfig{ResolutionTiers: []ResolutionTier{{MinAgeSecs: 1000, ResolutionSecs: 60},
+		{MinAgeSecs: 5000, ResolutionSecs: 300}}}
+	tests := []struct {
+		extents MatrixExtents
+		want    []resolutionExtent
+	}{
+		{MatrixExtents{9500000, 9900000}, []resolutionExtent{{9500000, 9900000, 0}}},
+		{MatrixExtents{8000000, 9900000}, []resolutionExtent{{9000000, 9900000, 0}, {8000000, 8999999, 60}}},
+		{MatrixExtents{1000000, 9900000}, []resolutionExtent{{9000000, 9900000, 0}, {5000000, 8999999, 60},
+			{1000000, 4999999, 300}}},
+		{MatrixExtents{1000000, 2000000}, []resolutionExtent{{1000000, 2000000, 300}}},
+	}
+	for i, test := range tests {
+		if extents := o.resolutionExtents(test.extents, now); !reflect.DeepEqual(extents, test.want) {
+			t.Errorf("test %d: unexpected result %v", i, extents)
+		}
+	}
+
+	// it should find the points that aged into a coarser tier since they were recorded
+	recorded := o.resolutionExtents(MatrixExtents{8000000, 9900000}, now)
+	if end := o.staleResolutionEnd(recorded, now); end != 0 {
+		t.Errorf("wanted %d got %d.", 0, end)
+	}
+	if end := o.staleResolutionEnd(recorded, now+500); end != 9499999 {
+		t.Errorf("wanted %d got %d.", 9499999, end)
+	}
+}
+
+func TestTricksterHandler_resolutionTiers(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the origin returns a point at every step of the requested range
+	var starts []int64
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := parseTime(r.FormValue(upStart))
+		end, _ := parseTime(r.FormValue(upEnd))
+		starts = append(starts, start.Unix())
+		ss := &model.SampleStream{Metric: model.Metric{"__name__": "up"}}
+		for ts := start.Unix(); ts <= end.Unix(); ts += 60 {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: 1})
+		}
+		json.NewEncoder(w).Encode(PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{ss}}})
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.FastForwardDisable = true
+	o.ResolutionTiers = []ResolutionTier{{MinAgeSecs: 3600, ResolutionSecs: 300}}
+	tr.Config.Origins["default"] = o
+
+	now := time.Now().Unix()
+	start, end := now-7200-now%60, now-600-now%60
+	query := func() {
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", fmt.Sprintf("%s/api/v1/query_range?%s", es.URL,
+			url.Values{upQuery: {"up"}, upStart: {fmt.Sprint(start)}, upEnd: {fmt.Sprint(end)}, upStep: {"60"}}.Encode()), nil))
+	}
+
+	// it should record the resolution of the cached points
+	query()
+	ctx, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf(
+		"%s/api/v1/query_range?query=up&start=%d&end=%d&step=60", es.URL, start, end), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info cacheRecordInfo
+	data, _ := tr.Cacher.Retrieve(ctx.CacheKey + recordInfoSuffix)
+	json.Unmarshal([]byte(data), &info)
+	if len(info.Resolutions) != 2 || info.Resolutions[1].ResolutionSecs != 300 {
+		t.Fatalf("unexpected resolutions %v", info.Resolutions)
+	}
+
+	// it should serve points at their recorded resolutions from the cache
+	query()
+	if len(starts) != 1 {
+		t.Errorf("wanted %d got %d.", 1, len(starts))
+	}
+
+	// it should fetch the points that aged into a coarser tier again, when they were cached at a finer one
+	info.Resolutions = []resolutionExtent{{Start: start * 1000, End: end * 1000}}
+	b, _ := json.Marshal(info)
+	tr.Cacher.Store(ctx.CacheKey+recordInfoSuffix, string(b), 60)
+	query()
+	if len(starts) != 2 || starts[1] != start {
+		t.Errorf("unexpected upstream requests %v", starts)
+	}
+
+	// it should discard a data set without recorded resolutions
+	tr.Cacher.Delete(ctx.CacheKey + recordInfoSuffix)
+	query()
+	if len(starts) != 3 || starts[2] != start {
+		t.Errorf("unexpected upstream requests %v", starts)
+	}
+}
@@ -0,0 +1,64 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// readResponseBody reads the body of an origin response, failing once it exceeds maxBytes. 0 is unlimited.
+func readResponseBody(body io.Reader, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		return ioutil.ReadAll(body)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxBytes {
+		return nil, classify(ecTooLarge, fmt.Errorf("response body exceeds max_response_bytes (%d)", maxBytes))
+	}
+	return b, nil
+}
+
+// checkMatrixLimits returns an error if the matrix parsed from the origin's response has more series or points than
+// the origin allows
+func (o PrometheusOriginConfig) checkMatrixLimits(pe PrometheusMatrixEnvelope) error {
+	if o.MaxResponseSeries > 0 && len(pe.Data.Result) > o.MaxResponseSeries {
+		return classify(ecTooLarge, fmt.Errorf("response has %d series, exceeding max_response_series (%d)", len(pe.Data.Result), o.MaxResponseSeries))
+	}
+	if n := pe.getValueCount(); o.MaxResponsePoints > 0 && n > o.MaxResponsePoints {
+		return classify(ecTooLarge, fmt.Errorf("response has %d points, exceeding max_response_points (%d)", n, o.MaxResponsePoints))
+	}
+	return nil
+}
+
+// checkVectorLimits returns an error if the vector parsed from the origin's response has more series than the origin
+// allows
+func (o PrometheusOriginConfig) checkVectorLimits(pv PrometheusVectorEnvelope) error {
+	if o.MaxResponseSeries > 0 && len(pv.Data.Result) > o.MaxResponseSeries {
+		return classify(ecTooLarge, fmt.Errorf("response has %d series, exceeding max_response_series (%d)", len(pv.Data.Result), o.MaxResponseSeries))
+	}
+	return nil
+}
+
+// validateResponseLimits returns an error if any of the origin's response limits are negative
+func (o PrometheusOriginConfig) validateResponseLimits() error {
+	if o.MaxResponseBytes < 0 || o.MaxResponseSeries < 0 || o.MaxResponsePoints < 0 {
+		return fmt.Errorf("response limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestReadResponseBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		maxBytes int64
+		ok       bool
+	}{
+		{"0123456789", 0, true},
+		{"0123456789", 10, true},
+		{"0123456789", 9, false},
+	}
+
+	for i, test := range tests {
+		b, err := readResponseBody(strings.NewReader(test.body), test.maxBytes)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+		if err == nil && string(b) != test.body {
+			t.Errorf("test %d: wanted %q got %q.", i, test.body, string(b))
+		}
+		if err != nil && errorClass(err) != ecTooLarge {
+			t.Errorf("test %d: wanted %q got %q.", i, ecTooLarge, errorClass(err))
+		}
+	}
+}
+
+func TestPrometheusOriginConfig_checkMatrixLimits(t *testing.T) {
+	pe := PrometheusMatrixEnvelope{}
+	pe.Data.Result = model.Matrix{
+		&model.SampleStream{Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}},
+		&model.SampleStream{Values: []model.SamplePair{{Timestamp: 1000, Value: 1}}},
+	}
+
+	tests := []struct {
+		o  PrometheusOriginConfig
+		ok bool
+	}{
+		{PrometheusOriginConfig{}, true},
+		{PrometheusOriginConfig{MaxResponseSeries: 2, MaxResponsePoints: 3}, true},
+		{PrometheusOriginConfig{MaxResponseSeries: 1}, false},
+		{PrometheusOriginConfig{MaxResponsePoints: 2}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.o.checkMatrixLimits(pe); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestParseMatrix_depth(t *testing.T) {
+	// it should refuse deeply nested values rather than recursing into them
+	body := `{"status":"success","data":{"resultType":"matrix","result":[],"x":` + strings.Repeat("[", 10000) + strings.Repeat("]", 10000) + `}}`
+	pe := PrometheusMatrixEnvelope{}
+	if err := parseMatrix([]byte(body), &pe); err == nil || !strings.Contains(err.Error(), "nesting") {
+		t.Errorf("unexpected result %v", err)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_responseLimits(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.MaxResponseBytes = 64
+	tr.Config.Origins["default"] = o
+
+	// it should respond 502 when the origin's response exceeds the limits
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("wanted %d got %d.", http.StatusBadGateway, w.Code)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.Errors.WithLabelValues(es.URL, psOrigin, ecTooLarge)); v == 0 {
+		t.Errorf("expected the error to be counted")
+	}
+}
@@ -0,0 +1,89 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// PrometheusResultEnvelope represents a response object from the Prometheus HTTP API of any result type,
+// with the result left undecoded until its type is known
+type PrometheusResultEnvelope struct {
+	Status string               `json:"status"`
+	Data   PrometheusResultData `json:"data"`
+}
+
+// PrometheusResultData represents the Data body of a response object of any result type from the Prometheus HTTP API
+type PrometheusResultData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// resultType returns the result type of a Prometheus API response, or an empty string if it cannot be decoded
+func resultType(body []byte) string {
+	re := PrometheusResultEnvelope{}
+	if err := json.Unmarshal(body, &re); err != nil {
+		return ""
+	}
+	return re.Data.ResultType
+}
+
+// decodeAsMatrix decodes a Prometheus API response of a matrix, vector or scalar result type as a matrix, so that
+// results of any numeric type can be cached and merged. Each sample of a vector becomes a single-point series,
+// and a scalar becomes a single-point series with no labels. String results have no numeric value and return an error.
+func decodeAsMatrix(body []byte, pe *PrometheusMatrixEnvelope) error {
+	re := PrometheusResultEnvelope{}
+	if err := json.Unmarshal(body, &re); err != nil {
+		return err
+	}
+
+	pe.Status = re.Status
+	pe.Data.ResultType = rvMatrix
+	pe.Data.Result = model.Matrix{}
+
+	if len(re.Data.Result) == 0 {
+		return nil
+	}
+
+	switch re.Data.ResultType {
+	case rvMatrix:
+		return json.Unmarshal(re.Data.Result, &pe.Data.Result)
+	case rvVector:
+		v := model.Vector{}
+		if err := json.Unmarshal(re.Data.Result, &v); err != nil {
+			return err
+		}
+		for _, s := range v {
+			pe.Data.Result = append(pe.Data.Result, &model.SampleStream{
+				Metric: s.Metric,
+				Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}},
+			})
+		}
+	case rvScalar:
+		s := model.Scalar{}
+		if err := json.Unmarshal(re.Data.Result, &s); err != nil {
+			return err
+		}
+		pe.Data.Result = append(pe.Data.Result, &model.SampleStream{
+			Metric: model.Metric{},
+			Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}},
+		})
+	default:
+		return fmt.Errorf("result type %q cannot be cached as a matrix", re.Data.ResultType)
+	}
+	return nil
+}
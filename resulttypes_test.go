@@ -0,0 +1,110 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	exampleVectorResponse = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"prometheus"},"value":[1435781430.781,"1"]},{"metric":{"__name__":"up","job":"node"},"value":[1435781430.781,"0"]}]}}`
+	exampleScalarResponse = `{"status":"success","data":{"resultType":"scalar","result":[1435781430.781,"42"]}}`
+	exampleStringResponse = `{"status":"success","data":{"resultType":"string","result":[1435781430.781,"hello"]}}`
+)
+
+func TestDecodeAsMatrix(t *testing.T) {
+	// it should decode a vector as single-point series
+	pe := PrometheusMatrixEnvelope{}
+	if err := decodeAsMatrix([]byte(exampleVectorResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if pe.Data.ResultType != rvMatrix {
+		t.Errorf("wanted %q got %q.", rvMatrix, pe.Data.ResultType)
+	}
+	if len(pe.Data.Result) != 2 || pe.getValueCount() != 2 {
+		t.Errorf("wanted %d series got %d.", 2, len(pe.Data.Result))
+	}
+	if pe.Data.Result[0].Metric["job"] != "prometheus" || pe.Data.Result[0].Values[0].Timestamp != 1435781430781 {
+		t.Errorf("unexpected series %v", pe.Data.Result[0])
+	}
+
+	// it should decode a scalar as an unlabeled single-point series
+	pe = PrometheusMatrixEnvelope{}
+	if err := decodeAsMatrix([]byte(exampleScalarResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if len(pe.Data.Result) != 1 || len(pe.Data.Result[0].Metric) != 0 || pe.Data.Result[0].Values[0].Value != 42 {
+		t.Errorf("unexpected matrix %v", pe.Data.Result)
+	}
+
+	// it should decode a matrix unchanged
+	pe = PrometheusMatrixEnvelope{}
+	if err := decodeAsMatrix([]byte(exampleRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if pe.getValueCount() != 6 {
+		t.Errorf("wanted %d got %d.", 6, pe.getValueCount())
+	}
+
+	// it should return an error for string results
+	pe = PrometheusMatrixEnvelope{}
+	if err := decodeAsMatrix([]byte(exampleStringResponse), &pe); err == nil {
+		t.Errorf("expected error for string result")
+	}
+}
+
+func TestResultType(t *testing.T) {
+	tests := map[string]string{
+		exampleRangeResponse:  rvMatrix,
+		exampleVectorResponse: rvVector,
+		exampleScalarResponse: rvScalar,
+		exampleStringResponse: rvString,
+		"not json":            "",
+	}
+	for body, want := range tests {
+		if got := resultType([]byte(body)); got != want {
+			t.Errorf("wanted %q got %q.", want, got)
+		}
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_scalar(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleScalarResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// it should respond with the scalar as a matrix rather than failing
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil)
+	tr.promQueryRangeHandler(w, r)
+
+	resp := w.Result()
+	if resp.StatusCode != 200 {
+		t.Errorf("wanted 200 got %d.", resp.StatusCode)
+	}
+
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	pm := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal(bodyBytes, &pm); err != nil {
+		t.Error(err)
+	}
+	if pm.Data.ResultType != rvMatrix {
+		t.Errorf("wanted %q got %q.", rvMatrix, pm.Data.ResultType)
+	}
+}
@@ -0,0 +1,95 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Listeners that routes are served on
+	lnProxy = "proxy"
+	lnAdmin = "admin"
+
+	// Route match types
+	rmExact  = "exact"
+	rmPrefix = "prefix"
+
+	// Sources of the origin of a proxied route
+	osPath  = "path"
+	osParam = "param_or_host"
+)
+
+// routeInfo describes a registered route
+type routeInfo struct {
+	Listener string   `json:"listener"`
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Methods  []string `json:"methods,omitempty"`
+	Match    string   `json:"match"`
+	Origin   string   `json:"origin,omitempty"`
+}
+
+// proxyRoutes are the names of the routes that are served by an origin
+var proxyRoutes = map[string]bool{rnHealth: true, rnQueryRange: true, rnQuery: true, rnProxy: true}
+
+// listRoutes returns the routes registered on the router, in the order they are matched
+func listRoutes(router *mux.Router, listener string) []routeInfo {
+	routes := []routeInfo{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		ri := routeInfo{Listener: listener, Name: route.GetName(), Match: routeMatchType(route)}
+		ri.Path, _ = route.GetPathTemplate()
+		ri.Methods, _ = route.GetMethods()
+		if proxyRoutes[ri.Name] {
+			ri.Origin = osParam
+			if strings.Contains(ri.Path, "{originMoniker}") {
+				ri.Origin = osPath
+			}
+		}
+		routes = append(routes, ri)
+		return nil
+	})
+	return routes
+}
+
+// routeMatchType returns whether the route matches its path exactly or as a prefix
+func routeMatchType(route *mux.Route) string {
+	// exact path matches are anchored at the end, while prefix matches are not
+	if re, err := route.GetPathRegexp(); err == nil && !strings.HasSuffix(re, "$") {
+		return rmPrefix
+	}
+	return rmExact
+}
+
+// routesHandler handles calls to /trickster/routes, which reports the route table of the proxy listener, and of the
+// admin listener when it is enabled, as JSON
+func (t *TricksterHandler) routesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	routes := []routeInfo{}
+	if t.Router != nil {
+		routes = listRoutes(t.Router, lnProxy)
+	}
+	if t.Config.adminListenerEnabled() {
+		routes = append(routes, listRoutes(t.newAdminRouter(), lnAdmin)...)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(routes)
+}
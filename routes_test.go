@@ -0,0 +1,74 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTricksterHandler_routesHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.newRouter()
+
+	w := httptest.NewRecorder()
+	tr.routesHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/routes", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, w.Result().StatusCode)
+	}
+
+	routes := []routeInfo{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should list the routes in the order they are matched, with the catch-all proxy route last
+	last := routes[len(routes)-1]
+	if last.Name != rnProxy || last.Path != "/" || last.Match != rmPrefix || last.Origin != osParam {
+		t.Errorf("unexpected catch-all route %v", last)
+	}
+
+	// it should describe how each route finds its origin
+	found := false
+	for _, r := range routes {
+		if r.Path == "/{originMoniker}/api/v1/query_range" {
+			found = true
+			if r.Name != rnQueryRange || r.Match != rmExact || r.Origin != osPath || len(r.Methods) != 2 {
+				t.Errorf("unexpected query_range route %v", r)
+			}
+		}
+		if r.Name == rnPing && r.Origin != "" {
+			t.Errorf("expected no origin for the %s route", rnPing)
+		}
+	}
+	if !found {
+		t.Errorf("expected a path-based query_range route")
+	}
+
+	// it should list the admin listener's routes separately when it is enabled
+	tr.Config.Admin.ListenPort = 9091
+	tr.newRouter()
+	w = httptest.NewRecorder()
+	tr.routesHandler(w, httptest.NewRequest("GET", "http://trickster/trickster/routes", nil))
+	routes = []routeInfo{}
+	json.NewDecoder(w.Result().Body).Decode(&routes)
+	for _, r := range routes {
+		if r.Name == rnPing && r.Listener != lnAdmin {
+			t.Errorf("wanted %q got %q.", lnAdmin, r.Listener)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Request priorities
+	prAlerting    = "alerting"
+	prInteractive = "interactive"
+	prBatch       = "batch"
+)
+
+// priorities ranks the request priorities, the highest first
+var priorities = map[string]int{prAlerting: 2, prInteractive: 1, prBatch: 0}
+
+// defaultShedAtPercents are the shares of full load at which the classes of each priority are shed, unless configured
+var defaultShedAtPercents = map[string]int{prAlerting: 150, prInteractive: 100, prBatch: 50}
+
+// priority returns the priority of the class
+func (c LoadSheddingClassConfig) priority() string {
+	if c.Priority == "" {
+		return prInteractive
+	}
+	return strings.ToLower(c.Priority)
+}
+
+// waiter is a request queued until its class and client are within their concurrency limits
+type waiter struct {
+	class  *loadClass
+	client string
+	seq    uint64
+	ready  chan struct{}
+}
+
+// admit starts the request of the class and client when they are within the configured load, returning the function
+// that accounts its end. When they are over a concurrency limit and queueing is enabled, the request waits for its
+// turn, by priority and then arrival, until the queue timeout or the end of the context. Otherwise, or if the wait
+// times out, admit returns the reason the request is shed.
+func (s *LoadShedder) admit(ctx context.Context, lc *loadClass, client string) (func(), string) {
+	if lc.over(atomic.LoadInt64(&s.queued), s.config.MaxUpstreamQueueDepth) {
+		s.shed(client)
+		return nil, lsUpstreamQueue
+	}
+
+	s.mu.Lock()
+	reason := s.blockedReason(lc, client)
+	if reason == "" {
+		s.start(lc, client)
+		s.mu.Unlock()
+		return s.releaser(lc, client), ""
+	}
+	if s.config.QueueTimeoutMS <= 0 {
+		s.account(client).shed++
+		s.mu.Unlock()
+		return nil, reason
+	}
+	w := &waiter{class: lc, client: client, seq: s.seq, ready: make(chan struct{})}
+	s.seq++
+	i := sort.Search(len(s.waiting), func(i int) bool { return s.waiting[i].class.priority < lc.priority })
+	s.waiting = append(s.waiting, nil)
+	copy(s.waiting[i+1:], s.waiting[i:])
+	s.waiting[i] = w
+	s.addWaiting(lc, 1)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(time.Duration(s.config.QueueTimeoutMS) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return s.releaser(lc, client), ""
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.waiting {
+		if s.waiting[i] == w {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			s.addWaiting(lc, -1)
+			s.account(client).shed++
+			return nil, lsQueueTimeout
+		}
+	}
+	// the request was started while timing out
+	return s.releaser(lc, client), ""
+}
+
+// blockedReason returns the concurrency limit that keeps a request of the class and client from starting, or an empty
+// string if it can start. s.mu must be held.
+func (s *LoadShedder) blockedReason(lc *loadClass, client string) string {
+	if lc.maxConcurrent > 0 && s.classInFlight[lc.name] >= lc.maxConcurrent {
+		return lsClassConcurrency
+	}
+	if a, ok := s.clients[client]; ok && s.config.MaxClientConcurrentRequests > 0 &&
+		a.inFlight >= s.config.MaxClientConcurrentRequests {
+		return lsClientConcurrency
+	}
+	if lc.over(int64(s.inFlight), s.config.MaxConcurrentRequests) {
+		return lsConcurrency
+	}
+	return ""
+}
+
+// start accounts a request of the class and client in flight. s.mu must be held.
+func (s *LoadShedder) start(lc *loadClass, client string) {
+	s.inFlight++
+	s.classInFlight[lc.name]++
+	a := s.account(client)
+	a.inFlight++
+	a.requests++
+	if s.metrics != nil {
+		s.metrics.InFlightRequests.Inc()
+	}
+}
+
+// releaser returns the function that accounts the end of a request of the class and client, and starts the queued
+// requests that can take its place
+func (s *LoadShedder) releaser(lc *loadClass, client string) func() {
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.inFlight--
+		s.classInFlight[lc.name]--
+		// clients with requests in flight are never forgotten
+		s.clients[client].inFlight--
+		if s.metrics != nil {
+			s.metrics.InFlightRequests.Dec()
+		}
+		s.dispatch()
+	}
+}
+
+// dispatch starts the queued requests that are within their concurrency limits, in priority order. s.mu must be held.
+func (s *LoadShedder) dispatch() {
+	waiting := s.waiting[:0]
+	for _, w := range s.waiting {
+		if s.blockedReason(w.class, w.client) != "" {
+			waiting = append(waiting, w)
+			continue
+		}
+		s.start(w.class, w.client)
+		s.addWaiting(w.class, -1)
+		close(w.ready)
+	}
+	for i := len(waiting); i < len(s.waiting); i++ {
+		s.waiting[i] = nil
+	}
+	s.waiting = waiting
+}
+
+func (s *LoadShedder) addWaiting(lc *loadClass, n float64) {
+	if s.metrics != nil {
+		s.metrics.RequestsWaiting.WithLabelValues(lc.name).Add(n)
+	}
+}
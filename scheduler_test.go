@@ -0,0 +1,125 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadShedder_admit_queue(t *testing.T) {
+	s := NewLoadShedder(LoadSheddingConfig{MaxConcurrentRequests: 1, QueueTimeoutMS: 5000, Classes: map[string]LoadSheddingClassConfig{
+		"rules":   {Priority: prAlerting, ShedAtPercent: 100},
+		"explore": {Priority: prBatch, ShedAtPercent: 100},
+	}}, nil)
+	rules := s.classes[1]
+	explore := s.classes[0]
+	if rules.name != "rules" || explore.name != "explore" {
+		t.Fatalf("unexpected classes %v %v", rules, explore)
+	}
+
+	release, reason := s.admit(context.Background(), explore, "")
+	if reason != "" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+
+	// queued requests should start in priority order, and then in order of arrival
+	var mu sync.Mutex
+	var started []string
+	var wg sync.WaitGroup
+	queue := func(lc *loadClass, name string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, reason := s.admit(context.Background(), lc, "")
+			if reason != "" {
+				t.Errorf("%s: unexpected reason %q", name, reason)
+				return
+			}
+			mu.Lock()
+			started = append(started, name)
+			mu.Unlock()
+			release()
+		}()
+	}
+	waiting := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.waiting)
+	}
+	for i, q := range []struct {
+		lc   *loadClass
+		name string
+	}{{explore, "explore1"}, {rules, "rules1"}, {explore, "explore2"}, {rules, "rules2"}} {
+		queue(q.lc, q.name)
+		// wait for the request to be queued, so that the order of arrival is known
+		for waiting() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	wg.Wait()
+
+	if want := []string{"rules1", "rules2", "explore1", "explore2"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("unexpected order %v", started)
+	}
+	if s.inFlight != 0 || len(s.waiting) != 0 {
+		t.Errorf("unexpected state %d %d", s.inFlight, len(s.waiting))
+	}
+}
+
+func TestLoadShedder_admit_queueTimeout(t *testing.T) {
+	s := NewLoadShedder(LoadSheddingConfig{QueueTimeoutMS: 10, Classes: map[string]LoadSheddingClassConfig{
+		"explore": {Priority: prBatch, MaxConcurrentRequests: 1},
+	}}, nil)
+	explore := s.classes[0]
+
+	release, reason := s.admit(context.Background(), explore, "")
+	if reason != "" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+
+	// it should limit the concurrency of the class, leaving the others unaffected
+	if _, reason := s.admit(context.Background(), explore, ""); reason != lsQueueTimeout {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if r, reason := s.admit(context.Background(), s.defaultClass, ""); reason != "" {
+		t.Errorf("unexpected reason %q", reason)
+	} else {
+		r()
+	}
+
+	// it should stop waiting when the request is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, reason := s.admit(ctx, explore, ""); reason != lsQueueTimeout {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	release()
+	if len(s.waiting) != 0 || s.classInFlight["explore"] != 0 {
+		t.Errorf("unexpected state %d %v", len(s.waiting), s.classInFlight)
+	}
+
+	// it should shed class limits right away without a queue
+	s.config.QueueTimeoutMS = 0
+	release, _ = s.admit(context.Background(), explore, "")
+	if _, reason := s.admit(context.Background(), explore, ""); reason != lsClassConcurrency {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	release()
+}
@@ -0,0 +1,138 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// Schema subcommand
+	ccSchema = "schema"
+
+	jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+)
+
+// configEnums lists the allowed values of the configuration options that take one of a fixed set of values, by their
+// dotted path in the configuration file. "*" stands for any origin name.
+var configEnums = map[string][]string{
+	"cache.cache_type":                         {ctMemory, ctFilesystem, ctRedis, ctBoltDB},
+	"cache.compression_codec":                  {czSnappy, czGzip},
+	"cache.compression_types":                  {mnQueryRange, mnQuery},
+	"cache.events.types":                       cacheEventTypes,
+	"proxy_server.unmatched_origin_policy":     {uoDefault, uoNotFound, uoMisdirected, uoRedirect},
+	"proxy_server.middlewares":                 defaultMiddlewares,
+	"proxy_server.listeners.tls.min_version":   tlsVersionNames,
+	"tls.min_version":                          tlsVersionNames,
+	"admin.tls.min_version":                    tlsVersionNames,
+	"origins.*.origin_type":                    {otPrometheus, otFederated, otSQLGateway},
+	"origins.*.compression_codec":              {czSnappy, czGzip, czNone},
+	"origins.*.diagnostics":                    {dmHeaders, dmTrailer},
+	"origins.*.x_forwarded_headers":            {fwOmit, fwAppend, fwReplace},
+	"origins.*.forwarded_header":               {fwOmit, fwAppend, fwReplace},
+	"origins.*.relabel.action":                 {raReplace, raKeep, raDrop, raLabelMap, raLabelDrop, raLabelKeep},
+	"origins.*.transform.fill":                 {fmNull, fmZero},
+	"origins.*.grafana.cache_key_scope":        {gsUser, gsTeam, gsOrg},
+	"origins.*.response_headers.cache_control": {dcTTL, dcNoStore},
+	"origins.*.auth_cache_policy":              {acShared, acPerCredential, acNoCache},
+	"origins.*.sql_gateway.time_format":        {sfRFC3339, sfUnix, sfUnixMS},
+	"origins.*.recording.mode":                 {rmRecord, rmReplay},
+	"origins.*.signing.method":                 signingMethods,
+	"origins.*.signing.encoding":               {seHex, seBase64},
+	"origins.*.disabled_middlewares":           defaultMiddlewares,
+	"load_shedding.classes.*.routes":           {rnQueryRange, rnQuery, rnWrite, rnProxy},
+	"load_shedding.classes.*.priority":         {prAlerting, prInteractive, prBatch},
+}
+
+// configSchema returns a JSON Schema of the configuration file, generated from the Config struct, with the internal
+// defaults and the allowed values of enumerated options
+func configSchema() map[string]interface{} {
+	s := schemaOf(reflect.ValueOf(*NewConfig()), "")
+	s["$schema"] = jsonSchemaDraft
+	s["title"] = "Trickster configuration"
+	return s
+}
+
+// schemaOf returns the schema of the configuration option at path, whose default value is v
+func schemaOf(v reflect.Value, path string) map[string]interface{} {
+	s := map[string]interface{}{}
+	switch v.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			// options without a toml key, like the hostname, are not read from the file
+			key := v.Type().Field(i).Tag.Get("toml")
+			if key == "" || key == "-" {
+				continue
+			}
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			properties[key] = schemaOf(v.Field(i), p)
+		}
+		s["type"] = "object"
+		s["properties"] = properties
+		s["additionalProperties"] = false
+	case reflect.Map:
+		// each configured origin starts from the default origin's values
+		elem := reflect.Zero(v.Type().Elem())
+		if path == "origins" {
+			elem = reflect.ValueOf(defaultOriginConfig())
+		}
+		s["type"] = "object"
+		s["additionalProperties"] = schemaOf(elem, path+".*")
+	case reflect.Slice:
+		s["type"] = "array"
+		s["items"] = schemaOf(reflect.Zero(v.Type().Elem()), path)
+		if v.Len() > 0 {
+			s["default"] = v.Interface()
+		}
+	case reflect.Ptr:
+		return schemaOf(reflect.Zero(v.Type().Elem()), path)
+	case reflect.String:
+		s["type"] = "string"
+	case reflect.Bool:
+		s["type"] = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s["type"] = "integer"
+	case reflect.Float32, reflect.Float64:
+		s["type"] = "number"
+	}
+
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64:
+		if !v.IsZero() {
+			s["default"] = v.Interface()
+		}
+		if values, ok := configEnums[path]; ok {
+			s["enum"] = values
+		}
+	}
+	return s
+}
+
+// runSchemaCommand handles "trickster schema", which prints the JSON Schema of the configuration file
+func runSchemaCommand() int {
+	b, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		fmt.Println("Could not generate the configuration schema: ", err.Error())
+		return 1
+	}
+	fmt.Println(string(b))
+	return 0
+}
@@ -0,0 +1,72 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConfigSchema(t *testing.T) {
+	// round trip the schema through JSON, as it is printed
+	b, err := json.Marshal(configSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	property := func(s map[string]interface{}, keys ...string) map[string]interface{} {
+		for _, key := range keys {
+			if key == "*" {
+				s, _ = s["additionalProperties"].(map[string]interface{})
+			} else {
+				properties, _ := s["properties"].(map[string]interface{})
+				s, _ = properties[key].(map[string]interface{})
+			}
+			if s == nil {
+				t.Fatalf("no schema for %v", keys)
+			}
+		}
+		return s
+	}
+
+	// it should describe options with their types and defaults
+	cacheType := property(s, "cache", "cache_type")
+	if cacheType["type"] != "string" || cacheType["default"] != ctMemory {
+		t.Errorf("unexpected schema %v", cacheType)
+	}
+	timeout := property(s, "origins", "*", "timeout_secs")
+	if timeout["type"] != "integer" || timeout["default"] != float64(180) {
+		t.Errorf("unexpected schema %v", timeout)
+	}
+	if items := property(s, "origins", "*", "relabel")["items"].(map[string]interface{}); items["type"] != "object" {
+		t.Errorf("unexpected schema %v", items)
+	}
+
+	// it should list the allowed values of enumerated options
+	action := property(s, "origins", "*", "relabel")["items"].(map[string]interface{})
+	action = property(action, "action")
+	if !reflect.DeepEqual(action["enum"], []interface{}{raReplace, raKeep, raDrop, raLabelMap, raLabelDrop, raLabelKeep}) {
+		t.Errorf("unexpected enum %v", action["enum"])
+	}
+
+	// it should leave out fields that are not read from the file
+	if _, ok := property(s, "main")["properties"].(map[string]interface{})["Hostname"]; ok {
+		t.Errorf("unexpected Hostname option")
+	}
+}
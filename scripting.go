@@ -0,0 +1,439 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// Script phases, each the name of the Lua function called at that phase
+	spOnRequest   = "on_request"
+	spPreUpstream = "pre_upstream"
+	spPreRespond  = "pre_respond"
+
+	defaultScriptTimeoutMS = 100
+)
+
+// ScriptConfig describes the Lua script whose functions are called as the origin's requests are received, sent
+// upstream and responded to
+type ScriptConfig struct {
+	// Path is the path of the Lua script. Default is empty (no script is run)
+	Path string `toml:"path"`
+	// TimeoutMS is the time each function call of the script may run for. Default is 100
+	TimeoutMS int `toml:"timeout_ms"`
+}
+
+// scripts are the compiled scripts, by path, so that each is compiled once however many origins run it
+var scripts = struct {
+	sync.Mutex
+	byPath map[string]*Script
+}{byPath: map[string]*Script{}}
+
+// enabled returns true if the origin runs a script
+func (c ScriptConfig) enabled() bool {
+	return c.Path != ""
+}
+
+// validate returns an error if the script cannot be compiled, or the timeout is negative
+func (c ScriptConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.TimeoutMS < 0 {
+		return fmt.Errorf("script: timeout_ms must not be negative")
+	}
+	if _, err := loadScript(c.Path); err != nil {
+		return fmt.Errorf("script: %v", err)
+	}
+	return nil
+}
+
+// script returns the compiled script of the validated config, or nil if the origin runs no script
+func (c ScriptConfig) script() *Script {
+	if !c.enabled() {
+		return nil
+	}
+	s, err := loadScript(c.Path)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// timeout returns the time each function call of the script may run for
+func (c ScriptConfig) timeout() time.Duration {
+	if c.TimeoutMS == 0 {
+		return defaultScriptTimeoutMS * time.Millisecond
+	}
+	return time.Duration(c.TimeoutMS) * time.Millisecond
+}
+
+// loadScript returns the compiled script at path, compiling it if needed
+func loadScript(path string) (*Script, error) {
+	scripts.Lock()
+	defer scripts.Unlock()
+	if s, ok := scripts.byPath[path]; ok {
+		return s, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := compileScript(f, path)
+	if err != nil {
+		return nil, err
+	}
+	scripts.byPath[path] = s
+	return s, nil
+}
+
+// Script is a compiled Lua script. Since Lua states cannot be shared by goroutines, each call runs in a state taken
+// from a pool, in which the script has already been run to define its functions.
+type Script struct {
+	name  string
+	proto *lua.FunctionProto
+	pool  sync.Pool
+}
+
+// compileScript compiles the Lua source read from r, reporting errors against name
+func compileScript(r io.Reader, name string) (*Script, error) {
+	chunk, err := parse.Parse(r, name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{name: name, proto: proto}
+	// run the script once, so that errors in its top level are reported when it is loaded
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	s.pool.Put(L)
+	return s, nil
+}
+
+// newState returns a Lua state with only the base, table, string and math libraries, in which the script has been run
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{lua.BaseLibName: lua.OpenBase, lua.TabLibName: lua.OpenTable,
+		lua.StringLibName: lua.OpenString, lua.MathLibName: lua.OpenMath} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	// scripts must not read files
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// call calls the script's function of the phase, if it defines one, with the table built in its state as its
+// argument, and returns the first two values it returned. defined is false if the script has no function for the
+// phase.
+func (s *Script) call(phase string, timeout time.Duration, build func(*lua.LState) *lua.LTable) (
+	ret1, ret2 lua.LValue, defined bool, err error) {
+	L, _ := s.pool.Get().(*lua.LState)
+	if L == nil {
+		if L, err = s.newState(); err != nil {
+			return lua.LNil, lua.LNil, false, err
+		}
+	}
+
+	fn, ok := L.GetGlobal(phase).(*lua.LFunction)
+	if !ok {
+		s.pool.Put(L)
+		return lua.LNil, lua.LNil, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, build(L))
+	L.RemoveContext()
+	if err != nil {
+		// a state interrupted mid call is not reused
+		L.Close()
+		return lua.LNil, lua.LNil, true, fmt.Errorf("%s: %s: %v", s.name, phase, err)
+	}
+	ret1, ret2 = L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	s.pool.Put(L)
+	return ret1, ret2, true, nil
+}
+
+// scriptRequestTable returns the request that a script's on_request and pre_upstream functions receive as a table,
+// with the fields method, path, query, origin (on_request only) and headers. Changes the functions make to the table's
+// path, query, origin and headers are applied to the request.
+func scriptRequestTable(L *lua.LState, r *http.Request, origin string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(r.Method))
+	t.RawSetString("path", lua.LString(r.URL.Path))
+	t.RawSetString("query", lua.LString(r.URL.RawQuery))
+	if origin != "" {
+		t.RawSetString("origin", lua.LString(origin))
+	}
+	t.RawSetString("headers", headersTable(L, r.Header))
+	return t
+}
+
+// headersTable returns a table of the first value of each header, by canonical header name
+func headersTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range h {
+		if len(values) > 0 {
+			t.RawSetString(name, lua.LString(values[0]))
+		}
+	}
+	return t
+}
+
+// applyHeadersTable applies the changes a script made to the headers table to the headers: headers set to nil are
+// removed, and headers set to a new value replace all of their values
+func applyHeadersTable(t lua.LValue, h http.Header) {
+	table, ok := t.(*lua.LTable)
+	if !ok {
+		return
+	}
+	for name, values := range h {
+		v := table.RawGetString(name)
+		if v == lua.LNil {
+			h.Del(name)
+		} else if len(values) == 0 || values[0] != v.String() {
+			h.Set(name, v.String())
+		}
+	}
+	table.ForEach(func(k, v lua.LValue) {
+		if name, ok := k.(lua.LString); ok && v != lua.LNil {
+			if _, exists := h[string(name)]; !exists {
+				h.Set(string(name), v.String())
+			}
+		}
+	})
+}
+
+// applyRequestTable applies the changes a script made to the request's path, query and headers
+func applyRequestTable(t *lua.LTable, r *http.Request) {
+	if path, ok := t.RawGetString("path").(lua.LString); ok {
+		r.URL.Path = string(path)
+		r.URL.RawPath = ""
+	}
+	if query, ok := t.RawGetString("query").(lua.LString); ok {
+		r.URL.RawQuery = string(query)
+	}
+	applyHeadersTable(t.RawGetString("headers"), r.Header)
+}
+
+// OnRequest calls the script's on_request function with the request received by the origin, and applies its changes.
+// When the function returns a status, and optionally a body, the request should be answered with them and not be
+// served; OnRequest then returns that status. A request routed by the function to another origin is returned with
+// that origin's moniker.
+func (s *Script) OnRequest(r *http.Request, origin string, timeout time.Duration) (*http.Request, int, string, error) {
+	var arg *lua.LTable
+	status, body, defined, err := s.call(spOnRequest, timeout, func(L *lua.LState) *lua.LTable {
+		arg = scriptRequestTable(L, r, origin)
+		return arg
+	})
+	if err != nil || !defined {
+		return r, 0, "", err
+	}
+
+	applyRequestTable(arg, r)
+	if routed, ok := arg.RawGetString("origin").(lua.LString); ok && string(routed) != origin {
+		vars := mux.Vars(r)
+		if name, ok := vars["originMoniker"]; ok {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, "/"+name)
+		}
+		routedVars := map[string]string{}
+		for k, v := range vars {
+			routedVars[k] = v
+		}
+		routedVars["originMoniker"] = string(routed)
+		r = mux.SetURLVars(r, routedVars)
+	}
+
+	if code, ok := status.(lua.LNumber); ok {
+		if err := validateScriptStatus(code); err != nil {
+			return r, 0, "", err
+		}
+		return r, int(code), lua.LVAsString(body), nil
+	}
+	return r, 0, "", nil
+}
+
+// validateScriptStatus returns an error if the status set by a script is not a valid HTTP status code, which
+// net/http refuses to write
+func validateScriptStatus(status lua.LNumber) error {
+	if status < 100 || status > 999 || status != lua.LNumber(int(status)) {
+		return fmt.Errorf("invalid status %v", status)
+	}
+	return nil
+}
+
+// PreUpstream calls the script's pre_upstream function with the request about to be sent upstream, and applies its
+// changes
+func (s *Script) PreUpstream(r *http.Request, timeout time.Duration) error {
+	var arg *lua.LTable
+	_, _, defined, err := s.call(spPreUpstream, timeout, func(L *lua.LState) *lua.LTable {
+		arg = scriptRequestTable(L, r, "")
+		return arg
+	})
+	if err != nil || !defined {
+		return err
+	}
+	applyRequestTable(arg, r)
+	return nil
+}
+
+// PreRespond calls the script's pre_respond function with a table of the response's status and headers, just before
+// they are written, applies its changes to the headers and returns the status it leaves in the table
+func (s *Script) PreRespond(code int, h http.Header, timeout time.Duration) (int, error) {
+	var arg *lua.LTable
+	_, _, defined, err := s.call(spPreRespond, timeout, func(L *lua.LState) *lua.LTable {
+		arg = L.NewTable()
+		arg.RawSetString("status", lua.LNumber(code))
+		arg.RawSetString("headers", headersTable(L, h))
+		return arg
+	})
+	if err != nil || !defined {
+		return code, err
+	}
+	applyHeadersTable(arg.RawGetString("headers"), h)
+	if status, ok := arg.RawGetString("status").(lua.LNumber); ok {
+		if err := validateScriptStatus(status); err != nil {
+			return code, err
+		}
+		return int(status), nil
+	}
+	return code, nil
+}
+
+// withScripts wraps a handler so that the origin's script, if any, is called as its requests are received and just
+// before they are responded to
+func (t *TricksterHandler) withScripts(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := getOriginName(r)
+		o := t.getOrigin(r)
+		s := o.Script.script()
+		if s == nil {
+			next(w, r)
+			return
+		}
+		if _, ok := t.Config.Origins[name]; !ok {
+			name = "default"
+		}
+
+		r, status, body, err := s.OnRequest(r, name, o.Script.timeout())
+		if err != nil {
+			level.Error(t.Logger).Log(lfEvent, "script error", "origin", name, lfDetail, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sw := &scriptResponseWriter{ResponseWriter: w, script: s, timeout: o.Script.timeout(),
+			onError: func(err error) {
+				level.Error(t.Logger).Log(lfEvent, "script error", "origin", name, lfDetail, err.Error())
+			}}
+		if status != 0 {
+			sw.WriteHeader(status)
+			sw.Write([]byte(body))
+			return
+		}
+		next(sw, r)
+	}
+}
+
+// scriptResponseWriter calls a script's pre_respond function just before the response headers are written
+type scriptResponseWriter struct {
+	http.ResponseWriter
+	script      *Script
+	timeout     time.Duration
+	onError     func(error)
+	wroteHeader bool
+}
+
+func (sw *scriptResponseWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		status, err := sw.script.PreRespond(code, sw.Header(), sw.timeout)
+		if err != nil {
+			// the response is written unchanged
+			sw.onError(err)
+		}
+		code = status
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *scriptResponseWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush writes the headers, if they have not been, and flushes the wrapped writer if it supports flushing, so that
+// streamed responses reach the client as they are written
+func (sw *scriptResponseWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// scriptTransport calls a script's pre_upstream function with the requests made through it
+type scriptTransport struct {
+	next    http.RoundTripper
+	script  *Script
+	timeout time.Duration
+}
+
+// newScriptTransport returns a transport calling the script's pre_upstream function with the requests made through
+// next
+func newScriptTransport(next http.RoundTripper, script *Script, timeout time.Duration) *scriptTransport {
+	return &scriptTransport{next: next, script: script, timeout: timeout}
+}
+
+// RoundTrip applies the script's changes to a copy of the request, leaving the caller's request untouched, and sends
+// it
+func (st *scriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scripted := req.Clone(req.Context())
+	if err := st.script.PreUpstream(scripted, st.timeout); err != nil {
+		return nil, err
+	}
+	return st.next.RoundTrip(scripted)
+}
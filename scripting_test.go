@@ -0,0 +1,282 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const testScript = `
+function on_request(req)
+  if req.headers["X-Deny"] then
+    return 403, "denied"
+  end
+  req.headers["X-Scope-Orgid"] = string.lower(req.headers["X-Tenant"] or "anonymous")
+  req.headers["X-Tenant"] = nil
+  if req.headers["X-Route"] then
+    req.origin = req.headers["X-Route"]
+  end
+end
+
+function pre_upstream(req)
+  req.query = req.query .. "&dedup=true"
+  req.headers["X-Upstream"] = req.method
+end
+
+function pre_respond(resp)
+  if resp.status == 500 then
+    resp.status = 502
+  end
+  resp.headers["X-Served-By"] = "trickster"
+  resp.headers["Server"] = nil
+end
+`
+
+// writeTestScript writes the script to a temporary file, and returns its path and a function removing it
+func writeTestScript(t *testing.T, script string) (string, func()) {
+	f, err := ioutil.TempFile("", "trickster-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(script)
+	f.Close()
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+func TestScriptConfig_validate(t *testing.T) {
+	valid, removeValid := writeTestScript(t, testScript)
+	defer removeValid()
+	syntax, removeSyntax := writeTestScript(t, "function on_request(req")
+	defer removeSyntax()
+	failing, removeFailing := writeTestScript(t, `error("boom")`)
+	defer removeFailing()
+	reads, removeReads := writeTestScript(t, `dofile("/etc/passwd")`)
+	defer removeReads()
+
+	tests := []struct {
+		config ScriptConfig
+		valid  bool
+	}{
+		{ScriptConfig{}, true},
+		{ScriptConfig{Path: valid, TimeoutMS: 10}, true},
+		{ScriptConfig{Path: valid, TimeoutMS: -1}, false},
+		{ScriptConfig{Path: valid + ".missing"}, false},
+		{ScriptConfig{Path: syntax}, false},
+		{ScriptConfig{Path: failing}, false},
+		{ScriptConfig{Path: reads}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestScript_OnRequest(t *testing.T) {
+	s, err := compileScript(strings.NewReader(testScript), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should apply the script's changes to the headers
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+	r.Header.Set("X-Tenant", "Team-A")
+	r, status, _, err := s.OnRequest(r, "default", time.Second)
+	if err != nil || status != 0 {
+		t.Fatalf("unexpected result %d %v", status, err)
+	}
+	if r.Header.Get("X-Scope-Orgid") != "team-a" || r.Header.Get("X-Tenant") != "" {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+
+	// it should answer the request with the status and body returned by the script
+	r = httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+	r.Header.Set("X-Deny", "1")
+	_, status, body, err := s.OnRequest(r, "default", time.Second)
+	if err != nil || status != http.StatusForbidden || body != "denied" {
+		t.Errorf("unexpected result %d %q %v", status, body, err)
+	}
+
+	// it should route the request to the origin set by the script, dropping the moniker of the original origin
+	r = mux.SetURLVars(httptest.NewRequest("GET", "http://trickster/tenants/api/v1/query", nil),
+		map[string]string{"originMoniker": "tenants"})
+	r.Header.Set("X-Route", "tenant-b")
+	r, _, _, err = s.OnRequest(r, "tenants", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := getOriginName(r); name != "tenant-b" || r.URL.Path != "/api/v1/query" {
+		t.Errorf("unexpected origin %s path %s", name, r.URL.Path)
+	}
+}
+
+func TestScript_call_timeout(t *testing.T) {
+	s, err := compileScript(strings.NewReader(`function on_request(req) while true do end end`), "loop.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should interrupt a script running past its timeout
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+	if _, _, _, err := s.OnRequest(r, "default", 10*time.Millisecond); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// it should leave requests untouched when the script has no function for the phase
+	if err := s.PreUpstream(r, 10*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScript_PreRespond(t *testing.T) {
+	s, err := compileScript(strings.NewReader(testScript), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should apply the script's changes to the status and headers, keeping the values of unchanged headers
+	h := http.Header{"Server": {"prometheus"}, "Vary": {"Accept", "Origin"}}
+	code, err := s.PreRespond(http.StatusInternalServerError, h, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadGateway {
+		t.Errorf("wanted %d got %d.", http.StatusBadGateway, code)
+	}
+	if h.Get("X-Served-By") != "trickster" || h.Get("Server") != "" || len(h["Vary"]) != 2 {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestScriptResponseWriter_Flush(t *testing.T) {
+	s, err := compileScript(strings.NewReader(testScript), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	sw := &scriptResponseWriter{ResponseWriter: w, script: s, timeout: time.Second, onError: func(err error) {
+		t.Error(err)
+	}}
+	var _ http.Flusher = sw
+
+	// it should call the script's pre_respond function and flush the wrapped writer
+	sw.Flush()
+	if !w.Flushed {
+		t.Errorf("expected the response to be flushed")
+	}
+	if v := w.Result().Header.Get("X-Served-By"); v != "trickster" {
+		t.Errorf("wanted %q got %q.", "trickster", v)
+	}
+}
+
+func TestScript_invalidStatus(t *testing.T) {
+	s, err := compileScript(strings.NewReader(`
+function on_request(req) return 42 end
+function pre_respond(resp) resp.status = 1000 end
+`), "status.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should treat a status that is not a valid HTTP status code as a script error
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+	if _, status, _, err := s.OnRequest(r, "default", time.Second); err == nil || status != 0 {
+		t.Errorf("unexpected result %d %v", status, err)
+	}
+	if code, err := s.PreRespond(http.StatusOK, http.Header{}, time.Second); err == nil || code != http.StatusOK {
+		t.Errorf("unexpected result %d %v", code, err)
+	}
+	if err := validateScriptStatus(200.5); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestTricksterHandler_withScripts(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	path, remove := writeTestScript(t, testScript)
+	defer remove()
+	o := tr.Config.Origins["default"]
+	o.Script.Path = path
+	tr.Config.Origins["default"] = o
+
+	var tenant string
+	next := func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header.Get("X-Scope-Orgid")
+		w.Header().Set("Server", "prometheus")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	// it should call the script as the request is received and responded to
+	w := httptest.NewRecorder()
+	tr.withScripts(next)(w, httptest.NewRequest("GET", "http://trickster/api/v1/query", nil))
+	if tenant != "anonymous" {
+		t.Errorf("wanted %q got %q.", "anonymous", tenant)
+	}
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Served-By") != "trickster" || w.Header().Get("Server") != "" {
+		t.Errorf("unexpected response %d %v", w.Code, w.Header())
+	}
+
+	// it should answer denied requests without serving them
+	tenant = ""
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+	r.Header.Set("X-Deny", "1")
+	tr.withScripts(next)(w, r)
+	if w.Code != http.StatusForbidden || w.Body.String() != "denied" || tenant != "" {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestTricksterHandler_getURL_scripted(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var received *http.Request
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Write([]byte(`{}`))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	path, remove := writeTestScript(t, testScript)
+	defer remove()
+
+	// it should call the script before sending the request upstream
+	o := tr.Config.Origins["default"]
+	o.Script.Path = path
+	headers := http.Header{}
+	if _, _, _, err := tr.getURL(o, "GET", es.URL+"/api/v1/query", url.Values{"query": {"up"}}, headers,
+		time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if received.URL.Query().Get("dedup") != "true" || received.Header.Get("X-Upstream") != "GET" {
+		t.Errorf("unexpected request %s %v", received.URL, received.Header)
+	}
+	// it should leave the caller's headers untouched
+	if headers.Get("X-Upstream") != "" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
@@ -0,0 +1,142 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// defaultShardMaxParallelism is used for origins that enable sharding without specifying a parallelism
+const defaultShardMaxParallelism = 4
+
+// shardExtents splits the provided extents into consecutive, non-overlapping sub-ranges no longer than shardMS,
+// with each shard boundary aligned to the step.
+func shardExtents(e MatrixExtents, stepMS int64, shardMS int64) []MatrixExtents {
+	if stepMS <= 0 || shardMS <= 0 || e.End-e.Start <= shardMS {
+		return []MatrixExtents{e}
+	}
+
+	// a shard must cover at least one step, and end on a step boundary
+	if shardMS < stepMS {
+		shardMS = stepMS
+	}
+	shardMS = (shardMS / stepMS) * stepMS
+
+	shards := make([]MatrixExtents, 0, (e.End-e.Start)/shardMS+1)
+	for start := e.Start; start <= e.End; start += shardMS {
+		end := start + shardMS - stepMS
+		if end > e.End {
+			end = e.End
+		}
+		shards = append(shards, MatrixExtents{Start: start, End: end})
+	}
+	return shards
+}
+
+// getShardedMatrixFromPrometheus fetches the provided extents from the origin's query_range endpoint. When sharding is configured
+// for the origin and the extents exceed the shard duration, the range is split into shards that are fetched in parallel
+// (bounded by the origin's shard parallelism) and merged into a single envelope before being returned, along with the
+// shard bodies, so that the bytes read from the origin are accounted for.
+func (t *TricksterHandler) getShardedMatrixFromPrometheus(ctx *ClientRequestContext, url string, params url.Values, e MatrixExtents, r *http.Request) (PrometheusMatrixEnvelope, []byte, *http.Response, time.Duration, error) {
+	shards := shardExtents(e, ctx.StepMS, ctx.Origin.ShardDurationSecs*1000)
+
+	if len(shards) == 1 {
+		return t.getMatrix(ctx.Origin, url, shardParams(params, e), r)
+	}
+
+	level.Debug(t.Logger).Log(lfEvent, "shardingRangeQuery", lfCacheKey, ctx.CacheKey, "shards", len(shards))
+
+	parallelism := ctx.Origin.ShardMaxParallelism
+	if parallelism <= 0 {
+		parallelism = defaultShardMaxParallelism
+	}
+
+	type shardResult struct {
+		pe       PrometheusMatrixEnvelope
+		body     []byte
+		resp     *http.Response
+		duration time.Duration
+		err      error
+	}
+
+	results := make([]shardResult, len(shards))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i := range shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			sr := &results[i]
+			sr.pe, sr.body, sr.resp, sr.duration, sr.err = t.getMatrix(ctx.Origin, url, shardParams(params, shards[i]), r)
+		}(i)
+	}
+	wg.Wait()
+
+	var merged PrometheusMatrixEnvelope
+	var resp *http.Response
+	var duration time.Duration
+	bodies := make([][]byte, 0, len(results))
+
+	for i := range results {
+		sr := results[i]
+		if sr.err != nil {
+			return PrometheusMatrixEnvelope{}, nil, nil, 0, sr.err
+		}
+		if sr.resp.StatusCode != http.StatusOK {
+			// surface the first failed shard to the client as-is
+			return PrometheusMatrixEnvelope{}, sr.body, sr.resp, 0, nil
+		}
+		if sr.duration > duration {
+			duration = sr.duration
+		}
+		if resp == nil {
+			resp = sr.resp
+		}
+		if sr.pe.Status != rvSuccess {
+			return sr.pe, sr.body, sr.resp, 0, nil
+		}
+		bodies = append(bodies, sr.body)
+		if i == 0 {
+			merged = sr.pe
+			continue
+		}
+		// mergeMatrix expects its second argument to precede the first
+		merged = t.mergeMatrix(sr.pe, merged)
+	}
+
+	return merged, bytes.Join(bodies, nil), resp, duration, nil
+}
+
+// shardParams returns a copy of the provided query_range parameters, with the start and end set to the provided extents
+func shardParams(params url.Values, e MatrixExtents) url.Values {
+	p := url.Values{}
+	for k, v := range params {
+		p[k] = append([]string(nil), v...)
+	}
+	p.Set(upStart, strconv.FormatInt(e.Start/1000, 10))
+	p.Set(upEnd, strconv.FormatInt(e.End/1000, 10))
+	return p
+}
@@ -0,0 +1,101 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardExtents(t *testing.T) {
+	tests := []struct {
+		e               MatrixExtents
+		stepMS, shardMS int64
+		shards          []MatrixExtents
+	}{
+		// sharding disabled
+		{
+			MatrixExtents{0, 100000}, 15000, 0,
+			[]MatrixExtents{{0, 100000}},
+		},
+		// range shorter than a shard
+		{
+			MatrixExtents{0, 60000}, 15000, 60000,
+			[]MatrixExtents{{0, 60000}},
+		},
+		// range split on step-aligned boundaries
+		{
+			MatrixExtents{0, 150000}, 15000, 60000,
+			[]MatrixExtents{{0, 45000}, {60000, 105000}, {120000, 150000}},
+		},
+		// shard duration that isn't a multiple of the step
+		{
+			MatrixExtents{0, 90000}, 30000, 50000,
+			[]MatrixExtents{{0, 0}, {30000, 30000}, {60000, 60000}, {90000, 90000}},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			shards := shardExtents(test.e, test.stepMS, test.shardMS)
+			if !reflect.DeepEqual(shards, test.shards) {
+				t.Fatalf("Mismatch\nactual=%v\nexpected=%v", shards, test.shards)
+			}
+		})
+	}
+}
+
+func TestTricksterHandler_getShardedMatrixFromPrometheus(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var requests int32
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, exampleRangeResponse)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	r := httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil)
+	ctx := &ClientRequestContext{Origin: tr.getOrigin(r), StepMS: 15000}
+	ctx.Origin.ShardDurationSecs = 15
+
+	// it should fetch each shard and merge them into a single envelope
+	pe, body, resp, _, err := tr.getShardedMatrixFromPrometheus(ctx, es.URL, url.Values{upQuery: []string{"up"}, upStep: []string{"15"}},
+		MatrixExtents{Start: 1435781430000, End: 1435781460000}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if requests != 3 {
+		t.Errorf("wanted %d upstream requests got %d.", 3, requests)
+	}
+	if pe.getValueCount() != 6 {
+		t.Errorf("wanted 6 got %d.", pe.getValueCount())
+	}
+
+	// it should return the shard bodies, so that their size is accounted for
+	if len(body) != 3*len(exampleRangeResponse) {
+		t.Errorf("wanted %d got %d.", 3*len(exampleRangeResponse), len(body))
+	}
+}
@@ -0,0 +1,146 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// Request signing methods
+	smHMAC = "hmac"
+
+	// Signature encodings
+	seHex    = "hex"
+	seBase64 = "base64"
+
+	defaultSignatureHeader = "X-Trickster-Signature"
+)
+
+// SigningConfig describes how the origin's upstream requests are signed, for origins such as storage gateways that
+// authenticate the requests they receive
+type SigningConfig struct {
+	// Method is the signing method: 'hmac'. Default is empty (requests are not signed)
+	Method string `toml:"method"`
+	// Secret is the key that requests are signed with, shared with the origin
+	Secret string `toml:"secret"`
+	// Header is the request header that the signature is placed in. Default is 'X-Trickster-Signature'
+	Header string `toml:"header"`
+	// Encoding is the encoding of the signature: 'hex' or 'base64'. Default is 'hex'
+	Encoding string `toml:"encoding"`
+}
+
+// RequestSigner signs the upstream requests of an origin. Signers modify only the headers of the request.
+type RequestSigner interface {
+	Sign(req *http.Request, now time.Time) error
+}
+
+// requestSigners are the constructors of the signers of each signing method, from a validated config
+var requestSigners = map[string]func(SigningConfig) RequestSigner{
+	smHMAC: newHMACSigner,
+}
+
+// signingMethods lists the signing methods, for the configuration schema
+var signingMethods = []string{smHMAC}
+
+// enabled returns true if the origin's upstream requests are signed
+func (c SigningConfig) enabled() bool {
+	return c.Method != ""
+}
+
+// validate returns an error if the signing method or encoding is unknown, or the secret is missing
+func (c SigningConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, ok := requestSigners[c.Method]; !ok {
+		return fmt.Errorf("signing: unknown method %q", c.Method)
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("signing: a secret is required")
+	}
+	if c.Encoding != "" && c.Encoding != seHex && c.Encoding != seBase64 {
+		return fmt.Errorf("signing: encoding must be %q or %q", seHex, seBase64)
+	}
+	return nil
+}
+
+// signer returns the signer of the validated config, or nil if requests are not signed
+func (c SigningConfig) signer() RequestSigner {
+	if newSigner, ok := requestSigners[c.Method]; ok {
+		return newSigner(c)
+	}
+	return nil
+}
+
+// hmacSigner signs requests with the HMAC-SHA256 of their method, path and date, each on its own line. The request's
+// Date header is set to the signing time when it has none.
+type hmacSigner struct {
+	config SigningConfig
+}
+
+func newHMACSigner(c SigningConfig) RequestSigner {
+	return &hmacSigner{config: c}
+}
+
+// Sign places the request's signature in the configured header
+func (s *hmacSigner) Sign(req *http.Request, now time.Time) error {
+	date := req.Header.Get(hnDate)
+	if date == "" {
+		date = now.UTC().Format(http.TimeFormat)
+		req.Header.Set(hnDate, date)
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.config.Secret))
+	mac.Write([]byte(req.Method + "\n" + req.URL.EscapedPath() + "\n" + date))
+	var signature string
+	if s.config.Encoding == seBase64 {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		signature = hex.EncodeToString(mac.Sum(nil))
+	}
+
+	header := s.config.Header
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	req.Header.Set(header, signature)
+	return nil
+}
+
+// signingTransport signs the requests made through it
+type signingTransport struct {
+	next   http.RoundTripper
+	signer RequestSigner
+}
+
+// newSigningTransport returns a transport signing the requests made through next with the signer
+func newSigningTransport(next http.RoundTripper, signer RequestSigner) *signingTransport {
+	return &signingTransport{next: next, signer: signer}
+}
+
+// RoundTrip signs a copy of the request, leaving the caller's request untouched, and sends it
+func (st *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	if err := st.signer.Sign(signed, time.Now()); err != nil {
+		return nil, err
+	}
+	return st.next.RoundTrip(signed)
+}
@@ -0,0 +1,103 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSigningConfig_validate(t *testing.T) {
+	tests := []struct {
+		config SigningConfig
+		valid  bool
+	}{
+		{SigningConfig{}, true},
+		{SigningConfig{Method: smHMAC, Secret: "s"}, true},
+		{SigningConfig{Method: smHMAC, Secret: "s", Encoding: seBase64}, true},
+		{SigningConfig{Method: smHMAC}, false},
+		{SigningConfig{Method: "sigv4", Secret: "s"}, false},
+		{SigningConfig{Method: smHMAC, Secret: "s", Encoding: "base32"}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestHMACSigner_Sign(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("GET\n/api/v1/query\nTue, 01 Jan 2019 00:00:00 GMT"))
+	sum := mac.Sum(nil)
+
+	// it should sign the method, path and date, setting the date when there is none
+	req := httptest.NewRequest("GET", "http://gateway/api/v1/query?query=up", nil)
+	SigningConfig{Method: smHMAC, Secret: "secret"}.signer().Sign(req, now)
+	if d := req.Header.Get(hnDate); d != "Tue, 01 Jan 2019 00:00:00 GMT" {
+		t.Errorf("unexpected date %q", d)
+	}
+	if s := req.Header.Get(defaultSignatureHeader); s != hex.EncodeToString(sum) {
+		t.Errorf("unexpected signature %q", s)
+	}
+
+	// it should keep the date of the request, and place the encoded signature in the configured header
+	req = httptest.NewRequest("GET", "http://gateway/api/v1/query", nil)
+	req.Header.Set(hnDate, "Tue, 01 Jan 2019 00:00:00 GMT")
+	SigningConfig{Method: smHMAC, Secret: "secret", Header: "X-Signature", Encoding: seBase64}.signer().Sign(req, now.Add(time.Hour))
+	if s := req.Header.Get("X-Signature"); s != base64.StdEncoding.EncodeToString(sum) {
+		t.Errorf("unexpected signature %q", s)
+	}
+
+	// it should not sign without a method
+	if s := (SigningConfig{}).signer(); s != nil {
+		t.Errorf("unexpected signer %v", s)
+	}
+}
+
+func TestTricksterHandler_getURL_signed(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var received http.Header
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte(`{}`))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// it should sign the upstream requests of an origin with a signing config
+	o := tr.Config.Origins["default"]
+	o.Signing = SigningConfig{Method: smHMAC, Secret: "secret"}
+	headers := http.Header{}
+	if _, _, _, err := tr.getURL(o, "GET", es.URL+"/api/v1/query", url.Values{}, headers, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if received.Get(defaultSignatureHeader) == "" || received.Get(hnDate) == "" {
+		t.Errorf("unexpected headers %v", received)
+	}
+	// it should leave the caller's headers untouched
+	if headers.Get(defaultSignatureHeader) != "" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
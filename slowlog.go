@@ -0,0 +1,64 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// newSlowQueryLogger returns the Logger for the slow query log, which writes to its own file when one is configured,
+// and otherwise to the application log
+func newSlowQueryLogger(cfg LoggingConfig, instance string, appLogger log.Logger) log.Logger {
+	if cfg.SlowQueryLogFile == "" {
+		return level.Warn(appLogger)
+	}
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(newLogWriter(cfg.SlowQueryLogFile, instance)))
+	return log.With(logger, "time", log.DefaultTimestampUTC, "app", "trickster")
+}
+
+// logSlowQuery records a range query that took at least the configured threshold to fulfill in the slow query log,
+// along with how it was fulfilled
+func (t *TricksterHandler) logSlowQuery(ctx *ClientRequestContext, elapsed time.Duration) {
+	threshold := t.Config.Logging.SlowQueryThresholdMS
+	if threshold <= 0 || elapsed < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+
+	logger := t.SlowQueryLogger
+	if logger == nil {
+		logger = level.Warn(t.Logger)
+	}
+
+	diag := ctx.Diagnostics
+	if diag == nil {
+		diag = ctx.diagnostics(nil)
+	}
+
+	logger.Log(lfEvent, "slow query",
+		"elapsed", elapsed.Seconds(),
+		"origin", ctx.Origin.OriginURL,
+		"query", ctx.RequestParams.Get(upQuery),
+		"step", ctx.StepParam,
+		"requestExtents", ctx.RequestExtents.String(),
+		lfCacheKey, ctx.CacheKey,
+		"cacheStatus", diag.Get(hnDiagCacheStatus),
+		"cacheExtents", diag.Get(hnDiagCacheExtents),
+		"fetchedExtents", diag.Get(hnDiagFetchedExtents),
+		"upstreamDurations", diag.Get(hnDiagUpstreamDuration),
+		lfClientIP, t.TrustedProxies.clientIP(ctx.Request),
+	)
+}
@@ -0,0 +1,88 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTricksterHandler_logSlowQuery(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, exampleRangeResponse)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	var buf bytes.Buffer
+	tr.SlowQueryLogger = log.NewLogfmtLogger(&buf)
+
+	// it should not log slow queries when disabled
+	tr.promQueryRangeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if buf.Len() != 0 {
+		t.Errorf("expected no slow query log, got %q", buf.String())
+	}
+
+	// it should log queries slower than the threshold, with how they were fulfilled
+	tr.Config.Logging.SlowQueryThresholdMS = 10
+	tr.promQueryRangeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	line := buf.String()
+	for _, want := range []string{`event="slow query"`, "query=up", "cacheStatus=", "fetchedExtents=", "upstreamDurations=", "origin=" + es.URL} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in %q", want, line)
+		}
+	}
+
+	// it should not log queries faster than the threshold
+	buf.Reset()
+	tr.Config.Logging.SlowQueryThresholdMS = 60000
+	tr.promQueryRangeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if buf.Len() != 0 {
+		t.Errorf("expected no slow query log, got %q", buf.String())
+	}
+}
+
+func TestNewSlowQueryLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trickster-slowlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// it should write to its own file when one is configured
+	path := filepath.Join(dir, "slow.log")
+	logger := newSlowQueryLogger(LoggingConfig{SlowQueryLogFile: path}, "", log.NewNopLogger())
+	logger.Log(lfEvent, "slow query")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `event="slow query"`) {
+		t.Errorf("unexpected slow query log %q", b)
+	}
+}
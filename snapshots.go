@@ -0,0 +1,249 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// snapshotKeyPrefix prefixes the cache keys of snapshots, so that they never collide with cached queries
+	snapshotKeyPrefix = "trickster.snapshot."
+
+	// defaultSnapshotTTLSecs is the time to live of a snapshot, unless configured or requested. 30 days
+	defaultSnapshotTTLSecs = 2592000
+
+	hnLastModified = "Last-Modified"
+	hnSnapshot     = "X-Trickster-Snapshot"
+)
+
+// snapshotNames are the names a snapshot may be given
+var snapshotNames = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// SnapshotsConfig is a collection of configurations for query response snapshots
+type SnapshotsConfig struct {
+	// TTLSecs is the time to live of a snapshot that does not request one. Default is 2592000 (30 days)
+	TTLSecs int64 `toml:"ttl_secs"`
+	// MaxTTLSecs limits the time to live a snapshot may request. Default is 0 (unlimited)
+	MaxTTLSecs int64 `toml:"max_ttl_secs"`
+}
+
+// validate returns an error if the snapshot settings are invalid
+func (c SnapshotsConfig) validate() error {
+	if c.TTLSecs < 0 || c.MaxTTLSecs < 0 {
+		return fmt.Errorf("cache: snapshot settings must not be negative")
+	}
+	return nil
+}
+
+// ttl returns the time to live of a snapshot requesting the provided one, or 0 for none
+func (c SnapshotsConfig) ttl(requested int64) int64 {
+	ttl := requested
+	if ttl == 0 {
+		ttl = c.TTLSecs
+	}
+	if ttl == 0 {
+		ttl = defaultSnapshotTTLSecs
+	}
+	if c.MaxTTLSecs > 0 && ttl > c.MaxTTLSecs {
+		ttl = c.MaxTTLSecs
+	}
+	return ttl
+}
+
+// snapshot is a query response captured as it was served to clients, stored in the cache under its name
+type snapshot struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	ContentType string `json:"contentType"`
+	Created     int64  `json:"created"`
+	Expires     int64  `json:"expires"`
+	Body        []byte `json:"body"`
+}
+
+// snapshotResult describes the snapshot taken by a snapshot request
+type snapshotResult struct {
+	Name    string `json:"name,omitempty"`
+	URL     string `json:"url"`
+	Path    string `json:"path,omitempty"`
+	Created int64  `json:"created,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// snapshotPath returns the path that the named snapshot is retrieved at
+func snapshotPath(name string) string {
+	return adminPathPrefix + "snapshots/" + name
+}
+
+// snapshotsHandler handles calls to /trickster/snapshots?url=..., which captures the response to the provided
+// query or query_range url, as it would be served to a client, and stores it in the cache as an immutable snapshot,
+// named by &name= or randomly, that expires after &ttl_secs= or the configured snapshot TTL. The response reports the
+// path the snapshot is retrieved at as JSON.
+func (t *TricksterHandler) snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	params := r.URL.Query()
+	result := snapshotResult{URL: params.Get("url"), Name: params.Get("name")}
+	var ttl int64
+	status := http.StatusCreated
+	if t.bypassed() {
+		status = http.StatusServiceUnavailable
+		result.Error = "the cache is bypassed"
+	} else if result.URL == "" {
+		status = http.StatusBadRequest
+		result.Error = "missing url parameter"
+	} else if result.Name != "" && !snapshotNames.MatchString(result.Name) {
+		status = http.StatusBadRequest
+		result.Error = "invalid name"
+	} else if s := params.Get("ttl_secs"); s != "" {
+		var err error
+		if ttl, err = strconv.ParseInt(s, 10, 64); err != nil || ttl <= 0 {
+			status = http.StatusBadRequest
+			result.Error = "invalid ttl_secs"
+		}
+	}
+	if result.Error == "" {
+		result, status = t.takeSnapshot(r, result.URL, result.Name, t.Config.Caching.Snapshots.ttl(ttl))
+		if status == http.StatusCreated {
+			w.Header().Set(hnLocation, result.Path)
+		}
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// takeSnapshot serves the query url through the router, and stores its response as the named snapshot, returning
+// the result and the status code of the snapshot request
+func (t *TricksterHandler) takeSnapshot(r *http.Request, u, name string, ttl int64) (snapshotResult, int) {
+	result := snapshotResult{URL: u, Name: name}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result, http.StatusBadRequest
+	}
+	var match mux.RouteMatch
+	if t.Router == nil || !t.Router.Match(req, &match) ||
+		(match.Route.GetName() != rnQueryRange && match.Route.GetName() != rnQuery) {
+		result.Error = "url is not a query or range query"
+		return result, http.StatusBadRequest
+	}
+	// the query is made with the headers of the snapshot request, so that it is cached and authorized the same
+	req.Header = snapshotHeaders(t.getOrigin(mux.SetURLVars(req, match.Vars)), r.Header)
+
+	if name == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			result.Error = err.Error()
+			return result, http.StatusInternalServerError
+		}
+		result.Name = hex.EncodeToString(b)
+	} else if _, err := t.Cacher.Retrieve(snapshotKeyPrefix + name); err == nil {
+		result.Error = "a snapshot with the name already exists"
+		return result, http.StatusConflict
+	}
+
+	w := httptest.NewRecorder()
+	t.Router.ServeHTTP(w, req.WithContext(r.Context()))
+	if w.Code != http.StatusOK {
+		result.Error = fmt.Sprintf("the query responded with status %d", w.Code)
+		return result, http.StatusBadGateway
+	}
+
+	now := time.Now().Unix()
+	s := snapshot{Name: result.Name, URL: u, ContentType: w.Header().Get(hnContentType), Created: now,
+		Expires: now + ttl, Body: w.Body.Bytes()}
+	b, err := json.Marshal(s)
+	if err != nil {
+		result.Error = err.Error()
+		return result, http.StatusInternalServerError
+	}
+	if err := t.Cacher.Store(snapshotKeyPrefix+s.Name, string(b), ttl); err != nil {
+		result.Error = err.Error()
+		return result, http.StatusInternalServerError
+	}
+	level.Info(t.Logger).Log(lfEvent, "took snapshot", "name", s.Name, "url", u, "ttl", ttl)
+
+	result.Path = snapshotPath(s.Name)
+	result.Created = s.Created
+	result.Expires = s.Expires
+	return result, http.StatusCreated
+}
+
+// snapshotHeaders returns the headers of the snapshot request that its query is made with: those the origin forwards,
+// its credentials, and those that scope the origin's cache keys, such as the Grafana user headers and session cookie
+func snapshotHeaders(o PrometheusOriginConfig, in http.Header) http.Header {
+	headers := o.RequestHeaders.scrub(in)
+	names := append([]string{hnAuthorization, o.CacheKeyPartitionHeader}, o.CacheKeyHeaders...)
+	if o.Grafana.Enabled {
+		names = append(names, o.Grafana.userHeader(), o.Grafana.teamHeader(), hnGrafanaOrgID)
+	}
+	for _, name := range names {
+		if values, ok := in[http.CanonicalHeaderKey(name)]; ok && name != "" {
+			headers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if o.Grafana.Enabled {
+		if c, err := (&http.Request{Header: in}).Cookie(grafanaSessionCookie); err == nil {
+			headers.Add("Cookie", c.String())
+		}
+	}
+	return headers
+}
+
+// snapshotHandler handles calls to /trickster/snapshots/{name}, which serves the named snapshot as it was captured
+func (t *TricksterHandler) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	body, err := t.Cacher.Retrieve(snapshotKeyPrefix + name)
+	var s snapshot
+	if err == nil {
+		err = json.Unmarshal([]byte(body), &s)
+	}
+	if err != nil {
+		w.Header().Set(hnCacheControl, hvNoCache)
+		w.Header().Set(hnContentType, hvApplicationJSON)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(snapshotResult{Name: name, Error: "snapshot not found"})
+		return
+	}
+
+	// the snapshot never changes, so clients may cache it until it expires
+	maxAge := s.Expires - time.Now().Unix()
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set(hnCacheControl, "public, max-age="+strconv.FormatInt(maxAge, 10)+", immutable")
+	w.Header().Set(hnExpires, time.Unix(s.Expires, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set(hnLastModified, time.Unix(s.Created, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set(hnSnapshot, s.Name)
+	if s.ContentType != "" {
+		w.Header().Set(hnContentType, s.ContentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(s.Body)
+}
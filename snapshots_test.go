@@ -0,0 +1,158 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotsConfig_ttl(t *testing.T) {
+	tests := []struct {
+		config    SnapshotsConfig
+		requested int64
+		ttl       int64
+	}{
+		{SnapshotsConfig{}, 0, defaultSnapshotTTLSecs},
+		{SnapshotsConfig{TTLSecs: 3600}, 0, 3600},
+		{SnapshotsConfig{TTLSecs: 3600}, 60, 60},
+		{SnapshotsConfig{TTLSecs: 3600, MaxTTLSecs: 600}, 0, 600},
+		{SnapshotsConfig{MaxTTLSecs: 600}, 60, 60},
+	}
+	for i, test := range tests {
+		if ttl := test.config.ttl(test.requested); ttl != test.ttl {
+			t.Errorf("test %d: unexpected result %d", i, ttl)
+		}
+	}
+}
+
+func TestSnapshotHeaders(t *testing.T) {
+	in := http.Header{}
+	in.Set(hnAuthorization, "Bearer token")
+	in.Set("X-Tenant", "a")
+	in.Set("X-Scope", "b")
+	in.Set("X-Forwarded", "c")
+	in.Set(hnGrafanaUser, "user")
+	in.Set(hnGrafanaOrgID, "1")
+	in.Set("Cookie", grafanaSessionCookie+"=session; other=value")
+	in.Set("X-Other", "d")
+
+	o := PrometheusOriginConfig{CacheKeyPartitionHeader: "x-tenant", CacheKeyHeaders: []string{"X-Scope"},
+		RequestHeaders: HeaderScrubConfig{Allow: []string{"X-Forwarded"}}}
+
+	// it should copy the credentials, cache key headers and the forwarded headers
+	h := snapshotHeaders(o, in)
+	for _, name := range []string{hnAuthorization, "X-Tenant", "X-Scope", "X-Forwarded"} {
+		if h.Get(name) != in.Get(name) {
+			t.Errorf("unexpected %s %q", name, h.Get(name))
+		}
+	}
+	for _, name := range []string{hnGrafanaUser, "Cookie", "X-Other"} {
+		if h.Get(name) != "" {
+			t.Errorf("unexpected %s %q", name, h.Get(name))
+		}
+	}
+
+	// it should copy the Grafana user headers and session cookie of origins recognizing Grafana users
+	o.Grafana.Enabled = true
+	h = snapshotHeaders(o, in)
+	if h.Get(hnGrafanaUser) != "user" || h.Get(hnGrafanaOrgID) != "1" || h.Get("Cookie") != grafanaSessionCookie+"=session" {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestTricksterHandler_snapshotsHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the origin answers every query with a different result
+	requests := 0
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set(hnContentType, hvApplicationJSON)
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"` +
+			strings.Repeat("1", requests) + `"]}]}}`))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	router := tr.newRouter()
+	admin := tr.newAdminRouter()
+
+	snap := func(query string) (*httptest.ResponseRecorder, snapshotResult) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", "http://trickster/trickster/snapshots?"+query, nil))
+		var result snapshotResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w, result
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://trickster"+path, nil))
+		return w
+	}
+	queryURL := url.QueryEscape("http://trickster/api/v1/query?query=up&time=1")
+
+	// it should capture the query response under a random name
+	w, result := snap("url=" + queryURL)
+	if w.Code != http.StatusCreated || result.Name == "" || result.Path != snapshotPath(result.Name) ||
+		w.Header().Get(hnLocation) != result.Path || result.Expires-result.Created != defaultSnapshotTTLSecs {
+		t.Fatalf("unexpected result %d %v", w.Code, result)
+	}
+
+	// it should serve the snapshot as captured, without querying the origin again
+	w = get(result.Path)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"1"`) ||
+		w.Header().Get(hnContentType) != hvApplicationJSON || w.Header().Get(hnSnapshot) != result.Name {
+		t.Errorf("unexpected snapshot %d %s %v", w.Code, w.Body.String(), w.Header())
+	}
+	if requests != 1 {
+		t.Errorf("wanted %d got %d.", 1, requests)
+	}
+
+	// it should take a named snapshot with the requested TTL, and never replace it
+	w, result = snap("url=" + queryURL + "&name=postmortem-42&ttl_secs=60")
+	if w.Code != http.StatusCreated || result.Path != adminPathPrefix+"snapshots/postmortem-42" ||
+		result.Expires-result.Created != 60 {
+		t.Fatalf("unexpected result %d %v", w.Code, result)
+	}
+	if w, _ = snap("url=" + queryURL + "&name=postmortem-42"); w.Code != http.StatusConflict {
+		t.Errorf("wanted %d got %d.", http.StatusConflict, w.Code)
+	}
+	if w = get(result.Path); !strings.Contains(w.Header().Get(hnCacheControl), "max-age=60") {
+		t.Errorf("unexpected cache control %q", w.Header().Get(hnCacheControl))
+	}
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusBadRequest},
+		{"url=" + url.QueryEscape("http://trickster/api/v1/labels"), http.StatusBadRequest},
+		{"url=" + queryURL + "&name=../etc", http.StatusBadRequest},
+		{"url=" + queryURL + "&ttl_secs=0", http.StatusBadRequest},
+	}
+	for i, test := range tests {
+		if w, _ = snap(test.query); w.Code != test.code {
+			t.Errorf("test %d: unexpected result %d", i, w.Code)
+		}
+	}
+
+	if w = get(snapshotPath("missing")); w.Code != http.StatusNotFound {
+		t.Errorf("wanted %d got %d.", http.StatusNotFound, w.Code)
+	}
+}
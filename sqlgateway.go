@@ -0,0 +1,454 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// otSQLGateway is the origin type of PostgREST-style HTTP gateways in front of SQL databases such as TimescaleDB
+	otSQLGateway = "sql_gateway"
+
+	// mnSQLRange is the method label of the time range requests to SQL gateways
+	mnSQLRange = "sql_range"
+
+	// Formats of the time column of SQL gateway origins
+	sfRFC3339 = "rfc3339"
+	sfUnix    = "unix"
+	sfUnixMS  = "unix_ms"
+
+	defaultSQLTimeColumn = "time"
+)
+
+// sqlTimeLayouts are the layouts of textual times accepted in SQL gateway filters and rows, as PostgREST renders
+// timestamptz, timestamp and date columns
+var sqlTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02"}
+
+// SQLGatewayConfig describes how to locate the time range of requests to a SQL gateway origin, so that the rows of
+// overlapping requests can be cached and fetched incrementally, as the data sets of Prometheus range queries are
+type SQLGatewayConfig struct {
+	// TimeColumn is the column filtered by the time range of requests, and included in their rows. Default is "time"
+	TimeColumn string `toml:"time_column"`
+	// TimeFormat is the format of the time column's values: "rfc3339" (default), "unix" (seconds) or "unix_ms"
+	TimeFormat string `toml:"time_format"`
+	// MaxRows is the most rows that the gateway returns for a request, such as PostgREST's db-max-rows. Responses with
+	// as many rows may be truncated, and are not cached. Default is 0 (unlimited)
+	MaxRows int `toml:"max_rows"`
+}
+
+// sqlGateway returns true if the origin is a SQL gateway
+func (o PrometheusOriginConfig) sqlGateway() bool {
+	return strings.ToLower(o.OriginType) == otSQLGateway
+}
+
+// timeColumn returns the time column of the gateway's tables
+func (c SQLGatewayConfig) timeColumn() string {
+	if c.TimeColumn == "" {
+		return defaultSQLTimeColumn
+	}
+	return c.TimeColumn
+}
+
+// validate returns an error if the time format is unknown, or the max rows negative
+func (c SQLGatewayConfig) validate() error {
+	if c.MaxRows < 0 {
+		return fmt.Errorf("sql_gateway: max_rows must not be negative")
+	}
+	switch c.TimeFormat {
+	case "", sfRFC3339, sfUnix, sfUnixMS:
+		return nil
+	}
+	return fmt.Errorf("sql_gateway: unknown time_format %q", c.TimeFormat)
+}
+
+// truncated returns true if the gateway's response with the number of rows may not hold every row of the request:
+// its Content-Range reports a greater total, as PostgREST does when the rows are counted or limited by db-max-rows,
+// or it holds the gateway's max rows
+func (c SQLGatewayConfig) truncated(resp *http.Response, rows int) bool {
+	if c.MaxRows > 0 && rows >= c.MaxRows {
+		return true
+	}
+	// e.g. "0-99/1000", or "0-99/*" when the total is unknown
+	cr := resp.Header.Get("Content-Range")
+	if i := strings.LastIndex(cr, "/"); i >= 0 {
+		if total, err := strconv.Atoi(cr[i+1:]); err == nil && total > rows {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTime returns the time of a filter or row value of the time column, in nanoseconds
+func (c SQLGatewayConfig) parseTime(v interface{}) (int64, error) {
+	switch c.TimeFormat {
+	case sfUnix, sfUnixMS:
+		var f float64
+		var err error
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case string:
+			f, err = strconv.ParseFloat(v, 64)
+		default:
+			err = fmt.Errorf("unexpected time %v", v)
+		}
+		if err != nil {
+			return 0, err
+		}
+		unit := float64(time.Second)
+		if c.TimeFormat == sfUnixMS {
+			unit = float64(time.Millisecond)
+		}
+		// the whole and fractional parts are scaled separately, to keep nanosecond precision
+		whole, frac := math.Modf(f)
+		return int64(whole)*int64(unit) + int64(math.Round(frac*unit)), nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected time %v", v)
+	}
+	for _, layout := range sqlTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("unable to parse time %q", s)
+}
+
+// formatTime returns the filter value of a time in nanoseconds
+func (c SQLGatewayConfig) formatTime(ns int64) string {
+	switch c.TimeFormat {
+	case sfUnix:
+		return formatDecimal(ns, int64(time.Second), 9)
+	case sfUnixMS:
+		return formatDecimal(ns, int64(time.Millisecond), 6)
+	}
+	return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+}
+
+// formatDecimal returns n divided by unit (10^digits) as an exact decimal, without trailing zeros
+func formatDecimal(n, unit int64, digits int) string {
+	if n < 0 {
+		return "-" + formatDecimal(-n, unit, digits)
+	}
+	whole, frac := n/unit, n%unit
+	if frac == 0 {
+		return strconv.FormatInt(whole, 10)
+	}
+	return strconv.FormatInt(whole, 10) + "." + strings.TrimRight(fmt.Sprintf("%0*d", digits, frac), "0")
+}
+
+// sqlExtent is a half-open range of times, in nanoseconds
+type sqlExtent struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// subtractExtents returns the parts of e not covered by the sorted, non-overlapping extents
+func subtractExtents(e sqlExtent, covered []sqlExtent) []sqlExtent {
+	missing := []sqlExtent{}
+	start := e.Start
+	for _, c := range covered {
+		if c.End <= start || c.Start >= e.End {
+			continue
+		}
+		if c.Start > start {
+			missing = append(missing, sqlExtent{start, c.Start})
+		}
+		start = c.End
+	}
+	if start < e.End {
+		missing = append(missing, sqlExtent{start, e.End})
+	}
+	return missing
+}
+
+// mergeExtents returns the union of the extents, sorted and without overlaps
+func mergeExtents(extents []sqlExtent) []sqlExtent {
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Start < extents[j].Start })
+	merged := []sqlExtent{}
+	for _, e := range extents {
+		if e.End <= e.Start {
+			continue
+		}
+		if n := len(merged); n > 0 && e.Start <= merged[n-1].End {
+			if e.End > merged[n-1].End {
+				merged[n-1].End = e.End
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// sqlRow is a row of a SQL gateway response, with the time of its time column
+type sqlRow struct {
+	ts  int64
+	raw json.RawMessage
+}
+
+// sqlCacheRecord is the cached rows of a SQL gateway request, and the extents they cover
+type sqlCacheRecord struct {
+	Extents []sqlExtent       `json:"extents"`
+	Rows    []json.RawMessage `json:"rows"`
+}
+
+// sqlRangeRequest is a time range request to a SQL gateway
+type sqlRangeRequest struct {
+	// params are the request's parameters, less the time range filters and order
+	params url.Values
+	extent sqlExtent
+	desc   bool
+}
+
+// parseSQLRangeRequest returns the time range request, or false if the request does not filter the time column by
+// both a lower and upper bound, or can't be served from cached rows: it is paginated, or ordered by another column
+func (o PrometheusOriginConfig) parseSQLRangeRequest(r *http.Request) (sqlRangeRequest, bool) {
+	c := o.SQLGateway
+	col := c.timeColumn()
+	params := r.URL.Query()
+	params.Del(upOrigin)
+	if o.AllowClientRefresh {
+		params.Del(o.refreshParam())
+	}
+
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || params.Get("limit") != "" || params.Get("offset") != "" {
+		return sqlRangeRequest{}, false
+	}
+	if accept := r.Header.Get("Accept"); accept != "" && !strings.Contains(accept, "json") && !strings.Contains(accept, "*/*") {
+		return sqlRangeRequest{}, false
+	}
+
+	req := sqlRangeRequest{params: params, extent: sqlExtent{math.MinInt64, math.MaxInt64}}
+	switch order := params.Get("order"); order {
+	case "", col, col + ".asc":
+	case col + ".desc":
+		req.desc = true
+	default:
+		return sqlRangeRequest{}, false
+	}
+
+	for _, filter := range params[col] {
+		i := strings.Index(filter, ".")
+		if i < 0 {
+			return sqlRangeRequest{}, false
+		}
+		ts, err := c.parseTime(filter[i+1:])
+		if err != nil {
+			return sqlRangeRequest{}, false
+		}
+		switch filter[:i] {
+		case "gte":
+			req.extent.Start = max64(req.extent.Start, ts)
+		case "gt":
+			req.extent.Start = max64(req.extent.Start, ts+1)
+		case "lt":
+			req.extent.End = min64(req.extent.End, ts)
+		case "lte":
+			req.extent.End = min64(req.extent.End, ts+1)
+		default:
+			return sqlRangeRequest{}, false
+		}
+	}
+	if req.extent.Start == math.MinInt64 || req.extent.End == math.MaxInt64 || req.extent.Start >= req.extent.End {
+		return sqlRangeRequest{}, false
+	}
+	// rows are fetched and cached in any order, and sorted in the requested one
+	params.Del(col)
+	params.Del("order")
+	return req, true
+}
+
+// parseRows returns the rows of a SQL gateway response body, which must be a JSON array of objects with the time column
+func (c SQLGatewayConfig) parseRows(body []json.RawMessage) ([]sqlRow, error) {
+	col := c.timeColumn()
+	rows := make([]sqlRow, 0, len(body))
+	for _, raw := range body {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		v, ok := fields[col]
+		if !ok {
+			return nil, fmt.Errorf("row has no %q column", col)
+		}
+		ts, err := c.parseTime(v)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, sqlRow{ts, raw})
+	}
+	return rows, nil
+}
+
+// serveSQLRange serves a time range request to a SQL gateway origin from cached rows, fetching only the parts of the
+// range missing from the cache. It returns false, without responding, for requests that are not cacheable, or whose
+// rows the gateway truncated.
+func (t *TricksterHandler) serveSQLRange(w http.ResponseWriter, r *http.Request, o PrometheusOriginConfig, originURL string) bool {
+	req, ok := o.parseSQLRangeRequest(r)
+	directive := cacheDirective(o, r)
+	if !ok || t.bypassed() || directive == cdBypass {
+		return false
+	}
+	c := o.SQLGateway
+	cacheKey := o.cacheKeyPartition(r) + deriveCacheKey(originURL+"?"+req.params.Encode()+o.cacheKeyScope(r), nil) + ".sql"
+
+	// the cached rows, unless the client asked for fresh data
+	var record sqlCacheRecord
+	var rows []sqlRow
+	cacheResult := crKeyMiss
+	if directive != cdRefresh && !noCacheRequested(o, r) {
+		if data, err := t.Cacher.Retrieve(cacheKey); err == nil {
+			if err := json.Unmarshal([]byte(data), &record); err == nil {
+				rows, err = c.parseRows(record.Rows)
+				if err != nil {
+					record, rows = sqlCacheRecord{}, nil
+				} else {
+					cacheResult = crPartialHit
+				}
+			} else {
+				t.countError(o, psCache, classify(ecDecode, err))
+			}
+		}
+	}
+
+	missing := subtractExtents(req.extent, record.Extents)
+	switch {
+	case len(missing) == 0:
+		cacheResult = crHit
+	case cacheResult == crPartialHit && len(missing) == 1 && missing[0] == req.extent:
+		cacheResult = crRangeMiss
+	}
+
+	// fetch the missing parts of the range from the origin
+	col := c.timeColumn()
+	for _, e := range missing {
+		params := url.Values{}
+		for k, v := range req.params {
+			params[k] = v
+		}
+		params[col] = []string{"gte." + c.formatTime(e.Start), "lt." + c.formatTime(e.End)}
+		body, resp, _, err := t.getURL(o, http.MethodGet, originURL, params, t.getProxyableClientHeaders(r), requestDeadline(r))
+		if err != nil {
+			t.originLog(o, level.Error, "error fetching data from origin SQL gateway").Log(lfDetail, err.Error())
+			writeOriginError(w, r)
+			return true
+		}
+		t.LoadShedder.addUpstreamBytes(r, int64(len(body)))
+		if resp.StatusCode != http.StatusOK {
+			// errors are relayed to the client as the origin returned them
+			writeResponse(w, body, resp)
+			return true
+		}
+
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			t.originLog(o, level.Warn, "sql gateway response is not a json array, serving it uncached").Log(lfDetail, err.Error())
+			writeResponse(w, body, resp)
+			return true
+		}
+		if c.truncated(resp, len(raw)) {
+			// the request is proxied as is, since the rows missing from the page would leave a gap in the cache
+			t.originLog(o, level.Warn, "sql gateway response is truncated, proxying the request uncached").Log("rows", len(raw),
+				"contentRange", resp.Header.Get("Content-Range"))
+			return false
+		}
+		fetched, err := c.parseRows(raw)
+		if err != nil {
+			t.originLog(o, level.Warn, "unable to find the time of sql gateway rows, serving them uncached").Log(lfDetail, err.Error())
+			writeResponse(w, body, resp)
+			return true
+		}
+		rows = append(rows, fetched...)
+		record.Extents = append(record.Extents, e)
+	}
+	t.countCacheResult(o.OriginURL, otSQLGateway, mnSQLRange, cacheResult, http.StatusOK)
+
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].ts < rows[j].ts })
+	if cacheResult != crHit {
+		t.storeSQLRows(o, cacheKey, req.extent, record.Extents, rows)
+	}
+
+	// respond with the rows of the requested range, in the requested order
+	out := make([]json.RawMessage, 0, len(rows))
+	for _, row := range rows {
+		if row.ts >= req.extent.Start && row.ts < req.extent.End {
+			out = append(out, row.raw)
+		}
+	}
+	if req.desc {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "sql gateway rows marshaling error", lfDetail, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set(hnContentType, hvApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return true
+}
+
+// storeSQLRows caches the rows within the extents, less those older than the origin's max value age or too recent to
+// be complete
+func (t *TricksterHandler) storeSQLRows(o PrometheusOriginConfig, cacheKey string, requested sqlExtent, extents []sqlExtent, rows []sqlRow) {
+	now := time.Now()
+	window := sqlExtent{now.Add(-time.Duration(o.MaxValueAgeSecs) * time.Second).UnixNano(), now.Add(-time.Duration(o.NoCacheLastDataSecs) * time.Second).UnixNano()}
+	cached := []sqlExtent{}
+	for _, e := range mergeExtents(extents) {
+		e.Start, e.End = max64(e.Start, window.Start), min64(e.End, window.End)
+		if e.Start < e.End {
+			cached = append(cached, e)
+		}
+	}
+	if len(cached) == 0 {
+		return
+	}
+
+	record := sqlCacheRecord{Extents: cached, Rows: []json.RawMessage{}}
+	for _, row := range rows {
+		for _, e := range cached {
+			if row.ts >= e.Start && row.ts < e.End {
+				record.Rows = append(record.Rows, row.raw)
+				break
+			}
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "sql gateway rows marshaling error", lfDetail, err.Error())
+		return
+	}
+	ttl := rangeTTL(o.TTLBuckets, (requested.End-requested.Start)/int64(time.Second), t.Config.Caching.RecordTTLSecs)
+	if err := t.Cacher.Store(cacheKey, string(data), ttl); err != nil {
+		t.countError(o, psCache, err)
+	}
+}
@@ -0,0 +1,280 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSQLGatewayConfig_parseTime(t *testing.T) {
+	tests := []struct {
+		format string
+		value  interface{}
+		ns     int64
+		ok     bool
+	}{
+		{"", "2019-01-01T00:00:00Z", 1546300800000000000, true},
+		{sfRFC3339, "2019-01-01T01:00:00.5+01:00", 1546300800500000000, true},
+		{sfRFC3339, "2019-01-01 00:00:00+00", 0, false},
+		{sfRFC3339, "2019-01-01 00:00:00+00:00", 1546300800000000000, true},
+		{sfRFC3339, "2019-01-01", 1546300800000000000, true},
+		{sfUnix, float64(1546300800), 1546300800000000000, true},
+		{sfUnix, "1546300800.25", 1546300800250000000, true},
+		{sfUnixMS, float64(1546300800250), 1546300800250000000, true},
+		{sfUnix, "yesterday", 0, false},
+		{sfRFC3339, float64(1546300800), 0, false},
+		{sfUnix, "-1.5", -1500000000, true},
+	}
+
+	for i, test := range tests {
+		ns, err := SQLGatewayConfig{TimeFormat: test.format}.parseTime(test.value)
+		if (err == nil) != test.ok || ns != test.ns {
+			t.Errorf("test %d: unexpected result %d %v", i, ns, err)
+		}
+	}
+
+	// it should format filter values that parse back to the same time
+	for _, format := range []string{sfRFC3339, sfUnix, sfUnixMS} {
+		c := SQLGatewayConfig{TimeFormat: format}
+		for _, want := range []int64{1546300800250000000, -1500000000} {
+			if ns, err := c.parseTime(c.formatTime(want)); err != nil || ns != want {
+				t.Errorf("%s: unexpected result %d %v", format, ns, err)
+			}
+		}
+	}
+}
+
+func TestSubtractExtents(t *testing.T) {
+	covered := []sqlExtent{{10, 20}, {30, 40}}
+	tests := []struct {
+		e       sqlExtent
+		missing []sqlExtent
+	}{
+		{sqlExtent{10, 20}, []sqlExtent{}},
+		{sqlExtent{0, 50}, []sqlExtent{{0, 10}, {20, 30}, {40, 50}}},
+		{sqlExtent{15, 35}, []sqlExtent{{20, 30}}},
+		{sqlExtent{41, 45}, []sqlExtent{{41, 45}}},
+	}
+
+	for i, test := range tests {
+		if missing := subtractExtents(test.e, covered); !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("test %d: unexpected result %v", i, missing)
+		}
+	}
+
+	// it should merge overlapping and adjacent extents
+	if merged := mergeExtents([]sqlExtent{{30, 40}, {10, 20}, {20, 25}, {35, 50}}); !reflect.DeepEqual(merged, []sqlExtent{{10, 25}, {30, 50}}) {
+		t.Errorf("unexpected result %v", merged)
+	}
+}
+
+func TestPrometheusOriginConfig_parseSQLRangeRequest(t *testing.T) {
+	o := PrometheusOriginConfig{OriginType: otSQLGateway, SQLGateway: SQLGatewayConfig{TimeColumn: "ts", TimeFormat: sfUnix}}
+	tests := []struct {
+		query  string
+		header string
+		extent sqlExtent
+		desc   bool
+		ok     bool
+	}{
+		{"select=ts,v&ts=gte.10&ts=lt.20", "", sqlExtent{10e9, 20e9}, false, true},
+		{"ts=gt.10&ts=lte.20&order=ts.desc", "", sqlExtent{10e9 + 1, 20e9 + 1}, true, true},
+		{"ts=gte.10", "", sqlExtent{}, false, false},
+		{"ts=gte.20&ts=lt.10", "", sqlExtent{}, false, false},
+		{"ts=gte.10&ts=lt.20&limit=5", "", sqlExtent{}, false, false},
+		{"ts=gte.10&ts=lt.20&order=v", "", sqlExtent{}, false, false},
+		{"ts=gte.10&ts=neq.20", "", sqlExtent{}, false, false},
+		{"ts=gte.10&ts=lt.20", "text/csv", sqlExtent{}, false, false},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://trickster/metrics?"+test.query, nil)
+		if test.header != "" {
+			r.Header.Set("Accept", test.header)
+		}
+		req, ok := o.parseSQLRangeRequest(r)
+		if ok != test.ok || (ok && (req.extent != test.extent || req.desc != test.desc)) {
+			t.Errorf("test %d: unexpected result %v %v", i, req, ok)
+		}
+	}
+
+	// it should leave the time filters out of the parameters that identify the cached rows
+	r := httptest.NewRequest(http.MethodGet, "http://trickster/metrics?select=ts,v&ts=gte.10&ts=lt.20", nil)
+	if req, _ := o.parseSQLRangeRequest(r); req.params.Encode() != "select=ts%2Cv" {
+		t.Errorf("unexpected params %s", req.params.Encode())
+	}
+
+	// it should reject unknown time formats
+	if err := (SQLGatewayConfig{TimeFormat: "iso"}).validate(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_sqlGateway(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// a row per minute over the two hours up to an hour ago
+	base := time.Now().Add(-3 * time.Hour).Truncate(time.Minute).UTC()
+	type row struct {
+		Time string `json:"time"`
+		Host string `json:"host"`
+		CPU  int    `json:"cpu"`
+	}
+	rows := []row{}
+	for i := 0; i < 120; i++ {
+		rows = append(rows, row{base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339), "web1", i})
+	}
+
+	var filters []url.Values
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		filters = append(filters, params)
+		out := []row{}
+		for _, rw := range rows {
+			ts, _ := time.Parse(time.RFC3339, rw.Time)
+			keep := true
+			for _, f := range params["time"] {
+				bound, _ := time.Parse(time.RFC3339Nano, f[strings.Index(f, ".")+1:])
+				switch f[:strings.Index(f, ".")] {
+				case "gte":
+					keep = keep && !ts.Before(bound)
+				case "lt":
+					keep = keep && ts.Before(bound)
+				}
+			}
+			if keep {
+				out = append(out, rw)
+			}
+		}
+		if params.Get("limit") != "" {
+			out = out[:1]
+		}
+		json.NewEncoder(w).Encode(out)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.OriginType = otSQLGateway
+	tr.Config.Origins["default"] = o
+
+	get := func(from, to int, extra string) []row {
+		q := fmt.Sprintf("http://trickster/metrics?select=time,host,cpu&host=eq.web1&time=gte.%s&time=lt.%s%s",
+			base.Add(time.Duration(from)*time.Minute).Format(time.RFC3339), base.Add(time.Duration(to)*time.Minute).Format(time.RFC3339), extra)
+		w := httptest.NewRecorder()
+		tr.promFullProxyHandler(w, httptest.NewRequest(http.MethodGet, q, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("wanted %d got %d.", http.StatusOK, w.Code)
+		}
+		out := []row{}
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	status := func(result string) float64 {
+		return testutil.ToFloat64(tr.Metrics.CacheRequestStatus.WithLabelValues(es.URL, otSQLGateway, mnSQLRange, result, "200"))
+	}
+
+	// it should fetch and cache the rows of the requested range
+	if out := get(0, 60, ""); len(out) != 60 || out[0].CPU != 0 || out[59].CPU != 59 {
+		t.Errorf("unexpected rows %v", out)
+	}
+	if status(crKeyMiss) != 1 {
+		t.Errorf("wanted %d got %v.", 1, status(crKeyMiss))
+	}
+
+	// it should only fetch the missing part of an overlapping range
+	if out := get(30, 90, ""); len(out) != 60 || out[0].CPU != 30 || out[59].CPU != 89 {
+		t.Errorf("unexpected rows %v", out)
+	}
+	if len(filters) != 2 || strings.Join(filters[1]["time"], ",") != "gte."+base.Add(60*time.Minute).Format(time.RFC3339)+",lt."+base.Add(90*time.Minute).Format(time.RFC3339) {
+		t.Errorf("unexpected filters %v", filters)
+	}
+	if filters[1].Get("host") != "eq.web1" || filters[1].Get("select") != "time,host,cpu" {
+		t.Errorf("unexpected filters %v", filters[1])
+	}
+	if status(crPartialHit) != 1 {
+		t.Errorf("wanted %d got %v.", 1, status(crPartialHit))
+	}
+
+	// it should serve covered ranges from the cache, in the requested order
+	if out := get(10, 80, "&order=time.desc"); len(out) != 70 || out[0].CPU != 79 || out[69].CPU != 10 {
+		t.Errorf("unexpected rows %v", out)
+	}
+	if len(filters) != 2 {
+		t.Errorf("wanted %d got %d.", 2, len(filters))
+	}
+	if status(crHit) != 1 {
+		t.Errorf("wanted %d got %v.", 1, status(crHit))
+	}
+
+	// it should proxy paginated requests as they are
+	if out := get(10, 80, "&limit=1"); len(out) != 1 || len(filters) != 3 || filters[2].Get("limit") != "1" {
+		t.Errorf("unexpected rows %v", out)
+	}
+
+	// it should keep the rows of requests with other filters apart
+	if out := get(0, 60, "&cpu=gte.50"); len(out) != 60 || len(filters) != 4 || filters[3].Get("cpu") != "gte.50" {
+		t.Errorf("unexpected rows %d", len(out))
+	}
+
+	// it should proxy requests whose rows may be truncated without caching them
+	o.SQLGateway.MaxRows = 60
+	tr.Config.Origins["default"] = o
+	for i := 0; i < 2; i++ {
+		if out := get(0, 60, "&cpu=gte.0"); len(out) != 60 {
+			t.Errorf("unexpected rows %d", len(out))
+		}
+	}
+	if len(filters) != 8 || filters[7].Get("time") != "gte."+base.Format(time.RFC3339) {
+		t.Errorf("unexpected filters %v", filters)
+	}
+}
+
+func TestSQLGatewayConfig_truncated(t *testing.T) {
+	tests := []struct {
+		maxRows      int
+		contentRange string
+		rows         int
+		truncated    bool
+	}{
+		{0, "", 1000, false},
+		{1000, "", 999, false},
+		{1000, "", 1000, true},
+		{0, "0-99/*", 100, false},
+		{0, "0-99/100", 100, false},
+		{0, "0-99/1000", 100, true},
+		{0, "*/0", 0, false},
+	}
+	for i, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.contentRange != "" {
+			resp.Header.Set("Content-Range", test.contentRange)
+		}
+		if (SQLGatewayConfig{MaxRows: test.maxRows}).truncated(resp, test.rows) != test.truncated {
+			t.Errorf("test %d: unexpected result %v", i, !test.truncated)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// Lock wait results
+	lwHit     = "hit"
+	lwMiss    = "miss"
+	lwTimeout = "timeout"
+)
+
+// StampedeConfig describes the protection of the origins from the concurrent requests for a popular record that is
+// missing from the cache or has expired
+type StampedeConfig struct {
+	// LockWaitMS is how long a request for a missing record waits for another request that is fetching it, rather than
+	// fetching it too. Default is 0 (requests do not wait)
+	LockWaitMS int64 `toml:"lock_wait_ms"`
+	// StaleSecs is how long records are kept after they expire, to be served while a single request refreshes them.
+	// Default is 0 (expired records are not served)
+	StaleSecs int64 `toml:"stale_secs"`
+	// TTLJitterPercent shortens the TTL of each record by a random share of up to this percentage, so that records
+	// cached together do not expire together. Default is 0 (no jitter)
+	TTLJitterPercent int64 `toml:"ttl_jitter_percent"`
+}
+
+// validate returns an error if the stampede protection settings are invalid
+func (c StampedeConfig) validate() error {
+	if c.LockWaitMS < 0 || c.StaleSecs < 0 || c.TTLJitterPercent < 0 {
+		return fmt.Errorf("cache: stampede settings must not be negative")
+	}
+	if c.TTLJitterPercent >= 100 {
+		return fmt.Errorf("cache: stampede ttl_jitter_percent must be less than 100")
+	}
+	return nil
+}
+
+// enabled returns true if requests for missing or expired records are coordinated
+func (c StampedeConfig) enabled() bool {
+	return c.LockWaitMS > 0 || c.StaleSecs > 0
+}
+
+// jitterTTL returns the ttl shortened by a random share of up to TTLJitterPercent
+func (c StampedeConfig) jitterTTL(ttl int64) int64 {
+	if c.TTLJitterPercent <= 0 {
+		return ttl
+	}
+	max := ttl * c.TTLJitterPercent / 100
+	if max <= 0 {
+		return ttl
+	}
+	return ttl - rand.Int63n(max+1)
+}
+
+// storeTTL returns the TTL a record that is fresh for ttl seconds is stored with, which keeps it for the stale window
+func (c StampedeConfig) storeTTL(ttl int64) int64 {
+	return c.jitterTTL(ttl) + c.StaleSecs
+}
+
+// keyLocks holds a lock for each cache key being fetched from an origin. The zero value is ready to use.
+type keyLocks struct {
+	mtx   sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// tryLock locks the key, returning the function that unlocks it, which may be called more than once, or false if the
+// key is already locked
+func (l *keyLocks) tryLock(key string) (func(), bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, ok := l.locks[key]; ok {
+		return nil, false
+	}
+	if l.locks == nil {
+		l.locks = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	l.locks[key] = ch
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mtx.Lock()
+			delete(l.locks, key)
+			l.mtx.Unlock()
+			close(ch)
+		})
+	}, true
+}
+
+// lock locks the key, waiting up to wait for another holder to unlock it. It returns the function that unlocks the
+// key, whether it waited for another holder, and false if the wait timed out, leaving the key unlocked.
+func (l *keyLocks) lock(key string, wait time.Duration) (unlock func(), waited bool, locked bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		if unlock, ok := l.tryLock(key); ok {
+			return unlock, waited, true
+		}
+		l.mtx.Lock()
+		ch, ok := l.locks[key]
+		l.mtx.Unlock()
+		if !ok {
+			continue
+		}
+		waited = true
+		select {
+		case <-ch:
+		case <-timer.C:
+			return func() {}, true, false
+		}
+	}
+}
+
+// retrieveProtected retrieves the record with the key for a request that fetches and stores it when it is missing
+// or expired, and then calls the returned function. Requests for a missing record wait for another request that is
+// fetching it, up to lock_wait_ms, and requests for an expired record are served it while another request refreshes
+// it. The record is to be fetched from the origin when the error is not nil.
+func (t *TricksterHandler) retrieveProtected(o PrometheusOriginConfig, cacheKey string) (string, func(), error) {
+	sc := t.Config.Caching.Stampede
+	data, err := t.Cacher.Retrieve(cacheKey)
+	if !sc.enabled() {
+		return data, func() {}, err
+	}
+
+	if err == nil {
+		if !t.expired(cacheKey) {
+			return data, func() {}, nil
+		}
+		// the expired record is refreshed by a single request, and served to the others until it is
+		unlock, ok := t.KeyLocks.tryLock(cacheKey)
+		if !ok {
+			t.Metrics.CacheStaleServes.WithLabelValues(o.OriginURL).Inc()
+			return data, func() {}, nil
+		}
+		return "", unlock, &cacheMissError{key: cacheKey}
+	}
+
+	if sc.LockWaitMS <= 0 {
+		if unlock, ok := t.KeyLocks.tryLock(cacheKey); ok {
+			return "", unlock, err
+		}
+		return "", func() {}, err
+	}
+	unlock, waited, locked := t.KeyLocks.lock(cacheKey, time.Duration(sc.LockWaitMS)*time.Millisecond)
+	if !waited {
+		return "", unlock, err
+	}
+	if !locked {
+		t.Metrics.CacheLockWaits.WithLabelValues(o.OriginURL, lwTimeout).Inc()
+		return "", unlock, err
+	}
+	// the request that held the lock has most likely stored the record
+	if data, err := t.Cacher.Retrieve(cacheKey); err == nil {
+		unlock()
+		t.Metrics.CacheLockWaits.WithLabelValues(o.OriginURL, lwHit).Inc()
+		return data, func() {}, nil
+	}
+	t.Metrics.CacheLockWaits.WithLabelValues(o.OriginURL, lwMiss).Inc()
+	return "", unlock, err
+}
+
+// refreshRequestedRange sets up the context to fetch the requested range of an expired data set again, rather
+// than serve it from the cache
+func (ctx *ClientRequestContext) refreshRequestedRange() {
+	if ctx.CacheLookupResult == crHit {
+		ctx.CacheLookupResult = crRangeMiss
+	}
+	ctx.OriginLowerExtents = MatrixExtents{}
+	ctx.OriginUpperExtents = ctx.RequestExtents
+}
+
+// mergeRefreshedRange returns the cached data set with the points within the extents replaced by the refreshed
+// ones, keeping the cached points outside of them
+func (t *TricksterHandler) mergeRefreshedRange(cached, refreshed PrometheusMatrixEnvelope, e MatrixExtents) PrometheusMatrixEnvelope {
+	before := cached.copy()
+	before.cropToRange(0, e.Start-1)
+	after := cached.copy()
+	after.cropToRange(e.End+1, 0)
+
+	// the cropped series share their points with the cached ones, and are clipped so that merges do not write to them
+	for _, m := range []PrometheusMatrixEnvelope{before, after} {
+		for _, s := range m.Data.Result {
+			s.Values = s.Values[:len(s.Values):len(s.Values)]
+		}
+	}
+	return t.mergeMatrix(after, t.mergeMatrix(refreshed, before))
+}
+
+// expired returns true if the record with the key is past its TTL, and is only kept for the stale window
+func (t *TricksterHandler) expired(cacheKey string) bool {
+	stale := t.Config.Caching.Stampede.StaleSecs
+	if stale <= 0 {
+		return false
+	}
+	expiration, err := t.Cacher.Expiration(cacheKey)
+	if err != nil {
+		return false
+	}
+	return expiration-stale <= time.Now().Unix()
+}
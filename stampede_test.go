@@ -0,0 +1,274 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestStampedeConfig_validate(t *testing.T) {
+	tests := []struct {
+		config StampedeConfig
+		valid  bool
+	}{
+		{StampedeConfig{}, true},
+		{StampedeConfig{LockWaitMS: 2000, StaleSecs: 30, TTLJitterPercent: 10}, true},
+		{StampedeConfig{LockWaitMS: -1}, false},
+		{StampedeConfig{StaleSecs: -1}, false},
+		{StampedeConfig{TTLJitterPercent: 100}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestStampedeConfig_jitterTTL(t *testing.T) {
+	// it should not change the ttl without jitter
+	if ttl := (StampedeConfig{}).jitterTTL(600); ttl != 600 {
+		t.Errorf("wanted %d got %d.", 600, ttl)
+	}
+
+	// it should shorten the ttl by up to the jitter percentage
+	c := StampedeConfig{TTLJitterPercent: 10, StaleSecs: 30}
+	for i := 0; i < 100; i++ {
+		if ttl := c.jitterTTL(600); ttl < 540 || ttl > 600 {
+			t.Fatalf("unexpected ttl %d", ttl)
+		}
+		if ttl := c.storeTTL(600); ttl < 570 || ttl > 630 {
+			t.Fatalf("unexpected store ttl %d", ttl)
+		}
+	}
+}
+
+func TestKeyLocks(t *testing.T) {
+	var l keyLocks
+
+	// it should lock a key once
+	unlock, ok := l.tryLock("key")
+	if !ok {
+		t.Fatal("expected the key to be locked")
+	}
+	if _, ok := l.tryLock("key"); ok {
+		t.Errorf("expected the key to be locked once")
+	}
+	if u, ok := l.tryLock("other"); !ok {
+		t.Errorf("expected another key to be locked")
+	} else {
+		u()
+	}
+
+	// it should time out waiting for a locked key, leaving it locked by its holder
+	if _, waited, locked := l.lock("key", 10*time.Millisecond); !waited || locked {
+		t.Errorf("unexpected result %t %t", waited, locked)
+	}
+
+	// it should lock the key once its holder unlocks it
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		unlock()
+	}()
+	u, waited, locked := l.lock("key", time.Second)
+	if !waited || !locked {
+		t.Errorf("unexpected result %t %t", waited, locked)
+	}
+	u()
+	u()
+	if _, waited, locked := l.lock("key", time.Second); waited || !locked {
+		t.Errorf("unexpected result %t %t", waited, locked)
+	}
+}
+
+func TestTricksterHandler_stampedeProtection(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var requests int32
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set(hnContentType, hvApplicationJSON)
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	o := tr.Config.Origins["default"]
+	o.ObjectCache.Enabled = true
+	tr.Config.Origins["default"] = o
+	tr.Config.Caching.Stampede = StampedeConfig{LockWaitMS: 2000, StaleSecs: 60}
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+"/api/v2/alerts", nil))
+		return w.Code
+	}
+
+	// it should fetch a missing record once for concurrent requests
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := get(); code != http.StatusOK {
+				t.Errorf("wanted %d got %d.", http.StatusOK, code)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("wanted %d got %d.", 1, n)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheLockWaits.WithLabelValues(es.URL, lwHit)); v != 4 {
+		t.Errorf("wanted %d got %v.", 4, v)
+	}
+
+	// it should keep records for the stale window
+	key := o.objectCacheKey(httptest.NewRequest("GET", es.URL+"/api/v2/alerts", nil), es.URL+"/api/v2/alerts")
+	if e, err := tr.Cacher.Expiration(key); err != nil || e < time.Now().Unix()+60 {
+		t.Errorf("unexpected expiration %d %v", e, err)
+	}
+
+	// it should serve an expired record while another request refreshes it
+	data, _ := tr.Cacher.Retrieve(key)
+	tr.Cacher.Store(key, data, 30)
+	unlock, _ := tr.KeyLocks.tryLock(key)
+	get()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("wanted %d got %d.", 1, n)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheStaleServes.WithLabelValues(es.URL)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+	unlock()
+
+	// it should refresh an expired record
+	get()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("wanted %d got %d.", 2, n)
+	}
+	if tr.expired(key) {
+		t.Errorf("expected a fresh record")
+	}
+}
+
+func TestTricksterHandler_stampedeProtection_range(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// the points of each response have the number of the request as their value
+	var requests int32
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		start, _ := parseTime(r.FormValue(upStart))
+		end, _ := parseTime(r.FormValue(upEnd))
+		ss := &model.SampleStream{Metric: model.Metric{"__name__": "up"}}
+		for ts := start.Unix() - start.Unix()%15; ts <= end.Unix(); ts += 15 {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: model.SampleValue(n)})
+		}
+		json.NewEncoder(w).Encode(PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{ss}}})
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	tr.Config.Caching.Stampede = StampedeConfig{StaleSecs: 60}
+
+	now := time.Now().Unix()
+	now -= now % 15
+	// the data set is cached for a wider range than the one that is refreshed
+	wide := fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=15", now-1200, now-300)
+	query := fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=15", now-900, now-600)
+	get := func(query string) {
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("wanted %d got %d.", http.StatusOK, w.Code)
+		}
+	}
+	get(wide)
+	n := atomic.LoadInt32(&requests)
+
+	// it should keep data sets for the stale window
+	ctx, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+query, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.CacheLookupResult != crHit {
+		t.Fatalf("wanted %s got %s.", crHit, ctx.CacheLookupResult)
+	}
+	if e, err := tr.Cacher.Expiration(ctx.CacheKey); err != nil || e < time.Now().Unix()+60 {
+		t.Errorf("unexpected expiration %d %v", e, err)
+	}
+
+	// it should serve an expired data set while another request refreshes it
+	data, _ := tr.Cacher.Retrieve(ctx.CacheKey)
+	tr.Cacher.Store(ctx.CacheKey, data, 30)
+	unlock, _ := tr.KeyLocks.tryLock(ctx.CacheKey)
+	get(query)
+	if m := atomic.LoadInt32(&requests); m != n {
+		t.Errorf("wanted %d got %d.", n, m)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheStaleServes.WithLabelValues(es.URL + prometheusAPIv1Path)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+	unlock()
+
+	// it should refresh an expired data set
+	get(query)
+	if m := atomic.LoadInt32(&requests); m != n+1 {
+		t.Errorf("wanted %d got %d.", n+1, m)
+	}
+	if tr.expired(ctx.CacheKey) {
+		t.Errorf("expected a fresh data set")
+	}
+	if _, ok := tr.KeyLocks.tryLock(ctx.CacheKey); !ok {
+		t.Errorf("expected the data set to be unlocked")
+	}
+
+	// it should merge the refreshed range into the cached data set, keeping the points outside of it
+	data, _ = tr.Cacher.Retrieve(ctx.CacheKey)
+	body, err := decompressCacheBody([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe := PrometheusMatrixEnvelope{}
+	if err := parseMatrix(body, &pe); err != nil {
+		t.Fatal(err)
+	}
+	if len(pe.Data.Result) != 1 {
+		t.Fatalf("wanted %d got %d.", 1, len(pe.Data.Result))
+	}
+	values := pe.Data.Result[0].Values
+	if len(values) != 61 {
+		t.Errorf("wanted %d got %d.", 61, len(values))
+	}
+	for i, v := range values {
+		ts, want := v.Timestamp.Unix(), model.SampleValue(n)
+		if ts >= now-900 && ts <= now-600 {
+			want = model.SampleValue(n + 1)
+		}
+		if ts != now-1200+int64(i)*15 || v.Value != want {
+			t.Errorf("test %d: unexpected result %v", i, v)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Bounds of the wait between attempts to reach startup dependencies
+	startupMinBackoff = time.Second
+	startupMaxBackoff = 30 * time.Second
+)
+
+// retryWithBackoff calls fn until it succeeds or the next attempt would be after the deadline, doubling the wait
+// between attempts up to max, and returns the error of the last attempt
+func retryWithBackoff(deadline time.Time, min, max time.Duration, fn func() error) error {
+	backoff := min
+	for {
+		err := fn()
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// connectCache connects to the cache, retrying for up to the configured startup wait. When the cache is still
+// unreachable and degraded startup is allowed, the instance proxies all requests without caching, as in bypass mode,
+// while it keeps trying to connect in the background.
+func (t *TricksterHandler) connectCache() error {
+	deadline := time.Now().Add(time.Duration(t.Config.Main.StartupWaitSecs) * time.Second)
+	err := retryWithBackoff(deadline, startupMinBackoff, startupMaxBackoff, func() error {
+		err := t.Cacher.Connect()
+		if err != nil && t.Config.Main.StartupWaitSecs > 0 {
+			level.Warn(t.Logger).Log(lfEvent, "unable to connect to cache, retrying", lfDetail, err.Error())
+		}
+		return err
+	})
+	if err == nil || !t.Config.Main.StartupDegraded {
+		return err
+	}
+
+	level.Error(t.Logger).Log(lfEvent, "starting without a cache until it is reachable", lfDetail, err.Error())
+	t.setCacheUnavailable(true)
+	go func() {
+		for {
+			time.Sleep(startupMaxBackoff)
+			if err := t.Cacher.Connect(); err == nil {
+				t.setCacheUnavailable(false)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// setCacheUnavailable records whether the cache could not be reached at startup, during which time all requests are
+// proxied without caching
+func (t *TricksterHandler) setCacheUnavailable(unavailable bool) {
+	var v int32
+	if unavailable {
+		v = 1
+	}
+	if atomic.SwapInt32(&t.cacheUnavailable, v) != v && !unavailable {
+		level.Info(t.Logger).Log(lfEvent, "connected to cache")
+	}
+	t.updateBypassMetric()
+}
+
+// waitForOrigins waits for up to the configured startup wait for every origin to pass its health check, and returns
+// an error naming those that did not
+func (t *TricksterHandler) waitForOrigins() error {
+	names := make([]string, 0, len(t.Config.Origins))
+	for name := range t.Config.Origins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	deadline := time.Now().Add(time.Duration(t.Config.Main.StartupWaitSecs) * time.Second)
+	return retryWithBackoff(deadline, startupMinBackoff, startupMaxBackoff, func() error {
+		unhealthy := []string{}
+		for _, name := range names {
+			if code := t.checkOrigin(name); code != http.StatusOK {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s (%d)", name, code))
+			}
+		}
+		if len(unhealthy) > 0 {
+			err := fmt.Errorf("origins failed their health check: %v", unhealthy)
+			level.Warn(t.Logger).Log(lfEvent, "waiting for origins", lfDetail, err.Error())
+			return err
+		}
+		return nil
+	})
+}
+
+// checkOrigin makes the health check of the named origin, as a request to its /health endpoint would, and returns
+// the resulting status code
+func (t *TricksterHandler) checkOrigin(name string) int {
+	r := httptest.NewRequest(http.MethodGet, "http://trickster/"+name+"/health", nil)
+	r = mux.SetURLVars(r, map[string]string{"originMoniker": name})
+	w := httptest.NewRecorder()
+	t.promHealthCheckHandler(w, r)
+	return w.Code
+}
@@ -0,0 +1,102 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	// it should retry until the attempt succeeds
+	attempts := 0
+	err := retryWithBackoff(time.Now().Add(time.Second), time.Millisecond, 4*time.Millisecond, func() error {
+		if attempts++; attempts < 4 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if attempts != 4 {
+		t.Errorf("wanted %d got %d.", 4, attempts)
+	}
+
+	// it should make a single attempt, and return its error, without time to retry
+	attempts = 0
+	err = retryWithBackoff(time.Now(), time.Millisecond, 4*time.Millisecond, func() error {
+		attempts++
+		return fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if attempts != 1 {
+		t.Errorf("wanted %d got %d.", 1, attempts)
+	}
+}
+
+func TestTricksterHandler_connectCache_degraded(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	cacher := tr.Cacher
+	defer func() { tr.Cacher = cacher }()
+	tr.Cacher = &BoltDBCache{T: tr, Config: BoltDBCacheConfig{Filename: "/nonexistent/trickster.db", Bucket: "trickster"}}
+
+	// it should fail when the cache is unreachable
+	if err := tr.connectCache(); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// it should start without the cache, bypassing it, when degraded startup is allowed
+	tr.Config.Main.StartupDegraded = true
+	if err := tr.connectCache(); err != nil {
+		t.Error(err)
+	}
+	if !tr.bypassed() {
+		t.Errorf("expected the cache to be bypassed")
+	}
+
+	tr.setCacheUnavailable(false)
+	if tr.bypassed() {
+		t.Errorf("expected the cache not to be bypassed")
+	}
+}
+
+func TestTricksterHandler_waitForOrigins(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	es := newTestServer("{}")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// it should succeed when every origin is healthy
+	if code := tr.checkOrigin("default"); code != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, code)
+	}
+	if err := tr.waitForOrigins(); err != nil {
+		t.Error(err)
+	}
+
+	// it should name the origins that are not
+	tr.Config.Origins["down"] = PrometheusOriginConfig{OriginURL: nonexistantOrigin, APIPath: prometheusAPIv1Path}
+	if err := tr.waitForOrigins(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,281 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	defaultStatsBucketSecs = 60
+	defaultStatsBuckets    = 60
+
+	// statsCacheKey is the cache key the stats are persisted to
+	statsCacheKey = "trickster.stats"
+)
+
+// StatsConfig describes the cache hit ratio history kept in memory and reported by /trickster/stats
+type StatsConfig struct {
+	// BucketSecs is the duration of each bucket of the history. Default is 60
+	BucketSecs int64 `toml:"bucket_secs"`
+	// Buckets is the number of buckets kept. Default is 60
+	Buckets int `toml:"buckets"`
+	// Persist stores the history in the cache at the end of each bucket, and restores it at startup, so that it
+	// survives restarts when the cache does
+	Persist bool `toml:"persist"`
+}
+
+// bucketSecs returns the duration of each bucket of the history
+func (c StatsConfig) bucketSecs() int64 {
+	if c.BucketSecs > 0 {
+		return c.BucketSecs
+	}
+	return defaultStatsBucketSecs
+}
+
+// buckets returns the number of buckets kept
+func (c StatsConfig) buckets() int {
+	if c.Buckets > 0 {
+		return c.Buckets
+	}
+	return defaultStatsBuckets
+}
+
+// validate returns an error if the bucket settings are negative
+func (c StatsConfig) validate() error {
+	if c.BucketSecs < 0 || c.Buckets < 0 {
+		return fmt.Errorf("stats: bucket settings must not be negative")
+	}
+	return nil
+}
+
+// statsSeries identifies the requests of an origin (by URL) and path ('query_range', 'query', 'proxy', ...) that
+// are counted together
+type statsSeries struct {
+	Origin string `json:"origin"`
+	Path   string `json:"path"`
+}
+
+// statsCounts are the counted requests of a series in a bucket, by cache result
+type statsCounts struct {
+	statsSeries
+	Results  map[string]int64 `json:"results"`
+	HitRatio float64          `json:"hit_ratio"`
+}
+
+// statsBucket holds the requests counted from its start, in seconds since the epoch, for a bucket duration
+type statsBucket struct {
+	Start  int64          `json:"start"`
+	Series []*statsCounts `json:"series"`
+}
+
+// HitStats keeps a rolling history of the cache results of the requests of each origin and path, in time buckets.
+// A nil HitStats counts nothing.
+type HitStats struct {
+	config StatsConfig
+
+	mu      sync.Mutex
+	buckets []*statsBucket
+}
+
+// NewHitStats returns an empty history
+func NewHitStats(c StatsConfig) *HitStats {
+	return &HitStats{config: c}
+}
+
+// record counts a request of the origin and path with the cache result at the time
+func (s *HitStats) record(origin, path, result string, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := now.Unix() / s.config.bucketSecs() * s.config.bucketSecs()
+	var b *statsBucket
+	if n := len(s.buckets); n > 0 && s.buckets[n-1].Start == start {
+		b = s.buckets[n-1]
+	} else {
+		b = &statsBucket{Start: start}
+		s.buckets = append(s.buckets, b)
+		s.trim(start)
+	}
+
+	key := statsSeries{Origin: origin, Path: path}
+	for _, c := range b.Series {
+		if c.statsSeries == key {
+			c.Results[result]++
+			return
+		}
+	}
+	b.Series = append(b.Series, &statsCounts{statsSeries: key, Results: map[string]int64{result: 1}})
+}
+
+// trim forgets the buckets that are too old to be kept at the time of the bucket starting at start. s.mu must be held.
+func (s *HitStats) trim(start int64) {
+	oldest := start - int64(s.config.buckets()-1)*s.config.bucketSecs()
+	i := 0
+	for i < len(s.buckets) && s.buckets[i].Start < oldest {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+}
+
+// statsReport is the hit ratio history reported by /trickster/stats
+type statsReport struct {
+	BucketSecs int64 `json:"bucket_secs"`
+	// Totals are the counts of each series over the whole history
+	Totals  []*statsCounts `json:"totals"`
+	Buckets []*statsBucket `json:"buckets"`
+}
+
+// report returns a copy of the history at the time, restricted to the origin (by URL) when it is set
+func (s *HitStats) report(origin string, now time.Time) statsReport {
+	r := statsReport{Totals: []*statsCounts{}, Buckets: []*statsBucket{}}
+	if s == nil {
+		return r
+	}
+	r.BucketSecs = s.config.bucketSecs()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trim(now.Unix() / s.config.bucketSecs() * s.config.bucketSecs())
+
+	totals := map[statsSeries]*statsCounts{}
+	for _, b := range s.buckets {
+		rb := &statsBucket{Start: b.Start, Series: []*statsCounts{}}
+		for _, c := range b.Series {
+			if origin != "" && c.Origin != origin {
+				continue
+			}
+			rc := &statsCounts{statsSeries: c.statsSeries, Results: map[string]int64{}}
+			t, ok := totals[c.statsSeries]
+			if !ok {
+				t = &statsCounts{statsSeries: c.statsSeries, Results: map[string]int64{}}
+				totals[c.statsSeries] = t
+				r.Totals = append(r.Totals, t)
+			}
+			for result, n := range c.Results {
+				rc.Results[result] = n
+				t.Results[result] += n
+			}
+			rc.setHitRatio()
+			rb.Series = append(rb.Series, rc)
+		}
+		r.Buckets = append(r.Buckets, rb)
+	}
+	for _, t := range r.Totals {
+		t.setHitRatio()
+	}
+	sort.Slice(r.Totals, func(i, j int) bool {
+		if r.Totals[i].Origin != r.Totals[j].Origin {
+			return r.Totals[i].Origin < r.Totals[j].Origin
+		}
+		return r.Totals[i].Path < r.Totals[j].Path
+	})
+	return r
+}
+
+// setHitRatio sets the share of the counted requests that were full cache hits
+func (c *statsCounts) setHitRatio() {
+	var total int64
+	for _, n := range c.Results {
+		total += n
+	}
+	if total > 0 {
+		c.HitRatio = float64(c.Results[crHit]) / float64(total)
+	}
+}
+
+// persist stores the history in the cache, expiring once all of it is too old to be kept
+func (s *HitStats) persist(c Cache) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.buckets)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Store(statsCacheKey, string(data), int64(s.config.buckets())*s.config.bucketSecs())
+}
+
+// restore loads the history persisted in the cache, if any, ahead of the buckets counted since startup
+func (s *HitStats) restore(c Cache) error {
+	data, err := c.Retrieve(statsCacheKey)
+	if err != nil {
+		return err
+	}
+	var buckets []*statsBucket
+	if err := json.Unmarshal([]byte(data), &buckets); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buckets) > 0 {
+		kept := buckets[:0]
+		for _, b := range buckets {
+			if b.Start < s.buckets[0].Start {
+				kept = append(kept, b)
+			}
+		}
+		buckets = kept
+	}
+	s.buckets = append(buckets, s.buckets...)
+	s.trim(time.Now().Unix() / s.config.bucketSecs() * s.config.bucketSecs())
+	return nil
+}
+
+// persistPeriodically persists the history at the end of each bucket
+func (s *HitStats) persistPeriodically(c Cache, logger log.Logger) {
+	for range time.Tick(time.Duration(s.config.bucketSecs()) * time.Second) {
+		if err := s.persist(c); err != nil {
+			level.Warn(logger).Log(lfEvent, "error persisting stats", lfDetail, err.Error())
+		}
+	}
+}
+
+// countCacheResult counts a request's cache result in the requests metric and the hit ratio history
+func (t *TricksterHandler) countCacheResult(originURL, originType, path, result string, code int) {
+	t.Metrics.CacheRequestStatus.WithLabelValues(originURL, originType, path, result, strconv.Itoa(code)).Inc()
+	t.Stats.record(originURL, path, result, time.Now())
+}
+
+// statsHandler handles calls to /trickster/stats?origin=..., which reports the cache results and hit ratios of the
+// requests of each origin and path over the kept history, in total and by time bucket
+func (t *TricksterHandler) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(hnCacheControl, hvNoCache)
+	w.Header().Set(hnContentType, hvApplicationJSON)
+
+	originURL := ""
+	if name := r.URL.Query().Get(upOrigin); name != "" {
+		o, ok := t.Config.Origins[name]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("unknown origin %q", name)})
+			return
+		}
+		originURL = o.OriginURL
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t.Stats.report(originURL, time.Now()))
+}
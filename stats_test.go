@@ -0,0 +1,136 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHitStats_report(t *testing.T) {
+	s := NewHitStats(StatsConfig{BucketSecs: 60, Buckets: 3})
+	now := time.Unix(6000, 0)
+
+	s.record("http://a", mnQueryRange, crHit, now.Add(-5*time.Minute))
+	s.record("http://a", mnQueryRange, crHit, now.Add(-90*time.Second))
+	s.record("http://a", mnQueryRange, crKeyMiss, now.Add(-90*time.Second))
+	s.record("http://a", mnQueryRange, crHit, now)
+	s.record("http://a", mnQueryRange, crPartialHit, now)
+	s.record("http://a", mnQuery, crHit, now)
+	s.record("http://b", mnQueryRange, crKeyMiss, now)
+
+	// it should report the kept buckets, forgetting those that are too old
+	r := s.report("", now)
+	if r.BucketSecs != 60 || len(r.Buckets) != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if r.Buckets[0].Start != 5880 || r.Buckets[1].Start != 6000 {
+		t.Errorf("unexpected bucket starts %d, %d", r.Buckets[0].Start, r.Buckets[1].Start)
+	}
+	if len(r.Buckets[1].Series) != 3 {
+		t.Errorf("wanted %d got %d.", 3, len(r.Buckets[1].Series))
+	}
+
+	// it should total the results and hit ratio of each origin and path
+	if len(r.Totals) != 3 {
+		t.Fatalf("wanted %d got %d.", 3, len(r.Totals))
+	}
+	total := r.Totals[1]
+	if total.Origin != "http://a" || total.Path != mnQueryRange || total.Results[crHit] != 2 ||
+		total.Results[crKeyMiss] != 1 || total.Results[crPartialHit] != 1 || total.HitRatio != 0.5 {
+		t.Errorf("unexpected totals %+v", total)
+	}
+
+	// it should restrict the report to an origin
+	if r := s.report("http://b", now); len(r.Totals) != 1 || r.Totals[0].HitRatio != 0 {
+		t.Errorf("unexpected report %+v", r.Totals)
+	}
+
+	// it should report nothing without stats
+	var nilStats *HitStats
+	nilStats.record("http://a", mnQuery, crHit, now)
+	if r := nilStats.report("", now); len(r.Totals) != 0 || len(r.Buckets) != 0 {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
+
+func TestHitStats_persist(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	now := time.Now()
+	s := NewHitStats(StatsConfig{})
+	s.record("http://a", mnQueryRange, crHit, now.Add(-2*time.Minute))
+	s.record("http://a", mnQueryRange, crKeyMiss, now)
+	if err := s.persist(tr.Cacher); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should restore the persisted history ahead of the requests counted since
+	restored := NewHitStats(StatsConfig{})
+	restored.record("http://a", mnQueryRange, crHit, now)
+	if err := restored.restore(tr.Cacher); err != nil {
+		t.Fatal(err)
+	}
+	r := restored.report("", now)
+	if len(r.Buckets) != 2 || len(r.Totals) != 1 || r.Totals[0].Results[crHit] != 2 || r.Totals[0].Results[crKeyMiss] != 0 {
+		t.Errorf("unexpected report %+v %+v", r.Buckets, r.Totals)
+	}
+
+	// it should fail with a cache miss when nothing was persisted
+	tr.Cacher.Delete(statsCacheKey)
+	if err := NewHitStats(StatsConfig{}).restore(tr.Cacher); !isCacheMiss(err) {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+}
+
+func TestTricksterHandler_statsHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(`{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	tr.Stats = NewHitStats(StatsConfig{})
+
+	// it should count the cache results of proxied requests
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		tr.promQueryHandler(w, httptest.NewRequest("GET", es.URL+"/api/v1/query?query=up&time=0", nil))
+	}
+
+	get := func(path string) (*http.Response, statsReport) {
+		w := httptest.NewRecorder()
+		tr.newAdminRouter().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var r statsReport
+		json.NewDecoder(w.Body).Decode(&r)
+		return w.Result(), r
+	}
+
+	resp, r := get("/trickster/stats?origin=default")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wanted %d got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if len(r.Totals) != 1 || r.Totals[0].Path != mnQuery || r.Totals[0].Results[crKeyMiss] != 1 ||
+		r.Totals[0].Results[crHit] != 1 || r.Totals[0].HitRatio != 0.5 {
+		t.Errorf("unexpected totals %+v", r.Totals)
+	}
+
+	// it should refuse unknown origins
+	if resp, _ := get("/trickster/stats?origin=nope"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wanted %d got %d.", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,51 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import "github.com/prometheus/common/model"
+
+// maxSharedStepPoints is the most points per series Trickster will request from the origin at the raw step.
+// Prometheus refuses range queries resulting in more than 11,000 points per series.
+const maxSharedStepPoints = 11000
+
+// sharedStepMS returns the raw step, in milliseconds, at which a range query with the provided step and extents
+// should be fetched and cached, or 0 if the query can't share the raw resolution
+func sharedStepMS(rawStepSecs int64, stepMS int64, e MatrixExtents) int64 {
+	rawStepMS := rawStepSecs * 1000
+	if rawStepMS <= 0 || stepMS%rawStepMS != 0 {
+		return 0
+	}
+	if (e.End-e.Start)/rawStepMS >= maxSharedStepPoints {
+		return 0
+	}
+	return rawStepMS
+}
+
+// rebucket reduces series fetched at the raw step to the response step, by keeping only the points that fall on
+// response step boundaries. Since Prometheus evaluates range queries at each step boundary independently, the result
+// is the same as querying at the response step.
+func (pe *PrometheusMatrixEnvelope) rebucket(stepMS int64, responseStepMS int64) {
+	if responseStepMS <= stepMS {
+		return
+	}
+	for i, stream := range pe.Data.Result {
+		values := make([]model.SamplePair, 0, len(stream.Values)/int(responseStepMS/stepMS)+1)
+		for _, v := range stream.Values {
+			if int64(v.Timestamp)%responseStepMS == 0 {
+				values = append(values, v)
+			}
+		}
+		pe.Data.Result[i] = &model.SampleStream{Metric: stream.Metric, Values: values}
+	}
+}
@@ -0,0 +1,100 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestSharedStepMS(t *testing.T) {
+	tests := []struct {
+		rawStepSecs int64
+		stepMS      int64
+		e           MatrixExtents
+		want        int64
+	}{
+		// it should not share when disabled
+		{0, 60000, MatrixExtents{0, 3600000}, 0},
+		// it should share steps that are multiples of the raw step
+		{15, 60000, MatrixExtents{0, 3600000}, 15000},
+		{15, 15000, MatrixExtents{0, 3600000}, 15000},
+		// it should not share steps that are not multiples of the raw step
+		{15, 20000, MatrixExtents{0, 3600000}, 0},
+		// it should not share when the raw step would exceed the point limit
+		{15, 60000, MatrixExtents{0, 15000 * maxSharedStepPoints}, 0},
+	}
+
+	for _, test := range tests {
+		if ms := sharedStepMS(test.rawStepSecs, test.stepMS, test.e); ms != test.want {
+			t.Errorf("wanted %d got %d.", test.want, ms)
+		}
+	}
+}
+
+func TestPrometheusMatrixEnvelope_rebucket(t *testing.T) {
+	pe := PrometheusMatrixEnvelope{
+		Data: PrometheusMatrixData{
+			ResultType: rvMatrix,
+			Result: []*model.SampleStream{
+				{
+					Metric: model.Metric{"__name__": "up"},
+					Values: []model.SamplePair{
+						{Timestamp: 0, Value: 1}, {Timestamp: 15000, Value: 2}, {Timestamp: 30000, Value: 3},
+						{Timestamp: 45000, Value: 4}, {Timestamp: 60000, Value: 5},
+					},
+				},
+			},
+		},
+	}
+
+	// it should keep only the points on the response step boundaries
+	pe.rebucket(15000, 30000)
+	values := pe.Data.Result[0].Values
+	if len(values) != 3 {
+		t.Fatalf("wanted %d got %d.", 3, len(values))
+	}
+	if values[1].Timestamp != 30000 || values[1].Value != 3 {
+		t.Errorf("unexpected value %v", values[1])
+	}
+}
+
+func TestTricksterHandler_buildRequestContext_sharedStep(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	o := tr.Config.Origins["default"]
+	o.RawStepSecs = 15
+	tr.Config.Origins["default"] = o
+
+	ctx15, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", "http://trickster"+exampleRangeQuery, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx30, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", "http://trickster"+strings.Replace(exampleRangeQuery, "step=15", "step=30", 1), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should share one cache entry at the raw step
+	if ctx15.CacheKey != ctx30.CacheKey {
+		t.Errorf("wanted %s got %s.", ctx15.CacheKey, ctx30.CacheKey)
+	}
+	if ctx30.StepMS != 15000 || ctx30.ResponseStepMS != 30000 {
+		t.Errorf("wanted 15000/30000 got %d/%d.", ctx30.StepMS, ctx30.ResponseStepMS)
+	}
+}
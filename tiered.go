@@ -0,0 +1,255 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// Cache tiers
+	tlL1 = "l1"
+	tlL2 = "l2"
+
+	// Cache tier read results
+	trHit  = "hit"
+	trMiss = "miss"
+
+	// tieredStripeCount is the number of stripes of a TieredCache, among which the keys are spread to track their writes
+	tieredStripeCount = 256
+)
+
+// TieredCacheConfig describes a cache of another type placed in front of the configured cache, such as a Memory
+// Cache in front of a shared Redis Cache
+type TieredCacheConfig struct {
+	// L1CacheType is the type of the cache in front of cache_type, which becomes the L2 cache. Default is none
+	L1CacheType string `toml:"l1_cache_type"`
+	// L1TTLSecs limits the TTL of the records in the L1 cache. Default is 0 (the TTL of the record)
+	L1TTLSecs int64 `toml:"l1_ttl_secs"`
+	// HedgeDelayMS races a read of the L2 cache with an L1 read that has not hit within this delay, rather than
+	// waiting for it to miss. Default is 0 (the L2 cache is read once the L1 read misses)
+	HedgeDelayMS int64 `toml:"hedge_delay_ms"`
+}
+
+// validateTiered returns an error if the tiered cache settings are invalid
+func (c CachingConfig) validateTiered() error {
+	tc := c.Tiered
+	if tc.L1TTLSecs < 0 || tc.HedgeDelayMS < 0 {
+		return fmt.Errorf("cache: tiered settings must not be negative")
+	}
+	if tc.L1CacheType == "" {
+		return nil
+	}
+	switch tc.L1CacheType {
+	case ctMemory, ctFilesystem, ctRedis, ctBoltDB:
+	default:
+		return fmt.Errorf("cache: unknown tiered l1_cache_type %q", tc.L1CacheType)
+	}
+	if tc.L1CacheType == c.CacheType {
+		return fmt.Errorf("cache: tiered l1_cache_type must differ from cache_type")
+	}
+	return nil
+}
+
+// TieredCache reads records from the L1 cache, and from the L2 cache when they are missing from the L1 cache or it
+// is slow to answer, promoting the records read from the L2 cache to the L1 cache. Records are written to both.
+type TieredCache struct {
+	L1 Cache
+	L2 Cache
+	T  *TricksterHandler
+
+	stripes [tieredStripeCount]tieredStripe
+}
+
+// tieredStripe counts the writes and deletes of the keys of a stripe, so that a record read from the L2 cache is not
+// promoted once it was replaced or deleted
+type tieredStripe struct {
+	mtx        sync.Mutex
+	generation uint64
+}
+
+// tierRead is the result of a read of a cache tier
+type tierRead struct {
+	tier string
+	data string
+	err  error
+}
+
+// Connect connects both tiers
+func (c *TieredCache) Connect() error {
+	if err := c.L2.Connect(); err != nil {
+		return err
+	}
+	return c.L1.Connect()
+}
+
+// stripe returns the stripe of the key
+func (c *TieredCache) stripe(cacheKey string) *tieredStripe {
+	h := fnv.New32a()
+	h.Write([]byte(cacheKey))
+	return &c.stripes[h.Sum32()%tieredStripeCount]
+}
+
+// generation returns the generation of the stripe of the key, which changes with each write or delete of its keys
+func (c *TieredCache) generation(cacheKey string) uint64 {
+	s := c.stripe(cacheKey)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.generation
+}
+
+// invalidatePromotions prevents the promotion of the records of the key read before it is written or deleted
+func (c *TieredCache) invalidatePromotions(cacheKey string) {
+	s := c.stripe(cacheKey)
+	s.mtx.Lock()
+	s.generation++
+	s.mtx.Unlock()
+}
+
+// Store places an object in both tiers, limiting its TTL in the L1 cache
+func (c *TieredCache) Store(cacheKey string, data string, ttl int64) error {
+	c.invalidatePromotions(cacheKey)
+	err := c.L2.Store(cacheKey, data, ttl)
+	if l1ttl := c.T.Config.Caching.Tiered.L1TTLSecs; l1ttl > 0 && ttl > l1ttl {
+		ttl = l1ttl
+	}
+	if err := c.L1.Store(cacheKey, data, ttl); err != nil {
+		level.Debug(c.T.Logger).Log(lfEvent, "unable to store record in the l1 cache", lfCacheKey, cacheKey, lfDetail, err.Error())
+	}
+	return err
+}
+
+// Retrieve looks for an object in the L1 cache, and in the L2 cache if the L1 cache misses or, when hedging, has
+// not hit within the hedge delay, returning the first hit
+func (c *TieredCache) Retrieve(cacheKey string) (string, error) {
+	generation := c.generation(cacheKey)
+	results := make(chan tierRead, 2)
+	read := func(tier string, cache Cache) {
+		start := time.Now()
+		data, err := cache.Retrieve(cacheKey)
+		c.observe(tier, start, err)
+		results <- tierRead{tier: tier, data: data, err: err}
+	}
+
+	var hedge <-chan time.Time
+	if d := c.T.Config.Caching.Tiered.HedgeDelayMS; d > 0 {
+		timer := time.NewTimer(time.Duration(d) * time.Millisecond)
+		defer timer.Stop()
+		hedge = timer.C
+		go read(tlL1, c.L1)
+	} else {
+		read(tlL1, c.L1)
+	}
+
+	pending, readL2 := 1, false
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if r.tier == tlL2 {
+					go c.promote(cacheKey, r.data, generation)
+				}
+				return r.data, nil
+			}
+			err = r.err
+			if !readL2 {
+				readL2 = true
+				pending++
+				go read(tlL2, c.L2)
+			}
+		case <-hedge:
+			hedge = nil
+			if !readL2 {
+				readL2 = true
+				pending++
+				if c.T.Metrics != nil {
+					c.T.Metrics.CacheHedgedReads.Inc()
+				}
+				go read(tlL2, c.L2)
+			}
+		}
+	}
+	return "", err
+}
+
+// promote stores a record read from the L2 cache in the L1 cache, until it expires from the L2 cache, unless the key
+// was written or deleted since the generation that it was read at
+func (c *TieredCache) promote(cacheKey, data string, generation uint64) {
+	expiration, err := c.L2.Expiration(cacheKey)
+	if err != nil {
+		return
+	}
+	ttl := expiration - time.Now().Unix()
+	if l1ttl := c.T.Config.Caching.Tiered.L1TTLSecs; l1ttl > 0 && ttl > l1ttl {
+		ttl = l1ttl
+	}
+	if ttl <= 0 {
+		return
+	}
+	s := c.stripe(cacheKey)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.generation != generation {
+		return
+	}
+	if err := c.L1.Store(cacheKey, data, ttl); err != nil {
+		level.Debug(c.T.Logger).Log(lfEvent, "unable to promote record to the l1 cache", lfCacheKey, cacheKey, lfDetail, err.Error())
+	}
+}
+
+// observe records the result and duration of a read of the tier
+func (c *TieredCache) observe(tier string, start time.Time, err error) {
+	if c.T.Metrics == nil {
+		return
+	}
+	result := trHit
+	if err != nil {
+		result = trMiss
+	}
+	c.T.Metrics.CacheTierReads.WithLabelValues(tier, result).Inc()
+	c.T.Metrics.CacheTierReadDuration.WithLabelValues(tier).Observe(time.Since(start).Seconds())
+}
+
+// Expiration returns the unix time at which an object expires from the L2 cache
+func (c *TieredCache) Expiration(cacheKey string) (int64, error) {
+	return c.L2.Expiration(cacheKey)
+}
+
+// Delete removes an object from both tiers
+func (c *TieredCache) Delete(cacheKey string) error {
+	c.invalidatePromotions(cacheKey)
+	c.L1.Delete(cacheKey)
+	return c.L2.Delete(cacheKey)
+}
+
+// Walk calls fn for each unexpired record in the L2 cache, which holds every record of the L1 cache
+func (c *TieredCache) Walk(fn func(CacheObject) error) error {
+	return c.L2.Walk(fn)
+}
+
+// Reap does nothing, since each tier reaps its own expired records once connected
+func (c *TieredCache) Reap() {}
+
+// Close closes both tiers
+func (c *TieredCache) Close() error {
+	c.L1.Close()
+	return c.L2.Close()
+}
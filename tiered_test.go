@@ -0,0 +1,132 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowCache is a Cache whose Retrieve takes at least delay
+type slowCache struct {
+	MemoryCache
+	delay time.Duration
+}
+
+func (c *slowCache) Retrieve(cacheKey string) (string, error) {
+	time.Sleep(c.delay)
+	return c.MemoryCache.Retrieve(cacheKey)
+}
+
+func TestCachingConfig_validateTiered(t *testing.T) {
+	tests := []struct {
+		config CachingConfig
+		valid  bool
+	}{
+		{CachingConfig{CacheType: ctRedis}, true},
+		{CachingConfig{CacheType: ctRedis, Tiered: TieredCacheConfig{L1CacheType: ctMemory, HedgeDelayMS: 5}}, true},
+		{CachingConfig{CacheType: ctRedis, Tiered: TieredCacheConfig{L1CacheType: ctRedis}}, false},
+		{CachingConfig{CacheType: ctRedis, Tiered: TieredCacheConfig{L1CacheType: "memcached"}}, false},
+		{CachingConfig{CacheType: ctRedis, Tiered: TieredCacheConfig{L1CacheType: ctMemory, L1TTLSecs: -1}}, false},
+	}
+	for i, test := range tests {
+		if err := test.config.validateTiered(); (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.Config.Caching.Tiered = TieredCacheConfig{L1TTLSecs: 30}
+
+	l1 := &slowCache{MemoryCache: MemoryCache{T: tr}}
+	l2 := &MemoryCache{T: tr}
+	c := &TieredCache{L1: l1, L2: l2, T: tr}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// it should store records in both tiers, limiting their TTL in the l1 cache
+	c.Store("both", "data", 600)
+	if e, err := l1.Expiration("both"); err != nil || e > time.Now().Unix()+30 {
+		t.Errorf("unexpected l1 expiration %d %v", e, err)
+	}
+	if e, err := l2.Expiration("both"); err != nil || e < time.Now().Unix()+599 {
+		t.Errorf("unexpected l2 expiration %d %v", e, err)
+	}
+
+	// it should read records missing from the l1 cache from the l2 cache, and promote them
+	l2.Store("l2only", "data", 10)
+	if data, err := c.Retrieve("l2only"); err != nil || data != "data" {
+		t.Errorf("unexpected result %q %v", data, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := l1.Retrieve("l2only"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e, err := l1.Expiration("l2only"); err != nil || e > time.Now().Unix()+10 {
+		t.Errorf("unexpected l1 expiration %d %v", e, err)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheTierReads.WithLabelValues(tlL1, trMiss)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheTierReads.WithLabelValues(tlL2, trHit)); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+
+	// it should miss when both tiers miss
+	if _, err := c.Retrieve("missing"); !isCacheMiss(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// it should delete records from both tiers
+	c.Delete("both")
+	if _, err := l1.Retrieve("both"); err == nil {
+		t.Errorf("expected l1 cache miss")
+	}
+	if _, err := l2.Retrieve("both"); err == nil {
+		t.Errorf("expected l2 cache miss")
+	}
+
+	// it should not promote a record that was replaced or deleted after it was read
+	generation := c.generation("replaced")
+	c.Store("replaced", "new", 600)
+	l1.Delete("replaced")
+	c.promote("replaced", "old", generation)
+	if _, err := l1.Retrieve("replaced"); err == nil {
+		t.Errorf("expected l1 cache miss")
+	}
+
+	// it should race the l2 cache with a slow l1 cache when hedging
+	c.Store("hedged", "data", 600)
+	tr.Config.Caching.Tiered.HedgeDelayMS = 10
+	l1.delay = 500 * time.Millisecond
+	start := time.Now()
+	if data, err := c.Retrieve("hedged"); err != nil || data != "data" {
+		t.Errorf("unexpected result %q %v", data, err)
+	}
+	if d := time.Since(start); d >= l1.delay {
+		t.Errorf("unexpected read duration %v", d)
+	}
+	if v := testutil.ToFloat64(tr.Metrics.CacheHedgedReads); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+}
@@ -0,0 +1,151 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// tlsVersions are the TLS versions that min_version may be set to
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersionNames are the keys of tlsVersions, in order
+var tlsVersionNames = []string{"1.0", "1.1", "1.2", "1.3"}
+
+// cipherSuiteID returns the ID of the named cipher suite, as named by crypto/tls
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// serverConfig returns the tls.Config of a listener with the TLS settings, or nil when they leave Go's defaults
+// unchanged
+func (c TLSConfig) serverConfig() (*tls.Config, error) {
+	if c.MinVersion == "" && len(c.CipherSuites) == 0 && !c.SessionTicketsDisabled {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{SessionTicketsDisabled: c.SessionTicketsDisabled}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown min_version %q", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	return cfg, nil
+}
+
+// validate returns an error if TLS is enabled without a certificate and key, or with an unknown version or cipher
+// suite or a negative OCSP refresh interval
+func (c TLSConfig) validate() error {
+	if c.Enabled && (c.FullChainCertPath == "" || c.PrivateKeyPath == "") {
+		return fmt.Errorf("tls requires full_chain_cert_path and private_key_path")
+	}
+	if c.OCSPRefreshSecs < 0 {
+		return fmt.Errorf("tls: ocsp_refresh_secs must not be negative")
+	}
+	_, err := c.serverConfig()
+	return err
+}
+
+// clientTLSConfig returns the tls.Config of connections to the origin, or nil when its TLS settings leave Go's
+// defaults unchanged
+func (o PrometheusOriginConfig) clientTLSConfig() (*tls.Config, error) {
+	if o.TLSSessionCacheSize <= 0 && o.TLSServerName == "" && len(o.TLSCAFiles) == 0 && len(o.TLSPinnedFingerprints) == 0 {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{ServerName: o.TLSServerName}
+	if o.TLSSessionCacheSize > 0 {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(o.TLSSessionCacheSize)
+	}
+
+	if len(o.TLSCAFiles) > 0 {
+		// the origin's authorities are layered over the system's
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range o.TLSCAFiles {
+			pem, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("tls_ca_files: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("tls_ca_files: no certificates found in %s", path)
+			}
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(o.TLSPinnedFingerprints) > 0 {
+		pins := make(map[string]bool, len(o.TLSPinnedFingerprints))
+		for _, fp := range o.TLSPinnedFingerprints {
+			pin, err := parseFingerprint(fp)
+			if err != nil {
+				return nil, err
+			}
+			pins[pin] = true
+		}
+		// the pins are checked in addition to the usual verification of the certificate chain
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				sum := sha256.Sum256(raw)
+				if pins[hex.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("origin certificate does not match any pinned fingerprint")
+		}
+	}
+	return cfg, nil
+}
+
+// parseFingerprint returns the lowercase hex form of a SHA-256 certificate fingerprint
+func parseFingerprint(fp string) (string, error) {
+	pin := strings.ToLower(strings.Replace(fp, ":", "", -1))
+	if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("tls_pinned_fingerprints: %q is not a SHA-256 fingerprint", fp)
+	}
+	return pin, nil
+}
+
+// validateTLS returns an error if the origin's CA files cannot be loaded, or its pinned fingerprints are malformed
+func (o PrometheusOriginConfig) validateTLS() error {
+	_, err := o.clientTLSConfig()
+	return err
+}
@@ -0,0 +1,154 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfig_serverConfig(t *testing.T) {
+	// it should leave Go's defaults by default
+	if cfg, err := (TLSConfig{Enabled: true}).serverConfig(); cfg != nil || err != nil {
+		t.Errorf("unexpected result %v %v", cfg, err)
+	}
+
+	// it should set the minimum version, cipher suites and session tickets
+	cfg, err := TLSConfig{
+		MinVersion:             "1.2",
+		CipherSuites:           []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		SessionTicketsDisabled: true,
+	}.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wanted %d got %d.", tls.VersionTLS12, cfg.MinVersion)
+	}
+	if len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("unexpected cipher suites %v", cfg.CipherSuites)
+	}
+	if !cfg.SessionTicketsDisabled {
+		t.Errorf("expected session tickets to be disabled")
+	}
+}
+
+func TestTLSConfig_validate(t *testing.T) {
+	tests := []struct {
+		c  TLSConfig
+		ok bool
+	}{
+		{TLSConfig{}, true},
+		{TLSConfig{Enabled: true, FullChainCertPath: "a.crt", PrivateKeyPath: "a.key", MinVersion: "1.3"}, true},
+		{TLSConfig{Enabled: true}, false},
+		{TLSConfig{MinVersion: "1.4"}, false},
+		{TLSConfig{CipherSuites: []string{"TLS_RSA_WITH_NULL"}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.c.validate(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestPrometheusOriginConfig_clientTLSConfig(t *testing.T) {
+	es := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer es.Close()
+
+	f, err := ioutil.TempFile("", "trickster-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: es.Certificate().Raw})
+	f.Close()
+
+	sum := sha256.Sum256(es.Certificate().Raw)
+	pin := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	get := func(o PrometheusOriginConfig) error {
+		cfg, err := o.clientTLSConfig()
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(es.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// it should leave Go's defaults by default
+	if cfg, err := (PrometheusOriginConfig{}).clientTLSConfig(); cfg != nil || err != nil {
+		t.Errorf("unexpected result %v %v", cfg, err)
+	}
+
+	// it should not trust the origin's certificate without its CA
+	if err := get(PrometheusOriginConfig{TLSServerName: "example.com"}); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// it should trust the origin's certificate with its CA
+	if err := get(PrometheusOriginConfig{TLSCAFiles: []string{f.Name()}}); err != nil {
+		t.Error(err)
+	}
+
+	// it should verify the certificate against the server name override
+	if err := get(PrometheusOriginConfig{TLSCAFiles: []string{f.Name()}, TLSServerName: "example.com"}); err != nil {
+		t.Error(err)
+	}
+	if err := get(PrometheusOriginConfig{TLSCAFiles: []string{f.Name()}, TLSServerName: "prometheus.example.org"}); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// it should require a pinned certificate
+	if err := get(PrometheusOriginConfig{TLSCAFiles: []string{f.Name()}, TLSPinnedFingerprints: []string{pin}}); err != nil {
+		t.Error(err)
+	}
+	other := strings.Repeat("00:", sha256.Size-1) + "00"
+	if err := get(PrometheusOriginConfig{TLSCAFiles: []string{f.Name()}, TLSPinnedFingerprints: []string{other}}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestPrometheusOriginConfig_validateTLS(t *testing.T) {
+	tests := []struct {
+		o  PrometheusOriginConfig
+		ok bool
+	}{
+		{PrometheusOriginConfig{}, true},
+		{PrometheusOriginConfig{TLSServerName: "example.com"}, true},
+		{PrometheusOriginConfig{TLSPinnedFingerprints: []string{strings.Repeat("Ab:", sha256.Size-1) + "cd"}}, true},
+		{PrometheusOriginConfig{TLSPinnedFingerprints: []string{"abcd"}}, false},
+		{PrometheusOriginConfig{TLSPinnedFingerprints: []string{strings.Repeat("zz", sha256.Size)}}, false},
+		{PrometheusOriginConfig{TLSCAFiles: []string{"/nonexistent/ca.pem"}}, false},
+		{PrometheusOriginConfig{TLSCAFiles: []string{"tlsconfig_test.go"}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.o.validateTLS(); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Gap fill modes
+	fmNone = ""
+	fmNull = "null"
+	fmZero = "zero"
+)
+
+// TransformConfig describes post-processing applied to the values of merged timeseries before they are returned to the client
+type TransformConfig struct {
+	// Multiply scales each value by the provided factor. 0 is treated as unset
+	Multiply float64 `toml:"multiply"`
+	// Divide divides each value by the provided divisor. 0 is treated as unset
+	Divide float64 `toml:"divide"`
+	// ClampMin raises any value below it up to it
+	ClampMin *float64 `toml:"clamp_min"`
+	// ClampMax lowers any value above it down to it
+	ClampMax *float64 `toml:"clamp_max"`
+	// Fill inserts a value at each step boundary of the requested range that has no data: "null" (NaN, rendered as a gap) or "zero"
+	Fill string `toml:"fill"`
+}
+
+// enabled returns true if the TransformConfig alters values in any way
+func (tc TransformConfig) enabled() bool {
+	return tc.Multiply != 0 || tc.Divide != 0 || tc.ClampMin != nil || tc.ClampMax != nil || tc.Fill != fmNone
+}
+
+// validate returns an error if the TransformConfig can't be applied
+func (tc TransformConfig) validate() error {
+	switch strings.ToLower(tc.Fill) {
+	case fmNone, fmNull, fmZero:
+	default:
+		return fmt.Errorf("unknown transform fill mode %q", tc.Fill)
+	}
+	if tc.ClampMin != nil && tc.ClampMax != nil && *tc.ClampMin > *tc.ClampMax {
+		return fmt.Errorf("transform clamp_min %v is greater than clamp_max %v", *tc.ClampMin, *tc.ClampMax)
+	}
+	return nil
+}
+
+// apply returns the transformed value
+func (tc TransformConfig) apply(v model.SampleValue) model.SampleValue {
+	f := float64(v)
+	if math.IsNaN(f) {
+		return v
+	}
+	if tc.Multiply != 0 {
+		f *= tc.Multiply
+	}
+	if tc.Divide != 0 {
+		f /= tc.Divide
+	}
+	if tc.ClampMin != nil && f < *tc.ClampMin {
+		f = *tc.ClampMin
+	}
+	if tc.ClampMax != nil && f > *tc.ClampMax {
+		f = *tc.ClampMax
+	}
+	return model.SampleValue(f)
+}
+
+// fillValue returns the value used for filling gaps
+func (tc TransformConfig) fillValue() model.SampleValue {
+	if strings.ToLower(tc.Fill) == fmZero {
+		return 0
+	}
+	return model.SampleValue(math.NaN())
+}
+
+// transform applies the TransformConfig to each series in the matrix. Gaps are filled at each step boundary between the
+// provided extents. New slices are allocated so that values shared with other envelopes are not modified.
+func (pe *PrometheusMatrixEnvelope) transform(tc TransformConfig, e MatrixExtents, stepMS int64) {
+	if !tc.enabled() {
+		return
+	}
+
+	fill := tc.Fill != fmNone && stepMS > 0 && e.End >= e.Start
+
+	for i, ss := range pe.Data.Result {
+		values := make([]model.SamplePair, 0, len(ss.Values))
+
+		j := 0
+		if fill {
+			for ts := e.Start; ts <= e.End; ts += stepMS {
+				// carry over any points that precede this step boundary
+				for j < len(ss.Values) && int64(ss.Values[j].Timestamp) < ts {
+					values = append(values, ss.Values[j])
+					j++
+				}
+				if j < len(ss.Values) && int64(ss.Values[j].Timestamp) == ts {
+					values = append(values, ss.Values[j])
+					j++
+					continue
+				}
+				values = append(values, model.SamplePair{Timestamp: model.Time(ts), Value: tc.fillValue()})
+			}
+		}
+		values = append(values, ss.Values[j:]...)
+
+		for k := range values {
+			values[k].Value = tc.apply(values[k].Value)
+		}
+
+		pe.Data.Result[i] = &model.SampleStream{Metric: ss.Metric, Values: values}
+	}
+}
+
+// transform applies the value transformations of the TransformConfig to each sample in the vector. Gaps are not filled.
+func (pv *PrometheusVectorEnvelope) transform(tc TransformConfig) {
+	if !tc.enabled() {
+		return
+	}
+	for i, s := range pv.Data.Result {
+		pv.Data.Result[i] = &model.Sample{Metric: s.Metric, Value: tc.apply(s.Value), Timestamp: s.Timestamp}
+	}
+}
+
+// transformVectorBody applies the TransformConfig to an instantaneous query response body. Bodies that are not
+// successful vector results are returned unmodified.
+func transformVectorBody(body []byte, tc TransformConfig) []byte {
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal(body, &pv); err != nil || pv.Status != rvSuccess || pv.Data.ResultType != rvVector {
+		return body
+	}
+	pv.transform(tc)
+	b, err := json.Marshal(pv)
+	if err != nil {
+		return body
+	}
+	return b
+}
@@ -0,0 +1,123 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestTransformConfig_apply(t *testing.T) {
+	min, max := 0.0, 10.0
+	tc := TransformConfig{Multiply: 100, Divide: 4, ClampMin: &min, ClampMax: &max}
+
+	tests := []struct {
+		in, out model.SampleValue
+	}{
+		{0.2, 5},
+		{1, 10},
+		{-1, 0},
+	}
+	for _, test := range tests {
+		if v := tc.apply(test.in); v != test.out {
+			t.Errorf("wanted %v got %v for input %v", test.out, v, test.in)
+		}
+	}
+
+	// NaN values should pass through untouched
+	if v := tc.apply(model.SampleValue(math.NaN())); !math.IsNaN(float64(v)) {
+		t.Errorf("wanted NaN got %v", v)
+	}
+}
+
+func TestTransformConfig_validate(t *testing.T) {
+	min, max := 10.0, 0.0
+	if err := (TransformConfig{Fill: "bogus"}).validate(); err == nil {
+		t.Errorf("expected error for unknown fill mode")
+	}
+	if err := (TransformConfig{ClampMin: &min, ClampMax: &max}).validate(); err == nil {
+		t.Errorf("expected error for clamp_min > clamp_max")
+	}
+	if err := (TransformConfig{Fill: fmZero}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrometheusMatrixEnvelope_transform(t *testing.T) {
+	pm := PrometheusMatrixEnvelope{
+		Status: rvSuccess,
+		Data: PrometheusMatrixData{
+			ResultType: rvMatrix,
+			Result: model.Matrix{
+				&model.SampleStream{
+					Metric: model.Metric{"__name__": "a"},
+					Values: []model.SamplePair{
+						{Timestamp: 15000, Value: 1},
+						{Timestamp: 45000, Value: 2},
+						{Timestamp: 52000, Value: 3},
+					},
+				},
+			},
+		},
+	}
+	orig := pm.Data.Result[0].Values
+
+	// it should fill each missing step boundary and scale every value
+	pm.transform(TransformConfig{Multiply: 2, Fill: fmZero}, MatrixExtents{Start: 0, End: 60000}, 15000)
+
+	expected := []model.SamplePair{
+		{Timestamp: 0, Value: 0},
+		{Timestamp: 15000, Value: 2},
+		{Timestamp: 30000, Value: 0},
+		{Timestamp: 45000, Value: 4},
+		{Timestamp: 52000, Value: 6},
+		{Timestamp: 60000, Value: 0},
+	}
+	values := pm.Data.Result[0].Values
+	if len(values) != len(expected) {
+		t.Fatalf("wanted %d values got %d: %v", len(expected), len(values), values)
+	}
+	for i := range expected {
+		if !values[i].Equal(&expected[i]) {
+			t.Errorf("wanted %v got %v at index %d", expected[i], values[i], i)
+		}
+	}
+
+	// it should not modify the original values
+	if orig[0].Value != 1 {
+		t.Errorf("original values were modified")
+	}
+
+	// null fills should be NaN
+	pm.transform(TransformConfig{Fill: fmNull}, MatrixExtents{Start: 60000, End: 75000}, 15000)
+	values = pm.Data.Result[0].Values
+	if !math.IsNaN(float64(values[len(values)-1].Value)) {
+		t.Errorf("wanted NaN got %v", values[len(values)-1].Value)
+	}
+}
+
+func TestTransformVectorBody(t *testing.T) {
+	body := transformVectorBody([]byte(exampleResponse), TransformConfig{Multiply: 100})
+
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal(body, &pv); err != nil {
+		t.Error(err)
+	}
+	if pv.Data.Result[0].Value != 100 {
+		t.Errorf("wanted 100 got %v", pv.Data.Result[0].Value)
+	}
+}
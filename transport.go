@@ -0,0 +1,272 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Upstream connection states, for the connections metric
+	csReused = "reused"
+	csNew    = "new"
+
+	defaultDialKeepAliveSecs = 30
+)
+
+// transportKey identifies the upstream transports that can be shared: those to the same host with the same settings
+type transportKey struct {
+	host                string
+	maxConnsPerHost     int
+	maxIdleConnsPerHost int
+	tlsSessionCacheSize int
+	dialKeepAliveSecs   int64
+	dnsResolvers        string
+	dnsRefreshSecs      int64
+	dnsPins             string
+	proxyURL            string
+	tlsServerName       string
+	tlsCAFiles          string
+	tlsPins             string
+	grpc                bool
+}
+
+// Transports holds the connection pools used for upstream requests, one per origin host and set of connection settings
+type Transports struct {
+	mtx        sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+// NewTransports returns an empty set of upstream transports
+func NewTransports() *Transports {
+	return &Transports{transports: make(map[transportKey]*http.Transport)}
+}
+
+// Get returns the transport for requests to the provided host of the origin, creating it if needed, signing its
+// requests, recording or replaying its responses and injecting the origin's faults, if any. The origin's script
+// changes its requests before they are signed.
+func (t *Transports) Get(o PrometheusOriginConfig, host string) http.RoundTripper {
+	tr := t.get(o, host)
+	if signer := o.Signing.signer(); signer != nil {
+		tr = newSigningTransport(tr, signer)
+	}
+	if s := o.Script.script(); s != nil {
+		tr = newScriptTransport(tr, s, o.Script.timeout())
+	}
+	if o.Recording.enabled() {
+		tr = newRecordingTransport(tr, o.Recording)
+	}
+	// faults are injected outside the recording, so that they are never recorded
+	if o.FaultInjection.enabled() {
+		return newFaultTransport(tr, o.FaultInjection)
+	}
+	return tr
+}
+
+func (t *Transports) get(o PrometheusOriginConfig, host string) http.RoundTripper {
+	if t == nil {
+		return http.DefaultTransport
+	}
+
+	key := transportKey{
+		host:                host,
+		maxConnsPerHost:     o.MaxConnsPerHost,
+		maxIdleConnsPerHost: o.MaxIdleConnsPerHost,
+		tlsSessionCacheSize: o.TLSSessionCacheSize,
+		dialKeepAliveSecs:   o.DialKeepAliveSecs,
+		dnsResolvers:        strings.Join(o.DNSResolvers, ","),
+		dnsRefreshSecs:      o.DNSRefreshSecs,
+		dnsPins:             o.dnsPinsString(),
+		proxyURL:            o.ProxyURL,
+		tlsServerName:       o.TLSServerName,
+		tlsCAFiles:          strings.Join(o.TLSCAFiles, ","),
+		tlsPins:             strings.Join(o.TLSPinnedFingerprints, ","),
+		grpc:                o.GRPC,
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if tr, ok := t.transports[key]; ok {
+		return tr
+	}
+	tr := newOriginTransport(o)
+	t.transports[key] = tr
+	if o.DNSRefreshSecs > 0 {
+		go refreshConnections(tr, time.Duration(o.DNSRefreshSecs)*time.Second)
+	}
+	return tr
+}
+
+// refreshConnections periodically closes the transport's idle connections, so that the next request to the origin
+// dials a new connection to the host's current address rather than reusing one to an address it no longer has
+func refreshConnections(tr *http.Transport, interval time.Duration) {
+	for range time.Tick(interval) {
+		tr.CloseIdleConnections()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of every transport
+func (t *Transports) CloseIdleConnections() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, tr := range t.transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+// newOriginTransport returns a transport with the origin's connection settings, and http.DefaultTransport's otherwise
+func newOriginTransport(o PrometheusOriginConfig) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	keepAlive := o.DialKeepAliveSecs
+	if keepAlive == 0 {
+		keepAlive = defaultDialKeepAliveSecs
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: time.Duration(keepAlive) * time.Second,
+	}
+	if len(o.DNSResolvers) > 0 {
+		dialer.Resolver = newResolver(o.DNSResolvers)
+	}
+	tr.DialContext = o.pinnedDialContext(dialer)
+
+	// config validation ensures the proxy url parses
+	if u, _ := o.proxyURL(); u != nil {
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	tr.MaxConnsPerHost = o.MaxConnsPerHost
+	if o.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+		if tr.MaxIdleConns < o.MaxIdleConnsPerHost {
+			tr.MaxIdleConns = o.MaxIdleConnsPerHost
+		}
+	}
+	// config validation ensures the CA files load and the fingerprints parse
+	if cfg, _ := o.clientTLSConfig(); cfg != nil {
+		tr.TLSClientConfig = cfg
+	}
+	if o.GRPC {
+		tr.Protocols = grpcProtocols(false)
+	}
+	return tr
+}
+
+// withConnectionTrace returns a context that counts whether the upstream request reused a pooled connection
+func (t *TricksterHandler) withConnectionTrace(ctx context.Context, host string) context.Context {
+	if t.Metrics == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			state := csNew
+			if info.Reused {
+				state = csReused
+			}
+			t.Metrics.OriginConnections.WithLabelValues(host, state).Inc()
+		},
+	})
+}
+
+// newResolver returns a resolver that queries the provided name servers (host:port) in turn
+func newResolver(servers []string) *net.Resolver {
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// pinnedDialContext returns a dial function that connects to the origin's pinned address for a host, when there is
+// one, instead of resolving the host
+func (o PrometheusOriginConfig) pinnedDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(o.DNSPins) == 0 {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := o.DNSPins[host]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// dnsPinsString returns the origin's pinned addresses in a stable form, to identify its transport
+func (o PrometheusOriginConfig) dnsPinsString() string {
+	pins := make([]string, 0, len(o.DNSPins))
+	for host, ip := range o.DNSPins {
+		pins = append(pins, host+"="+ip)
+	}
+	sort.Strings(pins)
+	return strings.Join(pins, ",")
+}
+
+// validateDNS returns an error if the origin's name servers are not host:port addresses, or its pins are not IPs
+func (o PrometheusOriginConfig) validateDNS() error {
+	for _, server := range o.DNSResolvers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("dns_resolvers: %v", err)
+		}
+	}
+	for host, ip := range o.DNSPins {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("dns_pins: %q is not an IP address for %q", ip, host)
+		}
+	}
+	if o.DNSRefreshSecs < 0 {
+		return fmt.Errorf("dns_refresh_secs must not be negative")
+	}
+	return nil
+}
+
+// proxyURL returns the parsed URL of the origin's outbound proxy, or nil if it has none
+func (o PrometheusOriginConfig) proxyURL() (*url.URL, error) {
+	if o.ProxyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(o.ProxyURL)
+	if err != nil {
+		// the parse error includes the url, and so any credentials in it
+		return nil, fmt.Errorf("proxy_url is not a valid url")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy_url scheme %q is not one of http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy_url has no host")
+	}
+	return u, nil
+}
@@ -0,0 +1,51 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import "fmt"
+
+// TTLBucket maps requests spanning up to MaxRangeSecs to a cache record TTL
+type TTLBucket struct {
+	// MaxRangeSecs is the largest requested range, in seconds, that this bucket applies to
+	MaxRangeSecs int64 `toml:"max_range_secs"`
+	// TTLSecs is the cache record TTL for requests in this bucket
+	TTLSecs int64 `toml:"ttl_secs"`
+}
+
+// validateTTLBuckets checks that the buckets are in ascending order of range and have usable TTLs
+func validateTTLBuckets(buckets []TTLBucket) error {
+	for i, b := range buckets {
+		if b.MaxRangeSecs <= 0 || b.TTLSecs <= 0 {
+			return fmt.Errorf("ttl bucket %d: max_range_secs and ttl_secs must be greater than 0", i)
+		}
+		if i > 0 && b.MaxRangeSecs <= buckets[i-1].MaxRangeSecs {
+			return fmt.Errorf("ttl bucket %d: buckets must be in ascending order of max_range_secs", i)
+		}
+	}
+	return nil
+}
+
+// rangeTTL returns the cache record TTL for a request spanning rangeSecs, per the buckets. Requests larger than the
+// largest bucket use its TTL, and defaultTTL is used when there are no buckets.
+func rangeTTL(buckets []TTLBucket, rangeSecs int64, defaultTTL int64) int64 {
+	if len(buckets) == 0 {
+		return defaultTTL
+	}
+	for _, b := range buckets {
+		if rangeSecs <= b.MaxRangeSecs {
+			return b.TTLSecs
+		}
+	}
+	return buckets[len(buckets)-1].TTLSecs
+}
@@ -0,0 +1,54 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import "testing"
+
+func TestRangeTTL(t *testing.T) {
+	buckets := []TTLBucket{{300, 60}, {86400, 600}, {2592000, 21600}}
+
+	tests := []struct {
+		rangeSecs int64
+		want      int64
+	}{
+		{60, 60},
+		{300, 60},
+		{3600, 600},
+		{2592000, 21600},
+		{31536000, 21600},
+	}
+
+	for _, test := range tests {
+		if ttl := rangeTTL(buckets, test.rangeSecs, 100); ttl != test.want {
+			t.Errorf("wanted %d got %d.", test.want, ttl)
+		}
+	}
+
+	// it should use the default without any buckets
+	if ttl := rangeTTL(nil, 3600, 100); ttl != 100 {
+		t.Errorf("wanted %d got %d.", 100, ttl)
+	}
+}
+
+func TestValidateTTLBuckets(t *testing.T) {
+	if err := validateTTLBuckets([]TTLBucket{{300, 60}, {86400, 600}}); err != nil {
+		t.Error(err)
+	}
+	if err := validateTTLBuckets([]TTLBucket{{86400, 600}, {300, 60}}); err == nil {
+		t.Errorf("expected an error for out of order buckets")
+	}
+	if err := validateTTLBuckets([]TTLBucket{{300, 0}}); err == nil {
+		t.Errorf("expected an error for a zero ttl")
+	}
+}
@@ -0,0 +1,121 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// Unmatched origin policies
+	uoDefault     = "default"
+	uoNotFound    = "not_found"
+	uoMisdirected = "misdirected"
+	uoRedirect    = "redirect"
+
+	defaultUnmatchedOriginBody = "no origin is configured for {{.Origin}}\n"
+)
+
+// unmatchedOriginRequest is the data available to the unmatched origin body and redirect url templates
+type unmatchedOriginRequest struct {
+	Origin string
+	Host   string
+	Path   string
+	Query  string
+}
+
+// unmatchedOriginTemplates parses the body and redirect url templates of the unmatched origin policy
+func (c ProxyServerConfig) unmatchedOriginTemplates() (*template.Template, *template.Template, error) {
+	text := c.UnmatchedOriginBody
+	if text == "" {
+		text = defaultUnmatchedOriginBody
+	}
+	body, err := template.New("unmatched_origin_body").Parse(text)
+	if err != nil {
+		return nil, nil, err
+	}
+	redirect, err := template.New("unmatched_origin_redirect_url").Parse(c.UnmatchedOriginRedirectURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, redirect, nil
+}
+
+// validateUnmatchedOriginPolicy returns an error if the unmatched origin policy is unknown, or its templates are invalid
+func (c ProxyServerConfig) validateUnmatchedOriginPolicy() error {
+	switch c.UnmatchedOriginPolicy {
+	case "", uoDefault, uoNotFound, uoMisdirected:
+	case uoRedirect:
+		if c.UnmatchedOriginRedirectURL == "" {
+			return fmt.Errorf("unmatched_origin_redirect_url is required when unmatched_origin_policy is %q", uoRedirect)
+		}
+	default:
+		return fmt.Errorf("unknown unmatched_origin_policy %q", c.UnmatchedOriginPolicy)
+	}
+	_, _, err := c.unmatchedOriginTemplates()
+	return err
+}
+
+// withUnmatchedOriginPolicy wraps a handler so that requests naming no configured origin, by path, url param or
+// Host header, are handled according to the proxy server's unmatched origin policy rather than always being
+// passed to the default origin
+func (t *TricksterHandler) withUnmatchedOriginPolicy(next http.HandlerFunc) http.HandlerFunc {
+	c := t.Config.ProxyServer
+	if c.UnmatchedOriginPolicy == "" || c.UnmatchedOriginPolicy == uoDefault {
+		return next
+	}
+
+	// the templates were already validated with the rest of the configuration
+	body, redirect, _ := c.unmatchedOriginTemplates()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := getOriginName(r)
+		if _, ok := t.Config.Origins[name]; ok {
+			next(w, r)
+			return
+		}
+
+		level.Debug(t.Logger).Log(lfEvent, "request for unmatched origin", "origin", name, "path", r.URL.Path, "policy", c.UnmatchedOriginPolicy)
+
+		data := unmatchedOriginRequest{Origin: name, Host: r.Host, Path: r.URL.Path, Query: r.URL.RawQuery}
+		var buf bytes.Buffer
+
+		w.Header().Set(hnCacheControl, hvNoCache)
+		if c.UnmatchedOriginPolicy == uoRedirect {
+			if err := redirect.Execute(&buf, data); err != nil {
+				level.Error(t.Logger).Log(lfEvent, "error rendering unmatched origin redirect url", lfDetail, err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, buf.String(), http.StatusFound)
+			return
+		}
+
+		code := http.StatusNotFound
+		if c.UnmatchedOriginPolicy == uoMisdirected {
+			code = http.StatusMisdirectedRequest
+		}
+		if err := body.Execute(&buf, data); err != nil {
+			level.Error(t.Logger).Log(lfEvent, "error rendering unmatched origin body", lfDetail, err.Error())
+		}
+		w.Header().Set(hnContentType, hvTextPlain)
+		w.WriteHeader(code)
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,115 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGetOriginName(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	router := tr.newRouter()
+
+	tests := map[string]string{
+		"http://trickster/foo/api/v1/query?query=up":        "foo",
+		"http://trickster/api/v1/query?query=up&origin=bar": "bar",
+		"http://trickster/api/v1/query?query=up":            "trickster",
+	}
+
+	for u, want := range tests {
+		req := httptest.NewRequest("GET", u, nil)
+		var match mux.RouteMatch
+		router.Match(req, &match)
+		if got := getOriginName(mux.SetURLVars(req, match.Vars)); got != want {
+			t.Errorf("wanted %q got %q.", want, got)
+		}
+	}
+}
+
+func TestTricksterHandler_withUnmatchedOriginPolicy(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer("{}")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	tests := []struct {
+		policy   string
+		body     string
+		url      string
+		code     int
+		wantBody string
+		location string
+	}{
+		// it should proxy unmatched requests to the default origin by default
+		{"", "", "http://unknown/api/v1/labels", http.StatusOK, "{}", ""},
+		// it should serve requests for a configured origin under any policy
+		{uoNotFound, "", "http://trickster/default/api/v1/labels", http.StatusOK, "{}", ""},
+		{uoNotFound, "", "http://unknown/api/v1/labels", http.StatusNotFound, "no origin is configured for unknown\n", ""},
+		{uoMisdirected, "bad origin {{.Origin}} for {{.Path}}", "http://trickster/foo/api/v1/labels", http.StatusMisdirectedRequest, "bad origin foo for /foo/api/v1/labels", ""},
+		{uoRedirect, "", "http://unknown/api/v1/labels?a=b", http.StatusFound, "", "http://trickster/default{{.Path}}?{{.Query}}"},
+	}
+
+	for i, test := range tests {
+		tr.Config.ProxyServer.UnmatchedOriginPolicy = test.policy
+		tr.Config.ProxyServer.UnmatchedOriginBody = test.body
+		tr.Config.ProxyServer.UnmatchedOriginRedirectURL = test.location
+		router := tr.newRouter()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		resp := w.Result()
+		if resp.StatusCode != test.code {
+			t.Errorf("test %d: wanted %d got %d.", i, test.code, resp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if test.wantBody != "" && string(body) != test.wantBody {
+			t.Errorf("test %d: wanted %q got %q.", i, test.wantBody, body)
+		}
+		if test.policy == uoRedirect {
+			if l := resp.Header.Get("Location"); l != "http://trickster/default/api/v1/labels?a=b" {
+				t.Errorf("test %d: unexpected redirect %q", i, l)
+			}
+		}
+	}
+}
+
+func TestConfig_validate_unmatchedOriginPolicy(t *testing.T) {
+	c := NewConfig()
+	c.ProxyServer.UnmatchedOriginPolicy = "bogus"
+	if err := c.validate(); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+
+	c.ProxyServer.UnmatchedOriginPolicy = uoRedirect
+	if err := c.validate(); err == nil {
+		t.Errorf("expected an error for a redirect without a url")
+	}
+
+	c.ProxyServer.UnmatchedOriginRedirectURL = "http://trickster/{{.Path"
+	if err := c.validate(); err == nil {
+		t.Errorf("expected an error for an invalid template")
+	}
+
+	c.ProxyServer.UnmatchedOriginRedirectURL = "http://trickster/default{{.Path}}"
+	if err := c.validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,362 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	mnWrite = "write"
+	rnWrite = "write"
+
+	// crBypass is the cache lookup result of requests that are never cached, such as writes
+	crBypass = "bypass"
+
+	hnContentEncoding    = "Content-Encoding"
+	hnUserAgent          = "User-Agent"
+	hnRemoteWriteVersion = "X-Prometheus-Remote-Write-Version"
+)
+
+// writeHeaders are the client headers that describe the body of a write, and are always passed to the origin
+var writeHeaders = []string{hnContentType, hnContentEncoding, hnUserAgent, hnRemoteWriteVersion}
+
+// errMalformedWrite is returned for remote write bodies that are not a snappy-compressed WriteRequest protobuf
+var errMalformedWrite = errors.New("malformed remote write request")
+
+// promWriteHandler handles calls to /write (Prometheus remote write), which are proxied to the origin without caching.
+// When the origin enables write_invalidates_cache, cached data sets overlapping the written samples are then removed.
+func (t *TricksterHandler) promWriteHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	vars := mux.Vars(r)
+
+	// clear out the origin moniker from the front of the API path
+	if originName, ok := vars["originMoniker"]; ok {
+		if strings.HasPrefix(path, "/"+originName) {
+			path = strings.Replace(path, "/"+originName, "", 1)
+		}
+	}
+
+	origin := t.proxyOrigin(t.getOrigin(r))
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error reading write request", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t.MemoryLimiter.Add(mcBuffers, int64(len(reqBody)))
+	defer t.MemoryLimiter.Release(mcBuffers, int64(len(reqBody)))
+
+	originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
+	if len(r.URL.RawQuery) > 0 {
+		originURL += "?" + r.URL.RawQuery
+	}
+	u, err := url.Parse(originURL)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error parsing write url", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	headers := t.getProxyableClientHeaders(r)
+	for _, name := range writeHeaders {
+		if v := r.Header.Get(name); v != "" {
+			headers.Set(name, v)
+		}
+	}
+
+	// writes are not retried or hedged, since they are not idempotent in general
+	var body []byte
+	var resp *http.Response
+	timeout, err := origin.upstreamTimeout(requestDeadline(r))
+	if err == nil {
+		body, resp, err = t.doRequest(context.Background(), origin, r.Method, u, headers, reqBody, timeout)
+	}
+	if err != nil {
+		t.originLog(origin, level.Error, "error writing to origin Prometheus").Log(lfDetail, err.Error())
+		writeOriginError(w, r)
+		return
+	}
+	t.countCacheResult(origin.OriginURL, otPrometheus, rnWrite, crBypass, resp.StatusCode)
+
+	if origin.WriteInvalidatesCache && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if series, err := decodeRemoteWrite(reqBody); err != nil {
+			t.originLog(origin, level.Warn, "unable to decode write for cache invalidation").Log(lfDetail, err.Error())
+		} else {
+			t.queueWriteInvalidation(origin.apiURL(), series)
+		}
+	}
+
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+	copyResponseTrailers(w, resp.Trailer)
+}
+
+// writtenSeries is a series of a write, with the range of its samples' timestamps in milliseconds
+type writtenSeries struct {
+	labels       model.Metric
+	minTS, maxTS int64
+}
+
+// overlaps returns true if the cached series' labels are a subset of the written series' labels, as they are for raw
+// selectors and aggregations by some of its labels, and the written samples are not all after the cached points
+func (ws writtenSeries) overlaps(cached *model.SampleStream) bool {
+	if len(cached.Values) == 0 || ws.minTS > int64(cached.Values[len(cached.Values)-1].Timestamp) {
+		return false
+	}
+	for name, value := range cached.Metric {
+		if ws.labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// writeInvalidationQueue coalesces the series of writes awaiting cache invalidation by origin API URL, so that a
+// stream of writes results in a single walk of the cache at a time
+type writeInvalidationQueue struct {
+	mu      sync.Mutex
+	pending map[string]map[string]*writtenSeries
+	running bool
+}
+
+// queueWriteInvalidation queues the series written to the origin with the API URL for cache invalidation in the
+// background
+func (t *TricksterHandler) queueWriteInvalidation(origin string, series []writtenSeries) {
+	q := &t.writeInvalidations
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		q.pending = make(map[string]map[string]*writtenSeries)
+	}
+	pending, ok := q.pending[origin]
+	if !ok {
+		pending = make(map[string]*writtenSeries)
+		q.pending[origin] = pending
+	}
+	for i := range series {
+		s := series[i]
+		key := s.labels.String()
+		if p, ok := pending[key]; ok {
+			p.minTS, p.maxTS = min64(p.minTS, s.minTS), max64(p.maxTS, s.maxTS)
+			continue
+		}
+		pending[key] = &s
+	}
+	if !q.running {
+		q.running = true
+		go t.runWriteInvalidations()
+	}
+}
+
+// runWriteInvalidations invalidates the queued series until none remain
+func (t *TricksterHandler) runWriteInvalidations() {
+	q := &t.writeInvalidations
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		pending := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+
+		for origin, written := range pending {
+			series := make([]writtenSeries, 0, len(written))
+			for _, s := range written {
+				series = append(series, *s)
+			}
+			t.invalidateWrittenSeries(origin, series)
+		}
+	}
+}
+
+// invalidateWrittenSeries removes the cached query_range data sets of the origin with the API URL that have a series
+// overlapping the written series. The data sets are found by their .info records, so that no other record is read,
+// and data sets cached without one are not matched.
+func (t *TricksterHandler) invalidateWrittenSeries(origin string, series []writtenSeries) int {
+	// the records are read and deleted after the walk, since some caches hold a lock while walking
+	keys := []string{}
+	err := t.Cacher.Walk(func(o CacheObject) error {
+		if !strings.HasSuffix(o.Key, recordInfoSuffix) {
+			return nil
+		}
+		var info cacheRecordInfo
+		if json.Unmarshal([]byte(o.Value), &info) == nil && info.Origin == origin {
+			keys = append(keys, strings.TrimSuffix(o.Key, recordInfoSuffix))
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error walking cache for write invalidation", lfDetail, err.Error())
+	}
+
+	stale := 0
+	for _, key := range keys {
+		if !t.overlapsWrittenSeries(key, series) {
+			continue
+		}
+		if err := t.Cacher.Delete(key); err != nil {
+			level.Error(t.Logger).Log(lfEvent, "error deleting cache record", lfCacheKey, key, lfDetail, err.Error())
+			continue
+		}
+		t.Cacher.Delete(key + recordInfoSuffix)
+		stale++
+	}
+	t.Metrics.WriteInvalidatedRecords.Add(float64(stale))
+	level.Debug(t.Logger).Log(lfEvent, "invalidated cache records overlapping writes", "origin", origin, "series", len(series), "records", stale)
+	return stale
+}
+
+// overlapsWrittenSeries returns true if the cached query_range data set with the key has a series overlapping the
+// written series
+func (t *TricksterHandler) overlapsWrittenSeries(cacheKey string, series []writtenSeries) bool {
+	data, err := t.Cacher.Retrieve(cacheKey)
+	if err != nil {
+		return false
+	}
+	body, err := decompressCacheBody([]byte(data))
+	if err != nil {
+		return false
+	}
+	var pe PrometheusMatrixEnvelope
+	if parseMatrix(body, &pe) != nil {
+		return false
+	}
+	for _, stream := range pe.Data.Result {
+		for _, ws := range series {
+			if ws.overlaps(stream) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeRemoteWrite returns the series of a Prometheus remote write request: a snappy-compressed WriteRequest
+// protobuf, which is decoded by hand, as only its labels and sample timestamps are needed
+func decodeRemoteWrite(body []byte) ([]writtenSeries, error) {
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	series := []writtenSeries{}
+	// WriteRequest: repeated TimeSeries timeseries = 1
+	err = walkProtoFields(b, func(field int, data []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		ws := writtenSeries{labels: model.Metric{}, minTS: math.MaxInt64, maxTS: math.MinInt64}
+		// TimeSeries: repeated Label labels = 1; repeated Sample samples = 2
+		err := walkProtoFields(data, func(field int, data []byte, _ uint64) error {
+			switch field {
+			case 1:
+				// Label: string name = 1; string value = 2
+				var name, value string
+				err := walkProtoFields(data, func(field int, data []byte, _ uint64) error {
+					switch field {
+					case 1:
+						name = string(data)
+					case 2:
+						value = string(data)
+					}
+					return nil
+				})
+				ws.labels[model.LabelName(name)] = model.LabelValue(value)
+				return err
+			case 2:
+				// Sample: double value = 1; int64 timestamp = 2
+				return walkProtoFields(data, func(field int, _ []byte, v uint64) error {
+					if field == 2 {
+						ts := int64(v)
+						ws.minTS, ws.maxTS = min64(ws.minTS, ts), max64(ws.maxTS, ts)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if ws.minTS <= ws.maxTS {
+			series = append(series, ws)
+		}
+		return nil
+	})
+	return series, err
+}
+
+// walkProtoFields calls fn with the field number and the value of each field of the protobuf message: the data of
+// length-delimited fields, or the number of varint and fixed-width fields
+func walkProtoFields(b []byte, fn func(field int, data []byte, v uint64) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformedWrite
+		}
+		b = b[n:]
+
+		var data []byte
+		var v uint64
+		switch key & 7 {
+		case 0: // varint
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errMalformedWrite
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errMalformedWrite
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errMalformedWrite
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errMalformedWrite
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return errMalformedWrite
+		}
+
+		if err := fn(int(key>>3), data, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
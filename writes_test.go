@@ -0,0 +1,218 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+// appendUvarint appends a protobuf varint
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// appendProtoBytes appends a length-delimited protobuf field
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field<<3|2))
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// newTestRemoteWrite returns a remote write body with a series of the labels and a sample at each timestamp
+func newTestRemoteWrite(labels map[string]string, timestamps ...int64) []byte {
+	var ts []byte
+	for name, value := range labels {
+		var l []byte
+		l = appendProtoBytes(l, 1, []byte(name))
+		l = appendProtoBytes(l, 2, []byte(value))
+		ts = appendProtoBytes(ts, 1, l)
+	}
+	for _, t := range timestamps {
+		s := appendUvarint(nil, 1<<3|1)
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, math.Float64bits(1))
+		s = append(s, value...)
+		s = appendUvarint(s, 2<<3|0)
+		s = appendUvarint(s, uint64(t))
+		ts = appendProtoBytes(ts, 2, s)
+	}
+	return snappy.Encode(nil, appendProtoBytes(nil, 1, ts))
+}
+
+func TestDecodeRemoteWrite(t *testing.T) {
+	series, err := decodeRemoteWrite(newTestRemoteWrite(map[string]string{"__name__": "up", "job": "node"}, 1435781460000, 1435781445000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should decode the labels and the range of the timestamps
+	if len(series) != 1 {
+		t.Fatalf("wanted %d got %d.", 1, len(series))
+	}
+	if !series[0].labels.Equal(model.Metric{"__name__": "up", "job": "node"}) {
+		t.Errorf("unexpected labels %v", series[0].labels)
+	}
+	if series[0].minTS != 1435781445000 || series[0].maxTS != 1435781460000 {
+		t.Errorf("unexpected timestamps %d %d", series[0].minTS, series[0].maxTS)
+	}
+
+	// it should reject bodies that are not snappy-compressed protobufs
+	if _, err := decodeRemoteWrite([]byte("not a write")); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := decodeRemoteWrite(snappy.Encode(nil, []byte{0x0a, 0x05, 0x01})); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestWrittenSeries_overlaps(t *testing.T) {
+	cached := &model.SampleStream{
+		Metric: model.Metric{"__name__": "up", "job": "node"},
+		Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 1}},
+	}
+	tests := []struct {
+		labels   model.Metric
+		minTS    int64
+		overlaps bool
+	}{
+		{model.Metric{"__name__": "up", "job": "node"}, 1500, true},
+		{model.Metric{"__name__": "up", "job": "node", "instance": "a"}, 500, true},
+		{model.Metric{"__name__": "up", "job": "node"}, 2001, false},
+		{model.Metric{"__name__": "up", "job": "prometheus"}, 1500, false},
+		{model.Metric{"job": "node"}, 1500, false},
+	}
+
+	for i, test := range tests {
+		ws := writtenSeries{labels: test.labels, minTS: test.minTS, maxTS: test.minTS}
+		if ws.overlaps(cached) != test.overlaps {
+			t.Errorf("test %d: unexpected result %v", i, !test.overlaps)
+		}
+	}
+}
+
+func TestTricksterHandler_promWriteHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	write := newTestRemoteWrite(map[string]string{"__name__": "up", "job": "prometheus", "instance": "localhost:9090"}, 1435781445000)
+	var received []byte
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/write" || r.Header.Get(hnContentEncoding) != "snappy" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+	router := tr.newRouter()
+
+	if err := tr.Cacher.Store("writeTestKey", exampleRangeResponse, 60); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Cacher.Delete("writeTestKey")
+	tr.storeRecordInfo("writeTestKey", cacheRecordInfo{Origin: tr.Config.Origins["default"].apiURL(), Query: "up"}, 60)
+
+	post := func() int {
+		r := httptest.NewRequest(http.MethodPost, "http://trickster/api/v1/write", bytes.NewReader(write))
+		r.Header.Set(hnContentEncoding, "snappy")
+		r.Header.Set(hnContentType, "application/x-protobuf")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// it should proxy the write to the origin, leaving the cache alone by default
+	if code := post(); code != http.StatusNoContent {
+		t.Errorf("wanted %d got %d.", http.StatusNoContent, code)
+	}
+	if !bytes.Equal(received, write) {
+		t.Errorf("unexpected body %q", received)
+	}
+	if _, err := tr.Cacher.Retrieve("writeTestKey"); err != nil {
+		t.Error(err)
+	}
+
+	// it should invalidate overlapping cached data sets when the origin enables it
+	o := tr.Config.Origins["default"]
+	o.WriteInvalidatesCache = true
+	tr.Config.Origins["default"] = o
+	if code := post(); code != http.StatusNoContent {
+		t.Errorf("wanted %d got %d.", http.StatusNoContent, code)
+	}
+	for i := 0; i < 100 && testutil.ToFloat64(tr.Metrics.WriteInvalidatedRecords) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := tr.Cacher.Retrieve("writeTestKey"); err == nil {
+		t.Errorf("expected a cache miss")
+	}
+	if v := testutil.ToFloat64(tr.Metrics.WriteInvalidatedRecords); v != 1 {
+		t.Errorf("wanted %d got %v.", 1, v)
+	}
+}
+
+func TestTricksterHandler_invalidateWrittenSeries(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	origin := "http://origin/api/v1/"
+	for key, info := range map[string]*cacheRecordInfo{
+		"writeTestKey":      {Origin: origin, Query: "up"},
+		"writeTestOtherKey": {Origin: "http://other/api/v1/", Query: "up"},
+		"writeTestNoInfo":   nil,
+	} {
+		if err := tr.Cacher.Store(key, exampleRangeResponse, 60); err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Cacher.Delete(key)
+		if info != nil {
+			tr.storeRecordInfo(key, *info, 60)
+			defer tr.Cacher.Delete(key + recordInfoSuffix)
+		}
+	}
+
+	// it should keep data sets whose series end before the written samples
+	later := writtenSeries{labels: model.Metric{"__name__": "up", "job": "node", "instance": "localhost:9091"}, minTS: 1435781475000, maxTS: 1435781475000}
+	if n := tr.invalidateWrittenSeries(origin, []writtenSeries{later}); n != 0 {
+		t.Errorf("wanted %d got %d.", 0, n)
+	}
+
+	// it should remove the origin's query_range data sets with an overlapping series, and leave other records alone
+	earlier := later
+	earlier.minTS = 1435781430000
+	if n := tr.invalidateWrittenSeries(origin, []writtenSeries{earlier}); n != 1 {
+		t.Errorf("wanted %d got %d.", 1, n)
+	}
+	if _, err := tr.Cacher.Retrieve("writeTestKey" + recordInfoSuffix); err == nil {
+		t.Errorf("expected a cache miss")
+	}
+	for _, key := range []string{"writeTestOtherKey", "writeTestNoInfo"} {
+		if _, err := tr.Cacher.Retrieve(key); err != nil {
+			t.Error(err)
+		}
+	}
+}